@@ -0,0 +1,164 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// blobFilePerms are the permissions of blobs written by EncryptToFile.
+const blobFilePerms os.FileMode = 0644
+
+// renameFile moves the temporary file written by EncryptToFile into place.
+// It is a variable so that tests can simulate failures.
+var renameFile = os.Rename
+
+// EncryptToFile is like Encrypt, but writes the blob to the file at
+// `outputPath`, replacing any existing file, in a crash-consistent way.
+//
+// The blob is first written to a temporary file in the same directory, which
+// is synced and then atomically renamed to `outputPath` only once encryption
+// has fully succeeded, so that a failure or crash never leaves a truncated
+// blob at `outputPath`. On error, the temporary file is removed.
+//
+// If the temporary file cannot be renamed because it is on a different
+// filesystem from `outputPath` (for example, if `outputPath` is a bind mount),
+// the blob is instead copied to `outputPath` and synced. This is not atomic,
+// but a partially copied blob is removed.
+func (c *StetClient) EncryptToFile(ctx context.Context, input io.Reader, outputPath string, stetConfig *configpb.StetConfig, blobID string, opts ...CallOption) (*StetMetadata, error) {
+	if outputPath == "" {
+		return nil, fmt.Errorf("no output file path passed to EncryptToFile()")
+	}
+
+	dir := filepath.Dir(outputPath)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(outputPath)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file in %v: %v", dir, err)
+	}
+
+	md, err := c.encryptToTempFile(ctx, input, tmp, stetConfig, blobID, opts)
+	if err == nil {
+		err = commitFile(c.logger(ctx), tmp.Name(), outputPath)
+	}
+	if err != nil {
+		tmp.Close()
+		if rmErr := os.Remove(tmp.Name()); rmErr != nil && !os.IsNotExist(rmErr) {
+			c.logger(ctx).Warningf("Failed to remove temporary file %v: %v", tmp.Name(), rmErr)
+		}
+		return nil, err
+	}
+
+	return md, nil
+}
+
+// encryptToTempFile encrypts `input` to `tmp`, then syncs and closes it.
+func (c *StetClient) encryptToTempFile(ctx context.Context, input io.Reader, tmp *os.File, stetConfig *configpb.StetConfig, blobID string, opts []CallOption) (*StetMetadata, error) {
+	if err := tmp.Chmod(blobFilePerms); err != nil {
+		return nil, fmt.Errorf("error setting permissions of temporary file: %v", err)
+	}
+
+	md, err := c.Encrypt(ctx, input, tmp, stetConfig, blobID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return nil, fmt.Errorf("error syncing temporary file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("error closing temporary file: %v", err)
+	}
+
+	return md, nil
+}
+
+// commitFile moves the synced file at `tmpPath` to `outputPath`, renaming it
+// if possible and otherwise copying it across filesystems.
+func commitFile(logger Logger, tmpPath, outputPath string) error {
+	err := renameFile(tmpPath, outputPath)
+	if err == nil {
+		// Sync the directory so that the rename itself is durable.
+		return syncDir(filepath.Dir(outputPath))
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("error renaming temporary file to %v: %v", outputPath, err)
+	}
+
+	logger.Warningf("Temporary file %v is on a different filesystem from %v, copying it instead", tmpPath, outputPath)
+	if err := copyFile(tmpPath, outputPath); err != nil {
+		if rmErr := os.Remove(outputPath); rmErr != nil && !os.IsNotExist(rmErr) {
+			logger.Warningf("Failed to remove partially copied file %v: %v", outputPath, rmErr)
+		}
+		return fmt.Errorf("error copying temporary file to %v: %v", outputPath, err)
+	}
+
+	return os.Remove(tmpPath)
+}
+
+// copyFile copies the file at `src` to `dst`, syncing it before returning.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, blobFilePerms)
+	if err != nil {
+		return err
+	}
+
+	// Match the permissions a rename would have given an existing file.
+	if err := out.Chmod(blobFilePerms); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(dst))
+}
+
+// syncDir syncs the directory at `dir`, making changes to its entries durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening directory %v: %v", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory %v: %v", dir, err)
+	}
+
+	return nil
+}
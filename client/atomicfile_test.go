@@ -0,0 +1,143 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"testing/iotest"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+)
+
+func TestEncryptToFile(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+	existing := []byte("This is the blob being replaced.")
+
+	errRename := errors.New("crashed before rename")
+
+	testcases := []struct {
+		name    string
+		input   io.Reader
+		rename  func(oldpath, newpath string) error
+		wantErr bool
+	}{
+		{
+			name:   "Renamed into place",
+			input:  bytes.NewReader(plaintext),
+			rename: os.Rename,
+		},
+		{
+			name:  "Copied across filesystems",
+			input: bytes.NewReader(plaintext),
+			rename: func(oldpath, newpath string) error {
+				return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+			},
+		},
+		{
+			name:    "Encryption fails",
+			input:   io.MultiReader(bytes.NewReader(plaintext), iotest.ErrReader(errors.New("read failed"))),
+			rename:  os.Rename,
+			wantErr: true,
+		},
+		{
+			name:  "Failure before rename",
+			input: bytes.NewReader(plaintext),
+			rename: func(string, string) error {
+				return errRename
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			oldRename := renameFile
+			renameFile = tc.rename
+			t.Cleanup(func() { renameFile = oldRename })
+
+			dir := t.TempDir()
+			outputPath := filepath.Join(dir, "blob.stet")
+			if err := os.WriteFile(outputPath, existing, 0600); err != nil {
+				t.Fatalf("WriteFile returned error: %v", err)
+			}
+
+			md, err := stetClient.EncryptToFile(ctx, tc.input, outputPath, stetConfig, "blob")
+
+			// No temporary file is left behind either way.
+			entries, readErr := os.ReadDir(dir)
+			if readErr != nil {
+				t.Fatalf("ReadDir returned error: %v", readErr)
+			}
+			if len(entries) != 1 || entries[0].Name() != "blob.stet" {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("Directory contains %v after EncryptToFile, want only blob.stet", names)
+			}
+
+			blob, readErr := os.ReadFile(outputPath)
+			if readErr != nil {
+				t.Fatalf("ReadFile returned error: %v", readErr)
+			}
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("EncryptToFile succeeded, want error")
+				}
+				if md != nil {
+					t.Errorf("EncryptToFile returned metadata %v on error, want nil", md)
+				}
+				if !bytes.Equal(blob, existing) {
+					t.Error("EncryptToFile modified the existing file on error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("EncryptToFile returned error: %v", err)
+			}
+			if md.BlobID != "blob" {
+				t.Errorf("EncryptToFile returned metadata with blob ID %q, want %q", md.BlobID, "blob")
+			}
+
+			info, err := os.Stat(outputPath)
+			if err != nil {
+				t.Fatalf("Stat returned error: %v", err)
+			}
+			if info.Mode().Perm() != blobFilePerms {
+				t.Errorf("Blob has permissions %v, want %v", info.Mode().Perm(), blobFilePerms)
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob), &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
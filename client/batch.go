@@ -0,0 +1,105 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// BatchItem is a single plaintext to encrypt with EncryptBatch.
+type BatchItem struct {
+	// BlobID identifies the item, and is used as the blob ID of its encrypted
+	// blob. If empty, EncryptBatch assigns a random blob ID before encrypting
+	// any item. To resume a failed batch, retry with the same blob IDs.
+	BlobID string
+	Input  io.Reader
+	Output io.Writer
+}
+
+// BatchResult is the outcome of encrypting a single BatchItem.
+type BatchResult struct {
+	BlobID string
+	// Metadata is set if the item was encrypted successfully.
+	Metadata *StetMetadata
+	// Skipped is set if the item was skipped by WithCompletedBlobIDs or
+	// WithBatchFilter.
+	Skipped bool
+	Err     error
+}
+
+// EncryptBatch encrypts each of the given items in order, as with Encrypt, or
+// concurrently if WithBatchConcurrency is given. The items share Cloud KMS
+// clients. A failed item does not stop the batch; the returned results, in the same
+// order as `items`, report the outcome of each, and the returned error is
+// non-nil if any item failed.
+//
+// Empty blob IDs in `items` are filled in place before any item is encrypted,
+// so that callers can record the identity of each item. Items can then be
+// skipped on retry with WithCompletedBlobIDs or WithBatchFilter. Blob IDs must
+// be unique within the batch. If the client's RequireBlobID is set, an empty
+// blob ID fails the whole batch instead.
+func (c *StetClient) EncryptBatch(ctx context.Context, items []BatchItem, stetConfig *configpb.StetConfig, opts ...CallOption) ([]BatchResult, error) {
+	callOpts := c.newCallOptions(opts)
+
+	seen := make(map[string]bool)
+	for i := range items {
+		blobID, err := c.newBlobID(items[i].BlobID)
+		if err != nil {
+			return nil, fmt.Errorf("batch item %v: %w", i, err)
+		}
+		items[i].BlobID = blobID
+
+		if seen[items[i].BlobID] {
+			return nil, fmt.Errorf("duplicate blob ID %q in batch", items[i].BlobID)
+		}
+		seen[items[i].BlobID] = true
+	}
+
+	// Share one Cloud KMS client factory across the batch, so that items
+	// reuse the same clients even when they would otherwise be per call.
+	kmsClients, release := c.kmsClientFactory(ctx)
+	defer release()
+	itemOpts := append(opts[:len(opts):len(opts)], withKMSClients(kmsClients))
+
+	results := make([]BatchResult, len(items))
+	forEachShare(len(items), callOpts.batchConcurrency, func(i int) {
+		item := items[i]
+		results[i].BlobID = item.BlobID
+
+		if callOpts.completedBlobIDs[item.BlobID] || (callOpts.batchFilter != nil && !callOpts.batchFilter(item.BlobID)) {
+			results[i].Skipped = true
+			return
+		}
+
+		results[i].Metadata, results[i].Err = c.Encrypt(ctx, item.Input, item.Output, stetConfig, item.BlobID, itemOpts...)
+	})
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("failed to encrypt %v of %v items in batch", failed, len(items))
+	}
+
+	return results, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	kmsspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"github.com/google/go-cmp/cmp"
+	gax "github.com/googleapis/gax-go/v2"
+)
+
+// failingWriter is an io.Writer that always returns an error.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func newBatchItems(outputs []*bytes.Buffer, failing int) []BatchItem {
+	items := make([]BatchItem, len(outputs))
+	for i := range items {
+		items[i] = BatchItem{Input: bytes.NewReader([]byte("plaintext")), Output: outputs[i]}
+		if i == failing {
+			items[i].Output = failingWriter{}
+		}
+	}
+	return items
+}
+
+func TestEncryptBatchResume(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	outputs := []*bytes.Buffer{{}, {}, {}}
+	items := newBatchItems(outputs, 1)
+
+	results, err := stetClient.EncryptBatch(ctx, items, stetConfig)
+	if err == nil {
+		t.Fatal("EncryptBatch succeeded with a failing item, want error")
+	}
+
+	var completed, remaining []string
+	for i, result := range results {
+		if result.BlobID == "" || result.BlobID != items[i].BlobID {
+			t.Errorf("results[%v].BlobID = %q, want assigned blob ID %q", i, result.BlobID, items[i].BlobID)
+		}
+		if result.Err == nil {
+			completed = append(completed, result.BlobID)
+		} else {
+			remaining = append(remaining, result.BlobID)
+		}
+	}
+
+	if diff := cmp.Diff([]string{items[1].BlobID}, remaining); diff != "" {
+		t.Fatalf("EncryptBatch failed items diff (-want +got):\n%s", diff)
+	}
+
+	testcases := []struct {
+		name string
+		opt  CallOption
+	}{
+		{
+			name: "Completed blob IDs",
+			opt:  WithCompletedBlobIDs(completed...),
+		},
+		{
+			name: "Batch filter",
+			opt: WithBatchFilter(func(blobID string) bool {
+				return blobID == remaining[0]
+			}),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			retryOutputs := []*bytes.Buffer{{}, {}, {}}
+			retryItems := newBatchItems(retryOutputs, -1)
+			for i := range retryItems {
+				retryItems[i].BlobID = items[i].BlobID
+			}
+
+			results, err := stetClient.EncryptBatch(ctx, retryItems, stetConfig, tc.opt)
+			if err != nil {
+				t.Fatalf("EncryptBatch returned error on retry: %v", err)
+			}
+
+			for i, result := range results {
+				wantSkipped := i != 1
+				if result.Skipped != wantSkipped {
+					t.Errorf("results[%v].Skipped = %v, want %v", i, result.Skipped, wantSkipped)
+				}
+				if wantSkipped && retryOutputs[i].Len() != 0 {
+					t.Errorf("EncryptBatch wrote output for skipped item %v", i)
+				}
+			}
+
+			var plaintext bytes.Buffer
+			md, err := stetClient.Decrypt(ctx, retryOutputs[1], &plaintext, stetConfig)
+			if err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if md.BlobID != items[1].BlobID {
+				t.Errorf("Decrypt returned blob ID %q, want %q", md.BlobID, items[1].BlobID)
+			}
+		})
+	}
+}
+
+func TestEncryptBatchDuplicateBlobIDs(t *testing.T) {
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	outputs := []*bytes.Buffer{{}, {}}
+	items := newBatchItems(outputs, -1)
+	items[0].BlobID = "blob"
+	items[1].BlobID = "blob"
+
+	if _, err := stetClient.EncryptBatch(context.Background(), items, newFakeKMSConfig(1)); err == nil {
+		t.Fatal("EncryptBatch succeeded with duplicate blob IDs, want error")
+	}
+
+	for i, output := range outputs {
+		if output.Len() != 0 {
+			t.Errorf("EncryptBatch wrote output for item %v despite duplicate blob IDs", i)
+		}
+	}
+}
+
+// inFlightKMS is a FakeKMS that records the maximum number of concurrent
+// Encrypt calls.
+type inFlightKMS struct {
+	*stettest.FakeKMS
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (k *inFlightKMS) Encrypt(ctx context.Context, req *kmsspb.EncryptRequest, opts ...gax.CallOption) (*kmsspb.EncryptResponse, error) {
+	k.mu.Lock()
+	k.inFlight++
+	if k.inFlight > k.maxInFlight {
+		k.maxInFlight = k.inFlight
+	}
+	k.mu.Unlock()
+
+	defer func() {
+		k.mu.Lock()
+		k.inFlight--
+		k.mu.Unlock()
+	}()
+
+	return k.FakeKMS.Encrypt(ctx, req, opts...)
+}
+
+func TestEncryptBatchConcurrency(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(2)
+
+	testcases := []struct {
+		name            string
+		limit           int
+		wantMaxInFlight int
+	}{
+		{
+			name:            "Sequential",
+			limit:           0,
+			wantMaxInFlight: 1,
+		},
+		{
+			name:            "Concurrent",
+			limit:           3,
+			wantMaxInFlight: 3,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeKMS := &inFlightKMS{FakeKMS: &stettest.FakeKMS{Latency: 10 * time.Millisecond}}
+			stetClient := &StetClient{KMSClient: fakeKMS}
+
+			outputs := make([]*bytes.Buffer, 6)
+			for i := range outputs {
+				outputs[i] = &bytes.Buffer{}
+			}
+			items := newBatchItems(outputs, 4)
+
+			results, err := stetClient.EncryptBatch(ctx, items, stetConfig, WithBatchConcurrency(tc.limit))
+			if err == nil {
+				t.Fatal("EncryptBatch succeeded with a failing item, want error")
+			}
+
+			// Shares of each item are wrapped sequentially, so only items run
+			// concurrently.
+			if fakeKMS.maxInFlight != tc.wantMaxInFlight {
+				t.Errorf("EncryptBatch made up to %v concurrent Encrypt calls, want %v", fakeKMS.maxInFlight, tc.wantMaxInFlight)
+			}
+
+			for i, result := range results {
+				if i == 4 {
+					if result.Err == nil {
+						t.Errorf("results[%v].Err = nil, want error", i)
+					}
+					continue
+				}
+
+				var plaintext bytes.Buffer
+				md, err := stetClient.Decrypt(ctx, outputs[i], &plaintext, stetConfig)
+				if err != nil {
+					t.Fatalf("Decrypt of item %v returned error: %v", i, err)
+				}
+
+				if md.BlobID != items[i].BlobID {
+					t.Errorf("Decrypt of item %v returned blob ID %q, want %q", i, md.BlobID, items[i].BlobID)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncryptBatch(b *testing.B) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(2)
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{Latency: time.Millisecond}}
+
+	for _, limit := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("Concurrency %d", limit), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				outputs := make([]*bytes.Buffer, 32)
+				for j := range outputs {
+					outputs[j] = &bytes.Buffer{}
+				}
+
+				if _, err := stetClient.EncryptBatch(ctx, newBatchItems(outputs, -1), stetConfig, WithBatchConcurrency(limit)); err != nil {
+					b.Fatalf("EncryptBatch returned error: %v", err)
+				}
+			}
+		})
+	}
+}
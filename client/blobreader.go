@@ -0,0 +1,163 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// BlobReader decrypts byte ranges of a STET-encrypted blob read through an
+// io.ReaderAt, such as an object in cloud storage. It is created by OpenBlob.
+//
+// The metadata is parsed and the DEK recovered once, when the BlobReader is
+// opened; both are then shared read-only. DecryptRange is therefore safe to
+// call concurrently, and each call independently authenticates every
+// ciphertext segment it reads.
+type BlobReader struct {
+	ciphertext io.ReaderAt
+	cipher     *segmentCipher
+	metadata   *StetMetadata
+}
+
+// OpenBlob parses the metadata of the `size`-byte STET-encrypted blob in
+// `input` and recovers its DEK, returning a BlobReader for decrypting ranges
+// of its plaintext.
+func (c *StetClient) OpenBlob(ctx context.Context, input io.ReaderAt, size int64, stetConfig *configpb.StetConfig, opts ...CallOption) (*BlobReader, error) {
+	callOpts := c.newCallOptions(opts)
+
+	section := io.NewSectionReader(input, 0, size)
+	metadata, err := ReadMetadata(section)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	ciphertextStart, err := section.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("error finding start of ciphertext: %v", err)
+	}
+	ciphertextLength := size - ciphertextStart
+
+	segmentSize, err := metadataSegmentSize(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	combinedDEK, unwrappedShares, err := c.recoverDEK(ctx, metadata, stetConfig, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := MetadataToAAD(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing metadata: %v", err)
+	}
+
+	// Segments are authenticated individually, so only the manifest's MAC and
+	// ciphertext length are checked, not its frame hashes.
+	if manifest := metadata.GetIntegrityManifest(); manifest != nil {
+		if err := checkManifestMAC(combinedDEK, metadata.GetBlobId(), manifest); err != nil {
+			return nil, err
+		}
+
+		if manifest.GetCiphertextLength() != ciphertextLength {
+			return nil, fmt.Errorf("ciphertext length is %v bytes, want %v bytes", ciphertextLength, manifest.GetCiphertextLength())
+		}
+	}
+
+	ciphertext := io.NewSectionReader(input, ciphertextStart, ciphertextLength)
+	cipher, err := newSegmentCipher(combinedDEK, aad, segmentSize, ciphertext, ciphertextLength)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ciphertext: %v", err)
+	}
+
+	var keyURIs []string
+	for _, unwrapped := range unwrappedShares {
+		if unwrapped.URI != "" {
+			keyURIs = append(keyURIs, unwrapped.URI)
+		}
+	}
+
+	return &BlobReader{
+		ciphertext: ciphertext,
+		cipher:     cipher,
+		metadata: &StetMetadata{
+			KeyUris: keyURIs,
+			BlobID:  metadata.GetBlobId(),
+		},
+	}, nil
+}
+
+// Metadata returns the blob ID and the URIs of the keys used to recover the
+// DEK. The caller must not modify it.
+func (b *BlobReader) Metadata() *StetMetadata {
+	return b.metadata
+}
+
+// Size returns the length of the blob's plaintext.
+func (b *BlobReader) Size() int64 {
+	return b.cipher.plaintextLength()
+}
+
+// DecryptRange decrypts `length` bytes of the blob's plaintext starting at
+// `offset`, writing them to `output`. Only the ciphertext segments covering
+// the range are read, and each is authenticated before its plaintext is
+// written, so decryption stops at the first segment that fails
+// authentication.
+func (b *BlobReader) DecryptRange(offset, length int64, output io.Writer) error {
+	if offset < 0 || length < 0 || offset+length > b.Size() {
+		return fmt.Errorf("range [%v, %v) is out of bounds for plaintext of %v bytes", offset, offset+length, b.Size())
+	}
+
+	for i := b.cipher.segmentAt(offset); length > 0; i++ {
+		plaintext, err := b.cipher.decryptSegment(b.ciphertext, i)
+		if err != nil {
+			return fmt.Errorf("error decrypting data: %v", err)
+		}
+
+		plaintext = plaintext[offset-b.cipher.plaintextStart(i):]
+		if int64(len(plaintext)) > length {
+			plaintext = plaintext[:length]
+		}
+
+		if _, err := output.Write(plaintext); err != nil {
+			return fmt.Errorf("failed to write plaintext: %v", err)
+		}
+
+		offset += int64(len(plaintext))
+		length -= int64(len(plaintext))
+	}
+
+	return nil
+}
+
+// DecryptRange is a shorthand for OpenBlob followed by a single call to
+// DecryptRange on the returned BlobReader. To decrypt several ranges of the
+// same blob, use OpenBlob, so that the DEK is only recovered once.
+func (c *StetClient) DecryptRange(ctx context.Context, input io.ReaderAt, size, offset, length int64, output io.Writer, stetConfig *configpb.StetConfig, opts ...CallOption) (*StetMetadata, error) {
+	blob, err := c.OpenBlob(ctx, input, size, stetConfig, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := blob.DecryptRange(offset, length, output); err != nil {
+		return nil, err
+	}
+
+	return blob.Metadata(), nil
+}
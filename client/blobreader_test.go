@@ -0,0 +1,257 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/tink/go/subtle/random"
+)
+
+// encryptBlob encrypts `plaintext` with `opts`, returning the STET blob.
+func encryptBlob(t *testing.T, stetClient *StetClient, plaintext []byte, opts ...CallOption) []byte {
+	t.Helper()
+
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(context.Background(), bytes.NewReader(plaintext), &blob, newFakeKMSConfig(1), "", opts...); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	return blob.Bytes()
+}
+
+func TestDecryptRange(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	firstSegment := aeadFirstSegmentSize - aeadTagSize
+	segment := int64(aeadSegmentSize - aeadTagSize)
+
+	testcases := []struct {
+		name          string
+		plaintextSize int64
+		offset        int64
+		length        int64
+	}{
+		{name: "Whole single segment", plaintextSize: 1000, offset: 0, length: 1000},
+		{name: "Middle of single segment", plaintextSize: 1000, offset: 10, length: 100},
+		{name: "Empty plaintext", plaintextSize: 0, offset: 0, length: 0},
+		{name: "Exactly one full segment", plaintextSize: firstSegment, offset: firstSegment - 10, length: 10},
+		{name: "Across first boundary", plaintextSize: 2*segment + 1000, offset: firstSegment - 10, length: 20},
+		{name: "Inside later segment", plaintextSize: 2*segment + 1000, offset: firstSegment + 100, length: 100},
+		{name: "Starting on boundary", plaintextSize: 2*segment + 1000, offset: firstSegment + segment, length: 1000},
+		{name: "Tail", plaintextSize: 2*segment + 1000, offset: 2*segment + 900, length: 100},
+		{name: "Whole blob", plaintextSize: 2*segment + 1000, offset: 0, length: 2*segment + 1000},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext := random.GetRandomBytes(uint32(tc.plaintextSize))
+			blob := encryptBlob(t, stetClient, plaintext)
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptRange(ctx, bytes.NewReader(blob), int64(len(blob)), tc.offset, tc.length, &output, stetConfig); err != nil {
+				t.Fatalf("DecryptRange(%v, %v) returned error: %v", tc.offset, tc.length, err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext[tc.offset:tc.offset+tc.length]) {
+				t.Errorf("DecryptRange(%v, %v) returned wrong plaintext", tc.offset, tc.length)
+			}
+		})
+	}
+}
+
+func TestDecryptRangeErrors(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	plaintext := make([]byte, 2*aeadSegmentSize)
+	blob := encryptBlob(t, stetClient, plaintext)
+	size := int64(len(blob))
+
+	// Corrupt a byte in the second of three segments.
+	corrupted := append([]byte{}, blob...)
+	corrupted[size-1000] ^= 1
+
+	manifestBlob := encryptBlob(t, stetClient, plaintext, WithIntegrityManifest())
+
+	testcases := []struct {
+		name   string
+		blob   []byte
+		size   int64
+		offset int64
+		length int64
+	}{
+		{name: "Negative offset", blob: blob, size: size, offset: -1, length: 10},
+		{name: "Past end", blob: blob, size: size, offset: int64(len(plaintext)) - 5, length: 10},
+		{name: "Truncated blob", blob: blob, size: size - 1, offset: int64(len(plaintext)) - 11, length: 10},
+		{name: "Corrupted segment", blob: corrupted, size: size, offset: aeadSegmentSize, length: 10},
+		{name: "Truncated blob with manifest", blob: manifestBlob, size: int64(len(manifestBlob)) - aeadSegmentSize, offset: 0, length: 10},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptRange(ctx, bytes.NewReader(tc.blob), tc.size, tc.offset, tc.length, &output, stetConfig); err == nil {
+				t.Errorf("DecryptRange(%v, %v) succeeded, want error", tc.offset, tc.length)
+			}
+		})
+	}
+
+	t.Run("Range before corrupted segment", func(t *testing.T) {
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptRange(ctx, bytes.NewReader(corrupted), size, 0, 10, &output, stetConfig); err != nil {
+			t.Errorf("DecryptRange of an intact segment returned error: %v", err)
+		}
+	})
+}
+
+func TestBlobReaderConcurrentRanges(t *testing.T) {
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	plaintext := random.GetRandomBytes(4*aeadSegmentSize + 12345)
+	blob := encryptBlob(t, stetClient, plaintext)
+
+	reader, err := stetClient.OpenBlob(context.Background(), bytes.NewReader(blob), int64(len(blob)), newFakeKMSConfig(1))
+	if err != nil {
+		t.Fatalf("OpenBlob returned error: %v", err)
+	}
+
+	if reader.Size() != int64(len(plaintext)) {
+		t.Fatalf("Size() = %v, want %v", reader.Size(), len(plaintext))
+	}
+
+	const ranges = 16
+	rangeSize := reader.Size() / ranges
+
+	var wg sync.WaitGroup
+	errs := make([]error, ranges)
+	for i := 0; i < ranges; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			offset := int64(i) * rangeSize
+			var output bytes.Buffer
+			if err := reader.DecryptRange(offset, rangeSize, &output); err != nil {
+				errs[i] = err
+				return
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext[offset:offset+rangeSize]) {
+				errs[i] = fmt.Errorf("wrong plaintext for range starting at %v", offset)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("DecryptRange for range %v: %v", i, err)
+		}
+	}
+}
+
+func TestSegmentSize(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	const segmentSize = aeadMinSegmentSize
+	plaintext := random.GetRandomBytes(5*segmentSize + 123)
+
+	var metadata, ciphertext bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadata, &ciphertext, stetConfig, "", WithSegmentSize(segmentSize), WithIntegrityManifest()); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	md, err := ReadMetadata(bytes.NewReader(metadata.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	if md.GetSegmentSize() != segmentSize {
+		t.Errorf("Metadata has segment size %v, want %v", md.GetSegmentSize(), segmentSize)
+	}
+
+	if md.GetIntegrityManifest().GetFrameSize() != segmentSize {
+		t.Errorf("Integrity manifest has frame size %v, want %v", md.GetIntegrityManifest().GetFrameSize(), segmentSize)
+	}
+
+	t.Run("Decrypt", func(t *testing.T) {
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata.Bytes()), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err != nil {
+			t.Fatalf("DecryptWithSidecar returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Error("DecryptWithSidecar returned wrong plaintext")
+		}
+	})
+
+	t.Run("DecryptRange", func(t *testing.T) {
+		blob := append(append([]byte{}, metadata.Bytes()...), ciphertext.Bytes()...)
+		offset, length := int64(2*segmentSize-100), int64(segmentSize+200)
+
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptRange(ctx, bytes.NewReader(blob), int64(len(blob)), offset, length, &output, stetConfig); err != nil {
+			t.Fatalf("DecryptRange returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext[offset:offset+length]) {
+			t.Error("DecryptRange returned wrong plaintext")
+		}
+	})
+
+	forgeries := []struct {
+		name string
+		size int64
+	}{
+		{name: "Mismatched segment size", size: 2 * segmentSize},
+		{name: "Removed segment size", size: 0},
+		{name: "Tiny segment size", size: 64},
+		{name: "Huge segment size", size: 1 << 40},
+	}
+
+	for _, tc := range forgeries {
+		t.Run(tc.name, func(t *testing.T) {
+			forged := rewriteMetadata(t, metadata.Bytes(), func(md *configpb.Metadata) {
+				md.SegmentSize = tc.size
+			})
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err == nil {
+				t.Error("DecryptWithSidecar succeeded with forged segment size, want error")
+			}
+		})
+	}
+
+	for _, size := range []int64{-1, aeadMinSegmentSize - 1, aeadMaxSegmentSize + 1} {
+		t.Run(fmt.Sprintf("Encrypt with segment size %v", size), func(t *testing.T) {
+			var blob bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "", WithSegmentSize(size)); err == nil {
+				t.Errorf("Encrypt succeeded with segment size %v, want error", size)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// DecryptCheckReport describes the checks made by CanDecrypt.
+type DecryptCheckReport struct {
+	// The outcome of checking the KEK of each share. No share is unwrapped,
+	// so URI is always empty and Combined always false.
+	Shares []ShareReport
+	// The number of shares whose KEKs passed their checks.
+	Usable int
+	// The number of shares needed to reconstruct the DEK.
+	Threshold int
+}
+
+// CanDecrypt estimates whether DecryptWithMetadata could reconstruct the DEK
+// of the blob with `metadata`, given the same configuration and CallOptions,
+// without unwrapping any of its shares. Instead, the KEK of each share is
+// checked: RSA and EC KEKs must have their private keys in the AsymmetricKeys
+// of `stetConfig`, while the CryptoKeys of KEK URIs and of the master KEKs of
+// Tink keysets must be retrievable from Cloud KMS, enabled, and meet the
+// requirements of the DecryptConfig and CallOptions.
+//
+// The checks are only an estimate: retrieving a CryptoKey does not require
+// permission to decrypt with it, and the EKMs of external KEKs are not
+// contacted, so a share may still fail to unwrap. CanDecrypt returns whether
+// at least the threshold number of KEKs passed their checks, and a report of
+// every check. An error is returned only if the checks could not be made at
+// all, such as when no KeyConfig matches the metadata.
+func (c *StetClient) CanDecrypt(ctx context.Context, metadata *configpb.Metadata, stetConfig *configpb.StetConfig, opts ...CallOption) (bool, *DecryptCheckReport, error) {
+	callOpts := c.newCallOptions(opts)
+
+	if metadata == nil {
+		return false, nil, fmt.Errorf("nil metadata passed to CanDecrypt()")
+	}
+
+	keyCfg, err := c.matchKeyConfig(metadata, stetConfig, callOpts)
+	if err != nil {
+		return false, nil, err
+	}
+
+	shareOpts := c.decryptSharesOpts(metadata, keyCfg, stetConfig, callOpts)
+	if len(metadata.GetShares()) != len(shareOpts.kekInfos) {
+		return false, nil, fmt.Errorf("number of shares (%d) does not match number of KEKs (%d)", len(metadata.GetShares()), len(shareOpts.kekInfos))
+	}
+
+	wrappedShares, err := orderSharesByKEK(metadata.GetShares(), len(shareOpts.kekInfos))
+	if err != nil {
+		return false, nil, err
+	}
+
+	var kmsClients *cloudkms.ClientFactory
+	if usesCloudKMS(shareOpts.kekInfos) {
+		var release func()
+		kmsClients, release = shareOpts.kmsClientFactory(ctx, c)
+		defer release()
+	}
+
+	report := &DecryptCheckReport{
+		Shares:    make([]ShareReport, len(wrappedShares)),
+		Threshold: shareThreshold(keyCfg),
+	}
+	forEachShare(len(wrappedShares), shareOpts.concurrency, func(i int) {
+		kek := shareOpts.kekInfos[i]
+		pl, err := c.checkShareKEK(ctx, kmsClients, wrappedShares[i], kek, shareOpts)
+		if err != nil {
+			c.logger(ctx).Infof("Share #%v cannot be unwrapped with %v: %v", i+1, kekDescription(kek), err)
+		}
+		report.Shares[i] = ShareReport{Index: i, KEK: kekDescription(kek), ProtectionLevel: pl, Err: err}
+	})
+
+	for _, share := range report.Shares {
+		if share.Err == nil {
+			report.Usable++
+		}
+	}
+
+	return report.Usable >= report.Threshold, report, nil
+}
+
+// checkShareKEK checks whether `wrapped` could be unwrapped with `kek`, as by
+// unwrapAndValidateShare, without unwrapping it. The protection level of the
+// KEK is returned for KEK URIs, and is unspecified otherwise.
+func (c *StetClient) checkShareKEK(ctx context.Context, kmsClients *cloudkms.ClientFactory, wrapped *configpb.WrappedShare, kek *configpb.KekInfo, opts sharesOpts) (rpb.ProtectionLevel, error) {
+	pl := rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED
+
+	if !opts.kekAvailable(kek) {
+		return pl, ErrKEKNotAvailable
+	}
+
+	// Only KEK URIs can be HSM or externally protected.
+	if _, ok := kek.KekType.(*configpb.KekInfo_KekUri); !ok && opts.minProtectionLevel != configpb.ShareProtectionLevel_ANY_PROTECTION_LEVEL {
+		return pl, fmt.Errorf("%v is software protected, below the minimum %v", kekDescription(kek), opts.minProtectionLevel)
+	}
+
+	switch x := kek.KekType.(type) {
+	case *configpb.KekInfo_RsaFingerprint:
+		key, err := PrivateKeyForRSAFingerprint(kek, opts.asymmetricKeys)
+		if opts.rsaKeyFallback && errors.Is(err, errNoRSAKeyForFingerprint) && len(opts.asymmetricKeys.GetPrivateKeyFiles()) != 0 {
+			// Whether another private key unwraps the share is only known
+			// by trying it, so assume one does.
+			return pl, nil
+		}
+		if err != nil {
+			return pl, fmt.Errorf("failed to find private key for RSA fingerprint: %v", err)
+		}
+
+		if opts.fips {
+			if err := checkFIPSRSAKey(&key.PublicKey); err != nil {
+				return pl, err
+			}
+		}
+
+		if _, err := oaepHash(shareOAEPParams(wrapped, kek), opts.fips); err != nil {
+			return pl, err
+		}
+
+	case *configpb.KekInfo_EcFingerprint:
+		key, err := PrivateKeyForECFingerprint(kek, opts.asymmetricKeys)
+		if err != nil {
+			return pl, fmt.Errorf("failed to find private key for EC fingerprint: %v", err)
+		}
+
+		if curve := ecdhCurve(key.Curve()); curve != wrapped.GetEcCurve() {
+			return pl, fmt.Errorf("share was wrapped with a %v key, but the private key for EC fingerprint %v is %v", wrapped.GetEcCurve(), kek.GetEcFingerprint(), curve)
+		}
+
+	case *configpb.KekInfo_KekUri:
+		var err error
+		pl, err = c.checkUnwrappingKEK(ctx, kmsClients, kek.GetKekUri(), opts)
+		if err != nil {
+			backupURI := kek.GetBackupKekUri()
+			if backupURI == "" || len(wrapped.GetBackupShare()) == 0 {
+				return pl, fmt.Errorf("error checking %v: %w", kek.GetKekUri(), err)
+			}
+
+			pl, err = c.checkUnwrappingKEK(ctx, kmsClients, backupURI, opts)
+			if err != nil {
+				return pl, fmt.Errorf("error checking backup %v: %w", backupURI, err)
+			}
+		}
+
+	case *configpb.KekInfo_TinkKeyset:
+		tk := kek.GetTinkKeyset()
+		if path := tk.GetKeysetFile(); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				return pl, fmt.Errorf("failed to find Tink keyset file: %v", err)
+			}
+		}
+
+		// The master KEK only decrypts the keyset, so is not subject to the
+		// requirements on KEKs that unwrap shares.
+		masterOpts := opts
+		masterOpts.requireImported = false
+		if _, err := c.checkUnwrappingKEK(ctx, kmsClients, tk.GetMasterKekUri(), masterOpts); err != nil {
+			return pl, fmt.Errorf("error checking Tink keyset master KEK: %w", err)
+		}
+
+	default:
+		return pl, fmt.Errorf("unsupported KekInfo type for %v: %v", kekDescription(kek), x)
+	}
+
+	return pl, nil
+}
+
+// checkUnwrappingKEK checks that the CryptoKey of `kekURI` can be retrieved,
+// that its version is enabled, and that it meets the requirements of `opts`,
+// returning its protection level. As no share is unwrapped, the primary
+// version, or the one the KEK is pinned to, is checked.
+func (c *StetClient) checkUnwrappingKEK(ctx context.Context, kmsClients *cloudkms.ClientFactory, kekURI string, opts sharesOpts) (rpb.ProtectionLevel, error) {
+	_, cryptoKey, _, err := c.unwrappingKEK(ctx, kmsClients, kekURI, opts)
+	if err != nil {
+		return rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED, err
+	}
+
+	pl := cryptoKey.GetPrimary().GetProtectionLevel()
+	if err := checkKEKProtectionLevel(kekURI, pl, opts); err != nil {
+		return rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED, err
+	}
+
+	return pl, checkKEKVersionState(kekURI, cryptoKey.GetPrimary())
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"google.golang.org/protobuf/proto"
+
+	kmsrpb "cloud.google.com/go/kms/apiv1/kmspb"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+func TestCanDecrypt(t *testing.T) {
+	ctx := context.Background()
+	keys, fingerprint := writeRSAKeyPair(t, 2048)
+
+	// A 2-of-3 configuration with two Cloud KMS KEKs and an RSA KEK.
+	stetConfig := newFakeKMSConfig(3)
+	keyCfg := stetConfig.GetEncryptConfig().GetKeyConfig()
+	keyCfg.GetShamir().Threshold = 2
+	keyCfg.GetKekInfos()[2].KekType = &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint}
+	stetConfig.AsymmetricKeys = keys
+
+	var metadataBuf bytes.Buffer
+	if _, err := (&StetClient{KMSClient: &stettest.FakeKMS{}}).EncryptWithSidecar(ctx, bytes.NewReader([]byte("plaintext")), &metadataBuf, &bytes.Buffer{}, stetConfig, "blob"); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+	metadata, err := ReadMetadata(&metadataBuf)
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	withoutRSAKey := proto.Clone(stetConfig).(*configpb.StetConfig)
+	withoutRSAKey.AsymmetricKeys = &configpb.AsymmetricKeys{}
+
+	testCases := []struct {
+		name       string
+		kms        *stettest.FakeKMS
+		stetConfig *configpb.StetConfig
+		opts       []CallOption
+		want       bool
+		wantUsable int
+		wantErrs   []error
+	}{
+		{
+			name:       "All KEKs usable",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: stetConfig,
+			want:       true,
+			wantUsable: 3,
+		},
+		{
+			// Shares are not unwrapped, so failing decryption goes unnoticed.
+			name:       "Decryption fails",
+			kms:        &stettest.FakeKMS{DecryptErr: fmt.Errorf("permission denied")},
+			stetConfig: stetConfig,
+			want:       true,
+			wantUsable: 3,
+		},
+		{
+			name:       "Missing RSA private key",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: withoutRSAKey,
+			want:       true,
+			wantUsable: 2,
+		},
+		{
+			name:       "Cloud KMS unreachable with RSA private key",
+			kms:        &stettest.FakeKMS{GetCryptoKeyErr: fmt.Errorf("unavailable")},
+			stetConfig: stetConfig,
+			want:       false,
+			wantUsable: 1,
+		},
+		{
+			name: "KEK version disabled",
+			kms: &stettest.FakeKMS{VersionStates: map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{
+				"projects/test/locations/test/keyRings/test/cryptoKeys/key0/cryptoKeyVersions/1": kmsrpb.CryptoKeyVersion_DISABLED,
+			}},
+			stetConfig: withoutRSAKey,
+			opts:       []CallOption{WithDisabledKEKVersions()},
+			want:       false,
+			wantUsable: 1,
+			wantErrs:   []error{ErrKEKVersionDisabled, nil},
+		},
+		{
+			name:       "KEKs not available",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: stetConfig,
+			opts:       []CallOption{WithAvailableKEKs("gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/key1")},
+			want:       false,
+			wantUsable: 1,
+			wantErrs:   []error{ErrKEKNotAvailable, nil, ErrKEKNotAvailable},
+		},
+		{
+			name:       "Minimum protection level",
+			kms:        &stettest.FakeKMS{ProtectionLevel: kmsrpb.ProtectionLevel_HSM},
+			stetConfig: withMinShareProtectionLevel(stetConfig, configpb.ShareProtectionLevel_HSM_PROTECTION_LEVEL),
+			want:       true,
+			wantUsable: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{KMSClient: tc.kms}
+			got, report, err := stetClient.CanDecrypt(ctx, metadata, tc.stetConfig, tc.opts...)
+			if err != nil {
+				t.Fatalf("CanDecrypt returned error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Errorf("CanDecrypt = %v, want %v; report: %+v", got, tc.want, report)
+			}
+			if report.Usable != tc.wantUsable || report.Threshold != 2 {
+				t.Errorf("CanDecrypt reported %v usable KEKs with a threshold of %v, want %v and 2", report.Usable, report.Threshold, tc.wantUsable)
+			}
+			for i, wantErr := range tc.wantErrs {
+				if gotErr := report.Shares[i].Err; (wantErr == nil) != (gotErr == nil) || !errors.Is(gotErr, wantErr) {
+					t.Errorf("CanDecrypt reported error %v for share #%v, want %v", gotErr, i+1, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestCanDecryptErrors(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+
+	var metadataBuf bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader([]byte("plaintext")), &metadataBuf, &bytes.Buffer{}, stetConfig, "blob"); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+	metadata, err := ReadMetadata(&metadataBuf)
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	missingShare := proto.Clone(metadata).(*configpb.Metadata)
+	missingShare.Shares = missingShare.GetShares()[:1]
+
+	testCases := []struct {
+		name       string
+		metadata   *configpb.Metadata
+		stetConfig *configpb.StetConfig
+	}{
+		{
+			name:       "Nil metadata",
+			stetConfig: stetConfig,
+		},
+		{
+			name:       "No matching KeyConfig",
+			metadata:   metadata,
+			stetConfig: newFakeKMSConfig(3),
+		},
+		{
+			name:       "Missing share",
+			metadata:   missingShare,
+			stetConfig: stetConfig,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := stetClient.CanDecrypt(ctx, tc.metadata, tc.stetConfig); err == nil {
+				t.Error("CanDecrypt succeeded, want error")
+			}
+		})
+	}
+}
+
+// withMinShareProtectionLevel returns a copy of `stetConfig` requiring shares
+// to be unwrapped with KEKs of at least the given protection level.
+func withMinShareProtectionLevel(stetConfig *configpb.StetConfig, level configpb.ShareProtectionLevel) *configpb.StetConfig {
+	config := proto.Clone(stetConfig).(*configpb.StetConfig)
+	config.GetDecryptConfig().MinShareProtectionLevel = level
+	return config
+}
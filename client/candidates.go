@@ -0,0 +1,95 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// DecryptWithMetadataCandidates is like DecryptWithMetadata, but takes several
+// candidate revisions of the metadata of the `size`-byte ciphertext in
+// `ciphertextInput`, such as the old and new metadata while the blob is being
+// rewrapped. It decrypts with the first candidate whose DEK and AAD
+// authenticate the ciphertext, and returns the index of that candidate.
+//
+// Candidates are checked by decrypting the first ciphertext segment, so no
+// plaintext is written to `output` until a candidate has been chosen.
+func (c *StetClient) DecryptWithMetadataCandidates(ctx context.Context, candidates []*configpb.Metadata, ciphertextInput io.ReaderAt, size int64, output io.Writer, stetConfig *configpb.StetConfig, opts ...CallOption) (int, *StetMetadata, error) {
+	callOpts := c.newCallOptions(opts)
+
+	if len(candidates) == 0 {
+		return -1, nil, fmt.Errorf("no metadata candidates passed to DecryptWithMetadataCandidates()")
+	}
+
+	var errs []error
+	for i, metadata := range candidates {
+		combinedDEK, unwrappedShares, segmentSize, err := c.authenticateCandidate(ctx, metadata, ciphertextInput, size, stetConfig, callOpts)
+		if err != nil {
+			c.logger(ctx).Infof("Metadata candidate %v does not authenticate the ciphertext: %v", i, err)
+			errs = append(errs, fmt.Errorf("metadata candidate %v: %w", i, err))
+			continue
+		}
+
+		md, err := decryptWithDEK(metadata, combinedDEK, unwrappedShares, segmentSize, callOpts.aeadWorkers, io.NewSectionReader(ciphertextInput, 0, size), output, nil)
+		if err != nil {
+			return i, nil, err
+		}
+
+		return i, md, nil
+	}
+
+	return -1, nil, fmt.Errorf("no metadata candidate authenticates the ciphertext: %w", errors.Join(errs...))
+}
+
+// authenticateCandidate recovers the DEK from the given metadata, and checks
+// that it and the metadata's AAD authenticate the first segment of the
+// ciphertext.
+func (c *StetClient) authenticateCandidate(ctx context.Context, metadata *configpb.Metadata, ciphertextInput io.ReaderAt, size int64, stetConfig *configpb.StetConfig, callOpts *callOptions) (shares.DEK, []shares.UnwrappedShare, int64, error) {
+	if metadata == nil {
+		return shares.DEK{}, nil, 0, fmt.Errorf("nil metadata")
+	}
+
+	segmentSize, err := metadataSegmentSize(metadata)
+	if err != nil {
+		return shares.DEK{}, nil, 0, err
+	}
+
+	combinedDEK, unwrappedShares, err := c.recoverDEK(ctx, metadata, stetConfig, callOpts)
+	if err != nil {
+		return shares.DEK{}, nil, 0, err
+	}
+
+	aad, err := MetadataToAAD(metadata)
+	if err != nil {
+		return shares.DEK{}, nil, 0, fmt.Errorf("error serializing metadata: %v", err)
+	}
+
+	cipher, err := newSegmentCipher(combinedDEK, aad, segmentSize, ciphertextInput, size)
+	if err != nil {
+		return shares.DEK{}, nil, 0, fmt.Errorf("error reading ciphertext: %v", err)
+	}
+
+	if _, err := cipher.decryptSegment(ciphertextInput, 0); err != nil {
+		return shares.DEK{}, nil, 0, fmt.Errorf("error decrypting data: %v", err)
+	}
+
+	return combinedDEK, unwrappedShares, segmentSize, nil
+}
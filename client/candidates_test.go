@@ -0,0 +1,113 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+func TestDecryptWithMetadataCandidates(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	// Encrypt the same plaintext twice, as a rewrap would, keeping only the
+	// ciphertext of the second encryption.
+	encryptBlob := func() (*configpb.Metadata, []byte) {
+		var metadataBuf, ciphertextBuf bytes.Buffer
+		if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertextBuf, stetConfig, "blob"); err != nil {
+			t.Fatalf("EncryptWithSidecar returned error: %v", err)
+		}
+
+		metadata, err := ReadMetadata(&metadataBuf)
+		if err != nil {
+			t.Fatalf("ReadMetadata returned error: %v", err)
+		}
+
+		return metadata, ciphertextBuf.Bytes()
+	}
+	oldMetadata, _ := encryptBlob()
+	newMetadata, ciphertext := encryptBlob()
+
+	testcases := []struct {
+		name       string
+		candidates []*configpb.Metadata
+		wantIndex  int
+		wantErr    bool
+	}{
+		{
+			name:       "Only matching candidate",
+			candidates: []*configpb.Metadata{newMetadata},
+			wantIndex:  0,
+		},
+		{
+			name:       "Old metadata first",
+			candidates: []*configpb.Metadata{oldMetadata, newMetadata},
+			wantIndex:  1,
+		},
+		{
+			name:       "Nil candidate skipped",
+			candidates: []*configpb.Metadata{nil, newMetadata},
+			wantIndex:  1,
+		},
+		{
+			name:       "No matching candidate",
+			candidates: []*configpb.Metadata{oldMetadata},
+			wantErr:    true,
+		},
+		{
+			name:    "No candidates",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			index, md, err := stetClient.DecryptWithMetadataCandidates(ctx, tc.candidates, bytes.NewReader(ciphertext), int64(len(ciphertext)), &output, stetConfig)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("DecryptWithMetadataCandidates succeeded, want error")
+				}
+				if output.Len() != 0 {
+					t.Errorf("DecryptWithMetadataCandidates wrote %v bytes of output on failure, want none", output.Len())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("DecryptWithMetadataCandidates returned error: %v", err)
+			}
+
+			if index != tc.wantIndex {
+				t.Errorf("DecryptWithMetadataCandidates returned candidate %v, want %v", index, tc.wantIndex)
+			}
+
+			if md.BlobID != "blob" {
+				t.Errorf("DecryptWithMetadataCandidates returned blob ID %q, want %q", md.BlobID, "blob")
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("DecryptWithMetadataCandidates returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
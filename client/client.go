@@ -16,47 +16,121 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	kms "cloud.google.com/go/kms/apiv1"
 	rpb "cloud.google.com/go/kms/apiv1/kmspb"
 	spb "cloud.google.com/go/kms/apiv1/kmspb"
 	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
 	"github.com/GoogleCloudPlatform/stet/client/confidentialspace"
+	"github.com/GoogleCloudPlatform/stet/client/ekmclient"
 	"github.com/GoogleCloudPlatform/stet/client/jwt"
+	"github.com/GoogleCloudPlatform/stet/client/requestid"
 	"github.com/GoogleCloudPlatform/stet/client/securesession"
 	"github.com/GoogleCloudPlatform/stet/client/shares"
 	"github.com/GoogleCloudPlatform/stet/client/vpc"
 	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
-	glog "github.com/golang/glog"
 	"github.com/google/uuid"
 	"google.golang.org/api/option"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
 	// Identifier for GCP KMS used in KEK URIs, from https://developers.google.com/tink/get-key-uri
 	gcpKeyPrefix = "gcp-kms://"
+
+	// Delay between attempts to establish a secure session with an external EKM.
+	secureSessionRetryDelay = time.Second
+
+	// The number of times a wrap or unwrap is retried on a new secure session
+	// after the connection to the EKM is lost.
+	secureSessionReconnects = 1
 )
 
+// Algorithms supported for wrapping shares with externally-protected keys.
+var supportedExternalAlgorithms = []rpb.CryptoKeyVersion_CryptoKeyVersionAlgorithm{
+	rpb.CryptoKeyVersion_EXTERNAL_SYMMETRIC_ENCRYPTION,
+}
+
 // StetMetadata represents metadata associated with data encrypted/decrypted by the client.
 type StetMetadata struct {
 	KeyUris []string
 	BlobID  string
+	// The time spent in each phase of the call, if requested
+	// WithTimingReport.
+	Timings *TimingReport
+	// The application-specific metadata recorded WithExtensions. On Decrypt,
+	// it has been authenticated along with the rest of the metadata.
+	Extensions map[string]string
+	// The secure sessions with external EKMs in which shares were wrapped or
+	// unwrapped, one per request, in the order the requests completed.
+	EKMSessions []EKMSession
+	// The indices of the shares that failed to unwrap and were repaired in
+	// the blob written WithReadRepair, if any.
+	RepairedShares []int
+}
+
+// EKMSession identifies a secure session with an external EKM, so that a
+// request made in it can be correlated with the EKM's audit logs.
+type EKMSession struct {
+	// The URI of the external key the request was made for.
+	URI string
+	// The identifier of the session, derived from its session context.
+	// See securesession.SecureSessionClient.SessionID.
+	SessionID string
+}
+
+// ShareReport describes the outcome of unwrapping a single share.
+type ShareReport struct {
+	// The index of the share, and of its KEK in the KeyConfig.
+	Index int
+	// A description of the KEK the share is wrapped with.
+	KEK string
+	// The URI of the key used to unwrap the share, if it succeeded.
+	URI string
+	// The protection level of the KEK, if it is a KEK URI.
+	ProtectionLevel rpb.ProtectionLevel
+	// The error unwrapping or validating the share, if it failed.
+	Err error
+	// Whether the share was combined to reconstruct the DEK.
+	Combined bool
+}
+
+// DecryptReport describes every share unwrapping attempt made while
+// decrypting, for diagnosing which KEKs are failing. See WithDecryptReport.
+type DecryptReport struct {
+	Shares []ShareReport
+	// Whether enough shares were unwrapped to reconstruct the DEK.
+	Reconstructed bool
+	// The indices of shares that were unwrapped, but not combined, as only
+	// the threshold number of shares is needed to reconstruct the DEK.
+	Unused []int
+	// The indices of shares that were not unwrapped because they were not
+	// needed or their KEKs were not available, rather than because unwrapping
+	// them failed. See WithHedgedUnwrap and WithAvailableKEKs.
+	Skipped []int
 }
 
 type secureSessionClient interface {
-	ConfidentialWrap(ctx context.Context, keyPath string, resourceName string, plaintext []byte) ([]byte, error)
-	ConfidentialUnwrap(ctx context.Context, keyPath string, resourceName string, wrappedBlob []byte) ([]byte, error)
+	ConfidentialWrapWithAAD(ctx context.Context, keyPath string, resourceName string, plaintext, aad []byte) ([]byte, error)
+	ConfidentialUnwrapWithAAD(ctx context.Context, keyPath string, resourceName string, wrappedBlob, aad []byte) ([]byte, error)
 	EndSession(context.Context) error
 }
 
@@ -73,16 +147,125 @@ type StetClient struct {
 	// Fake Secure Session Client for testing purposes.
 	testSecureSessionClient secureSessionClient
 
+	// Returns the fake Secure Session Client for the EKM key with the given
+	// URI, so that tests can simulate several EKMs behaving differently. Takes
+	// precedence over testSecureSessionClient.
+	testSecureSessionClientForURI func(uri string) (secureSessionClient, error)
+
 	// TLS certs to use for establishing communication with EKM. Used for specifying TLS certs for VPC
 	// connections.
 	ekmCertPool *x509.CertPool
 
-	// Whether to skip verification of the inner TLS session cert.
+	// Whether to skip verification of the inner TLS session cert. This can be
+	// overridden for a single call with WithInsecureSkipVerify.
 	InsecureSkipVerify bool
 
 	// The version of STET, if set. This is used to construct user agent
 	// strings for Cloud KMS requests.
 	Version string
+
+	// If set, used for all Cloud KMS requests instead of clients created by
+	// STET, for example to use a fake from the stettest package. The caller
+	// retains ownership of the client.
+	KMSClient cloudkms.Client
+
+	// If set, limits the rate of Cloud KMS requests made by the client, across
+	// all concurrent calls, to stay under Cloud KMS quotas. Requests wait for
+	// the limiter, bounded by their context, rather than failing with
+	// RESOURCE_EXHAUSTED. Must be set before the client is first used.
+	KMSRateLimiter *cloudkms.RateLimiter
+
+	// If set, the source of randomness for generating DEKs, splitting them
+	// with Shamir's Secret Sharing, wrapping shares and exported DEKs with
+	// RSA and EC keys, and the salt and nonce prefix of the ciphertext,
+	// instead of crypto/rand.Reader. This allows injecting a
+	// certified random number generator, or a deterministic source to produce
+	// reproducible blobs in tests. A source that is not cryptographically
+	// secure must never be used in production, as it makes the DEK
+	// predictable. DEKs taken from a DEKPool are not affected.
+	Rand io.Reader
+
+	// Receives the client's log messages. If nil, messages are logged via glog.
+	Logger Logger
+
+	// Receives the latency of each call to Cloud KMS and external EKMs. If
+	// nil, latencies are not measured.
+	Metrics Metrics
+
+	// The maximum number of shares to wrap or unwrap concurrently. If zero or
+	// one, shares are processed sequentially. Can be overridden for a single
+	// call with WithConcurrentShareLimit.
+	MaxConcurrentShares int
+
+	// The maximum wall-clock duration of each secure session with an external
+	// EKM, from establishing the session through ending it. If exceeded, the
+	// session is aborted and an error wrapping ErrSessionTimeout is returned.
+	// If zero, sessions are only bounded by the context's deadline. With
+	// ReuseSecureSessions, each use of a pooled session is bounded instead.
+	MaxSessionDuration time.Duration
+
+	// The number of times to retry the handshake of a secure session with an
+	// external EKM if it fails, such as due to a transient EKM error. Retries
+	// count towards MaxSessionDuration. If zero, the handshake is not retried.
+	SecureSessionRetries int
+
+	// The dial, TLS handshake, response header and keepalive timeouts of the
+	// HTTPS connections to external EKMs. Timeouts left unset take their value
+	// from ekmclient.DefaultHTTPTimeouts.
+	EKMHTTPTimeouts ekmclient.HTTPTimeouts
+
+	// The maximum duration of each wrap or unwrap call with a Cloud KMS KEK,
+	// by the protection level of the KEK's primary version. This allows, for
+	// example, a tight bound for HSM keys and a looser one for external keys,
+	// whose EKMs are often much slower. If exceeded, the call is aborted and
+	// an error wrapping ErrKEKTimeout is returned. Protection levels without a
+	// positive duration are only bounded by the context's deadline.
+	KEKTimeouts map[rpb.ProtectionLevel]time.Duration
+
+	// If set, secure sessions with external EKMs are kept open after use and
+	// reused by later operations with the same key that verify the EKM's
+	// certificate the same way, until Close is called. Each session is used
+	// by one operation at a time.
+	ReuseSecureSessions bool
+
+	// If set, STET only uses FIPS 140-approved algorithms, and returns an
+	// error wrapping ErrNotFIPSApproved for configurations that would use
+	// others. See FIPSCryptoBackend for whether the algorithms themselves are
+	// provided by a FIPS-validated module.
+	FIPSMode bool
+
+	// If set, obtains the auth token presented to external EKMs when
+	// establishing a secure session, instead of an identity token for the
+	// client's service account. In Confidential Space workloads, set this to
+	// confidentialspace.AttestationTokenSource() so that EKMs enforcing
+	// attestation policies accept the session.
+	EKMTokenSource jwt.TokenSource
+
+	// If set, derives the Cloud KMS resource name of a KEK from its gcp-kms://
+	// URI, such as for KMS emulators or deployments with non-standard key
+	// layouts. By default, the gcp-kms:// prefix is removed from the URI.
+	KMSResourceName func(uri string) (string, error)
+
+	// If set, Encrypt and EncryptBatch return an error wrapping
+	// ErrMissingBlobID when given an empty blob ID, instead of generating a
+	// random UUID. This catches bugs in systems where blob IDs are assigned
+	// by an external authority.
+	RequireBlobID bool
+
+	// If set, applied to each wrapped share after wrapping, and inverted
+	// before unwrapping shares it was applied to. Its name is recorded with
+	// each share, so blobs encrypted with a transform can only be decrypted
+	// by clients with a transform of the same name.
+	ShareTransform ShareTransform
+
+	// If set, ExportDEK may export the DEKs of blobs to a recipient's public
+	// key. See ExportDEK for the security implications.
+	AllowDEKExport bool
+
+	// Guards the resources below, which are released by Close.
+	mu         sync.Mutex
+	kmsClients *cloudkms.ClientFactory
+	sessions   map[string][]*pooledSession
 }
 
 // newCloudEKMClient initializes the StetClient's `cloudEKMClient`.
@@ -108,92 +291,286 @@ func (c *StetClient) newCloudEKMClient(ctx context.Context, credentials string)
 
 // parseEKMKeyURI takes in the key URI for a key stored in an EKM, and returns
 // the address for connecting to the EKM, and the key path for the resource.
+// The address keeps the port, if any, and the brackets around IPv6 literals.
 func parseEKMKeyURI(keyURI string) (string, string, error) {
 	u, err := url.Parse(keyURI)
 	if err != nil {
 		return "", "", fmt.Errorf("could not parse: %v", err)
 	}
 
-	addr := fmt.Sprintf("%s://%s", u.Scheme, u.Hostname())
+	if u.Hostname() == "" {
+		return "", "", fmt.Errorf("no host in key URI %q", keyURI)
+	}
+
+	addr := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
 	return addr, path.Base(keyURI), nil
 }
 
-// ekmSecureSessionWrap creates a secure session with the external EKM denoted by the given URI, and uses it to encrypt unwrappedShare.
-func (c *StetClient) ekmSecureSessionWrap(ctx context.Context, unwrappedShare []byte, md kekMetadata, ekmCertPool *x509.CertPool) ([]byte, error) {
-	addr, keyPath, err := parseEKMKeyURI(md.uri)
-	if err != nil {
-		return nil, err
+// ErrMissingBlobID is returned when encrypting without a blob ID while the
+// StetClient's RequireBlobID is set.
+var ErrMissingBlobID = errors.New("blob ID is required")
+
+// newBlobID returns `blobID`, or a random UUID if it is empty and blob IDs
+// are not required.
+func (c *StetClient) newBlobID(blobID string) (string, error) {
+	if blobID != "" {
+		return blobID, nil
 	}
 
-	var ekmClient secureSessionClient
-	if c.testSecureSessionClient != nil {
-		ekmClient = c.testSecureSessionClient
-	} else {
-		authToken, err := jwt.GenerateTokenWithAudience(ctx, addr)
-		if err != nil {
-			return nil, err
-		}
+	if c.RequireBlobID {
+		return "", ErrMissingBlobID
+	}
 
-		ekmClient, err = securesession.EstablishSecureSession(ctx, md.uri, authToken, securesession.HTTPCertPool(ekmCertPool), securesession.SkipTLSVerify(c.InsecureSkipVerify))
-		if err != nil {
-			return nil, fmt.Errorf("error establishing secure session: %v", err)
+	return uuid.NewString(), nil
+}
+
+// ErrSessionTimeout is returned when a secure session with an external EKM
+// exceeds the StetClient's MaxSessionDuration.
+var ErrSessionTimeout = errors.New("secure session exceeded maximum duration")
+
+// secureSessionFunc performs an operation with an established secure session.
+type secureSessionFunc func(ctx context.Context, ekmClient secureSessionClient, keyPath string) ([]byte, error)
+
+// withSecureSession creates a secure session with the external EKM denoted by
+// the given URI, calls fn with it, then ends the session. If the client has a
+// MaxSessionDuration, the session is aborted once it has been exceeded.
+func (c *StetClient) withSecureSession(ctx context.Context, md kekMetadata, ekmCertPool *x509.CertPool, fn secureSessionFunc) ([]byte, error) {
+	if c.MaxSessionDuration <= 0 {
+		return c.runSecureSession(ctx, md, ekmCertPool, fn)
+	}
+
+	sessionCtx, cancel := context.WithTimeout(ctx, c.MaxSessionDuration)
+	defer cancel()
+
+	type result struct {
+		blob []byte
+		err  error
+	}
+
+	// Run the session separately, so that it is abandoned on timeout even if
+	// the EKM does not respond to the context being cancelled.
+	done := make(chan result, 1)
+	go func() {
+		blob, err := c.runSecureSession(sessionCtx, md, ekmCertPool, fn)
+		done <- result{blob, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-sessionCtx.Done():
+		r.err = sessionCtx.Err()
+	}
+
+	if r.err != nil && ctx.Err() == nil && errors.Is(sessionCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w of %v: %v", ErrSessionTimeout, c.MaxSessionDuration, r.err)
+	}
+
+	return r.blob, r.err
+}
+
+// runSecureSession implements withSecureSession, without the time limit. If
+// fn fails because the connection to the EKM was lost, it is retried on a new
+// secure session, up to secureSessionReconnects times. Other failures, such as
+// authorization failures, are not retried.
+func (c *StetClient) runSecureSession(ctx context.Context, md kekMetadata, ekmCertPool *x509.CertPool, fn secureSessionFunc) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		blob, err := c.runSecureSessionOnce(ctx, md, ekmCertPool, fn)
+		if err == nil || !errors.Is(err, securesession.ErrConnectionLost) || attempt >= secureSessionReconnects {
+			return blob, err
 		}
+
+		c.logger(ctx).Warningf("Connection to %v lost, retrying on a new secure session: %v", md.uri, err)
+	}
+}
+
+// runSecureSessionOnce makes a single attempt at runSecureSession.
+func (c *StetClient) runSecureSessionOnce(ctx context.Context, md kekMetadata, ekmCertPool *x509.CertPool, fn secureSessionFunc) ([]byte, error) {
+	if c.ReuseSecureSessions {
+		return c.runPooledSession(ctx, md, ekmCertPool, fn)
+	}
+
+	_, keyPath, err := parseEKMKeyURI(md.uri)
+	if err != nil {
+		return nil, err
 	}
 
-	wrappedBlob, err := ekmClient.ConfidentialWrap(ctx, keyPath, md.resourceName, unwrappedShare)
+	ekmClient, err := c.establishSecureSession(ctx, md, ekmCertPool)
 	if err != nil {
-		return nil, fmt.Errorf("error wrapping with secure session: %v", err)
+		return nil, err
+	}
+
+	blob, err := fn(ctx, ekmClient, keyPath)
+	if err != nil {
+		discardSecureSession(ekmClient)
+		return nil, err
 	}
 
 	if err := ekmClient.EndSession(ctx); err != nil {
+		discardSecureSession(ekmClient)
 		return nil, fmt.Errorf("error ending secure session: %v", err)
 	}
 
-	return wrappedBlob, nil
+	return blob, nil
 }
 
-// ekmSecureSessionUnwrap creates a secure session with the external EKM denoted by the given URI, and uses it to decrypt wrappedShare.
-func (c *StetClient) ekmSecureSessionUnwrap(ctx context.Context, wrappedShare []byte, md kekMetadata, ekmCertPool *x509.CertPool) ([]byte, error) {
-	addr, keyPath, err := parseEKMKeyURI(md.uri)
-	if err != nil {
-		return nil, err
+// discardSecureSession releases the resources of a secure session that was
+// not ended successfully, such as its connection to the EKM.
+func discardSecureSession(session secureSessionClient) {
+	if closer, ok := session.(io.Closer); ok {
+		closer.Close()
 	}
+}
 
-	var ekmClient secureSessionClient
-	if c.testSecureSessionClient != nil {
-		ekmClient = c.testSecureSessionClient
-	} else {
-		authToken, err := jwt.GenerateTokenWithAudience(ctx, addr)
-		if err != nil {
-			return nil, err
-		}
+// ekmAuthToken returns the auth token to present to the external EKM at
+// `addr`, from the client's EKMTokenSource if set.
+func (c *StetClient) ekmAuthToken(ctx context.Context, addr string) (string, error) {
+	if c.EKMTokenSource != nil {
+		return jwt.TokenWithAudience(ctx, addr, c.EKMTokenSource)
+	}
+
+	return jwt.GenerateTokenWithAudience(ctx, addr)
+}
+
+// establishSecureSession establishes a secure session with the external EKM
+// denoted by the given URI.
+func (c *StetClient) establishSecureSession(ctx context.Context, md kekMetadata, ekmCertPool *x509.CertPool) (ekmClient secureSessionClient, err error) {
+	done := c.observe(OperationSession, md.protectionLevel)
+	defer func() { done(err) }()
 
-		ekmClient, err = securesession.EstablishSecureSession(ctx, md.uri, authToken, securesession.HTTPCertPool(ekmCertPool), securesession.SkipTLSVerify(c.InsecureSkipVerify))
+	if c.testSecureSessionClientForURI != nil {
+		ekmClient, err = c.testSecureSessionClientForURI(md.uri)
 		if err != nil {
-			return nil, fmt.Errorf("error establishing secure session: %v", err)
+			return nil, fmt.Errorf("error establishing secure session: %w", err)
 		}
+		return ekmClient, nil
+	}
+	if c.testSecureSessionClient != nil {
+		return c.testSecureSessionClient, nil
 	}
 
-	unwrappedBlob, err := ekmClient.ConfidentialUnwrap(ctx, keyPath, md.resourceName, wrappedShare)
+	addr, _, err := parseEKMKeyURI(md.uri)
 	if err != nil {
-		return nil, fmt.Errorf("error unwrapping with secure session: %v", err)
+		return nil, err
 	}
 
-	if err := ekmClient.EndSession(ctx); err != nil {
-		return nil, fmt.Errorf("error ending secure session: %v", err)
+	authToken, err := c.ekmAuthToken(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ekmClient, err = securesession.EstablishSecureSession(ctx, md.uri, authToken, securesession.HTTPCertPool(ekmCertPool), securesession.SkipTLSVerify(md.skipTLSVerify), securesession.HandshakeRetries(c.SecureSessionRetries+1, secureSessionRetryDelay), securesession.HTTPTimeouts(c.EKMHTTPTimeouts))
+	if err != nil {
+		return nil, fmt.Errorf("error establishing secure session: %w", err)
 	}
 
-	return unwrappedBlob, nil
+	return ekmClient, nil
+}
+
+// ekmSecureSessionWrap creates a secure session with the external EKM denoted by the given URI, and uses it to encrypt unwrappedShare.
+func (c *StetClient) ekmSecureSessionWrap(ctx context.Context, unwrappedShare, aad []byte, md kekMetadata, ekmCertPool *x509.CertPool) ([]byte, error) {
+	return c.withSecureSession(ctx, md, ekmCertPool, func(ctx context.Context, ekmClient secureSessionClient, keyPath string) ([]byte, error) {
+		wrappedBlob, err := ekmClient.ConfidentialWrapWithAAD(ctx, keyPath, md.resourceName, unwrappedShare, aad)
+		if err != nil {
+			return nil, fmt.Errorf("error wrapping with secure session%v: %w", describeSession(ekmClient), err)
+		}
+
+		c.logger(ctx).Infof("Wrapped share with %v in secure session%v", md.uri, describeSession(ekmClient))
+		md.sessions.record(md.uri, ekmClient)
+
+		return wrappedBlob, nil
+	})
+}
+
+// ekmSecureSessionUnwrap creates a secure session with the external EKM denoted by the given URI, and uses it to decrypt wrappedShare.
+func (c *StetClient) ekmSecureSessionUnwrap(ctx context.Context, wrappedShare, aad []byte, md kekMetadata, ekmCertPool *x509.CertPool) ([]byte, error) {
+	return c.withSecureSession(ctx, md, ekmCertPool, func(ctx context.Context, ekmClient secureSessionClient, keyPath string) ([]byte, error) {
+		unwrappedBlob, err := ekmClient.ConfidentialUnwrapWithAAD(ctx, keyPath, md.resourceName, wrappedShare, aad)
+		if err != nil {
+			return nil, fmt.Errorf("error unwrapping with secure session%v: %w", describeSession(ekmClient), err)
+		}
+
+		c.logger(ctx).Infof("Unwrapped share with %v in secure session%v", md.uri, describeSession(ekmClient))
+		md.sessions.record(md.uri, ekmClient)
+
+		return unwrappedBlob, nil
+	})
 }
 
 type kekMetadata struct {
 	protectionLevel rpb.ProtectionLevel
 	uri             string
 	resourceName    string
+
+	// Whether to skip verifying the EKM's certificate in the inner TLS
+	// session of secure sessions with it.
+	skipTLSVerify bool
+
+	// If set, records the secure sessions in which requests are made.
+	sessions *ekmSessionLog
+}
+
+// defaultKMSResourceName derives the Cloud KMS resource name of a KEK by
+// removing the gcp-kms:// prefix from its URI.
+func defaultKMSResourceName(uri string) (string, error) {
+	return strings.TrimPrefix(uri, gcpKeyPrefix), nil
+}
+
+// kmsResourceName derives the Cloud KMS resource name of a KEK from its URI,
+// with KMSResourceName if set.
+func (c *StetClient) kmsResourceName(uri string) (string, error) {
+	if c.KMSResourceName == nil {
+		return defaultKMSResourceName(uri)
+	}
+
+	name, err := c.KMSResourceName(uri)
+	if err != nil {
+		return "", fmt.Errorf("error deriving resource name for %v: %v", uri, err)
+	}
+
+	return name, nil
+}
+
+// ErrKEKVersionDisabled is returned when the CryptoKeyVersion of a Cloud KMS
+// KEK is disabled or scheduled for destruction, so that it cannot currently be
+// used, but could be re-enabled or restored.
+var ErrKEKVersionDisabled = errors.New("KEK version is disabled")
+
+// ErrKEKVersionDestroyed is returned when the CryptoKeyVersion of a Cloud KMS
+// KEK has been destroyed, so that shares wrapped with it are permanently lost.
+var ErrKEKVersionDestroyed = errors.New("KEK version is destroyed")
+
+// checkKEKVersionState returns an error if the CryptoKeyVersion `ver` of the
+// KEK identified by `uri` is not enabled, wrapping ErrKEKVersionDisabled or
+// ErrKEKVersionDestroyed if it is recoverable or permanently gone.
+func checkKEKVersionState(uri string, ver *rpb.CryptoKeyVersion) error {
+	switch ver.GetState() {
+	case rpb.CryptoKeyVersion_ENABLED:
+		return nil
+	case rpb.CryptoKeyVersion_DISABLED:
+		return fmt.Errorf("%w: CryptoKeyVersion %v for %v is not enabled, but may be re-enabled", ErrKEKVersionDisabled, ver.GetName(), uri)
+	case rpb.CryptoKeyVersion_DESTROY_SCHEDULED:
+		return fmt.Errorf("%w: CryptoKeyVersion %v for %v is not enabled, and is scheduled for destruction, but may be restored until then", ErrKEKVersionDisabled, ver.GetName(), uri)
+	case rpb.CryptoKeyVersion_DESTROYED:
+		return fmt.Errorf("%w: CryptoKeyVersion %v for %v is not enabled, and has been permanently destroyed", ErrKEKVersionDestroyed, ver.GetName(), uri)
+	default:
+		return fmt.Errorf("CryptoKeyVersion %v for %v is not enabled: %v", ver.GetName(), uri, ver.GetState())
+	}
 }
 
 // Retrieves the CryptoKey of a CloudKMS KEK URI.
 func getKekCryptoKey(ctx context.Context, kmsClient cloudkms.Client, kekInfo *configpb.KekInfo) (*rpb.CryptoKey, error) {
+	return getKekCryptoKeyWithName(ctx, kmsClient, kekInfo, defaultKMSResourceName, false)
+}
+
+// getKekCryptoKeyWithName is like getKekCryptoKey, but derives the resource
+// name of the KEK from its URI with `resourceName`.
+//
+// If the URI is pinned to a CryptoKeyVersion, the returned CryptoKey has that
+// version in place of its primary, so that it is the version checked and
+// used. If `allowDisabled` is set, a version that is disabled but not
+// destroyed is returned rather than rejected.
+func getKekCryptoKeyWithName(ctx context.Context, kmsClient cloudkms.Client, kekInfo *configpb.KekInfo, resourceName func(string) (string, error), allowDisabled bool) (*rpb.CryptoKey, error) {
 	_, ok := kekInfo.GetKekType().(*configpb.KekInfo_KekUri)
 	// No-op if this does not describe a KEK URI.
 	if !ok {
@@ -206,23 +583,130 @@ func getKekCryptoKey(ctx context.Context, kmsClient cloudkms.Client, kekInfo *co
 		return nil, fmt.Errorf("%v does not have the expected URI prefix, want %v", uri, gcpKeyPrefix)
 	}
 
-	cryptoKey, err := kmsClient.GetCryptoKey(ctx, &spb.GetCryptoKeyRequest{Name: strings.TrimPrefix(uri, gcpKeyPrefix)})
+	name, err := resourceName(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	keyName, pinned := splitCryptoKeyVersion(name)
+	cryptoKey, err := kmsClient.GetCryptoKey(ctx, &spb.GetCryptoKeyRequest{Name: keyName})
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving key metadata: %v", err)
 	}
 
+	// Asymmetric keys have no primary version, so the version to wrap with
+	// must be given.
+	asymmetric := isAsymmetricKEK(cryptoKey)
+	if asymmetric && !pinned {
+		return nil, fmt.Errorf("%v is an asymmetric decryption key, so must be pinned to a CryptoKeyVersion, as in %v/%v/1", uri, uri, cryptoKeyVersionsPart)
+	}
+
+	if pinned {
+		getter, ok := kmsClient.(cloudkms.VersionGetter)
+		if !ok {
+			return nil, fmt.Errorf("%v is pinned to a CryptoKeyVersion, but the Cloud KMS client cannot retrieve CryptoKeyVersions", uri)
+		}
+
+		ver, err := getter.GetCryptoKeyVersion(ctx, &spb.GetCryptoKeyVersionRequest{Name: name})
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving key version metadata: %v", err)
+		}
+
+		cryptoKey = proto.Clone(cryptoKey).(*rpb.CryptoKey)
+		cryptoKey.Primary = ver
+	}
+
 	cryptoKeyVer := cryptoKey.GetPrimary()
-	if cryptoKeyVer.GetState() != rpb.CryptoKeyVersion_ENABLED {
-		return nil, fmt.Errorf("CryptoKeyVersion for %v is not enabled", uri)
+	if err := checkKEKVersionState(uri, cryptoKeyVer); err != nil && !(allowDisabled && errors.Is(err, ErrKEKVersionDisabled)) {
+		return nil, err
 	}
 
 	if cryptoKeyVer.ProtectionLevel == rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED {
 		return nil, fmt.Errorf("unspecified protection level %v", cryptoKeyVer.GetProtectionLevel())
 	}
 
+	switch cryptoKeyVer.GetProtectionLevel() {
+	case rpb.ProtectionLevel_EXTERNAL, rpb.ProtectionLevel_EXTERNAL_VPC:
+		if asymmetric {
+			return nil, fmt.Errorf("asymmetric decryption key %v has protection level %v, but only SOFTWARE and HSM asymmetric keys are supported", uri, cryptoKeyVer.GetProtectionLevel())
+		}
+		if err := validateExternalKeyAlgorithm(cryptoKeyVer); err != nil {
+			return nil, fmt.Errorf("CryptoKeyVersion for %v cannot be used: %v", uri, err)
+		}
+	}
+
+	if asymmetric {
+		if err := cloudkms.CheckAsymmetricAlgorithm(cryptoKeyVer.GetAlgorithm()); err != nil {
+			return nil, fmt.Errorf("CryptoKeyVersion for %v cannot be used: %v", uri, err)
+		}
+	}
+
 	return cryptoKey, nil
 }
 
+// isAsymmetricKEK returns whether `cryptoKey` is an asymmetric decryption key,
+// with which shares are wrapped locally with its public key, and unwrapped
+// with AsymmetricDecrypt.
+func isAsymmetricKEK(cryptoKey *rpb.CryptoKey) bool {
+	return cryptoKey.GetPurpose() == rpb.CryptoKey_ASYMMETRIC_DECRYPT
+}
+
+// kekImport describes the imported key material backing the primary version
+// of a Cloud KMS KEK.
+type kekImport struct {
+	// Whether the key material was imported, rather than generated by Cloud
+	// KMS or held in an external EKM.
+	imported bool
+	// The resource name of the import job used, and when the import
+	// completed.
+	importJob  string
+	importTime time.Time
+}
+
+// kekImportInfo returns the import attributes of the primary version of
+// `cryptoKey`.
+func kekImportInfo(cryptoKey *rpb.CryptoKey) kekImport {
+	ver := cryptoKey.GetPrimary()
+	info := kekImport{
+		imported:  ver.GetImportJob() != "",
+		importJob: ver.GetImportJob(),
+	}
+
+	if t := ver.GetImportTime(); t != nil {
+		info.importTime = t.AsTime()
+	}
+
+	return info
+}
+
+// checkKEKImport logs whether the KEK identified by `uri` is backed by
+// imported key material, and returns an error if it is not but `required`.
+func (c *StetClient) checkKEKImport(ctx context.Context, uri string, cryptoKey *rpb.CryptoKey, required bool) error {
+	info := kekImportInfo(cryptoKey)
+	if !info.imported {
+		if required {
+			return fmt.Errorf("KEK %v is not backed by imported key material, but imported KEKs are required", uri)
+		}
+		return nil
+	}
+
+	c.logger(ctx).Infof("KEK %v is backed by key material imported with %v at %v", uri, info.importJob, info.importTime)
+	return nil
+}
+
+// validateExternalKeyAlgorithm returns an error if the algorithm of the given
+// externally-protected CryptoKeyVersion cannot be used to wrap shares.
+func validateExternalKeyAlgorithm(cryptoKeyVer *rpb.CryptoKeyVersion) error {
+	algorithm := cryptoKeyVer.GetAlgorithm()
+	for _, supported := range supportedExternalAlgorithms {
+		if algorithm == supported {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported algorithm %v, want one of %v", algorithm, supportedExternalAlgorithms)
+}
+
 func externalKEKMetadata(cryptoKey *rpb.CryptoKey) (*kekMetadata, error) {
 	cryptoKeyVer := cryptoKey.GetPrimary()
 
@@ -258,326 +742,1445 @@ func (c *StetClient) getExternalVPCKeyInfo(ctx context.Context, cryptoKey *rpb.C
 	}, ekmCerts, nil
 }
 
-// wrapShares encrypts the given shares using either the given key URIs or the
-// asymmetric key provided in the corresponding KekInfo struct. It returns a
-// list of wrapped shares, and a list of key URIs used for shares that were
-// wrapped by communicating with an external KMS (these lists might not
-// correspond one-to-one if some shares are wrapped via asymmetric key).
 type sharesOpts struct {
 	kekInfos        []*configpb.KekInfo
 	asymmetricKeys  *configpb.AsymmetricKeys
 	confSpaceConfig *confidentialspace.Config
-}
-
-func (c *StetClient) wrapShares(ctx context.Context, unwrappedShares [][]byte, opts sharesOpts) (wrappedShares []*configpb.WrappedShare, keyURIs []string, err error) {
-	if len(unwrappedShares) != len(opts.kekInfos) {
-		return nil, nil, fmt.Errorf("number of shares to wrap (%d) does not match number of KEKs (%d)", len(unwrappedShares), len(opts.kekInfos))
-	}
 
-	var kmsClients *cloudkms.ClientFactory
-	if c.testKMSClients != nil {
-		kmsClients = c.testKMSClients
-	} else {
-		kmsClients = cloudkms.NewClientFactory(c.Version)
-	}
-	defer kmsClients.Close()
+	// The maximum number of shares to wrap or unwrap concurrently.
+	concurrency int
 
-	for i, share := range unwrappedShares {
-		wrapped := &configpb.WrappedShare{
-			Hash: shares.HashShare(share),
-		}
+	// Whether to reject KEKs that are not FIPS-approved.
+	fips bool
 
-		kek := opts.kekInfos[i]
+	// If set, receives the outcome of each share unwrapping attempt.
+	report *DecryptReport
 
-		switch x := kek.KekType.(type) {
-		case *configpb.KekInfo_RsaFingerprint:
-			key, err := PublicKeyForRSAFingerprint(kek, opts.asymmetricKeys)
-			if err != nil {
-				return nil, nil, fmt.Errorf("failed to find public key for RSA fingerprint: %w", err)
-			}
+	// The algorithm used to hash shares when wrapping them.
+	hashAlgorithm configpb.ShareHashAlgorithm
 
-			wrapped.Share, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, share, nil)
-			if err != nil {
-				return nil, nil, fmt.Errorf("error wrapping key share: %v", err)
-			}
+	// The minimum protection level of KEKs used to unwrap shares.
+	minProtectionLevel configpb.ShareProtectionLevel
 
-		case *configpb.KekInfo_KekUri:
-			// Configure CloudKMS Client, with Confidential Space credentials if applicable.
-			creds := ""
-			if opts.confSpaceConfig != nil {
-				creds = opts.confSpaceConfig.FindMatchingCredentials(kek.GetKekUri(), configpb.CredentialMode_ENCRYPT_ONLY_MODE)
-			}
+	// Whether Cloud KMS KEKs must be backed by imported key material.
+	requireImported bool
 
-			kmsClient, err := kmsClients.Client(ctx, creds)
-			if err != nil {
-				return nil, nil, fmt.Errorf("error initializing Cloud KMS Client with credentials \"%v\": %v", creds, err)
-			}
+	// Whether to try every RSA private key for shares whose fingerprint
+	// matches none of them.
+	rsaKeyFallback bool
 
-			cryptoKey, err := getKekCryptoKey(ctx, kmsClient, kek)
-			if err != nil {
-				return nil, nil, fmt.Errorf("Error retrieving KEK Metadata: %v", err)
-			}
+	// Whether to skip verifying the certificates of external EKMs.
+	skipTLSVerify bool
 
-			var uri string
-			// Wrap share via KMS.
-			switch pl := cryptoKey.GetPrimary().ProtectionLevel; pl {
-			case rpb.ProtectionLevel_SOFTWARE, rpb.ProtectionLevel_HSM:
-				var err error
-				wrapOpts := cloudkms.WrapOpts{
-					Share:   share,
-					KeyName: strings.TrimPrefix(kek.GetKekUri(), gcpKeyPrefix),
-				}
-				wrapped.Share, err = cloudkms.WrapShare(ctx, kmsClient, wrapOpts)
-				if err != nil {
-					return nil, nil, fmt.Errorf("error wrapping key share: %v", err)
-				}
+	// If set, records the secure sessions in which shares are wrapped or
+	// unwrapped with external EKMs.
+	ekmSessions *ekmSessionLog
 
-				uri = kek.GetKekUri()
-			case rpb.ProtectionLevel_EXTERNAL:
-				kmd, err := externalKEKMetadata(cryptoKey)
-				if err != nil {
-					return nil, nil, fmt.Errorf("error creating KEK Metadata: %v", err)
-				}
+	// If set, the additional authenticated data sent with each Cloud KMS
+	// and external EKM wrap or unwrap request.
+	kekAAD []byte
 
-				// A nil ekmCertPool indicates the host's Root CAs will be used to connect to the EKM.
-				ekmWrappedShare, err := c.ekmSecureSessionWrap(ctx, share, *kmd, nil)
-				if err != nil {
-					return nil, nil, fmt.Errorf("error wrapping with secure session: %v", err)
-				}
+	// If set, the factory to create Cloud KMS clients with, shared with
+	// other operations such as the rest of an EncryptBatch call. Otherwise a
+	// factory is obtained for the operation.
+	kmsClients *cloudkms.ClientFactory
 
-				wrapped.Share = ekmWrappedShare
-				uri = kmd.uri
-			case rpb.ProtectionLevel_EXTERNAL_VPC:
-				kmd, ekmCerts, err := c.getExternalVPCKeyInfo(ctx, cryptoKey, creds)
-				if err != nil {
-					return nil, nil, fmt.Errorf("error getting external VPC key info: %v", err)
-				}
+	// If set, receives the time spent wrapping or unwrapping each share.
+	timings *TimingReport
 
-				ekmWrappedShare, err := c.ekmSecureSessionWrap(ctx, share, *kmd, ekmCerts)
-				if err != nil {
-					return nil, nil, fmt.Errorf("error wrapping with secure session: %v", err)
-				}
+	// If positive, shares are unwrapped with hedgeShares until this many
+	// have been unwrapped, with up to hedgeExtra more in flight.
+	hedgeThreshold int
+	hedgeExtra     int
 
-				wrapped.Share = ekmWrappedShare
-				uri = kmd.uri
-			default:
-				return nil, nil, fmt.Errorf("unsupported protection level %v", pl)
-			}
+	// Whether to attempt unwrapping with Cloud KMS KEK versions that are
+	// disabled but not destroyed.
+	allowDisabledVersions bool
 
-			// Return the URI used: the Cloud KMS one in the case of a software
-			// or HSM key, and the external key URI for an external key.
-			keyURIs = append(keyURIs, uri)
+	// If set, only shares whose KEKs are identified in it are unwrapped, as
+	// described in WithAvailableKEKs.
+	availableKEKs map[string]bool
 
-		default:
-			return nil, nil, fmt.Errorf("unsupported KekInfo type: %v", x)
-		}
+	// The source of randomness for wrapping shares with RSA and EC KEKs. If
+	// nil, crypto/rand.Reader is used.
+	rand io.Reader
+}
 
-		wrappedShares = append(wrappedShares, wrapped)
+// random returns the source of randomness for wrapping shares.
+func (o sharesOpts) random() io.Reader {
+	if o.rand == nil {
+		return rand.Reader
 	}
 
-	return wrappedShares, keyURIs, nil
+	return o.rand
 }
 
-// unwrapAndValidateShares decrypts the given wrapped share based on its URI.
-func (c *StetClient) unwrapAndValidateShares(ctx context.Context, wrappedShares []*configpb.WrappedShare, opts sharesOpts) ([]shares.UnwrappedShare, error) {
-	if len(wrappedShares) != len(opts.kekInfos) {
-		return nil, fmt.Errorf("number of shares to unwrap (%d) does not match number of KEKs (%d)", len(wrappedShares), len(opts.kekInfos))
+// kekAvailable reports whether a share wrapped with `kek` should be
+// unwrapped, according to opts.availableKEKs.
+func (opts sharesOpts) kekAvailable(kek *configpb.KekInfo) bool {
+	if opts.availableKEKs == nil {
+		return true
 	}
 
-	var kmsClients *cloudkms.ClientFactory
-	if c.testKMSClients != nil {
-		kmsClients = c.testKMSClients
-	} else {
-		kmsClients = cloudkms.NewClientFactory(c.Version)
+	for _, id := range kekIdentifiers(kek) {
+		if opts.availableKEKs[id] {
+			return true
+		}
 	}
-	defer kmsClients.Close()
 
-	// In order to support k-of-n decryption, don't exit early if share
-	// share unwrapping fails. Attempt to unwrap all shares and just
-	// return the subset of ones that succeeded, and let the Shamir's
-	// implementation handle the subset of shares.
-	var unwrappedShares []shares.UnwrappedShare
-	for i, wrapped := range wrappedShares {
-		unwrapped := shares.UnwrappedShare{}
-		kek := opts.kekInfos[i]
-		glog.Infof("Attempting to unwrap share #%v, URI %v", i+1, kek.GetKekUri())
+	return false
+}
 
-		switch x := kek.KekType.(type) {
-		case *configpb.KekInfo_RsaFingerprint:
-			key, err := PrivateKeyForRSAFingerprint(kek, opts.asymmetricKeys)
-			if err != nil {
-				glog.Errorf("Failed to find private key for RSA fingerprint: %v", err)
-				continue
-			}
+// kmsClientFactory returns the factory in opts.kmsClients if set, or else
+// one from the client as with StetClient.kmsClientFactory.
+func (opts sharesOpts) kmsClientFactory(ctx context.Context, c *StetClient) (*cloudkms.ClientFactory, func()) {
+	if opts.kmsClients != nil {
+		return opts.kmsClients, func() {}
+	}
 
-			unwrapped.Share, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key, wrapped.GetShare(), nil)
-			if err != nil {
-				glog.Errorf("Error unwrapping key share for %v: %v", kek.GetKekUri(), err)
-				continue
-			}
+	return c.kmsClientFactory(ctx)
+}
 
-		case *configpb.KekInfo_KekUri:
-			// Configure CloudKMS Client, with Confidential Space credentials if applicable.
-			creds := ""
-			if opts.confSpaceConfig != nil {
-				creds = opts.confSpaceConfig.FindMatchingCredentials(kek.GetKekUri(), configpb.CredentialMode_DECRYPT_ONLY_MODE)
-			}
+// usesCloudKMS reports whether any of the given KEKs need a Cloud KMS client,
+// as KEK URIs or Tink keysets do.
+func usesCloudKMS(kekInfos []*configpb.KekInfo) bool {
+	for _, kek := range kekInfos {
+		switch kek.GetKekType().(type) {
+		case *configpb.KekInfo_KekUri, *configpb.KekInfo_TinkKeyset:
+			return true
+		}
+	}
 
-			kmsClient, err := kmsClients.Client(ctx, creds)
-			if err != nil {
-				glog.Errorf("Error initializing Cloud KMS Client with credentials \"%v\" for %v: %v", creds, kek.GetKekUri(), err)
-				continue
-			}
+	return false
+}
 
-			cryptoKey, err := getKekCryptoKey(ctx, kmsClient, kek)
-			if err != nil {
-				glog.Errorf("Error retrieving KEK Metadata for %v: %v", kek.GetKekUri(), err)
-				continue
-			}
+// shareContextAAD returns the additional authenticated data binding the
+// shares of the blob with the given ID to the context set by
+// WithShareContext, or nil if no context was set. It is the following
+// serialization:
+//
+//	len(blobID) || blobID || encryptionContext
+func shareContextAAD(blobID string, encryptionContext []byte) []byte {
+	if encryptionContext == nil {
+		return nil
+	}
 
-			var uri string
-			// Unwrap share via KMS.
-			switch pl := cryptoKey.GetPrimary().ProtectionLevel; pl {
-			case rpb.ProtectionLevel_SOFTWARE, rpb.ProtectionLevel_HSM:
-				unwrapOpts := cloudkms.UnwrapOpts{
-					Share:   wrapped.GetShare(),
-					KeyName: strings.TrimPrefix(kek.GetKekUri(), gcpKeyPrefix),
-				}
-				unwrapped.Share, err = cloudkms.UnwrapShare(ctx, kmsClient, unwrapOpts)
-				if err != nil {
-					glog.Errorf("Error unwrapping key sharefor %v: %v", kek.GetKekUri(), err)
-					continue
-				}
+	aad := binary.LittleEndian.AppendUint64(nil, uint64(len(blobID)))
+	aad = append(aad, blobID...)
+	return append(aad, encryptionContext...)
+}
 
-				uri = kek.GetKekUri()
-			case rpb.ProtectionLevel_EXTERNAL:
-				kmd, err := externalKEKMetadata(cryptoKey)
-				if err != nil {
-					return nil, fmt.Errorf("error creating KEK Metadata: %v", err)
-				}
+// kmsClientFactory returns the factory used to create Cloud KMS clients for a
+// single operation, and a function to call once the operation is complete.
+// Clients created by STET are reused across operations until Close is called,
+// except those created for a request ID, which is part of their user agent.
+func (c *StetClient) kmsClientFactory(ctx context.Context) (*cloudkms.ClientFactory, func()) {
+	if c.testKMSClients != nil {
+		return c.testKMSClients, func() { c.testKMSClients.Close() }
+	}
 
-				unwrapped.Share, err = c.ekmSecureSessionUnwrap(ctx, wrapped.GetShare(), *kmd, nil)
-				if err != nil {
-					glog.Warningf("Error unwrapping with external EKM for %v: %v", kmd.uri, err)
-					continue
-				}
-				uri = kmd.uri
-			case rpb.ProtectionLevel_EXTERNAL_VPC:
-				kmd, ekmCerts, err := c.getExternalVPCKeyInfo(ctx, cryptoKey, creds)
-				if err != nil {
-					return nil, fmt.Errorf("error getting external VPC key info: %v", err)
-				}
+	if c.KMSClient != nil {
+		factory := cloudkms.NewStaticClientFactory(c.KMSClient)
+		factory.RateLimiter = c.KMSRateLimiter
+		return factory, func() {}
+	}
 
-				unwrapped.Share, err = c.ekmSecureSessionUnwrap(ctx, wrapped.GetShare(), *kmd, ekmCerts)
-				if err != nil {
-					glog.Errorf("Error unwrapping with external EKM for %v: %v", kmd.uri, err)
-					continue
-				}
+	if id := requestid.FromContext(ctx); id != "" {
+		factory := cloudkms.NewClientFactory(c.Version)
+		factory.RequestID = id
+		factory.RateLimiter = c.KMSRateLimiter
+		return factory, func() { factory.Close() }
+	}
 
-				uri = kmd.uri
-			default:
-				glog.Errorf("Unsupported protection level for %v: %v", kek.GetKekUri(), pl)
-				continue
-			}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-			// Return the URI used: the Cloud KMS one in the case of a software
-			// or HSM key, and the external key URI for an external key.
-			unwrapped.URI = uri
+	if c.kmsClients == nil {
+		c.kmsClients = cloudkms.NewClientFactory(c.Version)
+		c.kmsClients.RateLimiter = c.KMSRateLimiter
+	}
 
-		default:
-			glog.Errorf("Unsupported KekInfo type for %v: %v", kek.GetKekUri(), x)
-			continue
-		}
+	return c.kmsClients, func() {}
+}
 
-		if !shares.ValidateShare(unwrapped.Share, wrapped.GetHash()) {
-			glog.Errorf("Unwrapped share %v does not have the expected hash", i)
-			continue
-		}
+// ErrKEKLocationNotAllowed is returned by Encrypt when a Cloud KMS KEK is in a
+// location not in the EncryptConfig's allowed KEK locations.
+var ErrKEKLocationNotAllowed = errors.New("KEK location not allowed")
 
-		glog.Infof("Successfully unwrapped share %v", unwrapped.URI)
-		unwrappedShares = append(unwrappedShares, unwrapped)
+// checkKEKLocations returns an error if any Cloud KMS KEK of `keyCfg` is in a
+// location not in `allowed`. All locations are allowed if `allowed` is empty.
+func checkKEKLocations(keyCfg *configpb.KeyConfig, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
 	}
 
-	return unwrappedShares, nil
-}
-
-func (c *StetClient) newConfSpaceConfig(stetConfig *configpb.StetConfig) *confidentialspace.Config {
-	if c.testConfspaceConfig != nil {
-		return c.testConfspaceConfig
+	allowedSet := make(map[string]bool, len(allowed))
+	for _, location := range allowed {
+		allowedSet[location] = true
 	}
 
-	if csConfigs := stetConfig.GetConfidentialSpaceConfigs(); csConfigs != nil {
+	for _, kek := range keyCfg.GetKekInfos() {
+		var uris []string
+		switch kek.KekType.(type) {
+		case *configpb.KekInfo_KekUri:
+			uris = append(uris, kek.GetKekUri())
+		case *configpb.KekInfo_TinkKeyset:
+			uris = append(uris, kek.GetTinkKeyset().GetMasterKekUri())
+		}
+		if backup := kek.GetBackupKekUri(); backup != "" {
+			uris = append(uris, backup)
+		}
+
+		for _, uri := range uris {
+			location, err := kekLocation(uri)
+			if err != nil {
+				return fmt.Errorf("unable to determine the location of KEK %v: %v", uri, err)
+			}
+
+			if !allowedSet[location] {
+				return fmt.Errorf("KEK %v is in location %q: %w, want one of %q", uri, location, ErrKEKLocationNotAllowed, allowed)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ErrKEKTimeout is returned when wrapping or unwrapping a share with a Cloud
+// KMS KEK exceeds the StetClient's KEKTimeouts for its protection level.
+var ErrKEKTimeout = errors.New("KEK operation exceeded timeout")
+
+// withKEKTimeout calls fn to wrap or unwrap a share with the KEK identified by
+// kekURI, bounded by the client's KEKTimeouts entry for protection level pl.
+func (c *StetClient) withKEKTimeout(ctx context.Context, kekURI string, pl rpb.ProtectionLevel, fn func(ctx context.Context) ([]byte, string, error)) ([]byte, string, error) {
+	timeout := c.KEKTimeouts[pl]
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	kekCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	blob, uri, err := fn(kekCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(kekCtx.Err(), context.DeadlineExceeded) {
+		return nil, "", fmt.Errorf("%w of %v for %v KEK %v: %v", ErrKEKTimeout, timeout, pl, kekURI, err)
+	}
+
+	return blob, uri, err
+}
+
+// wrapKEKURIShare wraps a single share with the Cloud KMS key identified by
+// kekURI, using a secure session with the EKM if the key is externally
+// protected. It returns the wrapped share and the URI of the key used: the
+// Cloud KMS one in the case of a software or HSM key, and the external key
+// URI for an external key.
+func (c *StetClient) wrapKEKURIShare(ctx context.Context, kmsClients *cloudkms.ClientFactory, kekURI string, share []byte, opts sharesOpts) ([]byte, string, error) {
+	kek := &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: kekURI}}
+
+	// Configure CloudKMS Client, with Confidential Space credentials if applicable.
+	creds := ""
+	if opts.confSpaceConfig != nil {
+		creds = opts.confSpaceConfig.FindMatchingCredentials(kekURI, configpb.CredentialMode_ENCRYPT_ONLY_MODE)
+	}
+
+	kmsClient, err := kmsClients.Client(ctx, creds)
+	if err != nil {
+		return nil, "", fmt.Errorf("error initializing Cloud KMS Client with credentials \"%v\": %v", creds, err)
+	}
+
+	cryptoKey, err := getKekCryptoKeyWithName(ctx, kmsClient, kek, c.kmsResourceName, false)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error retrieving KEK Metadata: %w", err)
+	}
+
+	if err := c.checkKEKImport(ctx, kekURI, cryptoKey, opts.requireImported); err != nil {
+		return nil, "", err
+	}
+
+	pl := cryptoKey.GetPrimary().GetProtectionLevel()
+	done := c.observe(OperationWrap, pl)
+	wrapped, uri, err := c.withKEKTimeout(ctx, kekURI, pl, func(ctx context.Context) ([]byte, string, error) {
+		// Wrap share via KMS.
+		switch pl {
+		case rpb.ProtectionLevel_SOFTWARE, rpb.ProtectionLevel_HSM:
+			keyName, err := c.kmsResourceName(kekURI)
+			if err != nil {
+				return nil, "", err
+			}
+
+			wrapOpts := cloudkms.WrapOpts{
+				Share:   share,
+				KeyName: keyName,
+				AAD:     opts.kekAAD,
+			}
+			wrap := cloudkms.WrapShare
+			if isAsymmetricKEK(cryptoKey) {
+				wrap = cloudkms.AsymmetricWrapShare
+			}
+			wrapped, err := wrap(ctx, kmsClient, wrapOpts)
+			if err != nil {
+				return nil, "", fmt.Errorf("error wrapping key share: %v", err)
+			}
+
+			return wrapped, kekURI, nil
+		case rpb.ProtectionLevel_EXTERNAL:
+			kmd, err := externalKEKMetadata(cryptoKey)
+			if err != nil {
+				return nil, "", fmt.Errorf("error creating KEK Metadata: %v", err)
+			}
+			kmd.skipTLSVerify = opts.skipTLSVerify
+			kmd.sessions = opts.ekmSessions
+
+			// A nil ekmCertPool indicates the host's Root CAs will be used to connect to the EKM.
+			wrapped, err := c.ekmSecureSessionWrap(ctx, share, opts.kekAAD, *kmd, nil)
+			if err != nil {
+				return nil, "", fmt.Errorf("error wrapping with secure session: %w", err)
+			}
+
+			return wrapped, kmd.uri, nil
+		case rpb.ProtectionLevel_EXTERNAL_VPC:
+			kmd, ekmCerts, err := c.getExternalVPCKeyInfo(ctx, cryptoKey, creds)
+			if err != nil {
+				return nil, "", fmt.Errorf("error getting external VPC key info: %v", err)
+			}
+			kmd.skipTLSVerify = opts.skipTLSVerify
+			kmd.sessions = opts.ekmSessions
+
+			wrapped, err := c.ekmSecureSessionWrap(ctx, share, opts.kekAAD, *kmd, ekmCerts)
+			if err != nil {
+				return nil, "", fmt.Errorf("error wrapping with secure session: %w", err)
+			}
+
+			return wrapped, kmd.uri, nil
+		default:
+			return nil, "", fmt.Errorf("unsupported protection level %v", pl)
+		}
+	})
+	done(err)
+
+	return wrapped, uri, err
+}
+
+// meetsProtectionLevel returns whether a KEK with protection level `pl` may be
+// used to unwrap shares under the minimum level `min`.
+func meetsProtectionLevel(pl rpb.ProtectionLevel, min configpb.ShareProtectionLevel) bool {
+	switch min {
+	case configpb.ShareProtectionLevel_ANY_PROTECTION_LEVEL:
+		return true
+	case configpb.ShareProtectionLevel_HSM_PROTECTION_LEVEL:
+		return pl == rpb.ProtectionLevel_HSM || pl == rpb.ProtectionLevel_EXTERNAL || pl == rpb.ProtectionLevel_EXTERNAL_VPC
+	case configpb.ShareProtectionLevel_EXTERNAL_PROTECTION_LEVEL:
+		return pl == rpb.ProtectionLevel_EXTERNAL || pl == rpb.ProtectionLevel_EXTERNAL_VPC
+	default:
+		return false
+	}
+}
+
+// checkKEKProtectionLevel checks that the KEK version with protection level
+// `pl` used for `kekURI` meets the minimum in `opts`.
+func checkKEKProtectionLevel(kekURI string, pl rpb.ProtectionLevel, opts sharesOpts) error {
+	if !meetsProtectionLevel(pl, opts.minProtectionLevel) {
+		return fmt.Errorf("KEK %v has protection level %v, below the minimum %v", kekURI, pl, opts.minProtectionLevel)
+	}
+
+	return nil
+}
+
+// unwrappingKEK returns a Cloud KMS client and the CryptoKey of `kekURI`, for
+// unwrapping shares with it, along with the Confidential Space credentials
+// the client uses. It fails if the KEK is not imported but `opts` requires
+// it. The protection level is left to the caller to check, as the version
+// used to unwrap a share may not be the primary one.
+func (c *StetClient) unwrappingKEK(ctx context.Context, kmsClients *cloudkms.ClientFactory, kekURI string, opts sharesOpts) (cloudkms.Client, *rpb.CryptoKey, string, error) {
+	kek := &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: kekURI}}
+
+	// Configure CloudKMS Client, with Confidential Space credentials if applicable.
+	creds := ""
+	if opts.confSpaceConfig != nil {
+		creds = opts.confSpaceConfig.FindMatchingCredentials(kekURI, configpb.CredentialMode_DECRYPT_ONLY_MODE)
+	}
+
+	kmsClient, err := kmsClients.Client(ctx, creds)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("error initializing Cloud KMS Client with credentials \"%v\": %v", creds, err)
+	}
+
+	cryptoKey, err := getKekCryptoKeyWithName(ctx, kmsClient, kek, c.kmsResourceName, opts.allowDisabledVersions)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("error retrieving KEK Metadata: %w", err)
+	}
+
+	if err := c.checkKEKImport(ctx, kekURI, cryptoKey, opts.requireImported); err != nil {
+		return nil, nil, "", err
+	}
+
+	return kmsClient, cryptoKey, creds, nil
+}
+
+// unwrapKEKURIShare is the inverse of wrapKEKURIShare, returning the unwrapped
+// share, and the URI and protection level of the key used to unwrap it. The
+// share is not unwrapped
+// if the KEK's protection level is below `minLevel`.
+func (c *StetClient) unwrapKEKURIShare(ctx context.Context, kmsClients *cloudkms.ClientFactory, kekURI string, wrappedShare []byte, opts sharesOpts) ([]byte, string, rpb.ProtectionLevel, error) {
+	kmsClient, cryptoKey, creds, err := c.unwrappingKEK(ctx, kmsClients, kekURI, opts)
+	if err != nil {
+		return nil, "", rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED, err
+	}
+
+	// Cloud KMS unwraps shares of symmetric KEKs with the version they were
+	// wrapped with, which may not be the primary one, so its protection level
+	// is only known once unwrapped. Other KEKs use the primary version, or
+	// the one they are pinned to.
+	pl := cryptoKey.GetPrimary().GetProtectionLevel()
+	kmsSymmetric := (pl == rpb.ProtectionLevel_SOFTWARE || pl == rpb.ProtectionLevel_HSM) && !isAsymmetricKEK(cryptoKey)
+	if !kmsSymmetric {
+		if err := checkKEKProtectionLevel(kekURI, pl, opts); err != nil {
+			return nil, "", rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED, err
+		}
+	}
+
+	// If allowed, a disabled KEK version is still attempted, in case it has
+	// since been re-enabled, but its state is reported if unwrapping fails.
+	stateErr := checkKEKVersionState(kekURI, cryptoKey.GetPrimary())
+	if stateErr != nil {
+		c.logger(ctx).Warningf("Attempting to unwrap share with KEK that is not enabled: %v", stateErr)
+	}
+
+	done := c.observe(OperationUnwrap, pl)
+	unwrapped, uri, err := c.withKEKTimeout(ctx, kekURI, pl, func(ctx context.Context) ([]byte, string, error) {
+		// Unwrap share via KMS.
+		switch pl {
+		case rpb.ProtectionLevel_SOFTWARE, rpb.ProtectionLevel_HSM:
+			keyName, err := c.kmsResourceName(kekURI)
+			if err != nil {
+				return nil, "", err
+			}
+
+			// Cloud KMS selects the version to decrypt with from the
+			// ciphertext, so requests name the CryptoKey even if pinned,
+			// except for asymmetric keys, which are always pinned.
+			unwrapOpts := cloudkms.UnwrapOpts{
+				Share:   wrappedShare,
+				KeyName: keyName,
+				AAD:     opts.kekAAD,
+			}
+			if !kmsSymmetric {
+				unwrapped, err := cloudkms.AsymmetricUnwrapShare(ctx, kmsClient, unwrapOpts)
+				if err != nil {
+					return nil, "", fmt.Errorf("error unwrapping key share: %v", err)
+				}
+
+				return unwrapped, kekURI, nil
+			}
+
+			unwrapOpts.KeyName, _ = splitCryptoKeyVersion(keyName)
+			unwrapped, usedPL, err := cloudkms.UnwrapShareWithProtectionLevel(ctx, kmsClient, unwrapOpts)
+			if err != nil {
+				return nil, "", fmt.Errorf("error unwrapping key share: %v", err)
+			}
+
+			// Fall back to the primary version's level if Cloud KMS did not
+			// report the one used.
+			if usedPL != rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED {
+				pl = usedPL
+			}
+			if err := checkKEKProtectionLevel(kekURI, pl, opts); err != nil {
+				return nil, "", err
+			}
+
+			return unwrapped, kekURI, nil
+		case rpb.ProtectionLevel_EXTERNAL:
+			kmd, err := externalKEKMetadata(cryptoKey)
+			if err != nil {
+				return nil, "", fmt.Errorf("error creating KEK Metadata: %v", err)
+			}
+			kmd.skipTLSVerify = opts.skipTLSVerify
+			kmd.sessions = opts.ekmSessions
+
+			unwrapped, err := c.ekmSecureSessionUnwrap(ctx, wrappedShare, opts.kekAAD, *kmd, nil)
+			if err != nil {
+				return nil, "", fmt.Errorf("error unwrapping with external EKM for %v: %w", kmd.uri, err)
+			}
+
+			return unwrapped, kmd.uri, nil
+		case rpb.ProtectionLevel_EXTERNAL_VPC:
+			kmd, ekmCerts, err := c.getExternalVPCKeyInfo(ctx, cryptoKey, creds)
+			if err != nil {
+				return nil, "", fmt.Errorf("error getting external VPC key info: %v", err)
+			}
+			kmd.skipTLSVerify = opts.skipTLSVerify
+			kmd.sessions = opts.ekmSessions
+
+			unwrapped, err := c.ekmSecureSessionUnwrap(ctx, wrappedShare, opts.kekAAD, *kmd, ekmCerts)
+			if err != nil {
+				return nil, "", fmt.Errorf("error unwrapping with external EKM for %v: %w", kmd.uri, err)
+			}
+
+			return unwrapped, kmd.uri, nil
+		default:
+			return nil, "", fmt.Errorf("unsupported protection level %v", pl)
+		}
+	})
+	done(err)
+	if err != nil && stateErr != nil {
+		err = fmt.Errorf("%w (%w)", err, stateErr)
+	}
+
+	return unwrapped, uri, pl, err
+}
+
+// forEachShare calls fn for every index in [0, n), with at most limit calls
+// running concurrently. A limit less than 2 calls fn sequentially.
+func forEachShare(n, limit int, fn func(i int)) {
+	if limit < 2 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// hedgeShares calls fn for the indices in [0, n) in order until `needed` calls
+// have succeeded, keeping `extra` more calls running than are still needed,
+// and starting another call whenever one fails. The context passed to the
+// calls still running is then cancelled. Returns whether each index was not
+// needed: either never called, or failed once enough calls had succeeded.
+func hedgeShares(ctx context.Context, n, needed, extra int, fn func(ctx context.Context, i int) error) []bool {
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result)
+	unneeded := make([]bool, n)
+
+	next, running, succeeded := 0, 0, 0
+	for {
+		for succeeded < needed && running < needed-succeeded+extra && next < n {
+			go func(i int) {
+				results <- result{i, fn(hedgeCtx, i)}
+			}(next)
+			next++
+			running++
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if r.err == nil {
+			succeeded++
+			if succeeded == needed {
+				cancel()
+			}
+		} else if succeeded >= needed {
+			unneeded[r.i] = true
+		}
+	}
+
+	for i := next; i < n; i++ {
+		unneeded[i] = true
+	}
+
+	return unneeded
+}
+
+// kekDescription returns a human-readable description of the KEK, for logs
+// and errors. Not all KEK types have a URI.
+func kekDescription(kek *configpb.KekInfo) string {
+	switch kek.KekType.(type) {
+	case *configpb.KekInfo_KekUri:
+		return fmt.Sprintf("KEK URI %v", kek.GetKekUri())
+	case *configpb.KekInfo_RsaFingerprint:
+		return fmt.Sprintf("RSA fingerprint %v", kek.GetRsaFingerprint())
+	case *configpb.KekInfo_EcFingerprint:
+		return fmt.Sprintf("EC fingerprint %v", kek.GetEcFingerprint())
+	case *configpb.KekInfo_TinkKeyset:
+		return fmt.Sprintf("Tink keyset with master KEK %v", kek.GetTinkKeyset().GetMasterKekUri())
+	default:
+		return "unknown KEK type"
+	}
+}
+
+// kekIdentifiers returns the URIs and fingerprints identifying `kek` in
+// WithAvailableKEKs.
+func kekIdentifiers(kek *configpb.KekInfo) []string {
+	var ids []string
+	switch kek.KekType.(type) {
+	case *configpb.KekInfo_KekUri:
+		ids = append(ids, kek.GetKekUri())
+	case *configpb.KekInfo_RsaFingerprint:
+		ids = append(ids, kek.GetRsaFingerprint())
+	case *configpb.KekInfo_EcFingerprint:
+		ids = append(ids, kek.GetEcFingerprint())
+	case *configpb.KekInfo_TinkKeyset:
+		ids = append(ids, kek.GetTinkKeyset().GetMasterKekUri())
+	}
+
+	if backup := kek.GetBackupKekUri(); backup != "" {
+		ids = append(ids, backup)
+	}
+
+	return ids
+}
+
+// wrapShare encrypts a single share with the given KekInfo, returning the
+// wrapped share and the URIs of any keys used to wrap it.
+func (c *StetClient) wrapShare(ctx context.Context, kmsClients *cloudkms.ClientFactory, share []byte, kek *configpb.KekInfo, opts sharesOpts) (*configpb.WrappedShare, []string, error) {
+	hash, err := shares.HashShareWithAlgorithm(share, opts.hashAlgorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped := &configpb.WrappedShare{
+		Hash:          hash,
+		HashAlgorithm: opts.hashAlgorithm,
+	}
+
+	if kek.GetBackupKekUri() != "" && kek.GetKekUri() == "" {
+		return nil, nil, fmt.Errorf("backup KEKs are only supported for KEK URIs")
+	}
+
+	if kek.GetRsaOaepParams() != nil && kek.GetRsaFingerprint() == "" {
+		return nil, nil, fmt.Errorf("RSA-OAEP parameters are only supported for RSA fingerprints")
+	}
+
+	var keyURIs []string
+	switch x := kek.KekType.(type) {
+	case *configpb.KekInfo_RsaFingerprint:
+		key, err := PublicKeyForRSAFingerprint(kek, opts.asymmetricKeys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find public key for RSA fingerprint: %w", err)
+		}
+
+		if opts.fips {
+			if err := checkFIPSRSAKey(key); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		wrapped.Share, err = rsaWrapShare(opts.random(), key, share, kek.GetRsaOaepParams(), opts.fips)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error wrapping key share: %w", err)
+		}
+		wrapped.RsaOaepParams = kek.GetRsaOaepParams()
+
+	case *configpb.KekInfo_EcFingerprint:
+		key, err := PublicKeyForECFingerprint(kek, opts.asymmetricKeys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find public key for EC fingerprint: %w", err)
+		}
+
+		wrapped.Share, err = eciesWrap(opts.random(), key, share)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error wrapping key share: %v", err)
+		}
+		wrapped.EcCurve = ecdhCurve(key.Curve())
+
+	case *configpb.KekInfo_KekUri:
+		var uri string
+		var err error
+		wrapped.Share, uri, err = c.wrapKEKURIShare(ctx, kmsClients, kek.GetKekUri(), share, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyURIs = append(keyURIs, uri)
+
+		if backupURI := kek.GetBackupKekUri(); backupURI != "" {
+			wrapped.BackupShare, uri, err = c.wrapKEKURIShare(ctx, kmsClients, backupURI, share, opts)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error wrapping share with backup KEK: %v", err)
+			}
+			keyURIs = append(keyURIs, uri)
+		}
+
+	case *configpb.KekInfo_TinkKeyset:
+		primitive, err := c.tinkKeysetAEAD(ctx, kmsClients, kek.GetTinkKeyset(), opts.confSpaceConfig, configpb.CredentialMode_ENCRYPT_ONLY_MODE, opts.fips)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		wrapped.Share, err = primitive.Encrypt(share, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error wrapping key share with Tink keyset: %v", err)
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported KekInfo type: %v", x)
+	}
+
+	if err := c.transformShare(ctx, kek, wrapped); err != nil {
+		return nil, nil, err
+	}
+
+	return wrapped, keyURIs, nil
+}
+
+// wrapShares encrypts the given shares using either the given key URIs or the
+// asymmetric key provided in the corresponding KekInfo struct. It returns a
+// list of wrapped shares, and a list of key URIs used for shares that were
+// wrapped by communicating with an external KMS (these lists might not
+// correspond one-to-one if some shares are wrapped via asymmetric key).
+//
+// If a KekInfo specifies a backup KEK, the share is additionally wrapped with
+// it, and the backup key URI is included in the returned list.
+//
+// Up to opts.concurrency shares are wrapped concurrently.
+func (c *StetClient) wrapShares(ctx context.Context, unwrappedShares [][]byte, opts sharesOpts) (wrappedShares []*configpb.WrappedShare, keyURIs []string, err error) {
+	if len(unwrappedShares) != len(opts.kekInfos) {
+		return nil, nil, fmt.Errorf("number of shares to wrap (%d) does not match number of KEKs (%d)", len(unwrappedShares), len(opts.kekInfos))
+	}
+
+	// Only obtain Cloud KMS clients if a KEK needs them, so that shares can be
+	// wrapped with asymmetric KEKs without network access.
+	var kmsClients *cloudkms.ClientFactory
+	if usesCloudKMS(opts.kekInfos) {
+		var release func()
+		kmsClients, release = opts.kmsClientFactory(ctx, c)
+		defer release()
+	}
+
+	wrapped := make([]*configpb.WrappedShare, len(unwrappedShares))
+	uris := make([][]string, len(unwrappedShares))
+	errs := make([]error, len(unwrappedShares))
+	if opts.timings != nil {
+		opts.timings.PerShare = make([]time.Duration, len(unwrappedShares))
+	}
+	forEachShare(len(unwrappedShares), opts.concurrency, func(i int) {
+		defer opts.timings.startShare(i)()
+		wrapped[i], uris[i], errs[i] = c.wrapShare(ctx, kmsClients, unwrappedShares[i], opts.kekInfos[i], opts)
+	})
+
+	// Preserve share order in the returned lists, and report the error for the
+	// first share that failed. Not every KEK type reports a key URI, so the
+	// URIs do not necessarily correspond to shares by position.
+	for i := range unwrappedShares {
+		if errs[i] != nil {
+			return nil, nil, fmt.Errorf("error wrapping share #%v with %v: %w", i+1, kekDescription(opts.kekInfos[i]), errs[i])
+		}
+
+		wrapped[i].KekIndex = int64(i + 1)
+		wrappedShares = append(wrappedShares, wrapped[i])
+		keyURIs = append(keyURIs, uris[i]...)
+	}
+
+	return wrappedShares, keyURIs, nil
+}
+
+// unwrapWithAnyRSAKey tries to unwrap the share with each private key in
+// `keys`, returning the first unwrapped share that matches the share's hash.
+// In FIPS mode, keys that are not FIPS-approved are skipped.
+func unwrapWithAnyRSAKey(wrapped *configpb.WrappedShare, params *configpb.RsaOaepParams, keys *configpb.AsymmetricKeys, fips bool) ([]byte, error) {
+	if _, err := oaepHash(params, fips); err != nil {
+		return nil, err
+	}
+
+	for _, path := range keys.GetPrivateKeyFiles() {
+		key, err := readRSAPrivateKeyFile(path)
+		if errors.Is(err, errNotRSAPrivateKey) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if fips && checkFIPSRSAKey(&key.PublicKey) != nil {
+			continue
+		}
+
+		share, err := rsaUnwrapShare(key, wrapped.GetShare(), params, fips)
+		if err != nil {
+			continue
+		}
+
+		if shares.ValidateShareWithAlgorithm(share, wrapped.GetHash(), wrapped.GetHashAlgorithm()) {
+			return share, nil
+		}
+	}
+
+	return nil, fmt.Errorf("none of the %v configured RSA private keys unwraps the share", len(keys.GetPrivateKeyFiles()))
+}
+
+// unwrapAndValidateShare decrypts a single wrapped share with the given
+// KekInfo and validates it against its hash. If the KekInfo specifies a backup
+// KEK and unwrapping with the primary KEK fails, the backup copy of the share
+// is unwrapped instead. The protection level of the KEK is returned for KEK
+// URIs, and is unspecified otherwise.
+func (c *StetClient) unwrapAndValidateShare(ctx context.Context, kmsClients *cloudkms.ClientFactory, wrapped *configpb.WrappedShare, kek *configpb.KekInfo, opts sharesOpts) (*shares.UnwrappedShare, rpb.ProtectionLevel, error) {
+	unwrapped := &shares.UnwrappedShare{}
+	pl := rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED
+
+	wrapped, err := c.inverseTransformShare(ctx, kek, wrapped)
+	if err != nil {
+		return nil, pl, err
+	}
+
+	// Only KEK URIs can be HSM or externally protected.
+	if _, ok := kek.KekType.(*configpb.KekInfo_KekUri); !ok && opts.minProtectionLevel != configpb.ShareProtectionLevel_ANY_PROTECTION_LEVEL {
+		return nil, pl, fmt.Errorf("%v is software protected, below the minimum %v", kekDescription(kek), opts.minProtectionLevel)
+	}
+
+	switch x := kek.KekType.(type) {
+	case *configpb.KekInfo_RsaFingerprint:
+		key, err := PrivateKeyForRSAFingerprint(kek, opts.asymmetricKeys)
+		if opts.rsaKeyFallback && errors.Is(err, errNoRSAKeyForFingerprint) {
+			c.logger(ctx).Warningf("No RSA private key has fingerprint %v, trying each configured private key.", kek.GetRsaFingerprint())
+			unwrapped.Share, err = unwrapWithAnyRSAKey(wrapped, shareOAEPParams(wrapped, kek), opts.asymmetricKeys, opts.fips)
+			if err != nil {
+				return nil, pl, fmt.Errorf("error unwrapping key share for RSA fingerprint %v: %w", kek.GetRsaFingerprint(), err)
+			}
+			break
+		}
+		if err != nil {
+			return nil, pl, fmt.Errorf("failed to find private key for RSA fingerprint: %v", err)
+		}
+
+		if opts.fips {
+			if err := checkFIPSRSAKey(&key.PublicKey); err != nil {
+				return nil, pl, err
+			}
+		}
+
+		unwrapped.Share, err = rsaUnwrapShare(key, wrapped.GetShare(), shareOAEPParams(wrapped, kek), opts.fips)
+		if err != nil {
+			return nil, pl, fmt.Errorf("error unwrapping key share: %w", err)
+		}
+
+	case *configpb.KekInfo_EcFingerprint:
+		key, err := PrivateKeyForECFingerprint(kek, opts.asymmetricKeys)
+		if err != nil {
+			return nil, pl, fmt.Errorf("failed to find private key for EC fingerprint: %v", err)
+		}
+
+		if curve := ecdhCurve(key.Curve()); curve != wrapped.GetEcCurve() {
+			return nil, pl, fmt.Errorf("share was wrapped with a %v key, but the private key for EC fingerprint %v is %v", wrapped.GetEcCurve(), kek.GetEcFingerprint(), curve)
+		}
+
+		unwrapped.Share, err = eciesUnwrap(key, wrapped.GetShare())
+		if err != nil {
+			return nil, pl, fmt.Errorf("error unwrapping key share: %v", err)
+		}
+
+	case *configpb.KekInfo_KekUri:
+		var err error
+		unwrapped.Share, unwrapped.URI, pl, err = c.unwrapKEKURIShare(ctx, kmsClients, kek.GetKekUri(), wrapped.GetShare(), opts)
+		if err == nil && !shares.ValidateShareWithAlgorithm(unwrapped.Share, wrapped.GetHash(), wrapped.GetHashAlgorithm()) {
+			err = fmt.Errorf("unwrapped share does not have the expected hash")
+		}
+		if err != nil {
+			backupURI := kek.GetBackupKekUri()
+			if backupURI == "" || len(wrapped.GetBackupShare()) == 0 {
+				return nil, pl, fmt.Errorf("error unwrapping key share for %v: %w", kek.GetKekUri(), err)
+			}
+
+			c.logger(ctx).Errorf("Error unwrapping key share for %v, attempting backup URI %v: %v", kek.GetKekUri(), backupURI, err)
+			unwrapped.Share, unwrapped.URI, pl, err = c.unwrapKEKURIShare(ctx, kmsClients, backupURI, wrapped.GetBackupShare(), opts)
+			if err != nil {
+				return nil, pl, fmt.Errorf("error unwrapping key share for backup %v: %v", backupURI, err)
+			}
+		}
+
+	case *configpb.KekInfo_TinkKeyset:
+		primitive, err := c.tinkKeysetAEAD(ctx, kmsClients, kek.GetTinkKeyset(), opts.confSpaceConfig, configpb.CredentialMode_DECRYPT_ONLY_MODE, opts.fips)
+		if err != nil {
+			return nil, pl, err
+		}
+
+		unwrapped.Share, err = primitive.Decrypt(wrapped.GetShare(), nil)
+		if err != nil {
+			return nil, pl, fmt.Errorf("error unwrapping key share with Tink keyset: %v", err)
+		}
+
+	default:
+		return nil, pl, fmt.Errorf("unsupported KekInfo type for %v: %v", kekDescription(kek), x)
+	}
+
+	if !shares.ValidateShareWithAlgorithm(unwrapped.Share, wrapped.GetHash(), wrapped.GetHashAlgorithm()) {
+		return nil, pl, fmt.Errorf("unwrapped share does not have the expected hash")
+	}
+
+	return unwrapped, pl, nil
+}
+
+// orderSharesByKEK returns the given wrapped shares ordered to correspond to
+// the KekInfos they were wrapped with, based on their KEK indices. Shares
+// without indices are assumed to already be in order.
+func orderSharesByKEK(wrappedShares []*configpb.WrappedShare, numKEKs int) ([]*configpb.WrappedShare, error) {
+	numIndexed := 0
+	for _, wrapped := range wrappedShares {
+		if wrapped.GetKekIndex() != 0 {
+			numIndexed++
+		}
+	}
+
+	if numIndexed == 0 {
+		return wrappedShares, nil
+	}
+
+	if numIndexed != len(wrappedShares) {
+		return nil, fmt.Errorf("inconsistent share indices: %d of %d shares have a KEK index", numIndexed, len(wrappedShares))
+	}
+
+	ordered := make([]*configpb.WrappedShare, numKEKs)
+	for i, wrapped := range wrappedShares {
+		idx := wrapped.GetKekIndex()
+		if idx < 1 || idx > int64(numKEKs) {
+			return nil, fmt.Errorf("inconsistent share indices: share #%d has KEK index %d, want between 1 and %d", i+1, idx, numKEKs)
+		}
+
+		if ordered[idx-1] != nil {
+			return nil, fmt.Errorf("inconsistent share indices: multiple shares have KEK index %d", idx)
+		}
+
+		ordered[idx-1] = wrapped
+	}
+
+	return ordered, nil
+}
+
+// ErrShareNotNeeded is reported for shares that were not unwrapped, or whose
+// unwrapping was cancelled, because enough other shares were unwrapped first.
+// See WithHedgedUnwrap.
+var ErrShareNotNeeded = errors.New("share not needed, as enough shares were unwrapped")
+
+// ErrKEKNotAvailable is reported for shares that were not unwrapped because
+// their KEK was not among those given WithAvailableKEKs.
+var ErrKEKNotAvailable = errors.New("KEK not available to the caller")
+
+// unwrapAndValidateShares decrypts the given wrapped shares based on their
+// KekInfos, returning those that were unwrapped successfully.
+func (c *StetClient) unwrapAndValidateShares(ctx context.Context, wrappedShares []*configpb.WrappedShare, opts sharesOpts) ([]shares.UnwrappedShare, error) {
+	results, err := c.unwrapSharesByIndex(ctx, wrappedShares, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var unwrappedShares []shares.UnwrappedShare
+	for _, unwrapped := range results {
+		if unwrapped != nil {
+			unwrappedShares = append(unwrappedShares, *unwrapped)
+		}
+	}
+
+	return unwrappedShares, nil
+}
+
+// unwrapSharesByIndex decrypts the given wrapped shares based on their
+// KekInfos, returning the unwrapped share for each KekInfo, or nil if it
+// failed. Up to opts.concurrency shares are unwrapped concurrently, unless
+// hedging with opts.hedgeThreshold.
+func (c *StetClient) unwrapSharesByIndex(ctx context.Context, wrappedShares []*configpb.WrappedShare, opts sharesOpts) ([]*shares.UnwrappedShare, error) {
+	if len(wrappedShares) != len(opts.kekInfos) {
+		return nil, fmt.Errorf("number of shares to unwrap (%d) does not match number of KEKs (%d)", len(wrappedShares), len(opts.kekInfos))
+	}
+
+	wrappedShares, err := orderSharesByKEK(wrappedShares, len(opts.kekInfos))
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the shares whose KEKs the caller cannot use.
+	skipped := make([]bool, len(wrappedShares))
+	var availableKEKs []*configpb.KekInfo
+	for i, kek := range opts.kekInfos {
+		skipped[i] = !opts.kekAvailable(kek)
+		if !skipped[i] {
+			availableKEKs = append(availableKEKs, kek)
+		}
+	}
+
+	// Only obtain Cloud KMS clients if a KEK needs them, so that blobs wrapped
+	// only with asymmetric KEKs can be decrypted on air-gapped machines.
+	var kmsClients *cloudkms.ClientFactory
+	if usesCloudKMS(availableKEKs) {
+		var release func()
+		kmsClients, release = opts.kmsClientFactory(ctx, c)
+		defer release()
+	}
+
+	// In order to support k-of-n decryption, don't exit early if share
+	// share unwrapping fails. Attempt to unwrap all shares and just
+	// return the subset of ones that succeeded, and let the Shamir's
+	// implementation handle the subset of shares.
+	results := make([]*shares.UnwrappedShare, len(wrappedShares))
+	levels := make([]rpb.ProtectionLevel, len(wrappedShares))
+	errs := make([]error, len(wrappedShares))
+	if opts.timings != nil {
+		opts.timings.PerShare = make([]time.Duration, len(wrappedShares))
+	}
+	unwrapShare := func(shareCtx context.Context, i int) error {
+		kek := opts.kekInfos[i]
+		if skipped[i] {
+			c.logger(ctx).Infof("Skipping share #%v, as %v is not available", i+1, kekDescription(kek))
+			errs[i] = ErrKEKNotAvailable
+			return errs[i]
+		}
+
+		defer opts.timings.startShare(i)()
+		c.logger(ctx).Infof("Attempting to unwrap share #%v with %v", i+1, kekDescription(kek))
+
+		unwrapped, pl, err := c.unwrapAndValidateShare(shareCtx, kmsClients, wrappedShares[i], kek, opts)
+		levels[i] = pl
+		if err != nil {
+			if shareCtx.Err() != nil && ctx.Err() == nil {
+				c.logger(ctx).Infof("Cancelled unwrapping share #%v, as enough shares were unwrapped", i+1)
+			} else {
+				c.logger(ctx).Errorf("Failed to unwrap share #%v: %v", i+1, err)
+			}
+			errs[i] = err
+			return err
+		}
+
+		c.logger(ctx).Infof("Successfully unwrapped share #%v with %v", i+1, kekDescription(kek))
+		results[i] = unwrapped
+		return nil
+	}
+
+	if opts.hedgeThreshold > 0 {
+		unneeded := hedgeShares(ctx, len(wrappedShares), opts.hedgeThreshold, opts.hedgeExtra, unwrapShare)
+		for i := range unneeded {
+			if unneeded[i] {
+				errs[i] = ErrShareNotNeeded
+			}
+		}
+	} else {
+		forEachShare(len(wrappedShares), opts.concurrency, func(i int) {
+			unwrapShare(ctx, i)
+		})
+	}
+
+	if opts.report != nil {
+		opts.report.Shares = make([]ShareReport, len(wrappedShares))
+		for i := range wrappedShares {
+			opts.report.Shares[i] = ShareReport{Index: i, KEK: kekDescription(opts.kekInfos[i]), ProtectionLevel: levels[i], Err: errs[i]}
+			if results[i] != nil {
+				opts.report.Shares[i].URI = results[i].URI
+			}
+		}
+	}
+
+	// A KEK that is not permitted in FIPS mode is a configuration error, so
+	// fail rather than continuing with the remaining shares.
+	for i, err := range errs {
+		if errors.Is(err, ErrNotFIPSApproved) {
+			return nil, fmt.Errorf("error unwrapping share #%v with %v: %w", i+1, kekDescription(opts.kekInfos[i]), err)
+		}
+	}
+
+	return results, nil
+}
+
+func (c *StetClient) newConfSpaceConfig(stetConfig *configpb.StetConfig) *confidentialspace.Config {
+	if c.testConfspaceConfig != nil {
+		return c.testConfspaceConfig
+	}
+
+	if csConfigs := stetConfig.GetConfidentialSpaceConfigs(); csConfigs != nil {
 		return confidentialspace.NewConfig(csConfigs)
 	}
 
-	return nil
+	return nil
+}
+
+// Encrypt generates a DEK and creates EncryptedData in accordance with the EKM encryption protocol.
+func (c *StetClient) Encrypt(ctx context.Context, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig, blobID string, opts ...CallOption) (*StetMetadata, error) {
+	return c.EncryptWithSidecar(ctx, input, output, output, stetConfig, blobID, opts...)
+}
+
+// EncryptWithSidecar is like Encrypt, but writes the STET header and metadata
+// to metadataOutput and the ciphertext to ciphertextOutput, for storage layouts
+// that keep them separately. The ciphertext remains bound to the metadata, so
+// both must be provided to DecryptWithSidecar to decrypt.
+func (c *StetClient) EncryptWithSidecar(ctx context.Context, input io.Reader, metadataOutput, ciphertextOutput io.Writer, stetConfig *configpb.StetConfig, blobID string, opts ...CallOption) (*StetMetadata, error) {
+	callOpts := c.newCallOptions(opts)
+
+	config := stetConfig.GetEncryptConfig()
+	if config == nil {
+		return nil, fmt.Errorf("nil EncryptConfig passed to Encrypt()")
+	}
+
+	if err := shares.CheckShareCount(config.GetKeyConfig()); err != nil {
+		return nil, err
+	}
+
+	var md *StetMetadata
+	if callOpts.dekPool != nil {
+		doneDEK := callOpts.timings.start(dekPhase)
+		dek, err := callOpts.dekPool.get(config.GetKeyConfig())
+		doneDEK()
+		if err != nil {
+			return nil, err
+		}
+		defer dek.zero()
+
+		md, err = c.encryptWithShares(ctx, dek.key, dek.shares, input, metadataOutput, ciphertextOutput, stetConfig, config.GetKeyConfig(), blobID, callOpts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dek, err := callOpts.newDEK()
+		if err != nil {
+			return nil, err
+		}
+
+		md, err = c.encryptWithDEK(ctx, dek, input, metadataOutput, ciphertextOutput, stetConfig, config.GetKeyConfig(), blobID, callOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	md.EKMSessions = callOpts.ekmSessions.list()
+	return callOpts.attachTimings(md), nil
+}
+
+// encryptWithDEK splits `dataEncryptionKey` according to `keyCfg`, wraps the
+// shares, and encrypts `input` with it, writing the STET header and metadata
+// to metadataOutput and the ciphertext to ciphertextOutput.
+func (c *StetClient) encryptWithDEK(ctx context.Context, dataEncryptionKey shares.DEK, input io.Reader, metadataOutput, ciphertextOutput io.Writer, stetConfig *configpb.StetConfig, keyCfg *configpb.KeyConfig, blobID string, callOpts *callOptions) (*StetMetadata, error) {
+	doneDEK := callOpts.timings.start(dekPhase)
+	dekShares, err := callOpts.createDEKShares(dataEncryptionKey, keyCfg)
+	doneDEK()
+	if err != nil {
+		return nil, fmt.Errorf("error creating DEK shares: %v", err)
+	}
+
+	return c.encryptWithShares(ctx, dataEncryptionKey, dekShares, input, metadataOutput, ciphertextOutput, stetConfig, keyCfg, blobID, callOpts)
 }
 
-// Encrypt generates a DEK and creates EncryptedData in accordance with the EKM encryption protocol.
-func (c *StetClient) Encrypt(ctx context.Context, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig, blobID string) (*StetMetadata, error) {
-	config := stetConfig.GetEncryptConfig()
-	if config == nil {
-		return nil, fmt.Errorf("nil EncryptConfig passed to Encrypt()")
+// encryptWithShares is like encryptWithDEK, but with `dataEncryptionKey`
+// already split into `shares` according to `keyCfg`.
+func (c *StetClient) encryptWithShares(ctx context.Context, dataEncryptionKey shares.DEK, shares [][]byte, input io.Reader, metadataOutput, ciphertextOutput io.Writer, stetConfig *configpb.StetConfig, keyCfg *configpb.KeyConfig, blobID string, callOpts *callOptions) (*StetMetadata, error) {
+	blob, err := c.newBlobMetadata(ctx, dataEncryptionKey, shares, stetConfig, keyCfg, blobID, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sealBlob(dataEncryptionKey, blob.metadata, blob.segmentSize, blob.formatVersion, input, metadataOutput, ciphertextOutput, callOpts); err != nil {
+		return nil, err
+	}
+
+	return &StetMetadata{
+		KeyUris:    blob.keyURIs,
+		BlobID:     blob.metadata.GetBlobId(),
+		Extensions: copyExtensions(blob.metadata.GetExtensions()),
+	}, nil
+}
+
+// blobMetadata is the metadata of a blob being encrypted, with its shares
+// wrapped, and the parameters for encrypting its ciphertext.
+type blobMetadata struct {
+	metadata      *configpb.Metadata
+	segmentSize   int64
+	formatVersion uint8
+	// The URIs of the KEKs used to wrap the shares.
+	keyURIs []string
+}
+
+// newBlobMetadata creates the metadata for a blob encrypted with
+// `dataEncryptionKey`, wrapping its `shares` according to `keyCfg`.
+func (c *StetClient) newBlobMetadata(ctx context.Context, dataEncryptionKey shares.DEK, shares [][]byte, stetConfig *configpb.StetConfig, keyCfg *configpb.KeyConfig, blobID string, callOpts *callOptions) (*blobMetadata, error) {
+	if c.FIPSMode {
+		if err := checkFIPSKeyConfig(keyCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkKEKLocations(keyCfg, stetConfig.GetEncryptConfig().GetAllowedKekLocations()); err != nil {
+		return nil, err
 	}
 
-	keyCfg := config.GetKeyConfig()
-	dataEncryptionKey := shares.NewDEK()
-	shares, err := shares.CreateDEKShares(dataEncryptionKey, keyCfg)
+	formatVersion, err := encryptFormatVersion(keyCfg, callOpts)
 	if err != nil {
-		return nil, fmt.Errorf("error creating DEK shares: %v", err)
+		return nil, err
 	}
 
 	// Set blob ID if specified, otherwise generate UUID.
-	if blobID == "" {
-		blobID = uuid.NewString()
+	blobID, err = c.newBlobID(blobID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the signer before wrapping any shares.
+	if callOpts.signer != nil {
+		if err := checkSigner(callOpts.signer); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkExtensions(callOpts.extensions); err != nil {
+		return nil, err
 	}
 
 	// Create metadata.
-	metadata := &configpb.Metadata{BlobId: blobID, KeyConfig: keyCfg}
+	metadata := &configpb.Metadata{BlobId: blobID, KeyConfig: keyCfg, Extensions: copyExtensions(callOpts.extensions)}
+	// Readers of version 1 know neither AAD versions nor the salt and split
+	// scheme, so they can only be added to newer blobs.
+	if formatVersion >= FormatVersion2 {
+		metadata.AadVersion = aadVersion
+		metadata.AadSalt, err = callOpts.newAADSalt()
+		if err != nil {
+			return nil, err
+		}
+
+		metadata.SplitScheme, err = splitScheme(keyCfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if callOpts.provenance {
+		metadata.Provenance = &configpb.Provenance{
+			CreateTime:  timestamppb.Now(),
+			StetVersion: c.Version,
+		}
+	}
+	if callOpts.keyCommitment {
+		metadata.KeyCommitment = keyCommitment(dataEncryptionKey)
+	}
+
+	segmentSize := int64(aeadSegmentSize)
+	if size := callOpts.encryptSegmentSize(); size != 0 {
+		if err := checkSegmentSize(size); err != nil {
+			return nil, err
+		}
+		segmentSize = size
+		metadata.SegmentSize = segmentSize
+	}
 
 	var keyURIs []string
-	opts := sharesOpts{
+	shareOpts := sharesOpts{
 		kekInfos:        keyCfg.GetKekInfos(),
 		asymmetricKeys:  stetConfig.GetAsymmetricKeys(),
 		confSpaceConfig: c.newConfSpaceConfig(stetConfig),
+		concurrency:     callOpts.concurrentShareLimit,
+		fips:            c.FIPSMode,
+		hashAlgorithm:   callOpts.shareHashAlgorithm,
+		requireImported: callOpts.requireImportedKEKs,
+		kekAAD:          shareContextAAD(blobID, callOpts.shareContext),
+		kmsClients:      callOpts.kmsClients,
+		timings:         callOpts.timings,
+		skipTLSVerify:   callOpts.insecureSkipVerify,
+		ekmSessions:     callOpts.ekmSessions,
+		rand:            callOpts.rand,
+	}
+
+	doneShares := callOpts.timings.start(sharesPhase)
+	metadata.Shares, keyURIs, err = c.wrapShares(ctx, shares, shareOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping shares: %w", err)
+	}
+
+	if callOpts.verifyWrap {
+		// Only time the wrapping of each share.
+		verifyOpts := shareOpts
+		verifyOpts.timings = nil
+		if err := c.verifyWrappedShares(ctx, dataEncryptionKey, metadata.GetShares(), keyCfg, verifyOpts); err != nil {
+			return nil, fmt.Errorf("error verifying wrapped shares: %w", err)
+		}
 	}
+	doneShares()
 
-	metadata.Shares, keyURIs, err = c.wrapShares(ctx, shares, opts)
+	return &blobMetadata{
+		metadata:      metadata,
+		segmentSize:   segmentSize,
+		formatVersion: formatVersion,
+		keyURIs:       keyURIs,
+	}, nil
+}
+
+// verifyWrappedShares unwraps the just-wrapped shares with the same options
+// they were wrapped with, and checks that enough of them unwrap to
+// reconstruct `dataEncryptionKey`.
+func (c *StetClient) verifyWrappedShares(ctx context.Context, dataEncryptionKey shares.DEK, wrappedShares []*configpb.WrappedShare, keyCfg *configpb.KeyConfig, opts sharesOpts) error {
+	unwrappedShares, err := c.unwrapAndValidateShares(ctx, wrappedShares, opts)
 	if err != nil {
-		return nil, fmt.Errorf("error wrapping shares: %v", err)
+		return err
+	}
+
+	if err := enoughUnwrappedShares(unwrappedShares, keyCfg); err != nil {
+		return fmt.Errorf("not enough shares unwrapped to reconstruct DEK, see logs for unwrap details: %v", err)
+	}
+
+	var combinedDEK shares.DEK
+	if err := shares.CombineUnwrappedSharesInto(keyCfg, unwrappedShares, combinedDEK[:]); err != nil {
+		return fmt.Errorf("error combining unwrapped shares: %v", err)
+	}
+
+	if subtle.ConstantTimeCompare(combinedDEK[:], dataEncryptionKey[:]) != 1 {
+		return fmt.Errorf("unwrapped shares reconstruct a different DEK")
+	}
+
+	return nil
+}
+
+// sealBlob encrypts `input` with `dataEncryptionKey` under the AAD of
+// `metadata`, whose shares are already wrapped, writing the STET header and
+// metadata to metadataOutput and the ciphertext to ciphertextOutput. If
+// requested by `callOpts`, the integrity manifest is added to the metadata
+// and the blob is signed.
+func sealBlob(dataEncryptionKey shares.DEK, metadata *configpb.Metadata, segmentSize int64, formatVersion uint8, input io.Reader, metadataOutput, ciphertextOutput io.Writer, callOpts *callOptions) error {
+	// If signing, hash everything written to the outputs, in order.
+	var blobHash hash.Hash
+	if callOpts.signer != nil {
+		if err := checkSigner(callOpts.signer); err != nil {
+			return err
+		}
+
+		blobHash = sha256.New()
+		metadataOutput = io.MultiWriter(metadataOutput, blobHash)
+		ciphertextOutput = io.MultiWriter(ciphertextOutput, blobHash)
+	}
+
+	// If framing, write the ciphertext in chunks, so that its end is marked.
+	var framed *framedWriter
+	if callOpts.framing {
+		framed = &framedWriter{w: ciphertextOutput}
+		ciphertextOutput = framed
 	}
 
 	// Create AAD from metadata.
+	doneMetadata := callOpts.timings.start(metadataPhase)
 	aad, err := MetadataToAAD(metadata)
+	doneMetadata()
 	if err != nil {
-		return nil, fmt.Errorf("error serializing metadata: %v", err)
+		return fmt.Errorf("error serializing metadata: %v", err)
+	}
+
+	// If requested, encrypt into a buffer first to compute the integrity
+	// manifest, as it must be written in the metadata before the ciphertext.
+	// The buffer is pre-sized from the size hint, if any, but grows as needed
+	// if the hint is too small.
+	var ciphertext *bytes.Buffer
+	if callOpts.integrityManifest {
+		doneAEAD := callOpts.timings.start(aeadPhase)
+		ciphertext = new(bytes.Buffer)
+		if callOpts.hasSizeHint && callOpts.sizeHint >= 0 {
+			ciphertext.Grow(sizeHintPrealloc(ciphertextSize(callOpts.sizeHint, segmentSize)))
+		}
+		hasher := newFrameHasher(segmentSize)
+		if err := aeadEncryptFrom(callOpts.rand, callOpts.aeadWorkers, dataEncryptionKey, segmentSize, input, io.MultiWriter(ciphertext, hasher), aad); err != nil {
+			return fmt.Errorf("error encrypting data: %v", err)
+		}
+
+		metadata.IntegrityManifest = hasher.manifest()
+		metadata.IntegrityManifest.Mac = manifestMAC(dataEncryptionKey, metadata.GetBlobId(), metadata.GetIntegrityManifest())
+		doneAEAD()
+	}
+
+	// Write the header and metadata to `metadataOutput`.
+	doneMetadata = callOpts.timings.start(metadataPhase)
+	if err := writeMetadata(metadataOutput, metadata, formatVersion, callOpts); err != nil {
+		return err
+	}
+	doneMetadata()
+
+	doneAEAD := callOpts.timings.start(aeadPhase)
+	if ciphertext != nil {
+		if _, err := ciphertext.WriteTo(ciphertextOutput); err != nil {
+			return fmt.Errorf("failed to write ciphertext: %v", err)
+		}
+	} else {
+		// Pass `ciphertextOutput` to the AEAD encryption function to write the ciphertext.
+		if err := aeadEncryptFrom(callOpts.rand, callOpts.aeadWorkers, dataEncryptionKey, segmentSize, input, ciphertextOutput, aad); err != nil {
+			return fmt.Errorf("error encrypting data: %v", err)
+		}
+	}
+	if framed != nil {
+		if err := framed.Close(); err != nil {
+			return fmt.Errorf("failed to write ciphertext: %v", err)
+		}
+	}
+	doneAEAD()
+
+	if blobHash != nil {
+		signature, err := signDigest(callOpts.signer, blobHash.Sum(nil))
+		if err != nil {
+			return err
+		}
+
+		if _, err := callOpts.signatureOutput.Write(signature); err != nil {
+			return fmt.Errorf("failed to write signature: %v", err)
+		}
 	}
 
-	// Marshal the metadata into serialized bytes.
-	metadataBytes, err := proto.Marshal(metadata)
+	return nil
+}
+
+// writeMetadata serializes `metadata` and writes it to `output` after a STET
+// header of `formatVersion`.
+func writeMetadata(output io.Writer, metadata *configpb.Metadata, formatVersion uint8, callOpts *callOptions) error {
+	metadataBytes, err := marshalMetadata(metadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to serialize metadata: %v", err)
+		return fmt.Errorf("failed to serialize metadata: %v", err)
+	}
+
+	if len(metadataBytes) > math.MaxUint16 {
+		return fmt.Errorf("serialized metadata is %v bytes, exceeding the maximum of %v", len(metadataBytes), math.MaxUint16)
+	}
+
+	if callOpts.maxMetadataSize > 0 && len(metadataBytes) > callOpts.maxMetadataSize {
+		return fmt.Errorf("serialized metadata with %v wrapped shares is %v bytes, exceeding the configured maximum of %v", len(metadata.GetShares()), len(metadataBytes), callOpts.maxMetadataSize)
 	}
 
-	// Write the header and metadata to `output`.
-	if err := WriteSTETHeader(output, len(metadataBytes)); err != nil {
-		return nil, fmt.Errorf("failed to write encrypted file header: %v", err)
+	if err := writeSTETHeader(output, len(metadataBytes), formatVersion); err != nil {
+		return fmt.Errorf("failed to write encrypted file header: %v", err)
 	}
 
 	if _, err := output.Write(metadataBytes); err != nil {
-		return nil, fmt.Errorf("failed to write metadata: %v", err)
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+
+	return nil
+}
+
+// maxSizeHintPrealloc caps the buffer pre-allocated from a size hint, so that
+// a wildly wrong hint cannot exhaust memory before any input is read.
+const maxSizeHintPrealloc = 64 << 20
+
+// sizeHintPrealloc returns the number of bytes to pre-allocate for a buffer
+// expected to hold `size` bytes.
+func sizeHintPrealloc(size int64) int {
+	if size < 0 {
+		return 0
+	}
+	if size > maxSizeHintPrealloc {
+		return maxSizeHintPrealloc
 	}
+	return int(size)
+}
 
-	// Pass `output` to the AEAD encryption function to write the ciphertext.
-	if err := AeadEncrypt(dataEncryptionKey, input, output, aad); err != nil {
-		return nil, fmt.Errorf("error encrypting data: %v", err)
+// sizeHintSegmentSize returns the segment size to encrypt a plaintext expected
+// to be `size` bytes with, or zero for the default: the smallest multiple of
+// aeadMinSegmentSize whose first segment holds the whole plaintext, if that is
+// below the default, so that no larger segment buffers are allocated than the
+// plaintext needs.
+func sizeHintSegmentSize(size int64) int64 {
+	if size < 0 || size >= aeadSegmentSize {
+		return 0
 	}
 
-	return &StetMetadata{
-		KeyUris: keyURIs,
-		BlobID:  metadata.GetBlobId(),
-	}, nil
+	needed := size + aeadFirstSegmentOffset + aeadHeaderSize + aeadTagSize
+	segmentSize := (needed + aeadMinSegmentSize - 1) / aeadMinSegmentSize * aeadMinSegmentSize
+	if segmentSize >= aeadSegmentSize {
+		return 0
+	}
 
+	return segmentSize
 }
 
 // Returns whether the number of unwrapped shares is sufficient for combining the DEK based
@@ -591,80 +2194,425 @@ func enoughUnwrappedShares(shares []shares.UnwrappedShare, config *configpb.KeyC
 	}
 
 	// Otherwise, verify the number of shares is enough for the specified shamir threshold.
+	if threshold := shareThreshold(config); numShares < threshold {
+		return fmt.Errorf("number of unwrapped shares %v is less than threshold needed %v", numShares, threshold)
+	}
+
+	return nil
+}
+
+// shareThreshold returns the number of shares needed to recombine the DEK
+// under the given KeyConfig.
+func shareThreshold(config *configpb.KeyConfig) int {
 	if _, ok := config.GetKeySplittingAlgorithm().(*configpb.KeyConfig_Shamir); ok {
-		if int64(numShares) < config.GetShamir().GetThreshold() {
-			return fmt.Errorf("number of unwrapped shares %v is less than threshold needed %v", numShares, config.GetShamir().GetThreshold())
+		return int(config.GetShamir().GetThreshold())
+	}
+
+	return 1
+}
+
+// validateBlobKeyConfig checks that the KeyConfig embedded in `metadata` is
+// consistent with its shares, for use in place of a DecryptConfig.
+func validateBlobKeyConfig(metadata *configpb.Metadata) error {
+	keyCfg := metadata.GetKeyConfig()
+	if keyCfg == nil {
+		return fmt.Errorf("blob metadata has no KeyConfig")
+	}
+
+	numKEKs := len(keyCfg.GetKekInfos())
+	if numKEKs != len(metadata.GetShares()) {
+		return fmt.Errorf("blob KeyConfig has %v KEKs, but the blob has %v shares", numKEKs, len(metadata.GetShares()))
+	}
+
+	switch keyCfg.GetKeySplittingAlgorithm().(type) {
+	case *configpb.KeyConfig_NoSplit:
+		if numKEKs != 1 {
+			return fmt.Errorf("blob KeyConfig has %v KEKs, but 'no split' requires exactly 1", numKEKs)
+		}
+	case *configpb.KeyConfig_Shamir:
+		shamir := keyCfg.GetShamir()
+		if shamir.GetShares() != int64(numKEKs) || shamir.GetThreshold() < 1 || shamir.GetThreshold() > shamir.GetShares() {
+			return fmt.Errorf("blob KeyConfig has invalid Shamir configuration (threshold %v, shares %v) for %v KEKs", shamir.GetThreshold(), shamir.GetShares(), numKEKs)
 		}
+	default:
+		return fmt.Errorf("blob KeyConfig has unknown key splitting algorithm")
 	}
 
 	return nil
 }
 
-// Decrypt writes the decrypted data to the `output` writer, and returns the
-// key URIs used during decryption and the blob ID decrypted.
-func (c *StetClient) Decrypt(ctx context.Context, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig) (*StetMetadata, error) {
-	config := stetConfig.GetDecryptConfig()
-	if config == nil {
-		return nil, fmt.Errorf("nil DecryptConfig passed to Decrypt()")
+// matchKeyConfig returns the KeyConfig to decrypt the blob with `metadata`
+// with: the matching one in the DecryptConfig of `stetConfig`, or the one
+// embedded in the blob WithBlobKeyConfig.
+func (c *StetClient) matchKeyConfig(metadata *configpb.Metadata, stetConfig *configpb.StetConfig, callOpts *callOptions) (*configpb.KeyConfig, error) {
+	var matchingKeyConfig *configpb.KeyConfig
+
+	if callOpts.blobKeyConfig {
+		if err := validateBlobKeyConfig(metadata); err != nil {
+			return nil, err
+		}
+		matchingKeyConfig = metadata.GetKeyConfig()
+	} else {
+		config := stetConfig.GetDecryptConfig()
+		if config == nil {
+			return nil, fmt.Errorf("nil DecryptConfig passed to Decrypt()")
+		}
+
+		for _, keyCfg := range config.GetKeyConfigs() {
+			if proto.Equal(keyCfg, metadata.GetKeyConfig()) {
+				matchingKeyConfig = keyCfg
+				break
+			}
+		}
+
+		if matchingKeyConfig == nil {
+			return nil, fmt.Errorf("no known KeyConfig matches given data")
+		}
+	}
+
+	if c.FIPSMode {
+		if err := checkFIPSKeyConfig(matchingKeyConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return matchingKeyConfig, nil
+}
+
+// decryptSharesOpts returns the options to unwrap the shares of the blob with
+// `metadata`, wrapped according to `keyCfg`.
+func (c *StetClient) decryptSharesOpts(metadata *configpb.Metadata, keyCfg *configpb.KeyConfig, stetConfig *configpb.StetConfig, callOpts *callOptions) sharesOpts {
+	return sharesOpts{
+		kekInfos:           keyCfg.GetKekInfos(),
+		asymmetricKeys:     stetConfig.GetAsymmetricKeys(),
+		confSpaceConfig:    c.newConfSpaceConfig(stetConfig),
+		concurrency:        callOpts.concurrentShareLimit,
+		fips:               c.FIPSMode,
+		minProtectionLevel: stetConfig.GetDecryptConfig().GetMinShareProtectionLevel(),
+		requireImported:    callOpts.requireImportedKEKs,
+		rsaKeyFallback:     callOpts.rsaKeyFallback,
+		kekAAD:             shareContextAAD(metadata.GetBlobId(), callOpts.shareContext),
+		timings:            callOpts.timings,
+		skipTLSVerify:      callOpts.insecureSkipVerify,
+		ekmSessions:        callOpts.ekmSessions,
+		rand:               callOpts.rand,
+
+		allowDisabledVersions: callOpts.disabledKEKVersions,
+		availableKEKs:         callOpts.availableKEKs,
 	}
+}
 
-	metadata, err := ReadMetadata(input)
+// splitScheme returns the name of the key splitting scheme that DEKs are split
+// with for `keyCfg`, to record in the metadata.
+func splitScheme(keyCfg *configpb.KeyConfig) (string, error) {
+	scheme, err := shares.SchemeForKeyConfig(keyCfg)
 	if err != nil {
-		return nil, fmt.Errorf("error reading metadata: %v", err)
+		return "", err
 	}
 
-	// Find matching KeyConfig.
-	var matchingKeyConfig *configpb.KeyConfig
+	return scheme.Name(), nil
+}
 
-	for _, keyCfg := range config.GetKeyConfigs() {
-		if proto.Equal(keyCfg, metadata.GetKeyConfig()) {
-			matchingKeyConfig = keyCfg
-			break
+// combineDEK reconstructs the DEK of the blob with `metadata` from the shares
+// unwrapped according to `keyCfg`, with the split scheme recorded in the
+// metadata, if any, and checks it against the blob's key commitment, if any.
+func combineDEK(metadata *configpb.Metadata, keyCfg *configpb.KeyConfig, unwrappedShares []shares.UnwrappedShare) (shares.DEK, error) {
+	var combinedDEK shares.DEK
+	if err := shares.CombineUnwrappedSharesWithScheme(metadata.GetSplitScheme(), keyCfg, unwrappedShares, combinedDEK[:]); err != nil {
+		return shares.DEK{}, fmt.Errorf("error combining unwrapped shares: %v", err)
+	}
+
+	if commitment := metadata.GetKeyCommitment(); len(commitment) != 0 {
+		if err := checkKeyCommitment(combinedDEK, commitment); err != nil {
+			return shares.DEK{}, err
 		}
 	}
 
-	if matchingKeyConfig == nil {
-		return nil, fmt.Errorf("no known KeyConfig matches given data")
+	return combinedDEK, nil
+}
+
+// recoverDEK finds the KeyConfig in the DecryptConfig of `stetConfig` that
+// matches `metadata`, then unwraps its shares and recombines the DEK. If the
+// call was made WithBlobKeyConfig, the KeyConfig embedded in `metadata` is
+// used instead, and the DecryptConfig is not consulted.
+func (c *StetClient) recoverDEK(ctx context.Context, metadata *configpb.Metadata, stetConfig *configpb.StetConfig, callOpts *callOptions) (shares.DEK, []shares.UnwrappedShare, error) {
+	// Unwrapping is always reported, so that the shares combined into the DEK
+	// can be logged.
+	report := callOpts.decryptReport
+	if report == nil {
+		report = &DecryptReport{}
+	}
+	*report = DecryptReport{}
+
+	matchingKeyConfig, err := c.matchKeyConfig(metadata, stetConfig, callOpts)
+	if err != nil {
+		return shares.DEK{}, nil, err
 	}
 
 	// Unwrap shares and validate.
-	opts := sharesOpts{
-		kekInfos:        matchingKeyConfig.GetKekInfos(),
-		asymmetricKeys:  stetConfig.GetAsymmetricKeys(),
-		confSpaceConfig: c.newConfSpaceConfig(stetConfig),
+	shareOpts := c.decryptSharesOpts(metadata, matchingKeyConfig, stetConfig, callOpts)
+	shareOpts.report = report
+
+	// Fail without unwrapping any shares if too few KEKs are available.
+	numAvailable := 0
+	for _, kek := range matchingKeyConfig.GetKekInfos() {
+		if shareOpts.kekAvailable(kek) {
+			numAvailable++
+		}
+	}
+	if threshold := shareThreshold(matchingKeyConfig); numAvailable < threshold {
+		return shares.DEK{}, nil, fmt.Errorf("only %v of %v KEKs are available, but %v shares are needed to recombine the DEK", numAvailable, len(matchingKeyConfig.GetKekInfos()), threshold)
+	}
+
+	if callOpts.hedgedUnwrap {
+		shareOpts.hedgeThreshold = shareThreshold(matchingKeyConfig)
+		shareOpts.hedgeExtra = callOpts.hedgeExtra
 	}
 
-	unwrappedShares, err := c.unwrapAndValidateShares(ctx, metadata.GetShares(), opts)
+	doneShares := callOpts.timings.start(sharesPhase)
+	unwrappedShares, err := c.unwrapAndValidateShares(ctx, metadata.GetShares(), shareOpts)
+	doneShares()
 	if err != nil {
-		return nil, fmt.Errorf("error unwrapping and validating shares: %v", err)
+		return shares.DEK{}, nil, fmt.Errorf("error unwrapping and validating shares: %w", err)
 	}
 
 	// Verify we have enough unwrapped shares for the key config.
 	if err := enoughUnwrappedShares(unwrappedShares, matchingKeyConfig); err != nil {
-		return nil, fmt.Errorf("not enough unwrapped shares to recombine DEK, see logs for unwrap details: %v", err)
-	} else if len(unwrappedShares) < len(matchingKeyConfig.GetKekInfos()) {
-		glog.Warningf("Recieved enough unwrapped shares to recombine DEK, but not all shares unwrapped successfully: %v of %v unwrapped, see logs for unwrap details.", len(unwrappedShares), len(matchingKeyConfig.GetKekInfos()))
+		return shares.DEK{}, nil, fmt.Errorf("not enough unwrapped shares to recombine DEK, see logs for unwrap details: %v", err)
+	} else if !callOpts.hedgedUnwrap && len(unwrappedShares) < numAvailable {
+		c.logger(ctx).Warningf("Recieved enough unwrapped shares to recombine DEK, but not all shares unwrapped successfully: %v of %v unwrapped, see logs for unwrap details.", len(unwrappedShares), numAvailable)
 	}
 
-	combinedShares, err := shares.CombineUnwrappedShares(matchingKeyConfig, unwrappedShares)
+	// Only the threshold number of shares is combined, the first in KEK
+	// order; any others were unwrapped but are not needed.
+	combinedShares := unwrappedShares[:shareThreshold(matchingKeyConfig)]
+
+	doneDEK := callOpts.timings.start(dekPhase)
+	combinedDEK, err := combineDEK(metadata, matchingKeyConfig, combinedShares)
+	doneDEK()
 	if err != nil {
-		return nil, fmt.Errorf("error combining unwrapped shares: %v", err)
+		return shares.DEK{}, nil, err
 	}
 
-	var combinedDEK shares.DEK
-	copy(combinedDEK[:], combinedShares)
+	report.Reconstructed = true
+	report.markCombined(len(combinedShares))
+	c.logCombinedShares(ctx, metadata.GetBlobId(), report)
+
+	return combinedDEK, unwrappedShares, nil
+}
+
+// markCombined records in the report that the first `n` successfully
+// unwrapped shares were combined, and which shares were unused or skipped.
+func (r *DecryptReport) markCombined(n int) {
+	for i := range r.Shares {
+		share := &r.Shares[i]
+		switch {
+		case errors.Is(share.Err, ErrKEKNotAvailable) || errors.Is(share.Err, ErrShareNotNeeded):
+			r.Skipped = append(r.Skipped, share.Index)
+		case share.Err != nil:
+			// Shares that failed to unwrap are neither unused nor skipped.
+		case n > 0:
+			share.Combined = true
+			n--
+		default:
+			r.Unused = append(r.Unused, share.Index)
+		}
+	}
+}
+
+// logCombinedShares logs which shares were combined to reconstruct the DEK of
+// the given blob, and the keys that unwrapped them, so that incident response
+// can determine which KEKs each decryption exercised. Shares that were
+// unwrapped but not combined are logged as unused.
+func (c *StetClient) logCombinedShares(ctx context.Context, blobID string, report *DecryptReport) {
+	var combined []string
+	for _, share := range report.Shares {
+		if !share.Combined {
+			continue
+		}
+
+		desc := fmt.Sprintf("#%v (%v", share.Index+1, share.KEK)
+		if share.URI != "" {
+			desc += fmt.Sprintf(", unwrapped with %v", share.URI)
+		}
+		if share.ProtectionLevel != rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED {
+			desc += fmt.Sprintf(", protection level %v", share.ProtectionLevel)
+		}
+		combined = append(combined, desc+")")
+	}
+
+	c.logger(ctx).Infof("Reconstructed DEK of blob %q from %v of %v shares: %v", blobID, len(combined), len(report.Shares), strings.Join(combined, ", "))
+
+	if len(report.Unused) > 0 {
+		var unused []string
+		for _, i := range report.Unused {
+			unused = append(unused, fmt.Sprintf("#%v (%v)", i+1, report.Shares[i].KEK))
+		}
+		c.logger(ctx).Infof("Shares unwrapped but not needed to reconstruct the DEK of blob %q: %v", blobID, strings.Join(unused, ", "))
+	}
+}
+
+// Decrypt writes the decrypted data to the `output` writer, and returns the
+// key URIs used during decryption and the blob ID decrypted.
+//
+// The ciphertext is authenticated one segment at a time, and a segment's
+// plaintext is only written to `output` once it has been authenticated. If
+// the ciphertext has been tampered with, Decrypt fails at the first modified
+// segment without reading the rest of the input, but `output` may already
+// contain the plaintext of the preceding segments.
+func (c *StetClient) Decrypt(ctx context.Context, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig, opts ...CallOption) (*StetMetadata, error) {
+	return c.DecryptWithSidecar(ctx, input, input, output, stetConfig, opts...)
+}
+
+// DecryptWithSidecar is like Decrypt, but reads the STET header and metadata
+// from metadataInput and the ciphertext from ciphertextInput, as written by
+// EncryptWithSidecar.
+func (c *StetClient) DecryptWithSidecar(ctx context.Context, metadataInput, ciphertextInput io.Reader, output io.Writer, stetConfig *configpb.StetConfig, opts ...CallOption) (*StetMetadata, error) {
+	callOpts := c.newCallOptions(opts)
+
+	doneMetadata := callOpts.timings.start(metadataPhase)
+	metadata, err := ReadMetadata(metadataInput)
+	doneMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	return c.decryptWithMetadata(ctx, metadata, ciphertextInput, output, stetConfig, callOpts)
+}
+
+// DecryptWithMetadata is like Decrypt, but takes already-parsed metadata, such
+// as from a database, and reads only the ciphertext from ciphertextInput. The
+// metadata is still bound into the AAD, so decryption fails if it does not
+// match the metadata the ciphertext was encrypted with.
+func (c *StetClient) DecryptWithMetadata(ctx context.Context, metadata *configpb.Metadata, ciphertextInput io.Reader, output io.Writer, stetConfig *configpb.StetConfig, opts ...CallOption) (*StetMetadata, error) {
+	return c.decryptWithMetadata(ctx, metadata, ciphertextInput, output, stetConfig, c.newCallOptions(opts))
+}
+
+// decryptWithMetadata implements DecryptWithMetadata with the given call
+// options.
+func (c *StetClient) decryptWithMetadata(ctx context.Context, metadata *configpb.Metadata, ciphertextInput io.Reader, output io.Writer, stetConfig *configpb.StetConfig, callOpts *callOptions) (*StetMetadata, error) {
+	if metadata == nil {
+		return nil, fmt.Errorf("nil metadata passed to DecryptWithMetadata()")
+	}
+
+	segmentSize, err := metadataSegmentSize(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read repair needs to know which shares failed to unwrap.
+	if callOpts.readRepair != nil && callOpts.decryptReport == nil {
+		opts := *callOpts
+		opts.decryptReport = &DecryptReport{}
+		callOpts = &opts
+	}
+
+	combinedDEK, unwrappedShares, err := c.recoverDEK(ctx, metadata, stetConfig, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// If any shares failed to unwrap, write the repaired blob from the
+	// plaintext as it is decrypted.
+	var repairedShares []int
+	var finishRepair func(error) error
+	if callOpts.readRepair != nil {
+		var repaired *configpb.Metadata
+		repaired, repairedShares, err = c.repairShares(ctx, metadata, stetConfig, unwrappedShares, callOpts.decryptReport, callOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error repairing shares: %v", err)
+		}
+
+		if repaired != nil {
+			var repairInput io.Writer
+			repairInput, finishRepair, err = sealRepairedBlob(combinedDEK, repaired, segmentSize, callOpts.readRepair, callOpts)
+			if err != nil {
+				return nil, fmt.Errorf("error repairing shares: %v", err)
+			}
+			output = io.MultiWriter(output, repairInput)
+		}
+	}
+
+	var framed *framedReader
+	if callOpts.framing {
+		framed = &framedReader{r: ciphertextInput}
+		ciphertextInput = framed
+	} else if callOpts.ignoreTrailingBytes {
+		if size, ok := recordedCiphertextSize(metadata); ok {
+			ciphertextInput = io.LimitReader(ciphertextInput, size)
+		}
+	}
+
+	md, err := decryptWithDEK(metadata, combinedDEK, unwrappedShares, segmentSize, callOpts.aeadWorkers, ciphertextInput, output, callOpts.timings)
+	if err == nil && framed != nil {
+		err = framed.finish()
+	}
+	if finishRepair != nil {
+		if repairErr := finishRepair(err); err == nil && repairErr != nil {
+			return nil, fmt.Errorf("error writing repaired blob: %v", repairErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(repairedShares) > 0 {
+		c.logger(ctx).Infof("Repaired %v shares of blob %q that failed to unwrap", len(repairedShares), metadata.GetBlobId())
+	}
 
+	md.EKMSessions = callOpts.ekmSessions.list()
+	md.RepairedShares = repairedShares
+	return callOpts.attachTimings(md), nil
+}
+
+// decryptWithDEK decrypts the ciphertext of the blob with the given metadata,
+// using the DEK recovered from `unwrappedShares`, opening up to `workers`
+// segments concurrently if that is more than one. If `timings` is set, the
+// time spent is added to it.
+func decryptWithDEK(metadata *configpb.Metadata, combinedDEK shares.DEK, unwrappedShares []shares.UnwrappedShare, segmentSize int64, workers int, ciphertextInput io.Reader, output io.Writer, timings *TimingReport) (*StetMetadata, error) {
 	// Generate AAD and decrypt ciphertext.
+	doneMetadata := timings.start(metadataPhase)
 	aad, err := MetadataToAAD(metadata)
+	doneMetadata()
 	if err != nil {
 		return nil, fmt.Errorf("error serializing metadata: %v", err)
 	}
 
-	// Now `input` is at the start of ciphertext to pass to Tink.
-	if err := AeadDecrypt(combinedDEK, input, output, aad); err != nil {
+	// If the blob has an integrity manifest, check that it was written with
+	// this DEK, and hash the ciphertext as it is decrypted.
+	var hasher *frameHasher
+	if manifest := metadata.GetIntegrityManifest(); manifest != nil {
+		if err := checkManifestMAC(combinedDEK, metadata.GetBlobId(), manifest); err != nil {
+			return nil, err
+		}
+
+		if err := checkManifestShape(manifest); err != nil {
+			return nil, err
+		}
+
+		hasher = newFrameHasher(manifest.GetFrameSize())
+		ciphertextInput = io.TeeReader(ciphertextInput, hasher)
+	}
+
+	// Pass the ciphertext to Tink. When reading a combined blob, `ciphertextInput`
+	// is now at the start of the ciphertext.
+	doneAEAD := timings.start(aeadPhase)
+	if workers > 1 {
+		err = decryptSegmentsParallel(combinedDEK, segmentSize, ciphertextInput, output, aad, workers)
+	} else {
+		err = aeadDecrypt(combinedDEK, segmentSize, ciphertextInput, output, aad)
+	}
+	doneAEAD()
+	if err != nil {
 		return nil, fmt.Errorf("error decrypting data: %v", err)
 	}
 
+	if hasher != nil {
+		if err := compareManifests(metadata.GetIntegrityManifest(), hasher.manifest()); err != nil {
+			return nil, fmt.Errorf("ciphertext does not match integrity manifest: %v", err)
+		}
+	}
+
 	// Return URIs of keys used during decryption.
 	var keyURIs []string
 	for _, unwrapped := range unwrappedShares {
@@ -674,7 +2622,8 @@ func (c *StetClient) Decrypt(ctx context.Context, input io.Reader, output io.Wri
 	}
 
 	return &StetMetadata{
-		KeyUris: keyURIs,
-		BlobID:  metadata.GetBlobId(),
+		KeyUris:    keyURIs,
+		BlobID:     metadata.GetBlobId(),
+		Extensions: copyExtensions(metadata.GetExtensions()),
 	}, nil
 }
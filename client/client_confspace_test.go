@@ -388,3 +388,36 @@ func TestCredsIgnoredIfNotInConfspace(t *testing.T) {
 		t.Errorf("Did not get expected plaintext: got %v, want %v", decrypted.String(), plaintext)
 	}
 }
+
+func TestEKMAuthTokenFromTokenSource(t *testing.T) {
+	// An unsigned token shaped like a Confidential Space attestation token.
+	attestationToken := "eyJhbGciOiJSUzI1NiJ9.eyJpc3MiOiJodHRwczovL2NvbmZpZGVudGlhbGNvbXB1dGluZy5nb29nbGVhcGlzLmNvbSIsInN3bmFtZSI6IkNPTkZJREVOVElBTF9TUEFDRSJ9.signature"
+
+	var gotAudience string
+	stetClient := &StetClient{
+		EKMTokenSource: func(_ context.Context, audience string) (string, error) {
+			gotAudience = audience
+			return attestationToken, nil
+		},
+	}
+
+	token, err := stetClient.ekmAuthToken(context.Background(), "https://ekm.example.com:8443/v0/keys/key1")
+	if err != nil {
+		t.Fatalf("ekmAuthToken returned error: %v", err)
+	}
+
+	if token != attestationToken {
+		t.Errorf("ekmAuthToken returned %q, want the token from EKMTokenSource %q", token, attestationToken)
+	}
+
+	if want := "https://ekm.example.com"; gotAudience != want {
+		t.Errorf("EKMTokenSource called with audience %q, want %q", gotAudience, want)
+	}
+
+	stetClient.EKMTokenSource = func(context.Context, string) (string, error) {
+		return "", fmt.Errorf("launcher unavailable")
+	}
+	if _, err := stetClient.ekmAuthToken(context.Background(), "https://ekm.example.com/v0/keys/key1"); err == nil {
+		t.Error("ekmAuthToken succeeded with a failing EKMTokenSource, want error")
+	}
+}
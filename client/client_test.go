@@ -17,14 +17,26 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	mathrand "math/rand"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
 	confspace "github.com/GoogleCloudPlatform/stet/client/confidentialspace"
+	"github.com/GoogleCloudPlatform/stet/client/securesession"
 	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
 	"github.com/GoogleCloudPlatform/stet/client/testutil"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/tink/go/subtle/random"
@@ -39,21 +51,61 @@ import (
 )
 
 func TestParseEKMKeyURI(t *testing.T) {
-	keyURI := "https://test.ekm.io/endpoints/123456"
-	expectedAddr := "https://test.ekm.io"
-	expectedKeyPath := "123456"
-
-	addr, keyPath, err := parseEKMKeyURI(keyURI)
-	if err != nil {
-		t.Errorf("parseEKMKeyURI(%v) returned unexpected error: %v", keyURI, err)
+	testcases := []struct {
+		name        string
+		keyURI      string
+		wantAddr    string
+		wantKeyPath string
+	}{
+		{
+			name:        "Hostname",
+			keyURI:      "https://test.ekm.io/endpoints/123456",
+			wantAddr:    "https://test.ekm.io",
+			wantKeyPath: "123456",
+		},
+		{
+			name:        "Hostname with port",
+			keyURI:      "https://test.ekm.io:8443/endpoints/123456",
+			wantAddr:    "https://test.ekm.io:8443",
+			wantKeyPath: "123456",
+		},
+		{
+			name:        "IPv6 literal",
+			keyURI:      "https://[2001:db8::1]/keys/foo",
+			wantAddr:    "https://[2001:db8::1]",
+			wantKeyPath: "foo",
+		},
+		{
+			name:        "IPv6 literal with port",
+			keyURI:      "https://[2001:db8::1]:8443/keys/foo",
+			wantAddr:    "https://[2001:db8::1]:8443",
+			wantKeyPath: "foo",
+		},
 	}
 
-	if addr != expectedAddr {
-		t.Errorf("parseEKMKeyURI(%v) returned unexpected address. Got %v, want %v", keyURI, addr, expectedAddr)
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, keyPath, err := parseEKMKeyURI(tc.keyURI)
+			if err != nil {
+				t.Fatalf("parseEKMKeyURI(%v) returned unexpected error: %v", tc.keyURI, err)
+			}
+
+			if addr != tc.wantAddr {
+				t.Errorf("parseEKMKeyURI(%v) returned unexpected address. Got %v, want %v", tc.keyURI, addr, tc.wantAddr)
+			}
+
+			if keyPath != tc.wantKeyPath {
+				t.Errorf("parseEKMKeyURI(%v) returned unexpected keyPath. Got %v, want %v", tc.keyURI, keyPath, tc.wantKeyPath)
+			}
+		})
 	}
+}
 
-	if keyPath != expectedKeyPath {
-		t.Errorf("parseEKMKeyURI(%v) returned unexpected keyPath. Got %v, want %v", keyURI, keyPath, expectedKeyPath)
+func TestParseEKMKeyURIErrors(t *testing.T) {
+	for _, keyURI := range []string{"https://[2001:db8::1/keys/foo", "/keys/foo"} {
+		if _, _, err := parseEKMKeyURI(keyURI); err == nil {
+			t.Errorf("parseEKMKeyURI(%v) succeeded, want error", keyURI)
+		}
 	}
 }
 
@@ -175,6 +227,34 @@ func TestGetKekCryptoKeyErrors(t *testing.T) {
 			kekInfo:           validKekInfo,
 			expectedErrSubstr: "unspecified protection level",
 		},
+		{
+			name: "External key with unsupported algorithm",
+			fakeKmsClient: &testutil.FakeKeyManagementClient{
+				GetCryptoKeyFunc: func(_ context.Context, req *kmsspb.GetCryptoKeyRequest, _ ...gax.CallOption) (*kmsrpb.CryptoKey, error) {
+					ck := testutil.CreateEnabledCryptoKey(kmsrpb.ProtectionLevel_EXTERNAL, testutil.ExternalKEK.Name)
+					ck.Primary.Algorithm = kmsrpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256
+					return ck, nil
+				},
+			},
+			kekInfo: &configpb.KekInfo{
+				KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+			},
+			expectedErrSubstr: "unsupported algorithm",
+		},
+		{
+			name: "External VPC key with unspecified algorithm",
+			fakeKmsClient: &testutil.FakeKeyManagementClient{
+				GetCryptoKeyFunc: func(_ context.Context, req *kmsspb.GetCryptoKeyRequest, _ ...gax.CallOption) (*kmsrpb.CryptoKey, error) {
+					ck := testutil.CreateEnabledCryptoKey(kmsrpb.ProtectionLevel_EXTERNAL_VPC, testutil.VPCKEK.Name)
+					ck.Primary.Algorithm = kmsrpb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED
+					return ck, nil
+				},
+			},
+			kekInfo: &configpb.KekInfo{
+				KekType: &configpb.KekInfo_KekUri{KekUri: testutil.VPCKEK.URI()},
+			},
+			expectedErrSubstr: "unsupported algorithm",
+		},
 		{
 			name:          "KEK URI lacks GCP KMS identifying prefix",
 			fakeKmsClient: &testutil.FakeKeyManagementClient{},
@@ -193,6 +273,8 @@ func TestGetKekCryptoKeyErrors(t *testing.T) {
 
 			if err == nil {
 				t.Errorf("getKekMetadata returned no error, expected error related to \"%s\"", testCase.expectedErrSubstr)
+			} else if !strings.Contains(err.Error(), testCase.expectedErrSubstr) {
+				t.Errorf("getKekMetadata returned error %q, expected error related to \"%s\"", err, testCase.expectedErrSubstr)
 			}
 		})
 	}
@@ -249,7 +331,7 @@ func TestEkmSecureSessionWrap(t *testing.T) {
 
 	stetClient := &StetClient{testSecureSessionClient: &testutil.FakeSecureSessionClient{}}
 
-	ciphertext, err := stetClient.ekmSecureSessionWrap(ctx, plaintext, md, nil)
+	ciphertext, err := stetClient.ekmSecureSessionWrap(ctx, plaintext, nil, md, nil)
 	if err != nil {
 		t.Fatalf("ekmSecureSessionWrap(ctx, \"%s\", \"%v\") returned error: %v", plaintext, md, err)
 	}
@@ -287,13 +369,85 @@ func TestEkmSecureSessionWrapError(t *testing.T) {
 	for _, testCase := range testCases {
 		stetClient := &StetClient{testSecureSessionClient: testCase.fakeEkmClient}
 
-		_, err := stetClient.ekmSecureSessionWrap(ctx, []byte("this is plaintext"), kekMetadata{uri: "this is a uri"}, nil)
+		_, err := stetClient.ekmSecureSessionWrap(ctx, []byte("this is plaintext"), nil, kekMetadata{uri: "this is a uri"}, nil)
 		if err == nil {
 			t.Errorf("ekmSecureSessionWrap(context.Background, \"this is plaintext\", \"this is a uri\") returned no error, expected to return error related to %s", testCase.expectedErrSubstr)
 		}
 	}
 }
 
+func TestEkmSecureSessionCodedErrors(t *testing.T) {
+	ctx := context.Background()
+
+	keyCfg := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()}}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyCfg},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyCfg}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	testcases := []struct {
+		name          string
+		ekmErr        *securesession.EKMError
+		wantRetryable bool
+	}{
+		{
+			name:   "Attestation rejected",
+			ekmErr: &securesession.EKMError{HTTPStatus: 401, Category: securesession.EKMErrorAttestationRejected, Err: errors.New("attestation rejected")},
+		},
+		{
+			name:          "Quota exceeded",
+			ekmErr:        &securesession.EKMError{HTTPStatus: 429, Category: securesession.EKMErrorQuotaExceeded, Err: errors.New("quota exceeded")},
+			wantRetryable: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			codedErr := fmt.Errorf("%w: %w", securesession.ErrRequestFailed, tc.ekmErr)
+
+			// Wrapping failures are returned from Encrypt.
+			stetClient := &StetClient{
+				KMSClient:               &testutil.FakeKeyManagementClient{},
+				testSecureSessionClient: &testutil.FakeSecureSessionClient{WrapErr: codedErr},
+			}
+
+			_, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("data")), io.Discard, stetConfig, "blob")
+			var ekmErr *securesession.EKMError
+			if !errors.As(err, &ekmErr) {
+				t.Fatalf("Encrypt returned error %v, want error wrapping *securesession.EKMError", err)
+			}
+			if ekmErr.Category != tc.ekmErr.Category || ekmErr.Retryable() != tc.wantRetryable {
+				t.Errorf("Encrypt returned EKMError with category %v and Retryable() = %v, want %v and %v", ekmErr.Category, ekmErr.Retryable(), tc.ekmErr.Category, tc.wantRetryable)
+			}
+
+			// Unwrapping failures are reported per share.
+			stetClient.testSecureSessionClient = &testutil.FakeSecureSessionClient{}
+			var ciphertext bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("data")), &ciphertext, stetConfig, "blob"); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			stetClient.testSecureSessionClient = &testutil.FakeSecureSessionClient{UnwrapErr: codedErr}
+			var report DecryptReport
+			if _, err := stetClient.Decrypt(ctx, &ciphertext, io.Discard, stetConfig, WithDecryptReport(&report)); err == nil {
+				t.Fatal("Decrypt succeeded, want error")
+			}
+
+			if len(report.Shares) != 1 || !errors.As(report.Shares[0].Err, &ekmErr) {
+				t.Fatalf("Decrypt reported shares %+v, want one share failing with *securesession.EKMError", report.Shares)
+			}
+			if ekmErr.Category != tc.ekmErr.Category {
+				t.Errorf("Decrypt reported EKMError with category %v, want %v", ekmErr.Category, tc.ekmErr.Category)
+			}
+		})
+	}
+}
+
 func TestEkmSecureSessionUnwrap(t *testing.T) {
 	ctx := context.Background()
 	expectedPlaintext := []byte("this is plaintext")
@@ -302,7 +456,7 @@ func TestEkmSecureSessionUnwrap(t *testing.T) {
 
 	stetClient := &StetClient{testSecureSessionClient: &testutil.FakeSecureSessionClient{}}
 
-	plaintext, err := stetClient.ekmSecureSessionUnwrap(ctx, ciphertext, md, nil)
+	plaintext, err := stetClient.ekmSecureSessionUnwrap(ctx, ciphertext, nil, md, nil)
 	if err != nil {
 		t.Fatalf("ekmSecureSessionUnwrap(context.Background(), \"%s\", \"%v\") returned error: %v", ciphertext, md, err)
 	}
@@ -340,13 +494,172 @@ func TestEkmSecureSessionUnwrapError(t *testing.T) {
 	for _, testCase := range testCases {
 		stetClient := &StetClient{testSecureSessionClient: testCase.fakeEkmClient}
 
-		_, err := stetClient.ekmSecureSessionUnwrap(ctx, []byte("this is ciphertext"), kekMetadata{uri: testutil.ExternalKEK.URI()}, nil)
+		_, err := stetClient.ekmSecureSessionUnwrap(ctx, []byte("this is ciphertext"), nil, kekMetadata{uri: testutil.ExternalKEK.URI()}, nil)
 		if err == nil {
 			t.Errorf("ekmSecureSessionUnwrap(context.Background, \"this is ciphertext\", %v) returned no error, expected to return error related to %s", testutil.ExternalKEK.URI(), testCase.expectedErrSubstr)
 		}
 	}
 }
 
+// droppingSessionClient fails the first `drops` wraps and unwraps with
+// `dropErr`, simulating an EKM that drops the connection mid-request.
+type droppingSessionClient struct {
+	*testutil.FakeSecureSessionClient
+	drops   int
+	dropErr error
+	calls   int
+	closes  int
+}
+
+func (c *droppingSessionClient) Close() error {
+	c.closes++
+	return nil
+}
+
+func (c *droppingSessionClient) drop() error {
+	c.calls++
+	if c.calls <= c.drops {
+		return c.dropErr
+	}
+	return nil
+}
+
+func (c *droppingSessionClient) ConfidentialWrapWithAAD(ctx context.Context, keyPath, resourceName string, plaintext, aad []byte) ([]byte, error) {
+	if err := c.drop(); err != nil {
+		return nil, err
+	}
+	return c.FakeSecureSessionClient.ConfidentialWrapWithAAD(ctx, keyPath, resourceName, plaintext, aad)
+}
+
+func (c *droppingSessionClient) ConfidentialUnwrapWithAAD(ctx context.Context, keyPath, resourceName string, wrappedBlob, aad []byte) ([]byte, error) {
+	if err := c.drop(); err != nil {
+		return nil, err
+	}
+	return c.FakeSecureSessionClient.ConfidentialUnwrapWithAAD(ctx, keyPath, resourceName, wrappedBlob, aad)
+}
+
+func TestEkmSecureSessionReconnect(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("this is plaintext")
+	md := kekMetadata{uri: testutil.ExternalKEK.URI()}
+
+	connectionLost := fmt.Errorf("error session-encrypting the records: %w", fmt.Errorf("%w: %w", securesession.ErrConnectionLost, io.ErrUnexpectedEOF))
+	requestFailed := fmt.Errorf("error session-encrypting the records: %w", fmt.Errorf("%w: permission denied", securesession.ErrRequestFailed))
+
+	testCases := []struct {
+		name      string
+		drops     int
+		dropErr   error
+		reuse     bool
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name:      "Dropped connection retried",
+			drops:     1,
+			dropErr:   connectionLost,
+			wantCalls: 2,
+		},
+		{
+			name:      "Dropped pooled session retried",
+			drops:     1,
+			dropErr:   connectionLost,
+			reuse:     true,
+			wantCalls: 2,
+		},
+		{
+			name:      "Retries bounded",
+			drops:     secureSessionReconnects + 1,
+			dropErr:   connectionLost,
+			wantCalls: secureSessionReconnects + 1,
+			wantErr:   securesession.ErrConnectionLost,
+		},
+		{
+			name:      "Failed request not retried",
+			drops:     1,
+			dropErr:   requestFailed,
+			wantCalls: 1,
+			wantErr:   securesession.ErrRequestFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, op := range []string{"wrap", "unwrap"} {
+				session := &droppingSessionClient{
+					FakeSecureSessionClient: &testutil.FakeSecureSessionClient{},
+					drops:                   tc.drops,
+					dropErr:                 tc.dropErr,
+				}
+				stetClient := &StetClient{
+					testSecureSessionClient: session,
+					ReuseSecureSessions:     tc.reuse,
+				}
+
+				var err error
+				if op == "wrap" {
+					_, err = stetClient.ekmSecureSessionWrap(ctx, plaintext, nil, md, nil)
+				} else {
+					_, err = stetClient.ekmSecureSessionUnwrap(ctx, append(plaintext, 'E'), nil, md, nil)
+				}
+
+				if tc.wantErr == nil && err != nil {
+					t.Errorf("%v returned error: %v", op, err)
+				} else if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+					t.Errorf("%v returned error %v, want error wrapping %v", op, err, tc.wantErr)
+				}
+
+				if session.calls != tc.wantCalls {
+					t.Errorf("%v made %v attempts, want %v", op, session.calls, tc.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestEkmSecureSessionDiscardedOnError(t *testing.T) {
+	ctx := context.Background()
+	md := kekMetadata{uri: testutil.ExternalKEK.URI()}
+	requestFailed := fmt.Errorf("%w: permission denied", securesession.ErrRequestFailed)
+
+	testCases := []struct {
+		name        string
+		drops       int
+		wantCloses  int
+		wantSuccess bool
+	}{
+		{
+			name:        "Ended session not discarded",
+			wantSuccess: true,
+		},
+		{
+			name:       "Failed session discarded",
+			drops:      1,
+			wantCloses: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			session := &droppingSessionClient{
+				FakeSecureSessionClient: &testutil.FakeSecureSessionClient{},
+				drops:                   tc.drops,
+				dropErr:                 requestFailed,
+			}
+			stetClient := &StetClient{testSecureSessionClient: session}
+
+			_, err := stetClient.ekmSecureSessionWrap(ctx, []byte("this is plaintext"), nil, md, nil)
+			if tc.wantSuccess != (err == nil) {
+				t.Errorf("ekmSecureSessionWrap returned error %v, want success = %v", err, tc.wantSuccess)
+			}
+
+			if session.closes != tc.wantCloses {
+				t.Errorf("Session was closed %v times, want %v", session.closes, tc.wantCloses)
+			}
+		})
+	}
+}
+
 func TestWrapSharesIndividually(t *testing.T) {
 	testShare := []byte("I am a wrapped share.")
 	testHashedShare := shares.HashShare(testShare)
@@ -577,6 +890,86 @@ func TestWrapUnwrapShareAsymmetricKeyError(t *testing.T) {
 	}
 }
 
+func TestUnwrapShareRSAKeyFallback(t *testing.T) {
+	ctx := context.Background()
+	testShare := []byte("I am a wrapped share.")
+
+	dir := t.TempDir()
+	prvKeyFile := dir + "/private.pem"
+	pubKeyFile := dir + "/public.pem"
+	if err := os.WriteFile(prvKeyFile, []byte(testPrivatePEM), 0600); err != nil {
+		t.Fatalf("Failed to write test private key: %v", err)
+	}
+	if err := os.WriteFile(pubKeyFile, []byte(testPublicPEM), 0600); err != nil {
+		t.Fatalf("Failed to write test public key: %v", err)
+	}
+	otherKeys, _ := writeRSAKeyPair(t, 2048)
+
+	var stetClient StetClient
+	wrapOpts := sharesOpts{
+		kekInfos:       []*configpb.KekInfo{{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: testPublicFingerprint}}},
+		asymmetricKeys: &configpb.AsymmetricKeys{PublicKeyFiles: []string{pubKeyFile}},
+	}
+	wrappedShares, _, err := stetClient.wrapShares(ctx, [][]byte{testShare}, wrapOpts)
+	if err != nil {
+		t.Fatalf("wrapShares returned error: %v", err)
+	}
+
+	// The blob records a fingerprint computed with another scheme, which
+	// matches none of the keys.
+	reencoded := []*configpb.KekInfo{{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: "c29tZSBvdGhlciBmaW5nZXJwcmludCBzY2hlbWU="}}}
+
+	testCases := []struct {
+		name        string
+		privateKeys []string
+		fallback    bool
+		wantErr     bool
+	}{
+		{
+			name:        "Fallback finds correct key",
+			privateKeys: []string{otherKeys.GetPrivateKeyFiles()[0], prvKeyFile},
+			fallback:    true,
+		},
+		{
+			name:        "Fallback disabled",
+			privateKeys: []string{otherKeys.GetPrivateKeyFiles()[0], prvKeyFile},
+			wantErr:     true,
+		},
+		{
+			name:        "Fallback without correct key",
+			privateKeys: otherKeys.GetPrivateKeyFiles(),
+			fallback:    true,
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := sharesOpts{
+				kekInfos:       reencoded,
+				asymmetricKeys: &configpb.AsymmetricKeys{PrivateKeyFiles: tc.privateKeys},
+				rsaKeyFallback: tc.fallback,
+			}
+
+			unwrapped, _, err := stetClient.unwrapAndValidateShare(ctx, nil, wrappedShares[0], reencoded[0], opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("unwrapAndValidateShare succeeded, want error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unwrapAndValidateShare returned error: %v", err)
+			}
+
+			if !bytes.Equal(unwrapped.Share, testShare) {
+				t.Errorf("unwrapAndValidateShare returned share %v, want %v", unwrapped.Share, testShare)
+			}
+		})
+	}
+}
+
 func TestWrapSharesWithMultipleShares(t *testing.T) {
 	// Create lists of shares and kekInfos of appropriate length.
 	sharesList := [][]byte{[]byte("share1"), []byte("share2"), []byte("share3")}
@@ -1195,23 +1588,13 @@ func TestUnwrapAndValidateSharesError(t *testing.T) {
 	}
 }
 
-func TestWrapAndUnwrapWorkflow(t *testing.T) {
-	// Create lists of shares and kekInfos of appropriate length.
-	sharesList := [][]byte{[]byte("share1"), []byte("share2"), []byte("share3")}
-	kekInfoList := []*configpb.KekInfo{
-		&configpb.KekInfo{
-			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
-		},
-		&configpb.KekInfo{
-			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()},
-		},
-		&configpb.KekInfo{
-			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
-		},
+func TestWrapSharesWithBackupKEK(t *testing.T) {
+	share := []byte("I am an unwrapped share")
+	kekInfo := &configpb.KekInfo{
+		KekType:      &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+		BackupKekUri: testutil.HSMKEK.URI(),
 	}
 
-	ctx := context.Background()
-
 	stetClient := &StetClient{
 		testKMSClients: &cloudkms.ClientFactory{
 			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
@@ -1219,76 +1602,364 @@ func TestWrapAndUnwrapWorkflow(t *testing.T) {
 		testSecureSessionClient: &testutil.FakeSecureSessionClient{},
 	}
 
-	opts := sharesOpts{kekInfos: kekInfoList, asymmetricKeys: &configpb.AsymmetricKeys{}}
-	wrapped, _, err := stetClient.wrapShares(ctx, sharesList, opts)
-	if err != nil {
-		t.Fatalf("wrapShares(context.Background(), %v, %v, {}) returned with error %v", sharesList, kekInfoList, err)
-	}
-
-	unwrapped, err := stetClient.unwrapAndValidateShares(ctx, wrapped, opts)
+	opts := sharesOpts{kekInfos: []*configpb.KekInfo{kekInfo}, asymmetricKeys: &configpb.AsymmetricKeys{}}
+	wrapped, uris, err := stetClient.wrapShares(context.Background(), [][]byte{share}, opts)
 	if err != nil {
-		t.Errorf("unwrapAndValidateShares(context.Background(), %v, %v, {}) returned with error %v", wrapped, kekInfoList, err)
+		t.Fatalf("wrapShares returned with error %v", err)
 	}
 
-	if len(wrapped) != len(unwrapped) {
-		t.Fatalf("wrapShares returned %v shares, unwrapAndValidateShares returned %v shares. Expected equal numbers.", len(wrapped), len(unwrapped))
+	if len(wrapped) != 1 {
+		t.Fatalf("wrapShares returned %v shares, want 1", len(wrapped))
 	}
 
-	for i, unwrappedShare := range unwrapped {
-		if !bytes.Equal(unwrappedShare.Share, sharesList[i]) {
-			t.Errorf("unwrapAndValidateShares(context.Background(), %v, %v, {}) = %v, want %v", sharesList, kekInfoList, unwrappedShare, sharesList[i])
-		}
+	if want := append(share, byte('E')); !bytes.Equal(wrapped[0].GetShare(), want) {
+		t.Errorf("wrapShares did not return the expected wrapped share. Got %v, want %v", wrapped[0].GetShare(), want)
 	}
-}
 
-func TestEncryptAndDecryptWithNoSplitSucceeds(t *testing.T) {
-	testBlobID := "I am blob."
-	kekInfo := &configpb.KekInfo{
-		KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+	if want := testutil.FakeKMSWrap(share, testutil.HSMKEK.Name); !bytes.Equal(wrapped[0].GetBackupShare(), want) {
+		t.Errorf("wrapShares did not return the expected backup wrapped share. Got %v, want %v", wrapped[0].GetBackupShare(), want)
 	}
 
-	keyConfig := &configpb.KeyConfig{
-		KekInfos:              []*configpb.KekInfo{kekInfo},
-		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
-		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{true},
+	wantURIs := []string{testutil.ExternalEKMURI, testutil.HSMKEK.URI()}
+	if diff := cmp.Diff(wantURIs, uris); diff != "" {
+		t.Errorf("wrapShares returned unexpected key URIs (-want +got):\n%s", diff)
 	}
+}
 
-	stetConfig := &configpb.StetConfig{
-		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
-		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
-		AsymmetricKeys: &configpb.AsymmetricKeys{},
-	}
+func TestWrapSharesWithBackupKEKError(t *testing.T) {
+	share := []byte("I am an unwrapped share")
 
 	testCases := []struct {
-		name      string
-		plaintext []byte
+		name    string
+		kekInfo *configpb.KekInfo
 	}{
 		{
-			name:      "\"This is data to be encrypted.\"",
-			plaintext: []byte("This is data to be encrypted."),
+			name: "Backup KEK fails to wrap",
+			kekInfo: &configpb.KekInfo{
+				KekType:      &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+				BackupKekUri: "I am an invalid URI!",
+			},
 		},
 		{
-			name:      "Large size plaintext.",
-			plaintext: random.GetRandomBytes(1500000),
-		},
-	}
-
-	ctx := context.Background()
-
-	stetClient := &StetClient{
-		testKMSClients: &cloudkms.ClientFactory{
-			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+			name: "Backup KEK with RSA fingerprint",
+			kekInfo: &configpb.KekInfo{
+				KekType:      &configpb.KekInfo_RsaFingerprint{RsaFingerprint: testPublicFingerprint},
+				BackupKekUri: testutil.HSMKEK.URI(),
+			},
 		},
-		testSecureSessionClient: &testutil.FakeSecureSessionClient{},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			plaintextBuf := bytes.NewReader(tc.plaintext)
+			stetClient := &StetClient{
+				testKMSClients: &cloudkms.ClientFactory{
+					CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+				},
+				testSecureSessionClient: &testutil.FakeSecureSessionClient{},
+			}
 
-			var ciphertextBuf bytes.Buffer
-			if _, err := stetClient.Encrypt(ctx, plaintextBuf, &ciphertextBuf, stetConfig, testBlobID); err != nil {
-				t.Errorf("Encrypt(ctx, %v, buf, %v, {}, %v) returned error \"%v\", want no error", tc.plaintext, stetConfig.GetEncryptConfig(), testBlobID, err)
+			opts := sharesOpts{kekInfos: []*configpb.KekInfo{tc.kekInfo}, asymmetricKeys: &configpb.AsymmetricKeys{}}
+			if _, _, err := stetClient.wrapShares(context.Background(), [][]byte{share}, opts); err == nil {
+				t.Errorf("wrapShares(ctx, %v, %v) returned no error, want error", share, opts)
+			}
+		})
+	}
+}
+
+func TestUnwrapAndValidateSharesWithBackupKEK(t *testing.T) {
+	share := []byte("I am an unwrapped share")
+	kekInfo := &configpb.KekInfo{
+		KekType:      &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+		BackupKekUri: testutil.HSMKEK.URI(),
+	}
+
+	testCases := []struct {
+		name         string
+		wrappedShare *configpb.WrappedShare
+		fakeSSClient *testutil.FakeSecureSessionClient
+		expectedURI  string
+	}{
+		{
+			name: "Primary KEK succeeds",
+			wrappedShare: &configpb.WrappedShare{
+				Share:       append(share, byte('E')),
+				Hash:        shares.HashShare(share),
+				BackupShare: testutil.FakeKMSWrap(share, testutil.HSMKEK.Name),
+			},
+			fakeSSClient: &testutil.FakeSecureSessionClient{},
+			expectedURI:  testutil.ExternalEKMURI,
+		},
+		{
+			name: "EKM unavailable falls back to backup KEK",
+			wrappedShare: &configpb.WrappedShare{
+				Share:       append(share, byte('E')),
+				Hash:        shares.HashShare(share),
+				BackupShare: testutil.FakeKMSWrap(share, testutil.HSMKEK.Name),
+			},
+			fakeSSClient: &testutil.FakeSecureSessionClient{
+				UnwrapErr: errors.New("EKM unavailable"),
+			},
+			expectedURI: testutil.HSMKEK.URI(),
+		},
+		{
+			name: "Primary share fails hash validation falls back to backup KEK",
+			wrappedShare: &configpb.WrappedShare{
+				Share:       []byte("I am a corrupted share"),
+				Hash:        shares.HashShare(share),
+				BackupShare: testutil.FakeKMSWrap(share, testutil.HSMKEK.Name),
+			},
+			fakeSSClient: &testutil.FakeSecureSessionClient{},
+			expectedURI:  testutil.HSMKEK.URI(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{
+				testKMSClients: &cloudkms.ClientFactory{
+					CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+				},
+				testSecureSessionClient: tc.fakeSSClient,
+			}
+
+			opts := sharesOpts{kekInfos: []*configpb.KekInfo{kekInfo}, asymmetricKeys: &configpb.AsymmetricKeys{}}
+			unwrapped, err := stetClient.unwrapAndValidateShares(context.Background(), []*configpb.WrappedShare{tc.wrappedShare}, opts)
+			if err != nil {
+				t.Fatalf("unwrapAndValidateShares returned with error %v", err)
+			}
+
+			if len(unwrapped) != 1 {
+				t.Fatalf("unwrapAndValidateShares returned %v shares, want 1", len(unwrapped))
+			}
+
+			if !bytes.Equal(unwrapped[0].Share, share) {
+				t.Errorf("unwrapAndValidateShares did not return the expected unwrapped share. Got %v, want %v", unwrapped[0].Share, share)
+			}
+
+			if unwrapped[0].URI != tc.expectedURI {
+				t.Errorf("unwrapAndValidateShares did not return the expected URI. Got %v, want %v", unwrapped[0].URI, tc.expectedURI)
+			}
+		})
+	}
+}
+
+func TestUnwrapAndValidateSharesWithBackupKEKError(t *testing.T) {
+	share := []byte("I am an unwrapped share")
+
+	testCases := []struct {
+		name         string
+		kekInfo      *configpb.KekInfo
+		wrappedShare *configpb.WrappedShare
+	}{
+		{
+			name: "Backup KEK also fails",
+			kekInfo: &configpb.KekInfo{
+				KekType:      &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+				BackupKekUri: testutil.HSMKEK.URI(),
+			},
+			wrappedShare: &configpb.WrappedShare{
+				Share:       append(share, byte('E')),
+				Hash:        shares.HashShare(share),
+				BackupShare: testutil.FakeKMSWrap(share, testutil.SoftwareKEK.Name),
+			},
+		},
+		{
+			name: "Missing backup share",
+			kekInfo: &configpb.KekInfo{
+				KekType:      &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+				BackupKekUri: testutil.HSMKEK.URI(),
+			},
+			wrappedShare: &configpb.WrappedShare{
+				Share: append(share, byte('E')),
+				Hash:  shares.HashShare(share),
+			},
+		},
+		{
+			name: "No backup KEK configured",
+			kekInfo: &configpb.KekInfo{
+				KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+			},
+			wrappedShare: &configpb.WrappedShare{
+				Share:       append(share, byte('E')),
+				Hash:        shares.HashShare(share),
+				BackupShare: testutil.FakeKMSWrap(share, testutil.HSMKEK.Name),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{
+				testKMSClients: &cloudkms.ClientFactory{
+					CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+				},
+				testSecureSessionClient: &testutil.FakeSecureSessionClient{
+					UnwrapErr: errors.New("EKM unavailable"),
+				},
+			}
+
+			opts := sharesOpts{kekInfos: []*configpb.KekInfo{tc.kekInfo}, asymmetricKeys: &configpb.AsymmetricKeys{}}
+			unwrapped, err := stetClient.unwrapAndValidateShares(context.Background(), []*configpb.WrappedShare{tc.wrappedShare}, opts)
+			if err != nil {
+				t.Fatalf("unwrapAndValidateShares returned with error %v", err)
+			}
+
+			if len(unwrapped) != 0 {
+				t.Errorf("unwrapAndValidateShares returned %v shares, want 0", len(unwrapped))
+			}
+		})
+	}
+}
+
+func TestEncryptAndDecryptWithBackupKEK(t *testing.T) {
+	plaintext := []byte("This is data to be encrypted.")
+	keyConfig := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{{
+			KekType:      &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+			BackupKekUri: testutil.HSMKEK.URI(),
+		}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	ctx := context.Background()
+	kmsClients := &cloudkms.ClientFactory{
+		CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+	}
+
+	encryptClient := &StetClient{
+		testKMSClients:          kmsClients,
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{},
+	}
+
+	var ciphertext bytes.Buffer
+	if _, err := encryptClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "I am blob."); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	// Simulate an EKM outage during decryption.
+	decryptClient := &StetClient{
+		testKMSClients: kmsClients,
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{
+			UnwrapErr: errors.New("EKM unavailable"),
+		},
+	}
+
+	var output bytes.Buffer
+	md, err := decryptClient.Decrypt(ctx, &ciphertext, &output, stetConfig)
+	if err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+	}
+
+	if diff := cmp.Diff([]string{testutil.HSMKEK.URI()}, md.KeyUris); diff != "" {
+		t.Errorf("Decrypt returned unexpected key URIs (-want +got):\n%s", diff)
+	}
+}
+
+func TestWrapAndUnwrapWorkflow(t *testing.T) {
+	// Create lists of shares and kekInfos of appropriate length.
+	sharesList := [][]byte{[]byte("share1"), []byte("share2"), []byte("share3")}
+	kekInfoList := []*configpb.KekInfo{
+		&configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+		},
+		&configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()},
+		},
+		&configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()},
+		},
+	}
+
+	ctx := context.Background()
+
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{},
+	}
+
+	opts := sharesOpts{kekInfos: kekInfoList, asymmetricKeys: &configpb.AsymmetricKeys{}}
+	wrapped, _, err := stetClient.wrapShares(ctx, sharesList, opts)
+	if err != nil {
+		t.Fatalf("wrapShares(context.Background(), %v, %v, {}) returned with error %v", sharesList, kekInfoList, err)
+	}
+
+	unwrapped, err := stetClient.unwrapAndValidateShares(ctx, wrapped, opts)
+	if err != nil {
+		t.Errorf("unwrapAndValidateShares(context.Background(), %v, %v, {}) returned with error %v", wrapped, kekInfoList, err)
+	}
+
+	if len(wrapped) != len(unwrapped) {
+		t.Fatalf("wrapShares returned %v shares, unwrapAndValidateShares returned %v shares. Expected equal numbers.", len(wrapped), len(unwrapped))
+	}
+
+	for i, unwrappedShare := range unwrapped {
+		if !bytes.Equal(unwrappedShare.Share, sharesList[i]) {
+			t.Errorf("unwrapAndValidateShares(context.Background(), %v, %v, {}) = %v, want %v", sharesList, kekInfoList, unwrappedShare, sharesList[i])
+		}
+	}
+}
+
+func TestEncryptAndDecryptWithNoSplitSucceeds(t *testing.T) {
+	testBlobID := "I am blob."
+	kekInfo := &configpb.KekInfo{
+		KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+	}
+
+	keyConfig := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{kekInfo},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{true},
+	}
+
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	testCases := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{
+			name:      "\"This is data to be encrypted.\"",
+			plaintext: []byte("This is data to be encrypted."),
+		},
+		{
+			name:      "Large size plaintext.",
+			plaintext: random.GetRandomBytes(1500000),
+		},
+	}
+
+	ctx := context.Background()
+
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintextBuf := bytes.NewReader(tc.plaintext)
+
+			var ciphertextBuf bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, plaintextBuf, &ciphertextBuf, stetConfig, testBlobID); err != nil {
+				t.Errorf("Encrypt(ctx, %v, buf, %v, {}, %v) returned error \"%v\", want no error", tc.plaintext, stetConfig.GetEncryptConfig(), testBlobID, err)
 			}
 
 			// Decrypt the returned data and verify fields.
@@ -1547,62 +2218,272 @@ func TestEncryptGeneratesUUIDForBlobID(t *testing.T) {
 	}
 }
 
-func TestEncryptFailsWithNilConfig(t *testing.T) {
-	var stetClient StetClient
-
-	plaintextBuf := bytes.NewReader([]byte("This is data to be encrypted."))
-	var ciphertextBuf bytes.Buffer
+func TestEncryptRequireBlobID(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, RequireBlobID: true}
+	stetConfig := newFakeKMSConfig(1)
+	plaintext := []byte("This is data to be encrypted.")
 
-	stetConfig := &configpb.StetConfig{EncryptConfig: nil}
-	if _, err := stetClient.Encrypt(context.Background(), plaintextBuf, &ciphertextBuf, stetConfig, ""); err == nil {
-		t.Errorf("Encrypt expected to fail due to nil EncryptConfig.")
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, ""); !errors.Is(err, ErrMissingBlobID) {
+		t.Errorf("Encrypt with empty blob ID returned error %v, want %v", err, ErrMissingBlobID)
 	}
-}
-
-// Tests Decrypt with various error cases.
-func TestDecryptErrors(t *testing.T) {
-	ciphertext := []byte("I am ciphertext.")
 
-	shamirConfig := configpb.ShamirConfig{
-		Threshold: 2,
-		Shares:    2,
+	if ciphertext.Len() != 0 {
+		t.Errorf("Encrypt with empty blob ID wrote %v bytes, want none", ciphertext.Len())
 	}
 
-	kekInfos := []*configpb.KekInfo{
-		&configpb.KekInfo{
-			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
-		},
-		&configpb.KekInfo{
-			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
-		},
+	md, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "blob")
+	if err != nil {
+		t.Fatalf("Encrypt with explicit blob ID returned error: %v", err)
 	}
 
-	// Create test shares and corresponding hashes.
-	testShare := []byte("I am a wrapped share.")
-	testHashedShare := shares.HashShare(testShare)
-	testInvalidHashedShare := shares.HashShare([]byte("I am a different share."))
-
-	wrapped := &configpb.WrappedShare{
-		Share: append(testShare, byte('E')),
-		Hash:  testHashedShare,
+	if md.BlobID != "blob" {
+		t.Errorf("Encrypt returned blob ID %q, want %q", md.BlobID, "blob")
 	}
 
-	validKeyCfg := &configpb.KeyConfig{
-		KekInfos: []*configpb.KekInfo{&configpb.KekInfo{
-			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
-		}},
-		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
-		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{&shamirConfig},
+	items := []BatchItem{{BlobID: "blob", Input: bytes.NewReader(plaintext), Output: io.Discard}, {Input: bytes.NewReader(plaintext), Output: io.Discard}}
+	if _, err := stetClient.EncryptBatch(ctx, items, stetConfig); !errors.Is(err, ErrMissingBlobID) {
+		t.Errorf("EncryptBatch with empty blob ID returned error %v, want %v", err, ErrMissingBlobID)
 	}
+}
 
-	decryptCfg := configpb.DecryptConfig{
-		KeyConfigs: []*configpb.KeyConfig{validKeyCfg},
-	}
+func TestEncryptSizeHint(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+	plaintext := make([]byte, aeadSegmentSize+1000)
 
-	testCases := []struct {
-		name      string
-		metadata  *configpb.Metadata
-		config    *configpb.DecryptConfig
+	testcases := []struct {
+		name string
+		hint int64
+		opts []CallOption
+		// The segment size recorded in the metadata, zero for the default.
+		wantSegmentSize int64
+	}{
+		{
+			name: "Exact hint",
+			hint: int64(len(plaintext)),
+		},
+		{
+			name:            "Hint too small",
+			hint:            10,
+			wantSegmentSize: aeadMinSegmentSize,
+		},
+		{
+			name:            "Hint needing several blocks",
+			hint:            3 * aeadMinSegmentSize,
+			wantSegmentSize: 4 * aeadMinSegmentSize,
+		},
+		{
+			name: "Hint too large",
+			hint: 10 * int64(len(plaintext)),
+		},
+		{
+			name:            "Zero hint",
+			hint:            0,
+			wantSegmentSize: aeadMinSegmentSize,
+		},
+		{
+			name: "Negative hint",
+			hint: -1,
+		},
+		{
+			name:            "Hint with segment size",
+			hint:            10,
+			opts:            []CallOption{WithSegmentSize(2 * aeadMinSegmentSize)},
+			wantSegmentSize: 2 * aeadMinSegmentSize,
+		},
+		{
+			name: "Hint with format version 1",
+			hint: 10,
+			opts: []CallOption{WithFormatVersion(FormatVersion1)},
+		},
+		{
+			name:            "Wrong hint with integrity manifest",
+			hint:            10,
+			opts:            []CallOption{WithIntegrityManifest()},
+			wantSegmentSize: aeadMinSegmentSize,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ciphertext bytes.Buffer
+			opts := append([]CallOption{WithSizeHint(tc.hint)}, tc.opts...)
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "blob", opts...); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			metadata, err := ReadMetadata(bytes.NewReader(ciphertext.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+
+			if got := metadata.GetSegmentSize(); got != tc.wantSegmentSize {
+				t.Errorf("Encrypt recorded segment size %v, want %v", got, tc.wantSegmentSize)
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Error("Decrypt returned different plaintext than was encrypted")
+			}
+		})
+	}
+
+	t.Run("Modified segment size", func(t *testing.T) {
+		var metadataBuf, ciphertext bytes.Buffer
+		if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertext, stetConfig, "blob", WithSizeHint(10)); err != nil {
+			t.Fatalf("EncryptWithSidecar returned error: %v", err)
+		}
+
+		forged := rewriteMetadata(t, metadataBuf.Bytes(), func(md *configpb.Metadata) {
+			md.SegmentSize *= 2
+		})
+
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err == nil {
+			t.Error("DecryptWithSidecar succeeded with modified segment size, want error")
+		}
+	})
+}
+
+func TestEncryptVerifyWrap(t *testing.T) {
+	ctx := context.Background()
+	fakeKMS := &stettest.FakeKMS{}
+	plaintext := []byte("This is data to be encrypted.")
+
+	newConfig := func(threshold int64) *configpb.StetConfig {
+		stetConfig := newFakeKMSConfig(3)
+		stetConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = threshold
+		return stetConfig
+	}
+	failKey := strings.TrimPrefix(newConfig(3).GetEncryptConfig().GetKeyConfig().GetKekInfos()[1].GetKekUri(), gcpKeyPrefix)
+
+	testcases := []struct {
+		name       string
+		stetConfig *configpb.StetConfig
+		kmsClient  cloudkms.Client
+		opts       []CallOption
+		wantErr    bool
+	}{
+		{
+			name:       "All shares unwrap",
+			stetConfig: newConfig(3),
+			kmsClient:  fakeKMS,
+			opts:       []CallOption{WithVerifyWrap()},
+		},
+		{
+			name:       "Unwrap fails below threshold",
+			stetConfig: newConfig(3),
+			kmsClient:  &keyFailingKMS{FakeKMS: fakeKMS, failKey: failKey},
+			opts:       []CallOption{WithVerifyWrap()},
+			wantErr:    true,
+		},
+		{
+			name:       "Unwrap fails above threshold",
+			stetConfig: newConfig(2),
+			kmsClient:  &keyFailingKMS{FakeKMS: fakeKMS, failKey: failKey},
+			opts:       []CallOption{WithVerifyWrap()},
+		},
+		{
+			name:       "Unwrap failure ignored without verification",
+			stetConfig: newConfig(3),
+			kmsClient:  &keyFailingKMS{FakeKMS: fakeKMS, failKey: failKey},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{KMSClient: tc.kmsClient}
+
+			var ciphertext bytes.Buffer
+			_, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, tc.stetConfig, "blob", tc.opts...)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("Encrypt succeeded, want error")
+				}
+				if ciphertext.Len() != 0 {
+					t.Errorf("Encrypt wrote %v bytes after failed verification, want none", ciphertext.Len())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			var output bytes.Buffer
+			if _, err := (&StetClient{KMSClient: fakeKMS}).Decrypt(ctx, &ciphertext, &output, tc.stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
+
+func TestEncryptFailsWithNilConfig(t *testing.T) {
+	var stetClient StetClient
+
+	plaintextBuf := bytes.NewReader([]byte("This is data to be encrypted."))
+	var ciphertextBuf bytes.Buffer
+
+	stetConfig := &configpb.StetConfig{EncryptConfig: nil}
+	if _, err := stetClient.Encrypt(context.Background(), plaintextBuf, &ciphertextBuf, stetConfig, ""); err == nil {
+		t.Errorf("Encrypt expected to fail due to nil EncryptConfig.")
+	}
+}
+
+// Tests Decrypt with various error cases.
+func TestDecryptErrors(t *testing.T) {
+	ciphertext := []byte("I am ciphertext.")
+
+	shamirConfig := configpb.ShamirConfig{
+		Threshold: 2,
+		Shares:    2,
+	}
+
+	kekInfos := []*configpb.KekInfo{
+		&configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+		},
+		&configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+		},
+	}
+
+	// Create test shares and corresponding hashes.
+	testShare := []byte("I am a wrapped share.")
+	testHashedShare := shares.HashShare(testShare)
+	testInvalidHashedShare := shares.HashShare([]byte("I am a different share."))
+
+	wrapped := &configpb.WrappedShare{
+		Share: append(testShare, byte('E')),
+		Hash:  testHashedShare,
+	}
+
+	validKeyCfg := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{&configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+		}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{&shamirConfig},
+	}
+
+	decryptCfg := configpb.DecryptConfig{
+		KeyConfigs: []*configpb.KeyConfig{validKeyCfg},
+	}
+
+	testCases := []struct {
+		name      string
+		metadata  *configpb.Metadata
+		config    *configpb.DecryptConfig
 		errSubstr string
 	}{
 		{
@@ -1827,3 +2708,2573 @@ func TestEnoughUnwrappedShares(t *testing.T) {
 		})
 	}
 }
+
+// concurrencyRecorder records the peak number of concurrent calls to a fake KMS client.
+type concurrencyRecorder struct {
+	mu      sync.Mutex
+	current int
+	peak    int
+}
+
+func (r *concurrencyRecorder) track() func() {
+	r.mu.Lock()
+	r.current++
+	if r.current > r.peak {
+		r.peak = r.current
+	}
+	r.mu.Unlock()
+
+	// Hold the call open long enough for other calls to overlap with it.
+	time.Sleep(20 * time.Millisecond)
+
+	return func() {
+		r.mu.Lock()
+		r.current--
+		r.mu.Unlock()
+	}
+}
+
+func (r *concurrencyRecorder) kmsClient() *testutil.FakeKeyManagementClient {
+	return &testutil.FakeKeyManagementClient{
+		EncryptFunc: func(_ context.Context, req *kmsspb.EncryptRequest, _ ...gax.CallOption) (*kmsspb.EncryptResponse, error) {
+			defer r.track()()
+			return testutil.ValidEncryptResponse(req), nil
+		},
+		DecryptFunc: func(_ context.Context, req *kmsspb.DecryptRequest, _ ...gax.CallOption) (*kmsspb.DecryptResponse, error) {
+			defer r.track()()
+			return testutil.ValidDecryptResponse(req), nil
+		},
+	}
+}
+
+func TestConcurrentShareLimit(t *testing.T) {
+	kekInfo := &configpb.KekInfo{
+		KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+	}
+
+	keyConfig := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{kekInfo, kekInfo, kekInfo, kekInfo, kekInfo, kekInfo},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 3, Shares: 6}},
+	}
+
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	testCases := []struct {
+		name          string
+		clientDefault int
+		opts          []CallOption
+		wantPeak      int
+	}{
+		{
+			name:     "Sequential by default",
+			wantPeak: 1,
+		},
+		{
+			name:          "Client default",
+			clientDefault: 3,
+			wantPeak:      3,
+		},
+		{
+			name:          "Zero limit uses client default",
+			clientDefault: 2,
+			opts:          []CallOption{WithConcurrentShareLimit(0)},
+			wantPeak:      2,
+		},
+		{
+			name:          "Call option overrides client default",
+			clientDefault: 6,
+			opts:          []CallOption{WithConcurrentShareLimit(2)},
+			wantPeak:      2,
+		},
+		{
+			name:          "Call option forces sequential",
+			clientDefault: 6,
+			opts:          []CallOption{WithConcurrentShareLimit(1)},
+			wantPeak:      1,
+		},
+	}
+
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encryptRecorder := &concurrencyRecorder{}
+			stetClient := &StetClient{
+				testKMSClients: &cloudkms.ClientFactory{
+					CredsMap: map[string]cloudkms.Client{"": encryptRecorder.kmsClient()},
+				},
+				MaxConcurrentShares: tc.clientDefault,
+			}
+
+			var ciphertext bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "", tc.opts...); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			if encryptRecorder.peak != tc.wantPeak {
+				t.Errorf("Encrypt had a peak of %v concurrent wraps, want %v", encryptRecorder.peak, tc.wantPeak)
+			}
+
+			decryptRecorder := &concurrencyRecorder{}
+			stetClient.testKMSClients = &cloudkms.ClientFactory{
+				CredsMap: map[string]cloudkms.Client{"": decryptRecorder.kmsClient()},
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.Decrypt(ctx, &ciphertext, &output, stetConfig, tc.opts...); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if decryptRecorder.peak != tc.wantPeak {
+				t.Errorf("Decrypt had a peak of %v concurrent unwraps, want %v", decryptRecorder.peak, tc.wantPeak)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
+
+func TestEncryptAndDecryptWithSidecar(t *testing.T) {
+	keyConfig := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{{
+			KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()},
+		}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	ctx := context.Background()
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var metadataBuf, ciphertextBuf bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertextBuf, stetConfig, "I am blob."); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	// The metadata output should consist of exactly the header and metadata.
+	md, err := ReadMetadata(bytes.NewReader(metadataBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error on sidecar output: %v", err)
+	}
+	if md.GetBlobId() != "I am blob." {
+		t.Errorf("Sidecar metadata has blob ID %v, want %v", md.GetBlobId(), "I am blob.")
+	}
+
+	t.Run("Separate inputs", func(t *testing.T) {
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadataBuf.Bytes()), bytes.NewReader(ciphertextBuf.Bytes()), &output, stetConfig); err != nil {
+			t.Fatalf("DecryptWithSidecar returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("DecryptWithSidecar returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+	})
+
+	t.Run("Concatenated blob", func(t *testing.T) {
+		blob := append(append([]byte{}, metadataBuf.Bytes()...), ciphertextBuf.Bytes()...)
+
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob), &output, stetConfig); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+	})
+
+	t.Run("Mismatched metadata", func(t *testing.T) {
+		var otherMetadataBuf bytes.Buffer
+		if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &otherMetadataBuf, io.Discard, stetConfig, "I am blob."); err != nil {
+			t.Fatalf("EncryptWithSidecar returned error: %v", err)
+		}
+
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptWithSidecar(ctx, &otherMetadataBuf, bytes.NewReader(ciphertextBuf.Bytes()), &output, stetConfig); err == nil {
+			t.Errorf("DecryptWithSidecar returned no error for ciphertext paired with the wrong metadata, want error")
+		}
+	})
+}
+
+func TestOrderSharesByKEK(t *testing.T) {
+	shareA := &configpb.WrappedShare{Share: []byte("A"), KekIndex: 1}
+	shareB := &configpb.WrappedShare{Share: []byte("B"), KekIndex: 2}
+	shareC := &configpb.WrappedShare{Share: []byte("C"), KekIndex: 3}
+	legacyA := &configpb.WrappedShare{Share: []byte("A")}
+	legacyB := &configpb.WrappedShare{Share: []byte("B")}
+
+	testCases := []struct {
+		name    string
+		shares  []*configpb.WrappedShare
+		want    []*configpb.WrappedShare
+		wantErr bool
+	}{
+		{
+			name:   "In order",
+			shares: []*configpb.WrappedShare{shareA, shareB, shareC},
+			want:   []*configpb.WrappedShare{shareA, shareB, shareC},
+		},
+		{
+			name:   "Reordered",
+			shares: []*configpb.WrappedShare{shareC, shareA, shareB},
+			want:   []*configpb.WrappedShare{shareA, shareB, shareC},
+		},
+		{
+			name:   "No indices",
+			shares: []*configpb.WrappedShare{legacyB, legacyA},
+			want:   []*configpb.WrappedShare{legacyB, legacyA},
+		},
+		{
+			name:    "Some shares missing indices",
+			shares:  []*configpb.WrappedShare{shareA, legacyB, shareC},
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate indices",
+			shares:  []*configpb.WrappedShare{shareA, shareA, shareC},
+			wantErr: true,
+		},
+		{
+			name:    "Index out of range",
+			shares:  []*configpb.WrappedShare{shareA, shareB, &configpb.WrappedShare{Share: []byte("D"), KekIndex: 4}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := orderSharesByKEK(tc.shares, 3)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("orderSharesByKEK(%v, 3) returned no error, want error", tc.shares)
+				}
+				return
+			}
+
+			if len(tc.want) != len(tc.shares) {
+				t.Fatalf("Invalid test case: want %v shares, have %v", len(tc.want), len(tc.shares))
+			}
+
+			if err != nil {
+				t.Fatalf("orderSharesByKEK(%v, 3) returned error: %v", tc.shares, err)
+			}
+
+			if diff := cmp.Diff(tc.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("orderSharesByKEK(%v, 3) returned unexpected shares (-want +got):\n%s", tc.shares, diff)
+			}
+		})
+	}
+}
+
+func TestUnwrapAndValidateSharesReordered(t *testing.T) {
+	softwareShare := []byte("software share")
+	hsmShare := []byte("hsm share")
+
+	kekInfos := []*configpb.KekInfo{
+		{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()}},
+		{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()}},
+	}
+
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+	}
+
+	opts := sharesOpts{kekInfos: kekInfos, asymmetricKeys: &configpb.AsymmetricKeys{}}
+	wrapped, _, err := stetClient.wrapShares(context.Background(), [][]byte{softwareShare, hsmShare}, opts)
+	if err != nil {
+		t.Fatalf("wrapShares returned error: %v", err)
+	}
+
+	// Swap the shares, as a faulty rewrite of the metadata might.
+	wrapped[0], wrapped[1] = wrapped[1], wrapped[0]
+
+	unwrapped, err := stetClient.unwrapAndValidateShares(context.Background(), wrapped, opts)
+	if err != nil {
+		t.Fatalf("unwrapAndValidateShares returned error: %v", err)
+	}
+
+	if len(unwrapped) != 2 {
+		t.Fatalf("unwrapAndValidateShares returned %v shares, want 2", len(unwrapped))
+	}
+
+	if !bytes.Equal(unwrapped[0].Share, softwareShare) || !bytes.Equal(unwrapped[1].Share, hsmShare) {
+		t.Errorf("unwrapAndValidateShares returned shares %q and %q, want %q and %q", unwrapped[0].Share, unwrapped[1].Share, softwareShare, hsmShare)
+	}
+
+	// Inconsistent indices should result in a descriptive error.
+	wrapped[0].KekIndex = wrapped[1].KekIndex
+	if _, err := stetClient.unwrapAndValidateShares(context.Background(), wrapped, opts); err == nil || !strings.Contains(err.Error(), "inconsistent share indices") {
+		t.Errorf("unwrapAndValidateShares returned error %v, want error about inconsistent share indices", err)
+	}
+}
+
+func newFakeKMSConfig(numShares int) *configpb.StetConfig {
+	var kekInfos []*configpb.KekInfo
+	for i := 0; i < numShares; i++ {
+		kekInfos = append(kekInfos, &configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: fmt.Sprintf("gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/key%d", i)},
+		})
+	}
+
+	keyConfig := &configpb.KeyConfig{
+		KekInfos:              kekInfos,
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+	if numShares > 1 {
+		keyConfig.KeySplittingAlgorithm = &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: int64(numShares), Shares: int64(numShares)}}
+	}
+
+	return &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+}
+
+func TestEncryptShareCountMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name    string
+		numKEKs int
+	}{
+		{name: "Shamir with extra KEK", numKEKs: 4},
+		{name: "Shamir with missing KEK", numKEKs: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetConfig := newFakeKMSConfig(tc.numKEKs)
+			stetConfig.GetEncryptConfig().GetKeyConfig().KeySplittingAlgorithm = &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 3}}
+			fakeKMS := &stettest.FakeKMS{}
+			stetClient := &StetClient{KMSClient: fakeKMS}
+
+			_, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("data")), &bytes.Buffer{}, stetConfig, "")
+			if err == nil {
+				t.Fatal("Encrypt succeeded, want error")
+			}
+
+			if want := fmt.Sprintf("generates 3 shares but %v KEK Infos are configured", tc.numKEKs); !strings.Contains(err.Error(), want) {
+				t.Errorf("Encrypt returned error %q, want error containing %q", err, want)
+			}
+
+			if fakeKMS.Calls() != 0 {
+				t.Errorf("Encrypt made %v KMS calls, want none before validating the KeyConfig", fakeKMS.Calls())
+			}
+		})
+	}
+}
+
+func TestEncryptAndDecryptWithFakeKMS(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(3)
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{ProtectionLevel: kmsrpb.ProtectionLevel_HSM}}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, &ciphertext, &output, stetConfig); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+	}
+}
+
+func TestEncryptAndDecryptRSAOnlyWithoutKMS(t *testing.T) {
+	ctx := context.Background()
+
+	keys1, fingerprint1 := writeRSAKeyPair(t, 2048)
+	keys2, fingerprint2 := writeRSAKeyPair(t, 2048)
+	keyCfg := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{
+			{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint1}},
+			{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint2}},
+		},
+		DekAlgorithm: configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{
+			Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 2},
+		},
+	}
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig: &configpb.EncryptConfig{KeyConfig: keyCfg},
+		DecryptConfig: &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyCfg}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{
+			PublicKeyFiles:  append(keys1.GetPublicKeyFiles(), keys2.GetPublicKeyFiles()...),
+			PrivateKeyFiles: append(keys1.GetPrivateKeyFiles(), keys2.GetPrivateKeyFiles()...),
+		},
+	}
+
+	// Without a KMSClient, any Cloud KMS use would create the client's
+	// default factory, which connects to Cloud KMS.
+	stetClient := &StetClient{}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, &ciphertext, &output, stetConfig); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+	}
+
+	if stetClient.kmsClients != nil {
+		t.Errorf("Encrypt and Decrypt with only RSA KEKs initialized Cloud KMS clients %v, want none", stetClient.kmsClients.CredsMap)
+	}
+}
+
+func TestShareContext(t *testing.T) {
+	ctx := context.Background()
+	encryptionContext := []byte("projects/test/buckets/test/objects/test")
+
+	ekmKeyConfig := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()}}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+	ekmConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: ekmKeyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{ekmKeyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	kekTypes := []struct {
+		name       string
+		stetClient *StetClient
+		stetConfig *configpb.StetConfig
+	}{
+		{
+			name:       "Cloud KMS",
+			stetClient: &StetClient{KMSClient: &stettest.FakeKMS{}},
+			stetConfig: newFakeKMSConfig(2),
+		},
+		{
+			name: "External EKM",
+			stetClient: &StetClient{
+				KMSClient:               &testutil.FakeKeyManagementClient{},
+				testSecureSessionClient: &testutil.FakeSecureSessionClient{},
+			},
+			stetConfig: ekmConfig,
+		},
+	}
+
+	testcases := []struct {
+		name        string
+		decryptOpts []CallOption
+		wantErr     bool
+	}{
+		{
+			name:        "Same context",
+			decryptOpts: []CallOption{WithShareContext(encryptionContext)},
+		},
+		{
+			name:    "No context",
+			wantErr: true,
+		},
+		{
+			name:        "Different context",
+			decryptOpts: []CallOption{WithShareContext([]byte("projects/test/buckets/test/objects/other"))},
+			wantErr:     true,
+		},
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	for _, kt := range kekTypes {
+		var ciphertext bytes.Buffer
+		if _, err := kt.stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, kt.stetConfig, "", WithShareContext(encryptionContext)); err != nil {
+			t.Fatalf("%v: Encrypt returned error: %v", kt.name, err)
+		}
+
+		for _, tc := range testcases {
+			t.Run(kt.name+"/"+tc.name, func(t *testing.T) {
+				var output bytes.Buffer
+				_, err := kt.stetClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &output, kt.stetConfig, tc.decryptOpts...)
+				if tc.wantErr {
+					if err == nil {
+						t.Error("Decrypt succeeded, want error")
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("Decrypt returned error: %v", err)
+				}
+				if !bytes.Equal(output.Bytes(), plaintext) {
+					t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+				}
+			})
+		}
+	}
+}
+
+func TestShareContextAAD(t *testing.T) {
+	if aad := shareContextAAD("blob", nil); aad != nil {
+		t.Errorf("shareContextAAD(%q, nil) = %v, want nil", "blob", aad)
+	}
+
+	// Contexts must not be confused across blob IDs, even if their
+	// concatenation is the same.
+	if bytes.Equal(shareContextAAD("blob", []byte("context")), shareContextAAD("blobcon", []byte("text"))) {
+		t.Error("shareContextAAD returned the same AAD for different blob IDs and contexts")
+	}
+}
+
+func BenchmarkEncryptAndDecrypt(b *testing.B) {
+	ctx := context.Background()
+	plaintext := random.GetRandomBytes(1 << 20)
+
+	for _, numShares := range []int{1, 3} {
+		stetConfig := newFakeKMSConfig(numShares)
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+		b.Run(fmt.Sprintf("%d shares", numShares), func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				var ciphertext bytes.Buffer
+				if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, ""); err != nil {
+					b.Fatalf("Encrypt returned error: %v", err)
+				}
+
+				if _, err := stetClient.Decrypt(ctx, &ciphertext, io.Discard, stetConfig); err != nil {
+					b.Fatalf("Decrypt returned error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestDecryptFailsFastOnTamperedSegment(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(1)
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	// Eight segments of plaintext.
+	plaintext := make([]byte, 8*aeadSegmentSize)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+
+	var metadataBuf, ciphertextBuf bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertextBuf, stetConfig, ""); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	// Corrupt a byte in the second segment.
+	ciphertext := ciphertextBuf.Bytes()
+	ciphertext[aeadSegmentSize+100] ^= 1
+
+	input := &countingReader{r: bytes.NewReader(ciphertext)}
+	var output bytes.Buffer
+	if _, err := stetClient.DecryptWithSidecar(ctx, &metadataBuf, input, &output, stetConfig); err == nil {
+		t.Fatal("DecryptWithSidecar succeeded on tampered ciphertext, want error")
+	}
+
+	// Only the first segment precedes the corrupted one, so at most its
+	// plaintext may have been written.
+	if output.Len() >= aeadSegmentSize {
+		t.Errorf("DecryptWithSidecar wrote %v bytes of plaintext, want less than %v", output.Len(), aeadSegmentSize)
+	}
+	if !bytes.Equal(output.Bytes(), plaintext[:output.Len()]) {
+		t.Error("DecryptWithSidecar wrote plaintext that does not match the original")
+	}
+
+	// Decryption should stop well before the end of the input.
+	if input.n > 3*aeadSegmentSize {
+		t.Errorf("DecryptWithSidecar read %v bytes of ciphertext, want at most %v", input.n, 3*aeadSegmentSize)
+	}
+}
+
+func TestDecryptWithMetadata(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(2)
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	encrypt := func(plaintext []byte, blobID string) (*configpb.Metadata, []byte) {
+		var metadataBuf, ciphertextBuf bytes.Buffer
+		if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertextBuf, stetConfig, blobID); err != nil {
+			t.Fatalf("EncryptWithSidecar returned error: %v", err)
+		}
+
+		md, err := ReadMetadata(&metadataBuf)
+		if err != nil {
+			t.Fatalf("ReadMetadata returned error: %v", err)
+		}
+
+		return md, ciphertextBuf.Bytes()
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	metadata, ciphertext := encrypt(plaintext, "blob A")
+	otherMetadata, _ := encrypt(plaintext, "blob B")
+
+	t.Run("Matching metadata", func(t *testing.T) {
+		var output bytes.Buffer
+		md, err := stetClient.DecryptWithMetadata(ctx, metadata, bytes.NewReader(ciphertext), &output, stetConfig)
+		if err != nil {
+			t.Fatalf("DecryptWithMetadata returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("DecryptWithMetadata returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+
+		if md.BlobID != "blob A" {
+			t.Errorf("DecryptWithMetadata returned blob ID %v, want %v", md.BlobID, "blob A")
+		}
+	})
+
+	changedBlobID := proto.Clone(metadata).(*configpb.Metadata)
+	changedBlobID.BlobId = "blob B"
+
+	reorderedShares := proto.Clone(metadata).(*configpb.Metadata)
+	reorderedShares.Shares[0].Hash, reorderedShares.Shares[1].Hash = reorderedShares.Shares[1].Hash, reorderedShares.Shares[0].Hash
+
+	testcases := []struct {
+		name     string
+		metadata *configpb.Metadata
+	}{
+		{
+			name:     "Metadata of another blob",
+			metadata: otherMetadata,
+		},
+		{
+			name:     "Changed blob ID",
+			metadata: changedBlobID,
+		},
+		{
+			name:     "Swapped share hashes",
+			metadata: reorderedShares,
+		},
+		{
+			name:     "Nil metadata",
+			metadata: nil,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithMetadata(ctx, tc.metadata, bytes.NewReader(ciphertext), &output, stetConfig); err == nil {
+				t.Fatal("DecryptWithMetadata succeeded with mismatched metadata, want error")
+			}
+
+			if output.Len() != 0 {
+				t.Errorf("DecryptWithMetadata wrote %v bytes of output, want none", output.Len())
+			}
+		})
+	}
+}
+
+func TestEkmSecureSessionMaxDuration(t *testing.T) {
+	md := kekMetadata{uri: testutil.ExternalKEK.URI()}
+	plaintext := []byte("this is plaintext")
+
+	testCases := []struct {
+		name               string
+		latency            time.Duration
+		maxSessionDuration time.Duration
+		wantTimeout        bool
+	}{
+		{
+			name:    "No limit",
+			latency: 10 * time.Millisecond,
+		},
+		{
+			name:               "Session within limit",
+			latency:            time.Millisecond,
+			maxSessionDuration: 10 * time.Second,
+		},
+		{
+			name:               "Slow EKM exceeds limit",
+			latency:            10 * time.Second,
+			maxSessionDuration: 50 * time.Millisecond,
+			wantTimeout:        true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{
+				testSecureSessionClient: &testutil.FakeSecureSessionClient{Latency: tc.latency},
+				MaxSessionDuration:      tc.maxSessionDuration,
+			}
+
+			start := time.Now()
+			wrapped, wrapErr := stetClient.ekmSecureSessionWrap(context.Background(), plaintext, nil, md, nil)
+			_, unwrapErr := stetClient.ekmSecureSessionUnwrap(context.Background(), append(plaintext, 'E'), nil, md, nil)
+			elapsed := time.Since(start)
+
+			if !tc.wantTimeout {
+				if wrapErr != nil || unwrapErr != nil {
+					t.Fatalf("Got errors (%v, %v), want none", wrapErr, unwrapErr)
+				}
+				if !bytes.Equal(wrapped, append(plaintext, 'E')) {
+					t.Errorf("ekmSecureSessionWrap returned %v, want %v", wrapped, append(plaintext, 'E'))
+				}
+				return
+			}
+
+			if !errors.Is(wrapErr, ErrSessionTimeout) {
+				t.Errorf("ekmSecureSessionWrap returned error %v, want %v", wrapErr, ErrSessionTimeout)
+			}
+			if !errors.Is(unwrapErr, ErrSessionTimeout) {
+				t.Errorf("ekmSecureSessionUnwrap returned error %v, want %v", unwrapErr, ErrSessionTimeout)
+			}
+			if elapsed >= tc.latency {
+				t.Errorf("Sessions took %v, want them aborted after %v", elapsed, tc.maxSessionDuration)
+			}
+		})
+	}
+}
+
+func TestKEKTimeouts(t *testing.T) {
+	ctx := context.Background()
+	share := []byte("this is plaintext")
+
+	timeouts := map[kmsrpb.ProtectionLevel]time.Duration{
+		kmsrpb.ProtectionLevel_HSM:      10 * time.Second,
+		kmsrpb.ProtectionLevel_EXTERNAL: 50 * time.Millisecond,
+	}
+
+	testCases := []struct {
+		name         string
+		uri          string
+		wrappedShare []byte
+		ekmLatency   time.Duration
+		wantTimeout  bool
+	}{
+		{
+			name:         "Fast KMS within its timeout",
+			uri:          testutil.HSMKEK.URI(),
+			wrappedShare: testutil.FakeKMSWrap(share, testutil.HSMKEK.Name),
+			ekmLatency:   10 * time.Second,
+		},
+		{
+			name:         "KMS without a timeout",
+			uri:          testutil.SoftwareKEK.URI(),
+			wrappedShare: testutil.FakeKMSWrap(share, testutil.SoftwareKEK.Name),
+			ekmLatency:   10 * time.Second,
+		},
+		{
+			name:         "EKM within its timeout",
+			uri:          testutil.ExternalKEK.URI(),
+			wrappedShare: append(share, 'E'),
+			ekmLatency:   time.Millisecond,
+		},
+		{
+			name:         "Slow EKM exceeds its timeout",
+			uri:          testutil.ExternalKEK.URI(),
+			wrappedShare: append(share, 'E'),
+			ekmLatency:   10 * time.Second,
+			wantTimeout:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{
+				testKMSClients: &cloudkms.ClientFactory{
+					CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+				},
+				testSecureSessionClient: &testutil.FakeSecureSessionClient{Latency: tc.ekmLatency},
+				KEKTimeouts:             timeouts,
+			}
+
+			start := time.Now()
+			wrapped, _, wrapErr := stetClient.wrapKEKURIShare(ctx, stetClient.testKMSClients, tc.uri, share, sharesOpts{})
+			unwrapped, _, _, unwrapErr := stetClient.unwrapKEKURIShare(ctx, stetClient.testKMSClients, tc.uri, tc.wrappedShare, sharesOpts{})
+			elapsed := time.Since(start)
+
+			if !tc.wantTimeout {
+				if wrapErr != nil || unwrapErr != nil {
+					t.Fatalf("Got errors (%v, %v), want none", wrapErr, unwrapErr)
+				}
+				if !bytes.Equal(wrapped, tc.wrappedShare) {
+					t.Errorf("wrapKEKURIShare returned %v, want %v", wrapped, tc.wrappedShare)
+				}
+				if !bytes.Equal(unwrapped, share) {
+					t.Errorf("unwrapKEKURIShare returned %v, want %v", unwrapped, share)
+				}
+				return
+			}
+
+			if !errors.Is(wrapErr, ErrKEKTimeout) {
+				t.Errorf("wrapKEKURIShare returned error %v, want %v", wrapErr, ErrKEKTimeout)
+			}
+			if !errors.Is(unwrapErr, ErrKEKTimeout) {
+				t.Errorf("unwrapKEKURIShare returned error %v, want %v", unwrapErr, ErrKEKTimeout)
+			}
+			if elapsed >= tc.ekmLatency {
+				t.Errorf("Calls took %v, want them aborted after %v", elapsed, timeouts[kmsrpb.ProtectionLevel_EXTERNAL])
+			}
+		})
+	}
+}
+
+func TestEkmSecureSessionMaxDurationCancelled(t *testing.T) {
+	stetClient := &StetClient{
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{Latency: 10 * time.Second},
+		MaxSessionDuration:      10 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := stetClient.ekmSecureSessionWrap(ctx, []byte("this is plaintext"), nil, kekMetadata{uri: testutil.ExternalKEK.URI()}, nil)
+	if err == nil {
+		t.Fatal("ekmSecureSessionWrap succeeded with cancelled context, want error")
+	}
+
+	if errors.Is(err, ErrSessionTimeout) {
+		t.Errorf("ekmSecureSessionWrap returned %v, want an error other than %v", err, ErrSessionTimeout)
+	}
+}
+
+func TestEncryptAndDecryptHeterogeneousKEKs(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	pubKeyFile := dir + "/public.pem"
+	prvKeyFile := dir + "/private.pem"
+	if err := os.WriteFile(pubKeyFile, []byte(testPublicPEM), 0600); err != nil {
+		t.Fatalf("Failed to write test public key: %v", err)
+	}
+	if err := os.WriteFile(prvKeyFile, []byte(testPrivatePEM), 0600); err != nil {
+		t.Fatalf("Failed to write test private key: %v", err)
+	}
+
+	// Share 1 is wrapped with an RSA key, which reports no URI.
+	keyConfig := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{
+			{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: testPublicFingerprint}},
+			{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()}},
+			{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()}},
+		},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 3}},
+	}
+
+	newStetClient := func(ssClient *testutil.FakeSecureSessionClient) *StetClient {
+		return &StetClient{
+			testKMSClients: &cloudkms.ClientFactory{
+				CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+			},
+			testSecureSessionClient: ssClient,
+		}
+	}
+
+	encryptConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		AsymmetricKeys: &configpb.AsymmetricKeys{PublicKeyFiles: []string{pubKeyFile}},
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var ciphertext bytes.Buffer
+	encMd, err := newStetClient(&testutil.FakeSecureSessionClient{}).Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, encryptConfig, "")
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	wantEncryptURIs := []string{testutil.HSMKEK.URI(), testutil.ExternalEKMURI}
+	if diff := cmp.Diff(wantEncryptURIs, encMd.KeyUris); diff != "" {
+		t.Errorf("Encrypt returned unexpected key URIs (-want +got):\n%s", diff)
+	}
+
+	testCases := []struct {
+		name            string
+		privateKeyFiles []string
+		ssClient        *testutil.FakeSecureSessionClient
+		wantURIs        []string
+		wantErr         bool
+	}{
+		{
+			name:            "All shares unwrap",
+			privateKeyFiles: []string{prvKeyFile},
+			ssClient:        &testutil.FakeSecureSessionClient{},
+			wantURIs:        []string{testutil.HSMKEK.URI(), testutil.ExternalEKMURI},
+		},
+		{
+			name:     "RSA key unavailable",
+			ssClient: &testutil.FakeSecureSessionClient{},
+			wantURIs: []string{testutil.HSMKEK.URI(), testutil.ExternalEKMURI},
+		},
+		{
+			name:            "EKM unavailable",
+			privateKeyFiles: []string{prvKeyFile},
+			ssClient:        &testutil.FakeSecureSessionClient{UnwrapErr: errors.New("EKM unavailable")},
+			wantURIs:        []string{testutil.HSMKEK.URI()},
+		},
+		{
+			name:     "RSA key and EKM unavailable",
+			ssClient: &testutil.FakeSecureSessionClient{UnwrapErr: errors.New("EKM unavailable")},
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decryptConfig := &configpb.StetConfig{
+				DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+				AsymmetricKeys: &configpb.AsymmetricKeys{PrivateKeyFiles: tc.privateKeyFiles},
+			}
+
+			var output bytes.Buffer
+			decMd, err := newStetClient(tc.ssClient).Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &output, decryptConfig)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Decrypt returned no error, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+
+			if diff := cmp.Diff(tc.wantURIs, decMd.KeyUris); diff != "" {
+				t.Errorf("Decrypt returned unexpected key URIs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWrapSharesHeterogeneousKEKsError(t *testing.T) {
+	kekInfos := []*configpb.KekInfo{
+		{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()}},
+		{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: testPublicFingerprint}},
+		{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()}},
+	}
+
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{WrapErr: errors.New("EKM unavailable")},
+	}
+
+	// No public keys are configured, so shares 2 and 3 both fail, and the
+	// error for share 2 should be reported.
+	opts := sharesOpts{kekInfos: kekInfos, asymmetricKeys: &configpb.AsymmetricKeys{}}
+	_, _, err := stetClient.wrapShares(context.Background(), [][]byte{[]byte("1"), []byte("2"), []byte("3")}, opts)
+	if err == nil {
+		t.Fatal("wrapShares returned no error, want error")
+	}
+
+	wantSubstr := "share #2 with RSA fingerprint " + testPublicFingerprint
+	if !strings.Contains(err.Error(), wantSubstr) {
+		t.Errorf("wrapShares returned error %q, want error containing %q", err, wantSubstr)
+	}
+}
+
+func TestDecryptReport(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	keyConfig := newShamirKeyConfig("key", 2, 3)
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	var metadata, ciphertext bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader([]byte("plaintext")), &metadata, &ciphertext, stetConfig, ""); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	testCases := []struct {
+		name              string
+		corruptShares     []int
+		wantFailed        []bool
+		wantReconstructed bool
+	}{
+		{
+			name:              "All shares succeed",
+			wantFailed:        []bool{false, false, false},
+			wantReconstructed: true,
+		},
+		{
+			name:              "One share fails",
+			corruptShares:     []int{1},
+			wantFailed:        []bool{false, true, false},
+			wantReconstructed: true,
+		},
+		{
+			name:              "Too many shares fail",
+			corruptShares:     []int{0, 2},
+			wantFailed:        []bool{true, false, true},
+			wantReconstructed: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Corrupting a share makes it fail validation after unwrapping.
+			md := rewriteMetadata(t, metadata.Bytes(), func(md *configpb.Metadata) {
+				for _, i := range tc.corruptShares {
+					md.GetShares()[i].Hash[0] ^= 1
+				}
+			})
+
+			var report DecryptReport
+			_, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(md), bytes.NewReader(ciphertext.Bytes()), io.Discard, stetConfig, WithDecryptReport(&report))
+			if len(tc.corruptShares) == 0 && err != nil {
+				t.Fatalf("DecryptWithSidecar returned error: %v", err)
+			} else if len(tc.corruptShares) != 0 && err == nil {
+				t.Fatal("DecryptWithSidecar succeeded with corrupted shares, want error")
+			}
+
+			if report.Reconstructed != tc.wantReconstructed {
+				t.Errorf("DecryptReport.Reconstructed = %v, want %v", report.Reconstructed, tc.wantReconstructed)
+			}
+
+			if len(report.Shares) != len(tc.wantFailed) {
+				t.Fatalf("DecryptReport has %v shares, want %v", len(report.Shares), len(tc.wantFailed))
+			}
+
+			for i, share := range report.Shares {
+				if share.Index != i {
+					t.Errorf("DecryptReport.Shares[%v].Index = %v, want %v", i, share.Index, i)
+				}
+
+				wantKEK := kekDescription(keyConfig.GetKekInfos()[i])
+				if share.KEK != wantKEK {
+					t.Errorf("DecryptReport.Shares[%v].KEK = %q, want %q", i, share.KEK, wantKEK)
+				}
+
+				if failed := share.Err != nil; failed != tc.wantFailed[i] {
+					t.Errorf("DecryptReport.Shares[%v] failed = %v (err: %v), want %v", i, failed, share.Err, tc.wantFailed[i])
+				}
+
+				if !tc.wantFailed[i] && share.URI == "" {
+					t.Errorf("DecryptReport.Shares[%v].URI is empty for a successful share", i)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptReportUnusedShares(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	// A 2-of-5 config, over-provisioned with more KEKs than needed.
+	keyConfig := newShamirKeyConfig("key", 2, 5)
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("plaintext")), &blob, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	keyURI := func(i int) string {
+		return keyConfig.GetKekInfos()[i].GetKekUri()
+	}
+
+	// The first share fails to unwrap and the last KEK is not available, so
+	// the second and third shares are combined and the fourth is unused.
+	stetClient.KMSClient = &keyFailingKMS{FakeKMS: &stettest.FakeKMS{}, failKey: strings.TrimPrefix(keyURI(0), gcpKeyPrefix)}
+
+	var report DecryptReport
+	if _, err := stetClient.Decrypt(ctx, &blob, io.Discard, stetConfig, WithDecryptReport(&report), WithAvailableKEKs(keyURI(0), keyURI(1), keyURI(2), keyURI(3))); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	var combined []int
+	for _, share := range report.Shares {
+		if share.Combined {
+			combined = append(combined, share.Index)
+		}
+	}
+
+	if want := []int{1, 2}; !cmp.Equal(combined, want) {
+		t.Errorf("Decrypt combined shares %v, want %v", combined, want)
+	}
+	if want := []int{3}; !cmp.Equal(report.Unused, want) {
+		t.Errorf("DecryptReport.Unused = %v, want %v", report.Unused, want)
+	}
+	if want := []int{4}; !cmp.Equal(report.Skipped, want) {
+		t.Errorf("DecryptReport.Skipped = %v, want %v", report.Skipped, want)
+	}
+}
+
+func TestMaxMetadataSize(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	plaintext := []byte("This is data to be encrypted.")
+
+	// Find the metadata size of a blob with a single share.
+	var unlimited bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &unlimited, newFakeKMSConfig(1), "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	header, err := ReadSTETHeader(&unlimited)
+	if err != nil {
+		t.Fatalf("ReadSTETHeader returned error: %v", err)
+	}
+	size := int(header.MetadataLen)
+
+	testcases := []struct {
+		name      string
+		numShares int
+		limit     int
+		wantErr   bool
+	}{
+		{
+			name:      "No limit",
+			numShares: 3,
+			limit:     0,
+		},
+		{
+			name:      "Exactly at limit",
+			numShares: 1,
+			limit:     size,
+		},
+		{
+			name:      "One byte over limit",
+			numShares: 1,
+			limit:     size - 1,
+			wantErr:   true,
+		},
+		{
+			name:      "Too many shares",
+			numShares: 3,
+			limit:     size,
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			_, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &output, newFakeKMSConfig(tc.numShares), "blob", WithMaxMetadataSize(tc.limit))
+			if !tc.wantErr {
+				if err != nil {
+					t.Errorf("Encrypt returned error: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("Encrypt succeeded with metadata over the limit, want error")
+			}
+
+			if !strings.Contains(err.Error(), fmt.Sprintf("maximum of %v", tc.limit)) {
+				t.Errorf("Encrypt returned error %q, want it to report the limit %v", err, tc.limit)
+			}
+
+			if output.Len() != 0 {
+				t.Errorf("Encrypt wrote %v bytes of output, want none", output.Len())
+			}
+		})
+	}
+}
+
+func TestDecryptWithBlobKeyConfig(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+
+	encryptConfig := newFakeKMSConfig(3)
+	var metadataBuf, ciphertextBuf bytes.Buffer
+	if _, err := (&StetClient{KMSClient: &stettest.FakeKMS{}}).EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertextBuf, encryptConfig, "blob"); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		kms        *stettest.FakeKMS
+		stetConfig *configpb.StetConfig
+		mutate     func(*configpb.Metadata)
+		opts       []CallOption
+		wantErr    bool
+	}{
+		{
+			name:       "No DecryptConfig",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: &configpb.StetConfig{AsymmetricKeys: &configpb.AsymmetricKeys{}},
+			opts:       []CallOption{WithBlobKeyConfig()},
+		},
+		{
+			name:       "Non-matching DecryptConfig is ignored",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: newFakeKMSConfig(1),
+			opts:       []CallOption{WithBlobKeyConfig()},
+		},
+		{
+			name:       "No DecryptConfig without option",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: &configpb.StetConfig{AsymmetricKeys: &configpb.AsymmetricKeys{}},
+			wantErr:    true,
+		},
+		{
+			name:       "Caller cannot unwrap shares",
+			kms:        &stettest.FakeKMS{DecryptErr: fmt.Errorf("permission denied")},
+			stetConfig: &configpb.StetConfig{AsymmetricKeys: &configpb.AsymmetricKeys{}},
+			opts:       []CallOption{WithBlobKeyConfig()},
+			wantErr:    true,
+		},
+		{
+			name:       "KEKs do not match shares",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: &configpb.StetConfig{AsymmetricKeys: &configpb.AsymmetricKeys{}},
+			mutate: func(md *configpb.Metadata) {
+				md.GetKeyConfig().KekInfos = md.GetKeyConfig().GetKekInfos()[:2]
+			},
+			opts:    []CallOption{WithBlobKeyConfig()},
+			wantErr: true,
+		},
+		{
+			name:       "Threshold exceeds shares",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: &configpb.StetConfig{AsymmetricKeys: &configpb.AsymmetricKeys{}},
+			mutate: func(md *configpb.Metadata) {
+				md.GetKeyConfig().GetShamir().Threshold = 4
+			},
+			opts:    []CallOption{WithBlobKeyConfig()},
+			wantErr: true,
+		},
+		{
+			name:       "Missing KeyConfig",
+			kms:        &stettest.FakeKMS{},
+			stetConfig: &configpb.StetConfig{AsymmetricKeys: &configpb.AsymmetricKeys{}},
+			mutate: func(md *configpb.Metadata) {
+				md.KeyConfig = nil
+			},
+			opts:    []CallOption{WithBlobKeyConfig()},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			md := metadataBuf.Bytes()
+			if tc.mutate != nil {
+				md = rewriteMetadata(t, md, tc.mutate)
+			}
+
+			stetClient := &StetClient{KMSClient: tc.kms}
+
+			var output bytes.Buffer
+			_, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(md), bytes.NewReader(ciphertextBuf.Bytes()), &output, tc.stetConfig, tc.opts...)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("DecryptWithSidecar succeeded, want error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("DecryptWithSidecar returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("DecryptWithSidecar returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
+
+func TestNilAsymmetricKeys(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Pure KMS config", func(t *testing.T) {
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+		stetConfig := newFakeKMSConfig(3)
+		stetConfig.AsymmetricKeys = nil
+
+		plaintext := []byte("This is data to be encrypted.")
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob"); err != nil {
+			t.Fatalf("Encrypt returned error with nil AsymmetricKeys: %v", err)
+		}
+
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, &blob, &output, stetConfig); err != nil {
+			t.Fatalf("Decrypt returned error with nil AsymmetricKeys: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+	})
+
+	t.Run("Wrap and unwrap shares", func(t *testing.T) {
+		sharesList := [][]byte{[]byte("share1"), []byte("share2")}
+		stetClient := &StetClient{
+			testKMSClients: &cloudkms.ClientFactory{
+				CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+			},
+			testSecureSessionClient: &testutil.FakeSecureSessionClient{},
+		}
+
+		opts := sharesOpts{kekInfos: []*configpb.KekInfo{
+			{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.SoftwareKEK.URI()}},
+			{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()}},
+		}}
+
+		wrapped, _, err := stetClient.wrapShares(ctx, sharesList, opts)
+		if err != nil {
+			t.Fatalf("wrapShares returned error with nil AsymmetricKeys: %v", err)
+		}
+
+		unwrapped, err := stetClient.unwrapAndValidateShares(ctx, wrapped, opts)
+		if err != nil {
+			t.Fatalf("unwrapAndValidateShares returned error with nil AsymmetricKeys: %v", err)
+		}
+
+		for i, share := range unwrapped {
+			if !bytes.Equal(share.Share, sharesList[i]) {
+				t.Errorf("unwrapAndValidateShares returned share %v, want %v", share.Share, sharesList[i])
+			}
+		}
+	})
+
+	t.Run("RSA fingerprint", func(t *testing.T) {
+		var stetClient StetClient
+		opts := sharesOpts{kekInfos: []*configpb.KekInfo{
+			{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: testPublicFingerprint}},
+		}}
+
+		_, _, err := stetClient.wrapShares(ctx, [][]byte{[]byte("share")}, opts)
+		if err == nil {
+			t.Fatal("wrapShares succeeded for an RSA fingerprint KEK with nil AsymmetricKeys, want error")
+		}
+
+		if !strings.Contains(err.Error(), "no public key files are configured") {
+			t.Errorf("wrapShares returned error %q, want it to report missing public keys", err)
+		}
+
+		// Failures to unwrap individual shares are recorded in the report.
+		var report DecryptReport
+		opts.report = &report
+		wrapped := []*configpb.WrappedShare{{Share: []byte("wrapped"), Hash: make([]byte, sha256.Size)}}
+		unwrapped, err := stetClient.unwrapAndValidateShares(ctx, wrapped, opts)
+		if err != nil {
+			t.Fatalf("unwrapAndValidateShares returned error: %v", err)
+		}
+
+		if len(unwrapped) != 0 {
+			t.Fatalf("unwrapAndValidateShares unwrapped %v shares for an RSA fingerprint KEK with nil AsymmetricKeys, want 0", len(unwrapped))
+		}
+
+		if len(report.Shares) != 1 || report.Shares[0].Err == nil {
+			t.Fatalf("DecryptReport.Shares = %v, want one failed share", report.Shares)
+		}
+
+		if !strings.Contains(report.Shares[0].Err.Error(), "no private key files are configured") {
+			t.Errorf("unwrapAndValidateShares failed with %q, want it to report missing private keys", report.Shares[0].Err)
+		}
+	})
+}
+
+func TestEncryptAndDecryptWithShareHashAlgorithm(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	testCases := []struct {
+		alg     configpb.ShareHashAlgorithm
+		hashLen int
+	}{
+		{alg: configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH, hashLen: sha256.Size},
+		{alg: configpb.ShareHashAlgorithm_SHA384, hashLen: 48},
+		{alg: configpb.ShareHashAlgorithm_SHA512, hashLen: 64},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.alg.String(), func(t *testing.T) {
+			var metadata, ciphertext bytes.Buffer
+			if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadata, &ciphertext, stetConfig, "", WithShareHashAlgorithm(tc.alg)); err != nil {
+				t.Fatalf("EncryptWithSidecar returned error: %v", err)
+			}
+
+			md, err := ReadMetadata(bytes.NewReader(metadata.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+
+			for i, share := range md.GetShares() {
+				if share.GetHashAlgorithm() != tc.alg {
+					t.Errorf("Share %v has hash algorithm %v, want %v", i, share.GetHashAlgorithm(), tc.alg)
+				}
+				if len(share.GetHash()) != tc.hashLen {
+					t.Errorf("Share %v has a %v-byte hash, want %v bytes", i, len(share.GetHash()), tc.hashLen)
+				}
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata.Bytes()), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err != nil {
+				t.Fatalf("DecryptWithSidecar returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("DecryptWithSidecar returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+
+			// Changing the recorded algorithm makes the shares fail validation.
+			forged := rewriteMetadata(t, metadata.Bytes(), func(md *configpb.Metadata) {
+				for _, share := range md.GetShares() {
+					share.HashAlgorithm = configpb.ShareHashAlgorithm_SHA256
+					if tc.alg == configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH {
+						share.HashAlgorithm = configpb.ShareHashAlgorithm_SHA512
+					}
+				}
+			})
+
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext.Bytes()), io.Discard, stetConfig); err == nil {
+				t.Error("DecryptWithSidecar succeeded with a forged share hash algorithm, want error")
+			}
+		})
+	}
+
+	t.Run("Unknown algorithm", func(t *testing.T) {
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "", WithShareHashAlgorithm(configpb.ShareHashAlgorithm(100))); err == nil {
+			t.Error("Encrypt succeeded with an unknown share hash algorithm, want error")
+		}
+	})
+}
+
+func TestDecryptWithMinShareProtectionLevel(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{},
+	}
+
+	kekInfo := func(kek *testutil.KEK) *configpb.KekInfo {
+		return &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: kek.URI()}}
+	}
+
+	testCases := []struct {
+		name       string
+		keks       []*testutil.KEK
+		minLevel   configpb.ShareProtectionLevel
+		wantFailed []bool
+		wantErr    bool
+	}{
+		{
+			name:       "Any level",
+			keks:       []*testutil.KEK{testutil.SoftwareKEK, testutil.SoftwareKEK, testutil.HSMKEK},
+			minLevel:   configpb.ShareProtectionLevel_ANY_PROTECTION_LEVEL,
+			wantFailed: []bool{false, false, false},
+		},
+		{
+			name:       "HSM minimum met by HSM and external shares",
+			keks:       []*testutil.KEK{testutil.SoftwareKEK, testutil.HSMKEK, testutil.ExternalKEK},
+			minLevel:   configpb.ShareProtectionLevel_HSM_PROTECTION_LEVEL,
+			wantFailed: []bool{true, false, false},
+		},
+		{
+			name:       "HSM minimum not met",
+			keks:       []*testutil.KEK{testutil.SoftwareKEK, testutil.SoftwareKEK, testutil.HSMKEK},
+			minLevel:   configpb.ShareProtectionLevel_HSM_PROTECTION_LEVEL,
+			wantFailed: []bool{true, true, false},
+			wantErr:    true,
+		},
+		{
+			name:       "External minimum met",
+			keks:       []*testutil.KEK{testutil.HSMKEK, testutil.ExternalKEK, testutil.ExternalKEK},
+			minLevel:   configpb.ShareProtectionLevel_EXTERNAL_PROTECTION_LEVEL,
+			wantFailed: []bool{true, false, false},
+		},
+		{
+			name:       "External minimum not met",
+			keks:       []*testutil.KEK{testutil.SoftwareKEK, testutil.HSMKEK, testutil.ExternalKEK},
+			minLevel:   configpb.ShareProtectionLevel_EXTERNAL_PROTECTION_LEVEL,
+			wantFailed: []bool{true, true, false},
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var kekInfos []*configpb.KekInfo
+			for _, kek := range tc.keks {
+				kekInfos = append(kekInfos, kekInfo(kek))
+			}
+
+			keyConfig := &configpb.KeyConfig{
+				KekInfos:              kekInfos,
+				DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+				KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 3}},
+			}
+			stetConfig := &configpb.StetConfig{
+				EncryptConfig: &configpb.EncryptConfig{KeyConfig: keyConfig},
+				DecryptConfig: &configpb.DecryptConfig{
+					KeyConfigs:              []*configpb.KeyConfig{keyConfig},
+					MinShareProtectionLevel: tc.minLevel,
+				},
+			}
+
+			var blob bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, ""); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			var report DecryptReport
+			var output bytes.Buffer
+			_, err := stetClient.Decrypt(ctx, &blob, &output, stetConfig, WithDecryptReport(&report))
+			if tc.wantErr {
+				if err == nil {
+					t.Error("Decrypt succeeded without enough shares at the minimum protection level, want error")
+				}
+			} else if err != nil {
+				t.Errorf("Decrypt returned error: %v", err)
+			} else if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+
+			if len(report.Shares) != len(tc.wantFailed) {
+				t.Fatalf("DecryptReport has %v shares, want %v", len(report.Shares), len(tc.wantFailed))
+			}
+
+			for i, share := range report.Shares {
+				if failed := share.Err != nil; failed != tc.wantFailed[i] {
+					t.Errorf("DecryptReport.Shares[%v] failed = %v (err: %v), want %v", i, failed, share.Err, tc.wantFailed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUnwrapWithNonPrimaryVersionProtectionLevel(t *testing.T) {
+	ctx := context.Background()
+	share := []byte("this is plaintext")
+
+	testCases := []struct {
+		name string
+		kek  *testutil.KEK
+		// The protection level Cloud KMS reports for the version used.
+		usedLevel kmsrpb.ProtectionLevel
+		wantErr   bool
+	}{
+		{
+			name:      "HSM version of software primary",
+			kek:       testutil.SoftwareKEK,
+			usedLevel: kmsrpb.ProtectionLevel_HSM,
+		},
+		{
+			name:      "Software version of HSM primary",
+			kek:       testutil.HSMKEK,
+			usedLevel: kmsrpb.ProtectionLevel_SOFTWARE,
+			wantErr:   true,
+		},
+		{
+			name: "Level not reported",
+			kek:  testutil.HSMKEK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kmsClient := &testutil.FakeKeyManagementClient{
+				DecryptFunc: func(_ context.Context, req *kmsspb.DecryptRequest, _ ...gax.CallOption) (*kmsspb.DecryptResponse, error) {
+					resp := testutil.ValidDecryptResponse(req)
+					resp.ProtectionLevel = tc.usedLevel
+					return resp, nil
+				},
+			}
+			stetClient := &StetClient{
+				testKMSClients: &cloudkms.ClientFactory{CredsMap: map[string]cloudkms.Client{"": kmsClient}},
+			}
+
+			opts := sharesOpts{minProtectionLevel: configpb.ShareProtectionLevel_HSM_PROTECTION_LEVEL}
+			unwrapped, _, pl, err := stetClient.unwrapKEKURIShare(ctx, stetClient.testKMSClients, tc.kek.URI(), testutil.FakeKMSWrap(share, tc.kek.Name), opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("unwrapKEKURIShare succeeded with a version below the minimum protection level, want error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unwrapKEKURIShare returned error: %v", err)
+			}
+			if !bytes.Equal(unwrapped, share) {
+				t.Errorf("unwrapKEKURIShare returned %v, want %v", unwrapped, share)
+			}
+			if tc.usedLevel != kmsrpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED && pl != tc.usedLevel {
+				t.Errorf("unwrapKEKURIShare returned protection level %v, want %v", pl, tc.usedLevel)
+			}
+		})
+	}
+}
+
+func TestKMSResourceName(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+
+	// The fake only knows the test KEKs by their standard resource names, so
+	// the emulator-style URIs below must be mapped to them.
+	emulatorNames := map[string]string{
+		"gcp-kms://emulator/hsm-key":      testutil.HSMKEK.Name,
+		"gcp-kms://emulator/software-key": testutil.SoftwareKEK.Name,
+	}
+	resolver := func(uri string) (string, error) {
+		name, ok := emulatorNames[uri]
+		if !ok {
+			return "", fmt.Errorf("unknown key %v", uri)
+		}
+		return name, nil
+	}
+
+	keyConfig := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{
+			{KekType: &configpb.KekInfo_KekUri{KekUri: "gcp-kms://emulator/hsm-key"}},
+			{KekType: &configpb.KekInfo_KekUri{KekUri: "gcp-kms://emulator/software-key"}},
+		},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 2}},
+	}
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig: &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig: &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+	}
+
+	newClient := func(resolver func(string) (string, error)) *StetClient {
+		return &StetClient{
+			testKMSClients: &cloudkms.ClientFactory{
+				CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+			},
+			KMSResourceName: resolver,
+		}
+	}
+
+	t.Run("Custom resolver", func(t *testing.T) {
+		stetClient := newClient(resolver)
+
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, ""); err != nil {
+			t.Fatalf("Encrypt returned error: %v", err)
+		}
+
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, &blob, &output, stetConfig); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+	})
+
+	t.Run("Default resolver", func(t *testing.T) {
+		var blob bytes.Buffer
+		if _, err := newClient(nil).Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, ""); err == nil {
+			t.Error("Encrypt succeeded for emulator URIs without a resolver, want error")
+		}
+	})
+
+	t.Run("Resolver error", func(t *testing.T) {
+		failing := func(uri string) (string, error) {
+			return "", fmt.Errorf("no mapping")
+		}
+
+		var blob bytes.Buffer
+		if _, err := newClient(failing).Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, ""); err == nil {
+			t.Error("Encrypt succeeded with a failing resolver, want error")
+		}
+	})
+}
+
+func TestImportedKEKs(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	stetConfig := newFakeKMSConfig(2)
+	importJob := "projects/test/locations/test/keyRings/test/importJobs/job"
+
+	importedKMS := &stettest.FakeKMS{ImportJob: importJob}
+	generatedKMS := &stettest.FakeKMS{}
+
+	testCases := []struct {
+		name       string
+		encryptKMS *stettest.FakeKMS
+		decryptKMS *stettest.FakeKMS
+		encryptErr bool
+		decryptErr bool
+	}{
+		{
+			name:       "Imported KEKs",
+			encryptKMS: importedKMS,
+			decryptKMS: importedKMS,
+		},
+		{
+			name:       "Generated KEKs on encrypt",
+			encryptKMS: generatedKMS,
+			encryptErr: true,
+		},
+		{
+			name:       "Generated KEKs on decrypt",
+			encryptKMS: importedKMS,
+			decryptKMS: generatedKMS,
+			decryptErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &captureLogger{}
+			stetClient := &StetClient{KMSClient: tc.encryptKMS, Logger: logger}
+
+			var blob bytes.Buffer
+			_, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "", WithImportedKEKs())
+			if tc.encryptErr {
+				if err == nil {
+					t.Error("Encrypt succeeded with KEKs that are not imported, want error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			stetClient = &StetClient{KMSClient: tc.decryptKMS, Logger: logger}
+			var output bytes.Buffer
+			_, err = stetClient.Decrypt(ctx, bytes.NewReader(blob.Bytes()), &output, stetConfig, WithImportedKEKs())
+			if tc.decryptErr {
+				if err == nil {
+					t.Error("Decrypt succeeded with KEKs that are not imported, want error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+
+			// Each of the two KEKs is recorded on both encrypt and decrypt.
+			var recorded int
+			for _, line := range logger.lines {
+				if strings.Contains(line, importJob) {
+					recorded++
+				}
+			}
+			if recorded != 4 {
+				t.Errorf("Import job logged %v times, want 4:\n%v", recorded, strings.Join(logger.lines, "\n"))
+			}
+		})
+	}
+
+	t.Run("Not required", func(t *testing.T) {
+		stetClient := &StetClient{KMSClient: generatedKMS}
+
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, ""); err != nil {
+			t.Fatalf("Encrypt returned error: %v", err)
+		}
+
+		if _, err := stetClient.Decrypt(ctx, &blob, io.Discard, stetConfig); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+	})
+}
+
+func TestKEKVersionStates(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	keyName := "projects/test/locations/test/keyRings/test/cryptoKeys/key0"
+	primary := keyName + "/cryptoKeyVersions/1"
+	pinned := keyName + "/cryptoKeyVersions/2"
+
+	// The unpinned config uses the primary version, and the pinned config
+	// version 2, which is no longer the primary.
+	unpinnedConfig := newFakeKMSConfig(1)
+	pinnedConfig := newFakeKMSConfig(1)
+	pinnedConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[0].KekType = &configpb.KekInfo_KekUri{KekUri: gcpKeyPrefix + pinned}
+
+	testCases := []struct {
+		name          string
+		stetConfig    *configpb.StetConfig
+		states        map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState
+		allowDisabled bool
+		wantErr       error
+	}{
+		{
+			name:       "Pinned version enabled",
+			stetConfig: pinnedConfig,
+		},
+		{
+			name:       "Pinned version enabled with primary destroyed",
+			stetConfig: pinnedConfig,
+			states:     map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{primary: kmsrpb.CryptoKeyVersion_DESTROYED},
+		},
+		{
+			name:       "Pinned version disabled",
+			stetConfig: pinnedConfig,
+			states:     map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{pinned: kmsrpb.CryptoKeyVersion_DISABLED},
+			wantErr:    ErrKEKVersionDisabled,
+		},
+		{
+			name:       "Pinned version scheduled for destruction",
+			stetConfig: pinnedConfig,
+			states:     map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{pinned: kmsrpb.CryptoKeyVersion_DESTROY_SCHEDULED},
+			wantErr:    ErrKEKVersionDisabled,
+		},
+		{
+			name:       "Pinned version destroyed",
+			stetConfig: pinnedConfig,
+			states:     map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{pinned: kmsrpb.CryptoKeyVersion_DESTROYED},
+			wantErr:    ErrKEKVersionDestroyed,
+		},
+		{
+			name:          "Pinned version disabled with disabled versions allowed",
+			stetConfig:    pinnedConfig,
+			states:        map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{pinned: kmsrpb.CryptoKeyVersion_DISABLED},
+			allowDisabled: true,
+		},
+		{
+			name:          "Pinned version destroyed with disabled versions allowed",
+			stetConfig:    pinnedConfig,
+			states:        map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{pinned: kmsrpb.CryptoKeyVersion_DESTROYED},
+			allowDisabled: true,
+			wantErr:       ErrKEKVersionDestroyed,
+		},
+		{
+			name:       "Primary version disabled",
+			stetConfig: unpinnedConfig,
+			states:     map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{primary: kmsrpb.CryptoKeyVersion_DISABLED},
+			wantErr:    ErrKEKVersionDisabled,
+		},
+		{
+			name:       "Primary version destroyed",
+			stetConfig: unpinnedConfig,
+			states:     map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{primary: kmsrpb.CryptoKeyVersion_DESTROYED},
+			wantErr:    ErrKEKVersionDestroyed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Encrypt while every version is enabled.
+			stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+			var blob bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, tc.stetConfig, ""); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			stetClient = &StetClient{KMSClient: &stettest.FakeKMS{VersionStates: tc.states}}
+			report := &DecryptReport{}
+			opts := []CallOption{WithDecryptReport(report)}
+			if tc.allowDisabled {
+				opts = append(opts, WithDisabledKEKVersions())
+			}
+
+			var output bytes.Buffer
+			_, err := stetClient.Decrypt(ctx, bytes.NewReader(blob.Bytes()), &output, tc.stetConfig, opts...)
+			if tc.wantErr != nil {
+				if err == nil {
+					t.Fatal("Decrypt succeeded, want error")
+				}
+				if shareErr := report.Shares[0].Err; !errors.Is(shareErr, tc.wantErr) {
+					t.Errorf("Decrypt reported share error %v, want %v", shareErr, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+		})
+	}
+
+	t.Run("Disabled version allowed but unwrapping fails", func(t *testing.T) {
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, pinnedConfig, ""); err != nil {
+			t.Fatalf("Encrypt returned error: %v", err)
+		}
+
+		stetClient = &StetClient{KMSClient: &stettest.FakeKMS{
+			VersionStates: map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{pinned: kmsrpb.CryptoKeyVersion_DISABLED},
+			DecryptErr:    errors.New("key version is disabled"),
+		}}
+
+		report := &DecryptReport{}
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob.Bytes()), io.Discard, pinnedConfig, WithDisabledKEKVersions(), WithDecryptReport(report)); err == nil {
+			t.Fatal("Decrypt succeeded, want error")
+		}
+
+		if shareErr := report.Shares[0].Err; !errors.Is(shareErr, ErrKEKVersionDisabled) {
+			t.Errorf("Decrypt reported share error %v, want %v", shareErr, ErrKEKVersionDisabled)
+		}
+	})
+
+	t.Run("Encrypt with disabled pinned version", func(t *testing.T) {
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{
+			VersionStates: map[string]kmsrpb.CryptoKeyVersion_CryptoKeyVersionState{pinned: kmsrpb.CryptoKeyVersion_DISABLED},
+		}}
+
+		_, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), io.Discard, pinnedConfig, "", WithDisabledKEKVersions())
+		if !errors.Is(err, ErrKEKVersionDisabled) {
+			t.Errorf("Encrypt returned error %v, want %v", err, ErrKEKVersionDisabled)
+		}
+	})
+}
+
+// slowKeyKMS is a FakeKMS that is slow to decrypt with a single key, until
+// the request is cancelled.
+type slowKeyKMS struct {
+	*stettest.FakeKMS
+	slowKey string
+	delay   time.Duration
+}
+
+func (k *slowKeyKMS) Decrypt(ctx context.Context, req *kmsspb.DecryptRequest, opts ...gax.CallOption) (*kmsspb.DecryptResponse, error) {
+	if req.GetName() == k.slowKey {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(k.delay):
+		}
+	}
+	return k.FakeKMS.Decrypt(ctx, req, opts...)
+}
+
+func TestHedgedUnwrap(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+
+	// A 2-of-3 KeyConfig, with one share more than needed.
+	stetConfig := newFakeKMSConfig(3)
+	stetConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 2
+	keyName := func(i int) string {
+		return strings.TrimPrefix(stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[i].GetKekUri(), gcpKeyPrefix)
+	}
+
+	fakeKMS := &stettest.FakeKMS{}
+	stetClient := &StetClient{KMSClient: fakeKMS}
+
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	const slowDelay = 2 * time.Second
+
+	testcases := []struct {
+		name string
+		kms  cloudkms.Client
+		opts []CallOption
+		// The shares expected to be unwrapped and not needed.
+		wantUnwrapped []int
+		wantUnneeded  []int
+	}{
+		{
+			name:          "Slow KEK",
+			kms:           &slowKeyKMS{FakeKMS: fakeKMS, slowKey: keyName(0), delay: slowDelay},
+			opts:          []CallOption{WithHedgedUnwrap(1)},
+			wantUnwrapped: []int{1, 2},
+			wantUnneeded:  []int{0},
+		},
+		{
+			name:          "No extra requests",
+			kms:           fakeKMS,
+			opts:          []CallOption{WithHedgedUnwrap(0)},
+			wantUnwrapped: []int{0, 1},
+			wantUnneeded:  []int{2},
+		},
+		{
+			name:          "Failed KEK replaced",
+			kms:           &keyFailingKMS{FakeKMS: fakeKMS, failKey: keyName(0)},
+			opts:          []CallOption{WithHedgedUnwrap(0)},
+			wantUnwrapped: []int{1, 2},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{KMSClient: tc.kms}
+
+			var report DecryptReport
+			var output bytes.Buffer
+			start := time.Now()
+			if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob.Bytes()), &output, stetConfig, append(tc.opts, WithDecryptReport(&report))...); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if elapsed := time.Since(start); elapsed >= slowDelay/2 {
+				t.Errorf("Decrypt took %v, want less than %v despite the slow KEK", elapsed, slowDelay/2)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+
+			for _, i := range tc.wantUnwrapped {
+				if err := report.Shares[i].Err; err != nil {
+					t.Errorf("Decrypt reported error for share #%v: %v, want it unwrapped", i+1, err)
+				}
+			}
+			for _, i := range tc.wantUnneeded {
+				if err := report.Shares[i].Err; !errors.Is(err, ErrShareNotNeeded) {
+					t.Errorf("Decrypt reported error for share #%v: %v, want %v", i+1, err, ErrShareNotNeeded)
+				}
+			}
+		})
+	}
+}
+
+func TestAvailableKEKs(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(3)
+	stetConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 2
+
+	keyURI := func(i int) string {
+		return stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[i].GetKekUri()
+	}
+
+	fakeKMS := &stettest.FakeKMS{}
+	stetClient := &StetClient{KMSClient: fakeKMS}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	t.Run("Threshold available", func(t *testing.T) {
+		// The recipient cannot reach the third KEK, which is not attempted.
+		logger := &captureLogger{}
+		stetClient := &StetClient{
+			KMSClient: &keyFailingKMS{FakeKMS: fakeKMS, failKey: strings.TrimPrefix(keyURI(2), gcpKeyPrefix)},
+			Logger:    logger,
+		}
+
+		var output bytes.Buffer
+		var report DecryptReport
+		md, err := stetClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &output, stetConfig, WithAvailableKEKs(keyURI(0), keyURI(1)), WithDecryptReport(&report))
+		if err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+		}
+
+		if want := []string{keyURI(0), keyURI(1)}; !cmp.Equal(md.KeyUris, want) {
+			t.Errorf("Decrypt returned KeyUris %v, want %v", md.KeyUris, want)
+		}
+
+		if err := report.Shares[2].Err; !errors.Is(err, ErrKEKNotAvailable) {
+			t.Errorf("Decrypt reported error %v for the unavailable KEK, want ErrKEKNotAvailable", err)
+		}
+
+		for _, line := range logger.lines {
+			if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "WARNING") {
+				t.Errorf("Decrypt logged %q, want no errors or warnings for the unavailable KEK", line)
+			}
+		}
+	})
+
+	t.Run("Threshold not available", func(t *testing.T) {
+		calls := fakeKMS.Calls()
+
+		_, err := stetClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &bytes.Buffer{}, stetConfig, WithAvailableKEKs(keyURI(0), "unknown"))
+		if err == nil {
+			t.Fatal("Decrypt succeeded with 1 of 3 KEKs available, want error")
+		}
+
+		if fakeKMS.Calls() != calls {
+			t.Errorf("Decrypt made %v KMS calls, want none when too few KEKs are available", fakeKMS.Calls()-calls)
+		}
+	})
+}
+
+func TestKMSRateLimiter(t *testing.T) {
+	limiter, err := cloudkms.NewRateLimiter(1, 1)
+	if err != nil {
+		t.Fatalf("NewRateLimiter returned error: %v", err)
+	}
+
+	fakeKMS := &stettest.FakeKMS{}
+	stetClient := &StetClient{KMSClient: fakeKMS, KMSRateLimiter: limiter}
+
+	// Wrapping two shares makes more requests than the limiter permits
+	// before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = stetClient.Encrypt(ctx, bytes.NewReader([]byte("data")), &bytes.Buffer{}, newFakeKMSConfig(2), "")
+	if err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Errorf("Encrypt returned error %v, want rate limiting error", err)
+	}
+
+	if fakeKMS.Calls() != 1 {
+		t.Errorf("Encrypt made %v KMS calls, want 1 permitted by the rate limiter", fakeKMS.Calls())
+	}
+}
+
+func TestAllowedKEKLocations(t *testing.T) {
+	ctx := context.Background()
+	uri := func(location, key string) string {
+		return fmt.Sprintf("gcp-kms://projects/test/locations/%v/keyRings/test/cryptoKeys/%v", location, key)
+	}
+
+	testCases := []struct {
+		name         string
+		kekInfos     []*configpb.KekInfo
+		wantLocation string
+	}{
+		{
+			name: "KEKs in allowed locations",
+			kekInfos: []*configpb.KekInfo{
+				{KekType: &configpb.KekInfo_KekUri{KekUri: uri("us-east1", "key0")}},
+				{KekType: &configpb.KekInfo_KekUri{KekUri: uri("us-west1", "key1")}},
+			},
+		},
+		{
+			name: "KEK in disallowed location",
+			kekInfos: []*configpb.KekInfo{
+				{KekType: &configpb.KekInfo_KekUri{KekUri: uri("us-east1", "key0")}},
+				{KekType: &configpb.KekInfo_KekUri{KekUri: uri("europe-west1", "key1")}},
+			},
+			wantLocation: "europe-west1",
+		},
+		{
+			name: "Backup KEK in disallowed location",
+			kekInfos: []*configpb.KekInfo{
+				{KekType: &configpb.KekInfo_KekUri{KekUri: uri("us-east1", "key0")}, BackupKekUri: uri("global", "backup")},
+				{KekType: &configpb.KekInfo_KekUri{KekUri: uri("us-west1", "key1")}},
+			},
+			wantLocation: "global",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keyConfig := &configpb.KeyConfig{
+				KekInfos:              tc.kekInfos,
+				DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+				KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 2}},
+			}
+			stetConfig := &configpb.StetConfig{
+				EncryptConfig: &configpb.EncryptConfig{
+					KeyConfig:           keyConfig,
+					AllowedKekLocations: []string{"us-east1", "us-west1"},
+				},
+				DecryptConfig: &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+			}
+
+			fakeKMS := &stettest.FakeKMS{}
+			stetClient := &StetClient{KMSClient: fakeKMS}
+
+			var blob bytes.Buffer
+			_, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("data")), &blob, stetConfig, "")
+			if tc.wantLocation == "" {
+				if err != nil {
+					t.Fatalf("Encrypt returned error: %v", err)
+				}
+				if _, err := stetClient.Decrypt(ctx, &blob, io.Discard, stetConfig); err != nil {
+					t.Errorf("Decrypt returned error: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrKEKLocationNotAllowed) {
+				t.Fatalf("Encrypt returned error %v, want ErrKEKLocationNotAllowed", err)
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("in location %q", tc.wantLocation)) {
+				t.Errorf("Encrypt returned error %q, want it to name location %q", err, tc.wantLocation)
+			}
+			if fakeKMS.Calls() != 0 {
+				t.Errorf("Encrypt made %v KMS calls, want none", fakeKMS.Calls())
+			}
+		})
+	}
+}
+
+func TestInsecureSkipVerifyOverride(t *testing.T) {
+	testCases := []struct {
+		name   string
+		client bool
+		opts   []CallOption
+		want   bool
+	}{
+		{name: "Client default", client: true, want: true},
+		{name: "Client default off", client: false, want: false},
+		{name: "Call enables", client: false, opts: []CallOption{WithInsecureSkipVerify(true)}, want: true},
+		{name: "Call disables", client: true, opts: []CallOption{WithInsecureSkipVerify(false)}, want: false},
+	}
+
+	stetConfig := newFakeKMSConfig(1)
+	keyCfg := stetConfig.GetEncryptConfig().GetKeyConfig()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{InsecureSkipVerify: tc.client}
+			callOpts := stetClient.newCallOptions(tc.opts)
+
+			opts := stetClient.decryptSharesOpts(&configpb.Metadata{}, keyCfg, stetConfig, callOpts)
+			if opts.skipTLSVerify != tc.want {
+				t.Errorf("Shares are unwrapped with skipTLSVerify = %v, want %v", opts.skipTLSVerify, tc.want)
+			}
+		})
+	}
+}
+
+func TestRand(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(3)
+	stetConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 2
+	plaintext := []byte("This is data to be encrypted.")
+
+	encrypt := func(rand io.Reader, opts ...CallOption) ([]byte, error) {
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, Rand: rand}
+		var blob bytes.Buffer
+		_, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob", opts...)
+		return blob.Bytes(), err
+	}
+
+	seeded := func(seed int64) io.Reader {
+		return mathrand.New(mathrand.NewSource(seed))
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []CallOption
+	}{
+		{name: "Default"},
+		{name: "Integrity manifest", opts: []CallOption{WithIntegrityManifest()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blob, err := encrypt(seeded(1), tc.opts...)
+			if err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			// The same source must produce the same blob, which decrypts.
+			again, err := encrypt(seeded(1), tc.opts...)
+			if err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+			if !bytes.Equal(blob, again) {
+				t.Error("Encrypt with the same Rand produced different blobs, want identical blobs")
+			}
+
+			other, err := encrypt(seeded(2), tc.opts...)
+			if err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+			if bytes.Equal(blob, other) {
+				t.Error("Encrypt with different Rand sources produced identical blobs")
+			}
+
+			stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+			var output bytes.Buffer
+			if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob), &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+			}
+		})
+	}
+
+	// Running out of randomness must fail rather than produce a weak blob.
+	if _, err := encrypt(bytes.NewReader(make([]byte, shares.DEKBytes))); err == nil {
+		t.Error("Encrypt succeeded with an exhausted Rand, want error")
+	}
+}
+
+func TestAsymmetricDecryptKEK(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	keyName := "projects/test/locations/test/keyRings/test/cryptoKeys/key0"
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() returned error: %v", err)
+	}
+	fakeKMS := &stettest.FakeKMS{AsymmetricKeys: map[string]*rsa.PrivateKey{keyName: rsaKey}}
+	stetClient := &StetClient{KMSClient: fakeKMS}
+
+	stetConfig := newFakeKMSConfig(1)
+	stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[0].KekType = &configpb.KekInfo_KekUri{KekUri: gcpKeyPrefix + keyName + "/cryptoKeyVersions/1"}
+
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+	}
+
+	// The share must only be recoverable with the asymmetric key.
+	symmetricClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	if _, err := symmetricClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), io.Discard, stetConfig); err == nil {
+		t.Error("Decrypt without the asymmetric key succeeded, want error")
+	}
+
+	unpinnedConfig := newFakeKMSConfig(1)
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), io.Discard, unpinnedConfig, "blob"); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Errorf("Encrypt with an unpinned asymmetric KEK = %v, want error mentioning pinning", err)
+	}
+
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), io.Discard, stetConfig, "blob", WithShareContext([]byte("context"))); err == nil {
+		t.Error("Encrypt with a share context and an asymmetric KEK succeeded, want error")
+	}
+}
+
+func TestSplitScheme(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	plaintext := []byte("This is data to be encrypted.")
+
+	testcases := []struct {
+		name       string
+		numShares  int
+		opts       []CallOption
+		wantScheme string
+	}{
+		{
+			name:       "No split",
+			numShares:  1,
+			opts:       []CallOption{WithFormatVersion(FormatVersion2)},
+			wantScheme: shares.SchemeNoSplit,
+		},
+		{
+			name:       "Shamir",
+			numShares:  2,
+			opts:       []CallOption{WithFormatVersion(FormatVersion2)},
+			wantScheme: shares.SchemeShamir,
+		},
+		{
+			// Older readers would not bind the scheme into the AAD.
+			name:       "Format version 1",
+			numShares:  2,
+			opts:       []CallOption{WithFormatVersion(FormatVersion1)},
+			wantScheme: "",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetConfig := newFakeKMSConfig(tc.numShares)
+
+			var metadata, ciphertext bytes.Buffer
+			if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadata, &ciphertext, stetConfig, "blob", tc.opts...); err != nil {
+				t.Fatalf("EncryptWithSidecar returned error: %v", err)
+			}
+
+			md, err := ReadMetadata(bytes.NewReader(metadata.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+			if md.GetSplitScheme() != tc.wantScheme {
+				t.Errorf("Metadata has split scheme %q, want %q", md.GetSplitScheme(), tc.wantScheme)
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata.Bytes()), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err != nil {
+				t.Fatalf("DecryptWithSidecar returned error: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("DecryptWithSidecar returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+
+			// Changing the recorded scheme fails, both as it is bound into
+			// the AAD and as the shares cannot be combined with it.
+			for _, scheme := range []string{shares.SchemeNoSplit, shares.SchemeShamir, "shamir-gf65536"} {
+				if scheme == tc.wantScheme {
+					continue
+				}
+				forged := rewriteMetadata(t, metadata.Bytes(), func(md *configpb.Metadata) {
+					md.SplitScheme = scheme
+				})
+				if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext.Bytes()), io.Discard, stetConfig); err == nil {
+					t.Errorf("DecryptWithSidecar succeeded with split scheme changed to %q, want error", scheme)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipleEKMs(t *testing.T) {
+	ctx := context.Background()
+
+	// Each KEK is protected by its own EKM.
+	keyConfig := newShamirKeyConfig("ekm", 2, 3)
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+	ekmIndex := map[string]int{}
+	for i := range keyConfig.GetKekInfos() {
+		ekmIndex[fmt.Sprintf("https://ekm%d.example/external-key", i)] = i
+	}
+
+	kmsClient := &testutil.FakeKeyManagementClient{
+		GetCryptoKeyFunc: func(_ context.Context, req *kmsspb.GetCryptoKeyRequest, _ ...gax.CallOption) (*kmsrpb.CryptoKey, error) {
+			ck := testutil.CreateEnabledCryptoKey(kmsrpb.ProtectionLevel_EXTERNAL, req.GetName())
+			ck.Primary.ExternalProtectionLevelOptions.ExternalKeyUri = fmt.Sprintf("https://%v.example/external-key", path.Base(req.GetName()))
+			return ck, nil
+		},
+	}
+
+	// newStetClient returns a StetClient whose EKMs behave as in `ekms`, by
+	// index. A nil EKM cannot be reached.
+	newStetClient := func(ekms []*testutil.FakeSecureSessionClient) *StetClient {
+		return &StetClient{
+			testKMSClients: &cloudkms.ClientFactory{
+				CredsMap: map[string]cloudkms.Client{"": kmsClient},
+			},
+			testSecureSessionClientForURI: func(uri string) (secureSessionClient, error) {
+				i, ok := ekmIndex[uri]
+				if !ok {
+					return nil, fmt.Errorf("unexpected EKM URI %q", uri)
+				}
+				if ekms[i] == nil {
+					return nil, errors.New("EKM unreachable")
+				}
+				return ekms[i], nil
+			},
+		}
+	}
+
+	healthy := func() *testutil.FakeSecureSessionClient { return &testutil.FakeSecureSessionClient{} }
+	failing := func() *testutil.FakeSecureSessionClient {
+		return &testutil.FakeSecureSessionClient{UnwrapErr: errors.New("EKM unavailable")}
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var metadata, ciphertext bytes.Buffer
+	md, err := newStetClient([]*testutil.FakeSecureSessionClient{healthy(), healthy(), healthy()}).EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadata, &ciphertext, stetConfig, "blob")
+	if err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	wantURIs := []string{"https://ekm0.example/external-key", "https://ekm1.example/external-key", "https://ekm2.example/external-key"}
+	if diff := cmp.Diff(wantURIs, md.KeyUris); diff != "" {
+		t.Errorf("EncryptWithSidecar returned unexpected key URIs (-want +got):\n%s", diff)
+	}
+
+	testCases := []struct {
+		name       string
+		ekms       []*testutil.FakeSecureSessionClient
+		wantFailed []bool
+		wantErr    bool
+	}{
+		{
+			name:       "All EKMs succeed",
+			ekms:       []*testutil.FakeSecureSessionClient{healthy(), healthy(), healthy()},
+			wantFailed: []bool{false, false, false},
+		},
+		{
+			name:       "One EKM fails to unwrap",
+			ekms:       []*testutil.FakeSecureSessionClient{healthy(), failing(), healthy()},
+			wantFailed: []bool{false, true, false},
+		},
+		{
+			name:       "One EKM unreachable",
+			ekms:       []*testutil.FakeSecureSessionClient{nil, healthy(), healthy()},
+			wantFailed: []bool{true, false, false},
+		},
+		{
+			name:       "Too many EKMs fail",
+			ekms:       []*testutil.FakeSecureSessionClient{healthy(), failing(), nil},
+			wantFailed: []bool{false, true, true},
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			var report DecryptReport
+			_, err := newStetClient(tc.ekms).DecryptWithSidecar(ctx, bytes.NewReader(metadata.Bytes()), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig, WithDecryptReport(&report))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("DecryptWithSidecar succeeded, want error")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("DecryptWithSidecar returned error: %v", err)
+				}
+				if !bytes.Equal(output.Bytes(), plaintext) {
+					t.Errorf("DecryptWithSidecar returned plaintext %v, want %v", output.Bytes(), plaintext)
+				}
+			}
+
+			if len(report.Shares) != len(tc.wantFailed) {
+				t.Fatalf("DecryptReport has %v shares, want %v", len(report.Shares), len(tc.wantFailed))
+			}
+			for i, share := range report.Shares {
+				if failed := share.Err != nil; failed != tc.wantFailed[i] {
+					t.Errorf("DecryptReport.Shares[%v] failed = %v (err: %v), want %v", i, failed, share.Err, tc.wantFailed[i])
+				}
+			}
+		})
+	}
+}
@@ -16,15 +16,18 @@ package client
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/GoogleCloudPlatform/stet/client/shares"
 	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
@@ -40,8 +43,37 @@ const (
 	aeadSegmentSize        = 1048576
 	aeadFirstSegmentOffset = 0
 	aeadChunkSize          = 128
+
+	// Bounds on the segment size recorded in metadata, so that a malicious
+	// blob cannot make decryption process tiny or huge segments.
+	aeadMinSegmentSize = 4096
+	aeadMaxSegmentSize = 64 << 20
 )
 
+// checkSegmentSize returns an error if `size` is outside the allowed bounds.
+func checkSegmentSize(size int64) error {
+	if size < aeadMinSegmentSize || size > aeadMaxSegmentSize {
+		return fmt.Errorf("segment size %v is out of range, must be between %v and %v bytes", size, aeadMinSegmentSize, aeadMaxSegmentSize)
+	}
+
+	return nil
+}
+
+// metadataSegmentSize returns the segment size recorded in `md`, or the
+// default if none is recorded.
+func metadataSegmentSize(md *configpb.Metadata) (int64, error) {
+	size := md.GetSegmentSize()
+	if size == 0 {
+		return aeadSegmentSize, nil
+	}
+
+	if err := checkSegmentSize(size); err != nil {
+		return 0, fmt.Errorf("invalid metadata: %v", err)
+	}
+
+	return size, nil
+}
+
 /////////////////////////////////////////
 // For AEAD encryption and decryption. //
 /////////////////////////////////////////
@@ -49,7 +81,13 @@ const (
 // AeadEncrypt uses the provided key and AAD to encrypt the plaintext passed in
 // via `input`, writing the output to `output`.
 func AeadEncrypt(key shares.DEK, input io.Reader, output io.Writer, aad []byte) error {
-	cipher, err := subtle.NewAESGCMHKDF(key[:], aeadHKDFAlg, int(shares.DEKBytes), aeadSegmentSize, aeadFirstSegmentOffset)
+	return aeadEncrypt(key, aeadSegmentSize, input, output, aad)
+}
+
+// aeadEncrypt is like AeadEncrypt, but with ciphertext segments of
+// `segmentSize` bytes.
+func aeadEncrypt(key shares.DEK, segmentSize int64, input io.Reader, output io.Writer, aad []byte) error {
+	cipher, err := subtle.NewAESGCMHKDF(key[:], aeadHKDFAlg, int(shares.DEKBytes), int(segmentSize), aeadFirstSegmentOffset)
 	if err != nil {
 		return fmt.Errorf("unable to create new cipher: %v", err)
 	}
@@ -70,10 +108,113 @@ func AeadEncrypt(key shares.DEK, input io.Reader, output io.Writer, aad []byte)
 	return nil
 }
 
+// aeadEncryptFrom is like aeadEncrypt, but reads the salt and nonce prefix
+// from `random` if it is set, and seals up to `workers` segments concurrently
+// if that is more than one.
+func aeadEncryptFrom(random io.Reader, workers int, key shares.DEK, segmentSize int64, input io.Reader, output io.Writer, aad []byte) error {
+	if random == nil {
+		if workers < 2 {
+			return aeadEncrypt(key, segmentSize, input, output, aad)
+		}
+		random = rand.Reader
+	}
+
+	nonce := make([]byte, AeadNonceBytes)
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	salt, noncePrefix := nonce[:shares.DEKBytes], nonce[shares.DEKBytes:]
+	if workers > 1 {
+		return encryptSegmentsParallel(key, segmentSize, salt, noncePrefix, input, output, aad, workers)
+	}
+
+	return encryptSegments(key, segmentSize, salt, noncePrefix, input, output, aad)
+}
+
+// AeadNonceBytes is the size of the nonce accepted by AeadEncryptWithNonce:
+// the HKDF salt of the segment key followed by the segment nonce prefix.
+const AeadNonceBytes = int(aeadHeaderSize) - 1
+
+// NonceTracker guards AeadEncryptWithNonce against nonce reuse, by recording
+// the key and nonce pairs passed to it, mapped to the hash of the plaintext
+// and AAD they encrypted. It grows with every distinct pair, so should be
+// scoped to a single batch of test vectors and then discarded. The zero value
+// is ready to use, and it is safe for concurrent use.
+type NonceTracker struct {
+	mu   sync.Mutex
+	used map[[sha256.Size]byte][sha256.Size]byte
+}
+
+// AeadEncryptWithNonce is like AeadEncrypt, but uses the caller-provided
+// `nonce` of AeadNonceBytes bytes in place of a random one, so that the
+// ciphertext is deterministic.
+//
+// This is UNSAFE for production use, and is only intended for generating
+// known-answer test vectors and for interoperability testing: reusing a nonce
+// with the same key for different data breaks the confidentiality and
+// integrity of both ciphertexts. To guard against that, the plaintext is
+// buffered in memory, and an error is returned if a key and nonce pair is
+// reused with the same NonceTracker to encrypt a different plaintext or AAD.
+// The nonce must not be all zeros. Encrypt and its variants always use random
+// nonces.
+func (t *NonceTracker) AeadEncryptWithNonce(key shares.DEK, nonce []byte, input io.Reader, output io.Writer, aad []byte) error {
+	if len(nonce) != AeadNonceBytes {
+		return fmt.Errorf("nonce is %v bytes, want %v", len(nonce), AeadNonceBytes)
+	}
+
+	if bytes.Equal(nonce, make([]byte, AeadNonceBytes)) {
+		return fmt.Errorf("nonce must not be all zeros")
+	}
+
+	plaintext, err := io.ReadAll(input)
+	if err != nil {
+		return fmt.Errorf("failed to read plaintext: %v", err)
+	}
+
+	pairHash := sha256.New()
+	pairHash.Write(key[:])
+	pairHash.Write(nonce)
+	var pair [sha256.Size]byte
+	pairHash.Sum(pair[:0])
+
+	dataHash := sha256.New()
+	binary.Write(dataHash, binary.LittleEndian, uint64(len(aad)))
+	dataHash.Write(aad)
+	dataHash.Write(plaintext)
+	var data [sha256.Size]byte
+	dataHash.Sum(data[:0])
+
+	t.mu.Lock()
+	if t.used == nil {
+		t.used = make(map[[sha256.Size]byte][sha256.Size]byte)
+	}
+	prev, ok := t.used[pair]
+	if !ok {
+		t.used[pair] = data
+	}
+	t.mu.Unlock()
+
+	if ok && prev != data {
+		return fmt.Errorf("nonce was already used with this key to encrypt different data")
+	}
+
+	salt, noncePrefix := nonce[:shares.DEKBytes], nonce[shares.DEKBytes:]
+	return encryptSegments(key, aeadSegmentSize, salt, noncePrefix, bytes.NewReader(plaintext), output, aad)
+}
+
 // AeadDecrypt uses the provided key and AAD to decode the ciphertext passed
-// in via `input`, writing the output to `output.
+// in via `input`, writing the output to `output. Each segment is authenticated
+// before its plaintext is written, so decryption stops at the first segment
+// that fails authentication.
 func AeadDecrypt(key shares.DEK, input io.Reader, output io.Writer, aad []byte) error {
-	cipher, err := subtle.NewAESGCMHKDF(key[:], aeadHKDFAlg, int(shares.DEKBytes), aeadSegmentSize, aeadFirstSegmentOffset)
+	return aeadDecrypt(key, aeadSegmentSize, input, output, aad)
+}
+
+// aeadDecrypt is like AeadDecrypt, but for ciphertext segments of
+// `segmentSize` bytes.
+func aeadDecrypt(key shares.DEK, segmentSize int64, input io.Reader, output io.Writer, aad []byte) error {
+	cipher, err := subtle.NewAESGCMHKDF(key[:], aeadHKDFAlg, int(shares.DEKBytes), int(segmentSize), aeadFirstSegmentOffset)
 	if err != nil {
 		return fmt.Errorf("unable to create new cipher: %v", err)
 	}
@@ -112,6 +253,9 @@ func AeadDecrypt(key shares.DEK, input io.Reader, output io.Writer, aad []byte)
 // STETMagic is the magic string for a STET encrypted file header ("STETENCRYPTED").
 var STETMagic = [13]byte{'S', 'T', 'E', 'T', 'E', 'N', 'C', 'R', 'Y', 'P', 'T', 'E', 'D'}
 
+// STETHeaderBytes is the size of the encoded STETHeader.
+const STETHeaderBytes = 16
+
 // STETHeader is the file header for the encrypted STET file format.
 type STETHeader struct {
 	Magic       [13]byte // len([]byte(STETMagic)) == 13
@@ -120,6 +264,7 @@ type STETHeader struct {
 }
 
 // ReadSTETHeader reads a STET encrypted file header from `input`, returning a STETHeader.
+// It consumes exactly STETHeaderBytes from `input`.
 func ReadSTETHeader(input io.Reader) (*STETHeader, error) {
 	var header STETHeader
 	if err := binary.Read(input, binary.LittleEndian, &header); err != nil {
@@ -134,10 +279,16 @@ func ReadSTETHeader(input io.Reader) (*STETHeader, error) {
 }
 
 // WriteSTETHeader writes a STET encrypted file header with the given properties to `output`.
+// The header records FormatVersion1.
 func WriteSTETHeader(output io.Writer, metadataLen int) error {
+	return writeSTETHeader(output, metadataLen, FormatVersion1)
+}
+
+// writeSTETHeader is like WriteSTETHeader, but records the given format version.
+func writeSTETHeader(output io.Writer, metadataLen int, version uint8) error {
 	header := STETHeader{
 		Magic:       STETMagic,
-		Version:     1,
+		Version:     version,
 		MetadataLen: uint16(metadataLen),
 	}
 
@@ -149,8 +300,13 @@ func WriteSTETHeader(output io.Writer, metadataLen int) error {
 /////////////////////////////////////////////////
 
 // PublicKeyForRSAFingerprint Iterates through the public keys defined in `keys`, searching for one
-// that matches `kek`. If one is found, returns it, otherwise returns nil.
+// that matches `kek`. If one is found, returns it, otherwise returns nil. `keys` may be nil, in
+// which case an error is returned.
 func PublicKeyForRSAFingerprint(kek *configpb.KekInfo, keys *configpb.AsymmetricKeys) (*rsa.PublicKey, error) {
+	if len(keys.GetPublicKeyFiles()) == 0 {
+		return nil, fmt.Errorf("KEK has RSA fingerprint %s, but no public key files are configured in AsymmetricKeys", kek.GetRsaFingerprint())
+	}
+
 	for _, path := range keys.GetPublicKeyFiles() {
 		keyBytes, err := os.ReadFile(path)
 		if err != nil {
@@ -168,7 +324,8 @@ func PublicKeyForRSAFingerprint(kek *configpb.KekInfo, keys *configpb.Asymmetric
 		}
 		key, ok := pub.(*rsa.PublicKey)
 		if !ok {
-			return nil, fmt.Errorf("failed to parse RSA public key: %v", err)
+			// Skip keys of other types, such as EC keys.
+			continue
 		}
 		// Compute SHA-256 digest of the DER-encoded public key.
 		sha := sha256.Sum256(block.Bytes)
@@ -182,22 +339,20 @@ func PublicKeyForRSAFingerprint(kek *configpb.KekInfo, keys *configpb.Asymmetric
 }
 
 // PrivateKeyForRSAFingerprint iterates through the private keys defined in `keys`, searching for
-// one that matches `kek`. If one is found, returns it, otherwise returns nil.
+// one that matches `kek`. If one is found, returns it, otherwise returns nil. `keys` may be nil, in
+// which case an error is returned.
 func PrivateKeyForRSAFingerprint(kek *configpb.KekInfo, keys *configpb.AsymmetricKeys) (*rsa.PrivateKey, error) {
-	for _, path := range keys.GetPrivateKeyFiles() {
-		keyBytes, err := os.ReadFile(path)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open private key file: %w", err)
-		}
+	if len(keys.GetPrivateKeyFiles()) == 0 {
+		return nil, fmt.Errorf("KEK has RSA fingerprint %s, but no private key files are configured in AsymmetricKeys", kek.GetRsaFingerprint())
+	}
 
-		block, _ := pem.Decode(keyBytes)
-		if block == nil || block.Type != "RSA PRIVATE KEY" {
-			return nil, fmt.Errorf("failed to decode PEM block containing RSA private key")
+	for _, path := range keys.GetPrivateKeyFiles() {
+		key, err := readRSAPrivateKeyFile(path)
+		if errors.Is(err, errNotRSAPrivateKey) {
+			continue
 		}
-
-		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse PKCS1 private key from PEM: %v", err)
+			return nil, err
 		}
 
 		// Compute SHA-256 digest of the DER-encoded public key.
@@ -212,14 +367,120 @@ func PrivateKeyForRSAFingerprint(kek *configpb.KekInfo, keys *configpb.Asymmetri
 		}
 	}
 
-	return nil, fmt.Errorf("no RSA private key found for fingerprint: %s", kek.GetRsaFingerprint())
+	return nil, fmt.Errorf("%w: %s", errNoRSAKeyForFingerprint, kek.GetRsaFingerprint())
+}
+
+// errNoRSAKeyForFingerprint is returned by PrivateKeyForRSAFingerprint when
+// none of the private keys has the KEK's fingerprint.
+var errNoRSAKeyForFingerprint = errors.New("no RSA private key found for fingerprint")
+
+// errNotRSAPrivateKey is returned by readRSAPrivateKeyFile for EC private
+// keys, which are skipped when searching for RSA keys.
+var errNotRSAPrivateKey = errors.New("not an RSA private key")
+
+// readRSAPrivateKeyFile reads a PEM-encoded PKCS #1 RSA private key from the
+// file at `path`.
+func readRSAPrivateKeyFile(path string) (*rsa.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open private key file: %w", err)
+	}
+
+	block, _ := pem.Decode(keyBytes)
+	if block != nil && block.Type == ecPrivateKeyPEMType {
+		return nil, errNotRSAPrivateKey
+	}
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, fmt.Errorf("failed to decode PEM block containing RSA private key")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS1 private key from PEM: %v", err)
+	}
+
+	return key, nil
 }
 
 ////////////////////////////////////////////
 // For metadata serialization operations. //
 ////////////////////////////////////////////
 
-// MetadataToAAD processes metadata to use as AAD for AEAD Encryption.
+// AADVersion1 is the original serialization of metadata into AAD, used for
+// blobs whose metadata records no AAD version.
+const AADVersion1 uint32 = 1
+
+// AADVersion2 serializes each field of the metadata as a tagged record, so
+// that optional fields cannot be mistaken for one another. It is used for
+// blobs of FormatVersion2 and later.
+const AADVersion2 uint32 = 2
+
+// aadVersion is the AAD version Encrypt serializes the metadata of blobs of
+// FormatVersion2 and later with. Blobs of FormatVersion1 always use
+// AADVersion1, the only one their readers know.
+var aadVersion = AADVersion2
+
+// aadSaltBytes is the size of the random salt bound into the AAD of each blob
+// of format version 2 and later.
+const aadSaltBytes = 16
+
+// Tags of the top-level records of AADVersion2. Tags must never be reused or
+// renumbered.
+const (
+	aadTagShare uint32 = iota + 1
+	aadTagBlobID
+	aadTagProvenance
+	aadTagKeyCommitment
+	aadTagSegmentSize
+	_ // Formerly the plaintext size.
+	aadTagExtension
+	aadTagAADSalt
+	aadTagSplitScheme
+)
+
+// Tags of the records nested in a share record of AADVersion2.
+const (
+	aadTagWrappedShare uint32 = iota + 1
+	aadTagShareHash
+	aadTagShareHashAlgorithm
+	aadTagBackupShare
+	aadTagShareTransform
+)
+
+// aadSerializers maps each AAD version to the function serializing metadata
+// with it. A serializer must never change once released, as Decrypt uses the
+// one recorded in each blob: to change the serialization, add a new version
+// and update aadVersion.
+var aadSerializers = map[uint32]func(*configpb.Metadata) ([]byte, error){
+	AADVersion1: metadataToAADV1,
+	AADVersion2: metadataToAADV2,
+}
+
+// MetadataToAAD processes metadata to use as AAD for AEAD Encryption, with
+// the serialization of the AAD version recorded in the metadata.
+func MetadataToAAD(md *configpb.Metadata) ([]byte, error) {
+	version := md.GetAadVersion()
+	if version == 0 {
+		version = AADVersion1
+	}
+
+	serialize, ok := aadSerializers[version]
+	if !ok {
+		return nil, fmt.Errorf("AAD version %v is not supported by this version of STET", version)
+	}
+
+	// AADVersion1 only binds the shares and blob ID, so no newer field must
+	// be trusted, or written, alongside it.
+	if version == AADVersion1 {
+		if field := unboundAADV1Field(md); field != "" {
+			return nil, fmt.Errorf("metadata of AAD version %v cannot record a %v", version, field)
+		}
+	}
+
+	return serialize(md)
+}
+
+// metadataToAADV1 serializes metadata with AADVersion1.
 // The serialization scheme is as follows (given n := len(md.shares)):
 //
 //	len(md.shares[0].wrappedShare)      || md.shares[0].wrappedShare
@@ -230,8 +491,15 @@ func PrivateKeyForRSAFingerprint(kek *configpb.KekInfo, keys *configpb.Asymmetri
 //	|| len(md.blobID)                   || md.blobID
 //
 // Note that KeyConfig is explicitly omitted from the serialization,
-// as its presence is not important to the AAD.
-func MetadataToAAD(md *configpb.Metadata) ([]byte, error) {
+// as its presence is not important to the AAD. Every field added since is
+// only serialized by metadataToAADV2.
+//
+// The AAD must never be derived from the proto encoding of the metadata,
+// which is not guaranteed to be stable across versions of the protobuf
+// library: blobs written by one version of STET must remain decryptable by
+// every later version. Encrypt and Decrypt both compute the AAD from the
+// parsed fields alone.
+func metadataToAADV1(md *configpb.Metadata) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	for _, share := range md.GetShares() {
 		// Serialize share.wrappedShare
@@ -265,24 +533,213 @@ func MetadataToAAD(md *configpb.Metadata) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// unboundAADV1Field returns the name of the first field of `md` that
+// metadataToAADV1 does not serialize, or "" if there is none.
+func unboundAADV1Field(md *configpb.Metadata) string {
+	for _, share := range md.GetShares() {
+		switch {
+		case share.GetHashAlgorithm() != configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH:
+			return "share hash algorithm"
+		case len(share.GetBackupShare()) != 0:
+			return "backup share"
+		case share.GetTransform() != "":
+			return "share transform"
+		}
+	}
+
+	switch {
+	case md.GetProvenance() != nil:
+		return "provenance"
+	case len(md.GetKeyCommitment()) != 0:
+		return "key commitment"
+	case md.GetSegmentSize() != 0:
+		return "segment size"
+	case len(md.GetExtensions()) != 0:
+		return "extension"
+	case len(md.GetAadSalt()) != 0:
+		return "AAD salt"
+	case md.GetSplitScheme() != "":
+		return "split scheme"
+	}
+
+	return ""
+}
+
+// metadataToAADV2 serializes metadata with AADVersion2, as a sequence of
+// records of the form:
+//
+//	tag || len(value) || value
+//
+// with the tag a uint32, the length a uint64 and integer values in
+// little-endian order. The records are, in order of tag:
+//
+//	aadTagShare:         for each share, its own nested records
+//	aadTagBlobID:        md.blobID
+//	aadTagProvenance:    md.provenance.createTime.seconds
+//	                     || md.provenance.createTime.nanos
+//	                     || md.provenance.stetVersion
+//	aadTagKeyCommitment: md.keyCommitment
+//	aadTagSegmentSize:   md.segmentSize
+//	aadTagExtension:     for each extension, in order of name,
+//	                     len(name) || name || value
+//	aadTagAADSalt:       md.aadSalt
+//	aadTagSplitScheme:   md.splitScheme
+//
+// and for each share:
+//
+//	aadTagWrappedShare:       share.wrappedShare
+//	aadTagShareHash:          share.hash
+//	aadTagShareHashAlgorithm: share.hashAlgorithm
+//	aadTagBackupShare:        share.backupShare
+//	aadTagShareTransform:     share.transform
+//
+// The blob ID, and each share's wrapped share and hash, are always
+// serialized; every other record only if its field is set. As in
+// metadataToAADV1, the KeyConfig is omitted, and the AAD is computed from the
+// parsed fields alone.
+func metadataToAADV2(md *configpb.Metadata) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, share := range md.GetShares() {
+		shareBuf := new(bytes.Buffer)
+		if err := writeAADRecord(shareBuf, aadTagWrappedShare, share.GetShare()); err != nil {
+			return nil, fmt.Errorf("unable to serialize wrapped share: %v", err)
+		}
+
+		if err := writeAADRecord(shareBuf, aadTagShareHash, share.GetHash()); err != nil {
+			return nil, fmt.Errorf("unable to serialize hashed share: %v", err)
+		}
+
+		if alg := share.GetHashAlgorithm(); alg != configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH {
+			if err := writeAADRecord(shareBuf, aadTagShareHashAlgorithm, binary.LittleEndian.AppendUint32(nil, uint32(alg))); err != nil {
+				return nil, fmt.Errorf("unable to serialize share hash algorithm: %v", err)
+			}
+		}
+
+		if backup := share.GetBackupShare(); len(backup) != 0 {
+			if err := writeAADRecord(shareBuf, aadTagBackupShare, backup); err != nil {
+				return nil, fmt.Errorf("unable to serialize backup wrapped share: %v", err)
+			}
+		}
+
+		if transform := share.GetTransform(); transform != "" {
+			if err := writeAADRecord(shareBuf, aadTagShareTransform, []byte(transform)); err != nil {
+				return nil, fmt.Errorf("unable to serialize share transform: %v", err)
+			}
+		}
+
+		if err := writeAADRecord(buf, aadTagShare, shareBuf.Bytes()); err != nil {
+			return nil, fmt.Errorf("unable to serialize share: %v", err)
+		}
+	}
+
+	if err := writeAADRecord(buf, aadTagBlobID, []byte(md.GetBlobId())); err != nil {
+		return nil, fmt.Errorf("unable to serialize blobID: %v", err)
+	}
+
+	if provenance := md.GetProvenance(); provenance != nil {
+		createTime := provenance.GetCreateTime()
+		value := binary.LittleEndian.AppendUint64(nil, uint64(createTime.GetSeconds()))
+		value = binary.LittleEndian.AppendUint32(value, uint32(createTime.GetNanos()))
+		value = append(value, provenance.GetStetVersion()...)
+		if err := writeAADRecord(buf, aadTagProvenance, value); err != nil {
+			return nil, fmt.Errorf("unable to serialize provenance: %v", err)
+		}
+	}
+
+	if commitment := md.GetKeyCommitment(); len(commitment) != 0 {
+		if err := writeAADRecord(buf, aadTagKeyCommitment, commitment); err != nil {
+			return nil, fmt.Errorf("unable to serialize key commitment: %v", err)
+		}
+	}
+
+	if size := md.GetSegmentSize(); size != 0 {
+		if err := writeAADRecord(buf, aadTagSegmentSize, binary.LittleEndian.AppendUint64(nil, uint64(size))); err != nil {
+			return nil, fmt.Errorf("unable to serialize segment size: %v", err)
+		}
+	}
+
+	extensions := md.GetExtensions()
+	for _, name := range sortedExtensionNames(extensions) {
+		value := binary.LittleEndian.AppendUint64(nil, uint64(len(name)))
+		value = append(value, name...)
+		value = append(value, extensions[name]...)
+		if err := writeAADRecord(buf, aadTagExtension, value); err != nil {
+			return nil, fmt.Errorf("unable to serialize extension %q: %v", name, err)
+		}
+	}
+
+	if salt := md.GetAadSalt(); len(salt) != 0 {
+		if err := writeAADRecord(buf, aadTagAADSalt, salt); err != nil {
+			return nil, fmt.Errorf("unable to serialize AAD salt: %v", err)
+		}
+	}
+
+	if scheme := md.GetSplitScheme(); scheme != "" {
+		if err := writeAADRecord(buf, aadTagSplitScheme, []byte(scheme)); err != nil {
+			return nil, fmt.Errorf("unable to serialize split scheme: %v", err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeAADRecord writes a record of AADVersion2 with the given tag and value
+// to `buf`.
+func writeAADRecord(buf *bytes.Buffer, tag uint32, value []byte) error {
+	if err := binary.Write(buf, binary.LittleEndian, tag); err != nil {
+		return err
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, uint64(len(value))); err != nil {
+		return err
+	}
+
+	_, err := buf.Write(value)
+	return err
+}
+
+// marshalMetadata serializes metadata for writing after the STET header. It
+// uses deterministic marshaling, so that the same metadata is always written
+// as the same bytes by a given version of STET.
+func marshalMetadata(md *configpb.Metadata) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.Marshal(md)
+}
+
 // ReadMetadata parses and returns metadata from the input.
+//
+// It consumes exactly the STET header and the metadata length recorded in it
+// from `input`, and never reads ahead, so that a stream that cannot seek, such
+// as a network connection, is left positioned at the start of the ciphertext.
+// The caller may then continue reading the ciphertext, or close the stream.
 func ReadMetadata(input io.Reader) (*configpb.Metadata, error) {
+	metadata, _, err := readMetadata(input)
+	return metadata, err
+}
+
+// readMetadata is like ReadMetadata, but also returns the number of bytes
+// consumed from `input`: the size of the header and metadata.
+func readMetadata(input io.Reader) (*configpb.Metadata, int64, error) {
 	// Read the STET header from the given `input`.
 	header, err := ReadSTETHeader(input)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read STET encrypted file header: %v", err)
+		return nil, 0, fmt.Errorf("failed to read STET encrypted file header: %v", err)
+	}
+
+	if err := checkReadFormatVersion(header.Version); err != nil {
+		return nil, 0, err
 	}
 
-	// Based on the metadata length in `header`, read metadata from `input`.
+	// Based on the metadata length in `header`, read exactly the metadata
+	// from `input`.
 	metadataBytes := make([]byte, header.MetadataLen)
-	if _, err := input.Read(metadataBytes); err != nil {
-		return nil, fmt.Errorf("failed to read encrypted file metadata: %v", err)
+	if _, err := io.ReadFull(input, metadataBytes); err != nil {
+		return nil, 0, fmt.Errorf("failed to read encrypted file metadata: %v", err)
 	}
 
 	metadata := &configpb.Metadata{}
 	if err := proto.Unmarshal(metadataBytes, metadata); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata proto: %v", err)
+		return nil, 0, fmt.Errorf("failed to unmarshal metadata proto: %v", err)
 	}
 
-	return metadata, nil
+	return metadata, STETHeaderBytes + int64(header.MetadataLen), nil
 }
@@ -16,12 +16,19 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
 	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestAeadEncryptAndAeadDecrypt(t *testing.T) {
@@ -52,6 +59,117 @@ func TestAeadEncryptAndAeadDecrypt(t *testing.T) {
 	}
 }
 
+func TestAeadEncryptWithNonce(t *testing.T) {
+	testDEK := shares.NewDEK()
+	testAAD := []byte("AAD for testing only.")
+
+	firstSegment := int(aeadFirstSegmentSize - aeadTagSize)
+	testcases := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{name: "Empty", plaintext: []byte{}},
+		{name: "Short", plaintext: []byte("Plaintext for testing only.")},
+		{name: "Exactly one segment", plaintext: bytes.Repeat([]byte{'a'}, firstSegment)},
+		{name: "Multiple segments", plaintext: bytes.Repeat([]byte{'b'}, firstSegment+2*aeadSegmentSize)},
+	}
+
+	var tracker NonceTracker
+	for i, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			nonce := bytes.Repeat([]byte{byte(i + 1)}, AeadNonceBytes)
+
+			var first, second bytes.Buffer
+			if err := tracker.AeadEncryptWithNonce(testDEK, nonce, bytes.NewReader(tc.plaintext), &first, testAAD); err != nil {
+				t.Fatalf("AeadEncryptWithNonce returned error: %v", err)
+			}
+
+			// Encrypting the same data again reproduces the same ciphertext.
+			if err := tracker.AeadEncryptWithNonce(testDEK, nonce, bytes.NewReader(tc.plaintext), &second, testAAD); err != nil {
+				t.Fatalf("AeadEncryptWithNonce returned error on repeated input: %v", err)
+			}
+
+			if !bytes.Equal(first.Bytes(), second.Bytes()) {
+				t.Error("AeadEncryptWithNonce returned different ciphertexts for the same input")
+			}
+
+			var output bytes.Buffer
+			if err := AeadDecrypt(testDEK, &first, &output, testAAD); err != nil {
+				t.Fatalf("AeadDecrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), tc.plaintext) {
+				t.Errorf("AeadDecrypt returned %v bytes of plaintext, want the %v bytes encrypted", output.Len(), len(tc.plaintext))
+			}
+		})
+	}
+}
+
+func TestAeadEncryptWithNonceErrors(t *testing.T) {
+	testDEK := shares.NewDEK()
+	testPT := []byte("Plaintext for testing only.")
+	testAAD := []byte("AAD for testing only.")
+
+	var tracker NonceTracker
+	nonce := bytes.Repeat([]byte{0x42}, AeadNonceBytes)
+	if err := tracker.AeadEncryptWithNonce(testDEK, nonce, bytes.NewReader(testPT), io.Discard, testAAD); err != nil {
+		t.Fatalf("AeadEncryptWithNonce returned error: %v", err)
+	}
+
+	testcases := []struct {
+		name      string
+		nonce     []byte
+		plaintext []byte
+		aad       []byte
+	}{
+		{
+			name:      "Short nonce",
+			nonce:     nonce[1:],
+			plaintext: testPT,
+			aad:       testAAD,
+		},
+		{
+			name:      "Long nonce",
+			nonce:     append(append([]byte{}, nonce...), 0x42),
+			plaintext: testPT,
+			aad:       testAAD,
+		},
+		{
+			name:      "All-zero nonce",
+			nonce:     make([]byte, AeadNonceBytes),
+			plaintext: testPT,
+			aad:       testAAD,
+		},
+		{
+			name:      "Reused nonce with different plaintext",
+			nonce:     nonce,
+			plaintext: []byte("Different plaintext."),
+			aad:       testAAD,
+		},
+		{
+			name:      "Reused nonce with different AAD",
+			nonce:     nonce,
+			plaintext: testPT,
+			aad:       []byte("Different AAD."),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tracker.AeadEncryptWithNonce(testDEK, tc.nonce, bytes.NewReader(tc.plaintext), io.Discard, tc.aad); err == nil {
+				t.Error("AeadEncryptWithNonce succeeded, want error")
+			}
+		})
+	}
+
+	// Reuse is only tracked per NonceTracker, so state is not shared with
+	// unrelated callers.
+	var other NonceTracker
+	if err := other.AeadEncryptWithNonce(testDEK, nonce, bytes.NewReader([]byte("Different plaintext.")), io.Discard, testAAD); err != nil {
+		t.Errorf("AeadEncryptWithNonce with a separate NonceTracker returned error: %v", err)
+	}
+}
+
 func TestAeadDecryptFailsForInvalidCipherText(t *testing.T) {
 	testDEK := shares.NewDEK()
 	testCT := []byte("This is some random invalid ciphertext.")
@@ -282,6 +400,23 @@ func TestMetadataSerializeAvoidsCollisions(t *testing.T) {
 				KeyConfig: &configpb.KeyConfig{},
 			},
 		},
+		{
+			// Optional fields of the same shape are told apart by their tags.
+			&configpb.Metadata{
+				Shares:        []*configpb.WrappedShare{wrapped},
+				BlobId:        "blob",
+				KeyConfig:     &configpb.KeyConfig{},
+				AadVersion:    AADVersion2,
+				KeyCommitment: spacesHash,
+			},
+			&configpb.Metadata{
+				Shares:     []*configpb.WrappedShare{wrapped},
+				BlobId:     "blob",
+				KeyConfig:  &configpb.KeyConfig{},
+				AadVersion: AADVersion2,
+				AadSalt:    spacesHash,
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -300,3 +435,290 @@ func TestMetadataSerializeAvoidsCollisions(t *testing.T) {
 		}
 	}
 }
+
+func TestMetadataToAADV1Golden(t *testing.T) {
+	// The AAD of blobs written before AAD versions were recorded, which must
+	// never change.
+	wantAAD := "0f00000000000000" + "777261707065642073686172652030" +
+		"2000000000000000" + strings.Repeat("11", sha256.Size) +
+		"0f00000000000000" + "777261707065642073686172652031" +
+		"2000000000000000" + strings.Repeat("22", sha256.Size) +
+		"0400000000000000" + "626c6f62"
+
+	md := &configpb.Metadata{
+		Shares: []*configpb.WrappedShare{
+			{Share: []byte("wrapped share 0"), Hash: bytes.Repeat([]byte{0x11}, sha256.Size)},
+			{Share: []byte("wrapped share 1"), Hash: bytes.Repeat([]byte{0x22}, sha256.Size)},
+		},
+		BlobId:    "blob",
+		KeyConfig: newFakeKMSConfig(2).GetEncryptConfig().GetKeyConfig(),
+	}
+
+	aad, err := MetadataToAAD(md)
+	if err != nil {
+		t.Fatalf("MetadataToAAD returned error: %v", err)
+	}
+	if got := hex.EncodeToString(aad); got != wantAAD {
+		t.Errorf("MetadataToAAD = %v, want %v", got, wantAAD)
+	}
+
+	// Fields that AADVersion1 does not bind are rejected rather than ignored.
+	md.KeyCommitment = []byte("commitment")
+	if _, err := MetadataToAAD(md); err == nil {
+		t.Error("MetadataToAAD succeeded with a key commitment and AAD version 1, want error")
+	}
+}
+
+func TestMarshalMetadataDeterministic(t *testing.T) {
+	md := &configpb.Metadata{
+		Shares: []*configpb.WrappedShare{
+			{Share: []byte("share 0"), Hash: []byte("hash 0"), HashAlgorithm: configpb.ShareHashAlgorithm_SHA384},
+			{Share: []byte("share 1"), Hash: []byte("hash 1"), BackupShare: []byte("backup 1"), KekIndex: 1},
+		},
+		BlobId:    "blob",
+		KeyConfig: newFakeKMSConfig(2).GetEncryptConfig().GetKeyConfig(),
+		IntegrityManifest: &configpb.IntegrityManifest{
+			FrameSize:        aeadSegmentSize,
+			CiphertextLength: 42,
+			FrameHashes:      [][]byte{[]byte("frame hash")},
+			Mac:              []byte("mac"),
+		},
+		Provenance:    &configpb.Provenance{CreateTime: timestamppb.New(time.Unix(1700000000, 5)), StetVersion: "1.2.3"},
+		KeyCommitment: []byte("commitment"),
+		SegmentSize:   aeadMinSegmentSize,
+		AadVersion:    AADVersion2,
+	}
+
+	first, err := marshalMetadata(md)
+	if err != nil {
+		t.Fatalf("marshalMetadata returned error: %v", err)
+	}
+
+	second, err := marshalMetadata(proto.Clone(md).(*configpb.Metadata))
+	if err != nil {
+		t.Fatalf("marshalMetadata returned error: %v", err)
+	}
+
+	if !bytes.Equal(first, second) {
+		t.Errorf("marshalMetadata returned %x, then %x for the same metadata", first, second)
+	}
+
+	// The AAD of the parsed metadata must match that of the original.
+	var blob bytes.Buffer
+	if err := WriteSTETHeader(&blob, len(first)); err != nil {
+		t.Fatalf("WriteSTETHeader returned error: %v", err)
+	}
+	blob.Write(first)
+
+	parsed, err := ReadMetadata(&blob)
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	wantAAD, err := MetadataToAAD(md)
+	if err != nil {
+		t.Fatalf("MetadataToAAD returned error: %v", err)
+	}
+
+	gotAAD, err := MetadataToAAD(parsed)
+	if err != nil {
+		t.Fatalf("MetadataToAAD returned error: %v", err)
+	}
+
+	if !bytes.Equal(gotAAD, wantAAD) {
+		t.Errorf("MetadataToAAD of parsed metadata = %x, want %x", gotAAD, wantAAD)
+	}
+}
+
+func TestEncryptWritesDeterministicMetadata(t *testing.T) {
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, Version: "1.2.3"}
+	stetConfig := newFakeKMSConfig(2)
+
+	var metadataOutput bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(context.Background(), bytes.NewReader([]byte("plaintext")), &metadataOutput, io.Discard, stetConfig, "blob", WithProvenance(), WithIntegrityManifest(), WithKeyCommitment()); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	reader := bytes.NewReader(metadataOutput.Bytes())
+	if _, err := ReadSTETHeader(reader); err != nil {
+		t.Fatalf("ReadSTETHeader returned error: %v", err)
+	}
+	written, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("io.ReadAll returned error: %v", err)
+	}
+
+	parsed, err := ReadMetadata(bytes.NewReader(metadataOutput.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	// Re-marshaling the metadata as read by Decrypt reproduces the bytes
+	// written by Encrypt.
+	remarshaled, err := marshalMetadata(parsed)
+	if err != nil {
+		t.Fatalf("marshalMetadata returned error: %v", err)
+	}
+
+	if !bytes.Equal(remarshaled, written) {
+		t.Errorf("marshalMetadata of the parsed metadata = %x, want the %x written by Encrypt", remarshaled, written)
+	}
+}
+
+func TestAADVersions(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	encrypt := func(opts ...CallOption) []byte {
+		t.Helper()
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob", opts...); err != nil {
+			t.Fatalf("Encrypt returned error: %v", err)
+		}
+		return blob.Bytes()
+	}
+
+	// Blobs of format version 1 always use AAD version 1.
+	v1Blob := encrypt()
+	v2Blob := encrypt(WithFormatVersion(FormatVersion2))
+
+	// Add a hypothetical version 3 of the AAD serialization, and make it the
+	// one written by Encrypt.
+	const aadVersion3 = 3
+	defer func(version uint32) {
+		aadVersion = version
+		delete(aadSerializers, aadVersion3)
+	}(aadVersion)
+	aadSerializers[aadVersion3] = func(md *configpb.Metadata) ([]byte, error) {
+		aad, err := metadataToAADV2(md)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(aad)
+		return append([]byte("v3"), digest[:]...), nil
+	}
+	aadVersion = aadVersion3
+
+	v3Blob := encrypt(WithFormatVersion(FormatVersion2))
+
+	for _, tc := range []struct {
+		name        string
+		blob        []byte
+		wantVersion uint32
+	}{
+		{name: "Version 1", blob: v1Blob, wantVersion: 0},
+		{name: "Version 1 after a newer version is added", blob: encrypt(), wantVersion: 0},
+		{name: "Version 2", blob: v2Blob, wantVersion: AADVersion2},
+		{name: "Version 3", blob: v3Blob, wantVersion: aadVersion3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			md, err := ReadMetadata(bytes.NewReader(tc.blob))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+			if md.GetAadVersion() != tc.wantVersion {
+				t.Errorf("Metadata has AAD version %v, want %v", md.GetAadVersion(), tc.wantVersion)
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.Decrypt(ctx, bytes.NewReader(tc.blob), &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+			}
+		})
+	}
+
+	// Changing the recorded version changes the AAD, so decryption fails.
+	blobReader := bytes.NewReader(v3Blob)
+	if _, err := ReadMetadata(blobReader); err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+	ciphertext := v3Blob[len(v3Blob)-blobReader.Len():]
+
+	for _, version := range []uint32{AADVersion1, AADVersion2, 4} {
+		forged := rewriteMetadata(t, v3Blob, func(md *configpb.Metadata) {
+			md.AadVersion = version
+		})
+
+		if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext), io.Discard, stetConfig); err == nil {
+			t.Errorf("DecryptWithSidecar succeeded with AAD version changed to %v, want error", version)
+		}
+	}
+}
+
+func TestAADSalt(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	keyCfg := stetConfig.GetEncryptConfig().GetKeyConfig()
+	plaintext := []byte("This is data to be encrypted.")
+
+	// Encrypt two blobs with the same DEK, KeyConfig and blob ID, so that
+	// only the AAD salt tells their metadata apart.
+	dek := shares.NewDEK()
+	var metadata, ciphertexts [2]bytes.Buffer
+	var salts [2][]byte
+	for i := range metadata {
+		callOpts := stetClient.newCallOptions([]CallOption{WithFormatVersion(FormatVersion2)})
+		if _, err := stetClient.encryptWithDEK(ctx, dek, bytes.NewReader(plaintext), &metadata[i], &ciphertexts[i], stetConfig, keyCfg, "blob", callOpts); err != nil {
+			t.Fatalf("encryptWithDEK returned error: %v", err)
+		}
+
+		md, err := ReadMetadata(bytes.NewReader(metadata[i].Bytes()))
+		if err != nil {
+			t.Fatalf("ReadMetadata returned error: %v", err)
+		}
+		if len(md.GetAadSalt()) != aadSaltBytes {
+			t.Fatalf("Metadata has AAD salt of %v bytes, want %v", len(md.GetAadSalt()), aadSaltBytes)
+		}
+		salts[i] = md.GetAadSalt()
+	}
+	if bytes.Equal(salts[0], salts[1]) {
+		t.Errorf("Blobs have the same AAD salt %x, want different salts", salts[0])
+	}
+
+	decrypt := func(metadataBytes, ciphertext []byte) error {
+		_, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadataBytes), bytes.NewReader(ciphertext), io.Discard, stetConfig)
+		return err
+	}
+
+	if err := decrypt(metadata[0].Bytes(), ciphertexts[0].Bytes()); err != nil {
+		t.Fatalf("DecryptWithSidecar returned error: %v", err)
+	}
+
+	// Swapping the ciphertexts of the blobs fails.
+	if err := decrypt(metadata[0].Bytes(), ciphertexts[1].Bytes()); err == nil {
+		t.Error("DecryptWithSidecar succeeded with the ciphertext of another blob, want error")
+	}
+	if err := decrypt(metadata[1].Bytes(), ciphertexts[0].Bytes()); err == nil {
+		t.Error("DecryptWithSidecar succeeded with the ciphertext of another blob, want error")
+	}
+
+	// Removing or changing the salt fails.
+	for _, salt := range [][]byte{nil, salts[1]} {
+		forged := rewriteMetadata(t, metadata[0].Bytes(), func(md *configpb.Metadata) {
+			md.AadSalt = salt
+		})
+		if err := decrypt(forged, ciphertexts[0].Bytes()); err == nil {
+			t.Errorf("DecryptWithSidecar succeeded with AAD salt changed to %x, want error", salt)
+		}
+	}
+
+	// Blobs of format version 1, the default without newer features, are not
+	// salted, as older readers would not bind the salt into the AAD.
+	var v1Metadata bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &v1Metadata, io.Discard, stetConfig, "blob"); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+	md, err := ReadMetadata(&v1Metadata)
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+	if len(md.GetAadSalt()) != 0 {
+		t.Errorf("Blob of format version 1 has AAD salt %x, want none", md.GetAadSalt())
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudkms
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+	spb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/googleapis/gax-go/v2"
+	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// AsymmetricClient is implemented by Clients that can also use asymmetric
+// decryption keys, as needed to wrap shares with ASYMMETRIC_DECRYPT keys. The
+// Cloud KMS client implements it.
+type AsymmetricClient interface {
+	GetPublicKey(context.Context, *spb.GetPublicKeyRequest, ...gax.CallOption) (*rpb.PublicKey, error)
+	AsymmetricDecrypt(context.Context, *spb.AsymmetricDecryptRequest, ...gax.CallOption) (*spb.AsymmetricDecryptResponse, error)
+}
+
+// oaepHashes maps the asymmetric decryption algorithms that can wrap shares
+// to the hash they use with RSA-OAEP. The SHA-1 variants are not supported.
+var oaepHashes = map[rpb.CryptoKeyVersion_CryptoKeyVersionAlgorithm]crypto.Hash{
+	rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256: crypto.SHA256,
+	rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA256: crypto.SHA256,
+	rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA256: crypto.SHA256,
+	rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA512: crypto.SHA512,
+}
+
+// CheckAsymmetricAlgorithm returns an error if shares cannot be wrapped with
+// asymmetric decryption keys of the given algorithm.
+func CheckAsymmetricAlgorithm(algorithm rpb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) error {
+	if _, ok := oaepHashes[algorithm]; !ok {
+		return fmt.Errorf("unsupported asymmetric decryption algorithm %v", algorithm)
+	}
+
+	return nil
+}
+
+// asymmetricClient returns `client` as an AsymmetricClient, if it is one.
+func asymmetricClient(client Client) (AsymmetricClient, error) {
+	if client == nil {
+		return nil, fmt.Errorf("nil client specified")
+	}
+
+	asymmetric, ok := client.(AsymmetricClient)
+	if !ok {
+		return nil, fmt.Errorf("the Cloud KMS client does not support asymmetric decryption keys")
+	}
+
+	return asymmetric, nil
+}
+
+// AsymmetricWrapShare wraps the given share with RSA-OAEP, using the public
+// key of the ASYMMETRIC_DECRYPT CryptoKeyVersion named by opts.KeyName. Only
+// the public key is retrieved from Cloud KMS: the share is encrypted locally,
+// and never sent. AAD is not supported by asymmetric decryption keys.
+func AsymmetricWrapShare(ctx context.Context, client Client, opts WrapOpts) ([]byte, error) {
+	if len(opts.AAD) != 0 {
+		return nil, fmt.Errorf("additional authenticated data is not supported by asymmetric decryption keys")
+	}
+
+	asymmetric, err := asymmetricClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := asymmetric.GetPublicKey(ctx, &spb.GetPublicKeyRequest{Name: opts.KeyName}, opts.RPCOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %v", err)
+	}
+
+	if result.GetName() != opts.KeyName {
+		return nil, fmt.Errorf("GetPublicKey: request corrupted in-transit")
+	}
+	if result.GetPemCrc32C() == nil || int64(crc32c([]byte(result.GetPem()))) != result.GetPemCrc32C().GetValue() {
+		return nil, fmt.Errorf("GetPublicKey: response corrupted in-transit")
+	}
+
+	hash, ok := oaepHashes[result.GetAlgorithm()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported asymmetric decryption algorithm %v", result.GetAlgorithm())
+	}
+
+	block, _ := pem.Decode([]byte(result.GetPem()))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key PEM of %v", opts.KeyName)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key of %v: %v", opts.KeyName, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key of %v is a %T, want an RSA key", opts.KeyName, key)
+	}
+
+	wrapped, err := rsa.EncryptOAEP(hash.New(), rand.Reader, rsaKey, opts.Share, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with public key of %v: %v", opts.KeyName, err)
+	}
+
+	return wrapped, nil
+}
+
+// AsymmetricUnwrapShare unwraps a share wrapped by AsymmetricWrapShare, with
+// AsymmetricDecrypt using the CryptoKeyVersion named by opts.KeyName.
+func AsymmetricUnwrapShare(ctx context.Context, client Client, opts UnwrapOpts) ([]byte, error) {
+	if len(opts.AAD) != 0 {
+		return nil, fmt.Errorf("additional authenticated data is not supported by asymmetric decryption keys")
+	}
+
+	asymmetric, err := asymmetricClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &spb.AsymmetricDecryptRequest{
+		Name:             opts.KeyName,
+		Ciphertext:       opts.Share,
+		CiphertextCrc32C: wrapperspb.Int64(int64(crc32c(opts.Share))),
+	}
+
+	result, err := asymmetric.AsymmetricDecrypt(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt ciphertext: %v", err)
+	}
+
+	if !result.GetVerifiedCiphertextCrc32C() {
+		return nil, fmt.Errorf("AsymmetricDecrypt: request corrupted in-transit")
+	}
+	if result.GetPlaintextCrc32C() == nil || int64(crc32c(result.GetPlaintext())) != result.GetPlaintextCrc32C().GetValue() {
+		return nil, fmt.Errorf("AsymmetricDecrypt: response corrupted in-transit")
+	}
+
+	return result.GetPlaintext(), nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudkms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+	spb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/googleapis/gax-go/v2"
+	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const testAsymmetricKeyName = "projects/test/locations/test/keyRings/test/cryptoKeys/rsa/cryptoKeyVersions/1"
+
+// fakeAsymmetricClient serves a single RSA-OAEP decryption key, optionally
+// corrupting the fields covered by the CRC32C checks.
+type fakeAsymmetricClient struct {
+	minimalClient
+	key *rsa.PrivateKey
+
+	corruptPEM          bool
+	unverifiedRequest   bool
+	corruptPlaintextCRC bool
+}
+
+func (f *fakeAsymmetricClient) GetPublicKey(_ context.Context, req *spb.GetPublicKeyRequest, _ ...gax.CallOption) (*rpb.PublicKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(&f.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	pemCRC := int64(crc32c([]byte(pemKey)))
+	if f.corruptPEM {
+		pemCRC++
+	}
+
+	return &rpb.PublicKey{
+		Name:      req.GetName(),
+		Pem:       pemKey,
+		PemCrc32C: wrapperspb.Int64(pemCRC),
+		Algorithm: rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256,
+	}, nil
+}
+
+func (f *fakeAsymmetricClient) AsymmetricDecrypt(_ context.Context, req *spb.AsymmetricDecryptRequest, _ ...gax.CallOption) (*spb.AsymmetricDecryptResponse, error) {
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), nil, f.key, req.GetCiphertext(), nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintextCRC := int64(crc32c(plaintext))
+	if f.corruptPlaintextCRC {
+		plaintextCRC++
+	}
+
+	return &spb.AsymmetricDecryptResponse{
+		Plaintext:                plaintext,
+		PlaintextCrc32C:          wrapperspb.Int64(plaintextCRC),
+		VerifiedCiphertextCrc32C: !f.unverifiedRequest && req.GetCiphertextCrc32C().GetValue() == int64(crc32c(req.GetCiphertext())),
+	}, nil
+}
+
+func newFakeAsymmetricClient(t *testing.T) *fakeAsymmetricClient {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() returned error: %v", err)
+	}
+
+	return &fakeAsymmetricClient{key: key}
+}
+
+func TestAsymmetricWrapShareRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeAsymmetricClient(t)
+	share := []byte("Food share")
+
+	wrapped, err := AsymmetricWrapShare(ctx, client, WrapOpts{Share: share, KeyName: testAsymmetricKeyName})
+	if err != nil {
+		t.Fatalf("AsymmetricWrapShare() returned error: %v", err)
+	}
+	if bytes.Equal(wrapped, share) {
+		t.Errorf("AsymmetricWrapShare() returned the share unwrapped")
+	}
+
+	unwrapped, err := AsymmetricUnwrapShare(ctx, client, UnwrapOpts{Share: wrapped, KeyName: testAsymmetricKeyName})
+	if err != nil {
+		t.Fatalf("AsymmetricUnwrapShare() returned error: %v", err)
+	}
+	if !bytes.Equal(unwrapped, share) {
+		t.Errorf("AsymmetricUnwrapShare() = %q, want %q", unwrapped, share)
+	}
+}
+
+func TestAsymmetricShareFails(t *testing.T) {
+	ctx := context.Background()
+	share := []byte("Food share")
+
+	testCases := []struct {
+		name    string
+		client  func(*fakeAsymmetricClient) Client
+		aad     []byte
+		wantErr string
+	}{
+		{
+			name:    "client without asymmetric support",
+			client:  func(*fakeAsymmetricClient) Client { return minimalClient{} },
+			wantErr: "does not support asymmetric",
+		},
+		{
+			name:    "AAD",
+			client:  func(f *fakeAsymmetricClient) Client { return f },
+			aad:     []byte("aad"),
+			wantErr: "additional authenticated data",
+		},
+		{
+			name: "corrupted public key",
+			client: func(f *fakeAsymmetricClient) Client {
+				f.corruptPEM = true
+				return f
+			},
+			wantErr: "GetPublicKey: response corrupted",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := tc.client(newFakeAsymmetricClient(t))
+			_, err := AsymmetricWrapShare(ctx, client, WrapOpts{Share: share, KeyName: testAsymmetricKeyName, AAD: tc.aad})
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("AsymmetricWrapShare() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	unwrapCases := []struct {
+		name    string
+		corrupt func(*fakeAsymmetricClient)
+		wantErr string
+	}{
+		{
+			name:    "ciphertext not verified",
+			corrupt: func(f *fakeAsymmetricClient) { f.unverifiedRequest = true },
+			wantErr: "AsymmetricDecrypt: request corrupted",
+		},
+		{
+			name:    "corrupted plaintext",
+			corrupt: func(f *fakeAsymmetricClient) { f.corruptPlaintextCRC = true },
+			wantErr: "AsymmetricDecrypt: response corrupted",
+		},
+	}
+
+	for _, tc := range unwrapCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeAsymmetricClient(t)
+			wrapped, err := AsymmetricWrapShare(ctx, client, WrapOpts{Share: share, KeyName: testAsymmetricKeyName})
+			if err != nil {
+				t.Fatalf("AsymmetricWrapShare() returned error: %v", err)
+			}
+
+			tc.corrupt(client)
+			_, err = AsymmetricUnwrapShare(ctx, client, UnwrapOpts{Share: wrapped, KeyName: testAsymmetricKeyName})
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("AsymmetricUnwrapShare() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckAsymmetricAlgorithm(t *testing.T) {
+	if err := CheckAsymmetricAlgorithm(rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA256); err != nil {
+		t.Errorf("CheckAsymmetricAlgorithm(RSA_DECRYPT_OAEP_3072_SHA256) returned error: %v", err)
+	}
+	if err := CheckAsymmetricAlgorithm(rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA1); err == nil {
+		t.Errorf("CheckAsymmetricAlgorithm(RSA_DECRYPT_OAEP_2048_SHA1) succeeded, want error")
+	}
+}
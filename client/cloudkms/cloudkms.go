@@ -19,6 +19,7 @@ import (
 	"context"
 	"fmt"
 	"hash/crc32"
+	"sync"
 
 	"cloud.google.com/go/kms/apiv1"
 	rpb "cloud.google.com/go/kms/apiv1/kmspb"
@@ -36,6 +37,13 @@ type Client interface {
 	Close() error
 }
 
+// VersionGetter is implemented by Clients that can also retrieve a single
+// CryptoKeyVersion, as needed to use KEK URIs pinned to a version. The Cloud
+// KMS client implements it.
+type VersionGetter interface {
+	GetCryptoKeyVersion(context.Context, *spb.GetCryptoKeyVersionRequest, ...gax.CallOption) (*rpb.CryptoKeyVersion, error)
+}
+
 func crc32c(data []byte) uint32 {
 	t := crc32.MakeTable(crc32.Castagnoli)
 	return crc32.Checksum(data, t)
@@ -46,6 +54,10 @@ type WrapOpts struct {
 	Share   []byte
 	KeyName string
 	RPCOpts []gax.CallOption
+
+	// If set, sent as the additional authenticated data of the request, so
+	// that the same AAD must be supplied to unwrap the share.
+	AAD []byte
 }
 
 // WrapShare uses a KMS client to wrap the given share using Cloud KMS.
@@ -58,6 +70,10 @@ func WrapShare(ctx context.Context, client Client, opts WrapOpts) ([]byte, error
 		Plaintext:       opts.Share,
 		PlaintextCrc32C: wrapperspb.Int64(int64(crc32c(opts.Share))),
 	}
+	if len(opts.AAD) != 0 {
+		req.AdditionalAuthenticatedData = opts.AAD
+		req.AdditionalAuthenticatedDataCrc32C = wrapperspb.Int64(int64(crc32c(opts.AAD)))
+	}
 
 	result, err := client.Encrypt(ctx, req, opts.RPCOpts...)
 	if err != nil {
@@ -67,6 +83,9 @@ func WrapShare(ctx context.Context, client Client, opts WrapOpts) ([]byte, error
 	if !result.VerifiedPlaintextCrc32C {
 		return nil, fmt.Errorf("Encrypt: request corrupted in-transit")
 	}
+	if len(opts.AAD) != 0 && !result.VerifiedAdditionalAuthenticatedDataCrc32C {
+		return nil, fmt.Errorf("Encrypt: request AAD corrupted in-transit")
+	}
 	if int64(crc32c(result.Ciphertext)) != result.CiphertextCrc32C.Value {
 		return nil, fmt.Errorf("Encrypt: response corrupted in-transit")
 	}
@@ -77,33 +96,94 @@ func WrapShare(ctx context.Context, client Client, opts WrapOpts) ([]byte, error
 type UnwrapOpts struct {
 	Share   []byte
 	KeyName string
+
+	// Must match the AAD the share was wrapped with, if any.
+	AAD []byte
 }
 
 // UnwrapShare uses a KMS client to unwrap the given share using Cloud KMS.
 func UnwrapShare(ctx context.Context, client Client, opts UnwrapOpts) ([]byte, error) {
+	unwrapped, _, err := UnwrapShareWithProtectionLevel(ctx, client, opts)
+	return unwrapped, err
+}
+
+// UnwrapShareWithProtectionLevel is like UnwrapShare, but also returns the
+// protection level of the CryptoKeyVersion that Cloud KMS unwrapped the share
+// with, which is the one it was wrapped with rather than necessarily the
+// primary. The level is unspecified if Cloud KMS did not report it.
+func UnwrapShareWithProtectionLevel(ctx context.Context, client Client, opts UnwrapOpts) ([]byte, rpb.ProtectionLevel, error) {
 	req := &spb.DecryptRequest{
 		Name:             opts.KeyName,
 		Ciphertext:       opts.Share,
 		CiphertextCrc32C: wrapperspb.Int64(int64(crc32c(opts.Share))),
 	}
+	if len(opts.AAD) != 0 {
+		req.AdditionalAuthenticatedData = opts.AAD
+		req.AdditionalAuthenticatedDataCrc32C = wrapperspb.Int64(int64(crc32c(opts.AAD)))
+	}
 
 	result, err := client.Decrypt(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt ciphertext: %v", err)
+		return nil, rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED, fmt.Errorf("failed to decrypt ciphertext: %v", err)
 	}
 
 	if int64(crc32c(result.Plaintext)) != result.PlaintextCrc32C.Value {
-		return nil, fmt.Errorf("Decrypt: response corrupted in-transit")
+		return nil, rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED, fmt.Errorf("Decrypt: response corrupted in-transit")
+	}
+	return result.Plaintext, result.GetProtectionLevel(), nil
+}
+
+// AEAD implements tink.AEAD using a Cloud KMS key, for example to decrypt
+// Tink keysets encrypted with Cloud KMS.
+type AEAD struct {
+	ctx     context.Context
+	client  Client
+	keyName string
+}
+
+// NewAEAD returns an AEAD using the Cloud KMS key with the given name, of the
+// form "projects/*/locations/*/keyRings/*/cryptoKeys/*". The context is used
+// for all requests made by the AEAD.
+func NewAEAD(ctx context.Context, client Client, keyName string) *AEAD {
+	return &AEAD{ctx: ctx, client: client, keyName: keyName}
+}
+
+// Encrypt encrypts plaintext with the Cloud KMS key.
+func (a *AEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) != 0 {
+		return nil, fmt.Errorf("associated data is not supported")
+	}
+
+	return WrapShare(a.ctx, a.client, WrapOpts{Share: plaintext, KeyName: a.keyName})
+}
+
+// Decrypt decrypts ciphertext with the Cloud KMS key.
+func (a *AEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) != 0 {
+		return nil, fmt.Errorf("associated data is not supported")
 	}
-	return result.Plaintext, nil
+
+	return UnwrapShare(a.ctx, a.client, UnwrapOpts{Share: ciphertext, KeyName: a.keyName})
 }
 
 // ClientFactory manages singleton instances of KMS Clients mapped to JSON credentials.
+// It is safe for concurrent use.
 type ClientFactory struct {
 	CredsMap    map[string]Client
 	StetVersion string
 
+	// If set, included in the user agent of created clients, so that Cloud
+	// KMS requests can be correlated with the caller's request.
+	RequestID string
+
+	// If set, the clients returned by Client wait for it before each request.
+	RateLimiter *RateLimiter
+
+	mu           sync.Mutex
 	newKMSClient func(context.Context, ...option.ClientOption) (*kms.KeyManagementClient, error)
+
+	// If set, returned for all credentials, and not closed by Close.
+	staticClient Client
 }
 
 // NewClientFactory initializes a ClientMap with the provided version.
@@ -115,6 +195,13 @@ func NewClientFactory(version string) *ClientFactory {
 	}
 }
 
+// NewStaticClientFactory returns a ClientFactory that returns the given client
+// regardless of credentials. The caller retains ownership of the client, which
+// is not closed when the factory is closed.
+func NewStaticClientFactory(client Client) *ClientFactory {
+	return &ClientFactory{staticClient: client}
+}
+
 func (m *ClientFactory) createClient(ctx context.Context, credentials string) (Client, error) {
 	// Set user agent for Cloud KMS API calls.
 	ua := "STET/"
@@ -124,6 +211,10 @@ func (m *ClientFactory) createClient(ctx context.Context, credentials string) (C
 		ua += "dev"
 	}
 
+	if m.RequestID != "" {
+		ua += " request-id/" + m.RequestID
+	}
+
 	opts := []option.ClientOption{option.WithUserAgent(ua)}
 
 	// If credentials were specified, include them in the options.
@@ -137,6 +228,13 @@ func (m *ClientFactory) createClient(ctx context.Context, credentials string) (C
 // Client returns a KMS Client initialized with the provided credentials. If a client
 // with these credentials already exists, it returns that.
 func (m *ClientFactory) Client(ctx context.Context, credentials string) (Client, error) {
+	if m.staticClient != nil {
+		return m.rateLimited(m.staticClient), nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	client, ok := m.CredsMap[credentials]
 
 	if !ok {
@@ -149,11 +247,23 @@ func (m *ClientFactory) Client(ctx context.Context, credentials string) (Client,
 		m.CredsMap[credentials] = client
 	}
 
-	return client, nil
+	return m.rateLimited(client), nil
+}
+
+// rateLimited returns `client` limited by m.RateLimiter, if set.
+func (m *ClientFactory) rateLimited(client Client) Client {
+	if m.RateLimiter == nil {
+		return client
+	}
+
+	return NewRateLimitedClient(client, m.RateLimiter)
 }
 
 // Close iterates through all the clients in the map and closes them.
 func (m *ClientFactory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for _, client := range m.CredsMap {
 		if err := client.Close(); err != nil {
 			return err
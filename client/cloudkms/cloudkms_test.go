@@ -68,6 +68,7 @@ func TestWrapKMSShareFails(t *testing.T) {
 	plaintext := []byte("Plaintext")
 	testCases := []struct {
 		name            string
+		aad             []byte
 		encryptResponse *kmsspb.EncryptResponse
 		encryptError    error
 	}{
@@ -91,6 +92,17 @@ func TestWrapKMSShareFails(t *testing.T) {
 			},
 			encryptError: nil,
 		},
+		{
+			name: "AAD corrupted",
+			aad:  []byte("AAD"),
+			encryptResponse: &kmsspb.EncryptResponse{
+				Name:                    testutil.SoftwareKEK.Name,
+				Ciphertext:              []byte("Ciphertext"),
+				CiphertextCrc32C:        wrapperspb.Int64(int64(crc32c([]byte("Ciphertext")))),
+				VerifiedPlaintextCrc32C: true,
+			},
+			encryptError: nil,
+		},
 		{
 			name:            "Error from encrypt",
 			encryptResponse: nil,
@@ -108,7 +120,7 @@ func TestWrapKMSShareFails(t *testing.T) {
 				},
 			}
 
-			opts := WrapOpts{Share: []byte(plaintext), KeyName: testutil.SoftwareKEK.Name}
+			opts := WrapOpts{Share: []byte(plaintext), KeyName: testutil.SoftwareKEK.Name, AAD: testCase.aad}
 			_, err := WrapShare(ctx, fakeKMSClient, opts)
 
 			if err == nil {
@@ -216,6 +228,32 @@ func TestCreateClient(t *testing.T) {
 	}
 }
 
+func TestCreateClientWithRequestID(t *testing.T) {
+	expectedOpt := option.WithUserAgent("STET/test request-id/test-request-id")
+
+	testNewKMSClient := func(ctx context.Context, opts ...option.ClientOption) (*kms.KeyManagementClient, error) {
+		if len(opts) != 1 {
+			t.Fatalf("len(opts) = %v, want 1", len(opts))
+		}
+
+		if opts[0] != expectedOpt {
+			t.Errorf("opts[0] = %v, want %v", opts[0], expectedOpt)
+		}
+
+		return &kms.KeyManagementClient{}, nil
+	}
+
+	factory := &ClientFactory{
+		StetVersion:  "test",
+		RequestID:    "test-request-id",
+		newKMSClient: testNewKMSClient,
+	}
+
+	if _, err := factory.createClient(context.Background(), ""); err != nil {
+		t.Errorf("createClient returned error: %v", err)
+	}
+}
+
 func TestCreateClientWithCredentials(t *testing.T) {
 	credentials := "credentials: test"
 	version := "test"
@@ -252,3 +290,37 @@ func TestCreateClientWithCredentials(t *testing.T) {
 		t.Errorf("createClient returned error: %v", err)
 	}
 }
+
+type closeRecordingClient struct {
+	testutil.FakeKeyManagementClient
+	closed bool
+}
+
+func (c *closeRecordingClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestStaticClientFactory(t *testing.T) {
+	client := &closeRecordingClient{}
+	factory := NewStaticClientFactory(client)
+
+	for _, creds := range []string{"", "credentials: test"} {
+		got, err := factory.Client(context.Background(), creds)
+		if err != nil {
+			t.Fatalf("Client(ctx, %q) returned error: %v", creds, err)
+		}
+
+		if got != client {
+			t.Errorf("Client(ctx, %q) = %v, want the static client", creds, got)
+		}
+	}
+
+	if err := factory.Close(); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+
+	if client.closed {
+		t.Errorf("Close() closed the static client, want it left open")
+	}
+}
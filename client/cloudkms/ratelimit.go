@@ -0,0 +1,196 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudkms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+	spb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// RateLimiter limits the rate of Cloud KMS requests with a token bucket, so
+// that large batches stay under Cloud KMS quotas instead of failing with
+// RESOURCE_EXHAUSTED. Requests are permitted at up to `qps` per second on
+// average, with bursts of up to `burst`. It is safe for concurrent use, and a
+// single RateLimiter may be shared by several clients to limit them jointly.
+type RateLimiter struct {
+	qps   float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter permitting `qps` requests per second
+// with bursts of up to `burst`, starting with a full bucket.
+func NewRateLimiter(qps float64, burst int) (*RateLimiter, error) {
+	if qps <= 0 {
+		return nil, fmt.Errorf("rate limit must be positive, got %v requests per second", qps)
+	}
+
+	if burst <= 0 {
+		return nil, fmt.Errorf("rate limit burst must be positive, got %v", burst)
+	}
+
+	return &RateLimiter{
+		qps:    qps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}, nil
+}
+
+// Wait blocks until a request is permitted, or until `ctx` is done, in which
+// case it returns the context's error and the request is not counted.
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Reserve a token, which may leave the bucket in debt, and wait for the
+	// debt to be repaid.
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.qps
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens--
+	delay := time.Duration(-r.tokens / r.qps * float64(time.Second))
+	r.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Return the reserved token, so that cancelled requests do not delay
+		// later ones.
+		r.mu.Lock()
+		r.tokens++
+		r.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// NewRateLimitedClient returns a Client that waits for `limiter` before each
+// request to `client`. If `client` is a VersionGetter or an AsymmetricClient,
+// so is the returned Client. Closing the returned Client closes `client`.
+func NewRateLimitedClient(client Client, limiter *RateLimiter) Client {
+	limited := &rateLimitedClient{client: client, limiter: limiter}
+	getter, isGetter := client.(VersionGetter)
+	asymmetric, isAsymmetric := client.(AsymmetricClient)
+
+	switch {
+	case isGetter && isAsymmetric:
+		return &struct {
+			*rateLimitedClient
+			*rateLimitedVersionGetter
+			*rateLimitedAsymmetricClient
+		}{limited, &rateLimitedVersionGetter{getter, limiter}, &rateLimitedAsymmetricClient{asymmetric, limiter}}
+	case isGetter:
+		return &struct {
+			*rateLimitedClient
+			*rateLimitedVersionGetter
+		}{limited, &rateLimitedVersionGetter{getter, limiter}}
+	case isAsymmetric:
+		return &struct {
+			*rateLimitedClient
+			*rateLimitedAsymmetricClient
+		}{limited, &rateLimitedAsymmetricClient{asymmetric, limiter}}
+	}
+
+	return limited
+}
+
+type rateLimitedClient struct {
+	client  Client
+	limiter *RateLimiter
+}
+
+func (c *rateLimitedClient) GetCryptoKey(ctx context.Context, req *spb.GetCryptoKeyRequest, opts ...gax.CallOption) (*rpb.CryptoKey, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("rate limited: %w", err)
+	}
+
+	return c.client.GetCryptoKey(ctx, req, opts...)
+}
+
+func (c *rateLimitedClient) Encrypt(ctx context.Context, req *spb.EncryptRequest, opts ...gax.CallOption) (*spb.EncryptResponse, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("rate limited: %w", err)
+	}
+
+	return c.client.Encrypt(ctx, req, opts...)
+}
+
+func (c *rateLimitedClient) Decrypt(ctx context.Context, req *spb.DecryptRequest, opts ...gax.CallOption) (*spb.DecryptResponse, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("rate limited: %w", err)
+	}
+
+	return c.client.Decrypt(ctx, req, opts...)
+}
+
+func (c *rateLimitedClient) Close() error {
+	return c.client.Close()
+}
+
+type rateLimitedVersionGetter struct {
+	getter  VersionGetter
+	limiter *RateLimiter
+}
+
+func (c *rateLimitedVersionGetter) GetCryptoKeyVersion(ctx context.Context, req *spb.GetCryptoKeyVersionRequest, opts ...gax.CallOption) (*rpb.CryptoKeyVersion, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("rate limited: %w", err)
+	}
+
+	return c.getter.GetCryptoKeyVersion(ctx, req, opts...)
+}
+
+type rateLimitedAsymmetricClient struct {
+	client  AsymmetricClient
+	limiter *RateLimiter
+}
+
+func (c *rateLimitedAsymmetricClient) GetPublicKey(ctx context.Context, req *spb.GetPublicKeyRequest, opts ...gax.CallOption) (*rpb.PublicKey, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("rate limited: %w", err)
+	}
+
+	return c.client.GetPublicKey(ctx, req, opts...)
+}
+
+func (c *rateLimitedAsymmetricClient) AsymmetricDecrypt(ctx context.Context, req *spb.AsymmetricDecryptRequest, opts ...gax.CallOption) (*spb.AsymmetricDecryptResponse, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("rate limited: %w", err)
+	}
+
+	return c.client.AsymmetricDecrypt(ctx, req, opts...)
+}
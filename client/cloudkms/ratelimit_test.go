@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudkms
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	spb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/GoogleCloudPlatform/stet/client/testutil"
+	"github.com/googleapis/gax-go/v2"
+)
+
+func TestRateLimitedClientCapsRate(t *testing.T) {
+	const (
+		qps   = 100
+		burst = 5
+		calls = 25
+	)
+
+	limiter, err := NewRateLimiter(qps, burst)
+	if err != nil {
+		t.Fatalf("NewRateLimiter() returned error: %v", err)
+	}
+
+	fakeClient := &testutil.FakeKeyManagementClient{
+		DecryptFunc: func(context.Context, *spb.DecryptRequest, ...gax.CallOption) (*spb.DecryptResponse, error) {
+			return &spb.DecryptResponse{}, nil
+		},
+	}
+	client := NewRateLimitedClient(fakeClient, limiter)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Decrypt(context.Background(), &spb.DecryptRequest{}); err != nil {
+				t.Errorf("Decrypt() returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The burst is permitted immediately, and the rest at the limited rate.
+	if elapsed, want := time.Since(start), time.Duration(calls-burst)*time.Second/qps; elapsed < want*9/10 {
+		t.Errorf("%v calls took %v, want at least %v", calls, elapsed, want)
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	limiter, err := NewRateLimiter(1, 1)
+	if err != nil {
+		t.Fatalf("NewRateLimiter() returned error: %v", err)
+	}
+
+	// Use up the burst.
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	client := NewRateLimitedClient(&testutil.FakeKeyManagementClient{}, limiter)
+	if _, err := client.Encrypt(ctx, &spb.EncryptRequest{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Encrypt() returned error %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestNewRateLimiterErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		qps   float64
+		burst int
+	}{
+		{"Zero QPS", 0, 1},
+		{"Negative QPS", -1, 1},
+		{"Zero burst", 1, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewRateLimiter(tc.qps, tc.burst); err == nil {
+				t.Errorf("NewRateLimiter(%v, %v) succeeded, want error", tc.qps, tc.burst)
+			}
+		})
+	}
+}
+
+type minimalClient struct {
+	Client
+}
+
+func TestRateLimitedClientVersionGetter(t *testing.T) {
+	limiter, err := NewRateLimiter(1, 1)
+	if err != nil {
+		t.Fatalf("NewRateLimiter() returned error: %v", err)
+	}
+
+	if _, ok := NewRateLimitedClient(&testutil.FakeKeyManagementClient{}, limiter).(VersionGetter); !ok {
+		t.Error("NewRateLimitedClient() of a VersionGetter is not a VersionGetter")
+	}
+
+	if _, ok := NewRateLimitedClient(minimalClient{}, limiter).(VersionGetter); ok {
+		t.Error("NewRateLimitedClient() of a Client that is not a VersionGetter is a VersionGetter")
+	}
+
+	if _, ok := NewRateLimitedClient(&fakeAsymmetricClient{}, limiter).(AsymmetricClient); !ok {
+		t.Error("NewRateLimitedClient() of an AsymmetricClient is not an AsymmetricClient")
+	}
+
+	if _, ok := NewRateLimitedClient(minimalClient{}, limiter).(AsymmetricClient); ok {
+		t.Error("NewRateLimitedClient() of a Client that is not an AsymmetricClient is an AsymmetricClient")
+	}
+}
+
+func TestClientFactoryRateLimiter(t *testing.T) {
+	limiter, err := NewRateLimiter(1, 1)
+	if err != nil {
+		t.Fatalf("NewRateLimiter() returned error: %v", err)
+	}
+
+	factory := NewStaticClientFactory(&testutil.FakeKeyManagementClient{})
+	factory.RateLimiter = limiter
+
+	client, err := factory.Client(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Client() returned error: %v", err)
+	}
+
+	if _, err := client.GetCryptoKey(context.Background(), &spb.GetCryptoKeyRequest{Name: "key"}); err != nil {
+		t.Fatalf("GetCryptoKey() returned error: %v", err)
+	}
+
+	// The burst is used up, so the next request must wait about a second.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetCryptoKey(ctx, &spb.GetCryptoKeyRequest{Name: "key"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetCryptoKey() returned error %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package confidentialspace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+const (
+	teeServerSocket     = "/run/container_launcher/teeserver.sock"
+	attestationTokenURL = "http://localhost/v1/token"
+	// attestationTokenType requests an OIDC token with a custom audience.
+	attestationTokenType = "OIDC"
+)
+
+// attestationTokenRequest is the body of a custom token request to the
+// Confidential Space launcher.
+type attestationTokenRequest struct {
+	Audience  string `json:"audience"`
+	TokenType string `json:"token_type"`
+}
+
+// AttestationTokenSource returns a function that obtains Confidential Space
+// attestation tokens for a given audience from the container launcher. It is
+// suitable for StetClient.EKMTokenSource, and only works in a Confidential
+// Space workload.
+func AttestationTokenSource() func(ctx context.Context, audience string) (string, error) {
+	return attestationTokenSourceWithSocket(teeServerSocket)
+}
+
+// attestationTokenSourceWithSocket is like AttestationTokenSource, but
+// connects to the launcher at the given Unix socket. This allows our tests to
+// use a fake launcher.
+func attestationTokenSourceWithSocket(socket string) func(ctx context.Context, audience string) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	return func(ctx context.Context, audience string) (string, error) {
+		body, err := json.Marshal(attestationTokenRequest{Audience: audience, TokenType: attestationTokenType})
+		if err != nil {
+			return "", fmt.Errorf("failed to serialize attestation token request: %v", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, attestationTokenURL, bytes.NewReader(body))
+		if err != nil {
+			return "", fmt.Errorf("failed to create attestation token request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("failed to request attestation token from Confidential Space launcher: %v", err)
+		}
+		defer resp.Body.Close()
+
+		token, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("failed to read attestation token: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Confidential Space launcher returned %v: %s", resp.Status, token)
+		}
+
+		if len(token) == 0 {
+			return "", fmt.Errorf("Confidential Space launcher returned an empty attestation token")
+		}
+
+		return string(token), nil
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package confidentialspace
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeAttestationToken returns an unsigned token shaped like a Confidential
+// Space attestation token for the given audience.
+func fakeAttestationToken(audience string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":%q,"iss":"https://confidentialcomputing.googleapis.com","hwmodel":"GCP_AMD_SEV","swname":"CONFIDENTIAL_SPACE"}`, audience)))
+	return header + "." + claims + ".signature"
+}
+
+// startFakeLauncher serves `handler` on a Unix socket, returning its path.
+func startFakeLauncher(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+
+	// Unix socket paths are limited in length, so avoid t.TempDir().
+	dir, err := os.MkdirTemp("", "cs")
+	if err != nil {
+		t.Fatalf("Error creating socket directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "teeserver.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Error listening on %v: %v", socket, err)
+	}
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return socket
+}
+
+func TestAttestationTokenSource(t *testing.T) {
+	audience := "https://ekm.example.com"
+
+	socket := startFakeLauncher(t, func(w http.ResponseWriter, r *http.Request) {
+		var req attestationTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/token" || req.TokenType != attestationTokenType {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(fakeAttestationToken(req.Audience)))
+	})
+
+	token, err := attestationTokenSourceWithSocket(socket)(context.Background(), audience)
+	if err != nil {
+		t.Fatalf("Attestation token source returned error: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Attestation token source returned %q, want a JWT", token)
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("Error decoding token claims: %v", err)
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatalf("Error parsing token claims: %v", err)
+	}
+
+	if claims.Aud != audience {
+		t.Errorf("Attestation token has audience %q, want %q", claims.Aud, audience)
+	}
+}
+
+func TestAttestationTokenSourceErrors(t *testing.T) {
+	testcases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "Launcher error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "not in a Confidential Space workload", http.StatusInternalServerError)
+			},
+		},
+		{
+			name:    "Empty token",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			socket := startFakeLauncher(t, tc.handler)
+			if _, err := attestationTokenSourceWithSocket(socket)(context.Background(), "https://ekm.example.com"); err == nil {
+				t.Error("Attestation token source succeeded, want error")
+			}
+		})
+	}
+
+	t.Run("No launcher", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "missing.sock")
+		if _, err := attestationTokenSourceWithSocket(socket)(context.Background(), "https://ekm.example.com"); err == nil {
+			t.Error("Attestation token source succeeded without a launcher, want error")
+		}
+	})
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// ConfigFormat is the encoding of a serialized CombinedConfig.
+type ConfigFormat int
+
+const (
+	// ConfigFormatJSON is the protobuf JSON encoding.
+	ConfigFormatJSON ConfigFormat = iota
+	// ConfigFormatTextproto is the protobuf text format.
+	ConfigFormatTextproto
+)
+
+func (f ConfigFormat) String() string {
+	switch f {
+	case ConfigFormatJSON:
+		return "JSON"
+	case ConfigFormatTextproto:
+		return "textproto"
+	default:
+		return fmt.Sprintf("ConfigFormat(%d)", int(f))
+	}
+}
+
+// ParseCombinedConfig parses a CombinedConfig in the given format and returns
+// the StetConfig derived from it. See StetConfigFromCombined.
+func ParseCombinedConfig(data []byte, format ConfigFormat) (*configpb.StetConfig, error) {
+	combined, err := unmarshalCombinedConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return StetConfigFromCombined(combined)
+}
+
+// unmarshalCombinedConfig parses a CombinedConfig in the given format.
+func unmarshalCombinedConfig(data []byte, format ConfigFormat) (*configpb.CombinedConfig, error) {
+	combined := &configpb.CombinedConfig{}
+
+	switch format {
+	case ConfigFormatJSON:
+		if err := protojson.Unmarshal(data, combined); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal CombinedConfig from JSON: %w", err)
+		}
+	case ConfigFormatTextproto:
+		if err := prototext.Unmarshal(data, combined); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal CombinedConfig from textproto: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %v", format)
+	}
+
+	return combined, nil
+}
+
+// LoadCombinedConfigFile reads a CombinedConfig from the file at `path` and
+// returns the StetConfig derived from it. Files with a .json extension are
+// parsed as JSON, and those with a .textproto, .txtpb or .pbtxt extension as
+// textproto.
+func LoadCombinedConfigFile(path string) (*configpb.StetConfig, error) {
+	var format ConfigFormat
+	switch filepath.Ext(path) {
+	case ".json":
+		format = ConfigFormatJSON
+	case ".textproto", ".txtpb", ".pbtxt":
+		format = ConfigFormatTextproto
+	default:
+		return nil, fmt.Errorf("unrecognized config file extension for %q, want .json, .textproto, .txtpb or .pbtxt", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	return ParseCombinedConfig(data, format)
+}
+
+// StetConfigFromCombined derives a StetConfig from a CombinedConfig. The
+// EncryptConfig uses its KeyConfig, and the DecryptConfig contains a copy of
+// the same KeyConfig followed by any additional decrypt KeyConfigs, so blobs
+// encrypted with the result can always be decrypted with it.
+func StetConfigFromCombined(combined *configpb.CombinedConfig) (*configpb.StetConfig, error) {
+	keyConfig := combined.GetKeyConfig()
+	if keyConfig == nil {
+		return nil, fmt.Errorf("no KeyConfig found in CombinedConfig")
+	}
+
+	if len(keyConfig.GetKekInfos()) == 0 {
+		return nil, fmt.Errorf("KeyConfig in CombinedConfig has no KekInfos")
+	}
+
+	decryptKeyConfigs := []*configpb.KeyConfig{proto.Clone(keyConfig).(*configpb.KeyConfig)}
+	for i, kc := range combined.GetAdditionalDecryptKeyConfigs() {
+		if len(kc.GetKekInfos()) == 0 {
+			return nil, fmt.Errorf("additional decrypt KeyConfig #%v in CombinedConfig has no KekInfos", i)
+		}
+		decryptKeyConfigs = append(decryptKeyConfigs, proto.Clone(kc).(*configpb.KeyConfig))
+	}
+
+	return &configpb.StetConfig{
+		EncryptConfig:            &configpb.EncryptConfig{KeyConfig: proto.Clone(keyConfig).(*configpb.KeyConfig)},
+		DecryptConfig:            &configpb.DecryptConfig{KeyConfigs: decryptKeyConfigs},
+		AsymmetricKeys:           combined.GetAsymmetricKeys(),
+		ConfidentialSpaceConfigs: combined.GetConfidentialSpaceConfigs(),
+	}, nil
+}
+
+// LoadCombinedConfigEnv parses a CombinedConfig from the environment variable
+// `name` and returns the StetConfig derived from it, so that containerized
+// deployments can be configured without mounting a file. The format is
+// detected from the contents: JSON if it starts with '{', and textproto
+// otherwise. As the config may contain secret material, parse errors only
+// report where parsing failed, and the contents are never logged.
+func LoadCombinedConfigEnv(name string) (*configpb.StetConfig, error) {
+	data, ok := os.LookupEnv(name)
+	if !ok || strings.TrimSpace(data) == "" {
+		return nil, fmt.Errorf("environment variable %v is not set or empty", name)
+	}
+
+	return parseSecretCombinedConfig([]byte(data), fmt.Sprintf("environment variable %v", name))
+}
+
+// LoadCombinedConfigSecret reads a CombinedConfig from a Secret Manager
+// secret version and returns the StetConfig derived from it. `name` is the
+// resource name of the secret version, such as
+// "projects/my-project/secrets/stet-config/versions/3", or of the secret, in
+// which case its latest version is read. The payload's CRC32C checksum is
+// verified if present. The format is detected, and parse errors reported, as
+// in LoadCombinedConfigEnv.
+func LoadCombinedConfigSecret(ctx context.Context, name string, opts ...option.ClientOption) (*configpb.StetConfig, error) {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	service, err := secretmanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Secret Manager client: %v", err)
+	}
+
+	resp, err := service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret version %v: %v", name, err)
+	}
+
+	if resp.Payload == nil {
+		return nil, fmt.Errorf("secret version %v has no payload", name)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payload of secret version %v: %v", name, err)
+	}
+
+	if resp.Payload.DataCrc32c != 0 && int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))) != resp.Payload.DataCrc32c {
+		return nil, fmt.Errorf("payload of secret version %v does not match its CRC32C checksum", name)
+	}
+
+	return parseSecretCombinedConfig(data, fmt.Sprintf("secret version %v", name))
+}
+
+// parseErrorPosition matches the position reported in protobuf parse errors.
+var parseErrorPosition = regexp.MustCompile(`\(line \d+:\d+\)`)
+
+// parseSecretCombinedConfig is like ParseCombinedConfig, for configs from
+// `source` that may contain secret material. The format is detected from the
+// contents, and parse errors, which may quote the config, are replaced by the
+// position at which parsing failed.
+func parseSecretCombinedConfig(data []byte, source string) (*configpb.StetConfig, error) {
+	format := ConfigFormatTextproto
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		format = ConfigFormatJSON
+	}
+
+	combined, err := unmarshalCombinedConfig(data, format)
+	if err != nil {
+		where := "at " + strings.Trim(parseErrorPosition.FindString(err.Error()), "()")
+		if where == "at " {
+			where = "before the end of the input"
+		}
+		return nil, fmt.Errorf("failed to parse CombinedConfig from %v as %v: malformed %v (details omitted as the config may contain secret material)", source, format, where)
+	}
+
+	stetConfig, err := StetConfigFromCombined(combined)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CombinedConfig from %v: %v", source, err)
+	}
+
+	return stetConfig, nil
+}
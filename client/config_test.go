@@ -0,0 +1,360 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+)
+
+const testCombinedConfigJSON = `{
+  "keyConfig": {
+    "kekInfos": [{"kekUri": "gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/key0"}],
+    "dekAlgorithm": "AES256_GCM",
+    "noSplit": true
+  },
+  "additionalDecryptKeyConfigs": [{
+    "kekInfos": [{"kekUri": "gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/old"}],
+    "dekAlgorithm": "AES256_GCM",
+    "noSplit": true
+  }]
+}`
+
+const testCombinedConfigTextproto = `
+key_config {
+  kek_infos { kek_uri: "gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/key0" }
+  dek_algorithm: AES256_GCM
+  no_split: true
+}
+additional_decrypt_key_configs {
+  kek_infos { kek_uri: "gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/old" }
+  dek_algorithm: AES256_GCM
+  no_split: true
+}
+`
+
+func TestLoadCombinedConfigFile(t *testing.T) {
+	testcases := []struct {
+		name     string
+		filename string
+		contents string
+	}{
+		{
+			name:     "JSON",
+			filename: "stet.json",
+			contents: testCombinedConfigJSON,
+		},
+		{
+			name:     "Textproto",
+			filename: "stet.textproto",
+			contents: testCombinedConfigTextproto,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.filename)
+			if err := os.WriteFile(path, []byte(tc.contents), 0600); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			stetConfig, err := LoadCombinedConfigFile(path)
+			if err != nil {
+				t.Fatalf("LoadCombinedConfigFile returned error: %v", err)
+			}
+
+			keyConfigs := stetConfig.GetDecryptConfig().GetKeyConfigs()
+			if len(keyConfigs) != 2 {
+				t.Fatalf("DecryptConfig has %v KeyConfigs, want 2", len(keyConfigs))
+			}
+
+			if !proto.Equal(stetConfig.GetEncryptConfig().GetKeyConfig(), keyConfigs[0]) {
+				t.Errorf("EncryptConfig KeyConfig %v does not match DecryptConfig KeyConfig %v", stetConfig.GetEncryptConfig().GetKeyConfig(), keyConfigs[0])
+			}
+
+			// Blobs encrypted with the derived config should decrypt with it.
+			ctx := context.Background()
+			stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+			plaintext := []byte("This is data to be encrypted.")
+
+			var ciphertext, output bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, ""); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			if _, err := stetClient.Decrypt(ctx, &ciphertext, &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
+
+func TestParseCombinedConfigErrors(t *testing.T) {
+	testcases := []struct {
+		name   string
+		data   string
+		format ConfigFormat
+	}{
+		{
+			name:   "Invalid JSON",
+			data:   "{",
+			format: ConfigFormatJSON,
+		},
+		{
+			name:   "Invalid textproto",
+			data:   "key_config {",
+			format: ConfigFormatTextproto,
+		},
+		{
+			name:   "JSON parsed as textproto",
+			data:   testCombinedConfigJSON,
+			format: ConfigFormatTextproto,
+		},
+		{
+			name:   "Unknown format",
+			data:   testCombinedConfigJSON,
+			format: ConfigFormat(-1),
+		},
+		{
+			name:   "Missing KeyConfig",
+			data:   `{"asymmetricKeys": {}}`,
+			format: ConfigFormatJSON,
+		},
+		{
+			name:   "KeyConfig without KekInfos",
+			data:   `{"keyConfig": {"dekAlgorithm": "AES256_GCM", "noSplit": true}}`,
+			format: ConfigFormatJSON,
+		},
+		{
+			name:   "Additional KeyConfig without KekInfos",
+			data:   `key_config { kek_infos { kek_uri: "gcp-kms://key" } } additional_decrypt_key_configs { no_split: true }`,
+			format: ConfigFormatTextproto,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseCombinedConfig([]byte(tc.data), tc.format); err == nil {
+				t.Error("ParseCombinedConfig succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestLoadCombinedConfigFileUnknownExtension(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stet.yaml")
+	if err := os.WriteFile(path, []byte(testCombinedConfigJSON), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	if _, err := LoadCombinedConfigFile(path); err == nil {
+		t.Error("LoadCombinedConfigFile succeeded for a .yaml file, want error")
+	}
+}
+
+func TestStetConfigFromCombinedCopiesKeyConfigs(t *testing.T) {
+	combined := &configpb.CombinedConfig{KeyConfig: newShamirKeyConfig("key", 2, 3)}
+
+	stetConfig, err := StetConfigFromCombined(combined)
+	if err != nil {
+		t.Fatalf("StetConfigFromCombined returned error: %v", err)
+	}
+
+	// Modifying the derived EncryptConfig must not desynchronize it from the
+	// source, nor alias the DecryptConfig.
+	stetConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 3
+
+	if !proto.Equal(stetConfig.GetDecryptConfig().GetKeyConfigs()[0], combined.GetKeyConfig()) {
+		t.Error("StetConfigFromCombined returned a DecryptConfig aliasing the EncryptConfig")
+	}
+}
+
+// testSecretConfig is a malformed config containing a value that must not
+// appear in errors.
+const testSecretConfig = `key_config { kek_infos { kek_uri: SECRETVALUE } }`
+
+func TestLoadCombinedConfigEnv(t *testing.T) {
+	const envVar = "STET_TEST_COMBINED_CONFIG"
+
+	testcases := []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{
+			name:     "JSON",
+			contents: testCombinedConfigJSON,
+		},
+		{
+			name:     "Textproto",
+			contents: testCombinedConfigTextproto,
+		},
+		{
+			name:     "Malformed",
+			contents: testSecretConfig,
+			wantErr:  true,
+		},
+		{
+			name:     "Truncated JSON",
+			contents: testCombinedConfigJSON[:40],
+			wantErr:  true,
+		},
+		{
+			name:     "No KeyConfig",
+			contents: "{}",
+			wantErr:  true,
+		},
+		{
+			name:     "Empty",
+			contents: "",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(envVar, tc.contents)
+
+			stetConfig, err := LoadCombinedConfigEnv(envVar)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("LoadCombinedConfigEnv succeeded, want error")
+				}
+				if strings.Contains(err.Error(), "SECRETVALUE") {
+					t.Errorf("LoadCombinedConfigEnv returned error %q containing the config contents", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadCombinedConfigEnv returned error: %v", err)
+			}
+
+			if len(stetConfig.GetDecryptConfig().GetKeyConfigs()) != 2 {
+				t.Errorf("LoadCombinedConfigEnv returned %v decrypt KeyConfigs, want 2", len(stetConfig.GetDecryptConfig().GetKeyConfigs()))
+			}
+		})
+	}
+
+	t.Run("Unset", func(t *testing.T) {
+		if _, err := LoadCombinedConfigEnv("STET_TEST_UNSET_CONFIG"); err == nil {
+			t.Error("LoadCombinedConfigEnv succeeded with unset variable, want error")
+		}
+	})
+}
+
+func TestLoadCombinedConfigSecret(t *testing.T) {
+	ctx := context.Background()
+	const wantPath = "/v1/projects/test/secrets/stet-config/versions/latest:access"
+
+	testcases := []struct {
+		name     string
+		secret   string
+		contents string
+		badCRC   bool
+		wantErr  bool
+	}{
+		{
+			name:     "Secret version",
+			secret:   "projects/test/secrets/stet-config/versions/latest",
+			contents: testCombinedConfigTextproto,
+		},
+		{
+			name:     "Secret without version",
+			secret:   "projects/test/secrets/stet-config",
+			contents: testCombinedConfigJSON,
+		},
+		{
+			name:     "Malformed",
+			secret:   "projects/test/secrets/stet-config",
+			contents: testSecretConfig,
+			wantErr:  true,
+		},
+		{
+			name:     "Checksum mismatch",
+			secret:   "projects/test/secrets/stet-config",
+			contents: testCombinedConfigJSON,
+			badCRC:   true,
+			wantErr:  true,
+		},
+		{
+			name:     "Secret not found",
+			secret:   "projects/test/secrets/other",
+			contents: testCombinedConfigJSON,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != wantPath {
+					http.Error(w, `{"error": {"code": 404, "message": "secret not found"}}`, http.StatusNotFound)
+					return
+				}
+
+				crc := int64(crc32.Checksum([]byte(tc.contents), crc32.MakeTable(crc32.Castagnoli)))
+				if tc.badCRC {
+					crc++
+				}
+
+				json.NewEncoder(w).Encode(map[string]any{
+					"name": "projects/test/secrets/stet-config/versions/1",
+					"payload": map[string]string{
+						"data":       base64.StdEncoding.EncodeToString([]byte(tc.contents)),
+						"dataCrc32c": strconv.FormatInt(crc, 10),
+					},
+				})
+			}))
+			defer server.Close()
+
+			stetConfig, err := LoadCombinedConfigSecret(ctx, tc.secret, option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("LoadCombinedConfigSecret succeeded, want error")
+				}
+				if strings.Contains(err.Error(), "SECRETVALUE") {
+					t.Errorf("LoadCombinedConfigSecret returned error %q containing the config contents", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadCombinedConfigSecret returned error: %v", err)
+			}
+
+			if len(stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()) != 1 {
+				t.Errorf("LoadCombinedConfigSecret returned EncryptConfig %v, want one KekInfo", stetConfig.GetEncryptConfig())
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// pooledDEK is a pre-generated DEK and its unwrapped shares.
+type pooledDEK struct {
+	key    shares.DEK
+	shares [][]byte
+}
+
+// zero overwrites the DEK and its shares.
+func (d *pooledDEK) zero() {
+	d.key = shares.DEK{}
+	for _, share := range d.shares {
+		for i := range share {
+			share[i] = 0
+		}
+	}
+}
+
+// DEKPool generates DEKs and splits them into shares ahead of time for a
+// fixed KeyConfig, moving that work off the Encrypt path. Pass it to Encrypt
+// with WithDEKPool. It is safe for concurrent use.
+//
+// Each DEK is handed out to exactly one Encrypt call, so every blob still has
+// a unique DEK; if the pool is empty, the DEK is generated inline as usual.
+// Shares are still wrapped by each call, as wrapping depends on the KEKs
+// being reachable at encryption time.
+//
+// Pooled DEKs are held unwrapped in memory until used or until Close is
+// called, so a pool of `size` keeps up to `size` keys (and their shares)
+// exposed to anything that can read process memory for longer than Encrypt
+// alone would. Keep the pool small, and Close it when no longer needed.
+type DEKPool struct {
+	keyCfg *configpb.KeyConfig
+	deks   chan *pooledDEK
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewDEKPool returns a DEKPool that keeps up to `size` DEKs split according to
+// `keyCfg`, refilling it in the background.
+func NewDEKPool(keyCfg *configpb.KeyConfig, size int) (*DEKPool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("DEK pool size must be positive, got %v", size)
+	}
+
+	p := &DEKPool{
+		keyCfg: proto.Clone(keyCfg).(*configpb.KeyConfig),
+		deks:   make(chan *pooledDEK, size),
+		done:   make(chan struct{}),
+	}
+
+	// Generate the first DEK inline, so an invalid KeyConfig is reported here.
+	dek, err := p.generate()
+	if err != nil {
+		return nil, err
+	}
+	p.deks <- dek
+
+	p.wg.Add(1)
+	go p.fill()
+
+	return p, nil
+}
+
+// generate creates a new DEK and splits it into shares.
+func (p *DEKPool) generate() (*pooledDEK, error) {
+	dek := &pooledDEK{key: shares.NewDEK()}
+
+	var err error
+	dek.shares, err = shares.CreateDEKShares(dek.key, p.keyCfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating DEK shares: %v", err)
+	}
+
+	return dek, nil
+}
+
+// fill keeps the pool full until it is closed.
+func (p *DEKPool) fill() {
+	defer p.wg.Done()
+
+	for {
+		// The KeyConfig was validated by NewDEKPool, so this cannot fail.
+		dek, err := p.generate()
+		if err != nil {
+			return
+		}
+
+		select {
+		case p.deks <- dek:
+		case <-p.done:
+			dek.zero()
+			return
+		}
+	}
+}
+
+// get returns an unused DEK and its shares for `keyCfg`, which must match the
+// pool's KeyConfig. The caller should zero the DEK once done with it.
+func (p *DEKPool) get(keyCfg *configpb.KeyConfig) (*pooledDEK, error) {
+	if !proto.Equal(keyCfg, p.keyCfg) {
+		return nil, fmt.Errorf("KeyConfig does not match the DEK pool's KeyConfig")
+	}
+
+	select {
+	case <-p.done:
+		return nil, fmt.Errorf("DEK pool is closed")
+	default:
+	}
+
+	select {
+	case dek := <-p.deks:
+		return dek, nil
+	default:
+		return p.generate()
+	}
+}
+
+// Close stops refilling the pool and zeroes any unused DEKs. Encrypt calls
+// using the pool afterwards fail.
+func (p *DEKPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+
+		for {
+			select {
+			case dek := <-p.deks:
+				dek.zero()
+			default:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+func TestEncryptWithDEKPool(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(3)
+
+	pool, err := NewDEKPool(stetConfig.GetEncryptConfig().GetKeyConfig(), 2)
+	if err != nil {
+		t.Fatalf("NewDEKPool returned error: %v", err)
+	}
+	defer pool.Close()
+
+	// Encrypt more blobs than the pool holds, so some DEKs are generated inline.
+	for i := 0; i < 5; i++ {
+		plaintext := []byte(fmt.Sprintf("plaintext %v", i))
+
+		var encrypted bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &encrypted, stetConfig, "", WithDEKPool(pool)); err != nil {
+			t.Fatalf("Encrypt with DEK pool returned error: %v", err)
+		}
+
+		var decrypted bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, &encrypted, &decrypted, stetConfig); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %q, want %q", decrypted.Bytes(), plaintext)
+		}
+	}
+}
+
+func TestDEKPoolUniqueDEKs(t *testing.T) {
+	keyCfg := newFakeKMSConfig(1).GetEncryptConfig().GetKeyConfig()
+	pool, err := NewDEKPool(keyCfg, 4)
+	if err != nil {
+		t.Fatalf("NewDEKPool returned error: %v", err)
+	}
+	defer pool.Close()
+
+	seen := make(map[shares.DEK]bool)
+	for i := 0; i < 20; i++ {
+		dek, err := pool.get(keyCfg)
+		if err != nil {
+			t.Fatalf("get returned error: %v", err)
+		}
+
+		if seen[dek.key] {
+			t.Fatalf("get returned DEK %x more than once", dek.key)
+		}
+		seen[dek.key] = true
+	}
+}
+
+func TestDEKPoolErrors(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+	keyCfg := stetConfig.GetEncryptConfig().GetKeyConfig()
+
+	invalidKeyCfg := newFakeKMSConfig(2).GetEncryptConfig().GetKeyConfig()
+	invalidKeyCfg.KeySplittingAlgorithm = &configpb.KeyConfig_NoSplit{NoSplit: true}
+
+	if _, err := NewDEKPool(keyCfg, 0); err == nil {
+		t.Error("NewDEKPool with size 0 succeeded, want error")
+	}
+
+	if _, err := NewDEKPool(invalidKeyCfg, 1); err == nil {
+		t.Error("NewDEKPool with invalid KeyConfig succeeded, want error")
+	}
+
+	otherPool, err := NewDEKPool(newFakeKMSConfig(3).GetEncryptConfig().GetKeyConfig(), 1)
+	if err != nil {
+		t.Fatalf("NewDEKPool returned error: %v", err)
+	}
+	defer otherPool.Close()
+
+	closedPool, err := NewDEKPool(keyCfg, 1)
+	if err != nil {
+		t.Fatalf("NewDEKPool returned error: %v", err)
+	}
+	closedPool.Close()
+
+	testcases := []struct {
+		name string
+		pool *DEKPool
+	}{
+		{
+			name: "Mismatched KeyConfig",
+			pool: otherPool,
+		},
+		{
+			name: "Closed pool",
+			pool: closedPool,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("plaintext")), &output, stetConfig, "", WithDEKPool(tc.pool)); err == nil {
+				t.Error("Encrypt succeeded, want error")
+			}
+		})
+	}
+}
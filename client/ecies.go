@@ -0,0 +1,269 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	tinksubtle "github.com/google/tink/go/subtle"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// eciesLabel is the HKDF info prefix used to derive ECIES share wrapping keys.
+const eciesLabel = "STET ECIES share wrapping key"
+
+// eciesOverhead is the size of the nonce and tag added by AES-GCM.
+const eciesOverhead = 12 + 16
+
+// ecPrivateKeyPEMType is the PEM block type of SEC 1 EC private keys.
+const ecPrivateKeyPEMType = "EC PRIVATE KEY"
+
+// errNoECKeyForFingerprint is returned by PrivateKeyForECFingerprint when
+// none of the private keys has the KEK's fingerprint.
+var errNoECKeyForFingerprint = errors.New("no EC private key found for fingerprint")
+
+// ecCurve returns the metadata representation of an EC key's curve. Only
+// P-256 and P-384 are supported.
+func ecCurve(curve elliptic.Curve) (configpb.EcCurve, error) {
+	switch curve {
+	case elliptic.P256():
+		return configpb.EcCurve_NIST_P256, nil
+	case elliptic.P384():
+		return configpb.EcCurve_NIST_P384, nil
+	default:
+		return configpb.EcCurve_UNKNOWN_EC_CURVE, fmt.Errorf("unsupported EC curve %v, want P-256 or P-384", curve.Params().Name)
+	}
+}
+
+// ecdhCurve returns the metadata representation of an ECDH key's curve.
+func ecdhCurve(curve ecdh.Curve) configpb.EcCurve {
+	switch curve {
+	case ecdh.P256():
+		return configpb.EcCurve_NIST_P256
+	case ecdh.P384():
+		return configpb.EcCurve_NIST_P384
+	default:
+		return configpb.EcCurve_UNKNOWN_EC_CURVE
+	}
+}
+
+// PublicKeyForECFingerprint iterates through the public keys defined in
+// `keys`, searching for an EC key that matches `kek`. Keys of other types are
+// skipped. Returns an error if none matches, or if the matching key is not on
+// a supported curve.
+func PublicKeyForECFingerprint(kek *configpb.KekInfo, keys *configpb.AsymmetricKeys) (*ecdh.PublicKey, error) {
+	if len(keys.GetPublicKeyFiles()) == 0 {
+		return nil, fmt.Errorf("KEK has EC fingerprint %s, but no public key files are configured in AsymmetricKeys", kek.GetEcFingerprint())
+	}
+
+	for _, path := range keys.GetPublicKeyFiles() {
+		keyBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open public key file: %w", err)
+		}
+
+		block, _ := pem.Decode(keyBytes)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("failed to decode PEM block containing public key")
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key from PEM: %v", err)
+		}
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			continue
+		}
+
+		// Compute SHA-256 digest of the DER-encoded public key.
+		sha := sha256.Sum256(block.Bytes)
+		if base64.StdEncoding.EncodeToString(sha[:]) != kek.GetEcFingerprint() {
+			continue
+		}
+
+		if _, err := ecCurve(key.Curve); err != nil {
+			return nil, err
+		}
+
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert EC public key: %v", err)
+		}
+
+		return ecdhKey, nil
+	}
+
+	return nil, fmt.Errorf("no EC public key found for fingerprint: %s", kek.GetEcFingerprint())
+}
+
+// PrivateKeyForECFingerprint iterates through the private keys defined in
+// `keys`, searching for a PEM-encoded SEC 1 EC private key that matches
+// `kek`. Keys of other types are skipped. Returns an error if none matches,
+// or if the matching key is not on a supported curve.
+func PrivateKeyForECFingerprint(kek *configpb.KekInfo, keys *configpb.AsymmetricKeys) (*ecdh.PrivateKey, error) {
+	if len(keys.GetPrivateKeyFiles()) == 0 {
+		return nil, fmt.Errorf("KEK has EC fingerprint %s, but no private key files are configured in AsymmetricKeys", kek.GetEcFingerprint())
+	}
+
+	for _, path := range keys.GetPrivateKeyFiles() {
+		keyBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open private key file: %w", err)
+		}
+
+		block, _ := pem.Decode(keyBytes)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode PEM block containing private key")
+		}
+		if block.Type != ecPrivateKeyPEMType {
+			continue
+		}
+
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EC private key from PEM: %v", err)
+		}
+
+		// Compute SHA-256 digest of the DER-encoded public key.
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal public key from private key: %w", err)
+		}
+		sha := sha256.Sum256(der)
+		if base64.StdEncoding.EncodeToString(sha[:]) != kek.GetEcFingerprint() {
+			continue
+		}
+
+		if _, err := ecCurve(key.Curve); err != nil {
+			return nil, err
+		}
+
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert EC private key: %v", err)
+		}
+
+		return ecdhKey, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", errNoECKeyForFingerprint, kek.GetEcFingerprint())
+}
+
+// eciesKey derives the AES-256 key wrapping a share from the ECDH shared
+// secret with HKDF-SHA256 and no salt, binding it to both public keys with the
+// info eciesLabel || ephemeralPublic || recipientPublic.
+func eciesKey(secret, ephemeralPublic, recipientPublic []byte) ([]byte, error) {
+	info := make([]byte, 0, len(eciesLabel)+len(ephemeralPublic)+len(recipientPublic))
+	info = append(info, eciesLabel...)
+	info = append(info, ephemeralPublic...)
+	info = append(info, recipientPublic...)
+
+	key, err := tinksubtle.ComputeHKDF(aeadHKDFAlg, secret, nil, info, sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive ECIES key: %v", err)
+	}
+
+	return key, nil
+}
+
+// eciesWrap encrypts `share` to the EC public key, with randomness from
+// `random`. The wrapped share is the uncompressed ephemeral public key,
+// followed by the AES-256-GCM nonce and ciphertext.
+func eciesWrap(random io.Reader, pub *ecdh.PublicKey, share []byte) ([]byte, error) {
+	ephemeral, err := pub.Curve().GenerateKey(random)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral EC key: %v", err)
+	}
+
+	secret, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute ECDH shared secret: %v", err)
+	}
+
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	gcm, err := eciesAEAD(secret, ephemeralPublic, pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	wrapped := append(ephemeralPublic, nonce...)
+	return gcm.Seal(wrapped, nonce, share, nil), nil
+}
+
+// eciesUnwrap decrypts a share wrapped by eciesWrap with the EC private key.
+func eciesUnwrap(prv *ecdh.PrivateKey, wrapped []byte) ([]byte, error) {
+	// An uncompressed point is 0x04 || X || Y, each coordinate the size of
+	// the private key.
+	pointSize := 1 + 2*len(prv.Bytes())
+	if len(wrapped) < pointSize {
+		return nil, fmt.Errorf("wrapped share is too short to contain an ephemeral public key")
+	}
+
+	ephemeral, err := prv.Curve().NewPublicKey(wrapped[:pointSize])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ephemeral public key: %v", err)
+	}
+
+	secret, err := prv.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute ECDH shared secret: %v", err)
+	}
+
+	gcm, err := eciesAEAD(secret, wrapped[:pointSize], prv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	rest := wrapped[pointSize:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped share is too short to contain a nonce")
+	}
+
+	return gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+}
+
+// eciesAEAD returns the AES-256-GCM cipher keyed with eciesKey.
+func eciesAEAD(secret, ephemeralPublic, recipientPublic []byte) (cipher.AEAD, error) {
+	key, err := eciesKey(secret, ephemeralPublic, recipientPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
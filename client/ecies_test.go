@@ -0,0 +1,183 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// writeECKeyPair generates an EC keypair on `curve`, writes it to PEM files,
+// and returns the AsymmetricKeys referencing them and the key's fingerprint.
+func writeECKeyPair(t *testing.T, curve elliptic.Curve) (*configpb.AsymmetricKeys, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey returned error: %v", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey returned error: %v", err)
+	}
+
+	prvDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey returned error: %v", err)
+	}
+
+	dir := t.TempDir()
+	pubFile := filepath.Join(dir, "public.pem")
+	prvFile := filepath.Join(dir, "private.pem")
+
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+
+	if err := os.WriteFile(prvFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: prvDER}), 0600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+
+	sha := sha256.Sum256(pubDER)
+	keys := &configpb.AsymmetricKeys{PublicKeyFiles: []string{pubFile}, PrivateKeyFiles: []string{prvFile}}
+	return keys, base64.StdEncoding.EncodeToString(sha[:])
+}
+
+func newECConfig(keys *configpb.AsymmetricKeys, fingerprint string) *configpb.StetConfig {
+	keyCfg := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{{KekType: &configpb.KekInfo_EcFingerprint{EcFingerprint: fingerprint}}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+
+	return &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyCfg},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyCfg}},
+		AsymmetricKeys: keys,
+	}
+}
+
+func TestECIESRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+
+	testcases := []struct {
+		name      string
+		curve     elliptic.Curve
+		wantCurve configpb.EcCurve
+	}{
+		{
+			name:      "P-256",
+			curve:     elliptic.P256(),
+			wantCurve: configpb.EcCurve_NIST_P256,
+		},
+		{
+			name:      "P-384",
+			curve:     elliptic.P384(),
+			wantCurve: configpb.EcCurve_NIST_P384,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, fingerprint := writeECKeyPair(t, tc.curve)
+			stetConfig := newECConfig(keys, fingerprint)
+			stetClient := &StetClient{}
+
+			var metadataBuf, ciphertext bytes.Buffer
+			if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertext, stetConfig, "blob"); err != nil {
+				t.Fatalf("EncryptWithSidecar returned error: %v", err)
+			}
+
+			metadata, err := ReadMetadata(bytes.NewReader(metadataBuf.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+			if got := metadata.GetShares()[0].GetEcCurve(); got != tc.wantCurve {
+				t.Errorf("EncryptWithSidecar recorded curve %v, want %v", got, tc.wantCurve)
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadataBuf.Bytes()), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err != nil {
+				t.Fatalf("DecryptWithSidecar returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("DecryptWithSidecar returned plaintext %q, want %q", output.Bytes(), plaintext)
+			}
+
+			// A share recorded with the wrong curve is rejected.
+			forged := rewriteMetadata(t, metadataBuf.Bytes(), func(md *configpb.Metadata) {
+				md.GetShares()[0].EcCurve = configpb.EcCurve_UNKNOWN_EC_CURVE
+			})
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err == nil {
+				t.Error("DecryptWithSidecar succeeded with mismatched curve, want error")
+			}
+		})
+	}
+}
+
+func TestECIESUnsupportedCurve(t *testing.T) {
+	keys, fingerprint := writeECKeyPair(t, elliptic.P521())
+	stetConfig := newECConfig(keys, fingerprint)
+
+	var ciphertext bytes.Buffer
+	if _, err := (&StetClient{}).Encrypt(context.Background(), bytes.NewReader([]byte("data")), &ciphertext, stetConfig, "blob"); err == nil {
+		t.Error("Encrypt succeeded with a P-521 key, want error")
+	}
+
+	kek := stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[0]
+	if _, err := PrivateKeyForECFingerprint(kek, keys); err == nil {
+		t.Error("PrivateKeyForECFingerprint succeeded with a P-521 key, want error")
+	}
+}
+
+func TestECAndRSAKeysCoexist(t *testing.T) {
+	ecKeys, ecFingerprint := writeECKeyPair(t, elliptic.P256())
+	rsaKeys, rsaFingerprint := writeRSAKeyPair(t, 2048)
+	keys := &configpb.AsymmetricKeys{
+		PublicKeyFiles:  append(ecKeys.GetPublicKeyFiles(), rsaKeys.GetPublicKeyFiles()...),
+		PrivateKeyFiles: append(ecKeys.GetPrivateKeyFiles(), rsaKeys.GetPrivateKeyFiles()...),
+	}
+
+	rsaKEK := &configpb.KekInfo{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: rsaFingerprint}}
+	if _, err := PublicKeyForRSAFingerprint(rsaKEK, keys); err != nil {
+		t.Errorf("PublicKeyForRSAFingerprint returned error: %v", err)
+	}
+	if _, err := PrivateKeyForRSAFingerprint(rsaKEK, keys); err != nil {
+		t.Errorf("PrivateKeyForRSAFingerprint returned error: %v", err)
+	}
+
+	ecKEK := &configpb.KekInfo{KekType: &configpb.KekInfo_EcFingerprint{EcFingerprint: ecFingerprint}}
+	if _, err := PublicKeyForECFingerprint(ecKEK, keys); err != nil {
+		t.Errorf("PublicKeyForECFingerprint returned error: %v", err)
+	}
+	if _, err := PrivateKeyForECFingerprint(ecKEK, keys); err != nil {
+		t.Errorf("PrivateKeyForECFingerprint returned error: %v", err)
+	}
+}
@@ -12,7 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package ekmclient defines an HTTP client for contacting Confidential EKM services.
+// Package ekmclient defines HTTP and gRPC clients for contacting Confidential
+// EKM services.
 package ekmclient
 
 import (
@@ -23,9 +24,12 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/GoogleCloudPlatform/stet/client/requestid"
 	cwpb "github.com/GoogleCloudPlatform/stet/proto/confidential_wrap_go_proto"
 	sspb "github.com/GoogleCloudPlatform/stet/proto/secure_session_go_proto"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -41,14 +45,75 @@ const (
 	confidentialWrapEndpoint     = ":confidentialwrap"
 	confidentialUnwrapEndpoint   = ":confidentialunwrap"
 	tlsAlertRecord               = 21
+
+	// HTTP header used to send the caller's request ID, if any, to the EKM.
+	requestIDHeader = "X-Request-ID"
 )
 
+// HTTPTimeouts bounds the HTTPS connections of a ConfidentialEKMClient to the
+// EKM, so that an unresponsive EKM cannot hang a request indefinitely. These
+// apply to the outer HTTPS layer, not the inner TLS session tunneled through
+// it. A zero field takes its value from DefaultHTTPTimeouts, and a negative
+// one disables that timeout.
+type HTTPTimeouts struct {
+	// The maximum time to establish a TCP connection to the EKM.
+	Dial time.Duration
+	// The maximum time for the TLS handshake of the HTTPS connection.
+	TLSHandshake time.Duration
+	// The maximum time to wait for the EKM's response headers after the
+	// request has been written.
+	ResponseHeader time.Duration
+	// The interval between TCP keepalive probes on the connection.
+	KeepAlive time.Duration
+}
+
+// DefaultHTTPTimeouts are the timeouts used by a ConfidentialEKMClient for any
+// left unset in its Timeouts.
+var DefaultHTTPTimeouts = HTTPTimeouts{
+	Dial:           30 * time.Second,
+	TLSHandshake:   10 * time.Second,
+	ResponseHeader: time.Minute,
+	KeepAlive:      30 * time.Second,
+}
+
+// withDefaults returns the timeouts in `t`, with unset ones taken from
+// DefaultHTTPTimeouts and disabled ones set to zero, as net/http expects.
+func (t HTTPTimeouts) withDefaults() HTTPTimeouts {
+	resolve := func(d, def time.Duration) time.Duration {
+		switch {
+		case d == 0:
+			return def
+		case d < 0:
+			return 0
+		default:
+			return d
+		}
+	}
+
+	keepAlive := t.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultHTTPTimeouts.KeepAlive
+	}
+
+	return HTTPTimeouts{
+		Dial:           resolve(t.Dial, DefaultHTTPTimeouts.Dial),
+		TLSHandshake:   resolve(t.TLSHandshake, DefaultHTTPTimeouts.TLSHandshake),
+		ResponseHeader: resolve(t.ResponseHeader, DefaultHTTPTimeouts.ResponseHeader),
+		// net.Dialer itself disables keepalives if negative.
+		KeepAlive: keepAlive,
+	}
+}
+
 // ConfidentialEKMClient is an HTTP client that has methods for making
 // requests to a server implementing the EKM UDE protocol.
 type ConfidentialEKMClient struct {
 	URI       string
 	AuthToken string
 	CertPool  *x509.CertPool
+
+	// Timeouts of the HTTPS connections to the EKM. If unset,
+	// DefaultHTTPTimeouts apply.
+	Timeouts HTTPTimeouts
 }
 
 // NewConfidentialEKMClient constructs a new ConfidentialEKMClient against
@@ -82,6 +147,18 @@ func removeEndpointPathComponent(url string) string {
 	return url
 }
 
+// StatusError is returned by ConfidentialEKMClient when the EKM responds with
+// a non-OK HTTP status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non-OK status returned: %s - %s", e.Status, e.Body)
+}
+
 func (c ConfidentialEKMClient) post(ctx context.Context, url string, protoReq, protoResp proto.Message) error {
 	marshaled, err := protojson.Marshal(protoReq)
 	if err != nil {
@@ -99,11 +176,23 @@ func (c ConfidentialEKMClient) post(ctx context.Context, url string, protoReq, p
 		httpReq.Header.Set("Authorization", "Bearer "+c.AuthToken)
 	}
 
+	if id := requestid.FromContext(ctx); id != "" {
+		httpReq.Header.Set(requestIDHeader, id)
+	}
+
+	timeouts := c.Timeouts.withDefaults()
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Dial,
+		KeepAlive: timeouts.KeepAlive,
+	}
 	client := http.Client{
 		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
 			TLSClientConfig: &tls.Config{
 				RootCAs: c.CertPool,
 			},
+			TLSHandshakeTimeout:   timeouts.TLSHandshake,
+			ResponseHeaderTimeout: timeouts.ResponseHeader,
 		},
 	}
 
@@ -119,7 +208,7 @@ func (c ConfidentialEKMClient) post(ctx context.Context, url string, protoReq, p
 	}
 
 	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("non-OK status returned: %s - %s", httpResp.Status, string(respBody))
+		return &StatusError{StatusCode: httpResp.StatusCode, Status: httpResp.Status, Body: string(respBody)}
 	}
 
 	if err = protojson.Unmarshal(respBody, protoResp); err != nil {
@@ -17,11 +17,15 @@ package ekmclient
 import (
 	"context"
 	"crypto/x509"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 
+	"github.com/GoogleCloudPlatform/stet/client/requestid"
 	cwpb "github.com/GoogleCloudPlatform/stet/proto/confidential_wrap_go_proto"
 	sspb "github.com/GoogleCloudPlatform/stet/proto/secure_session_go_proto"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -90,6 +94,33 @@ func TestPost(t *testing.T) {
 	}
 }
 
+func TestPostWithRequestID(t *testing.T) {
+	requestID := "test-request-id"
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get(requestIDHeader); got != requestID {
+			t.Errorf("HTTP request does not have expected %s header: got %q, want %q", requestIDHeader, got, requestID)
+		}
+
+		marshaled, err := protojson.Marshal(&sspb.BeginSessionResponse{})
+		if err != nil {
+			t.Fatalf("Unable to marshal server response: %v", err)
+		}
+
+		w.Write(marshaled)
+	}))
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(ts.Certificate())
+
+	client := ConfidentialEKMClient{URI: ts.URL + placeholderEndpoint, CertPool: certPool}
+
+	ctx := requestid.NewContext(context.Background(), requestID)
+	if err := client.post(ctx, ts.URL, &sspb.BeginSessionRequest{}, &sspb.BeginSessionResponse{}); err != nil {
+		t.Fatalf("post(ctx, url, req, resp) returned error: %v", err)
+	}
+}
+
 func TestPostErrors(t *testing.T) {
 	testCases := []struct {
 		name              string
@@ -328,3 +359,140 @@ func TestSetJWTToken(t *testing.T) {
 		t.Errorf("GetJWTToken() = %s, want %s", token, expectedToken)
 	}
 }
+
+func TestHTTPTimeoutsWithDefaults(t *testing.T) {
+	testcases := []struct {
+		name     string
+		timeouts HTTPTimeouts
+		want     HTTPTimeouts
+	}{
+		{
+			name:     "Unset",
+			timeouts: HTTPTimeouts{},
+			want:     DefaultHTTPTimeouts,
+		},
+		{
+			name:     "Custom",
+			timeouts: HTTPTimeouts{Dial: time.Second, TLSHandshake: 2 * time.Second, ResponseHeader: 3 * time.Second, KeepAlive: 4 * time.Second},
+			want:     HTTPTimeouts{Dial: time.Second, TLSHandshake: 2 * time.Second, ResponseHeader: 3 * time.Second, KeepAlive: 4 * time.Second},
+		},
+		{
+			name:     "Partially set",
+			timeouts: HTTPTimeouts{Dial: time.Second},
+			want:     HTTPTimeouts{Dial: time.Second, TLSHandshake: DefaultHTTPTimeouts.TLSHandshake, ResponseHeader: DefaultHTTPTimeouts.ResponseHeader, KeepAlive: DefaultHTTPTimeouts.KeepAlive},
+		},
+		{
+			name:     "Disabled",
+			timeouts: HTTPTimeouts{Dial: -1, TLSHandshake: -1, ResponseHeader: -1, KeepAlive: -1},
+			want:     HTTPTimeouts{KeepAlive: -1},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.timeouts.withDefaults(); got != tc.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// isTimeout returns whether `err` is from a network operation timing out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestPostDialTimeout(t *testing.T) {
+	const dialTimeout = 100 * time.Millisecond
+
+	// An address in a private range that is not routed, so that connecting
+	// to it hangs until the dial timeout.
+	client := &ConfidentialEKMClient{
+		URI:      "https://10.255.255.1" + placeholderEndpoint,
+		Timeouts: HTTPTimeouts{Dial: dialTimeout},
+	}
+
+	start := time.Now()
+	_, err := client.BeginSession(context.Background(), &sspb.BeginSessionRequest{})
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("BeginSession with an unroutable address succeeded, want error")
+	}
+	if !isTimeout(err) && elapsed < dialTimeout {
+		t.Skipf("Address is reachable or rejected in this environment: %v", err)
+	}
+
+	if !isTimeout(err) || !strings.Contains(err.Error(), "dial") {
+		t.Errorf("BeginSession returned error %v, want a dial timeout", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("BeginSession took %v to fail, want about the dial timeout", elapsed)
+	}
+}
+
+func TestPostTLSHandshakeTimeout(t *testing.T) {
+	// A server that accepts connections, but never completes a handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer listener.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+
+	client := &ConfidentialEKMClient{
+		URI:      "https://" + listener.Addr().String() + placeholderEndpoint,
+		Timeouts: HTTPTimeouts{TLSHandshake: 100 * time.Millisecond},
+	}
+
+	start := time.Now()
+	if _, err := client.BeginSession(context.Background(), &sspb.BeginSessionRequest{}); !isTimeout(err) {
+		t.Errorf("BeginSession with an unresponsive server returned error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("BeginSession took %v to fail, want about the TLS handshake timeout", elapsed)
+	}
+}
+
+func TestPostResponseHeaderTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(ts.Certificate())
+
+	client := &ConfidentialEKMClient{
+		URI:      ts.URL + placeholderEndpoint,
+		CertPool: certPool,
+		Timeouts: HTTPTimeouts{ResponseHeader: 100 * time.Millisecond},
+	}
+
+	start := time.Now()
+	if _, err := client.BeginSession(context.Background(), &sspb.BeginSessionRequest{}); err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("BeginSession with a slow server returned error %v, want a response header timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("BeginSession took %v to fail, want about the response header timeout", elapsed)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ekmclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/GoogleCloudPlatform/stet/client/requestid"
+	cwpb "github.com/GoogleCloudPlatform/stet/proto/confidential_wrap_go_proto"
+	sspb "github.com/GoogleCloudPlatform/stet/proto/secure_session_go_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// GRPCScheme is the URI scheme of EKMs that expose the secure session
+	// and confidential wrap services over gRPC, rather than HTTP.
+	GRPCScheme = "grpcs"
+
+	// Default port for gRPC EKMs, if none is given in the URI.
+	defaultGRPCPort = "443"
+
+	// gRPC metadata keys used to send the auth token and request ID.
+	authorizationMetadataKey = "authorization"
+	requestIDMetadataKey     = "x-request-id"
+)
+
+// bearerToken implements credentials.PerRPCCredentials to authenticate gRPC
+// requests to the EKM with a bearer token.
+type bearerToken struct {
+	token string
+}
+
+func (t bearerToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{
+		authorizationMetadataKey: "Bearer " + t.token,
+	}, nil
+}
+
+func (bearerToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// GRPCEKMClient is a gRPC client that has methods for making requests to a
+// server implementing the EKM UDE protocol over gRPC. It carries the same
+// messages as ConfidentialEKMClient, and should be closed once the session is
+// over.
+type GRPCEKMClient struct {
+	conn          *grpc.ClientConn
+	sessionClient sspb.ConfidentialEkmSessionEstablishmentServiceClient
+	wrapClient    cwpb.ConfidentialWrapUnwrapServiceClient
+}
+
+// NewGRPCEKMClient constructs a new GRPCEKMClient for the EKM key with the
+// given grpcs:// URI. The connection is secured with TLS, validated against
+// certPool if set, or the system roots otherwise. If authToken is set, it is
+// sent as a bearer token with each request.
+func NewGRPCEKMClient(uri, authToken string, certPool *x509.CertPool) (*GRPCEKMClient, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse EKM URI: %v", err)
+	}
+
+	if u.Scheme != GRPCScheme {
+		return nil, fmt.Errorf("EKM URI has scheme %q, want %q", u.Scheme, GRPCScheme)
+	}
+
+	target := u.Host
+	if u.Port() == "" {
+		target = net.JoinHostPort(u.Hostname(), defaultGRPCPort)
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: certPool})),
+	}
+
+	if authToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken{authToken}))
+	}
+
+	return newGRPCEKMClient(target, opts...)
+}
+
+func newGRPCEKMClient(target string, opts ...grpc.DialOption) (*GRPCEKMClient, error) {
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to EKM at %v: %v", target, err)
+	}
+
+	return &GRPCEKMClient{
+		conn:          conn,
+		sessionClient: sspb.NewConfidentialEkmSessionEstablishmentServiceClient(conn),
+		wrapClient:    cwpb.NewConfidentialWrapUnwrapServiceClient(conn),
+	}, nil
+}
+
+// Close closes the connection to the EKM.
+func (c *GRPCEKMClient) Close() error {
+	return c.conn.Close()
+}
+
+// outgoingContext adds the caller's request ID, if any, to the request metadata.
+func outgoingContext(ctx context.Context) context.Context {
+	if id := requestid.FromContext(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, id)
+	}
+
+	return ctx
+}
+
+func (c *GRPCEKMClient) BeginSession(ctx context.Context, req *sspb.BeginSessionRequest) (*sspb.BeginSessionResponse, error) {
+	resp, err := c.sessionClient.BeginSession(outgoingContext(ctx), req)
+	if err != nil {
+		return nil, fmt.Errorf("BeginSession RPC returned with error: %w", err)
+	}
+
+	if records := resp.GetTlsRecords(); len(records) > 0 && records[0] == tlsAlertRecord {
+		return resp, fmt.Errorf("TLS alert in response: %s", hex.EncodeToString(records))
+	}
+
+	return resp, nil
+}
+
+func (c *GRPCEKMClient) Handshake(ctx context.Context, req *sspb.HandshakeRequest) (*sspb.HandshakeResponse, error) {
+	resp, err := c.sessionClient.Handshake(outgoingContext(ctx), req)
+	if err != nil {
+		return nil, fmt.Errorf("Handshake RPC returned with error: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (c *GRPCEKMClient) NegotiateAttestation(ctx context.Context, req *sspb.NegotiateAttestationRequest) (*sspb.NegotiateAttestationResponse, error) {
+	resp, err := c.sessionClient.NegotiateAttestation(outgoingContext(ctx), req)
+	if err != nil {
+		return nil, fmt.Errorf("NegotiateAttestation RPC returned with error: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (c *GRPCEKMClient) Finalize(ctx context.Context, req *sspb.FinalizeRequest) (*sspb.FinalizeResponse, error) {
+	resp, err := c.sessionClient.Finalize(outgoingContext(ctx), req)
+	if err != nil {
+		return nil, fmt.Errorf("Finalize RPC returned with error: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (c *GRPCEKMClient) EndSession(ctx context.Context, req *sspb.EndSessionRequest) (*sspb.EndSessionResponse, error) {
+	resp, err := c.sessionClient.EndSession(outgoingContext(ctx), req)
+	if err != nil {
+		return nil, fmt.Errorf("EndSession RPC returned with error: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (c *GRPCEKMClient) ConfidentialWrap(ctx context.Context, req *cwpb.ConfidentialWrapRequest) (*cwpb.ConfidentialWrapResponse, error) {
+	resp, err := c.wrapClient.ConfidentialWrap(outgoingContext(ctx), req)
+	if err != nil {
+		return nil, fmt.Errorf("ConfidentialWrap RPC returned with error: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (c *GRPCEKMClient) ConfidentialUnwrap(ctx context.Context, req *cwpb.ConfidentialUnwrapRequest) (*cwpb.ConfidentialUnwrapResponse, error) {
+	resp, err := c.wrapClient.ConfidentialUnwrap(outgoingContext(ctx), req)
+	if err != nil {
+		return nil, fmt.Errorf("ConfidentialUnwrap RPC returned with error: %w", err)
+	}
+
+	return resp, nil
+}
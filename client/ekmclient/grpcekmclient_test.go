@@ -0,0 +1,195 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ekmclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/requestid"
+	cwpb "github.com/GoogleCloudPlatform/stet/proto/confidential_wrap_go_proto"
+	sspb "github.com/GoogleCloudPlatform/stet/proto/secure_session_go_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+const testGRPCToken = "test token"
+
+// fakeGRPCEKM is a fake gRPC EKM that checks the auth token of each request,
+// and echoes back the TLS records and request ID it receives.
+type fakeGRPCEKM struct {
+	sspb.UnimplementedConfidentialEkmSessionEstablishmentServiceServer
+	cwpb.UnimplementedConfidentialWrapUnwrapServiceServer
+}
+
+func (fakeGRPCEKM) checkMetadata(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if got := md.Get(authorizationMetadataKey); len(got) != 1 || got[0] != "Bearer "+testGRPCToken {
+		return "", fmt.Errorf("got authorization metadata %v, want %q", got, "Bearer "+testGRPCToken)
+	}
+
+	if ids := md.Get(requestIDMetadataKey); len(ids) == 1 {
+		return ids[0], nil
+	}
+
+	return "", nil
+}
+
+func (f fakeGRPCEKM) BeginSession(ctx context.Context, req *sspb.BeginSessionRequest) (*sspb.BeginSessionResponse, error) {
+	id, err := f.checkMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sspb.BeginSessionResponse{SessionContext: []byte(id), TlsRecords: req.GetTlsRecords()}, nil
+}
+
+func (f fakeGRPCEKM) Handshake(ctx context.Context, req *sspb.HandshakeRequest) (*sspb.HandshakeResponse, error) {
+	if _, err := f.checkMetadata(ctx); err != nil {
+		return nil, err
+	}
+
+	return &sspb.HandshakeResponse{TlsRecords: req.GetTlsRecords()}, nil
+}
+
+func (f fakeGRPCEKM) ConfidentialWrap(ctx context.Context, req *cwpb.ConfidentialWrapRequest) (*cwpb.ConfidentialWrapResponse, error) {
+	if _, err := f.checkMetadata(ctx); err != nil {
+		return nil, err
+	}
+
+	return &cwpb.ConfidentialWrapResponse{TlsRecords: req.GetTlsRecords()}, nil
+}
+
+// startFakeGRPCEKM starts a fake gRPC EKM over TLS, returning its grpcs://
+// key URI and a cert pool that trusts it.
+func startFakeGRPCEKM(t *testing.T) (string, *x509.CertPool) {
+	t.Helper()
+
+	// Borrow a certificate for 127.0.0.1 from httptest.
+	certServer := httptest.NewTLSServer(nil)
+	cert := certServer.TLS.Certificates[0]
+	pool := x509.NewCertPool()
+	pool.AddCert(certServer.Certificate())
+	certServer.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen returned error: %v", err)
+	}
+
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	sspb.RegisterConfidentialEkmSessionEstablishmentServiceServer(server, fakeGRPCEKM{})
+	cwpb.RegisterConfidentialWrapUnwrapServiceServer(server, fakeGRPCEKM{})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	return fmt.Sprintf("grpcs://%v/v0/keys/key1", lis.Addr()), pool
+}
+
+func TestGRPCEKMClient(t *testing.T) {
+	uri, pool := startFakeGRPCEKM(t)
+	records := []byte("test records")
+
+	client, err := NewGRPCEKMClient(uri, testGRPCToken, pool)
+	if err != nil {
+		t.Fatalf("NewGRPCEKMClient returned error: %v", err)
+	}
+	defer client.Close()
+
+	ctx := requestid.NewContext(context.Background(), "request-1")
+
+	beginResp, err := client.BeginSession(ctx, &sspb.BeginSessionRequest{TlsRecords: records})
+	if err != nil {
+		t.Fatalf("BeginSession returned error: %v", err)
+	}
+
+	if !bytes.Equal(beginResp.GetTlsRecords(), records) {
+		t.Errorf("BeginSession returned TLS records %q, want %q", beginResp.GetTlsRecords(), records)
+	}
+
+	if string(beginResp.GetSessionContext()) != "request-1" {
+		t.Errorf("BeginSession sent request ID %q, want %q", beginResp.GetSessionContext(), "request-1")
+	}
+
+	handshakeResp, err := client.Handshake(ctx, &sspb.HandshakeRequest{TlsRecords: records})
+	if err != nil {
+		t.Fatalf("Handshake returned error: %v", err)
+	}
+
+	if !bytes.Equal(handshakeResp.GetTlsRecords(), records) {
+		t.Errorf("Handshake returned TLS records %q, want %q", handshakeResp.GetTlsRecords(), records)
+	}
+
+	wrapResp, err := client.ConfidentialWrap(ctx, &cwpb.ConfidentialWrapRequest{TlsRecords: records})
+	if err != nil {
+		t.Fatalf("ConfidentialWrap returned error: %v", err)
+	}
+
+	if !bytes.Equal(wrapResp.GetTlsRecords(), records) {
+		t.Errorf("ConfidentialWrap returned TLS records %q, want %q", wrapResp.GetTlsRecords(), records)
+	}
+}
+
+func TestGRPCEKMClientErrors(t *testing.T) {
+	uri, pool := startFakeGRPCEKM(t)
+
+	t.Run("Wrong token", func(t *testing.T) {
+		client, err := NewGRPCEKMClient(uri, "wrong token", pool)
+		if err != nil {
+			t.Fatalf("NewGRPCEKMClient returned error: %v", err)
+		}
+		defer client.Close()
+
+		if _, err := client.BeginSession(context.Background(), &sspb.BeginSessionRequest{}); err == nil {
+			t.Error("BeginSession succeeded with the wrong token, want error")
+		}
+	})
+
+	t.Run("Untrusted server certificate", func(t *testing.T) {
+		client, err := NewGRPCEKMClient(uri, testGRPCToken, x509.NewCertPool())
+		if err != nil {
+			t.Fatalf("NewGRPCEKMClient returned error: %v", err)
+		}
+		defer client.Close()
+
+		if _, err := client.BeginSession(context.Background(), &sspb.BeginSessionRequest{}); err == nil {
+			t.Error("BeginSession succeeded with an untrusted server, want error")
+		}
+	})
+
+	t.Run("Unimplemented RPC", func(t *testing.T) {
+		client, err := NewGRPCEKMClient(uri, testGRPCToken, pool)
+		if err != nil {
+			t.Fatalf("NewGRPCEKMClient returned error: %v", err)
+		}
+		defer client.Close()
+
+		if _, err := client.Finalize(context.Background(), &sspb.FinalizeRequest{}); err == nil {
+			t.Error("Finalize succeeded against a server without it, want error")
+		}
+	})
+
+	t.Run("HTTPS URI", func(t *testing.T) {
+		if _, err := NewGRPCEKMClient("https://127.0.0.1/v0/keys/key1", testGRPCToken, pool); err == nil {
+			t.Error("NewGRPCEKMClient succeeded with an https:// URI, want error")
+		}
+	})
+}
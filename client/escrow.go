@@ -0,0 +1,213 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// ErrDEKExportNotAllowed is returned by ExportDEK unless the StetClient's
+// AllowDEKExport is set.
+var ErrDEKExportNotAllowed = errors.New("DEK export is not allowed by the client")
+
+// dekExportLabel is the RSA-OAEP label of DEKs exported to RSA keys, so that
+// they cannot be confused with wrapped shares.
+const dekExportLabel = "STET exported DEK"
+
+// ExportedDEK is the DEK of a STET-encrypted blob wrapped to a recipient's
+// public key by ExportDEK, together with the blob's metadata, so that the
+// holder of the recipient's private key can decrypt the blob's ciphertext
+// with DecryptWithExportedDEK without access to any of its KEKs.
+type ExportedDEK struct {
+	// The metadata of the blob. It is bound into the AAD of the ciphertext,
+	// so decryption fails if it does not match the blob.
+	Metadata *configpb.Metadata
+	// The DEK, wrapped with RSA-OAEP for RSA recipients, or ECIES as for EC
+	// KEKs for EC recipients.
+	WrappedDEK []byte
+	// The SHA-256 fingerprint of the recipient's public key, in the format
+	// of RSA and EC KEK fingerprints.
+	RecipientFingerprint string
+}
+
+// recipientFingerprint returns the fingerprint of the public key `pub`.
+func recipientFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal recipient public key: %v", err)
+	}
+
+	sha := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sha[:]), nil
+}
+
+// wrapExportedDEK wraps `dek` to the recipient public key, which must be an
+// RSA key, or an EC key on a curve supported for EC KEKs, with randomness
+// from `random`.
+func wrapExportedDEK(random io.Reader, dek shares.DEK, recipient crypto.PublicKey, fips bool) ([]byte, error) {
+	switch pub := recipient.(type) {
+	case *rsa.PublicKey:
+		if fips {
+			if err := checkFIPSRSAKey(pub); err != nil {
+				return nil, err
+			}
+		}
+
+		return rsa.EncryptOAEP(sha256.New(), random, pub, dek[:], []byte(dekExportLabel))
+	case *ecdsa.PublicKey:
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC recipient public key: %v", err)
+		}
+
+		return wrapExportedDEK(random, dek, ecdhPub, fips)
+	case *ecdh.PublicKey:
+		if ecdhCurve(pub.Curve()) == configpb.EcCurve_UNKNOWN_EC_CURVE {
+			return nil, fmt.Errorf("unsupported EC recipient curve, want P-256 or P-384")
+		}
+
+		return eciesWrap(random, pub, dek[:])
+	default:
+		return nil, fmt.Errorf("unsupported recipient public key type %T, want RSA or EC", recipient)
+	}
+}
+
+// unwrapExportedDEK is the inverse of wrapExportedDEK, with the recipient's
+// private key.
+func unwrapExportedDEK(wrapped []byte, recipient crypto.PrivateKey) (shares.DEK, error) {
+	var dek []byte
+	var err error
+	switch prv := recipient.(type) {
+	case *rsa.PrivateKey:
+		dek, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, prv, wrapped, []byte(dekExportLabel))
+	case *ecdsa.PrivateKey:
+		ecdhPrv, err := prv.ECDH()
+		if err != nil {
+			return shares.DEK{}, fmt.Errorf("invalid EC recipient private key: %v", err)
+		}
+
+		return unwrapExportedDEK(wrapped, ecdhPrv)
+	case *ecdh.PrivateKey:
+		dek, err = eciesUnwrap(prv, wrapped)
+	default:
+		return shares.DEK{}, fmt.Errorf("unsupported recipient private key type %T, want RSA or EC", recipient)
+	}
+	if err != nil {
+		return shares.DEK{}, fmt.Errorf("error unwrapping exported DEK: %v", err)
+	}
+
+	var key shares.DEK
+	if len(dek) != len(key) {
+		return shares.DEK{}, fmt.Errorf("exported DEK is %v bytes, want %v", len(dek), len(key))
+	}
+	copy(key[:], dek)
+
+	return key, nil
+}
+
+// ExportDEK reconstructs the DEK of the STET-encrypted blob read from `input`
+// as Decrypt does, and returns it wrapped to the `recipient` public key, which
+// must be an *rsa.PublicKey, or an *ecdsa.PublicKey or *ecdh.PublicKey on
+// P-256 or P-384. This supports authorized key escrow and recovery: the
+// holder of the recipient's private key can then decrypt the blob with
+// DecryptWithExportedDEK. Only the metadata is read from `input`, and the
+// ciphertext is never decrypted.
+//
+// SECURITY: the exported DEK decrypts the blob without any of its KEKs, so it
+// bypasses every control they enforce, including KEK access policies,
+// revocation, key destruction, EKM attestation, and the audit logs of Cloud
+// KMS and external EKMs. Anyone with the recipient's private key can decrypt
+// the blob for as long as the exported DEK exists. Only export to keys that
+// are protected at least as well as the blob's KEKs. For this reason, it
+// returns ErrDEKExportNotAllowed unless the client's AllowDEKExport is set,
+// and logs a warning for each export.
+func (c *StetClient) ExportDEK(ctx context.Context, input io.Reader, stetConfig *configpb.StetConfig, recipient crypto.PublicKey, opts ...CallOption) (*ExportedDEK, error) {
+	if !c.AllowDEKExport {
+		return nil, ErrDEKExportNotAllowed
+	}
+
+	callOpts := c.newCallOptions(opts)
+
+	fingerprint, err := recipientFingerprint(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := ReadMetadata(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	dek, _, err := c.recoverDEK(ctx, metadata, stetConfig, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := wrapExportedDEK(callOpts.random(), dek, recipient, c.FIPSMode)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping DEK to recipient key: %w", err)
+	}
+
+	c.logger(ctx).Warningf("Exported DEK of blob %q to recipient public key with fingerprint %v.", metadata.GetBlobId(), fingerprint)
+
+	return &ExportedDEK{
+		Metadata:             metadata,
+		WrappedDEK:           wrapped,
+		RecipientFingerprint: fingerprint,
+	}, nil
+}
+
+// DecryptWithExportedDEK decrypts the ciphertext of the blob whose DEK was
+// exported by ExportDEK, with the recipient's private key, which must be an
+// *rsa.PrivateKey, *ecdsa.PrivateKey or *ecdh.PrivateKey. As with
+// DecryptWithMetadata, only the ciphertext is read from `ciphertextInput`, as
+// the metadata is part of the exported DEK. No KEKs are used.
+func DecryptWithExportedDEK(exported *ExportedDEK, recipient crypto.PrivateKey, ciphertextInput io.Reader, output io.Writer) (*StetMetadata, error) {
+	if exported == nil || exported.Metadata == nil {
+		return nil, fmt.Errorf("exported DEK has no blob metadata")
+	}
+
+	segmentSize, err := metadataSegmentSize(exported.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := unwrapExportedDEK(exported.WrappedDEK, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	if commitment := exported.Metadata.GetKeyCommitment(); len(commitment) != 0 {
+		if err := checkKeyCommitment(dek, commitment); err != nil {
+			return nil, err
+		}
+	}
+
+	return decryptWithDEK(exported.Metadata, dek, nil, segmentSize, 0, ciphertextInput, output, nil)
+}
@@ -0,0 +1,218 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+)
+
+// encryptSidecar encrypts `plaintext`, returning the header and metadata, and
+// the ciphertext separately.
+func encryptSidecar(t *testing.T, stetClient *StetClient, plaintext []byte) ([]byte, []byte) {
+	t.Helper()
+
+	var metadata, ciphertext bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(context.Background(), bytes.NewReader(plaintext), &metadata, &ciphertext, newFakeKMSConfig(2), ""); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	return metadata.Bytes(), ciphertext.Bytes()
+}
+
+func TestExportDEK(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	stetConfig := newFakeKMSConfig(2)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey returned error: %v", err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey returned error: %v", err)
+	}
+	ecdhKey, err := ecdh.P384().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdh.GenerateKey returned error: %v", err)
+	}
+
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, AllowDEKExport: true}
+	metadata, ciphertext := encryptSidecar(t, stetClient, plaintext)
+
+	testcases := []struct {
+		name       string
+		recipient  crypto.PublicKey
+		privateKey crypto.PrivateKey
+	}{
+		{
+			name:       "RSA",
+			recipient:  &rsaKey.PublicKey,
+			privateKey: rsaKey,
+		},
+		{
+			name:       "ECDSA P-256",
+			recipient:  &ecdsaKey.PublicKey,
+			privateKey: ecdsaKey,
+		},
+		{
+			name:       "ECDH P-384",
+			recipient:  ecdhKey.PublicKey(),
+			privateKey: ecdhKey,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			exported, err := stetClient.ExportDEK(ctx, bytes.NewReader(metadata), stetConfig, tc.recipient)
+			if err != nil {
+				t.Fatalf("ExportDEK returned error: %v", err)
+			}
+
+			wantFingerprint, err := recipientFingerprint(tc.recipient)
+			if err != nil {
+				t.Fatalf("recipientFingerprint returned error: %v", err)
+			}
+			if exported.RecipientFingerprint != wantFingerprint {
+				t.Errorf("ExportDEK returned recipient fingerprint %v, want %v", exported.RecipientFingerprint, wantFingerprint)
+			}
+
+			// The recipient needs no access to the blob's KEKs.
+			var output bytes.Buffer
+			md, err := DecryptWithExportedDEK(exported, tc.privateKey, bytes.NewReader(ciphertext), &output)
+			if err != nil {
+				t.Fatalf("DecryptWithExportedDEK returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("DecryptWithExportedDEK returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+			if md.BlobID != exported.Metadata.GetBlobId() {
+				t.Errorf("DecryptWithExportedDEK returned blob ID %v, want %v", md.BlobID, exported.Metadata.GetBlobId())
+			}
+		})
+	}
+}
+
+func TestExportDEKRand(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	stetConfig := newFakeKMSConfig(2)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey returned error: %v", err)
+	}
+	ecdhKey, err := ecdh.P384().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdh.GenerateKey returned error: %v", err)
+	}
+
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, AllowDEKExport: true}
+	metadata, _ := encryptSidecar(t, stetClient, plaintext)
+
+	// Wrapping the exported DEK must draw on the client's Rand, so running
+	// out of it fails the export.
+	stetClient.Rand = bytes.NewReader(nil)
+	for _, tc := range []struct {
+		name      string
+		recipient crypto.PublicKey
+	}{
+		{name: "RSA", recipient: &rsaKey.PublicKey},
+		{name: "ECDH P-384", recipient: ecdhKey.PublicKey()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := stetClient.ExportDEK(ctx, bytes.NewReader(metadata), stetConfig, tc.recipient); err == nil {
+				t.Error("ExportDEK succeeded with an exhausted Rand, want error")
+			}
+		})
+	}
+}
+
+func TestExportDEKErrors(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	stetConfig := newFakeKMSConfig(2)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey returned error: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey returned error: %v", err)
+	}
+	p521Key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey returned error: %v", err)
+	}
+
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, AllowDEKExport: true}
+	metadata, ciphertext := encryptSidecar(t, stetClient, plaintext)
+	_, otherCiphertext := encryptSidecar(t, stetClient, plaintext)
+
+	t.Run("Not allowed", func(t *testing.T) {
+		noExport := &StetClient{KMSClient: &stettest.FakeKMS{}}
+		if _, err := noExport.ExportDEK(ctx, bytes.NewReader(metadata), stetConfig, &rsaKey.PublicKey); !errors.Is(err, ErrDEKExportNotAllowed) {
+			t.Errorf("ExportDEK returned error %v, want %v", err, ErrDEKExportNotAllowed)
+		}
+	})
+
+	t.Run("Unsupported curve", func(t *testing.T) {
+		if _, err := stetClient.ExportDEK(ctx, bytes.NewReader(metadata), stetConfig, &p521Key.PublicKey); err == nil {
+			t.Error("ExportDEK succeeded with P-521 recipient, want error")
+		}
+	})
+
+	t.Run("Unknown KeyConfig", func(t *testing.T) {
+		if _, err := stetClient.ExportDEK(ctx, bytes.NewReader(metadata), newFakeKMSConfig(3), &rsaKey.PublicKey); err == nil {
+			t.Error("ExportDEK succeeded without a matching KeyConfig, want error")
+		}
+	})
+
+	exported, err := stetClient.ExportDEK(ctx, bytes.NewReader(metadata), stetConfig, &rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("ExportDEK returned error: %v", err)
+	}
+
+	t.Run("Wrong recipient key", func(t *testing.T) {
+		if _, err := DecryptWithExportedDEK(exported, otherKey, bytes.NewReader(ciphertext), &bytes.Buffer{}); err == nil {
+			t.Error("DecryptWithExportedDEK succeeded with the wrong private key, want error")
+		}
+	})
+
+	t.Run("Other blob", func(t *testing.T) {
+		if _, err := DecryptWithExportedDEK(exported, rsaKey, bytes.NewReader(otherCiphertext), &bytes.Buffer{}); err == nil {
+			t.Error("DecryptWithExportedDEK succeeded with the ciphertext of another blob, want error")
+		}
+	})
+
+	t.Run("No metadata", func(t *testing.T) {
+		if _, err := DecryptWithExportedDEK(&ExportedDEK{WrappedDEK: exported.WrappedDEK}, rsaKey, bytes.NewReader(ciphertext), &bytes.Buffer{}); err == nil {
+			t.Error("DecryptWithExportedDEK succeeded without metadata, want error")
+		}
+	})
+}
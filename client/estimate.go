@@ -0,0 +1,147 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/uuid"
+)
+
+// maxWrapOverhead bounds how many bytes longer than a share its wrapped form
+// is, for KEKs whose ciphertext format is opaque to STET: Cloud KMS keys,
+// external keys wrapped by an EKM, and Tink keysets.
+const maxWrapOverhead = 256
+
+// EstimateBlobSize returns an upper bound on the size of the blob written by
+// Encrypt for a plaintext of `plaintextSize` bytes with the given
+// EncryptConfig and no CallOptions, including the STET header, the metadata
+// and the ciphertext. It makes no requests: shares wrapped with RSA keys are
+// sized exactly from the public keys in `keys`, while those wrapped with Cloud
+// KMS keys, external keys or Tink keysets are assumed to grow by at most
+// maxWrapOverhead bytes. The blob ID is assumed to be no longer than the UUIDs
+// generated by Encrypt.
+func EstimateBlobSize(plaintextSize int64, config *configpb.EncryptConfig, keys *configpb.AsymmetricKeys) (int64, error) {
+	if plaintextSize < 0 {
+		return 0, fmt.Errorf("plaintext size %v is negative", plaintextSize)
+	}
+
+	if config == nil {
+		return 0, fmt.Errorf("nil EncryptConfig passed to EstimateBlobSize()")
+	}
+
+	keyCfg := config.GetKeyConfig()
+	dekShares, err := shares.CreateDEKShares(shares.DEK{}, keyCfg)
+	if err != nil {
+		return 0, fmt.Errorf("error creating DEK shares: %v", err)
+	}
+
+	// Build metadata with placeholder fields of the maximum size, so that its
+	// serialized size bounds that of the real metadata.
+	scheme, err := splitScheme(keyCfg)
+	if err != nil {
+		return 0, err
+	}
+
+	metadata := &configpb.Metadata{
+		BlobId:    uuid.Nil.String(),
+		KeyConfig: keyCfg,
+	}
+
+	// Blobs of newer format versions also record the AAD version, salt and
+	// split scheme.
+	formatVersion, err := encryptFormatVersion(keyCfg, &callOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if formatVersion >= FormatVersion2 {
+		metadata.AadVersion = aadVersion
+		metadata.AadSalt = make([]byte, aadSaltBytes)
+		metadata.SplitScheme = scheme
+	}
+
+	for i, kek := range keyCfg.GetKekInfos() {
+		size, err := maxWrappedShareSize(len(dekShares[i]), kek, keys)
+		if err != nil {
+			return 0, fmt.Errorf("error estimating the size of share #%v wrapped with %v: %v", i+1, kekDescription(kek), err)
+		}
+
+		wrapped := &configpb.WrappedShare{
+			Share:    make([]byte, size),
+			Hash:     shares.HashShare(dekShares[i]),
+			KekIndex: int64(i + 1),
+		}
+		if kek.GetBackupKekUri() != "" {
+			wrapped.BackupShare = make([]byte, len(dekShares[i])+maxWrapOverhead)
+		}
+
+		metadata.Shares = append(metadata.Shares, wrapped)
+	}
+
+	metadataBytes, err := marshalMetadata(metadata)
+	if err != nil {
+		return 0, fmt.Errorf("failed to serialize metadata: %v", err)
+	}
+
+	headerSize := int64(binary.Size(STETHeader{}))
+	return headerSize + int64(len(metadataBytes)) + ciphertextSize(plaintextSize, aeadSegmentSize), nil
+}
+
+// maxWrappedShareSize returns an upper bound on the size of a share of
+// `shareSize` bytes once wrapped with `kek`.
+func maxWrappedShareSize(shareSize int, kek *configpb.KekInfo, keys *configpb.AsymmetricKeys) (int, error) {
+	switch x := kek.KekType.(type) {
+	case *configpb.KekInfo_RsaFingerprint:
+		key, err := PublicKeyForRSAFingerprint(kek, keys)
+		if err != nil {
+			return 0, err
+		}
+
+		// RSA-OAEP ciphertexts are the size of the modulus.
+		return key.Size(), nil
+
+	case *configpb.KekInfo_EcFingerprint:
+		key, err := PublicKeyForECFingerprint(kek, keys)
+		if err != nil {
+			return 0, err
+		}
+
+		// ECIES prepends the ephemeral public key to the AES-GCM ciphertext.
+		return len(key.Bytes()) + shareSize + eciesOverhead, nil
+
+	case *configpb.KekInfo_KekUri, *configpb.KekInfo_TinkKeyset:
+		return shareSize + maxWrapOverhead, nil
+
+	default:
+		return 0, fmt.Errorf("unsupported KekInfo type: %v", x)
+	}
+}
+
+// ciphertextSize returns the size of the streaming AEAD ciphertext of a
+// plaintext of `plaintextSize` bytes, with segments of `segmentSize` bytes.
+// Every segment carries a tag, so even an empty plaintext has one.
+func ciphertextSize(plaintextSize, segmentSize int64) int64 {
+	segments := int64(1)
+	firstCapacity := segmentSize - aeadFirstSegmentOffset - aeadHeaderSize - aeadTagSize
+	if rest := plaintextSize - firstCapacity; rest > 0 {
+		capacity := segmentSize - aeadTagSize
+		segments += (rest + capacity - 1) / capacity
+	}
+
+	return aeadHeaderSize + plaintextSize + segments*aeadTagSize
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+func TestEstimateBlobSize(t *testing.T) {
+	rsaKeys, rsaFingerprint := writeRSAKeyPair(t, 2048)
+	rsaConfig := &configpb.StetConfig{
+		EncryptConfig: &configpb.EncryptConfig{
+			KeyConfig: &configpb.KeyConfig{
+				KekInfos:              []*configpb.KekInfo{{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: rsaFingerprint}}},
+				DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+				KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+			},
+		},
+		AsymmetricKeys: rsaKeys,
+	}
+
+	firstCapacity := int64(aeadFirstSegmentSize - aeadTagSize)
+	capacity := int64(aeadSegmentSize - aeadTagSize)
+
+	testcases := []struct {
+		name      string
+		config    *configpb.StetConfig
+		exact     bool
+		sizes     []int64
+		maxExcess int64
+	}{
+		{
+			name:   "RSA key",
+			config: rsaConfig,
+			exact:  true,
+			sizes:  []int64{0, 1, firstCapacity, firstCapacity + 1, firstCapacity + capacity, firstCapacity + capacity + 1},
+		},
+		{
+			name:      "Cloud KMS key",
+			config:    newFakeKMSConfig(1),
+			sizes:     []int64{0, 1000},
+			maxExcess: maxWrapOverhead,
+		},
+		{
+			name:      "Shamir with Cloud KMS keys",
+			config:    newFakeKMSConfig(3),
+			sizes:     []int64{0, 1000},
+			maxExcess: 3 * maxWrapOverhead,
+		},
+	}
+
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, size := range tc.sizes {
+				estimate, err := EstimateBlobSize(size, tc.config.GetEncryptConfig(), tc.config.GetAsymmetricKeys())
+				if err != nil {
+					t.Fatalf("EstimateBlobSize(%v) returned error: %v", size, err)
+				}
+
+				var output bytes.Buffer
+				if _, err := stetClient.Encrypt(context.Background(), bytes.NewReader(make([]byte, size)), &output, tc.config, ""); err != nil {
+					t.Fatalf("Encrypt returned error: %v", err)
+				}
+				actual := int64(output.Len())
+
+				if tc.exact && estimate != actual {
+					t.Errorf("EstimateBlobSize(%v) = %v, want %v", size, estimate, actual)
+				}
+				if estimate < actual || estimate-actual > tc.maxExcess {
+					t.Errorf("EstimateBlobSize(%v) = %v, want between %v and %v", size, estimate, actual, actual+tc.maxExcess)
+				}
+			}
+		})
+	}
+}
+
+func TestEstimateBlobSizeErrors(t *testing.T) {
+	unknownFingerprint := &configpb.EncryptConfig{
+		KeyConfig: &configpb.KeyConfig{
+			KekInfos:              []*configpb.KekInfo{{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: testPublicFingerprint}}},
+			KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+		},
+	}
+
+	tooFewKEKs := newFakeKMSConfig(3).GetEncryptConfig()
+	tooFewKEKs.KeyConfig.KekInfos = tooFewKEKs.GetKeyConfig().GetKekInfos()[:2]
+
+	testcases := []struct {
+		name          string
+		plaintextSize int64
+		config        *configpb.EncryptConfig
+	}{
+		{"Negative plaintext size", -1, newFakeKMSConfig(1).GetEncryptConfig()},
+		{"Nil EncryptConfig", 10, nil},
+		{"Unknown RSA fingerprint", 10, unknownFingerprint},
+		{"Too few KEKs for shares", 10, tooFewKEKs},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := EstimateBlobSize(tc.plaintextSize, tc.config, &configpb.AsymmetricKeys{}); err == nil {
+				t.Error("EstimateBlobSize succeeded, want error")
+			}
+		})
+	}
+}
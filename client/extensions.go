@@ -0,0 +1,75 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+const (
+	// The maximum total size in bytes of the names and values of a blob's
+	// extensions, so that they do not bloat the metadata.
+	maxExtensionsSize = 16 * 1024
+)
+
+// extensionNameRegexp matches valid extension names: a lowercase letter
+// followed by up to 63 lowercase letters, digits, '.', '_' or '-'.
+var extensionNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9._-]{0,63}$`)
+
+// checkExtensions returns an error if any extension name is invalid, or if
+// the extensions are too large in total.
+func checkExtensions(extensions map[string]string) error {
+	size := 0
+	for _, name := range sortedExtensionNames(extensions) {
+		if !extensionNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid extension name %q, must match %v", name, extensionNameRegexp)
+		}
+		size += len(name) + len(extensions[name])
+	}
+
+	if size > maxExtensionsSize {
+		return fmt.Errorf("extensions are %v bytes, exceeding the limit of %v", size, maxExtensionsSize)
+	}
+
+	return nil
+}
+
+// sortedExtensionNames returns the names of `extensions` in sorted order, for
+// serializing them deterministically.
+func sortedExtensionNames(extensions map[string]string) []string {
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// copyExtensions returns a copy of `extensions`, or nil if there are none.
+func copyExtensions(extensions map[string]string) map[string]string {
+	if len(extensions) == 0 {
+		return nil
+	}
+
+	copied := make(map[string]string, len(extensions))
+	for name, value := range extensions {
+		copied[name] = value
+	}
+
+	return copied
+}
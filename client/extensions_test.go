@@ -0,0 +1,161 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExtensions(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+	extensions := map[string]string{
+		"retention-class":     "7y",
+		"data.classification": "confidential",
+		"empty":               "",
+	}
+
+	var metadataBuf, ciphertext bytes.Buffer
+	encMd, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertext, stetConfig, "blob", WithExtensions(extensions))
+	if err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	if diff := cmp.Diff(extensions, encMd.Extensions); diff != "" {
+		t.Errorf("EncryptWithSidecar returned unexpected Extensions (-want +got):\n%s", diff)
+	}
+
+	info, err := InspectMetadata(bytes.NewReader(metadataBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("InspectMetadata returned error: %v", err)
+	}
+
+	if diff := cmp.Diff(extensions, info.Extensions); diff != "" {
+		t.Errorf("InspectMetadata returned unexpected Extensions (-want +got):\n%s", diff)
+	}
+
+	var output bytes.Buffer
+	decMd, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadataBuf.Bytes()), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig)
+	if err != nil {
+		t.Fatalf("DecryptWithSidecar returned error: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("DecryptWithSidecar returned plaintext %q, want %q", output.Bytes(), plaintext)
+	}
+
+	if diff := cmp.Diff(extensions, decMd.Extensions); diff != "" {
+		t.Errorf("DecryptWithSidecar returned unexpected Extensions (-want +got):\n%s", diff)
+	}
+
+	forgeries := []struct {
+		name   string
+		mutate func(md *configpb.Metadata)
+	}{
+		{
+			name:   "Modified value",
+			mutate: func(md *configpb.Metadata) { md.Extensions["retention-class"] = "1d" },
+		},
+		{
+			name:   "Removed extension",
+			mutate: func(md *configpb.Metadata) { delete(md.Extensions, "empty") },
+		},
+		{
+			name:   "Added extension",
+			mutate: func(md *configpb.Metadata) { md.Extensions["legal-hold"] = "false" },
+		},
+		{
+			name:   "Removed all extensions",
+			mutate: func(md *configpb.Metadata) { md.Extensions = nil },
+		},
+		{
+			name: "Renamed extension",
+			mutate: func(md *configpb.Metadata) {
+				md.Extensions["retention_class"] = md.Extensions["retention-class"]
+				delete(md.Extensions, "retention-class")
+			},
+		},
+	}
+
+	for _, tc := range forgeries {
+		t.Run(tc.name, func(t *testing.T) {
+			forged := rewriteMetadata(t, metadataBuf.Bytes(), tc.mutate)
+
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext.Bytes()), &bytes.Buffer{}, stetConfig); err == nil {
+				t.Error("DecryptWithSidecar succeeded with tampered extensions, want error")
+			}
+		})
+	}
+}
+
+func TestExtensionsErrors(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	testCases := []struct {
+		name       string
+		extensions map[string]string
+		opts       []CallOption
+	}{
+		{
+			name:       "Empty name",
+			extensions: map[string]string{"": "value"},
+		},
+		{
+			name:       "Uppercase name",
+			extensions: map[string]string{"Retention": "7y"},
+		},
+		{
+			name:       "Name starting with digit",
+			extensions: map[string]string{"1class": "a"},
+		},
+		{
+			name:       "Name with space",
+			extensions: map[string]string{"data class": "a"},
+		},
+		{
+			name:       "Name too long",
+			extensions: map[string]string{strings.Repeat("a", 65): "a"},
+		},
+		{
+			name:       "Too large",
+			extensions: map[string]string{"a": strings.Repeat("x", maxExtensionsSize)},
+		},
+		{
+			name:       "Format version 1",
+			extensions: map[string]string{"a": "b"},
+			opts:       []CallOption{WithFormatVersion(FormatVersion1)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]CallOption{WithExtensions(tc.extensions)}, tc.opts...)
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("data")), &bytes.Buffer{}, stetConfig, "blob", opts...); err == nil {
+				t.Error("Encrypt succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/tink/go/keyset"
+)
+
+// ErrNotFIPSApproved is returned in FIPS mode when a configuration would use
+// an algorithm that is not FIPS 140-approved.
+var ErrNotFIPSApproved = errors.New("not FIPS-approved")
+
+// minFIPSRSABits is the minimum RSA modulus size allowed in FIPS mode.
+const minFIPSRSABits = 2048
+
+// fipsTinkKeyTypes are the Tink AEAD key types allowed in FIPS mode.
+var fipsTinkKeyTypes = map[string]bool{
+	"type.googleapis.com/google.crypto.tink.AesGcmKey":         true,
+	"type.googleapis.com/google.crypto.tink.AesCtrHmacAeadKey": true,
+}
+
+// FIPSCryptoBackend reports whether STET was built against a FIPS-validated
+// Go crypto backend, such as with GOEXPERIMENT=boringcrypto. This is
+// independent of the StetClient's FIPSMode, which restricts the algorithms
+// STET uses but not the implementation of them.
+func FIPSCryptoBackend() bool {
+	return boringCryptoEnabled()
+}
+
+// checkFIPSKeyConfig returns an error if the KeyConfig does not explicitly
+// select a FIPS-approved DEK algorithm. Key splitting is not a cryptographic
+// primitive covered by FIPS 140, so is not restricted.
+func checkFIPSKeyConfig(keyCfg *configpb.KeyConfig) error {
+	if alg := keyCfg.GetDekAlgorithm(); alg != configpb.DekAlgorithm_AES256_GCM {
+		return fmt.Errorf("DEK algorithm %v is %w, want %v", alg, ErrNotFIPSApproved, configpb.DekAlgorithm_AES256_GCM)
+	}
+
+	return nil
+}
+
+// checkFIPSRSAKey returns an error if the RSA key is too small for FIPS mode.
+// RSA keys are only used with OAEP, which is approved with SHA-256 or SHA-512;
+// see oaepHash.
+func checkFIPSRSAKey(key *rsa.PublicKey) error {
+	if bits := key.N.BitLen(); bits < minFIPSRSABits {
+		return fmt.Errorf("%v-bit RSA key is %w, want at least %v bits", bits, ErrNotFIPSApproved, minFIPSRSABits)
+	}
+
+	return nil
+}
+
+// checkFIPSKeyset returns an error if any key in the Tink keyset is of a type
+// that is not FIPS-approved, such as ChaCha20-Poly1305.
+func checkFIPSKeyset(handle *keyset.Handle) error {
+	for _, info := range handle.KeysetInfo().GetKeyInfo() {
+		if !fipsTinkKeyTypes[info.GetTypeUrl()] {
+			return fmt.Errorf("Tink key type %v is %w", info.GetTypeUrl(), ErrNotFIPSApproved)
+		}
+	}
+
+	return nil
+}
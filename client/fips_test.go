@@ -0,0 +1,202 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/testutil"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+)
+
+// writeRSAKeyPair generates an RSA key of the given size, writes it to PEM
+// files, and returns the AsymmetricKeys config and the key's fingerprint.
+func writeRSAKeyPair(t *testing.T, bits int) (*configpb.AsymmetricKeys, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey returned error: %v", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey returned error: %v", err)
+	}
+
+	dir := t.TempDir()
+	pubFile := filepath.Join(dir, "public.pem")
+	prvFile := filepath.Join(dir, "private.pem")
+
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+
+	if err := os.WriteFile(prvFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+
+	sha := sha256.Sum256(pubDER)
+	keys := &configpb.AsymmetricKeys{PublicKeyFiles: []string{pubFile}, PrivateKeyFiles: []string{prvFile}}
+	return keys, base64.StdEncoding.EncodeToString(sha[:])
+}
+
+func TestFIPSMode(t *testing.T) {
+	approvedKeys, approvedFingerprint := writeRSAKeyPair(t, 2048)
+	smallKeys, smallFingerprint := writeRSAKeyPair(t, 1024)
+
+	// Create a ChaCha20-Poly1305 Tink keyset, encrypted with the software KEK.
+	handle, err := keyset.NewHandle(aead.ChaCha20Poly1305KeyTemplate())
+	if err != nil {
+		t.Fatalf("keyset.NewHandle returned error: %v", err)
+	}
+
+	var chachaKeyset bytes.Buffer
+	masterKey := cloudkms.NewAEAD(context.Background(), &testutil.FakeKeyManagementClient{}, testutil.SoftwareKEK.Name)
+	if err := handle.Write(keyset.NewBinaryWriter(&chachaKeyset), masterKey); err != nil {
+		t.Fatalf("handle.Write returned error: %v", err)
+	}
+
+	aesKeyset, _ := newEncryptedTestKeyset(t)
+
+	tinkKEK := func(encryptedKeyset []byte) *configpb.KekInfo {
+		return &configpb.KekInfo{KekType: &configpb.KekInfo_TinkKeyset{TinkKeyset: &configpb.TinkKeyset{
+			Keyset:       &configpb.TinkKeyset_EncryptedKeyset{EncryptedKeyset: encryptedKeyset},
+			MasterKekUri: testutil.SoftwareKEK.URI(),
+		}}}
+	}
+
+	testCases := []struct {
+		name         string
+		kekInfo      *configpb.KekInfo
+		dekAlgorithm configpb.DekAlgorithm
+		keys         *configpb.AsymmetricKeys
+		wantErr      bool
+	}{
+		{
+			name:         "Cloud KMS KEK",
+			kekInfo:      &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()}},
+			dekAlgorithm: configpb.DekAlgorithm_AES256_GCM,
+		},
+		{
+			name:         "2048-bit RSA key",
+			kekInfo:      &configpb.KekInfo{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: approvedFingerprint}},
+			dekAlgorithm: configpb.DekAlgorithm_AES256_GCM,
+			keys:         approvedKeys,
+		},
+		{
+			name:         "AES-GCM Tink keyset",
+			kekInfo:      tinkKEK(aesKeyset),
+			dekAlgorithm: configpb.DekAlgorithm_AES256_GCM,
+		},
+		{
+			name:         "Unspecified DEK algorithm",
+			kekInfo:      &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()}},
+			dekAlgorithm: configpb.DekAlgorithm_UNKNOWN_DEK_ALGORITHM,
+			wantErr:      true,
+		},
+		{
+			name:         "1024-bit RSA key",
+			kekInfo:      &configpb.KekInfo{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: smallFingerprint}},
+			dekAlgorithm: configpb.DekAlgorithm_AES256_GCM,
+			keys:         smallKeys,
+			wantErr:      true,
+		},
+		{
+			name:         "ChaCha20-Poly1305 Tink keyset",
+			kekInfo:      tinkKEK(chachaKeyset.Bytes()),
+			dekAlgorithm: configpb.DekAlgorithm_AES256_GCM,
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keyConfig := &configpb.KeyConfig{
+				KekInfos:              []*configpb.KekInfo{tc.kekInfo},
+				DekAlgorithm:          tc.dekAlgorithm,
+				KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+			}
+			stetConfig := &configpb.StetConfig{
+				EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+				DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+				AsymmetricKeys: tc.keys,
+			}
+
+			newStetClient := func(fipsMode bool) *StetClient {
+				return &StetClient{
+					testKMSClients: &cloudkms.ClientFactory{
+						CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+					},
+					FIPSMode: fipsMode,
+				}
+			}
+
+			ctx := context.Background()
+			var ciphertext bytes.Buffer
+			_, err := newStetClient(true).Encrypt(ctx, bytes.NewReader([]byte("plaintext")), &ciphertext, stetConfig, "")
+			if tc.wantErr {
+				if !errors.Is(err, ErrNotFIPSApproved) {
+					t.Errorf("Encrypt in FIPS mode returned error %v, want %v", err, ErrNotFIPSApproved)
+				}
+
+				// The same config should be usable outside FIPS mode, but
+				// not for decryption in FIPS mode.
+				ciphertext.Reset()
+				if _, err := newStetClient(false).Encrypt(ctx, bytes.NewReader([]byte("plaintext")), &ciphertext, stetConfig, ""); err != nil {
+					t.Fatalf("Encrypt outside FIPS mode returned error: %v", err)
+				}
+
+				if _, err := newStetClient(true).Decrypt(ctx, &ciphertext, &bytes.Buffer{}, stetConfig); !errors.Is(err, ErrNotFIPSApproved) {
+					t.Errorf("Decrypt in FIPS mode returned error %v, want %v", err, ErrNotFIPSApproved)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Encrypt in FIPS mode returned error: %v", err)
+			}
+
+			var output bytes.Buffer
+			if _, err := newStetClient(true).Decrypt(ctx, &ciphertext, &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt in FIPS mode returned error: %v", err)
+			}
+
+			if output.String() != "plaintext" {
+				t.Errorf("Decrypt in FIPS mode returned %q, want %q", output.String(), "plaintext")
+			}
+		})
+	}
+}
+
+func TestFIPSCryptoBackend(t *testing.T) {
+	if FIPSCryptoBackend() != boringCryptoEnabled() {
+		t.Errorf("FIPSCryptoBackend() = %v, want %v", FIPSCryptoBackend(), boringCryptoEnabled())
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// Blob format versions, recorded in the STET header. Decrypt reads blobs of
+// every supported version.
+const (
+	// FormatVersion1 is the original blob format. The metadata only holds the
+	// wrapped shares with their SHA-256 hashes, the blob ID and the KeyConfig,
+	// and the ciphertext has segments of the default size. Shares may also
+	// record their KEK index, which older readers ignore.
+	FormatVersion1 uint8 = 1
+
+	// FormatVersion2 adds optional metadata for backup shares, share hash
+	// algorithms, integrity manifests, provenance, key commitments, custom
+	// segment sizes, share transforms, EC KEK curves and RSA-OAEP parameters,
+	// and framed ciphertexts.
+	// Blobs that use any of these cannot be decrypted by readers of version 1
+	// only. Blobs of version 2 also serialize their metadata into the AAD
+	// with AADVersion2, bind a random salt into it, and record their key
+	// splitting scheme.
+	FormatVersion2 uint8 = 2
+
+	// LatestFormatVersion is the newest blob format version that STET can
+	// read and write.
+	LatestFormatVersion = FormatVersion2
+)
+
+// formatVersion2Features returns the features of the Encrypt call with the
+// given KeyConfig and options that require FormatVersion2.
+func formatVersion2Features(keyCfg *configpb.KeyConfig, callOpts *callOptions) []string {
+	var features []string
+	for _, kek := range keyCfg.GetKekInfos() {
+		if kek.GetBackupKekUri() != "" {
+			features = append(features, "backup KEK")
+			break
+		}
+	}
+	for _, kek := range keyCfg.GetKekInfos() {
+		if kek.GetEcFingerprint() != "" {
+			features = append(features, "EC KEK")
+			break
+		}
+	}
+	for _, kek := range keyCfg.GetKekInfos() {
+		if kek.GetRsaOaepParams() != nil {
+			features = append(features, "RSA-OAEP parameters")
+			break
+		}
+	}
+	if callOpts.shareHashAlgorithm != configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH {
+		features = append(features, "share hash algorithm")
+	}
+	if callOpts.integrityManifest {
+		features = append(features, "integrity manifest")
+	}
+	if callOpts.provenance {
+		features = append(features, "provenance")
+	}
+	if callOpts.keyCommitment {
+		features = append(features, "key commitment")
+	}
+	if callOpts.encryptSegmentSize() != 0 {
+		features = append(features, "custom segment size")
+	}
+	if callOpts.shareTransform {
+		features = append(features, "share transform")
+	}
+	if len(callOpts.extensions) != 0 {
+		features = append(features, "extensions")
+	}
+	if callOpts.framing {
+		features = append(features, "framing")
+	}
+
+	return features
+}
+
+// encryptFormatVersion returns the format version to write for the Encrypt
+// call with the given KeyConfig and options: the version requested with
+// WithFormatVersion, or otherwise the oldest version that supports the
+// features used, so that the blob is readable by as many versions of STET as
+// possible. Returns an error if the requested version does not support a
+// feature used.
+func encryptFormatVersion(keyCfg *configpb.KeyConfig, callOpts *callOptions) (uint8, error) {
+	features := formatVersion2Features(keyCfg, callOpts)
+
+	version := callOpts.formatVersion
+	if version == 0 {
+		if len(features) > 0 {
+			return FormatVersion2, nil
+		}
+		return FormatVersion1, nil
+	}
+
+	if version > LatestFormatVersion {
+		return 0, fmt.Errorf("blob format version %v is not supported, the latest is %v", version, LatestFormatVersion)
+	}
+
+	if version < FormatVersion2 && len(features) > 0 {
+		return 0, fmt.Errorf("%v requires blob format version %v, but version %v was requested", features[0], FormatVersion2, version)
+	}
+
+	return version, nil
+}
+
+// checkReadFormatVersion returns an error if blobs of the given format version
+// cannot be read.
+func checkReadFormatVersion(version uint8) error {
+	if version < FormatVersion1 || version > LatestFormatVersion {
+		return fmt.Errorf("blob format version %v is not supported, want between %v and %v", version, FormatVersion1, LatestFormatVersion)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+)
+
+func TestEncryptFormatVersion(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+	plaintext := []byte("This is data to be encrypted.")
+
+	testcases := []struct {
+		name        string
+		opts        []CallOption
+		wantVersion uint8
+		wantErr     bool
+	}{
+		{
+			name:        "Default without newer features",
+			wantVersion: FormatVersion1,
+		},
+		{
+			name:        "Default with newer features",
+			opts:        []CallOption{WithProvenance()},
+			wantVersion: FormatVersion2,
+		},
+		{
+			name:        "Pinned to version 1",
+			opts:        []CallOption{WithFormatVersion(FormatVersion1)},
+			wantVersion: FormatVersion1,
+		},
+		{
+			name:        "Pinned to version 2 without newer features",
+			opts:        []CallOption{WithFormatVersion(FormatVersion2)},
+			wantVersion: FormatVersion2,
+		},
+		{
+			name:    "Version 1 with custom segment size",
+			opts:    []CallOption{WithFormatVersion(FormatVersion1), WithSegmentSize(64 * 1024)},
+			wantErr: true,
+		},
+		{
+			name:    "Version 1 with key commitment",
+			opts:    []CallOption{WithFormatVersion(FormatVersion1), WithKeyCommitment()},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown version",
+			opts:    []CallOption{WithFormatVersion(LatestFormatVersion + 1)},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var blob bytes.Buffer
+			_, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "", tc.opts...)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("Encrypt succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			header, err := ReadSTETHeader(bytes.NewReader(blob.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadSTETHeader returned error: %v", err)
+			}
+			if header.Version != tc.wantVersion {
+				t.Errorf("Encrypt wrote format version %v, want %v", header.Version, tc.wantVersion)
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.Decrypt(ctx, &blob, &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned %q, want %q", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
+
+func TestDecryptUnsupportedFormatVersion(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("This is data to be encrypted.")), &blob, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	for _, version := range []uint8{0, LatestFormatVersion + 1} {
+		modified := append([]byte{}, blob.Bytes()...)
+		modified[len(STETMagic)] = version
+
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(modified), &output, stetConfig); err == nil {
+			t.Errorf("Decrypt of blob with format version %v succeeded, want error", version)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// The ciphertext of a blob encrypted WithFraming is written as a sequence of
+// chunks, each a little-endian uint32 length followed by that many bytes of
+// ciphertext, and ends with a chunk of length zero. A reader finds the end of
+// the blob from this end marker alone, so Encrypt can stream the plaintext
+// without knowing its size in advance. The chunks carry no meaning of their
+// own: truncating or extending the ciphertext they hold fails its
+// authentication, as for unframed blobs.
+
+// maxFramedChunkSize bounds the length of each chunk of a framed ciphertext.
+const maxFramedChunkSize = aeadSegmentSize
+
+// framedWriter writes the ciphertext of a framed blob to the underlying
+// writer, as chunks of at most maxFramedChunkSize bytes. Close must be called
+// to write the end marker.
+type framedWriter struct {
+	w io.Writer
+}
+
+func (f *framedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFramedChunkSize {
+			chunk = chunk[:maxFramedChunkSize]
+		}
+
+		if err := binary.Write(f.w, binary.LittleEndian, uint32(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := f.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Close writes the end marker of the framed ciphertext. It does not close the
+// underlying writer.
+func (f *framedWriter) Close() error {
+	return binary.Write(f.w, binary.LittleEndian, uint32(0))
+}
+
+// framedReader reads the ciphertext of a framed blob from the underlying
+// reader, returning io.EOF at its end marker, so that nothing past the end of
+// the blob is read.
+type framedReader struct {
+	r io.Reader
+	// The bytes left in the current chunk, and whether the end marker was
+	// read.
+	remaining uint32
+	done      bool
+}
+
+func (f *framedReader) Read(p []byte) (int, error) {
+	if f.done {
+		return 0, io.EOF
+	}
+
+	if f.remaining == 0 {
+		if err := binary.Read(f.r, binary.LittleEndian, &f.remaining); err != nil {
+			return 0, fmt.Errorf("error reading framed ciphertext: %w", io.ErrUnexpectedEOF)
+		}
+
+		if f.remaining == 0 {
+			f.done = true
+			return 0, io.EOF
+		}
+		if f.remaining > maxFramedChunkSize {
+			return 0, fmt.Errorf("framed ciphertext has a chunk of %v bytes, exceeding the maximum of %v", f.remaining, maxFramedChunkSize)
+		}
+	}
+
+	if uint32(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+
+	n, err := f.r.Read(p)
+	f.remaining -= uint32(n)
+	if err == io.EOF {
+		err = fmt.Errorf("error reading framed ciphertext: %w", io.ErrUnexpectedEOF)
+	}
+
+	return n, err
+}
+
+// finish reads the rest of the framed ciphertext up to its end marker, and
+// returns an error if any ciphertext is left, as once decrypted, the blob
+// must end there.
+func (f *framedReader) finish() error {
+	n, err := io.Copy(io.Discard, f)
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return fmt.Errorf("framed ciphertext has %v bytes after the end of the ciphertext", n)
+	}
+
+	return nil
+}
+
+// recordedCiphertextSize returns the length of the ciphertext of the blob with
+// `metadata`, if it is recorded in its integrity manifest.
+func recordedCiphertextSize(metadata *configpb.Metadata) (int64, bool) {
+	if manifest := metadata.GetIntegrityManifest(); manifest != nil {
+		return manifest.GetCiphertextLength(), true
+	}
+
+	return 0, false
+}
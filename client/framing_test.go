@@ -0,0 +1,261 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+)
+
+func TestFraming(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+
+	// An empty blob, a single-segment blob and a blob of several segments.
+	plaintexts := [][]byte{
+		{},
+		[]byte("This is data to be encrypted."),
+		bytes.Repeat([]byte("0123456789abcdef"), 1000),
+	}
+
+	testCases := []struct {
+		name string
+		opts []CallOption
+	}{
+		{name: "Default segment size"},
+		{name: "Custom segment size", opts: []CallOption{WithSegmentSize(aeadMinSegmentSize)}},
+		{name: "Parallel AEAD", opts: []CallOption{WithSegmentSize(aeadMinSegmentSize), WithParallelAEAD(2)}},
+		{name: "Integrity manifest", opts: []CallOption{WithIntegrityManifest()}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]CallOption{WithFraming()}, tc.opts...)
+
+			var stream bytes.Buffer
+			for i, plaintext := range plaintexts {
+				if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &stream, stetConfig, "", opts...); err != nil {
+					t.Fatalf("Encrypt of blob #%v returned error: %v", i+1, err)
+				}
+			}
+
+			// Each Decrypt stops at the end of its blob.
+			input := bytes.NewReader(stream.Bytes())
+			for i, plaintext := range plaintexts {
+				var output bytes.Buffer
+				if _, err := stetClient.Decrypt(ctx, input, &output, stetConfig, opts...); err != nil {
+					t.Fatalf("Decrypt of blob #%v returned error: %v", i+1, err)
+				}
+				if !bytes.Equal(output.Bytes(), plaintext) {
+					t.Errorf("Decrypt of blob #%v returned %v bytes of plaintext, want %v", i+1, output.Len(), len(plaintext))
+				}
+			}
+			if input.Len() != 0 {
+				t.Errorf("Decrypt left %v bytes of the stream unread, want none", input.Len())
+			}
+
+			// Without framing, Decrypt reads the next blob as ciphertext.
+			if _, err := stetClient.Decrypt(ctx, bytes.NewReader(stream.Bytes()), io.Discard, stetConfig, tc.opts...); err == nil {
+				t.Error("Decrypt of concatenated blobs without framing succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestFramingErrors(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	// A blob encrypted without framing has no chunks or end marker.
+	var unframed bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &unframed, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	if _, err := stetClient.Decrypt(ctx, &unframed, io.Discard, stetConfig, WithFraming()); err == nil {
+		t.Error("Decrypt WithFraming of a blob encrypted without it succeeded, want error")
+	}
+
+	// A truncated blob fails, rather than reading into the next.
+	var framed bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &framed, stetConfig, "", WithFraming()); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	truncated := framed.Bytes()[:framed.Len()-1]
+	if _, err := stetClient.Decrypt(ctx, bytes.NewReader(truncated), io.Discard, stetConfig, WithFraming()); err == nil {
+		t.Error("Decrypt WithFraming of a truncated blob succeeded, want error")
+	}
+}
+
+func TestEncryptStreams(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	testCases := []struct {
+		name string
+		opts []CallOption
+	}{
+		{
+			name: "Framing",
+			opts: []CallOption{WithFraming()},
+		},
+		{
+			name: "Size hint",
+			opts: []CallOption{WithSizeHint(int64(len(plaintext)))},
+		},
+		{
+			name: "Framing with size hint",
+			opts: []CallOption{WithFraming(), WithSizeHint(int64(len(plaintext)))},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintextReader, plaintextWriter := io.Pipe()
+			blobReader, blobWriter := io.Pipe()
+			go func() {
+				_, err := stetClient.Encrypt(ctx, plaintextReader, blobWriter, stetConfig, "", tc.opts...)
+				blobWriter.CloseWithError(err)
+			}()
+
+			// The metadata is written before the plaintext is complete, as
+			// Encrypt does not buffer it.
+			read := make(chan error, 1)
+			go func() {
+				_, err := ReadMetadata(blobReader)
+				read <- err
+			}()
+			select {
+			case err := <-read:
+				if err != nil {
+					t.Fatalf("ReadMetadata returned error: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				plaintextWriter.CloseWithError(errors.New("timed out"))
+				t.Fatal("Encrypt did not write the metadata before the end of the plaintext")
+			}
+
+			go func() {
+				plaintextWriter.Write(plaintext)
+				plaintextWriter.Close()
+			}()
+			if _, err := io.Copy(io.Discard, blobReader); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+		})
+	}
+}
+
+func TestIgnoreTrailingBytes(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	// Padding to the next 4 KiB block boundary.
+	pad := func(blob []byte) []byte {
+		padded := make([]byte, (len(blob)/4096+1)*4096)
+		copy(padded, blob)
+		return padded
+	}
+
+	testCases := []struct {
+		name        string
+		encryptOpts []CallOption
+		// Whether the ciphertext length is recorded in the metadata.
+		recorded bool
+	}{
+		{
+			name:        "Size hint",
+			encryptOpts: []CallOption{WithSizeHint(int64(len(plaintext)))},
+			recorded:    false,
+		},
+		{
+			name:        "Custom segment size",
+			encryptOpts: []CallOption{WithSegmentSize(aeadMinSegmentSize), WithIntegrityManifest()},
+			recorded:    true,
+		},
+		{
+			name:        "Integrity manifest",
+			encryptOpts: []CallOption{WithIntegrityManifest()},
+			recorded:    true,
+		},
+		{
+			name:     "No recorded length",
+			recorded: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var blob bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "", tc.encryptOpts...); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			decrypt := func(blob []byte, opts ...CallOption) ([]byte, error) {
+				var output bytes.Buffer
+				_, err := stetClient.Decrypt(ctx, bytes.NewReader(blob), &output, stetConfig, opts...)
+				return output.Bytes(), err
+			}
+
+			// Unpadded blobs decrypt with or without the option.
+			for _, opts := range [][]CallOption{nil, {WithIgnoreTrailingBytes()}} {
+				output, err := decrypt(blob.Bytes(), opts...)
+				if err != nil {
+					t.Fatalf("Decrypt of unpadded blob returned error: %v", err)
+				}
+				if !bytes.Equal(output, plaintext) {
+					t.Errorf("Decrypt of unpadded blob returned %v bytes of plaintext, want %v", len(output), len(plaintext))
+				}
+			}
+
+			padded := pad(blob.Bytes())
+			if _, err := decrypt(padded); err == nil {
+				t.Error("Decrypt of padded blob without WithIgnoreTrailingBytes succeeded, want error")
+			}
+
+			output, err := decrypt(padded, WithIgnoreTrailingBytes())
+			if !tc.recorded {
+				if err == nil {
+					t.Error("Decrypt WithIgnoreTrailingBytes of padded blob without a recorded length succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt WithIgnoreTrailingBytes of padded blob returned error: %v", err)
+			}
+			if !bytes.Equal(output, plaintext) {
+				t.Errorf("Decrypt WithIgnoreTrailingBytes of padded blob returned %v bytes of plaintext, want %v", len(output), len(plaintext))
+			}
+
+			// A truncated blob still fails.
+			truncated := blob.Bytes()[:blob.Len()-1]
+			if _, err := decrypt(truncated, WithIgnoreTrailingBytes()); err == nil {
+				t.Error("Decrypt WithIgnoreTrailingBytes of truncated blob succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// BlobInfo describes a STET-encrypted blob, as read from its metadata by
+// InspectMetadata.
+type BlobInfo struct {
+	BlobID string
+	// The KeyConfig the blob was encrypted with.
+	KeyConfig *configpb.KeyConfig
+	// A description of the KEK each share is wrapped with.
+	KEKs []string
+	// Whether the blob has an integrity manifest, for VerifyIntegrity.
+	HasIntegrityManifest bool
+	// When and with which version of STET the blob was encrypted, if recorded
+	// with WithProvenance. CreateTime is the zero time otherwise.
+	CreateTime  time.Time
+	STETVersion string
+	// The application-specific metadata recorded WithExtensions, if any.
+	Extensions map[string]string
+	// The size of the STET header and metadata, which is the number of bytes
+	// InspectMetadata consumed from its input. In a blob written by Encrypt,
+	// the ciphertext starts at this offset.
+	MetadataBytes int64
+}
+
+// InspectMetadata reads the STET header and metadata from `input` and
+// describes the blob, without unwrapping any shares or decrypting any data.
+// As with ReadMetadata, it reads no further than the metadata, so a stream
+// that cannot seek can afterwards be read for the ciphertext.
+//
+// The metadata is only authenticated on decryption, so the returned BlobInfo
+// must not be trusted until the blob has been successfully decrypted.
+func InspectMetadata(input io.Reader) (*BlobInfo, error) {
+	metadata, metadataBytes, err := readMetadata(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	info := &BlobInfo{
+		BlobID:               metadata.GetBlobId(),
+		KeyConfig:            metadata.GetKeyConfig(),
+		HasIntegrityManifest: metadata.GetIntegrityManifest() != nil,
+		STETVersion:          metadata.GetProvenance().GetStetVersion(),
+		Extensions:           copyExtensions(metadata.GetExtensions()),
+		MetadataBytes:        metadataBytes,
+	}
+
+	for _, kek := range metadata.GetKeyConfig().GetKekInfos() {
+		info.KEKs = append(info.KEKs, kekDescription(kek))
+	}
+
+	if createTime := metadata.GetProvenance().GetCreateTime(); createTime != nil {
+		info.CreateTime = createTime.AsTime()
+	}
+
+	return info, nil
+}
+
+// KeyConfigMatch describes a KeyConfig in a DecryptConfig that matches the
+// KeyConfig a blob was encrypted with, as returned by MatchKeyConfigs.
+type KeyConfigMatch struct {
+	// The index of the KeyConfig in the DecryptConfig.
+	Index     int
+	KeyConfig *configpb.KeyConfig
+	// The number of shares whose KEKs the caller is likely to hold, and the
+	// number needed to recombine the DEK.
+	AvailableShares int
+	Threshold       int
+}
+
+// Sufficient reports whether the caller likely holds enough shares to decrypt
+// the blob with the matching KeyConfig.
+func (m KeyConfigMatch) Sufficient() bool {
+	return m.AvailableShares >= m.Threshold
+}
+
+// MatchKeyConfigs reads the STET header and metadata from `input` and returns
+// the KeyConfigs in the DecryptConfig of `stetConfig` that match the one the
+// blob was encrypted with, in the order they are configured. Decrypt uses the
+// first of these.
+//
+// No shares are unwrapped, so availability is estimated offline: shares
+// wrapped with an RSA key are only counted if a private key with a matching
+// fingerprint is configured in the AsymmetricKeys of `stetConfig`, while
+// shares wrapped with Cloud KMS or EKM keys and Tink keysets are assumed to be
+// available, as checking them requires calls to the key management systems.
+func MatchKeyConfigs(input io.Reader, stetConfig *configpb.StetConfig) ([]KeyConfigMatch, error) {
+	metadata, err := ReadMetadata(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	var matches []KeyConfigMatch
+	for i, keyCfg := range stetConfig.GetDecryptConfig().GetKeyConfigs() {
+		if !proto.Equal(keyCfg, metadata.GetKeyConfig()) {
+			continue
+		}
+
+		available := 0
+		for _, kek := range keyCfg.GetKekInfos() {
+			if kekLikelyAvailable(kek, stetConfig.GetAsymmetricKeys()) {
+				available++
+			}
+		}
+
+		matches = append(matches, KeyConfigMatch{
+			Index:           i,
+			KeyConfig:       keyCfg,
+			AvailableShares: available,
+			Threshold:       shareThreshold(keyCfg),
+		})
+	}
+
+	return matches, nil
+}
+
+// kekLikelyAvailable reports whether a share wrapped with `kek` can likely be
+// unwrapped with the given asymmetric keys, as described in MatchKeyConfigs.
+func kekLikelyAvailable(kek *configpb.KekInfo, keys *configpb.AsymmetricKeys) bool {
+	switch kek.GetKekType().(type) {
+	case *configpb.KekInfo_KekUri, *configpb.KekInfo_TinkKeyset:
+		return true
+	case *configpb.KekInfo_RsaFingerprint:
+		_, err := PrivateKeyForRSAFingerprint(kek, keys)
+		return err == nil
+	case *configpb.KekInfo_EcFingerprint:
+		_, err := PrivateKeyForECFingerprint(kek, keys)
+		return err == nil
+	default:
+		return false
+	}
+}
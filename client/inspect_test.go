@@ -0,0 +1,296 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestInspectMetadataProvenance(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, Version: "1.2.3"}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	before := time.Now()
+	var withProvenance bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &withProvenance, stetConfig, "blob", WithProvenance()); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	after := time.Now()
+
+	var withoutProvenance bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &withoutProvenance, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	info, err := InspectMetadata(bytes.NewReader(withProvenance.Bytes()))
+	if err != nil {
+		t.Fatalf("InspectMetadata returned error: %v", err)
+	}
+
+	if info.CreateTime.Before(before) || info.CreateTime.After(after) {
+		t.Errorf("InspectMetadata returned CreateTime %v, want between %v and %v", info.CreateTime, before, after)
+	}
+
+	want := &BlobInfo{
+		BlobID:      "blob",
+		KEKs:        []string{kekDescription(stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[0]), kekDescription(stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[1])},
+		STETVersion: "1.2.3",
+	}
+	ignore := cmp.FilterPath(func(p cmp.Path) bool {
+		name := p.Last().String()
+		return name == ".KeyConfig" || name == ".CreateTime" || name == ".MetadataBytes"
+	}, cmp.Ignore())
+	if diff := cmp.Diff(want, info, ignore); diff != "" {
+		t.Errorf("InspectMetadata returned diff (-want +got):\n%s", diff)
+	}
+
+	info, err = InspectMetadata(bytes.NewReader(withoutProvenance.Bytes()))
+	if err != nil {
+		t.Fatalf("InspectMetadata returned error: %v", err)
+	}
+
+	if !info.CreateTime.IsZero() || info.STETVersion != "" {
+		t.Errorf("InspectMetadata returned provenance (%v, %q) for a blob encrypted without it", info.CreateTime, info.STETVersion)
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, bytes.NewReader(withProvenance.Bytes()), &output, stetConfig); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+	}
+}
+
+func TestInspectMetadataNonSeekableStream(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	var metadata, ciphertext bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadata, &ciphertext, stetConfig, "blob"); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	// Stream the blob through a pipe, only writing the ciphertext once the
+	// metadata has been inspected, so that reading past the metadata blocks.
+	pr, pw := io.Pipe()
+	inspected := make(chan struct{})
+	go func() {
+		pw.Write(metadata.Bytes())
+		<-inspected
+		pw.Write(ciphertext.Bytes())
+		pw.Close()
+	}()
+
+	type result struct {
+		info *BlobInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := InspectMetadata(pr)
+		done <- result{info, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("InspectMetadata blocked reading past the metadata")
+	}
+	close(inspected)
+
+	if r.err != nil {
+		t.Fatalf("InspectMetadata returned error: %v", r.err)
+	}
+	if r.info.MetadataBytes != int64(metadata.Len()) {
+		t.Errorf("InspectMetadata returned MetadataBytes %v, want %v", r.info.MetadataBytes, metadata.Len())
+	}
+
+	// The rest of the stream is exactly the ciphertext, which decrypts.
+	rest, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("Reading the rest of the stream returned error: %v", err)
+	}
+	if !bytes.Equal(rest, ciphertext.Bytes()) {
+		t.Fatal("The stream after InspectMetadata is not the ciphertext")
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata.Bytes()), bytes.NewReader(rest), &output, stetConfig); err != nil {
+		t.Fatalf("DecryptWithSidecar returned error: %v", err)
+	}
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("DecryptWithSidecar returned plaintext %q, want %q", output.Bytes(), plaintext)
+	}
+}
+
+func TestProvenanceBoundIntoAAD(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, Version: "1.2.3"}
+	stetConfig := newFakeKMSConfig(1)
+
+	metadata, ciphertext := encryptWithProvenance(t, stetClient, stetConfig)
+
+	testcases := []struct {
+		name   string
+		mutate func(*configpb.Metadata)
+	}{
+		{
+			name: "Modified creation time",
+			mutate: func(md *configpb.Metadata) {
+				md.GetProvenance().CreateTime = timestamppb.New(time.Unix(0, 0))
+			},
+		},
+		{
+			name: "Modified version",
+			mutate: func(md *configpb.Metadata) {
+				md.GetProvenance().StetVersion = "0.0.1"
+			},
+		},
+		{
+			name: "Removed provenance",
+			mutate: func(md *configpb.Metadata) {
+				md.Provenance = nil
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			forged := rewriteMetadata(t, metadata, tc.mutate)
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext), &output, stetConfig); err == nil {
+				t.Error("DecryptWithSidecar succeeded with forged provenance, want error")
+			}
+		})
+	}
+}
+
+// encryptWithProvenance encrypts a fixed plaintext with provenance, returning
+// the metadata and ciphertext separately.
+func encryptWithProvenance(t *testing.T, stetClient *StetClient, stetConfig *configpb.StetConfig) ([]byte, []byte) {
+	t.Helper()
+
+	var metadataBuf, ciphertextBuf bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(context.Background(), bytes.NewReader([]byte("plaintext")), &metadataBuf, &ciphertextBuf, stetConfig, "", WithProvenance()); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	return metadataBuf.Bytes(), ciphertextBuf.Bytes()
+}
+
+func TestMatchKeyConfigs(t *testing.T) {
+	ctx := context.Background()
+	keys, fingerprint := writeRSAKeyPair(t, 2048)
+
+	keyConfig := newFakeKMSConfig(2).GetEncryptConfig().GetKeyConfig()
+	keyConfig.KekInfos = append(keyConfig.KekInfos, &configpb.KekInfo{
+		KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint},
+	})
+	keyConfig.KeySplittingAlgorithm = &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 3, Shares: 3}}
+	otherKeyConfig := newFakeKMSConfig(1).GetEncryptConfig().GetKeyConfig()
+
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	encryptConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		AsymmetricKeys: keys,
+	}
+
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("This is data to be encrypted.")), &blob, encryptConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	decryptConfig := &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{otherKeyConfig, keyConfig, keyConfig}}
+
+	testcases := []struct {
+		name          string
+		decryptConfig *configpb.DecryptConfig
+		keys          *configpb.AsymmetricKeys
+		want          []KeyConfigMatch
+		// Whether each match in `want` is expected to be Sufficient.
+		wantSufficient bool
+	}{
+		{
+			name:          "All shares available",
+			decryptConfig: decryptConfig,
+			keys:          keys,
+			want: []KeyConfigMatch{
+				{Index: 1, KeyConfig: keyConfig, AvailableShares: 3, Threshold: 3},
+				{Index: 2, KeyConfig: keyConfig, AvailableShares: 3, Threshold: 3},
+			},
+			wantSufficient: true,
+		},
+		{
+			name:          "Missing RSA private key",
+			decryptConfig: decryptConfig,
+			keys:          &configpb.AsymmetricKeys{PublicKeyFiles: keys.GetPublicKeyFiles()},
+			want: []KeyConfigMatch{
+				{Index: 1, KeyConfig: keyConfig, AvailableShares: 2, Threshold: 3},
+				{Index: 2, KeyConfig: keyConfig, AvailableShares: 2, Threshold: 3},
+			},
+		},
+		{
+			name:          "No matching KeyConfig",
+			decryptConfig: &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{otherKeyConfig}},
+			keys:          keys,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetConfig := &configpb.StetConfig{DecryptConfig: tc.decryptConfig, AsymmetricKeys: tc.keys}
+
+			got, err := MatchKeyConfigs(bytes.NewReader(blob.Bytes()), stetConfig)
+			if err != nil {
+				t.Fatalf("MatchKeyConfigs returned error: %v", err)
+			}
+
+			if diff := cmp.Diff(tc.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("MatchKeyConfigs returned diff (-want +got):\n%s", diff)
+			}
+
+			for _, match := range got {
+				if match.Sufficient() != tc.wantSufficient {
+					t.Errorf("Sufficient() = %v for KeyConfig %v, want %v", match.Sufficient(), match.Index, tc.wantSufficient)
+				}
+			}
+		})
+	}
+}
+
+func TestSTETHeaderBytes(t *testing.T) {
+	if got := binary.Size(STETHeader{}); got != STETHeaderBytes {
+		t.Errorf("STETHeader encodes to %v bytes, want STETHeaderBytes = %v", got, STETHeaderBytes)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// manifestMACLabel is used to derive the manifest MAC key from the DEK.
+const manifestMACLabel = "STET integrity manifest MAC key"
+
+// frameHasher is an io.Writer that computes the SHA-256 hash of each
+// fixed-size frame of the data written to it.
+type frameHasher struct {
+	frameSize int64
+	length    int64
+	current   hash.Hash
+	inFrame   int64
+	hashes    [][]byte
+}
+
+func newFrameHasher(frameSize int64) *frameHasher {
+	return &frameHasher{frameSize: frameSize, current: sha256.New()}
+}
+
+func (f *frameHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := f.frameSize - f.inFrame
+		if int64(len(p)) < chunk {
+			chunk = int64(len(p))
+		}
+
+		f.current.Write(p[:chunk])
+		f.inFrame += chunk
+		f.length += chunk
+		p = p[chunk:]
+
+		if f.inFrame == f.frameSize {
+			f.hashes = append(f.hashes, f.current.Sum(nil))
+			f.current.Reset()
+			f.inFrame = 0
+		}
+	}
+
+	return n, nil
+}
+
+// manifest returns the manifest for the data written so far, without a MAC.
+func (f *frameHasher) manifest() *configpb.IntegrityManifest {
+	hashes := f.hashes
+	if f.inFrame > 0 {
+		hashes = append(hashes[:len(hashes):len(hashes)], f.current.Sum(nil))
+	}
+
+	return &configpb.IntegrityManifest{
+		FrameSize:        f.frameSize,
+		CiphertextLength: f.length,
+		FrameHashes:      hashes,
+	}
+}
+
+// manifestMAC computes the MAC of the manifest for the blob with the given ID,
+// keyed with a key derived from the DEK. The MAC covers the following
+// serialization (given n := len(m.frameHashes)):
+//
+//	len(blobID) || blobID || m.frameSize || m.ciphertextLength
+//	|| m.frameHashes[0] || ... || m.frameHashes[n-1]
+func manifestMAC(key shares.DEK, blobID string, m *configpb.IntegrityManifest) []byte {
+	keyMAC := hmac.New(sha256.New, key[:])
+	keyMAC.Write([]byte(manifestMACLabel))
+
+	mac := hmac.New(sha256.New, keyMAC.Sum(nil))
+	binary.Write(mac, binary.LittleEndian, uint64(len(blobID)))
+	mac.Write([]byte(blobID))
+	binary.Write(mac, binary.LittleEndian, m.GetFrameSize())
+	binary.Write(mac, binary.LittleEndian, m.GetCiphertextLength())
+	for _, h := range m.GetFrameHashes() {
+		mac.Write(h)
+	}
+
+	return mac.Sum(nil)
+}
+
+// checkManifestMAC verifies the MAC of the manifest with the DEK.
+func checkManifestMAC(key shares.DEK, blobID string, m *configpb.IntegrityManifest) error {
+	if !hmac.Equal(m.GetMac(), manifestMAC(key, blobID, m)) {
+		return fmt.Errorf("integrity manifest MAC does not match")
+	}
+
+	return nil
+}
+
+// checkManifestShape checks that the frame size and ciphertext length of an
+// untrusted manifest are in range, and that it has one frame hash per frame of
+// the ciphertext, so that verifying it computes a bounded number of hashes.
+func checkManifestShape(m *configpb.IntegrityManifest) error {
+	if err := checkSegmentSize(m.GetFrameSize()); err != nil {
+		return fmt.Errorf("invalid integrity manifest frame size: %v", err)
+	}
+
+	length := m.GetCiphertextLength()
+	if length < 0 {
+		return fmt.Errorf("invalid integrity manifest ciphertext length %v", length)
+	}
+
+	if frames := (length + m.GetFrameSize() - 1) / m.GetFrameSize(); int64(len(m.GetFrameHashes())) != frames {
+		return fmt.Errorf("integrity manifest has %v frame hashes for %v frames", len(m.GetFrameHashes()), frames)
+	}
+
+	return nil
+}
+
+// compareManifests checks that the frame hashes computed from the ciphertext
+// match those in the stored manifest.
+func compareManifests(stored, computed *configpb.IntegrityManifest) error {
+	if computed.GetCiphertextLength() != stored.GetCiphertextLength() {
+		return fmt.Errorf("ciphertext length is %v bytes, want %v bytes", computed.GetCiphertextLength(), stored.GetCiphertextLength())
+	}
+
+	if len(computed.GetFrameHashes()) != len(stored.GetFrameHashes()) {
+		return fmt.Errorf("ciphertext has %v frames, want %v", len(computed.GetFrameHashes()), len(stored.GetFrameHashes()))
+	}
+
+	for i, h := range computed.GetFrameHashes() {
+		if !bytes.Equal(h, stored.GetFrameHashes()[i]) {
+			return fmt.Errorf("hash of ciphertext frame %v does not match manifest", i)
+		}
+	}
+
+	return nil
+}
+
+// VerifyIntegrity checks the ciphertext of a STET-encrypted blob against the
+// integrity manifest stored in its metadata, without decrypting it. This
+// detects corruption or truncation of the ciphertext, but does not
+// authenticate the blob: only Decrypt can do that.
+//
+// Returns an error if the blob was encrypted without an integrity manifest.
+func VerifyIntegrity(input io.Reader) error {
+	return VerifyIntegrityWithSidecar(input, input)
+}
+
+// VerifyIntegrityWithSidecar is like VerifyIntegrity, but reads the STET
+// header and metadata from metadataInput and the ciphertext from
+// ciphertextInput, as written by EncryptWithSidecar.
+func VerifyIntegrityWithSidecar(metadataInput, ciphertextInput io.Reader) error {
+	metadata, err := ReadMetadata(metadataInput)
+	if err != nil {
+		return fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	stored := metadata.GetIntegrityManifest()
+	if stored == nil {
+		return fmt.Errorf("blob has no integrity manifest")
+	}
+
+	if err := checkManifestShape(stored); err != nil {
+		return err
+	}
+
+	// Reading one byte past the recorded length is enough to detect trailing
+	// data, without hashing the rest of it.
+	hasher := newFrameHasher(stored.GetFrameSize())
+	if _, err := io.Copy(hasher, io.LimitReader(ciphertextInput, stored.GetCiphertextLength()+1)); err != nil {
+		return fmt.Errorf("error reading ciphertext: %v", err)
+	}
+
+	if err := compareManifests(stored, hasher.manifest()); err != nil {
+		return fmt.Errorf("integrity check failed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFrameHasher(t *testing.T) {
+	data := []byte("0123456789")
+
+	testcases := []struct {
+		name       string
+		writes     []int
+		wantFrames [][]byte
+	}{
+		{
+			name:       "Single write",
+			writes:     []int{10},
+			wantFrames: [][]byte{data[0:4], data[4:8], data[8:10]},
+		},
+		{
+			name:       "Writes across frame boundaries",
+			writes:     []int{3, 3, 3, 1},
+			wantFrames: [][]byte{data[0:4], data[4:8], data[8:10]},
+		},
+		{
+			name:       "Exact frames",
+			writes:     []int{4, 4},
+			wantFrames: [][]byte{data[0:4], data[4:8]},
+		},
+		{
+			name:   "Empty",
+			writes: nil,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			hasher := newFrameHasher(4)
+
+			offset := 0
+			for _, n := range tc.writes {
+				hasher.Write(data[offset : offset+n])
+				offset += n
+			}
+
+			manifest := hasher.manifest()
+			if manifest.GetCiphertextLength() != int64(offset) {
+				t.Errorf("manifest().GetCiphertextLength() = %v, want %v", manifest.GetCiphertextLength(), offset)
+			}
+
+			if len(manifest.GetFrameHashes()) != len(tc.wantFrames) {
+				t.Fatalf("manifest() has %v frame hashes, want %v", len(manifest.GetFrameHashes()), len(tc.wantFrames))
+			}
+
+			for i, frame := range tc.wantFrames {
+				want := sha256.Sum256(frame)
+				if !bytes.Equal(manifest.GetFrameHashes()[i], want[:]) {
+					t.Errorf("manifest().GetFrameHashes()[%v] = %x, want %x", i, manifest.GetFrameHashes()[i], want)
+				}
+			}
+		})
+	}
+}
+
+// encryptWithManifest encrypts `plaintext` with an integrity manifest,
+// returning the metadata and ciphertext separately.
+func encryptWithManifest(t *testing.T, stetClient *StetClient, stetConfig *configpb.StetConfig, plaintext []byte) ([]byte, []byte) {
+	t.Helper()
+
+	var metadataBuf, ciphertextBuf bytes.Buffer
+	if _, err := stetClient.EncryptWithSidecar(context.Background(), bytes.NewReader(plaintext), &metadataBuf, &ciphertextBuf, stetConfig, "", WithIntegrityManifest()); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+
+	return metadataBuf.Bytes(), ciphertextBuf.Bytes()
+}
+
+// rewriteMetadata applies `mutate` to the serialized metadata, returning the
+// re-serialized header and metadata.
+func rewriteMetadata(t *testing.T, metadataBytes []byte, mutate func(*configpb.Metadata)) []byte {
+	t.Helper()
+
+	metadata, err := ReadMetadata(bytes.NewReader(metadataBytes))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	mutate(metadata)
+
+	serialized, err := proto.Marshal(metadata)
+	if err != nil {
+		t.Fatalf("proto.Marshal returned error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSTETHeader(&buf, len(serialized)); err != nil {
+		t.Fatalf("WriteSTETHeader returned error: %v", err)
+	}
+	buf.Write(serialized)
+
+	return buf.Bytes()
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	plaintext := make([]byte, 2*aeadSegmentSize+1000)
+	metadata, ciphertext := encryptWithManifest(t, stetClient, stetConfig, plaintext)
+
+	corrupted := append([]byte{}, ciphertext...)
+	corrupted[aeadSegmentSize+10] ^= 1
+
+	var noManifest bytes.Buffer
+	if _, err := stetClient.Encrypt(context.Background(), bytes.NewReader(plaintext), &noManifest, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	withManifest := func(mutate func(*configpb.IntegrityManifest)) []byte {
+		forged := rewriteMetadata(t, metadata, func(md *configpb.Metadata) {
+			mutate(md.GetIntegrityManifest())
+		})
+		return append(forged, ciphertext...)
+	}
+
+	testcases := []struct {
+		name    string
+		blob    []byte
+		wantErr bool
+	}{
+		{
+			name: "Intact blob",
+			blob: append(append([]byte{}, metadata...), ciphertext...),
+		},
+		{
+			name:    "Corrupted frame",
+			blob:    append(append([]byte{}, metadata...), corrupted...),
+			wantErr: true,
+		},
+		{
+			name:    "Truncated ciphertext",
+			blob:    append(append([]byte{}, metadata...), ciphertext[:2*aeadSegmentSize]...),
+			wantErr: true,
+		},
+		{
+			name:    "Trailing data",
+			blob:    append(append(append([]byte{}, metadata...), ciphertext...), 0),
+			wantErr: true,
+		},
+		{
+			name:    "No integrity manifest",
+			blob:    noManifest.Bytes(),
+			wantErr: true,
+		},
+		{
+			name: "Frame size too small",
+			blob: withManifest(func(m *configpb.IntegrityManifest) {
+				m.FrameSize = 1
+			}),
+			wantErr: true,
+		},
+		{
+			name: "Frame size too large",
+			blob: withManifest(func(m *configpb.IntegrityManifest) {
+				m.FrameSize = aeadMaxSegmentSize + 1
+			}),
+			wantErr: true,
+		},
+		{
+			name: "Negative ciphertext length",
+			blob: withManifest(func(m *configpb.IntegrityManifest) {
+				m.CiphertextLength = -1
+			}),
+			wantErr: true,
+		},
+		{
+			name: "Too few frame hashes",
+			blob: withManifest(func(m *configpb.IntegrityManifest) {
+				m.FrameHashes = m.FrameHashes[:1]
+			}),
+			wantErr: true,
+		},
+		{
+			name: "Frame hashes for a longer ciphertext",
+			blob: withManifest(func(m *configpb.IntegrityManifest) {
+				m.FrameHashes = append(m.FrameHashes, m.FrameHashes[0])
+			}),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyIntegrity(bytes.NewReader(tc.blob))
+			if tc.wantErr && err == nil {
+				t.Error("VerifyIntegrity succeeded, want error")
+			} else if !tc.wantErr && err != nil {
+				t.Errorf("VerifyIntegrity returned error: %v", err)
+			}
+		})
+	}
+
+	t.Run("Sidecar", func(t *testing.T) {
+		if err := VerifyIntegrityWithSidecar(bytes.NewReader(metadata), bytes.NewReader(ciphertext)); err != nil {
+			t.Errorf("VerifyIntegrityWithSidecar returned error: %v", err)
+		}
+	})
+}
+
+func TestDecryptWithIntegrityManifest(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	plaintext := []byte("This is data to be encrypted.")
+	metadata, ciphertext := encryptWithManifest(t, stetClient, stetConfig, plaintext)
+
+	t.Run("Valid manifest", func(t *testing.T) {
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata), bytes.NewReader(ciphertext), &output, stetConfig); err != nil {
+			t.Fatalf("DecryptWithSidecar returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("DecryptWithSidecar returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+	})
+
+	testcases := []struct {
+		name   string
+		mutate func(*configpb.Metadata)
+	}{
+		{
+			name: "Modified frame hash",
+			mutate: func(md *configpb.Metadata) {
+				md.GetIntegrityManifest().GetFrameHashes()[0][0] ^= 1
+			},
+		},
+		{
+			name: "Modified ciphertext length",
+			mutate: func(md *configpb.Metadata) {
+				md.GetIntegrityManifest().CiphertextLength++
+			},
+		},
+		{
+			name: "Missing MAC",
+			mutate: func(md *configpb.Metadata) {
+				md.GetIntegrityManifest().Mac = nil
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			forged := rewriteMetadata(t, metadata, tc.mutate)
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext), &output, stetConfig); err == nil {
+				t.Error("DecryptWithSidecar succeeded with forged integrity manifest, want error")
+			}
+		})
+	}
+}
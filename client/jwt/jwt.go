@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
 
 	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/iam/credentials/apiv1"
@@ -43,18 +44,36 @@ func instanceIdentityToken(audience string) (string, error) {
 	return metadata.Get(fmt.Sprintf(instanceIdentityURL, audience))
 }
 
+// audienceForURL returns the audience for JWTs sent to the given EKM address:
+// its scheme and host, without the port. IPv6 literals keep their brackets.
+func audienceForURL(u *url.URL) string {
+	host := u.Hostname()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	return fmt.Sprintf("%v://%v", u.Scheme, host)
+}
+
+// TokenSource returns a signed JWT with the given audience.
+type TokenSource func(ctx context.Context, audience string) (string, error)
+
 // GenerateTokenWithAudience generates a JWT with the FQDN of the given
 // address as its audience.
 func GenerateTokenWithAudience(ctx context.Context, address string) (string, error) {
+	return TokenWithAudience(ctx, address, GenerateJWT)
+}
+
+// TokenWithAudience is like GenerateTokenWithAudience, but obtains the JWT
+// from `source`.
+func TokenWithAudience(ctx context.Context, address string, source TokenSource) (string, error) {
 	u, err := url.Parse(address)
 	if err != nil {
 		return "", fmt.Errorf("could not parse EKM address: %v", err)
 	}
 
-	audience := fmt.Sprintf("%v://%v", u.Scheme, u.Hostname())
-
 	var authToken string
-	if authToken, err = GenerateJWT(ctx, audience); err != nil {
+	if authToken, err = source(ctx, audienceForURL(u)); err != nil {
 		return "", fmt.Errorf("failed to generate JWT: %v", err)
 	}
 
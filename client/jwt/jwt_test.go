@@ -0,0 +1,67 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTokenWithAudience(t *testing.T) {
+	testcases := []struct {
+		name         string
+		address      string
+		wantAudience string
+	}{
+		{
+			name:         "Hostname",
+			address:      "https://test.ekm.io",
+			wantAudience: "https://test.ekm.io",
+		},
+		{
+			name:         "Hostname with port",
+			address:      "https://test.ekm.io:8443",
+			wantAudience: "https://test.ekm.io",
+		},
+		{
+			name:         "IPv6 literal",
+			address:      "https://[2001:db8::1]",
+			wantAudience: "https://[2001:db8::1]",
+		},
+		{
+			name:         "IPv6 literal with port",
+			address:      "https://[2001:db8::1]:8443",
+			wantAudience: "https://[2001:db8::1]",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotAudience string
+			source := func(_ context.Context, audience string) (string, error) {
+				gotAudience = audience
+				return "token", nil
+			}
+
+			if _, err := TokenWithAudience(context.Background(), tc.address, source); err != nil {
+				t.Fatalf("TokenWithAudience(%v) returned error: %v", tc.address, err)
+			}
+
+			if gotAudience != tc.wantAudience {
+				t.Errorf("TokenWithAudience(%v) requested audience %v, want %v", tc.address, gotAudience, tc.wantAudience)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+)
+
+// keyCommitmentLabel is the fixed string MACed under the DEK to commit to it.
+const keyCommitmentLabel = "STET DEK commitment"
+
+// keyCommitment returns the HMAC-SHA256 of keyCommitmentLabel under the DEK.
+func keyCommitment(key shares.DEK) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(keyCommitmentLabel))
+	return mac.Sum(nil)
+}
+
+// ErrKeyCommitmentMismatch is returned by Decrypt if the DEK reconstructed from
+// the shares does not match the key commitment of a blob encrypted
+// WithKeyCommitment, for example because the shares were combined to the wrong
+// value. It is distinct from an authentication failure of the ciphertext,
+// which is reported if the DEK is correct but the ciphertext was corrupted.
+var ErrKeyCommitmentMismatch = errors.New("reconstructed key does not match the key commitment in the metadata")
+
+// checkKeyCommitment verifies that `commitment` was computed from the DEK.
+func checkKeyCommitment(key shares.DEK, commitment []byte) error {
+	if !hmac.Equal(commitment, keyCommitment(key)) {
+		return fmt.Errorf("%w: the shares were unwrapped with the wrong keys or have been modified", ErrKeyCommitmentMismatch)
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+func TestDecryptWithKeyCommitment(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	plaintext := []byte("This is data to be encrypted.")
+
+	encrypt := func(opts ...CallOption) ([]byte, []byte) {
+		var metadataBuf, ciphertextBuf bytes.Buffer
+		if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertextBuf, stetConfig, "blob", opts...); err != nil {
+			t.Fatalf("EncryptWithSidecar returned error: %v", err)
+		}
+		return metadataBuf.Bytes(), ciphertextBuf.Bytes()
+	}
+
+	metadata, ciphertext := encrypt(WithKeyCommitment())
+	otherMetadata, _ := encrypt(WithKeyCommitment())
+
+	other, err := ReadMetadata(bytes.NewReader(otherMetadata))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	t.Run("Valid commitment", func(t *testing.T) {
+		md, err := ReadMetadata(bytes.NewReader(metadata))
+		if err != nil {
+			t.Fatalf("ReadMetadata returned error: %v", err)
+		}
+
+		if len(md.GetKeyCommitment()) == 0 {
+			t.Fatal("Metadata has no key commitment")
+		}
+
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata), bytes.NewReader(ciphertext), &output, stetConfig); err != nil {
+			t.Fatalf("DecryptWithSidecar returned error: %v", err)
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("DecryptWithSidecar returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+	})
+
+	testcases := []struct {
+		name        string
+		mutate      func(*configpb.Metadata)
+		wantErrText string
+	}{
+		{
+			name: "Shares of another DEK",
+			mutate: func(md *configpb.Metadata) {
+				md.Shares = other.GetShares()
+			},
+			wantErrText: "reconstructed key does not match",
+		},
+		{
+			name: "Modified commitment",
+			mutate: func(md *configpb.Metadata) {
+				md.GetKeyCommitment()[0] ^= 1
+			},
+			wantErrText: "reconstructed key does not match",
+		},
+		{
+			name: "Removed commitment",
+			mutate: func(md *configpb.Metadata) {
+				md.KeyCommitment = nil
+			},
+			wantErrText: "error decrypting data",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			forged := rewriteMetadata(t, metadata, tc.mutate)
+
+			var output bytes.Buffer
+			_, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext), &output, stetConfig)
+			if err == nil {
+				t.Fatal("DecryptWithSidecar succeeded with forged metadata, want error")
+			}
+
+			if !strings.Contains(err.Error(), tc.wantErrText) {
+				t.Errorf("DecryptWithSidecar returned error %q, want it to contain %q", err, tc.wantErrText)
+			}
+		})
+	}
+
+}
+
+func TestKeyCommitmentMixedShares(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+
+	plaintext := []byte("This is data to be encrypted.")
+
+	testcases := []struct {
+		name string
+		opts []CallOption
+		// Whether the mismatch is caught by the key commitment, rather than
+		// reported as an authentication failure of the ciphertext.
+		wantMismatch bool
+	}{
+		{
+			name:         "With key commitment",
+			opts:         []CallOption{WithKeyCommitment()},
+			wantMismatch: true,
+		},
+		{
+			name:         "Without key commitment",
+			wantMismatch: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var metadata, ciphertext, otherMetadata bytes.Buffer
+			if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadata, &ciphertext, stetConfig, "blob", tc.opts...); err != nil {
+				t.Fatalf("EncryptWithSidecar returned error: %v", err)
+			}
+			if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &otherMetadata, io.Discard, stetConfig, "blob", tc.opts...); err != nil {
+				t.Fatalf("EncryptWithSidecar returned error: %v", err)
+			}
+
+			other, err := ReadMetadata(bytes.NewReader(otherMetadata.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+
+			// Each share, along with its hash, is valid, so every share
+			// unwraps and validates, but together they combine to neither
+			// blob's DEK.
+			forged := rewriteMetadata(t, metadata.Bytes(), func(md *configpb.Metadata) {
+				md.GetShares()[1] = other.GetShares()[1]
+			})
+
+			_, err = stetClient.DecryptWithSidecar(ctx, bytes.NewReader(forged), bytes.NewReader(ciphertext.Bytes()), io.Discard, stetConfig)
+			if err == nil {
+				t.Fatal("DecryptWithSidecar succeeded with mixed shares, want error")
+			}
+			if got := errors.Is(err, ErrKeyCommitmentMismatch); got != tc.wantMismatch {
+				t.Errorf("DecryptWithSidecar returned error %q, errors.Is(err, ErrKeyCommitmentMismatch) = %v, want %v", err, got, tc.wantMismatch)
+			}
+
+			// With the correct shares, a corrupted ciphertext is reported as
+			// such rather than as a wrong key.
+			corrupted := bytes.Clone(ciphertext.Bytes())
+			corrupted[len(corrupted)-1] ^= 1
+			_, err = stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata.Bytes()), bytes.NewReader(corrupted), io.Discard, stetConfig)
+			if err == nil {
+				t.Fatal("DecryptWithSidecar succeeded with corrupted ciphertext, want error")
+			}
+			if errors.Is(err, ErrKeyCommitmentMismatch) {
+				t.Errorf("DecryptWithSidecar returned error %q for corrupted ciphertext, want an error other than ErrKeyCommitmentMismatch", err)
+			}
+		})
+	}
+}
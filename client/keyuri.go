@@ -0,0 +1,109 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cryptoKeyNameParts are the fixed collection segments of a Cloud KMS
+// CryptoKey resource name, "projects/*/locations/*/keyRings/*/cryptoKeys/*".
+var cryptoKeyNameParts = []string{"projects", "locations", "keyRings", "cryptoKeys"}
+
+// validateCryptoKeyName returns an error if `name` is not a well-formed Cloud
+// KMS CryptoKey resource name.
+func validateCryptoKeyName(name string) error {
+	segments := strings.Split(name, "/")
+	if len(segments) != 2*len(cryptoKeyNameParts) {
+		return fmt.Errorf("%q is not a CryptoKey resource name, want the format projects/*/locations/*/keyRings/*/cryptoKeys/*", name)
+	}
+
+	for i, part := range cryptoKeyNameParts {
+		if segments[2*i] != part {
+			return fmt.Errorf("%q is not a CryptoKey resource name: found %q, want %q", name, segments[2*i], part)
+		}
+		if segments[2*i+1] == "" {
+			return fmt.Errorf("%q is not a CryptoKey resource name: empty %v ID", name, part)
+		}
+	}
+
+	return nil
+}
+
+// cryptoKeyVersionsPart is the collection segment of a CryptoKeyVersion
+// resource name following its CryptoKey, as in
+// "projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*".
+const cryptoKeyVersionsPart = "cryptoKeyVersions"
+
+// splitCryptoKeyVersion returns the name of the CryptoKey that the resource
+// `name` refers to, and whether `name` is pinned to one of its
+// CryptoKeyVersions.
+func splitCryptoKeyVersion(name string) (string, bool) {
+	segments := strings.Split(name, "/")
+	n := 2 * len(cryptoKeyNameParts)
+	if len(segments) != n+2 || segments[n] != cryptoKeyVersionsPart || segments[n+1] == "" {
+		return name, false
+	}
+
+	return strings.Join(segments[:n], "/"), true
+}
+
+// kekLocation returns the location of the Cloud KMS KEK with the given
+// Tink-format URI, which may be pinned to a version.
+func kekLocation(uri string) (string, error) {
+	if !strings.HasPrefix(uri, gcpKeyPrefix) {
+		return "", fmt.Errorf("%q does not have the expected URI prefix, want %v", uri, gcpKeyPrefix)
+	}
+
+	name, _ := splitCryptoKeyVersion(strings.TrimPrefix(uri, gcpKeyPrefix))
+	if err := validateCryptoKeyName(name); err != nil {
+		return "", err
+	}
+
+	// The location ID follows "projects/*/locations/".
+	return strings.Split(name, "/")[3], nil
+}
+
+// ToResourceName converts a Tink-format Cloud KMS key URI, such as
+// "gcp-kms://projects/p/locations/l/keyRings/r/cryptoKeys/k", to the bare
+// resource name used in Cloud KMS requests.
+func ToResourceName(uri string) (string, error) {
+	if !strings.HasPrefix(uri, gcpKeyPrefix) {
+		return "", fmt.Errorf("%q does not have the expected URI prefix, want %v", uri, gcpKeyPrefix)
+	}
+
+	name := strings.TrimPrefix(uri, gcpKeyPrefix)
+	if err := validateCryptoKeyName(name); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// ToTinkURI converts a Cloud KMS CryptoKey resource name, such as
+// "projects/p/locations/l/keyRings/r/cryptoKeys/k", to the Tink-format key
+// URI used in STET configs.
+func ToTinkURI(resourceName string) (string, error) {
+	if strings.HasPrefix(resourceName, gcpKeyPrefix) {
+		return "", fmt.Errorf("%q is already a key URI, want a bare resource name", resourceName)
+	}
+
+	if err := validateCryptoKeyName(resourceName); err != nil {
+		return "", err
+	}
+
+	return gcpKeyPrefix + resourceName, nil
+}
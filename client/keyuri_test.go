@@ -0,0 +1,122 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"testing"
+)
+
+const testResourceName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+func TestKeyURIRoundTrip(t *testing.T) {
+	uri, err := ToTinkURI(testResourceName)
+	if err != nil {
+		t.Fatalf("ToTinkURI(%q) returned error: %v", testResourceName, err)
+	}
+
+	if want := "gcp-kms://" + testResourceName; uri != want {
+		t.Errorf("ToTinkURI(%q) = %q, want %q", testResourceName, uri, want)
+	}
+
+	name, err := ToResourceName(uri)
+	if err != nil {
+		t.Fatalf("ToResourceName(%q) returned error: %v", uri, err)
+	}
+
+	if name != testResourceName {
+		t.Errorf("ToResourceName(%q) = %q, want %q", uri, name, testResourceName)
+	}
+}
+
+func TestToResourceNameMalformed(t *testing.T) {
+	testcases := []struct {
+		name string
+		uri  string
+	}{
+		{name: "Missing prefix", uri: testResourceName},
+		{name: "Wrong scheme", uri: "aws-kms://" + testResourceName},
+		{name: "Empty", uri: ""},
+		{name: "Prefix only", uri: "gcp-kms://"},
+		{name: "Key ring", uri: "gcp-kms://projects/p/locations/global/keyRings/r"},
+		{name: "Key version", uri: "gcp-kms://" + testResourceName + "/cryptoKeyVersions/1"},
+		{name: "Empty key ID", uri: "gcp-kms://projects/p/locations/global/keyRings/r/cryptoKeys/"},
+		{name: "Misspelled collection", uri: "gcp-kms://projects/p/locations/global/keyrings/r/cryptoKeys/k"},
+		{name: "Double prefix", uri: "gcp-kms://gcp-kms://" + testResourceName},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if name, err := ToResourceName(tc.uri); err == nil {
+				t.Errorf("ToResourceName(%q) = %q, want error", tc.uri, name)
+			}
+		})
+	}
+}
+
+func TestToTinkURIMalformed(t *testing.T) {
+	testcases := []struct {
+		name         string
+		resourceName string
+	}{
+		{name: "Already a URI", resourceName: "gcp-kms://" + testResourceName},
+		{name: "Empty", resourceName: ""},
+		{name: "Leading slash", resourceName: "/" + testResourceName},
+		{name: "Trailing slash", resourceName: testResourceName + "/"},
+		{name: "Empty project", resourceName: "projects//locations/global/keyRings/r/cryptoKeys/k"},
+		{name: "Missing key", resourceName: "projects/p/locations/global/keyRings/r"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if uri, err := ToTinkURI(tc.resourceName); err == nil {
+				t.Errorf("ToTinkURI(%q) = %q, want error", tc.resourceName, uri)
+			}
+		})
+	}
+}
+
+func TestKEKLocation(t *testing.T) {
+	testcases := []struct {
+		name    string
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{name: "CryptoKey", uri: "gcp-kms://projects/p/locations/us-east1/keyRings/r/cryptoKeys/k", want: "us-east1"},
+		{name: "Pinned version", uri: "gcp-kms://projects/p/locations/europe/keyRings/r/cryptoKeys/k/cryptoKeyVersions/3", want: "europe"},
+		{name: "Missing prefix", uri: "projects/p/locations/us-east1/keyRings/r/cryptoKeys/k", wantErr: true},
+		{name: "Key ring", uri: "gcp-kms://projects/p/locations/us-east1/keyRings/r", wantErr: true},
+		{name: "Empty location", uri: "gcp-kms://projects/p/locations//keyRings/r/cryptoKeys/k", wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := kekLocation(tc.uri)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("kekLocation(%q) = %q, want error", tc.uri, got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("kekLocation(%q) returned error: %v", tc.uri, err)
+			}
+			if got != tc.want {
+				t.Errorf("kekLocation(%q) = %q, want %q", tc.uri, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/stet/client/requestid"
+	glog "github.com/golang/glog"
+)
+
+// Logger is the interface through which StetClient logs messages.
+type Logger interface {
+	Infof(format string, args ...any)
+	Warningf(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// glogLogger is the default Logger, which logs via glog.
+type glogLogger struct{}
+
+func (glogLogger) Infof(format string, args ...any) {
+	glog.InfoDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Warningf(format string, args ...any) {
+	glog.WarningDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Errorf(format string, args ...any) {
+	glog.ErrorDepth(1, fmt.Sprintf(format, args...))
+}
+
+// prefixLogger prepends a fixed prefix to all messages.
+type prefixLogger struct {
+	Logger
+	prefix string
+}
+
+func (l prefixLogger) Infof(format string, args ...any) {
+	l.Logger.Infof(l.prefix+format, args...)
+}
+
+func (l prefixLogger) Warningf(format string, args ...any) {
+	l.Logger.Warningf(l.prefix+format, args...)
+}
+
+func (l prefixLogger) Errorf(format string, args ...any) {
+	l.Logger.Errorf(l.prefix+format, args...)
+}
+
+// WithRequestID returns a copy of ctx carrying the given request ID. STET
+// includes the ID in its log messages, and in requests to Cloud KMS and
+// external EKMs made with the context.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return requestid.NewContext(ctx, id)
+}
+
+// logger returns the Logger to use for operations with the given context.
+func (c *StetClient) logger(ctx context.Context) Logger {
+	var l Logger = glogLogger{}
+	if c.Logger != nil {
+		l = c.Logger
+	}
+
+	if id := requestid.FromContext(ctx); id != "" {
+		// Escape the ID, as the prefix becomes part of the format string.
+		return prefixLogger{Logger: l, prefix: "[request " + strings.ReplaceAll(id, "%", "%%") + "] "}
+	}
+
+	return l
+}
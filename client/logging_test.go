@@ -0,0 +1,177 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	kmsrpb "cloud.google.com/go/kms/apiv1/kmspb"
+	kmsspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// captureLogger is a Logger that records all messages.
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) logf(level, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Infof(format string, args ...any)    { l.logf("INFO", format, args...) }
+func (l *captureLogger) Warningf(format string, args ...any) { l.logf("WARNING", format, args...) }
+func (l *captureLogger) Errorf(format string, args ...any)   { l.logf("ERROR", format, args...) }
+
+func TestRequestIDInLogs(t *testing.T) {
+	testCases := []struct {
+		name       string
+		requestID  string
+		wantPrefix string
+	}{
+		{
+			name:       "Request ID",
+			requestID:  "test-request-id",
+			wantPrefix: "[request test-request-id] ",
+		},
+		{
+			name:       "Request ID with formatting directive",
+			requestID:  "100%v",
+			wantPrefix: "[request 100%v] ",
+		},
+	}
+
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &captureLogger{}
+			stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, Logger: logger}
+
+			ctx := WithRequestID(context.Background(), tc.requestID)
+
+			var ciphertext bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, ""); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			if _, err := stetClient.Decrypt(ctx, &ciphertext, &bytes.Buffer{}, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if len(logger.lines) == 0 {
+				t.Fatalf("No messages were logged")
+			}
+
+			for _, line := range logger.lines {
+				if !strings.Contains(line, tc.wantPrefix) {
+					t.Errorf("Logged message %q does not contain request ID prefix %q", line, tc.wantPrefix)
+				}
+			}
+		})
+	}
+}
+
+func TestNoRequestIDInLogs(t *testing.T) {
+	logger := &captureLogger{}
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, Logger: logger}
+	stetConfig := newFakeKMSConfig(1)
+
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(context.Background(), bytes.NewReader([]byte("data")), &ciphertext, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	if _, err := stetClient.Decrypt(context.Background(), &ciphertext, &bytes.Buffer{}, stetConfig); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	for _, line := range logger.lines {
+		if strings.Contains(line, "[request") {
+			t.Errorf("Logged message %q contains a request ID prefix, want none", line)
+		}
+	}
+}
+
+// keyFailingKMS is a FakeKMS that fails to decrypt with a single key.
+type keyFailingKMS struct {
+	*stettest.FakeKMS
+	failKey string
+}
+
+func (k *keyFailingKMS) Decrypt(ctx context.Context, req *kmsspb.DecryptRequest, opts ...gax.CallOption) (*kmsspb.DecryptResponse, error) {
+	if req.GetName() == k.failKey {
+		return nil, fmt.Errorf("key %v is unavailable", k.failKey)
+	}
+	return k.FakeKMS.Decrypt(ctx, req, opts...)
+}
+
+func TestCombinedSharesLogged(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(3)
+	stetConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 2
+
+	keyURI := func(i int) string {
+		return stetConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[i].GetKekUri()
+	}
+
+	fakeKMS := &stettest.FakeKMS{ProtectionLevel: kmsrpb.ProtectionLevel_HSM}
+	stetClient := &StetClient{KMSClient: fakeKMS}
+
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("data")), &ciphertext, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	logger := &captureLogger{}
+	stetClient = &StetClient{
+		KMSClient: &keyFailingKMS{FakeKMS: fakeKMS, failKey: strings.TrimPrefix(keyURI(1), gcpKeyPrefix)},
+		Logger:    logger,
+	}
+
+	var report DecryptReport
+	if _, err := stetClient.Decrypt(ctx, &ciphertext, &bytes.Buffer{}, stetConfig, WithDecryptReport(&report)); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	// Only the shares unwrapped without error are combined.
+	var combined []string
+	for _, share := range report.Shares {
+		if share.Err == nil {
+			combined = append(combined, fmt.Sprintf("#%v (KEK URI %v, unwrapped with %v, protection level HSM)", share.Index+1, keyURI(share.Index), keyURI(share.Index)))
+		}
+	}
+	if len(combined) != 2 {
+		t.Fatalf("Decrypt combined %v shares, want 2", len(combined))
+	}
+
+	want := fmt.Sprintf("INFO: Reconstructed DEK of blob %q from 2 of 3 shares: %v", "blob", strings.Join(combined, ", "))
+	for _, line := range logger.lines {
+		if line == want {
+			return
+		}
+	}
+	t.Errorf("Decrypt did not log the combined shares, want %q in logged messages %q", want, logger.lines)
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"time"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// Operation identifies a call to Cloud KMS or an external EKM whose latency is
+// reported to Metrics.
+type Operation string
+
+const (
+	// OperationWrap is wrapping a share with a KEK in Cloud KMS or an
+	// external EKM. For external KEKs, this includes OperationSession.
+	OperationWrap Operation = "wrap"
+	// OperationUnwrap is unwrapping a share with a KEK in Cloud KMS or an
+	// external EKM. For external KEKs, this includes OperationSession.
+	OperationUnwrap Operation = "unwrap"
+	// OperationSession is establishing a secure session with an external EKM.
+	OperationSession Operation = "session"
+)
+
+// Metrics is the interface through which StetClient reports the latency of
+// its calls to Cloud KMS and external EKMs, for example to record them in
+// histograms for setting SLOs. Its methods may be called concurrently.
+type Metrics interface {
+	// ObserveLatency records that `op` with a KEK of protection level `pl`
+	// took `d`, and failed with `err` if it is non-nil.
+	ObserveLatency(op Operation, pl rpb.ProtectionLevel, d time.Duration, err error)
+}
+
+// noObservation is returned by observe if no Metrics is set.
+func noObservation(error) {}
+
+// observe starts timing `op` with a KEK of protection level `pl`, returning a
+// function that reports the time elapsed and the outcome to the client's
+// Metrics. If the client has no Metrics, the clock is not read at all.
+func (c *StetClient) observe(op Operation, pl rpb.ProtectionLevel) func(err error) {
+	if c.Metrics == nil {
+		return noObservation
+	}
+
+	start := time.Now()
+	return func(err error) {
+		c.Metrics.ObserveLatency(op, pl, time.Since(start), err)
+	}
+}
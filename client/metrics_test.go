@@ -0,0 +1,202 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"github.com/GoogleCloudPlatform/stet/client/testutil"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/go-cmp/cmp"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// observation is a latency observed by fakeMetrics, without the duration.
+type observation struct {
+	Op     Operation
+	PL     rpb.ProtectionLevel
+	Failed bool
+}
+
+// fakeMetrics records the latencies observed through it.
+type fakeMetrics struct {
+	mu           sync.Mutex
+	observations []observation
+	durations    []time.Duration
+}
+
+func (f *fakeMetrics) ObserveLatency(op Operation, pl rpb.ProtectionLevel, d time.Duration, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.observations = append(f.observations, observation{Op: op, PL: pl, Failed: err != nil})
+	f.durations = append(f.durations, d)
+}
+
+// reset returns the observations recorded so far, and clears them.
+func (f *fakeMetrics) reset() ([]observation, []time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	observations, durations := f.observations, f.durations
+	f.observations, f.durations = nil, nil
+	return observations, durations
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	const ekmLatency = 10 * time.Millisecond
+
+	// A single externally protected KEK, whose EKM is given by the test case.
+	ekmConfig := &configpb.StetConfig{
+		EncryptConfig: &configpb.EncryptConfig{KeyConfig: &configpb.KeyConfig{
+			KekInfos:              []*configpb.KekInfo{{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()}}},
+			DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+			KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+		}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+	ekmConfig.DecryptConfig = &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{ekmConfig.GetEncryptConfig().GetKeyConfig()}}
+	ekmClient := func(session *testutil.FakeSecureSessionClient) *StetClient {
+		return &StetClient{
+			testKMSClients: &cloudkms.ClientFactory{
+				CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+			},
+			testSecureSessionClient: session,
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		stetClient  *StetClient
+		stetConfig  *configpb.StetConfig
+		wantEncrypt []observation
+		wantDecrypt []observation
+	}{
+		{
+			name:       "Software KEKs",
+			stetClient: &StetClient{KMSClient: &stettest.FakeKMS{}},
+			stetConfig: newFakeKMSConfig(2),
+			wantEncrypt: []observation{
+				{Op: OperationWrap, PL: rpb.ProtectionLevel_SOFTWARE},
+				{Op: OperationWrap, PL: rpb.ProtectionLevel_SOFTWARE},
+			},
+			wantDecrypt: []observation{
+				{Op: OperationUnwrap, PL: rpb.ProtectionLevel_SOFTWARE},
+				{Op: OperationUnwrap, PL: rpb.ProtectionLevel_SOFTWARE},
+			},
+		},
+		{
+			name:       "HSM KEK",
+			stetClient: &StetClient{KMSClient: &stettest.FakeKMS{ProtectionLevel: rpb.ProtectionLevel_HSM}},
+			stetConfig: newFakeKMSConfig(1),
+			wantEncrypt: []observation{
+				{Op: OperationWrap, PL: rpb.ProtectionLevel_HSM},
+			},
+			wantDecrypt: []observation{
+				{Op: OperationUnwrap, PL: rpb.ProtectionLevel_HSM},
+			},
+		},
+		{
+			name:       "External KEK",
+			stetClient: ekmClient(&testutil.FakeSecureSessionClient{Latency: ekmLatency}),
+			stetConfig: ekmConfig,
+			wantEncrypt: []observation{
+				{Op: OperationSession, PL: rpb.ProtectionLevel_EXTERNAL},
+				{Op: OperationWrap, PL: rpb.ProtectionLevel_EXTERNAL},
+			},
+			wantDecrypt: []observation{
+				{Op: OperationSession, PL: rpb.ProtectionLevel_EXTERNAL},
+				{Op: OperationUnwrap, PL: rpb.ProtectionLevel_EXTERNAL},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := &fakeMetrics{}
+			tc.stetClient.Metrics = metrics
+
+			var blob bytes.Buffer
+			if _, err := tc.stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, tc.stetConfig, "blob"); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			observations, durations := metrics.reset()
+			if diff := cmp.Diff(tc.wantEncrypt, observations); diff != "" {
+				t.Errorf("Encrypt observed unexpected latencies (-want +got):\n%s", diff)
+			}
+			checkLatencies(t, observations, durations, ekmLatency)
+
+			if _, err := tc.stetClient.Decrypt(ctx, bytes.NewReader(blob.Bytes()), io.Discard, tc.stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			observations, durations = metrics.reset()
+			if diff := cmp.Diff(tc.wantDecrypt, observations); diff != "" {
+				t.Errorf("Decrypt observed unexpected latencies (-want +got):\n%s", diff)
+			}
+			checkLatencies(t, observations, durations, ekmLatency)
+		})
+	}
+
+	t.Run("Failed unwrap", func(t *testing.T) {
+		var blob bytes.Buffer
+		if _, err := ekmClient(&testutil.FakeSecureSessionClient{}).Encrypt(ctx, bytes.NewReader(plaintext), &blob, ekmConfig, "blob"); err != nil {
+			t.Fatalf("Encrypt returned error: %v", err)
+		}
+
+		metrics := &fakeMetrics{}
+		stetClient := ekmClient(&testutil.FakeSecureSessionClient{UnwrapErr: errors.New("EKM unavailable")})
+		stetClient.Metrics = metrics
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob.Bytes()), io.Discard, ekmConfig); err == nil {
+			t.Fatal("Decrypt succeeded with a failing EKM, want error")
+		}
+
+		want := []observation{
+			{Op: OperationSession, PL: rpb.ProtectionLevel_EXTERNAL},
+			{Op: OperationUnwrap, PL: rpb.ProtectionLevel_EXTERNAL, Failed: true},
+		}
+		observations, _ := metrics.reset()
+		if diff := cmp.Diff(want, observations); diff != "" {
+			t.Errorf("Decrypt observed unexpected latencies (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// checkLatencies checks that the wrap and unwrap operations with external KEKs
+// took at least the latency of the fake EKM.
+func checkLatencies(t *testing.T, observations []observation, durations []time.Duration, ekmLatency time.Duration) {
+	t.Helper()
+
+	for i, o := range observations {
+		if o.PL != rpb.ProtectionLevel_EXTERNAL || o.Op == OperationSession {
+			continue
+		}
+		if durations[i] < ekmLatency {
+			t.Errorf("Observed %v latency of %v, want at least the EKM latency of %v", o.Op, durations[i], ekmLatency)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// MigrateRSAShare moves the share of a STET-encrypted blob that is wrapped
+// with the RSA key with the given fingerprint to the Cloud KMS KEK `kekURI`,
+// such as when moving from self-managed RSA keys to Cloud KMS. The DEK is
+// recovered using the DecryptConfig of `stetConfig`, whose AsymmetricKeys
+// must hold the RSA private key. The share is then unwrapped with the private
+// key and rewrapped with the new KEK, and the blob is written to `output` with
+// the same DEK and blob ID, and with the share and its KekInfo replaced. The
+// other wrapped shares are copied unchanged.
+//
+// As the wrapped shares are bound into the AAD of the ciphertext, the
+// ciphertext is re-encrypted with the unchanged DEK under the new AAD, as
+// with Resplit. The migrated KeyConfig must be present in the DecryptConfig
+// for the new blob to be decrypted. On error, `output` may contain a partial
+// blob and should be discarded.
+//
+// Returns the URIs of the keys used to wrap the new share.
+func (c *StetClient) MigrateRSAShare(ctx context.Context, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig, fingerprint, kekURI string, opts ...CallOption) (*StetMetadata, error) {
+	callOpts := c.newCallOptions(opts)
+
+	if !strings.HasPrefix(kekURI, gcpKeyPrefix) {
+		return nil, fmt.Errorf("KEK URI %q does not have the expected URI prefix, want %v", kekURI, gcpKeyPrefix)
+	}
+
+	metadata, err := ReadMetadata(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	segmentSize, err := metadataSegmentSize(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	keks := metadata.GetKeyConfig().GetKekInfos()
+	index := -1
+	for i, kek := range keks {
+		if kek.GetRsaFingerprint() == fingerprint {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("blob has no share wrapped with RSA fingerprint %v", fingerprint)
+	}
+
+	dek, _, err := c.recoverDEK(ctx, metadata, stetConfig, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := MetadataToAAD(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing metadata: %v", err)
+	}
+
+	ordered, err := orderSharesByKEK(metadata.GetShares(), len(keks))
+	if err != nil {
+		return nil, err
+	}
+	oldShare := ordered[index]
+
+	kmsClients, release := c.kmsClientFactory(ctx)
+	defer release()
+
+	shareOpts := sharesOpts{
+		asymmetricKeys:  stetConfig.GetAsymmetricKeys(),
+		confSpaceConfig: c.newConfSpaceConfig(stetConfig),
+		fips:            c.FIPSMode,
+		hashAlgorithm:   oldShare.GetHashAlgorithm(),
+		requireImported: callOpts.requireImportedKEKs,
+		rsaKeyFallback:  callOpts.rsaKeyFallback,
+		kekAAD:          shareContextAAD(metadata.GetBlobId(), callOpts.shareContext),
+		skipTLSVerify:   callOpts.insecureSkipVerify,
+		ekmSessions:     callOpts.ekmSessions,
+		rand:            callOpts.rand,
+	}
+
+	unwrapped, _, err := c.unwrapAndValidateShare(ctx, kmsClients, oldShare, keks[index], shareOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping share for RSA fingerprint %v: %v", fingerprint, err)
+	}
+
+	newKEK := &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: kekURI}}
+	newShare, keyURIs, err := c.wrapShare(ctx, kmsClients, unwrapped.Share, newKEK, shareOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping share with %v: %w", kekURI, err)
+	}
+	newShare.KekIndex = oldShare.GetKekIndex()
+
+	// Replace the share and its KekInfo, keeping the order of both. The
+	// integrity manifest covers the old ciphertext, so it is recomputed.
+	migrated := proto.Clone(metadata).(*configpb.Metadata)
+	migrated.GetKeyConfig().GetKekInfos()[index] = newKEK
+	for i, share := range metadata.GetShares() {
+		if share == oldShare {
+			migrated.GetShares()[i] = newShare
+		}
+	}
+	migrated.IntegrityManifest = nil
+
+	if c.FIPSMode {
+		if err := checkFIPSKeyConfig(migrated.GetKeyConfig()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the features of the blob when choosing the format version.
+	sealOpts := resealOptions(metadata, callOpts)
+	sealOpts.shareHashAlgorithm = oldShare.GetHashAlgorithm()
+
+	formatVersion, err := encryptFormatVersion(migrated.GetKeyConfig(), sealOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt the existing ciphertext into a pipe that is read as the
+	// plaintext for the new blob.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(aeadDecrypt(dek, segmentSize, input, pw, aad))
+	}()
+	defer pr.Close()
+
+	if err := sealBlob(dek, migrated, segmentSize, formatVersion, pr, output, output, sealOpts); err != nil {
+		return nil, err
+	}
+
+	return &StetMetadata{
+		KeyUris: keyURIs,
+		BlobID:  migrated.GetBlobId(),
+	}, nil
+}
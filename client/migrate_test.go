@@ -0,0 +1,133 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMigrateRSAShare(t *testing.T) {
+	ctx := context.Background()
+	keys, fingerprint := writeRSAKeyPair(t, 2048)
+	kmsURI := "gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/kept"
+	newURI := "gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/migrated"
+
+	keyConfig := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{
+			{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint}},
+			{KekType: &configpb.KekInfo_KekUri{KekUri: kmsURI}},
+		},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 2}},
+	}
+	migratedKeyConfig := proto.Clone(keyConfig).(*configpb.KeyConfig)
+	migratedKeyConfig.GetKekInfos()[0] = &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: newURI}}
+
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: keys,
+	}
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob", WithIntegrityManifest()); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	oldMetadata, err := ReadMetadata(bytes.NewReader(blob.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	var migrated bytes.Buffer
+	md, err := stetClient.MigrateRSAShare(ctx, bytes.NewReader(blob.Bytes()), &migrated, stetConfig, fingerprint, newURI)
+	if err != nil {
+		t.Fatalf("MigrateRSAShare returned error: %v", err)
+	}
+
+	if len(md.KeyUris) != 1 || md.KeyUris[0] != newURI {
+		t.Errorf("MigrateRSAShare returned key URIs %v, want [%v]", md.KeyUris, newURI)
+	}
+
+	newMetadata, err := ReadMetadata(bytes.NewReader(migrated.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	if !proto.Equal(newMetadata.GetKeyConfig(), migratedKeyConfig) {
+		t.Errorf("MigrateRSAShare wrote KeyConfig %v, want %v", newMetadata.GetKeyConfig(), migratedKeyConfig)
+	}
+
+	if !proto.Equal(newMetadata.GetShares()[1], oldMetadata.GetShares()[1]) {
+		t.Errorf("MigrateRSAShare changed the share wrapped with %v", kmsURI)
+	}
+
+	if newMetadata.GetBlobId() != "blob" {
+		t.Errorf("MigrateRSAShare wrote blob ID %q, want %q", newMetadata.GetBlobId(), "blob")
+	}
+
+	// The migrated blob decrypts without the RSA private key.
+	decryptConfig := &configpb.StetConfig{
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{migratedKeyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	if err := VerifyIntegrity(bytes.NewReader(migrated.Bytes())); err != nil {
+		t.Errorf("VerifyIntegrity of migrated blob returned error: %v", err)
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, bytes.NewReader(migrated.Bytes()), &output, decryptConfig); err != nil {
+		t.Fatalf("Decrypt of migrated blob returned error: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt of migrated blob returned plaintext %v, want %v", output.Bytes(), plaintext)
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		testcases := []struct {
+			name        string
+			fingerprint string
+			kekURI      string
+		}{
+			{
+				name:        "Unknown fingerprint",
+				fingerprint: "not a real fingerprint",
+				kekURI:      newURI,
+			},
+			{
+				name:        "Not a Cloud KMS KEK",
+				fingerprint: fingerprint,
+				kekURI:      "https://my-kms.io/external-key",
+			},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				if _, err := stetClient.MigrateRSAShare(ctx, bytes.NewReader(blob.Bytes()), &bytes.Buffer{}, stetConfig, tc.fingerprint, tc.kekURI); err == nil {
+					t.Error("MigrateRSAShare succeeded, want error")
+				}
+			})
+		}
+	})
+}
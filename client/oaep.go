@@ -0,0 +1,79 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// oaepHash returns a new hash of the function selected by the RSA-OAEP
+// parameters, which is SHA-256 if they are unset. SHA-1 is rejected if `fips`
+// is set.
+func oaepHash(params *configpb.RsaOaepParams, fips bool) (hash.Hash, error) {
+	switch alg := params.GetHash(); alg {
+	case configpb.OaepHash_DEFAULT_OAEP_HASH, configpb.OaepHash_OAEP_SHA256:
+		return sha256.New(), nil
+	case configpb.OaepHash_OAEP_SHA512:
+		return sha512.New(), nil
+	case configpb.OaepHash_OAEP_SHA1:
+		if fips {
+			return nil, fmt.Errorf("RSA-OAEP hash %v is %w", alg, ErrNotFIPSApproved)
+		}
+		return sha1.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported RSA-OAEP hash %v", alg)
+	}
+}
+
+// rsaWrapShare wraps `share` with RSA-OAEP, using the hash and label of
+// `params`, and randomness from `random`.
+func rsaWrapShare(random io.Reader, key *rsa.PublicKey, share []byte, params *configpb.RsaOaepParams, fips bool) ([]byte, error) {
+	h, err := oaepHash(params, fips)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsa.EncryptOAEP(h, random, key, share, params.GetLabel())
+}
+
+// rsaUnwrapShare is the inverse of rsaWrapShare.
+func rsaUnwrapShare(key *rsa.PrivateKey, wrapped []byte, params *configpb.RsaOaepParams, fips bool) ([]byte, error) {
+	h, err := oaepHash(params, fips)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsa.DecryptOAEP(h, rand.Reader, key, wrapped, params.GetLabel())
+}
+
+// shareOAEPParams returns the RSA-OAEP parameters to unwrap `wrapped` with:
+// those recorded in the share, or, for shares that do not record any, those
+// of its KekInfo.
+func shareOAEPParams(wrapped *configpb.WrappedShare, kek *configpb.KekInfo) *configpb.RsaOaepParams {
+	if params := wrapped.GetRsaOaepParams(); params != nil {
+		return params
+	}
+
+	return kek.GetRsaOaepParams()
+}
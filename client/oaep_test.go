@@ -0,0 +1,160 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/google/go-cmp/cmp"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// newRSAConfig returns a StetConfig that wraps a single share with the RSA
+// key with `fingerprint` and the given RSA-OAEP parameters.
+func newRSAConfig(keys *configpb.AsymmetricKeys, fingerprint string, params *configpb.RsaOaepParams) *configpb.StetConfig {
+	keyConfig := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{{
+			KekType:       &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint},
+			RsaOaepParams: params,
+		}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+
+	return &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: keys,
+	}
+}
+
+func TestRSAOAEPParams(t *testing.T) {
+	ctx := context.Background()
+	keys, fingerprint := writeRSAKeyPair(t, 2048)
+	key, err := PrivateKeyForRSAFingerprint(&configpb.KekInfo{KekType: &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint}}, keys)
+	if err != nil {
+		t.Fatalf("PrivateKeyForRSAFingerprint returned error: %v", err)
+	}
+	plaintext := []byte("This is data to be encrypted.")
+
+	testCases := []struct {
+		name   string
+		params *configpb.RsaOaepParams
+	}{
+		{name: "Default"},
+		{name: "SHA-1", params: &configpb.RsaOaepParams{Hash: configpb.OaepHash_OAEP_SHA1}},
+		{name: "SHA-256", params: &configpb.RsaOaepParams{Hash: configpb.OaepHash_OAEP_SHA256}},
+		{name: "SHA-512", params: &configpb.RsaOaepParams{Hash: configpb.OaepHash_OAEP_SHA512}},
+		{name: "Label", params: &configpb.RsaOaepParams{Label: []byte("label")}},
+		{name: "SHA-512 with label", params: &configpb.RsaOaepParams{Hash: configpb.OaepHash_OAEP_SHA512, Label: []byte("label")}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetConfig := newRSAConfig(keys, fingerprint, tc.params)
+			stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+			var metadataBuf, ciphertext bytes.Buffer
+			if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &ciphertext, stetConfig, "blob"); err != nil {
+				t.Fatalf("EncryptWithSidecar returned error: %v", err)
+			}
+
+			metadata, err := ReadMetadata(bytes.NewReader(metadataBuf.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+
+			// The parameters are recorded with the share, and were used to wrap it.
+			share := metadata.GetShares()[0]
+			if diff := cmp.Diff(tc.params, share.GetRsaOaepParams(), protocmp.Transform()); diff != "" {
+				t.Errorf("Share recorded unexpected RSA-OAEP parameters (-want +got):\n%s", diff)
+			}
+			_, defaultErr := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, share.GetShare(), nil)
+			hash := tc.params.GetHash()
+			isDefault := tc.params.GetLabel() == nil && (hash == configpb.OaepHash_DEFAULT_OAEP_HASH || hash == configpb.OaepHash_OAEP_SHA256)
+			if isDefault != (defaultErr == nil) {
+				t.Errorf("Unwrapping the share with SHA-256 and no label returned error %v, want success only for the default parameters", defaultErr)
+			}
+
+			var output bytes.Buffer
+			if _, err := stetClient.DecryptWithSidecar(ctx, &metadataBuf, &ciphertext, &output, stetConfig); err != nil {
+				t.Fatalf("DecryptWithSidecar returned error: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("DecryptWithSidecar returned plaintext %q, want %q", output.Bytes(), plaintext)
+			}
+		})
+	}
+}
+
+func TestRSAOAEPParamsErrors(t *testing.T) {
+	ctx := context.Background()
+	keys, fingerprint := writeRSAKeyPair(t, 2048)
+	plaintext := []byte("This is data to be encrypted.")
+
+	// SHA-1 is not permitted in FIPS mode.
+	sha1Config := newRSAConfig(keys, fingerprint, &configpb.RsaOaepParams{Hash: configpb.OaepHash_OAEP_SHA1})
+	fipsClient := &StetClient{FIPSMode: true}
+	if _, err := fipsClient.Encrypt(ctx, bytes.NewReader(plaintext), &bytes.Buffer{}, sha1Config, "blob"); !errors.Is(err, ErrNotFIPSApproved) {
+		t.Errorf("Encrypt in FIPS mode with SHA-1 = %v, want %v", err, ErrNotFIPSApproved)
+	}
+
+	var blob bytes.Buffer
+	if _, err := (&StetClient{}).Encrypt(ctx, bytes.NewReader(plaintext), &blob, sha1Config, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	if _, err := fipsClient.Decrypt(ctx, &blob, &bytes.Buffer{}, sha1Config); !errors.Is(err, ErrNotFIPSApproved) {
+		t.Errorf("Decrypt in FIPS mode with SHA-1 = %v, want %v", err, ErrNotFIPSApproved)
+	}
+
+	// Parameters are only supported for RSA KEKs.
+	kmsConfig := newFakeKMSConfig(1)
+	kmsConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[0].RsaOaepParams = &configpb.RsaOaepParams{Hash: configpb.OaepHash_OAEP_SHA512}
+	if _, err := (&StetClient{KMSClient: &stettest.FakeKMS{}}).Encrypt(ctx, bytes.NewReader(plaintext), &bytes.Buffer{}, kmsConfig, "blob"); err == nil {
+		t.Error("Encrypt with RSA-OAEP parameters for a KEK URI succeeded, want error")
+	}
+
+	// Blobs with parameters need format version 2.
+	labelConfig := newRSAConfig(keys, fingerprint, &configpb.RsaOaepParams{Label: []byte("label")})
+	if _, err := (&StetClient{}).Encrypt(ctx, bytes.NewReader(plaintext), &bytes.Buffer{}, labelConfig, "blob", WithFormatVersion(FormatVersion1)); err == nil {
+		t.Error("Encrypt with RSA-OAEP parameters and format version 1 succeeded, want error")
+	}
+
+	// The share must not unwrap with other parameters than it records.
+	var metadataBuf bytes.Buffer
+	if _, err := (&StetClient{}).EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadataBuf, &bytes.Buffer{}, labelConfig, "blob"); err != nil {
+		t.Fatalf("EncryptWithSidecar returned error: %v", err)
+	}
+	metadata, err := ReadMetadata(&metadataBuf)
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+	tampered := proto.Clone(metadata).(*configpb.Metadata)
+	tampered.GetShares()[0].RsaOaepParams.Label = []byte("other label")
+	if _, err := (&StetClient{}).DecryptWithMetadata(ctx, tampered, &bytes.Buffer{}, &bytes.Buffer{}, labelConfig); err == nil {
+		t.Error("DecryptWithMetadata with a different RSA-OAEP label succeeded, want error")
+	}
+}
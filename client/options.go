@@ -0,0 +1,565 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// callOptions holds the settings that can be configured for a single call to
+// Encrypt or Decrypt.
+type callOptions struct {
+	concurrentShareLimit int
+	integrityManifest    bool
+	completedBlobIDs     map[string]bool
+	batchFilter          func(blobID string) bool
+	decryptReport        *DecryptReport
+	dekPool              *DEKPool
+	provenance           bool
+	keyCommitment        bool
+	maxMetadataSize      int
+	blobKeyConfig        bool
+	signer               crypto.Signer
+	signatureOutput      io.Writer
+	segmentSize          int64
+	shareHashAlgorithm   configpb.ShareHashAlgorithm
+	requireImportedKEKs  bool
+	rsaKeyFallback       bool
+	formatVersion        uint8
+	shareContext         []byte
+	sizeHint             int64
+	hasSizeHint          bool
+	verifyWrap           bool
+	batchConcurrency     int
+	timingReport         bool
+	disabledKEKVersions  bool
+	hedgedUnwrap         bool
+	hedgeExtra           int
+	extensions           map[string]string
+	availableKEKs        map[string]bool
+	aeadWorkers          int
+	readRepair           io.Writer
+	framing              bool
+	ignoreTrailingBytes  bool
+
+	// Whether to skip verifying the EKM's certificate in the inner TLS
+	// session, resolved to the client's InsecureSkipVerify unless set by
+	// WithInsecureSkipVerify.
+	insecureSkipVerify    bool
+	hasInsecureSkipVerify bool
+
+	// The timing report being recorded, and when the call started, if
+	// requested WithTimingReport.
+	timings   *TimingReport
+	callStart time.Time
+
+	// The Cloud KMS client factory shared by the items of an EncryptBatch.
+	kmsClients *cloudkms.ClientFactory
+
+	// Whether the client applies a ShareTransform to wrapped shares.
+	shareTransform bool
+
+	// The client's Rand, if set.
+	rand io.Reader
+
+	// The secure sessions in which shares were wrapped or unwrapped with
+	// external EKMs during the call.
+	ekmSessions *ekmSessionLog
+}
+
+// CallOption is an option for a single call to Encrypt or Decrypt.
+type CallOption func(*callOptions)
+
+// WithConcurrentShareLimit sets the maximum number of shares that are wrapped
+// or unwrapped concurrently during the call, overriding the client's
+// MaxConcurrentShares. A limit of zero uses the client default.
+func WithConcurrentShareLimit(limit int) CallOption {
+	return func(o *callOptions) {
+		o.concurrentShareLimit = limit
+	}
+}
+
+// WithIntegrityManifest makes Encrypt store a manifest of ciphertext hashes in
+// the blob metadata, which VerifyIntegrity can check without keys. Since the
+// metadata precedes the ciphertext, the ciphertext is buffered in memory until
+// encryption completes. It has no effect on Decrypt, which always checks the
+// manifest if present.
+func WithIntegrityManifest() CallOption {
+	return func(o *callOptions) {
+		o.integrityManifest = true
+	}
+}
+
+// WithBatchConcurrency makes EncryptBatch encrypt up to `limit` items
+// concurrently, pipelining their wrap requests to Cloud KMS, instead of one
+// at a time. Within each item, shares are still wrapped concurrently up to
+// the share limit, so up to `limit` times that many requests may be in
+// flight: keep both within the KEKs' rate limits. A limit less than 2
+// encrypts items sequentially. It has no effect on other calls.
+func WithBatchConcurrency(limit int) CallOption {
+	return func(o *callOptions) {
+		o.batchConcurrency = limit
+	}
+}
+
+// withKMSClients makes the call create Cloud KMS clients with `kmsClients`,
+// so that the items of an EncryptBatch share them.
+func withKMSClients(kmsClients *cloudkms.ClientFactory) CallOption {
+	return func(o *callOptions) {
+		o.kmsClients = kmsClients
+	}
+}
+
+// WithCompletedBlobIDs makes EncryptBatch skip the items with the given blob
+// IDs, such as those that succeeded in an earlier, partially failed call. It
+// has no effect on other calls.
+func WithCompletedBlobIDs(blobIDs ...string) CallOption {
+	return func(o *callOptions) {
+		if o.completedBlobIDs == nil {
+			o.completedBlobIDs = make(map[string]bool)
+		}
+		for _, id := range blobIDs {
+			o.completedBlobIDs[id] = true
+		}
+	}
+}
+
+// WithBatchFilter makes EncryptBatch call `filter` with the blob ID of each
+// item before encrypting it, skipping the item if it returns false. It has no
+// effect on other calls.
+func WithBatchFilter(filter func(blobID string) bool) CallOption {
+	return func(o *callOptions) {
+		o.batchFilter = filter
+	}
+}
+
+// WithDecryptReport makes Decrypt record the outcome of every share unwrapping
+// attempt in `report`, including the error for each failed share, and whether
+// the DEK could be reconstructed. The report is filled in even if Decrypt
+// fails, so that operators can identify which KEKs are the problem. It has no
+// effect on Encrypt.
+func WithDecryptReport(report *DecryptReport) CallOption {
+	return func(o *callOptions) {
+		o.decryptReport = report
+	}
+}
+
+// newCallOptions applies the given options on top of the client defaults.
+func (c *StetClient) newCallOptions(opts []CallOption) *callOptions {
+	o := &callOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.concurrentShareLimit == 0 {
+		o.concurrentShareLimit = c.MaxConcurrentShares
+	}
+	o.shareTransform = c.ShareTransform != nil
+	o.rand = c.Rand
+	o.ekmSessions = &ekmSessionLog{}
+	if !o.hasInsecureSkipVerify {
+		o.insecureSkipVerify = c.InsecureSkipVerify
+	}
+
+	if o.timingReport {
+		o.timings = &TimingReport{}
+		o.callStart = time.Now()
+	}
+
+	return o
+}
+
+// newDEK generates a DEK, from the client's Rand if set.
+func (o *callOptions) newDEK() (shares.DEK, error) {
+	if o.rand == nil {
+		return shares.NewDEK(), nil
+	}
+
+	return shares.NewDEKFromReader(o.rand)
+}
+
+// random returns the client's Rand if set, and crypto/rand.Reader otherwise.
+func (o *callOptions) random() io.Reader {
+	if o.rand == nil {
+		return rand.Reader
+	}
+
+	return o.rand
+}
+
+// encryptSegmentSize returns the segment size Encrypt is to record in the
+// metadata, or zero for the default: the size given WithSegmentSize, or
+// otherwise the one chosen from the size hint, if any.
+func (o *callOptions) encryptSegmentSize() int64 {
+	if o.segmentSize != 0 || !o.hasSizeHint || o.formatVersion == FormatVersion1 {
+		return o.segmentSize
+	}
+
+	return sizeHintSegmentSize(o.sizeHint)
+}
+
+// newAADSalt generates the AAD salt of a blob, from the client's Rand if set.
+func (o *callOptions) newAADSalt() ([]byte, error) {
+	salt := make([]byte, aadSaltBytes)
+	if _, err := io.ReadFull(o.random(), salt); err != nil {
+		return nil, fmt.Errorf("error generating AAD salt: %v", err)
+	}
+
+	return salt, nil
+}
+
+// createDEKShares splits `dek` according to `keyCfg`, with randomness from
+// the client's Rand if set.
+func (o *callOptions) createDEKShares(dek shares.DEK, keyCfg *configpb.KeyConfig) ([][]byte, error) {
+	if o.rand == nil {
+		return shares.CreateDEKShares(dek, keyCfg)
+	}
+
+	return shares.CreateDEKSharesFromReader(o.rand, dek, keyCfg)
+}
+
+// WithDEKPool makes Encrypt take its DEK and unwrapped shares from `pool`
+// instead of generating them, which fails if the pool was created for a
+// different KeyConfig than the call's. It has no effect on Decrypt.
+func WithDEKPool(pool *DEKPool) CallOption {
+	return func(o *callOptions) {
+		o.dekPool = pool
+	}
+}
+
+// WithProvenance makes Encrypt record the current time and the client's
+// Version in the blob metadata, where InspectMetadata can read them. They are
+// bound into the AAD, so cannot be altered without failing decryption. As
+// they reveal when the blob was created, they are not recorded by default.
+// It has no effect on Decrypt.
+func WithProvenance() CallOption {
+	return func(o *callOptions) {
+		o.provenance = true
+	}
+}
+
+// WithKeyCommitment makes Encrypt store a commitment to the DEK in the blob
+// metadata. Decrypt then checks the DEK reconstructed from the shares against
+// it before decrypting, so that a wrong key is reported as such, with
+// ErrKeyCommitmentMismatch, rather than as an authentication failure of the
+// ciphertext. It has no effect on Decrypt, which always checks the commitment
+// if present.
+func WithKeyCommitment() CallOption {
+	return func(o *callOptions) {
+		o.keyCommitment = true
+	}
+}
+
+// WithMaxMetadataSize makes Encrypt fail if the serialized metadata, including
+// the wrapped shares, exceeds `size` bytes, for storage systems that limit the
+// size of object headers. The error reports the actual size, so that callers
+// can choose fewer KEKs. A size of zero means no limit beyond the format's
+// own. It has no effect on Decrypt.
+func WithMaxMetadataSize(size int) CallOption {
+	return func(o *callOptions) {
+		o.maxMetadataSize = size
+	}
+}
+
+// WithBlobKeyConfig makes Decrypt recover the DEK using the KeyConfig embedded
+// in the blob's metadata, instead of requiring a matching KeyConfig in the
+// DecryptConfig, which may then be omitted. The shares are still unwrapped
+// with the client's KMS and EKM access and the AsymmetricKeys of the
+// StetConfig, so decryption only succeeds if the caller holds enough of the
+// blob's KEKs. As the blob then chooses which KEKs are used, callers should
+// only use it for blobs from trusted sources. It has no effect on Encrypt.
+func WithBlobKeyConfig() CallOption {
+	return func(o *callOptions) {
+		o.blobKeyConfig = true
+	}
+}
+
+// WithSignature makes Encrypt sign the blob it writes with `signer`, which
+// must hold an RSA or ECDSA key, and write the detached signature to
+// `signatureOutput` once encryption completes. The signature covers the STET
+// header, metadata and ciphertext, so recipients can check who produced the
+// blob with VerifySignature, without decrypting it. It has no effect on
+// Decrypt.
+func WithSignature(signer crypto.Signer, signatureOutput io.Writer) CallOption {
+	return func(o *callOptions) {
+		o.signer = signer
+		o.signatureOutput = signatureOutput
+	}
+}
+
+// WithSegmentSize makes Encrypt split the ciphertext into segments of `size`
+// bytes instead of the default 1 MiB, which must be between 4 KiB and 64 MiB.
+// The size is recorded in the metadata and bound into the AAD, so Decrypt
+// uses the same framing. Smaller segments reduce the data read by
+// DecryptRange, at the cost of a 16-byte tag per segment. It has no effect on
+// Decrypt.
+func WithSegmentSize(size int64) CallOption {
+	return func(o *callOptions) {
+		o.segmentSize = size
+	}
+}
+
+// WithSizeHint tells Encrypt that the plaintext is expected to be `size`
+// bytes, such as from a file stat. Unless WithSegmentSize or FormatVersion1 is
+// requested, a plaintext expected to fit in less than the default segment is
+// encrypted with the smallest segment size that holds it, so that smaller
+// buffers are allocated; the segment size is recorded in the metadata, which
+// requires FormatVersion2. The ciphertext buffered for WithIntegrityManifest is
+// also pre-sized from the hint. The plaintext is still streamed, and the hint
+// is only an optimization: if it is wrong, the blob is still encrypted
+// correctly. It has no effect on Decrypt.
+func WithSizeHint(size int64) CallOption {
+	return func(o *callOptions) {
+		o.sizeHint = size
+		o.hasSizeHint = true
+	}
+}
+
+// WithFraming makes blobs self-delimiting, so that several can be
+// concatenated in one stream and read back one at a time. Encrypt writes the
+// ciphertext in length-prefixed chunks followed by an end marker, still
+// streaming the plaintext. Decrypt then reads exactly the header, metadata
+// and ciphertext of one blob, leaving the input positioned at the start of the
+// next, instead of reading the ciphertext to the end of the input. Blobs
+// encrypted WithFraming can only be read by Decrypt WithFraming, which fails
+// for blobs encrypted without it.
+func WithFraming() CallOption {
+	return func(o *callOptions) {
+		o.framing = true
+	}
+}
+
+// WithIgnoreTrailingBytes makes Decrypt read only as much ciphertext as the
+// metadata records, ignoring any bytes after it, such as padding added by
+// storage systems that round objects up to a block boundary. The length is
+// recorded for blobs encrypted WithIntegrityManifest. For other blobs, Decrypt
+// reads the ciphertext to the end of the input as usual. Unlike WithFraming,
+// the trailing bytes may be left unread. It has no effect on Encrypt.
+func WithIgnoreTrailingBytes() CallOption {
+	return func(o *callOptions) {
+		o.ignoreTrailingBytes = true
+	}
+}
+
+// WithExtensions makes Encrypt record application-specific metadata, such as
+// a retention class or data classification, in the blob metadata, where
+// Decrypt and InspectMetadata return it. Names must start with a lowercase
+// letter and consist of at most 64 lowercase letters, digits, '.', '_' or
+// '-', and the names and values may total at most 16 KiB.
+//
+// Extensions are bound into the AAD, so cannot be altered without failing
+// decryption, but they are NOT encrypted: anyone with the blob can read them,
+// so they must not contain sensitive data. As with other metadata,
+// InspectMetadata returns them before they are authenticated. Calling
+// WithExtensions more than once merges the maps. It has no effect on Decrypt.
+func WithExtensions(extensions map[string]string) CallOption {
+	return func(o *callOptions) {
+		if o.extensions == nil {
+			o.extensions = make(map[string]string, len(extensions))
+		}
+		for name, value := range extensions {
+			o.extensions[name] = value
+		}
+	}
+}
+
+// WithVerifyWrap makes Encrypt unwrap the shares immediately after wrapping
+// them and check that they reconstruct the DEK, failing before anything is
+// written if they do not. This catches KEKs that can wrap but not unwrap, such
+// as from EKM key state or permission problems, at the cost of doubling the
+// KMS and EKM calls. As with Decrypt, only as many shares as the KeyConfig's
+// threshold must unwrap, so shares wrapped with asymmetric KEKs whose private
+// keys are not configured are tolerated if enough others unwrap. It has no
+// effect on Decrypt.
+func WithVerifyWrap() CallOption {
+	return func(o *callOptions) {
+		o.verifyWrap = true
+	}
+}
+
+// WithTimingReport makes Encrypt and Decrypt measure the time spent in each
+// phase of the call, and return it in the Timings field of the StetMetadata.
+// Timings are not measured by default.
+func WithTimingReport() CallOption {
+	return func(o *callOptions) {
+		o.timingReport = true
+	}
+}
+
+// WithDisabledKEKVersions makes Decrypt attempt to unwrap shares with Cloud
+// KMS KEKs whose version is disabled or scheduled for destruction, rather
+// than failing before calling Cloud KMS, for example while the version is
+// being re-enabled. If unwrapping fails, the error still wraps
+// ErrKEKVersionDisabled. Destroyed versions are always rejected with
+// ErrKEKVersionDestroyed. It has no effect on Encrypt, which only wraps with
+// enabled versions.
+//
+// The version checked is the one pinned in the KEK URI, if the URI ends in
+// "/cryptoKeyVersions/*", and otherwise the primary version of the KEK.
+func WithDisabledKEKVersions() CallOption {
+	return func(o *callOptions) {
+		o.disabledKEKVersions = true
+	}
+}
+
+// WithHedgedUnwrap makes Decrypt unwrap only as many shares as the KeyConfig's
+// threshold, plus `extra` hedged requests, concurrently, and cancel the rest
+// once the threshold is met. If a share fails to unwrap, the next one is
+// started in its place. For over-provisioned k-of-n KeyConfigs, this keeps a
+// single slow KEK, such as behind an overloaded external EKM, from dominating
+// the latency of the call. Shares that were not needed are reported with
+// ErrShareNotNeeded. The client's MaxConcurrentShares does not apply, and a
+// negative `extra` is treated as zero.
+func WithHedgedUnwrap(extra int) CallOption {
+	return func(o *callOptions) {
+		o.hedgedUnwrap = true
+		o.hedgeExtra = extra
+		if o.hedgeExtra < 0 {
+			o.hedgeExtra = 0
+		}
+	}
+}
+
+// WithAvailableKEKs tells Decrypt which KEKs the caller can use, each
+// identified by its KEK URI or backup KEK URI, RSA or EC fingerprint, or the
+// master KEK URI of a Tink keyset, exactly as in the KeyConfig. Shares wrapped
+// with any other KEK are skipped without attempting to unwrap them, and are
+// reported with ErrKEKNotAvailable, so that a recipient holding only some of
+// the KEKs of a k-of-n KeyConfig makes no calls to, and logs no errors for,
+// the rest. Decrypt fails early if fewer KEKs are available than the
+// threshold. Calling WithAvailableKEKs more than once adds to the KEKs. It has
+// no effect on Encrypt.
+func WithAvailableKEKs(keks ...string) CallOption {
+	return func(o *callOptions) {
+		if o.availableKEKs == nil {
+			o.availableKEKs = make(map[string]bool, len(keks))
+		}
+		for _, kek := range keks {
+			o.availableKEKs[kek] = true
+		}
+	}
+}
+
+// WithShareHashAlgorithm makes Encrypt hash the unwrapped shares with `alg`
+// instead of SHA-256. The algorithm is recorded with each wrapped share, so
+// Decrypt validates shares with the matching algorithm. It has no effect on
+// Decrypt.
+func WithShareHashAlgorithm(alg configpb.ShareHashAlgorithm) CallOption {
+	return func(o *callOptions) {
+		o.shareHashAlgorithm = alg
+	}
+}
+
+// WithImportedKEKs requires the primary version of every Cloud KMS KEK used to
+// wrap or unwrap shares to be backed by key material imported into Cloud KMS
+// with an import job, for organizations that bring their own keys. Shares
+// whose KEKs are generated by Cloud KMS, or held in an external EKM, fail to
+// wrap or unwrap. RSA and Tink keyset KEKs are not affected.
+func WithImportedKEKs() CallOption {
+	return func(o *callOptions) {
+		o.requireImportedKEKs = true
+	}
+}
+
+// WithRSAKeyFallback makes Decrypt unwrap shares whose RSA fingerprint matches
+// none of the configured private keys by trying each private key in turn, and
+// accepting the first that yields a share with the expected hash. This
+// recovers blobs whose fingerprints were computed from a different encoding
+// of the key, at the cost of an RSA decryption per key and share. It has no
+// effect on Encrypt.
+func WithRSAKeyFallback() CallOption {
+	return func(o *callOptions) {
+		o.rsaKeyFallback = true
+	}
+}
+
+// WithFormatVersion makes Encrypt write a blob of the given format version,
+// such as FormatVersion1 for compatibility with older versions of STET, and
+// fail if the call uses a feature that the version does not support. By
+// default, Encrypt writes the oldest version that supports the features used.
+// Request FormatVersion2 to bind a random salt into the AAD of blobs that use
+// no newer feature. It has no effect on Decrypt, which reads every supported
+// version.
+func WithFormatVersion(version uint8) CallOption {
+	return func(o *callOptions) {
+		o.formatVersion = version
+	}
+}
+
+// WithShareContext binds the shares wrapped by Cloud KMS and external EKM KEKs
+// to the given encryption context and the blob ID, by sending them as the
+// additional authenticated data of each wrap request. Decrypt must be called
+// with the same context, or unwrapping these shares fails. Shares wrapped with
+// RSA keys or Tink keysets are not affected.
+func WithShareContext(encryptionContext []byte) CallOption {
+	return func(o *callOptions) {
+		o.shareContext = encryptionContext
+	}
+}
+
+// WithInsecureSkipVerify overrides the client's InsecureSkipVerify for the
+// call, setting whether the certificate presented by external EKMs in the
+// inner TLS session of each secure session is verified. This allows a single
+// client to use both trusted EKMs and test EKMs with self-signed certificates.
+func WithInsecureSkipVerify(skip bool) CallOption {
+	return func(o *callOptions) {
+		o.insecureSkipVerify = skip
+		o.hasInsecureSkipVerify = true
+	}
+}
+
+// WithParallelAEAD makes Encrypt and Decrypt seal or open up to `workers`
+// ciphertext segments concurrently, for higher throughput on large blobs on
+// machines with several cores. A value less than 1 uses GOMAXPROCS workers.
+// Segments are still read and written in order, and each segment's nonce is
+// derived from its index, so the blob is the same as one encrypted serially.
+// Up to about twice `workers` segments are buffered in memory at a time.
+func WithParallelAEAD(workers int) CallOption {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	return func(o *callOptions) {
+		o.aeadWorkers = workers
+	}
+}
+
+// WithReadRepair makes Decrypt repair a blob whose DEK was reconstructed even
+// though some of its shares failed to unwrap, such as while an EKM was down.
+// Each failed share is recreated from the unwrapped shares and wrapped again
+// with its KEK, and the repaired blob, with the same DEK and blob ID and its
+// other shares unchanged, is written to `repaired` as the plaintext is
+// decrypted. Callers should then replace the stored blob with it. As the
+// wrapped shares are bound into the AAD, the ciphertext is re-encrypted.
+//
+// Nothing is written if no share failed or none could be repaired; the repaired
+// shares are listed in the RepairedShares of the returned StetMetadata. Only
+// blobs split with Shamir's Secret Sharing can be repaired. If Decrypt fails,
+// `repaired` may contain a partial blob and should be discarded. It has no
+// effect on Encrypt.
+func WithReadRepair(repaired io.Writer) CallOption {
+	return func(o *callOptions) {
+		o.readRepair = repaired
+	}
+}
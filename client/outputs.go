@@ -0,0 +1,148 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// OutputsError is returned by EncryptToOutputs if writing to any output
+// failed.
+type OutputsError struct {
+	// The error writing to each output, in the same order as the outputs, or
+	// nil if the whole blob was written to it.
+	Errs []error
+}
+
+func (e *OutputsError) Error() string {
+	var failed, succeeded []string
+	for i, err := range e.Errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("output #%v: %v", i+1, err))
+		} else {
+			succeeded = append(succeeded, fmt.Sprintf("#%v", i+1))
+		}
+	}
+
+	msg := fmt.Sprintf("failed to write to %v of %v outputs (%v)", len(failed), len(e.Errs), strings.Join(failed, "; "))
+	if len(succeeded) > 0 {
+		msg += fmt.Sprintf(", blob written to outputs %v", strings.Join(succeeded, ", "))
+	}
+
+	return msg
+}
+
+// Unwrap returns the errors of the outputs that failed.
+func (e *OutputsError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// Succeeded returns the indices of the outputs the whole blob was written to.
+func (e *OutputsError) Succeeded() []int {
+	var succeeded []int
+	for i, err := range e.Errs {
+		if err == nil {
+			succeeded = append(succeeded, i)
+		}
+	}
+
+	return succeeded
+}
+
+// errAllOutputsFailed stops encryption once no output can be written to.
+var errAllOutputsFailed = errors.New("writing to every output failed")
+
+// fanOutWriter writes to each of its outputs in turn, dropping any output
+// that fails so that the others can still be written.
+type fanOutWriter struct {
+	outputs []io.Writer
+	errs    []error
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	written := false
+	for i, output := range w.outputs {
+		if w.errs[i] != nil {
+			continue
+		}
+
+		n, err := output.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			w.errs[i] = err
+			continue
+		}
+
+		written = true
+	}
+
+	if !written {
+		return 0, errAllOutputsFailed
+	}
+
+	return len(p), nil
+}
+
+// EncryptToOutputs is like Encrypt, but writes the blob to each of `outputs`
+// in a single pass, for example to replicate it to several destinations
+// without encrypting it more than once. The header, metadata and ciphertext
+// are written to every output as they are produced.
+//
+// If writing to an output fails, nothing more is written to it, but the blob
+// is still written to the others. In that case, an *OutputsError is returned
+// reporting which outputs failed, along with the metadata of the blob if any
+// output succeeded. If every output fails, or encryption otherwise fails, no
+// metadata is returned.
+func (c *StetClient) EncryptToOutputs(ctx context.Context, input io.Reader, outputs []io.Writer, stetConfig *configpb.StetConfig, blobID string, opts ...CallOption) (*StetMetadata, error) {
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("no outputs passed to EncryptToOutputs()")
+	}
+
+	w := &fanOutWriter{outputs: outputs, errs: make([]error, len(outputs))}
+	md, err := c.EncryptWithSidecar(ctx, input, w, w, stetConfig, blobID, opts...)
+
+	failed := 0
+	for _, outputErr := range w.errs {
+		if outputErr != nil {
+			failed++
+		}
+	}
+
+	switch {
+	case failed == len(outputs):
+		return nil, &OutputsError{Errs: w.errs}
+	case err != nil:
+		return nil, err
+	case failed > 0:
+		return md, &OutputsError{Errs: w.errs}
+	}
+
+	return md, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"github.com/google/go-cmp/cmp"
+)
+
+var errWriterFull = errors.New("writer full")
+
+// limitedWriter accepts up to `limit` bytes, then fails.
+type limitedWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errWriterFull
+	}
+	return w.buf.Write(p)
+}
+
+func TestEncryptToOutputs(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := bytes.Repeat([]byte("This is data to be encrypted. "), 100000)
+
+	decrypt := func(t *testing.T, blob []byte) {
+		t.Helper()
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob), &output, stetConfig); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Error("Decrypt returned different plaintext")
+		}
+	}
+
+	t.Run("All outputs succeed", func(t *testing.T) {
+		var first, second bytes.Buffer
+		md, err := stetClient.EncryptToOutputs(ctx, bytes.NewReader(plaintext), []io.Writer{&first, &second}, stetConfig, "blob")
+		if err != nil {
+			t.Fatalf("EncryptToOutputs returned error: %v", err)
+		}
+		if md.BlobID != "blob" {
+			t.Errorf("EncryptToOutputs returned blob ID %q, want %q", md.BlobID, "blob")
+		}
+
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Error("EncryptToOutputs wrote different blobs to the outputs")
+		}
+		decrypt(t, first.Bytes())
+	})
+
+	t.Run("One output fails midway", func(t *testing.T) {
+		var first bytes.Buffer
+		second := &limitedWriter{limit: len(plaintext) / 2}
+		md, err := stetClient.EncryptToOutputs(ctx, bytes.NewReader(plaintext), []io.Writer{&first, second}, stetConfig, "blob")
+
+		var outputsErr *OutputsError
+		if !errors.As(err, &outputsErr) {
+			t.Fatalf("EncryptToOutputs returned error %v, want *OutputsError", err)
+		}
+		if !errors.Is(err, errWriterFull) {
+			t.Errorf("EncryptToOutputs returned error %v, want it to wrap the writer's error", err)
+		}
+		if diff := cmp.Diff([]int{0}, outputsErr.Succeeded()); diff != "" {
+			t.Errorf("Succeeded() returned unexpected outputs (-want +got):\n%s", diff)
+		}
+		if outputsErr.Errs[0] != nil || outputsErr.Errs[1] == nil {
+			t.Errorf("OutputsError has errors %v, want only the second output to fail", outputsErr.Errs)
+		}
+
+		// The blob is still complete in the output that did not fail.
+		if md == nil {
+			t.Fatal("EncryptToOutputs returned nil metadata, want metadata of the blob written to the first output")
+		}
+		decrypt(t, first.Bytes())
+	})
+
+	t.Run("All outputs fail", func(t *testing.T) {
+		outputs := []io.Writer{&limitedWriter{limit: 10}, &limitedWriter{limit: 1000}}
+		md, err := stetClient.EncryptToOutputs(ctx, bytes.NewReader(plaintext), outputs, stetConfig, "blob")
+
+		var outputsErr *OutputsError
+		if !errors.As(err, &outputsErr) {
+			t.Fatalf("EncryptToOutputs returned error %v, want *OutputsError", err)
+		}
+		if len(outputsErr.Succeeded()) != 0 {
+			t.Errorf("Succeeded() returned %v, want no outputs", outputsErr.Succeeded())
+		}
+		if md != nil {
+			t.Errorf("EncryptToOutputs returned metadata %+v, want nil", md)
+		}
+	})
+
+	t.Run("No outputs", func(t *testing.T) {
+		if _, err := stetClient.EncryptToOutputs(ctx, bytes.NewReader(plaintext), nil, stetConfig, "blob"); err == nil {
+			t.Error("EncryptToOutputs succeeded with no outputs, want error")
+		}
+	})
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+)
+
+// segmentReader splits a stream into the segments of a streaming AEAD
+// plaintext or ciphertext, reporting which segment is the last.
+type segmentReader struct {
+	reader *bufio.Reader
+	// The size of the next segment, and of every segment after the first.
+	size     int64
+	restSize int64
+}
+
+// next returns the next segment, and whether no data follows it. Every
+// segment is read into a new buffer, so that it can be processed while the
+// following segments are read.
+func (r *segmentReader) next() ([]byte, bool, error) {
+	segment := make([]byte, r.size)
+	n, err := io.ReadFull(r.reader, segment)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+
+	_, peekErr := r.reader.Peek(1)
+	if peekErr != nil && peekErr != io.EOF {
+		return nil, false, peekErr
+	}
+
+	r.size = r.restSize
+	return segment[:n], peekErr == io.EOF, nil
+}
+
+// segmentResult is the outcome of processing a single segment.
+type segmentResult struct {
+	data []byte
+	err  error
+}
+
+// processSegments reads segments with `next` until the last, passes each to
+// `process` with its index, and writes the results to `output`. Up to
+// `workers` segments are processed concurrently, but results are written in
+// the order the segments were read, so the output does not depend on which
+// segments finish first. Processing stops at the first error, and no results
+// from later segments are written.
+func processSegments(workers int, next func() ([]byte, bool, error), process func(i int64, segment []byte, last bool) ([]byte, error), output io.Writer) error {
+	// The reader queues a channel for the result of every segment in
+	// order, and at most `workers` segments are processed at a time.
+	results := make(chan chan segmentResult, workers)
+	sem := make(chan struct{}, workers)
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+
+	go func() {
+		defer close(readerDone)
+		defer close(results)
+
+		for i := int64(0); ; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			result := make(chan segmentResult, 1)
+			segment, last, err := next()
+			if err != nil {
+				<-sem
+				result <- segmentResult{err: err}
+			} else {
+				go func(i int64) {
+					defer func() { <-sem }()
+					data, err := process(i, segment, last)
+					result <- segmentResult{data: data, err: err}
+				}(i)
+			}
+
+			select {
+			case results <- result:
+			case <-stop:
+				return
+			}
+
+			if err != nil || last {
+				return
+			}
+		}
+	}()
+
+	// Wait for the reader to stop before returning, so that `input` is not
+	// read after the call.
+	defer func() {
+		close(stop)
+		<-readerDone
+	}()
+
+	for result := range results {
+		r := <-result
+		if r.err != nil {
+			return r.err
+		}
+
+		if _, err := output.Write(r.data); err != nil {
+			return fmt.Errorf("failed to write segment: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// encryptSegmentsParallel is like encryptSegments, but seals up to `workers`
+// segments concurrently. Each segment's nonce is derived from its index, so
+// the ciphertext is identical to that written by encryptSegments.
+func encryptSegmentsParallel(key shares.DEK, segmentSize int64, salt, noncePrefix []byte, input io.Reader, output io.Writer, aad []byte, workers int) error {
+	aead, err := newSegmentAEAD(key, salt, aad)
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte{byte(aeadHeaderSize)}, salt...)
+	header = append(header, noncePrefix...)
+	if _, err := output.Write(header); err != nil {
+		return fmt.Errorf("failed to write ciphertext header: %v", err)
+	}
+
+	reader := &segmentReader{
+		reader:   bufio.NewReader(input),
+		size:     segmentSize - aeadFirstSegmentOffset - aeadHeaderSize - aeadTagSize,
+		restSize: segmentSize - aeadTagSize,
+	}
+
+	next := func() ([]byte, bool, error) {
+		plaintext, last, err := reader.next()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to encrypt: %v", err)
+		}
+		return plaintext, last, nil
+	}
+
+	seal := func(i int64, plaintext []byte, last bool) ([]byte, error) {
+		return aead.Seal(nil, segmentNonce(noncePrefix, i, last), plaintext, nil), nil
+	}
+
+	return processSegments(workers, next, seal, output)
+}
+
+// decryptSegmentsParallel is like aeadDecrypt, but opens up to `workers`
+// segments concurrently. As with aeadDecrypt, plaintext is only written once
+// every segment before it has been authenticated, so decryption stops at the
+// first segment that fails authentication.
+func decryptSegmentsParallel(key shares.DEK, segmentSize int64, input io.Reader, output io.Writer, aad []byte, workers int) error {
+	header := make([]byte, aeadHeaderSize)
+	if _, err := io.ReadFull(input, header); err != nil {
+		return fmt.Errorf("failed to read ciphertext header: %v", err)
+	}
+
+	if int64(header[0]) != aeadHeaderSize {
+		return fmt.Errorf("invalid ciphertext header length %v, want %v", header[0], aeadHeaderSize)
+	}
+
+	aead, err := newSegmentAEAD(key, header[1:1+shares.DEKBytes], aad)
+	if err != nil {
+		return err
+	}
+	noncePrefix := header[1+shares.DEKBytes:]
+
+	reader := &segmentReader{
+		reader:   bufio.NewReader(input),
+		size:     segmentSize - aeadFirstSegmentOffset - aeadHeaderSize,
+		restSize: segmentSize,
+	}
+
+	next := func() ([]byte, bool, error) {
+		segment, last, err := reader.next()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decrypt: %v", err)
+		}
+		return segment, last, nil
+	}
+
+	open := func(i int64, segment []byte, last bool) ([]byte, error) {
+		if int64(len(segment)) < aeadTagSize {
+			return nil, fmt.Errorf("ciphertext ends with a truncated segment")
+		}
+
+		plaintext, err := aead.Open(segment[:0], segmentNonce(noncePrefix, i, last), segment, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to authenticate segment %v: %v", i, err)
+		}
+		return plaintext, nil
+	}
+
+	return processSegments(workers, next, open, output)
+}
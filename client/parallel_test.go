@@ -0,0 +1,215 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"github.com/google/tink/go/subtle/random"
+)
+
+func TestParallelSegments(t *testing.T) {
+	segmentSize := int64(aeadMinSegmentSize)
+	firstCapacity := int(segmentSize - aeadHeaderSize - aeadTagSize)
+	capacity := int(segmentSize - aeadTagSize)
+
+	key := shares.NewDEK()
+	salt := random.GetRandomBytes(uint32(shares.DEKBytes))
+	noncePrefix := random.GetRandomBytes(uint32(AeadNonceBytes) - shares.DEKBytes)
+	aad := []byte("aad")
+
+	for _, size := range []int{0, 1, firstCapacity, firstCapacity + 1, firstCapacity + 5*capacity, firstCapacity + 9*capacity + 7} {
+		plaintext := random.GetRandomBytes(uint32(size))
+
+		var serial bytes.Buffer
+		if err := encryptSegments(key, segmentSize, salt, noncePrefix, bytes.NewReader(plaintext), &serial, aad); err != nil {
+			t.Fatalf("encryptSegments returned error: %v", err)
+		}
+
+		for _, workers := range []int{2, 3, 16} {
+			t.Run(fmt.Sprintf("%v bytes with %v workers", size, workers), func(t *testing.T) {
+				var ciphertext bytes.Buffer
+				if err := encryptSegmentsParallel(key, segmentSize, salt, noncePrefix, bytes.NewReader(plaintext), &ciphertext, aad, workers); err != nil {
+					t.Fatalf("encryptSegmentsParallel returned error: %v", err)
+				}
+
+				if !bytes.Equal(ciphertext.Bytes(), serial.Bytes()) {
+					t.Fatal("encryptSegmentsParallel returned a different ciphertext than encryptSegments")
+				}
+
+				var output bytes.Buffer
+				if err := decryptSegmentsParallel(key, segmentSize, bytes.NewReader(ciphertext.Bytes()), &output, aad, workers); err != nil {
+					t.Fatalf("decryptSegmentsParallel returned error: %v", err)
+				}
+				if !bytes.Equal(output.Bytes(), plaintext) {
+					t.Errorf("decryptSegmentsParallel returned %v bytes of plaintext, want the original %v", output.Len(), len(plaintext))
+				}
+			})
+		}
+	}
+}
+
+func TestDecryptSegmentsParallelErrors(t *testing.T) {
+	segmentSize := int64(aeadMinSegmentSize)
+	capacity := int(segmentSize - aeadTagSize)
+	firstCapacity := int(segmentSize - aeadHeaderSize - aeadTagSize)
+	key := shares.NewDEK()
+	aad := []byte("aad")
+
+	// Eight segments of plaintext.
+	plaintext := random.GetRandomBytes(uint32(firstCapacity + 7*capacity))
+	var ciphertext bytes.Buffer
+	if err := aeadEncrypt(key, segmentSize, bytes.NewReader(plaintext), &ciphertext, aad); err != nil {
+		t.Fatalf("aeadEncrypt returned error: %v", err)
+	}
+	blob := ciphertext.Bytes()
+
+	// Segment 4 is tampered with, so only the first four segments' plaintext
+	// may be written.
+	tampered := bytes.Clone(blob)
+	tampered[segmentSize+3*segmentSize+10] ^= 1
+
+	testCases := []struct {
+		name       string
+		ciphertext []byte
+		aad        []byte
+		wantOutput int
+	}{
+		{
+			name:       "Tampered segment",
+			ciphertext: tampered,
+			aad:        aad,
+			wantOutput: firstCapacity + 3*capacity,
+		},
+		{
+			name:       "Truncated last segment",
+			ciphertext: blob[:len(blob)-int(aeadTagSize)-1],
+			aad:        aad,
+			wantOutput: firstCapacity + 6*capacity,
+		},
+		{
+			name:       "Dropped last segment",
+			ciphertext: blob[:int(segmentSize)+6*int(segmentSize)],
+			aad:        aad,
+			wantOutput: firstCapacity + 5*capacity,
+		},
+		{
+			name:       "Wrong AAD",
+			ciphertext: blob,
+			aad:        []byte("other aad"),
+		},
+		{
+			name:       "Truncated header",
+			ciphertext: blob[:aeadHeaderSize-1],
+			aad:        aad,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			if err := decryptSegmentsParallel(key, segmentSize, bytes.NewReader(tc.ciphertext), &output, tc.aad, 4); err == nil {
+				t.Error("decryptSegmentsParallel succeeded, want error")
+			}
+			if output.Len() != tc.wantOutput || !bytes.Equal(output.Bytes(), plaintext[:output.Len()]) {
+				t.Errorf("decryptSegmentsParallel wrote %v bytes of plaintext, want the first %v", output.Len(), tc.wantOutput)
+			}
+		})
+	}
+}
+
+func TestWithParallelAEAD(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(1)
+	plaintext := random.GetRandomBytes(3*aeadSegmentSize + 100)
+
+	encrypt := func(opts ...CallOption) []byte {
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, Rand: mathrand.New(mathrand.NewSource(1))}
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob", opts...); err != nil {
+			t.Fatalf("Encrypt returned error: %v", err)
+		}
+		return blob.Bytes()
+	}
+
+	// With the same randomness, the blob must not depend on parallelism.
+	serial := encrypt()
+	for _, workers := range []int{0, 4} {
+		if parallel := encrypt(WithParallelAEAD(workers)); !bytes.Equal(parallel, serial) {
+			t.Errorf("Encrypt WithParallelAEAD(%v) wrote a different blob than serial Encrypt", workers)
+		}
+	}
+
+	// Blobs encrypted with random nonces decrypt either way.
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob", WithParallelAEAD(4)); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	for _, opts := range [][]CallOption{nil, {WithParallelAEAD(4)}} {
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob.Bytes()), &output, stetConfig, opts...); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned %v bytes of plaintext, want the original %v", output.Len(), len(plaintext))
+		}
+	}
+}
+
+func BenchmarkParallelAEAD(b *testing.B) {
+	key := shares.NewDEK()
+	plaintext := random.GetRandomBytes(64 << 20)
+	aad := []byte("aad")
+
+	var ciphertext bytes.Buffer
+	if err := aeadEncrypt(key, aeadSegmentSize, bytes.NewReader(plaintext), &ciphertext, aad); err != nil {
+		b.Fatalf("aeadEncrypt returned error: %v", err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Encrypt with %d workers", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				if err := aeadEncryptFrom(nil, workers, key, aeadSegmentSize, bytes.NewReader(plaintext), io.Discard, aad); err != nil {
+					b.Fatalf("aeadEncryptFrom returned error: %v", err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("Decrypt with %d workers", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				var err error
+				if workers > 1 {
+					err = decryptSegmentsParallel(key, aeadSegmentSize, bytes.NewReader(ciphertext.Bytes()), io.Discard, aad, workers)
+				} else {
+					err = aeadDecrypt(key, aeadSegmentSize, bytes.NewReader(ciphertext.Bytes()), io.Discard, aad)
+				}
+				if err != nil {
+					b.Fatalf("decrypt returned error: %v", err)
+				}
+			}
+		})
+	}
+}
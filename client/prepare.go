@@ -0,0 +1,191 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// PreparedEncrypt is the first phase of a two-phase Encrypt, created by
+// PrepareEncrypt. Its metadata is final, with all shares already wrapped, so
+// it can be recorded, for instance in a database transaction, before the
+// ciphertext is written with Encrypt.
+//
+// The DEK is held only in memory until Encrypt or Abort is called, after
+// which it is zeroed. A PreparedEncrypt that is abandoned without either is
+// zeroed when it is garbage collected, but callers should not rely on this:
+// call Abort, typically deferred, as soon as phase two will not happen. It is
+// safe for concurrent use.
+type PreparedEncrypt struct {
+	mu  sync.Mutex
+	dek shares.DEK
+	// Whether Encrypt or Abort has been called, after which the DEK is zero.
+	done bool
+
+	metadata    *configpb.Metadata
+	header      []byte
+	aad         []byte
+	segmentSize int64
+	keyURIs     []string
+	// The client's Rand, if set, for the salt and nonce prefix.
+	rand io.Reader
+	// The number of segments to seal concurrently, set WithParallelAEAD.
+	aeadWorkers int
+}
+
+// PrepareEncrypt is the first phase of a two-phase Encrypt: it generates a DEK
+// and wraps its shares, returning the final STET header and metadata without
+// encrypting any data. Write the ciphertext with the Encrypt method of the
+// returned PreparedEncrypt. The metadata followed by the ciphertext is a blob
+// as written by Encrypt, and they may also be stored separately as with
+// EncryptWithSidecar.
+//
+// As the metadata must be final before any data is read, the options that
+// record properties of the ciphertext in it, WithIntegrityManifest, are not
+// supported, nor are WithFraming and WithSignature.
+func (c *StetClient) PrepareEncrypt(ctx context.Context, stetConfig *configpb.StetConfig, blobID string, opts ...CallOption) (*PreparedEncrypt, error) {
+	callOpts := c.newCallOptions(opts)
+
+	config := stetConfig.GetEncryptConfig()
+	if config == nil {
+		return nil, fmt.Errorf("nil EncryptConfig passed to PrepareEncrypt()")
+	}
+
+	if err := shares.CheckShareCount(config.GetKeyConfig()); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case callOpts.integrityManifest:
+		return nil, fmt.Errorf("integrity manifest is not supported by PrepareEncrypt")
+	case callOpts.framing:
+		return nil, fmt.Errorf("framing is not supported by PrepareEncrypt")
+	case callOpts.signer != nil:
+		return nil, fmt.Errorf("signing is not supported by PrepareEncrypt")
+	}
+
+	// The unwrapped shares are zeroed once wrapped, and the DEK is copied
+	// into the PreparedEncrypt.
+	var dek *pooledDEK
+	if callOpts.dekPool != nil {
+		var err error
+		dek, err = callOpts.dekPool.get(config.GetKeyConfig())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		key, err := callOpts.newDEK()
+		if err != nil {
+			return nil, err
+		}
+
+		dek = &pooledDEK{key: key}
+		dek.shares, err = callOpts.createDEKShares(dek.key, config.GetKeyConfig())
+		if err != nil {
+			dek.zero()
+			return nil, fmt.Errorf("error creating DEK shares: %v", err)
+		}
+	}
+	defer dek.zero()
+
+	blob, err := c.newBlobMetadata(ctx, dek.key, dek.shares, stetConfig, config.GetKeyConfig(), blobID, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := MetadataToAAD(blob.metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing metadata: %v", err)
+	}
+
+	var header bytes.Buffer
+	if err := writeMetadata(&header, blob.metadata, blob.formatVersion, callOpts); err != nil {
+		return nil, err
+	}
+
+	p := &PreparedEncrypt{
+		dek:         dek.key,
+		metadata:    blob.metadata,
+		header:      header.Bytes(),
+		aad:         aad,
+		segmentSize: blob.segmentSize,
+		keyURIs:     blob.keyURIs,
+		rand:        callOpts.rand,
+		aeadWorkers: callOpts.aeadWorkers,
+	}
+	runtime.SetFinalizer(p, (*PreparedEncrypt).Abort)
+
+	return p, nil
+}
+
+// Metadata returns the STET header and metadata of the blob, which precede
+// the ciphertext in a blob written by Encrypt, or are passed separately to
+// DecryptWithSidecar.
+func (p *PreparedEncrypt) Metadata() []byte {
+	return bytes.Clone(p.header)
+}
+
+// BlobID returns the ID of the blob.
+func (p *PreparedEncrypt) BlobID() string {
+	return p.metadata.GetBlobId()
+}
+
+// Encrypt is the second phase of a two-phase Encrypt: it encrypts `input` with
+// the prepared DEK, writing only the ciphertext to `ciphertextOutput`, and
+// then zeroes the DEK. It may only be called once, and not after Abort.
+func (p *PreparedEncrypt) Encrypt(input io.Reader, ciphertextOutput io.Writer) (*StetMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return nil, fmt.Errorf("prepared encryption of blob %q has already been used or aborted", p.metadata.GetBlobId())
+	}
+	defer p.zero()
+
+	if err := aeadEncryptFrom(p.rand, p.aeadWorkers, p.dek, p.segmentSize, input, ciphertextOutput, p.aad); err != nil {
+		return nil, fmt.Errorf("error encrypting data: %v", err)
+	}
+
+	return &StetMetadata{
+		KeyUris:    p.keyURIs,
+		BlobID:     p.metadata.GetBlobId(),
+		Extensions: copyExtensions(p.metadata.GetExtensions()),
+	}, nil
+}
+
+// Abort abandons the second phase, zeroing the DEK so that the ciphertext can
+// no longer be written. It has no effect if Encrypt or Abort has already been
+// called.
+func (p *PreparedEncrypt) Abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.zero()
+}
+
+// zero overwrites the DEK and marks the PreparedEncrypt as done. The caller
+// must hold p.mu.
+func (p *PreparedEncrypt) zero() {
+	p.dek = shares.DEK{}
+	p.done = true
+}
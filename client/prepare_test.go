@@ -0,0 +1,152 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+)
+
+func TestPrepareEncrypt(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := bytes.Repeat([]byte("This is data to be encrypted. "), 100000)
+
+	prepared, err := stetClient.PrepareEncrypt(ctx, stetConfig, "blob", WithExtensions(map[string]string{"class": "a"}))
+	if err != nil {
+		t.Fatalf("PrepareEncrypt returned error: %v", err)
+	}
+	defer prepared.Abort()
+
+	if prepared.BlobID() != "blob" {
+		t.Errorf("BlobID() = %q, want %q", prepared.BlobID(), "blob")
+	}
+
+	// The metadata is final before any data is encrypted.
+	metadata := prepared.Metadata()
+	info, err := InspectMetadata(bytes.NewReader(metadata))
+	if err != nil {
+		t.Fatalf("InspectMetadata returned error: %v", err)
+	}
+	if info.BlobID != "blob" || info.Extensions["class"] != "a" {
+		t.Errorf("InspectMetadata returned %+v, want blob ID %q with extension", info, "blob")
+	}
+
+	var ciphertext bytes.Buffer
+	md, err := prepared.Encrypt(bytes.NewReader(plaintext), &ciphertext)
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	if md.BlobID != "blob" || len(md.KeyUris) != 2 {
+		t.Errorf("Encrypt returned %+v, want blob ID %q and 2 key URIs", md, "blob")
+	}
+
+	if prepared.dek != (shares.DEK{}) {
+		t.Error("DEK was not zeroed after Encrypt")
+	}
+
+	if _, err := prepared.Encrypt(bytes.NewReader(plaintext), &bytes.Buffer{}); err == nil {
+		t.Error("Second Encrypt succeeded, want error")
+	}
+
+	t.Run("Sidecar", func(t *testing.T) {
+		var output bytes.Buffer
+		if _, err := stetClient.DecryptWithSidecar(ctx, bytes.NewReader(metadata), bytes.NewReader(ciphertext.Bytes()), &output, stetConfig); err != nil {
+			t.Fatalf("DecryptWithSidecar returned error: %v", err)
+		}
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Error("DecryptWithSidecar returned different plaintext")
+		}
+	})
+
+	t.Run("Combined", func(t *testing.T) {
+		blob := append(bytes.Clone(metadata), ciphertext.Bytes()...)
+
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob), &output, stetConfig); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Error("Decrypt returned different plaintext")
+		}
+	})
+}
+
+func TestPrepareEncryptAbort(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	prepared, err := stetClient.PrepareEncrypt(ctx, stetConfig, "blob")
+	if err != nil {
+		t.Fatalf("PrepareEncrypt returned error: %v", err)
+	}
+
+	prepared.Abort()
+	if prepared.dek != (shares.DEK{}) {
+		t.Error("DEK was not zeroed by Abort")
+	}
+
+	if _, err := prepared.Encrypt(bytes.NewReader([]byte("data")), &bytes.Buffer{}); err == nil {
+		t.Error("Encrypt after Abort succeeded, want error")
+	}
+
+	// Abort is idempotent.
+	prepared.Abort()
+}
+
+func TestPrepareEncryptErrors(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey returned error: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		opts []CallOption
+	}{
+		{
+			name: "Integrity manifest",
+			opts: []CallOption{WithIntegrityManifest()},
+		},
+		{
+			name: "Framing",
+			opts: []CallOption{WithFraming()},
+		},
+		{
+			name: "Signer",
+			opts: []CallOption{WithSignature(signer, &bytes.Buffer{})},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := stetClient.PrepareEncrypt(ctx, stetConfig, "blob", tc.opts...); err == nil {
+				t.Error("PrepareEncrypt succeeded, want error")
+			}
+		})
+	}
+}
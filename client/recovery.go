@@ -0,0 +1,217 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// Recovery reconstructs the DEK of a blob incrementally, for manual
+// break-glass recovery when too few shares can be unwrapped by Decrypt. It
+// holds the shares unwrapped so far, to which shares unwrapped by external
+// means can be added with AddShare, or which can be retried with additional
+// key material with Retry, until enough are held to Decrypt the blob.
+//
+// The unwrapped shares are held in memory until the Recovery is no longer
+// referenced. A Recovery is not safe for concurrent use.
+type Recovery struct {
+	c        *StetClient
+	callOpts *callOptions
+	metadata *configpb.Metadata
+	keyCfg   *configpb.KeyConfig
+
+	// The wrapped shares, ordered by KEK, and the share unwrapped from each,
+	// or nil if it has not been unwrapped.
+	wrapped   []*configpb.WrappedShare
+	unwrapped []*shares.UnwrappedShare
+}
+
+// BeginRecovery reads the STET header and metadata of a blob from
+// `metadataInput`, and attempts to unwrap each of its shares as Decrypt
+// would. Unlike Decrypt, it succeeds even if too few shares are unwrapped to
+// reconstruct the DEK; use the returned Recovery to add more. If
+// `metadataInput` also contains the ciphertext, as written by Encrypt, it is
+// left positioned at the start of the ciphertext, for Recovery.Decrypt.
+func (c *StetClient) BeginRecovery(ctx context.Context, metadataInput io.Reader, stetConfig *configpb.StetConfig, opts ...CallOption) (*Recovery, error) {
+	callOpts := c.newCallOptions(opts)
+
+	metadata, err := ReadMetadata(metadataInput)
+	if err != nil {
+		return nil, err
+	}
+
+	keyCfg, err := c.matchKeyConfig(metadata, stetConfig, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadata.GetShares()) != len(keyCfg.GetKekInfos()) {
+		return nil, fmt.Errorf("number of shares (%d) does not match number of KEKs (%d)", len(metadata.GetShares()), len(keyCfg.GetKekInfos()))
+	}
+
+	wrapped, err := orderSharesByKEK(metadata.GetShares(), len(keyCfg.GetKekInfos()))
+	if err != nil {
+		return nil, err
+	}
+
+	shareOpts := c.decryptSharesOpts(metadata, keyCfg, stetConfig, callOpts)
+	shareOpts.report = callOpts.decryptReport
+	unwrapped, err := c.unwrapSharesByIndex(ctx, wrapped, shareOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping and validating shares: %w", err)
+	}
+
+	return &Recovery{
+		c:         c,
+		callOpts:  callOpts,
+		metadata:  metadata,
+		keyCfg:    keyCfg,
+		wrapped:   wrapped,
+		unwrapped: unwrapped,
+	}, nil
+}
+
+// KeyConfig returns the KeyConfig the blob was encrypted with. The share at
+// each index was wrapped with the KekInfo at the same index.
+func (r *Recovery) KeyConfig() *configpb.KeyConfig {
+	return r.keyCfg
+}
+
+// Unwrapped returns the indices of the shares unwrapped so far.
+func (r *Recovery) Unwrapped() []int {
+	var indices []int
+	for i, unwrapped := range r.unwrapped {
+		if unwrapped != nil {
+			indices = append(indices, i)
+		}
+	}
+
+	return indices
+}
+
+// Missing returns the indices of the shares not yet unwrapped.
+func (r *Recovery) Missing() []int {
+	var indices []int
+	for i, unwrapped := range r.unwrapped {
+		if unwrapped == nil {
+			indices = append(indices, i)
+		}
+	}
+
+	return indices
+}
+
+// Needed returns the number of additional shares needed to reconstruct the
+// DEK, or zero if enough have been unwrapped.
+func (r *Recovery) Needed() int {
+	needed := shareThreshold(r.keyCfg) - len(r.Unwrapped())
+	if needed < 0 {
+		return 0
+	}
+
+	return needed
+}
+
+// AddShare adds the unwrapped share at `index`, obtained by external means,
+// such as by unwrapping it with an offline key. The share is validated
+// against its hash in the metadata before being added.
+func (r *Recovery) AddShare(index int, share []byte) error {
+	if index < 0 || index >= len(r.wrapped) {
+		return fmt.Errorf("share index %v is out of range, the blob has %v shares", index, len(r.wrapped))
+	}
+
+	wrapped := r.wrapped[index]
+	if !shares.ValidateShareWithAlgorithm(share, wrapped.GetHash(), wrapped.GetHashAlgorithm()) {
+		return fmt.Errorf("share #%v does not have the expected hash", index+1)
+	}
+
+	r.unwrapped[index] = &shares.UnwrappedShare{Share: append([]byte(nil), share...)}
+	return nil
+}
+
+// Retry attempts to unwrap the missing shares again, with the asymmetric keys
+// and Confidential Space configs of `stetConfig`, for example after adding
+// the private key of an offline RSA KEK to its AsymmetricKeys. The
+// DecryptConfig of `stetConfig` is not used to match the KeyConfig again.
+// Shares that still fail to unwrap are logged, and not treated as errors.
+// Returns the number of shares newly unwrapped.
+func (r *Recovery) Retry(ctx context.Context, stetConfig *configpb.StetConfig) (int, error) {
+	missing := r.Missing()
+
+	var missingKEKs []*configpb.KekInfo
+	for _, i := range missing {
+		missingKEKs = append(missingKEKs, r.keyCfg.GetKekInfos()[i])
+	}
+
+	opts := r.c.decryptSharesOpts(r.metadata, r.keyCfg, stetConfig, r.callOpts)
+
+	var kmsClients *cloudkms.ClientFactory
+	if usesCloudKMS(missingKEKs) {
+		var release func()
+		kmsClients, release = opts.kmsClientFactory(ctx, r.c)
+		defer release()
+	}
+
+	added := 0
+	for _, i := range missing {
+		kek := r.keyCfg.GetKekInfos()[i]
+		r.c.logger(ctx).Infof("Retrying unwrapping share #%v with %v", i+1, kekDescription(kek))
+
+		unwrapped, _, err := r.c.unwrapAndValidateShare(ctx, kmsClients, r.wrapped[i], kek, opts)
+		if err != nil {
+			r.c.logger(ctx).Errorf("Failed to unwrap share #%v: %v", i+1, err)
+			continue
+		}
+
+		r.unwrapped[i] = unwrapped
+		added++
+	}
+
+	return added, nil
+}
+
+// Decrypt reconstructs the DEK from the shares unwrapped so far and decrypts
+// the ciphertext of the blob from `ciphertextInput`, as with
+// DecryptWithSidecar. It fails if more shares are Needed.
+func (r *Recovery) Decrypt(ciphertextInput io.Reader, output io.Writer) (*StetMetadata, error) {
+	if needed := r.Needed(); needed > 0 {
+		return nil, fmt.Errorf("%v more shares are needed to reconstruct the DEK, missing shares %v", needed, r.Missing())
+	}
+
+	var unwrappedShares []shares.UnwrappedShare
+	for _, unwrapped := range r.unwrapped {
+		if unwrapped != nil {
+			unwrappedShares = append(unwrappedShares, *unwrapped)
+		}
+	}
+
+	combinedDEK, err := combineDEK(r.metadata, r.keyCfg, unwrappedShares)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentSize, err := metadataSegmentSize(r.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptWithDEK(r.metadata, combinedDEK, unwrappedShares, segmentSize, r.callOpts.aeadWorkers, ciphertextInput, output, nil)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+
+	// A 2-of-3 config with two KMS KEKs and one offline RSA KEK.
+	rsaKeys, rsaFingerprint := writeRSAKeyPair(t, 2048)
+	stetConfig := newFakeKMSConfig(3)
+	keyCfg := stetConfig.GetEncryptConfig().GetKeyConfig()
+	keyCfg.GetShamir().Threshold = 2
+	keyCfg.GetKekInfos()[2].KekType = &configpb.KekInfo_RsaFingerprint{RsaFingerprint: rsaFingerprint}
+	stetConfig.AsymmetricKeys = rsaKeys
+
+	fakeKMS := &stettest.FakeKMS{}
+	stetClient := &StetClient{KMSClient: fakeKMS}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	// The recipient cannot use the second KMS KEK, and does not have the
+	// offline private key to begin with.
+	noPrivateKey := proto.Clone(stetConfig).(*configpb.StetConfig)
+	noPrivateKey.AsymmetricKeys = &configpb.AsymmetricKeys{PublicKeyFiles: rsaKeys.GetPublicKeyFiles()}
+	failKey := strings.TrimPrefix(keyCfg.GetKekInfos()[1].GetKekUri(), gcpKeyPrefix)
+	recipient := &StetClient{
+		KMSClient: &keyFailingKMS{FakeKMS: fakeKMS, failKey: failKey},
+		Logger:    &captureLogger{},
+	}
+
+	t.Run("Retry with offline key", func(t *testing.T) {
+		input := bytes.NewReader(ciphertext.Bytes())
+		r, err := recipient.BeginRecovery(ctx, input, noPrivateKey)
+		if err != nil {
+			t.Fatalf("BeginRecovery returned error: %v", err)
+		}
+
+		if got, want := r.Unwrapped(), []int{0}; !cmp.Equal(got, want) {
+			t.Errorf("Unwrapped() = %v, want %v", got, want)
+		}
+		if got, want := r.Missing(), []int{1, 2}; !cmp.Equal(got, want) {
+			t.Errorf("Missing() = %v, want %v", got, want)
+		}
+		if got := r.Needed(); got != 1 {
+			t.Errorf("Needed() = %v, want 1", got)
+		}
+
+		if _, err := r.Decrypt(bytes.NewReader(nil), &bytes.Buffer{}); err == nil {
+			t.Error("Decrypt succeeded with too few shares, want error")
+		}
+
+		added, err := r.Retry(ctx, stetConfig)
+		if err != nil {
+			t.Fatalf("Retry returned error: %v", err)
+		}
+		if added != 1 {
+			t.Errorf("Retry added %v shares, want 1", added)
+		}
+		if got, want := r.Unwrapped(), []int{0, 2}; !cmp.Equal(got, want) {
+			t.Errorf("Unwrapped() after Retry = %v, want %v", got, want)
+		}
+
+		var output bytes.Buffer
+		if _, err := r.Decrypt(input, &output); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+		}
+	})
+
+	t.Run("Add external share", func(t *testing.T) {
+		// Obtain the offline share by means outside the recovery.
+		full, err := stetClient.BeginRecovery(ctx, bytes.NewReader(ciphertext.Bytes()), stetConfig)
+		if err != nil {
+			t.Fatalf("BeginRecovery returned error: %v", err)
+		}
+		externalShare := full.unwrapped[2].Share
+
+		input := bytes.NewReader(ciphertext.Bytes())
+		r, err := recipient.BeginRecovery(ctx, input, noPrivateKey)
+		if err != nil {
+			t.Fatalf("BeginRecovery returned error: %v", err)
+		}
+
+		if err := r.AddShare(3, externalShare); err == nil {
+			t.Error("AddShare succeeded with an out of range index, want error")
+		}
+		if err := r.AddShare(1, externalShare); err == nil {
+			t.Error("AddShare succeeded with a share at the wrong index, want error")
+		}
+		if err := r.AddShare(2, []byte("not a share")); err == nil {
+			t.Error("AddShare succeeded with an invalid share, want error")
+		}
+		if got := r.Needed(); got != 1 {
+			t.Errorf("Needed() after invalid shares = %v, want 1", got)
+		}
+
+		if err := r.AddShare(2, externalShare); err != nil {
+			t.Fatalf("AddShare returned error: %v", err)
+		}
+		if got := r.Needed(); got != 0 {
+			t.Errorf("Needed() after AddShare = %v, want 0", got)
+		}
+
+		var output bytes.Buffer
+		if _, err := r.Decrypt(input, &output); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// failedShares returns the indices of the shares in `report` that failed to
+// unwrap, as opposed to being skipped.
+func failedShares(report *DecryptReport) []int {
+	var failed []int
+	for _, share := range report.Shares {
+		if share.Err != nil && !errors.Is(share.Err, ErrKEKNotAvailable) && !errors.Is(share.Err, ErrShareNotNeeded) {
+			failed = append(failed, share.Index)
+		}
+	}
+
+	return failed
+}
+
+// recreateShare recreates the unwrapped share of `wrapped` from the shares of
+// the same DEK in `unwrapped`, at least the threshold of them. The x
+// coordinate of the share is only recorded inside the wrapped share, so the
+// share at each coordinate is compared against the hash of `wrapped`.
+func recreateShare(unwrapped [][]byte, wrapped *configpb.WrappedShare) ([]byte, error) {
+	for x := 1; x <= 255; x++ {
+		share, err := shares.EvaluateShare(unwrapped, byte(x))
+		if err != nil {
+			return nil, err
+		}
+
+		if shares.ValidateShareWithAlgorithm(share, wrapped.GetHash(), wrapped.GetHashAlgorithm()) {
+			return share, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no share of the DEK matches the hash of the wrapped share")
+}
+
+// repairShares recreates the shares of the blob with `metadata` that failed to
+// unwrap, as listed in `report`, from the shares in `unwrappedShares`, and
+// wraps them again with their KEKs. It returns a copy of `metadata` with the
+// repaired shares replaced, and the indices of the repaired shares, or nil if
+// no share was repaired. Shares that cannot be repaired, such as because their
+// KEK is still unavailable, are logged and left unchanged.
+func (c *StetClient) repairShares(ctx context.Context, metadata *configpb.Metadata, stetConfig *configpb.StetConfig, unwrappedShares []shares.UnwrappedShare, report *DecryptReport, callOpts *callOptions) (*configpb.Metadata, []int, error) {
+	failed := failedShares(report)
+	if len(failed) == 0 {
+		return nil, nil, nil
+	}
+
+	// Only shares split with Shamir's Secret Sharing can be recreated from
+	// the others.
+	keyCfg, err := c.matchKeyConfig(metadata, stetConfig, callOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	scheme, err := shares.ResolveScheme(metadata.GetSplitScheme(), keyCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if scheme.Name() != shares.SchemeShamir {
+		return nil, nil, nil
+	}
+
+	keks := keyCfg.GetKekInfos()
+	ordered, err := orderSharesByKEK(metadata.GetShares(), len(keks))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unwrapped [][]byte
+	for _, share := range unwrappedShares {
+		unwrapped = append(unwrapped, share.Share)
+	}
+
+	shareOpts := c.decryptSharesOpts(metadata, keyCfg, stetConfig, callOpts)
+	shareOpts.timings = nil
+
+	var kmsClients *cloudkms.ClientFactory
+	if usesCloudKMS(keks) {
+		var release func()
+		kmsClients, release = shareOpts.kmsClientFactory(ctx, c)
+		defer release()
+	}
+
+	repaired := proto.Clone(metadata).(*configpb.Metadata)
+	var indices []int
+	for _, i := range failed {
+		oldShare := ordered[i]
+
+		share, err := recreateShare(unwrapped, oldShare)
+		if err != nil {
+			c.logger(ctx).Warningf("Failed to repair share #%v of blob %q: %v", i+1, metadata.GetBlobId(), err)
+			continue
+		}
+
+		shareOpts.hashAlgorithm = oldShare.GetHashAlgorithm()
+		newShare, _, err := c.wrapShare(ctx, kmsClients, share, keks[i], shareOpts)
+		if err != nil {
+			c.logger(ctx).Warningf("Failed to repair share #%v of blob %q: error wrapping share with %v: %v", i+1, metadata.GetBlobId(), kekDescription(keks[i]), err)
+			continue
+		}
+		newShare.KekIndex = oldShare.GetKekIndex()
+
+		for j, s := range metadata.GetShares() {
+			if s == oldShare {
+				repaired.GetShares()[j] = newShare
+			}
+		}
+		indices = append(indices, i)
+	}
+
+	if len(indices) == 0 {
+		return nil, nil, nil
+	}
+
+	return repaired, indices, nil
+}
+
+// resealOptions returns the options to write a blob derived from the blob
+// with `metadata` with the same DEK, keeping the blob's features.
+func resealOptions(metadata *configpb.Metadata, callOpts *callOptions) *callOptions {
+	opts := *callOpts
+	opts.integrityManifest = metadata.GetIntegrityManifest() != nil
+	opts.provenance = metadata.GetProvenance() != nil
+	opts.keyCommitment = len(metadata.GetKeyCommitment()) != 0
+	opts.segmentSize = metadata.GetSegmentSize()
+	opts.hasSizeHint = false
+	opts.extensions = metadata.GetExtensions()
+	if len(metadata.GetShares()) > 0 {
+		opts.shareHashAlgorithm = metadata.GetShares()[0].GetHashAlgorithm()
+	}
+
+	return &opts
+}
+
+// sealRepairedBlob starts writing the blob with the repaired `metadata` and
+// the unchanged DEK to `output`, encrypting the plaintext written to the
+// returned writer and recomputing the integrity manifest, if any. Once the
+// plaintext is complete, or decrypting it failed, the returned function must
+// be called with the error decrypting, if any; it waits for the blob to be
+// written and returns any error writing it. If writing the blob fails, the
+// rest of the plaintext is discarded, so that the decryption is not
+// interrupted.
+func sealRepairedBlob(dek shares.DEK, metadata *configpb.Metadata, segmentSize int64, output io.Writer, callOpts *callOptions) (io.Writer, func(error) error, error) {
+	sealOpts := resealOptions(metadata, callOpts)
+	sealOpts.timings = nil
+
+	// The integrity manifest covers the old ciphertext, so it is recomputed.
+	metadata.IntegrityManifest = nil
+
+	formatVersion, err := encryptFormatVersion(metadata.GetKeyConfig(), sealOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := sealBlob(dek, metadata, segmentSize, formatVersion, pr, output, output, sealOpts)
+		if err != nil {
+			io.Copy(io.Discard, pr)
+		}
+		done <- err
+	}()
+
+	finish := func(decryptErr error) error {
+		pw.CloseWithError(decryptErr)
+		return <-done
+	}
+
+	return pw, finish, nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	"github.com/google/go-cmp/cmp"
+	gax "github.com/googleapis/gax-go/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	kmsspb "cloud.google.com/go/kms/apiv1/kmspb"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// outageKMS is a FakeKMS whose key `downKey` can neither wrap nor unwrap.
+type outageKMS struct {
+	*stettest.FakeKMS
+	downKey string
+}
+
+func (o *outageKMS) Encrypt(ctx context.Context, req *kmsspb.EncryptRequest, opts ...gax.CallOption) (*kmsspb.EncryptResponse, error) {
+	if req.GetName() == o.downKey {
+		return nil, fmt.Errorf("key %v is unavailable", o.downKey)
+	}
+	return o.FakeKMS.Encrypt(ctx, req, opts...)
+}
+
+func (o *outageKMS) Decrypt(ctx context.Context, req *kmsspb.DecryptRequest, opts ...gax.CallOption) (*kmsspb.DecryptResponse, error) {
+	if req.GetName() == o.downKey {
+		return nil, fmt.Errorf("key %v is unavailable", o.downKey)
+	}
+	return o.FakeKMS.Decrypt(ctx, req, opts...)
+}
+
+func TestReadRepair(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("This is data to be encrypted.")
+	keys, fingerprint := writeRSAKeyPair(t, 2048)
+
+	kmsConfig := newFakeKMSConfig(3)
+	kmsConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 2
+	firstKey := "projects/test/locations/test/keyRings/test/cryptoKeys/key0"
+
+	// The first share of `rsaConfig` is wrapped with an RSA key, whose private
+	// key is missing from `noPrivateKey`.
+	rsaConfig := newFakeKMSConfig(3)
+	rsaConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 2
+	rsaConfig.GetEncryptConfig().GetKeyConfig().GetKekInfos()[0].KekType = &configpb.KekInfo_RsaFingerprint{RsaFingerprint: fingerprint}
+	rsaConfig.AsymmetricKeys = keys
+	noPrivateKey := proto.Clone(rsaConfig).(*configpb.StetConfig)
+	noPrivateKey.GetAsymmetricKeys().PrivateKeyFiles = nil
+
+	testCases := []struct {
+		name          string
+		encryptConfig *configpb.StetConfig
+		decryptConfig *configpb.StetConfig
+		encryptOpts   []CallOption
+		kmsClient     *outageKMS
+		// Whether the EKM has recovered by the time the share is rewrapped.
+		recovered    bool
+		wantRepaired []int
+	}{
+		{
+			name:          "No failed shares",
+			encryptConfig: kmsConfig,
+			decryptConfig: kmsConfig,
+			kmsClient:     &outageKMS{FakeKMS: &stettest.FakeKMS{}},
+		},
+		{
+			name:          "Share repaired after outage",
+			encryptConfig: kmsConfig,
+			decryptConfig: kmsConfig,
+			kmsClient:     &outageKMS{FakeKMS: &stettest.FakeKMS{}, downKey: firstKey},
+			recovered:     true,
+			wantRepaired:  []int{0},
+		},
+		{
+			name:          "Share repaired with blob features",
+			encryptConfig: kmsConfig,
+			decryptConfig: kmsConfig,
+			encryptOpts:   []CallOption{WithIntegrityManifest(), WithKeyCommitment(), WithSegmentSize(4096), WithShareHashAlgorithm(configpb.ShareHashAlgorithm_SHA512)},
+			kmsClient:     &outageKMS{FakeKMS: &stettest.FakeKMS{}, downKey: firstKey},
+			recovered:     true,
+			wantRepaired:  []int{0},
+		},
+		{
+			name:          "Share not repaired during outage",
+			encryptConfig: kmsConfig,
+			decryptConfig: kmsConfig,
+			kmsClient:     &outageKMS{FakeKMS: &stettest.FakeKMS{}, downKey: firstKey},
+		},
+		{
+			name:          "RSA share repaired",
+			encryptConfig: rsaConfig,
+			decryptConfig: noPrivateKey,
+			kmsClient:     &outageKMS{FakeKMS: &stettest.FakeKMS{}},
+			wantRepaired:  []int{0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{KMSClient: tc.kmsClient}
+
+			var blob bytes.Buffer
+			encryptClient := &StetClient{KMSClient: tc.kmsClient.FakeKMS}
+			if _, err := encryptClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, tc.encryptConfig, "blob", tc.encryptOpts...); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+			original := blob.Bytes()
+
+			// Unwrapping fails during the outage, but wrapping succeeds
+			// once the EKM has recovered.
+			if tc.recovered {
+				stetClient.KMSClient = &keyFailingKMS{FakeKMS: tc.kmsClient.FakeKMS, failKey: tc.kmsClient.downKey}
+			}
+
+			var output, repaired bytes.Buffer
+			md, err := stetClient.Decrypt(ctx, bytes.NewReader(original), &output, tc.decryptConfig, WithReadRepair(&repaired))
+			if err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+			}
+			if diff := cmp.Diff(tc.wantRepaired, md.RepairedShares); diff != "" {
+				t.Errorf("Decrypt returned unexpected RepairedShares (-want +got):\n%s", diff)
+			}
+
+			if len(tc.wantRepaired) == 0 {
+				if repaired.Len() != 0 {
+					t.Errorf("Decrypt wrote a repaired blob of %v bytes, want none", repaired.Len())
+				}
+				return
+			}
+
+			// The repaired blob has the same DEK and blob ID, and only the
+			// repaired shares differ.
+			oldMetadata, err := ReadMetadata(bytes.NewReader(original))
+			if err != nil {
+				t.Fatalf("ReadMetadata returned error: %v", err)
+			}
+			newMetadata, err := ReadMetadata(bytes.NewReader(repaired.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadMetadata of repaired blob returned error: %v", err)
+			}
+			if newMetadata.GetBlobId() != oldMetadata.GetBlobId() {
+				t.Errorf("Repaired blob has ID %q, want %q", newMetadata.GetBlobId(), oldMetadata.GetBlobId())
+			}
+			if !bytes.Equal(newMetadata.GetKeyCommitment(), oldMetadata.GetKeyCommitment()) {
+				t.Error("Repaired blob has a different key commitment")
+			}
+			if (newMetadata.GetIntegrityManifest() == nil) != (oldMetadata.GetIntegrityManifest() == nil) {
+				t.Errorf("Repaired blob has integrity manifest %v, want one only if the original has one", newMetadata.GetIntegrityManifest())
+			}
+			if newMetadata.GetSegmentSize() != oldMetadata.GetSegmentSize() {
+				t.Errorf("Repaired blob has segment size %v, want %v", newMetadata.GetSegmentSize(), oldMetadata.GetSegmentSize())
+			}
+			repairedIndex := map[int]bool{}
+			for _, i := range tc.wantRepaired {
+				repairedIndex[i] = true
+			}
+			for i, share := range oldMetadata.GetShares() {
+				if repairedIndex[i] {
+					if !bytes.Equal(newMetadata.GetShares()[i].GetHash(), share.GetHash()) {
+						t.Errorf("Repaired share #%v has a different hash, want the same share", i+1)
+					}
+					continue
+				}
+				if diff := cmp.Diff(share, newMetadata.GetShares()[i], protocmp.Transform()); diff != "" {
+					t.Errorf("Share #%v changed in the repaired blob (-want +got):\n%s", i+1, diff)
+				}
+			}
+
+			// Every share of the repaired blob unwraps.
+			var report DecryptReport
+			var repairedOutput bytes.Buffer
+			if _, err := encryptClient.Decrypt(ctx, &repaired, &repairedOutput, tc.encryptConfig, WithDecryptReport(&report)); err != nil {
+				t.Fatalf("Decrypt of repaired blob returned error: %v", err)
+			}
+			if !bytes.Equal(repairedOutput.Bytes(), plaintext) {
+				t.Errorf("Decrypt of repaired blob returned plaintext %q, want %q", repairedOutput.Bytes(), plaintext)
+			}
+			for _, share := range report.Shares {
+				if share.Err != nil {
+					t.Errorf("Share #%v of repaired blob failed to unwrap: %v", share.Index+1, share.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadRepairDecryptFails(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(3)
+	stetConfig.GetEncryptConfig().GetKeyConfig().GetShamir().Threshold = 2
+	fakeKMS := &stettest.FakeKMS{}
+
+	var blob bytes.Buffer
+	if _, err := (&StetClient{KMSClient: fakeKMS}).Encrypt(ctx, bytes.NewReader([]byte("This is data to be encrypted.")), &blob, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	// Tamper with the last byte of the ciphertext.
+	tampered := blob.Bytes()
+	tampered[len(tampered)-1] ^= 1
+
+	stetClient := &StetClient{KMSClient: &keyFailingKMS{FakeKMS: fakeKMS, failKey: "projects/test/locations/test/keyRings/test/cryptoKeys/key0"}}
+	var repaired bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, bytes.NewReader(tampered), &bytes.Buffer{}, stetConfig, WithReadRepair(&repaired)); err == nil {
+		t.Error("Decrypt of tampered blob WithReadRepair succeeded, want error")
+	}
+}
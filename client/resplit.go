@@ -0,0 +1,129 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Resplit re-splits the DEK of a STET-encrypted blob under `newKeyConfig`,
+// such as to change the Shamir threshold or KEKs, without changing the DEK.
+// The DEK is recovered using the DecryptConfig of `stetConfig`, then split and
+// wrapped as described by `newKeyConfig`, and the blob is written to `output`
+// with the same blob ID. `newKeyConfig` must be present in the DecryptConfig
+// for the new blob to be decrypted.
+//
+// As the wrapped shares are bound into the AAD of the ciphertext, the
+// ciphertext is re-encrypted with the unchanged DEK under the new AAD; it is
+// authenticated as it is read, and Resplit fails if it has been tampered with.
+// On error, `output` may contain a partial blob and should be discarded.
+//
+// Returns the URIs of the keys used to wrap the new shares.
+func (c *StetClient) Resplit(ctx context.Context, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig, newKeyConfig *configpb.KeyConfig, opts ...CallOption) (*StetMetadata, error) {
+	callOpts := c.newCallOptions(opts)
+
+	if newKeyConfig == nil {
+		return nil, fmt.Errorf("nil KeyConfig passed to Resplit()")
+	}
+
+	metadata, err := ReadMetadata(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	if proto.Equal(metadata.GetKeyConfig(), newKeyConfig) {
+		return nil, fmt.Errorf("blob is already split with the given KeyConfig")
+	}
+
+	if newKeyConfig.GetDekAlgorithm() != metadata.GetKeyConfig().GetDekAlgorithm() {
+		return nil, fmt.Errorf("cannot change DEK algorithm from %v to %v when re-splitting", metadata.GetKeyConfig().GetDekAlgorithm(), newKeyConfig.GetDekAlgorithm())
+	}
+
+	return c.reseal(ctx, metadata, input, output, stetConfig, newKeyConfig, callOpts)
+}
+
+// RefreshShares re-randomizes the Shamir shares of a STET-encrypted blob
+// without changing the DEK, so that shares leaked before the refresh cannot
+// be combined with shares of the refreshed blob. The DEK is recovered using
+// the DecryptConfig of `stetConfig`, then split afresh under the blob's
+// existing KeyConfig and KEKs, and the blob is written to `output` with the
+// same blob ID.
+//
+// As with Resplit, the wrapped shares are bound into the AAD, so the
+// ciphertext is re-encrypted with the unchanged DEK under the new AAD. On
+// error, `output` may contain a partial blob and should be discarded.
+//
+// Returns the URIs of the keys used to wrap the new shares.
+func (c *StetClient) RefreshShares(ctx context.Context, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig, opts ...CallOption) (*StetMetadata, error) {
+	callOpts := c.newCallOptions(opts)
+
+	metadata, err := ReadMetadata(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+
+	if metadata.GetKeyConfig().GetShamir() == nil {
+		return nil, fmt.Errorf("only blobs split with Shamir's Secret Sharing can have their shares refreshed")
+	}
+
+	return c.reseal(ctx, metadata, input, output, stetConfig, metadata.GetKeyConfig(), callOpts)
+}
+
+// reseal recovers the DEK of the blob with the given metadata, whose
+// ciphertext is read from `input`, and writes a blob with the same DEK and
+// blob ID split under `keyCfg` to `output`.
+func (c *StetClient) reseal(ctx context.Context, metadata *configpb.Metadata, input io.Reader, output io.Writer, stetConfig *configpb.StetConfig, keyCfg *configpb.KeyConfig, callOpts *callOptions) (*StetMetadata, error) {
+	segmentSize, err := metadataSegmentSize(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, _, err := c.recoverDEK(ctx, metadata, stetConfig, callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := MetadataToAAD(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing metadata: %v", err)
+	}
+
+	// Keep the key commitment, segment size and share hash algorithm of the
+	// blob, unless overridden.
+	opts := *callOpts
+	opts.keyCommitment = opts.keyCommitment || len(metadata.GetKeyCommitment()) != 0
+	if opts.segmentSize == 0 {
+		opts.segmentSize = metadata.GetSegmentSize()
+	}
+	if opts.shareHashAlgorithm == configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH && len(metadata.GetShares()) > 0 {
+		opts.shareHashAlgorithm = metadata.GetShares()[0].GetHashAlgorithm()
+	}
+	callOpts = &opts
+
+	// Decrypt the existing ciphertext into a pipe that is read as the
+	// plaintext for the new blob.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(aeadDecrypt(dek, segmentSize, input, pw, aad))
+	}()
+	defer pr.Close()
+
+	return c.encryptWithDEK(ctx, dek, pr, output, output, stetConfig, keyCfg, metadata.GetBlobId(), callOpts)
+}
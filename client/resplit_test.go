@@ -0,0 +1,273 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// newShamirKeyConfig returns a `threshold`-of-`numShares` KeyConfig using
+// fake Cloud KMS keys whose names are prefixed by `prefix`.
+func newShamirKeyConfig(prefix string, threshold, numShares int) *configpb.KeyConfig {
+	var kekInfos []*configpb.KekInfo
+	for i := 0; i < numShares; i++ {
+		kekInfos = append(kekInfos, &configpb.KekInfo{
+			KekType: &configpb.KekInfo_KekUri{KekUri: fmt.Sprintf("gcp-kms://projects/test/locations/test/keyRings/test/cryptoKeys/%v%d", prefix, i)},
+		})
+	}
+
+	return &configpb.KeyConfig{
+		KekInfos:              kekInfos,
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: int64(threshold), Shares: int64(numShares)}},
+	}
+}
+
+func TestResplit(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	oldKeyConfig := newShamirKeyConfig("old", 2, 3)
+	newKeyConfig := newShamirKeyConfig("new", 3, 5)
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: oldKeyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{oldKeyConfig, newKeyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	var resplit bytes.Buffer
+	md, err := stetClient.Resplit(ctx, bytes.NewReader(blob.Bytes()), &resplit, stetConfig, newKeyConfig)
+	if err != nil {
+		t.Fatalf("Resplit returned error: %v", err)
+	}
+
+	if len(md.KeyUris) != 5 {
+		t.Errorf("Resplit returned %v key URIs, want 5", len(md.KeyUris))
+	}
+
+	// The re-split blob should use the new KeyConfig and the same DEK.
+	oldMetadata, err := ReadMetadata(bytes.NewReader(blob.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	newMetadata, err := ReadMetadata(bytes.NewReader(resplit.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	if len(newMetadata.GetShares()) != 5 {
+		t.Errorf("Re-split blob has %v shares, want 5", len(newMetadata.GetShares()))
+	}
+
+	oldDEK, _, err := stetClient.recoverDEK(ctx, oldMetadata, stetConfig, stetClient.newCallOptions(nil))
+	if err != nil {
+		t.Fatalf("recoverDEK returned error for original blob: %v", err)
+	}
+
+	newDEK, _, err := stetClient.recoverDEK(ctx, newMetadata, stetConfig, stetClient.newCallOptions(nil))
+	if err != nil {
+		t.Fatalf("recoverDEK returned error for re-split blob: %v", err)
+	}
+
+	if oldDEK != newDEK {
+		t.Error("Resplit changed the DEK")
+	}
+
+	var output bytes.Buffer
+	decryptMD, err := stetClient.Decrypt(ctx, &resplit, &output, stetConfig)
+	if err != nil {
+		t.Fatalf("Decrypt returned error for re-split blob: %v", err)
+	}
+
+	if decryptMD.BlobID != "blob" {
+		t.Errorf("Decrypt returned blob ID %q, want %q", decryptMD.BlobID, "blob")
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+	}
+}
+
+func TestResplitErrors(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	oldKeyConfig := newShamirKeyConfig("old", 2, 3)
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: oldKeyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{oldKeyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(make([]byte, 2*aeadSegmentSize)), &blob, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	tampered := append([]byte{}, blob.Bytes()...)
+	tampered[len(tampered)-100] ^= 1
+
+	invalidThreshold := newShamirKeyConfig("new", 4, 3)
+
+	unknownDEKKeyConfig := newShamirKeyConfig("new", 3, 5)
+	unknownDEKKeyConfig.DekAlgorithm = configpb.DekAlgorithm_UNKNOWN_DEK_ALGORITHM
+
+	testcases := []struct {
+		name         string
+		blob         []byte
+		newKeyConfig *configpb.KeyConfig
+	}{
+		{
+			name:         "Nil KeyConfig",
+			blob:         blob.Bytes(),
+			newKeyConfig: nil,
+		},
+		{
+			name:         "Unchanged KeyConfig",
+			blob:         blob.Bytes(),
+			newKeyConfig: oldKeyConfig,
+		},
+		{
+			name:         "Threshold exceeds shares",
+			blob:         blob.Bytes(),
+			newKeyConfig: invalidThreshold,
+		},
+		{
+			name:         "Changed DEK algorithm",
+			blob:         blob.Bytes(),
+			newKeyConfig: unknownDEKKeyConfig,
+		},
+		{
+			name:         "Tampered ciphertext",
+			blob:         tampered,
+			newKeyConfig: newShamirKeyConfig("new", 3, 5),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			if _, err := stetClient.Resplit(ctx, bytes.NewReader(tc.blob), &output, stetConfig, tc.newKeyConfig); err == nil {
+				t.Error("Resplit succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestRefreshShares(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	keyConfig := newShamirKeyConfig("key", 2, 3)
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig:  &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig:  &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+		AsymmetricKeys: &configpb.AsymmetricKeys{},
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "blob"); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	var refreshed bytes.Buffer
+	if _, err := stetClient.RefreshShares(ctx, bytes.NewReader(blob.Bytes()), &refreshed, stetConfig); err != nil {
+		t.Fatalf("RefreshShares returned error: %v", err)
+	}
+
+	oldMetadata, err := ReadMetadata(bytes.NewReader(blob.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	newMetadata, err := ReadMetadata(bytes.NewReader(refreshed.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata returned error: %v", err)
+	}
+
+	oldDEK, oldShares, err := stetClient.recoverDEK(ctx, oldMetadata, stetConfig, stetClient.newCallOptions(nil))
+	if err != nil {
+		t.Fatalf("recoverDEK returned error for original blob: %v", err)
+	}
+
+	newDEK, newShares, err := stetClient.recoverDEK(ctx, newMetadata, stetConfig, stetClient.newCallOptions(nil))
+	if err != nil {
+		t.Fatalf("recoverDEK returned error for refreshed blob: %v", err)
+	}
+
+	if oldDEK != newDEK {
+		t.Fatal("RefreshShares changed the DEK")
+	}
+
+	for i := range oldShares {
+		if bytes.Equal(oldShares[i].Share, newShares[i].Share) {
+			t.Errorf("RefreshShares did not change share %v", i)
+		}
+	}
+
+	// Combining an old share with a new one must not yield the DEK.
+	for i := range oldShares {
+		for j := range newShares {
+			if i == j {
+				continue
+			}
+
+			combined, err := shares.CombineShares([][]byte{oldShares[i].Share, newShares[j].Share})
+			if err == nil && bytes.Equal(combined, oldDEK[:]) {
+				t.Errorf("Combining old share %v with new share %v recovered the DEK", i, j)
+			}
+		}
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, &refreshed, &output, stetConfig); err != nil {
+		t.Fatalf("Decrypt returned error for refreshed blob: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %q, want %q", output.Bytes(), plaintext)
+	}
+}
+
+func TestRefreshSharesNoSplit(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+
+	var blob bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("plaintext")), &blob, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.RefreshShares(ctx, &blob, &output, stetConfig); err == nil {
+		t.Error("RefreshShares succeeded for a blob without Shamir shares, want error")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package securesession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/GoogleCloudPlatform/stet/client/ekmclient"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrConnectionLost is wrapped by the errors returned from ConfidentialWrap
+// and ConfidentialUnwrap when the connection to the EKM fails before a
+// response is received, such as when the EKM drops the TCP or TLS connection.
+// The EKM has not rejected the request, so it is safe to retry on a new
+// secure session.
+var ErrConnectionLost = errors.New("connection to EKM lost")
+
+// ErrRequestFailed is wrapped by the errors returned from ConfidentialWrap and
+// ConfidentialUnwrap when the EKM responds with an error, such as for a
+// protocol or authorization failure. These must not be retried on a new
+// secure session. If the EKM returned a status code, an *EKMError is also
+// wrapped, whose Retryable method reports whether the request may succeed if
+// retried later.
+var ErrRequestFailed = errors.New("EKM request failed")
+
+// EKMErrorCategory classifies an error response from an EKM by its status
+// code.
+type EKMErrorCategory int
+
+const (
+	// EKMErrorOther is an error response in none of the other categories.
+	EKMErrorOther EKMErrorCategory = iota
+
+	// EKMErrorAttestationRejected means the EKM did not accept the client's
+	// attestation evidence or credentials.
+	EKMErrorAttestationRejected
+
+	// EKMErrorPermissionDenied means the client is not authorized to use the
+	// key.
+	EKMErrorPermissionDenied
+
+	// EKMErrorKeyDisabled means the key is not in a state that allows the
+	// operation, such as being disabled or destroyed.
+	EKMErrorKeyDisabled
+
+	// EKMErrorQuotaExceeded means the client has exceeded the EKM's request
+	// quota or rate limit.
+	EKMErrorQuotaExceeded
+)
+
+func (c EKMErrorCategory) String() string {
+	switch c {
+	case EKMErrorAttestationRejected:
+		return "attestation rejected"
+	case EKMErrorPermissionDenied:
+		return "permission denied"
+	case EKMErrorKeyDisabled:
+		return "key disabled"
+	case EKMErrorQuotaExceeded:
+		return "quota exceeded"
+	default:
+		return "other"
+	}
+}
+
+// EKMError is an error response from an EKM, preserving the status code the
+// EKM returned so that callers can distinguish failure categories.
+type EKMError struct {
+	// The HTTP status code, for EKMs reached over HTTPS. Zero otherwise.
+	HTTPStatus int
+
+	// The gRPC status code, for EKMs reached over gRPC. OK otherwise.
+	GRPCCode codes.Code
+
+	Category EKMErrorCategory
+	Err      error
+}
+
+func (e *EKMError) Error() string {
+	return fmt.Sprintf("EKM error (%v): %v", e.Category, e.Err)
+}
+
+func (e *EKMError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the request may succeed if retried after a
+// backoff. Only exceeded quotas are retryable: the other categories need an
+// operator to change the key, its permissions or the attestation policy.
+func (e *EKMError) Retryable() bool {
+	return e.Category == EKMErrorQuotaExceeded
+}
+
+// httpErrorCategories maps the HTTP status codes returned by EKMs to error
+// categories.
+var httpErrorCategories = map[int]EKMErrorCategory{
+	http.StatusUnauthorized:       EKMErrorAttestationRejected,
+	http.StatusForbidden:          EKMErrorPermissionDenied,
+	http.StatusPreconditionFailed: EKMErrorKeyDisabled,
+	http.StatusTooManyRequests:    EKMErrorQuotaExceeded,
+}
+
+// grpcErrorCategories maps the gRPC status codes returned by EKMs to error
+// categories.
+var grpcErrorCategories = map[codes.Code]EKMErrorCategory{
+	codes.Unauthenticated:    EKMErrorAttestationRejected,
+	codes.PermissionDenied:   EKMErrorPermissionDenied,
+	codes.FailedPrecondition: EKMErrorKeyDisabled,
+	codes.ResourceExhausted:  EKMErrorQuotaExceeded,
+}
+
+// newEKMError returns an *EKMError wrapping `err` if it carries an HTTP or
+// gRPC status code from the EKM, and `err` unchanged otherwise.
+func newEKMError(err error) error {
+	var statusErr *ekmclient.StatusError
+	if errors.As(err, &statusErr) {
+		return &EKMError{HTTPStatus: statusErr.StatusCode, Category: httpErrorCategories[statusErr.StatusCode], Err: err}
+	}
+
+	if s, ok := status.FromError(err); ok && s.Code() != codes.OK && s.Code() != codes.Unknown {
+		return &EKMError{GRPCCode: s.Code(), Category: grpcErrorCategories[s.Code()], Err: err}
+	}
+
+	return err
+}
+
+// classifyRPCError wraps an error returned by the EKM client in
+// ErrConnectionLost or ErrRequestFailed. Errors from the context being
+// cancelled or timing out are returned unchanged, as they are neither.
+func classifyRPCError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	if isConnectionError(err) {
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrRequestFailed, newEKMError(err))
+}
+
+// isConnectionError reports whether `err` is a connection-level failure,
+// rather than an error response from the EKM.
+func isConnectionError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	// gRPC reports dropped connections as Unavailable.
+	if s, ok := status.FromError(err); ok && s.Code() == codes.Unavailable {
+		return true
+	}
+
+	return false
+}
+
+// attestationEKMError is like newEKMError, for errors from the EKM when it
+// evaluates the attestation evidence. As the evidence is all that is being
+// authorized, permission denied errors are reported as rejected attestations.
+func attestationEKMError(err error) error {
+	err = newEKMError(err)
+
+	var ekmErr *EKMError
+	if errors.As(err, &ekmErr) && ekmErr.Category == EKMErrorPermissionDenied {
+		ekmErr.Category = EKMErrorAttestationRejected
+	}
+
+	return err
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package securesession
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrUnexpectedRecord is returned when the server sends a TLS record that is
+// not valid at the current stage of secure session establishment, such as
+// application data before the handshake has completed.
+var ErrUnexpectedRecord = errors.New("unexpected TLS record from server")
+
+// TLS record content types, as defined in RFC 8446 section 5.1.
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+	recordTypeApplicationData  = 23
+)
+
+const (
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+
+	handshakeTypeServerHello          = 2
+	extensionSupportedVersions        = 43
+	supportedVersionTLS13      uint16 = 0x0304
+)
+
+// handshakeRecordChecker inspects the TLS records received from the server
+// while the handshake is in progress, before they are passed to the TLS
+// connection. The zero value is ready to use.
+//
+// Under TLS 1.2, the server never sends application data records during the
+// handshake. Under TLS 1.3, all handshake messages after the ServerHello are
+// encrypted and sent as application data records, so these are only rejected
+// if they precede the ServerHello.
+//
+// The server may fragment handshake messages across several records (and
+// several responses), so the ServerHello is only inspected once it has been
+// fully reassembled. Validating the handshake itself is left to the TLS
+// connection.
+type handshakeRecordChecker struct {
+	serverHelloSeen bool
+	tls13           bool
+
+	// handshake buffers the plaintext handshake messages received before
+	// the ServerHello has been reassembled.
+	handshake []byte
+}
+
+// check returns an error wrapping ErrUnexpectedRecord if `records` contains an
+// application data record that is not allowed at this point in the
+// handshake. Records that cannot be parsed are left for the TLS connection to
+// reject.
+func (h *handshakeRecordChecker) check(records []byte) error {
+	for len(records) >= recordHeaderLen {
+		contentType := records[0]
+		length := int(binary.BigEndian.Uint16(records[3:5]))
+		if len(records) < recordHeaderLen+length {
+			return nil
+		}
+		fragment := records[recordHeaderLen : recordHeaderLen+length]
+		records = records[recordHeaderLen+length:]
+
+		switch contentType {
+		case recordTypeHandshake:
+			if !h.serverHelloSeen {
+				h.handshake = append(h.handshake, fragment...)
+				h.reassembleServerHello()
+			}
+		case recordTypeApplicationData:
+			if !h.serverHelloSeen {
+				return fmt.Errorf("%w: application data received before ServerHello", ErrUnexpectedRecord)
+			}
+			if !h.tls13 {
+				return fmt.Errorf("%w: application data received before TLS 1.2 handshake completed", ErrUnexpectedRecord)
+			}
+		case recordTypeChangeCipherSpec, recordTypeAlert:
+		default:
+			// Not a TLS record; let the TLS connection report the error.
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// reassembleServerHello consumes the complete handshake messages buffered so
+// far, recording the negotiated version once the ServerHello is found.
+func (h *handshakeRecordChecker) reassembleServerHello() {
+	for len(h.handshake) >= handshakeHeaderLen {
+		length := int(h.handshake[1])<<16 | int(h.handshake[2])<<8 | int(h.handshake[3])
+		if len(h.handshake) < handshakeHeaderLen+length {
+			// Wait for the rest of the message.
+			return
+		}
+		msg := h.handshake[:handshakeHeaderLen+length]
+		h.handshake = h.handshake[handshakeHeaderLen+length:]
+
+		if msg[0] == handshakeTypeServerHello {
+			h.serverHelloSeen = true
+			h.tls13 = serverHelloIsTLS13(msg)
+			h.handshake = nil
+			return
+		}
+	}
+}
+
+// serverHelloIsTLS13 reports whether the ServerHello handshake message at the
+// start of `msg` selects TLS 1.3 via the supported_versions extension.
+func serverHelloIsTLS13(msg []byte) bool {
+	// Skip the handshake header (4), legacy_version (2) and random (32).
+	const sessionIDOffset = 4 + 2 + 32
+	if len(msg) <= sessionIDOffset {
+		return false
+	}
+	msg = msg[sessionIDOffset:]
+
+	// Skip the session ID, cipher suite (2) and compression method (1).
+	skip := 1 + int(msg[0]) + 2 + 1
+	if len(msg) < skip+2 {
+		return false
+	}
+	msg = msg[skip:]
+
+	extLen := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	if len(msg) > extLen {
+		msg = msg[:extLen]
+	}
+
+	for len(msg) >= 4 {
+		extType := binary.BigEndian.Uint16(msg)
+		length := int(binary.BigEndian.Uint16(msg[2:]))
+		if len(msg) < 4+length {
+			return false
+		}
+		if extType == extensionSupportedVersions && length == 2 {
+			return binary.BigEndian.Uint16(msg[4:]) == supportedVersionTLS13
+		}
+		msg = msg[4+length:]
+	}
+
+	return false
+}
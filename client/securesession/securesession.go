@@ -17,13 +17,19 @@ package securesession
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/GoogleCloudPlatform/stet/client/ekmclient"
@@ -111,8 +117,13 @@ type SecureSessionClient struct {
 	tls              TLSConn
 	state            clientState
 	handshakeState   *atomic.Value
+	records          handshakeRecordChecker
 	ctx              []byte                            // the opaque session context
 	attestationTypes *aepb.AttestationEvidenceTypeList // attestation types requested by server
+
+	// Closed once the goroutine running the inner TLS handshake has exited.
+	handshakeDone chan struct{}
+	closeOnce     sync.Once
 }
 
 // tryReescalatePrivileges checks if the process is owned by root but
@@ -142,8 +153,12 @@ func tryDeescalatePrivileges() error {
 }
 
 type secureSessionOptions struct {
-	httpCertPool  *x509.CertPool
-	skipTLSVerify bool
+	httpCertPool      *x509.CertPool
+	skipTLSVerify     bool
+	handshakeAttempts int
+	retryDelay        time.Duration
+	cipherSuites      []uint16
+	httpTimeouts      ekmclient.HTTPTimeouts
 }
 
 // SecureSessionOption configures EstablishSecureSession.
@@ -165,11 +180,67 @@ func SkipTLSVerify(skipTLSVerify bool) SecureSessionOption {
 	}
 }
 
+// HandshakeRetries sets how many times the BeginSession and Handshake steps
+// of session establishment are attempted, and the delay between attempts.
+// Each attempt uses a fresh transport shim and TLS connection. Attestation
+// and finalization are not retried. Passing this option again will overwrite
+// earlier values.
+func HandshakeRetries(attempts int, delay time.Duration) SecureSessionOption {
+	return func(opts *secureSessionOptions) {
+		opts.handshakeAttempts = attempts
+		opts.retryDelay = delay
+	}
+}
+
+// CipherSuites sets the TLS 1.2 cipher suites allowed for the inner TLS
+// session, for EKMs or policies that require a narrower set. Each suite must
+// be in constants.SafeCipherSuites. TLS 1.3 cipher suites are not
+// configurable. Passing this option again will overwrite earlier values.
+func CipherSuites(suites []uint16) SecureSessionOption {
+	return func(opts *secureSessionOptions) {
+		opts.cipherSuites = suites
+	}
+}
+
+// HTTPTimeouts sets the dial, TLS handshake, response header and keepalive
+// timeouts of the HTTPS connections to EKMs reached over HTTP. Timeouts that
+// are left unset take their value from ekmclient.DefaultHTTPTimeouts. It has
+// no effect on EKMs reached over gRPC. Passing this option again will
+// overwrite earlier values.
+func HTTPTimeouts(timeouts ekmclient.HTTPTimeouts) SecureSessionOption {
+	return func(opts *secureSessionOptions) {
+		opts.httpTimeouts = timeouts
+	}
+}
+
+// validateCipherSuites returns an error if `suites` is empty or contains a
+// cipher suite that is not in constants.SafeCipherSuites.
+func validateCipherSuites(suites []uint16) error {
+	if len(suites) == 0 {
+		return fmt.Errorf("no cipher suites configured")
+	}
+
+	safe := make(map[uint16]bool)
+	for _, suite := range constants.SafeCipherSuites {
+		safe[suite] = true
+	}
+
+	for _, suite := range suites {
+		if !safe[suite] {
+			return fmt.Errorf("cipher suite %v is not allowed", tls.CipherSuiteName(suite))
+		}
+	}
+
+	return nil
+}
+
 // DefaultSecureSessionOptions control the default values before
 // applying options passed to EstablishSecureSession.
 var DefaultSecureSessionOptions = []SecureSessionOption{
 	HTTPCertPool(nil),
 	SkipTLSVerify(false),
+	HandshakeRetries(1, 0),
+	CipherSuites(constants.AllowableCipherSuites),
 }
 
 // EstablishSecureSession takes in a service address and performs the
@@ -186,52 +257,151 @@ func EstablishSecureSession(ctx context.Context, addr, authToken string, opts ..
 		opt(&options)
 	}
 
-	client, err := newSecureSessionClient(addr, authToken, options.httpCertPool, options.skipTLSVerify)
-
-	if err != nil {
-		return nil, fmt.Errorf("error creating a secure session client: %v", err)
+	if err := validateCipherSuites(options.cipherSuites); err != nil {
+		return nil, fmt.Errorf("invalid cipher suites for secure session: %v", err)
 	}
 
-	// Begin secure session establishment with a BeginSession call.
-	if err := client.beginSession(ctx); err != nil {
-		return nil, fmt.Errorf("error beginning session establishment: %v", err)
+	newClient := func() (*SecureSessionClient, error) {
+		return newSecureSessionClient(addr, authToken, options.httpCertPool, options.skipTLSVerify, options.cipherSuites, options.httpTimeouts)
 	}
 
-	// Continue making Handshake requests until the TLS handshake is complete.
-	for client.state != clientStateHandshakeCompleted {
-		if client.handshakeState.Load() == clientStateFailed {
-			return nil, fmt.Errorf("error on handshake: handshake in failure state")
-		}
-
-		if err := client.handshake(ctx); err != nil {
-			return nil, fmt.Errorf("error on handshake: %v", err)
-		}
+	client, err := handshakeWithRetries(ctx, newClient, options.handshakeAttempts, options.retryDelay)
+	if err != nil {
+		return nil, err
 	}
 
 	// Ask server for what attestation evidence is acceptable.
 	if err := client.negotiateAttestation(ctx); err != nil {
-		return nil, fmt.Errorf("error negotiating attestation: %v", err)
+		client.abandon()
+		return nil, fmt.Errorf("error negotiating attestation: %w", err)
 	}
 
 	// Present negotiated attestation evidence to finalize the secure session.
 	if err := client.finalize(ctx); err != nil {
-		return nil, fmt.Errorf("error finalizing attestation: %v", err)
+		client.abandon()
+		return nil, fmt.Errorf("error finalizing attestation: %w", err)
 	}
 
 	return client, nil
 }
 
+// handshakeWithRetries creates a client with `newClient` and completes the
+// TLS handshake with the server, making up to `attempts` attempts. Failed
+// clients are abandoned, so each attempt starts from a fresh transport shim
+// and TLS connection.
+func handshakeWithRetries(ctx context.Context, newClient func() (*SecureSessionClient, error), attempts int, delay time.Duration) (*SecureSessionClient, error) {
+	for attempt := 1; ; attempt++ {
+		client, err := newClient()
+		if err != nil {
+			return nil, fmt.Errorf("error creating a secure session client: %v", err)
+		}
+
+		err = client.establishTLS(ctx)
+		if err == nil {
+			return client, nil
+		}
+
+		client.abandon()
+
+		if attempt >= attempts || errors.Is(err, ErrUnexpectedRecord) {
+			return nil, err
+		}
+
+		glog.Warningf("Secure session handshake attempt %v of %v failed, retrying: %v", attempt, attempts, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last attempt failed with: %v)", ctx.Err(), err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// establishTLS performs the BeginSession and Handshake steps of session
+// establishment, until the inner TLS handshake is complete.
+func (c *SecureSessionClient) establishTLS(ctx context.Context) error {
+	// Begin secure session establishment with a BeginSession call.
+	if err := c.beginSession(ctx); err != nil {
+		return fmt.Errorf("error beginning session establishment: %w", err)
+	}
+
+	// Continue making Handshake requests until the TLS handshake is complete.
+	for c.state != clientStateHandshakeCompleted {
+		if c.handshakeState.Load() == handshakeFailed {
+			return fmt.Errorf("error on handshake: handshake in failure state")
+		}
+
+		if err := c.handshake(ctx); err != nil {
+			return fmt.Errorf("error on handshake: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// abandon marks the client as failed and closes it.
+func (c *SecureSessionClient) abandon() {
+	c.state = clientStateFailed
+	c.Close()
+}
+
+// Close releases the resources of the client without ending the secure
+// session: it closes the transport shim, which stops the inner TLS handshake
+// if it is still in progress, waits for the goroutine running the handshake
+// to exit, and closes the connection to the EKM. Callers that discard a client
+// without a successful EndSession call, such as after an error, should call
+// Close to avoid leaking them. It is safe to call more than once, and after
+// EndSession.
+func (c *SecureSessionClient) Close() error {
+	c.closeOnce.Do(func() {
+		if c.shim != nil {
+			c.shim.Close()
+		}
+
+		if c.handshakeDone != nil {
+			<-c.handshakeDone
+		}
+
+		c.closeTransport()
+	})
+
+	return nil
+}
+
+// closeTransport closes the connection to the EKM, if it has one.
+func (c *SecureSessionClient) closeTransport() {
+	if closer, ok := c.client.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			glog.Warningf("Failed to close connection to EKM: %v", err)
+		}
+	}
+}
+
 // newClient returns a new SecureSessionClient object that connects to a
-// secure session service at the given address.
-func newSecureSessionClient(addr, authToken string, httpCertPool *x509.CertPool, skipTLSVerify bool) (*SecureSessionClient, error) {
+// secure session service at the given address, allowing the given TLS 1.2
+// cipher suites for the inner session, with the given timeouts for HTTP EKMs.
+func newSecureSessionClient(addr, authToken string, httpCertPool *x509.CertPool, skipTLSVerify bool, cipherSuites []uint16, httpTimeouts ekmclient.HTTPTimeouts) (*SecureSessionClient, error) {
 	c := &SecureSessionClient{}
 
-	c.client = ekmclient.ConfidentialEKMClient{URI: addr, AuthToken: authToken, CertPool: httpCertPool}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse address for secure session client: %v", err)
+	}
+
+	// Use gRPC for EKMs with a grpcs:// URI, and HTTP otherwise.
+	if u.Scheme == ekmclient.GRPCScheme {
+		c.client, err = ekmclient.NewGRPCEKMClient(addr, authToken, httpCertPool)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c.client = ekmclient.ConfidentialEKMClient{URI: addr, AuthToken: authToken, CertPool: httpCertPool, Timeouts: httpTimeouts}
+	}
 	c.shim = transportshim.NewTransportShim()
 	c.handshakeState = &atomic.Value{}
 
 	cfg := &tls.Config{
-		CipherSuites: constants.AllowableCipherSuites,
+		CipherSuites: cipherSuites,
 		MinVersion:   tls.VersionTLS12,
 		MaxVersion:   tls.VersionTLS13,
 		RootCAs:      httpCertPool,
@@ -242,10 +412,6 @@ func newSecureSessionClient(addr, authToken string, httpCertPool *x509.CertPool,
 		cfg.InsecureSkipVerify = true
 		glog.Warningln("Skipping inner TLS verification.")
 	} else {
-		u, err := url.Parse(addr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse address for secure session client: %v", err)
-		}
 		cfg.ServerName = u.Hostname()
 	}
 
@@ -253,9 +419,15 @@ func newSecureSessionClient(addr, authToken string, httpCertPool *x509.CertPool,
 
 	// Kick off inner TLS session handshake and wait for a write.
 	c.handshakeState.Store(handshakeInitiated)
+	c.handshakeDone = make(chan struct{})
 	go func() {
+		defer close(c.handshakeDone)
 		if err := c.tls.Handshake(); err != nil {
-			glog.Errorf("Inner TLS handshake failed: %v", err.Error())
+			if errors.Is(err, net.ErrClosed) {
+				glog.Infof("Inner TLS handshake stopped by closing the client")
+			} else {
+				glog.Errorf("Inner TLS handshake failed: %v", err.Error())
+			}
 			c.handshakeState.Store(handshakeFailed)
 			return
 		}
@@ -284,6 +456,11 @@ func (c *SecureSessionClient) beginSession(ctx context.Context) error {
 		return errors.New("failed to initialize session; likely authentication error")
 	}
 
+	if err := c.records.check(resp.GetTlsRecords()); err != nil {
+		c.state = clientStateFailed
+		return err
+	}
+
 	// Update the state of the session.
 	c.state = clientStateInitiated
 	c.ctx = resp.GetSessionContext()
@@ -307,6 +484,11 @@ func (c *SecureSessionClient) handshake(ctx context.Context) error {
 		return fmt.Errorf("error continuing session establishment: %v", err)
 	}
 
+	if err := c.records.check(resp.GetTlsRecords()); err != nil {
+		c.state = clientStateFailed
+		return err
+	}
+
 	// Write received TLS records back to the transport shim.
 	c.shim.QueueReceiveBuf(resp.GetTlsRecords())
 
@@ -364,7 +546,7 @@ func (c *SecureSessionClient) negotiateAttestation(ctx context.Context) error {
 
 	resp, err := c.client.NegotiateAttestation(ctx, req)
 	if err != nil {
-		return fmt.Errorf("error negotiating attestation with client: %v", err)
+		return fmt.Errorf("error negotiating attestation with client: %w", newEKMError(err))
 	}
 
 	// Decode the records that the server responded with to figure out what
@@ -532,13 +714,28 @@ func (c *SecureSessionClient) finalize(ctx context.Context) error {
 	}
 
 	if _, err := c.client.Finalize(ctx, req); err != nil {
-		return fmt.Errorf("error finalizing secure session with client: %v", err)
+		return fmt.Errorf("error finalizing secure session with client: %w", attestationEKMError(err))
 	}
 
 	c.state = clientStateAttestationAccepted
 	return nil
 }
 
+// SessionID returns an identifier of the secure session, for correlating its
+// requests with the EKM's audit logs: the hex encoding of the first 16 bytes
+// of the SHA-256 hash of the session context issued by the EKM in
+// BeginSession. The session context itself is presented with every request
+// in the session, so it is not revealed. The identifier is empty until the
+// session has begun, and does not change for the rest of the session.
+func (c *SecureSessionClient) SessionID() string {
+	if len(c.ctx) == 0 {
+		return ""
+	}
+
+	hash := sha256.Sum256(c.ctx)
+	return hex.EncodeToString(hash[:16])
+}
+
 // EndSession explicitly closes the previous established secure session.
 func (c *SecureSessionClient) EndSession(ctx context.Context) error {
 	if c.state != clientStateAttestationAccepted {
@@ -561,12 +758,20 @@ func (c *SecureSessionClient) EndSession(ctx context.Context) error {
 	}
 
 	c.state = clientStateEnded
+	c.Close()
 	return nil
 }
 
 // ConfidentialWrap uses the established secure session to wrap the given plaintext
 // using the specified key path and resource name, returning the wrapped blob.
 func (c *SecureSessionClient) ConfidentialWrap(ctx context.Context, keyPath, resourceName string, plaintext []byte) ([]byte, error) {
+	return c.ConfidentialWrapWithAAD(ctx, keyPath, resourceName, plaintext, nil)
+}
+
+// ConfidentialWrapWithAAD is like ConfidentialWrap, but binds the wrapped blob
+// to the given additional authenticated data, which must be supplied again to
+// ConfidentialUnwrapWithAAD.
+func (c *SecureSessionClient) ConfidentialWrapWithAAD(ctx context.Context, keyPath, resourceName string, plaintext, aad []byte) ([]byte, error) {
 	if c.state != clientStateAttestationAccepted {
 		return nil, errors.New("Called ConfidentialWrap with unestablished secure session")
 	}
@@ -579,7 +784,7 @@ func (c *SecureSessionClient) ConfidentialWrap(ctx context.Context, keyPath, res
 			RelativeResourceName: resourceName,
 			AccessReasonContext:  &cwpb.AccessReasonContext{Reason: cwpb.AccessReasonContext_CUSTOMER_INITIATED_ACCESS},
 		},
-		AdditionalAuthenticatedData: nil,
+		AdditionalAuthenticatedData: aad,
 		KeyUriPrefix:                "",
 	}
 
@@ -605,7 +810,7 @@ func (c *SecureSessionClient) ConfidentialWrap(ctx context.Context, keyPath, res
 	// Make RPC, session-encrypt the records, and unmarshal the inner WrapResponse.
 	resp, err := c.client.ConfidentialWrap(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("error session-encrypting the records: %v", err)
+		return nil, fmt.Errorf("error session-encrypting the records: %w", classifyRPCError(err))
 	}
 
 	records := resp.GetTlsRecords()
@@ -629,6 +834,12 @@ func (c *SecureSessionClient) ConfidentialWrap(ctx context.Context, keyPath, res
 // ConfidentialUnwrap uses the established secure session to unwrap the given
 // blob via the given key path and resource name, returning the plaintext.
 func (c *SecureSessionClient) ConfidentialUnwrap(ctx context.Context, keyPath, resourceName string, wrappedBlob []byte) ([]byte, error) {
+	return c.ConfidentialUnwrapWithAAD(ctx, keyPath, resourceName, wrappedBlob, nil)
+}
+
+// ConfidentialUnwrapWithAAD is like ConfidentialUnwrap, for blobs wrapped by
+// ConfidentialWrapWithAAD with the given additional authenticated data.
+func (c *SecureSessionClient) ConfidentialUnwrapWithAAD(ctx context.Context, keyPath, resourceName string, wrappedBlob, aad []byte) ([]byte, error) {
 	if c.state != clientStateAttestationAccepted {
 		return nil, errors.New("Called ConfidentialUnwrap with unestablished secure session")
 	}
@@ -641,7 +852,7 @@ func (c *SecureSessionClient) ConfidentialUnwrap(ctx context.Context, keyPath, r
 			RelativeResourceName: resourceName,
 			AccessReasonContext:  &cwpb.AccessReasonContext{Reason: cwpb.AccessReasonContext_CUSTOMER_INITIATED_ACCESS},
 		},
-		AdditionalAuthenticatedData: nil,
+		AdditionalAuthenticatedData: aad,
 		KeyUriPrefix:                "",
 	}
 
@@ -667,7 +878,7 @@ func (c *SecureSessionClient) ConfidentialUnwrap(ctx context.Context, keyPath, r
 	// Make RPC, session-decrypt the records, and unmarshal the inner WrapResponse.
 	resp, err := c.client.ConfidentialUnwrap(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("error session-decrypting the records: %v", err)
+		return nil, fmt.Errorf("error session-decrypting the records: %w", classifyRPCError(err))
 	}
 
 	records := resp.GetTlsRecords()
@@ -23,14 +23,25 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"runtime"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/stet/client/ekmclient"
+	"github.com/GoogleCloudPlatform/stet/constants"
 	aepb "github.com/GoogleCloudPlatform/stet/proto/attestation_evidence_go_proto"
 	cwpb "github.com/GoogleCloudPlatform/stet/proto/confidential_wrap_go_proto"
 	pb "github.com/GoogleCloudPlatform/stet/proto/secure_session_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -39,7 +50,13 @@ var testReceiveBuf = []byte("test receivebuf")
 
 type fakeShim struct {
 	net.Conn
-	t *testing.T
+	t      *testing.T
+	closed bool
+}
+
+func (f *fakeShim) Close() error {
+	f.closed = true
+	return nil
 }
 
 func (f *fakeShim) DrainSendBuf() []byte {
@@ -189,6 +206,55 @@ func TestBeginSession(t *testing.T) {
 	}
 }
 
+func TestSessionID(t *testing.T) {
+	beginSession := func(sessionContext []byte) *SecureSessionClient {
+		t.Helper()
+
+		ssClient := &SecureSessionClient{
+			client: &fakeEkmClient{
+				beginSessionFunc: func(context.Context, *pb.BeginSessionRequest) (*pb.BeginSessionResponse, error) {
+					return &pb.BeginSessionResponse{SessionContext: sessionContext, TlsRecords: testReceiveBuf}, nil
+				},
+			},
+			shim: &fakeShim{t: t},
+		}
+
+		if id := ssClient.SessionID(); id != "" {
+			t.Errorf("SessionID() before beginSession() = %q, want empty", id)
+		}
+
+		if err := ssClient.beginSession(context.Background()); err != nil {
+			t.Fatalf("beginSession() returned unexpected error: %v", err)
+		}
+
+		return ssClient
+	}
+
+	sessionContext := []byte("test session context")
+	first := beginSession(sessionContext)
+	id := first.SessionID()
+	if id == "" {
+		t.Fatal("SessionID() returned an empty identifier for a begun session")
+	}
+
+	// The identifier is stable for the session, and does not reveal the
+	// session context.
+	if again := first.SessionID(); again != id {
+		t.Errorf("SessionID() = %q, then %q, want the same identifier", id, again)
+	}
+	if strings.Contains(id, fmt.Sprintf("%x", sessionContext)) || strings.Contains(id, string(sessionContext)) {
+		t.Errorf("SessionID() = %q reveals the session context", id)
+	}
+
+	if other := beginSession([]byte("other session context")).SessionID(); other == id {
+		t.Errorf("SessionID() = %q for two sessions with different contexts, want different identifiers", id)
+	}
+
+	if same := beginSession(sessionContext).SessionID(); same != id {
+		t.Errorf("SessionID() = %q and %q for the same session context, want the same identifier", id, same)
+	}
+}
+
 func TestBeginSessionErrors(t *testing.T) {
 	testcases := []struct {
 		name             string
@@ -331,6 +397,471 @@ func TestHandshakeError(t *testing.T) {
 	}
 }
 
+func TestHandshakeWithRetries(t *testing.T) {
+	testcases := []struct {
+		name          string
+		attempts      int
+		failures      int
+		wantErr       bool
+		wantCreated   int
+		wantAbandoned int
+	}{
+		{
+			name:        "Success on first attempt",
+			attempts:    3,
+			failures:    0,
+			wantCreated: 1,
+		},
+		{
+			name:          "Success after transient failure",
+			attempts:      3,
+			failures:      1,
+			wantCreated:   2,
+			wantAbandoned: 1,
+		},
+		{
+			name:          "Failure without retries",
+			attempts:      1,
+			failures:      1,
+			wantErr:       true,
+			wantCreated:   1,
+			wantAbandoned: 1,
+		},
+		{
+			name:          "Attempts exhausted",
+			attempts:      2,
+			failures:      5,
+			wantErr:       true,
+			wantCreated:   2,
+			wantAbandoned: 2,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			beginSessionCalls := 0
+			ekmClient := &fakeEkmClient{
+				beginSessionFunc: func(context.Context, *pb.BeginSessionRequest) (*pb.BeginSessionResponse, error) {
+					beginSessionCalls++
+					if beginSessionCalls <= tc.failures {
+						return nil, errors.New("transient BeginSession error")
+					}
+					return &pb.BeginSessionResponse{SessionContext: []byte("test session context"), TlsRecords: testReceiveBuf}, nil
+				},
+				handshakeFunc: func(context.Context, *pb.HandshakeRequest) (*pb.HandshakeResponse, error) {
+					return &pb.HandshakeResponse{TlsRecords: testReceiveBuf}, nil
+				},
+			}
+
+			var shims []*fakeShim
+			newClient := func() (*SecureSessionClient, error) {
+				shim := &fakeShim{t: t}
+				shims = append(shims, shim)
+
+				c := &SecureSessionClient{
+					client: ekmClient,
+					shim:   shim,
+					tls: &fakeTLSConn{
+						connectionStateFunc: func() tls.ConnectionState {
+							return tls.ConnectionState{HandshakeComplete: true}
+						},
+					},
+					handshakeState: &atomic.Value{},
+				}
+				c.handshakeState.Store(handshakeInitiated)
+				return c, nil
+			}
+
+			client, err := handshakeWithRetries(context.Background(), newClient, tc.attempts, 0)
+			if tc.wantErr && err == nil {
+				t.Fatal("handshakeWithRetries() succeeded, want error")
+			} else if !tc.wantErr && err != nil {
+				t.Fatalf("handshakeWithRetries() returned unexpected error: %v", err)
+			}
+
+			if !tc.wantErr {
+				if client.state != clientStateHandshakeCompleted {
+					t.Errorf("Client state is %v, want %v", client.state, clientStateHandshakeCompleted)
+				}
+
+				if client.shim != shims[len(shims)-1] || client.shim.(*fakeShim).closed {
+					t.Error("handshakeWithRetries() did not return the open client from the last attempt")
+				}
+			}
+
+			if len(shims) != tc.wantCreated {
+				t.Errorf("handshakeWithRetries() created %v clients, want %v", len(shims), tc.wantCreated)
+			}
+
+			abandoned := 0
+			for _, shim := range shims {
+				if shim.closed {
+					abandoned++
+				}
+			}
+
+			if abandoned != tc.wantAbandoned {
+				t.Errorf("handshakeWithRetries() closed %v shims, want %v", abandoned, tc.wantAbandoned)
+			}
+		})
+	}
+}
+
+func TestHandshakeWithRetriesContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	newClient := func() (*SecureSessionClient, error) {
+		attempts++
+		return &SecureSessionClient{
+			client: &fakeEkmClient{
+				beginSessionFunc: func(context.Context, *pb.BeginSessionRequest) (*pb.BeginSessionResponse, error) {
+					cancel()
+					return nil, errors.New("transient BeginSession error")
+				},
+			},
+			shim: &fakeShim{t: t},
+		}, nil
+	}
+
+	if _, err := handshakeWithRetries(ctx, newClient, 5, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("handshakeWithRetries() returned error %v, want %v", err, context.Canceled)
+	}
+
+	if attempts != 1 {
+		t.Errorf("handshakeWithRetries() made %v attempts after context was cancelled, want 1", attempts)
+	}
+}
+
+func TestNewSecureSessionClientTransport(t *testing.T) {
+	testcases := []struct {
+		name     string
+		addr     string
+		wantGRPC bool
+	}{
+		{
+			name: "HTTPS URI",
+			addr: "https://localhost/v0/keys/key1",
+		},
+		{
+			name:     "gRPC URI",
+			addr:     "grpcs://localhost:8443/v0/keys/key1",
+			wantGRPC: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			timeouts := ekmclient.HTTPTimeouts{Dial: time.Second, ResponseHeader: -1}
+			client, err := newSecureSessionClient(tc.addr, "token", nil, true, constants.AllowableCipherSuites, timeouts)
+			if err != nil {
+				t.Fatalf("newSecureSessionClient(%q) returned error: %v", tc.addr, err)
+			}
+			defer client.abandon()
+
+			_, isGRPC := client.client.(*ekmclient.GRPCEKMClient)
+			if isGRPC != tc.wantGRPC {
+				t.Errorf("newSecureSessionClient(%q) created client of type %T, want gRPC = %v", tc.addr, client.client, tc.wantGRPC)
+			}
+
+			if httpClient, ok := client.client.(ekmclient.ConfidentialEKMClient); ok && httpClient.Timeouts != timeouts {
+				t.Errorf("newSecureSessionClient(%q) created client with timeouts %+v, want %+v", tc.addr, httpClient.Timeouts, timeouts)
+			}
+		})
+	}
+}
+
+func TestCloseStopsHandshake(t *testing.T) {
+	const numClients = 20
+	baseline := runtime.NumGoroutine()
+
+	var clients []*SecureSessionClient
+	for i := 0; i < numClients; i++ {
+		client, err := newSecureSessionClient("https://localhost/v0/keys/key1", "token", nil, true, constants.AllowableCipherSuites, ekmclient.HTTPTimeouts{})
+		if err != nil {
+			t.Fatalf("newSecureSessionClient returned error: %v", err)
+		}
+		clients = append(clients, client)
+	}
+
+	if got := runtime.NumGoroutine(); got < baseline+numClients {
+		t.Fatalf("Got %v goroutines after creating %v clients, want at least %v", got, numClients, baseline+numClients)
+	}
+
+	for _, client := range clients {
+		if err := client.Close(); err != nil {
+			t.Errorf("Close returned error: %v", err)
+		}
+
+		// Close waits for the handshake goroutine, so it has already failed.
+		if state := client.handshakeState.Load(); state != handshakeFailed {
+			t.Errorf("Handshake state after Close is %v, want %v", state, handshakeFailed)
+		}
+
+		if err := client.Close(); err != nil {
+			t.Errorf("Second Close returned error: %v", err)
+		}
+	}
+
+	// Other goroutines may take a moment to wind down.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := runtime.NumGoroutine(); got > baseline {
+		t.Errorf("Got %v goroutines after closing all clients, want at most %v", got, baseline)
+	}
+}
+
+func TestCipherSuitesOption(t *testing.T) {
+	testcases := []struct {
+		name    string
+		suites  []uint16
+		wantErr bool
+	}{
+		{
+			name:   "Default suites",
+			suites: constants.AllowableCipherSuites,
+		},
+		{
+			name:   "Narrower subset",
+			suites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		},
+		{
+			name:   "ECDHE RSA suite",
+			suites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		},
+		{
+			name:    "RSA key exchange",
+			suites:  []uint16{tls.TLS_RSA_WITH_AES_256_GCM_SHA384},
+			wantErr: true,
+		},
+		{
+			name:    "Broken cipher mixed with safe ones",
+			suites:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA},
+			wantErr: true,
+		},
+		{
+			name:    "No suites",
+			suites:  []uint16{},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateCipherSuites(tc.suites)
+			if tc.wantErr && err == nil {
+				t.Errorf("validateCipherSuites(%v) succeeded, want error", tc.suites)
+			} else if !tc.wantErr && err != nil {
+				t.Errorf("validateCipherSuites(%v) returned error: %v", tc.suites, err)
+			}
+		})
+	}
+
+	t.Run("EstablishSecureSession rejects unsupported cipher", func(t *testing.T) {
+		suites := []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}
+		_, err := EstablishSecureSession(context.Background(), "https://localhost/v0/keys/key1", "token", CipherSuites(suites))
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("EstablishSecureSession with cipher suites %v returned error %v, want cipher suite rejection", suites, err)
+		}
+	})
+}
+
+// tlsRecord returns a TLS record with the given content type and fragment.
+func tlsRecord(contentType byte, fragment []byte) []byte {
+	return append([]byte{contentType, 0x03, 0x03, byte(len(fragment) >> 8), byte(len(fragment))}, fragment...)
+}
+
+// serverHelloRecord returns a handshake record containing a minimal
+// ServerHello, selecting TLS 1.3 via supported_versions if `tls13` is set.
+func serverHelloRecord(tls13 bool) []byte {
+	var exts []byte
+	if tls13 {
+		exts = []byte{0x00, extensionSupportedVersions, 0x00, 0x02, 0x03, 0x04}
+	}
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0x00)                // empty session ID
+	body = append(body, 0x13, 0x01, 0x00)    // cipher suite, compression
+	body = append(body, byte(len(exts)>>8), byte(len(exts)))
+	body = append(body, exts...)
+
+	msg := append([]byte{handshakeTypeServerHello, 0x00, byte(len(body) >> 8), byte(len(body))}, body...)
+	return tlsRecord(recordTypeHandshake, msg)
+}
+
+// fragmentRecord splits the fragment of a single TLS record into records of
+// at most `size` bytes each.
+func fragmentRecord(record []byte, size int) []byte {
+	contentType := record[0]
+	fragment := record[recordHeaderLen:]
+
+	var records []byte
+	for len(fragment) > size {
+		records = append(records, tlsRecord(contentType, fragment[:size])...)
+		fragment = fragment[size:]
+	}
+	return append(records, tlsRecord(contentType, fragment)...)
+}
+
+func TestHandshakeRecordChecker(t *testing.T) {
+	appData := tlsRecord(recordTypeApplicationData, []byte("application data"))
+	fragmentedHello := fragmentRecord(serverHelloRecord(true), 3)
+	// Boundary after the first four records of the fragmented ServerHello.
+	helloSplit := 4 * (recordHeaderLen + 3)
+
+	testcases := []struct {
+		name    string
+		flights [][]byte
+		wantErr bool
+	}{
+		{
+			name:    "TLS 1.3 encrypted handshake after ServerHello",
+			flights: [][]byte{append(serverHelloRecord(true), appData...)},
+		},
+		{
+			name:    "TLS 1.3 post-handshake records",
+			flights: [][]byte{serverHelloRecord(true), appData},
+		},
+		{
+			name: "TLS 1.2 handshake",
+			flights: [][]byte{
+				serverHelloRecord(false),
+				append(tlsRecord(recordTypeChangeCipherSpec, []byte{0x01}), tlsRecord(recordTypeHandshake, []byte("finished"))...),
+			},
+		},
+		{
+			name:    "Unparseable records",
+			flights: [][]byte{testReceiveBuf},
+		},
+		{
+			name:    "TLS 1.3 fragmented ServerHello",
+			flights: [][]byte{append(append([]byte{}, fragmentedHello...), appData...)},
+		},
+		{
+			name: "TLS 1.3 ServerHello fragmented across flights",
+			flights: [][]byte{
+				fragmentedHello[:helloSplit],
+				append(append([]byte{}, fragmentedHello[helloSplit:]...), appData...),
+			},
+		},
+		{
+			name:    "TLS 1.2 fragmented ServerHello",
+			flights: [][]byte{fragmentRecord(serverHelloRecord(false), 3)},
+		},
+		{
+			name:    "Application data before ServerHello",
+			flights: [][]byte{append(appData, serverHelloRecord(true)...)},
+			wantErr: true,
+		},
+		{
+			name:    "Application data alone in first flight",
+			flights: [][]byte{appData},
+			wantErr: true,
+		},
+		{
+			name:    "Application data within fragmented ServerHello",
+			flights: [][]byte{append(append(append([]byte{}, fragmentedHello[:recordHeaderLen+3]...), appData...), fragmentedHello[recordHeaderLen+3:]...)},
+			wantErr: true,
+		},
+		{
+			name:    "TLS 1.2 application data after fragmented ServerHello",
+			flights: [][]byte{append(fragmentRecord(serverHelloRecord(false), 3), appData...)},
+			wantErr: true,
+		},
+		{
+			name:    "TLS 1.2 application data in same flight as ServerHello",
+			flights: [][]byte{append(serverHelloRecord(false), appData...)},
+			wantErr: true,
+		},
+		{
+			name:    "TLS 1.2 application data before Finished",
+			flights: [][]byte{serverHelloRecord(false), append(appData, tlsRecord(recordTypeChangeCipherSpec, []byte{0x01})...)},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var checker handshakeRecordChecker
+
+			var err error
+			for _, flight := range tc.flights {
+				if err = checker.check(flight); err != nil {
+					break
+				}
+			}
+
+			if tc.wantErr {
+				if !errors.Is(err, ErrUnexpectedRecord) {
+					t.Errorf("check() = %v, want error wrapping %v", err, ErrUnexpectedRecord)
+				}
+			} else if err != nil {
+				t.Errorf("check() returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestBeginSessionUnexpectedApplicationData(t *testing.T) {
+	ekmClient := &fakeEkmClient{
+		beginSessionFunc: func(context.Context, *pb.BeginSessionRequest) (*pb.BeginSessionResponse, error) {
+			return &pb.BeginSessionResponse{
+				SessionContext: []byte("test session context"),
+				TlsRecords:     tlsRecord(recordTypeApplicationData, []byte("application data")),
+			}, nil
+		},
+	}
+
+	// The fake shim fails the test if the records are queued to it.
+	ssClient := &SecureSessionClient{
+		client: ekmClient,
+		shim:   &fakeShim{t: t},
+	}
+
+	if err := ssClient.beginSession(context.Background()); !errors.Is(err, ErrUnexpectedRecord) {
+		t.Fatalf("beginSession() = %v, want error wrapping %v", err, ErrUnexpectedRecord)
+	}
+
+	if ssClient.state != clientStateFailed {
+		t.Errorf("Client state is %v, want %v", ssClient.state, clientStateFailed)
+	}
+}
+
+func TestHandshakeUnexpectedApplicationData(t *testing.T) {
+	ekmClient := &fakeEkmClient{
+		handshakeFunc: func(context.Context, *pb.HandshakeRequest) (*pb.HandshakeResponse, error) {
+			return &pb.HandshakeResponse{
+				TlsRecords: tlsRecord(recordTypeApplicationData, []byte("application data")),
+			}, nil
+		},
+	}
+
+	ssClient := &SecureSessionClient{
+		client:         ekmClient,
+		shim:           &fakeShim{t: t},
+		ctx:            []byte("test session context"),
+		tls:            &fakeTLSConn{},
+		handshakeState: &atomic.Value{},
+	}
+
+	// Simulate a TLS 1.2 ServerHello received in BeginSession.
+	if err := ssClient.records.check(serverHelloRecord(false)); err != nil {
+		t.Fatalf("check() returned unexpected error: %v", err)
+	}
+
+	if err := ssClient.handshake(context.Background()); !errors.Is(err, ErrUnexpectedRecord) {
+		t.Fatalf("handshake() = %v, want error wrapping %v", err, ErrUnexpectedRecord)
+	}
+
+	if ssClient.state != clientStateFailed {
+		t.Errorf("Client state is %v, want %v", ssClient.state, clientStateFailed)
+	}
+}
+
 func TestNegotiateAttestation(t *testing.T) {
 	expectedContext := []byte("test session context")
 	ekmClient := &fakeEkmClient{
@@ -584,6 +1115,36 @@ func TestFinalizeErrors(t *testing.T) {
 	}
 }
 
+func TestFinalizeAttestationRejected(t *testing.T) {
+	ssClient := &SecureSessionClient{
+		client: &fakeEkmClient{
+			finalizeFunc: func(context.Context, *pb.FinalizeRequest) (*pb.FinalizeResponse, error) {
+				return nil, &ekmclient.StatusError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}
+			},
+		},
+		tls: &fakeTLSConn{
+			writeFunc: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+		},
+		ctx: []byte("test session context"),
+		attestationTypes: &aepb.AttestationEvidenceTypeList{
+			Types: []aepb.AttestationEvidenceType{aepb.AttestationEvidenceType_NULL_ATTESTATION},
+		},
+	}
+
+	err := ssClient.finalize(context.Background())
+
+	var ekmErr *EKMError
+	if !errors.As(err, &ekmErr) {
+		t.Fatalf("finalize() = %v, want error wrapping *EKMError", err)
+	}
+
+	if ekmErr.Category != EKMErrorAttestationRejected {
+		t.Errorf("EKMError has category %v, want %v", ekmErr.Category, EKMErrorAttestationRejected)
+	}
+}
+
 func TestEndSession(t *testing.T) {
 	expectedContext := []byte("test session context")
 	ekmClient := &fakeEkmClient{
@@ -858,6 +1419,172 @@ func TestConfidentialWrapErrors(t *testing.T) {
 	}
 }
 
+func TestConfidentialWrapErrorClass(t *testing.T) {
+	testcases := []struct {
+		name    string
+		rpcErr  error
+		wantErr error
+	}{
+		{
+			name:    "Connection reset",
+			rpcErr:  &url.Error{Op: "Post", URL: "https://ekm", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}},
+			wantErr: ErrConnectionLost,
+		},
+		{
+			name:    "Connection closed mid-response",
+			rpcErr:  fmt.Errorf("HTTP call returned with error: %w", &url.Error{Op: "Post", URL: "https://ekm", Err: io.EOF}),
+			wantErr: ErrConnectionLost,
+		},
+		{
+			name:    "gRPC connection unavailable",
+			rpcErr:  status.Error(codes.Unavailable, "connection closed"),
+			wantErr: ErrConnectionLost,
+		},
+		{
+			name:    "gRPC permission denied",
+			rpcErr:  status.Error(codes.PermissionDenied, "not authorized"),
+			wantErr: ErrRequestFailed,
+		},
+		{
+			name:    "HTTP error status",
+			rpcErr:  errors.New("non-OK status returned: 403 Forbidden - not authorized"),
+			wantErr: ErrRequestFailed,
+		},
+		{
+			name:    "Context cancelled",
+			rpcErr:  &url.Error{Op: "Post", URL: "https://ekm", Err: context.Canceled},
+			wantErr: context.Canceled,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ssClient := &SecureSessionClient{
+				client: &fakeEkmClient{
+					confidentialWrapFunc: func(context.Context, *cwpb.ConfidentialWrapRequest) (*cwpb.ConfidentialWrapResponse, error) {
+						return nil, tc.rpcErr
+					},
+					confidentialUnwrapFunc: func(context.Context, *cwpb.ConfidentialUnwrapRequest) (*cwpb.ConfidentialUnwrapResponse, error) {
+						return nil, tc.rpcErr
+					},
+				},
+				shim:  &fakeShim{t: t},
+				ctx:   []byte("test session context"),
+				tls:   &fakeTLSConn{writeFunc: func([]byte) (int, error) { return 1, nil }},
+				state: clientStateAttestationAccepted,
+			}
+
+			_, err := ssClient.ConfidentialWrap(context.Background(), "test/key/path", "test-key-name", []byte("test plaintext"))
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("ConfidentialWrap() = %v, want error wrapping %v", err, tc.wantErr)
+			}
+
+			_, err = ssClient.ConfidentialUnwrap(context.Background(), "test/key/path", "test-key-name", []byte("test ciphertext"))
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("ConfidentialUnwrap() = %v, want error wrapping %v", err, tc.wantErr)
+			}
+
+			if errors.Is(err, ErrConnectionLost) && errors.Is(err, ErrRequestFailed) {
+				t.Errorf("ConfidentialUnwrap() = %v, wrapping both %v and %v", err, ErrConnectionLost, ErrRequestFailed)
+			}
+		})
+	}
+}
+
+func TestConfidentialWrapEKMError(t *testing.T) {
+	testcases := []struct {
+		name          string
+		rpcErr        error
+		wantHTTP      int
+		wantGRPC      codes.Code
+		wantCategory  EKMErrorCategory
+		wantRetryable bool
+	}{
+		{
+			name:          "HTTP quota exceeded",
+			rpcErr:        &ekmclient.StatusError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"},
+			wantHTTP:      http.StatusTooManyRequests,
+			wantCategory:  EKMErrorQuotaExceeded,
+			wantRetryable: true,
+		},
+		{
+			name:         "HTTP attestation rejected",
+			rpcErr:       &ekmclient.StatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"},
+			wantHTTP:     http.StatusUnauthorized,
+			wantCategory: EKMErrorAttestationRejected,
+		},
+		{
+			name:         "HTTP key disabled",
+			rpcErr:       &ekmclient.StatusError{StatusCode: http.StatusPreconditionFailed, Status: "412 Precondition Failed"},
+			wantHTTP:     http.StatusPreconditionFailed,
+			wantCategory: EKMErrorKeyDisabled,
+		},
+		{
+			name:         "HTTP other status",
+			rpcErr:       &ekmclient.StatusError{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error"},
+			wantHTTP:     http.StatusInternalServerError,
+			wantCategory: EKMErrorOther,
+		},
+		{
+			name:          "gRPC quota exceeded",
+			rpcErr:        fmt.Errorf("ConfidentialWrap RPC returned with error: %w", status.Error(codes.ResourceExhausted, "quota exceeded")),
+			wantGRPC:      codes.ResourceExhausted,
+			wantCategory:  EKMErrorQuotaExceeded,
+			wantRetryable: true,
+		},
+		{
+			name:         "gRPC attestation rejected",
+			rpcErr:       status.Error(codes.Unauthenticated, "attestation rejected"),
+			wantGRPC:     codes.Unauthenticated,
+			wantCategory: EKMErrorAttestationRejected,
+		},
+		{
+			name:         "gRPC permission denied",
+			rpcErr:       status.Error(codes.PermissionDenied, "not authorized"),
+			wantGRPC:     codes.PermissionDenied,
+			wantCategory: EKMErrorPermissionDenied,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ssClient := &SecureSessionClient{
+				client: &fakeEkmClient{
+					confidentialWrapFunc: func(context.Context, *cwpb.ConfidentialWrapRequest) (*cwpb.ConfidentialWrapResponse, error) {
+						return nil, tc.rpcErr
+					},
+				},
+				shim:  &fakeShim{t: t},
+				ctx:   []byte("test session context"),
+				tls:   &fakeTLSConn{writeFunc: func([]byte) (int, error) { return 1, nil }},
+				state: clientStateAttestationAccepted,
+			}
+
+			_, err := ssClient.ConfidentialWrap(context.Background(), "test/key/path", "test-key-name", []byte("test plaintext"))
+			if !errors.Is(err, ErrRequestFailed) {
+				t.Errorf("ConfidentialWrap() = %v, want error wrapping %v", err, ErrRequestFailed)
+			}
+
+			var ekmErr *EKMError
+			if !errors.As(err, &ekmErr) {
+				t.Fatalf("ConfidentialWrap() = %v, want error wrapping *EKMError", err)
+			}
+
+			if ekmErr.HTTPStatus != tc.wantHTTP || ekmErr.GRPCCode != tc.wantGRPC {
+				t.Errorf("EKMError has HTTP status %v and gRPC code %v, want %v and %v", ekmErr.HTTPStatus, ekmErr.GRPCCode, tc.wantHTTP, tc.wantGRPC)
+			}
+
+			if ekmErr.Category != tc.wantCategory {
+				t.Errorf("EKMError has category %v, want %v", ekmErr.Category, tc.wantCategory)
+			}
+
+			if ekmErr.Retryable() != tc.wantRetryable {
+				t.Errorf("EKMError.Retryable() = %v, want %v", ekmErr.Retryable(), tc.wantRetryable)
+			}
+		})
+	}
+}
+
 func TestConfidentialUnwrap(t *testing.T) {
 	expectedContext := []byte("test session context")
 	expectedPlaintext := []byte("test plaintext")
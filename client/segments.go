@@ -0,0 +1,239 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/google/tink/go/streamingaead/subtle"
+	tinksubtle "github.com/google/tink/go/subtle"
+)
+
+// The ciphertext written by AeadEncrypt follows Tink's AES-GCM-HKDF streaming
+// AEAD format: a header holding its own length, a salt and a nonce prefix,
+// followed by segments of aeadSegmentSize bytes (or the segment size recorded
+// in the metadata) that each end with a GCM tag. The first segment is
+// shortened by the header, and the last segment may be shorter than the
+// rest. The segment key is derived from the DEK with HKDF, using the salt and
+// the AAD.
+const (
+	aeadHeaderSize       = 1 + int64(shares.DEKBytes) + subtle.AESGCMHKDFNoncePrefixSizeInBytes
+	aeadTagSize          = subtle.AESGCMHKDFTagSizeInBytes
+	aeadFirstSegmentSize = aeadSegmentSize - aeadFirstSegmentOffset - aeadHeaderSize
+)
+
+// segmentCipher decrypts individual segments of a streaming AEAD ciphertext,
+// so that they can be read in any order. It is safe for concurrent use.
+type segmentCipher struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	segmentSize int64
+	// The length of the ciphertext, including the header, and the number of
+	// segments it holds.
+	length   int64
+	segments int64
+}
+
+// newSegmentAEAD returns the AES-GCM cipher for the segments of a ciphertext
+// with the given salt, keyed with a segment key derived from the DEK.
+func newSegmentAEAD(key shares.DEK, salt, aad []byte) (cipher.AEAD, error) {
+	segmentKey, err := tinksubtle.ComputeHKDF(aeadHKDFAlg, key[:], salt, aad, shares.DEKBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive segment key: %v", err)
+	}
+
+	block, err := aes.NewCipher(segmentKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create new cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create new cipher: %v", err)
+	}
+
+	return aead, nil
+}
+
+// segmentNonce returns the GCM nonce of segment `i`, which marks whether it is
+// the last segment of the ciphertext.
+func segmentNonce(noncePrefix []byte, i int64, last bool) []byte {
+	nonce := make([]byte, subtle.AESGCMHKDFNonceSizeInBytes)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[len(noncePrefix):], uint32(i))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// newSegmentCipher reads the header of the `length`-byte ciphertext in
+// `ciphertext`, which has segments of `segmentSize` bytes, and returns a
+// segmentCipher for it.
+func newSegmentCipher(key shares.DEK, aad []byte, segmentSize int64, ciphertext io.ReaderAt, length int64) (*segmentCipher, error) {
+	if length < aeadHeaderSize+aeadTagSize {
+		return nil, fmt.Errorf("ciphertext is %v bytes, too short to be valid", length)
+	}
+
+	header := make([]byte, aeadHeaderSize)
+	if _, err := ciphertext.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read ciphertext header: %v", err)
+	}
+
+	if int64(header[0]) != aeadHeaderSize {
+		return nil, fmt.Errorf("invalid ciphertext header length %v, want %v", header[0], aeadHeaderSize)
+	}
+
+	aead, err := newSegmentAEAD(key, header[1:1+shares.DEKBytes], aad)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &segmentCipher{
+		aead:        aead,
+		noncePrefix: header[1+shares.DEKBytes:],
+		segmentSize: segmentSize,
+		length:      length,
+		segments:    1,
+	}
+
+	if body := length - aeadHeaderSize; body > s.firstSegmentSize() {
+		s.segments += (body - s.firstSegmentSize() + segmentSize - 1) / segmentSize
+	}
+
+	if start, _ := s.ciphertextBounds(s.segments - 1); length-start < aeadTagSize {
+		return nil, fmt.Errorf("ciphertext ends with a truncated segment")
+	}
+
+	return s, nil
+}
+
+// firstSegmentSize returns the size of the first segment, which is shortened
+// by the header.
+func (s *segmentCipher) firstSegmentSize() int64 {
+	return s.segmentSize - aeadFirstSegmentOffset - aeadHeaderSize
+}
+
+// plaintextLength returns the length of the plaintext of the whole ciphertext.
+func (s *segmentCipher) plaintextLength() int64 {
+	return s.length - aeadHeaderSize - s.segments*aeadTagSize
+}
+
+// ciphertextBounds returns the start and end offsets of segment `i` in the
+// ciphertext.
+func (s *segmentCipher) ciphertextBounds(i int64) (int64, int64) {
+	start, end := aeadHeaderSize, aeadHeaderSize+s.firstSegmentSize()
+	if i > 0 {
+		start = end + (i-1)*s.segmentSize
+		end = start + s.segmentSize
+	}
+
+	if end > s.length {
+		end = s.length
+	}
+
+	return start, end
+}
+
+// plaintextStart returns the offset in the plaintext of the start of segment
+// `i`.
+func (s *segmentCipher) plaintextStart(i int64) int64 {
+	if i == 0 {
+		return 0
+	}
+
+	return s.firstSegmentSize() - aeadTagSize + (i-1)*(s.segmentSize-aeadTagSize)
+}
+
+// segmentAt returns the index of the segment holding the plaintext byte at
+// `offset`.
+func (s *segmentCipher) segmentAt(offset int64) int64 {
+	if first := s.firstSegmentSize() - aeadTagSize; offset >= first {
+		return 1 + (offset-first)/(s.segmentSize-aeadTagSize)
+	}
+
+	return 0
+}
+
+// decryptSegment reads segment `i` from `ciphertext`, authenticates it and
+// returns its plaintext.
+func (s *segmentCipher) decryptSegment(ciphertext io.ReaderAt, i int64) ([]byte, error) {
+	if i < 0 || i >= s.segments {
+		return nil, fmt.Errorf("segment %v out of range, ciphertext has %v segments", i, s.segments)
+	}
+
+	start, end := s.ciphertextBounds(i)
+	segment := make([]byte, end-start)
+	if _, err := ciphertext.ReadAt(segment, start); err != nil {
+		return nil, fmt.Errorf("failed to read segment %v: %v", i, err)
+	}
+
+	nonce := segmentNonce(s.noncePrefix, i, i == s.segments-1)
+	plaintext, err := s.aead.Open(segment[:0], nonce, segment, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate segment %v: %v", i, err)
+	}
+
+	return plaintext, nil
+}
+
+// encryptSegments writes the ciphertext of `input` with the given salt and
+// nonce prefix in place of random ones, in the same format as AeadEncrypt.
+func encryptSegments(key shares.DEK, segmentSize int64, salt, noncePrefix []byte, input io.Reader, output io.Writer, aad []byte) error {
+	aead, err := newSegmentAEAD(key, salt, aad)
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte{byte(aeadHeaderSize)}, salt...)
+	header = append(header, noncePrefix...)
+	if _, err := output.Write(header); err != nil {
+		return fmt.Errorf("failed to write ciphertext header: %v", err)
+	}
+
+	reader := bufio.NewReader(input)
+	plaintext := make([]byte, segmentSize-aeadTagSize)
+	size := segmentSize - aeadFirstSegmentOffset - aeadHeaderSize - aeadTagSize
+	for i := int64(0); ; i++ {
+		n, err := io.ReadFull(reader, plaintext[:size])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to encrypt: %v", err)
+		}
+
+		// The segment is the last one if no plaintext follows it.
+		_, peekErr := reader.Peek(1)
+		if peekErr != nil && peekErr != io.EOF {
+			return fmt.Errorf("failed to encrypt: %v", peekErr)
+		}
+		last := peekErr == io.EOF
+
+		segment := aead.Seal(nil, segmentNonce(noncePrefix, i, last), plaintext[:n], nil)
+		if _, err := output.Write(segment); err != nil {
+			return fmt.Errorf("failed to write segment %v: %v", i, err)
+		}
+
+		if last {
+			return nil
+		}
+		size = segmentSize - aeadTagSize
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// pooledSession is a secure session kept open for reuse. The mutex serializes
+// use of the session, and is held while it is established or ended.
+type pooledSession struct {
+	mu     sync.Mutex
+	client secureSessionClient
+
+	// The certificates the EKM's certificate is verified against, nil for
+	// the host's root CAs. Immutable once pooled.
+	certPool *x509.CertPool
+}
+
+// runPooledSession is like runSecureSession, but reuses an open session for
+// the same key and certificates if there is one, and leaves the session open
+// afterwards. If fn fails, the session is ended and removed, so that the next
+// use establishes a fresh one.
+func (c *StetClient) runPooledSession(ctx context.Context, md kekMetadata, ekmCertPool *x509.CertPool, fn secureSessionFunc) ([]byte, error) {
+	_, keyPath, err := parseEKMKeyURI(md.uri)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions established without verifying the EKM's certificate are
+	// not reused by calls that verify it, and vice versa.
+	poolKey := md.uri
+	if md.skipTLSVerify {
+		poolKey += " (unverified)"
+	}
+
+	// Nor are sessions verified against one set of certificates reused by
+	// calls that verify against another. Pools are compared by content, as
+	// they may be rebuilt for each call, such as for EKMs reached over VPC.
+	c.mu.Lock()
+	if c.sessions == nil {
+		c.sessions = make(map[string][]*pooledSession)
+	}
+	var session *pooledSession
+	for _, s := range c.sessions[poolKey] {
+		if s.certPool.Equal(ekmCertPool) {
+			session = s
+			break
+		}
+	}
+	if session == nil {
+		session = &pooledSession{certPool: ekmCertPool}
+		c.sessions[poolKey] = append(c.sessions[poolKey], session)
+	}
+	c.mu.Unlock()
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.client == nil {
+		session.client, err = c.establishSecureSession(ctx, md, ekmCertPool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	blob, err := fn(ctx, session.client, keyPath)
+	if err != nil {
+		if endErr := session.client.EndSession(ctx); endErr != nil {
+			c.logger(ctx).Warningf("Failed to end secure session with %v after error: %v", md.uri, endErr)
+			discardSecureSession(session.client)
+		}
+		session.client = nil
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+// Close releases the resources held by the client: the Cloud KMS clients it
+// created, and any secure sessions kept open by ReuseSecureSessions, which are
+// ended. A KMSClient set by the caller is not closed. Close should only be
+// called once no operations are in progress. It is safe to call more than
+// once, and the client remains usable afterwards, creating new resources as
+// needed.
+func (c *StetClient) Close() error {
+	c.mu.Lock()
+	kmsClients := c.kmsClients
+	sessions := c.sessions
+	c.kmsClients = nil
+	c.sessions = nil
+	c.mu.Unlock()
+
+	var errs []error
+	for uri, pooled := range sessions {
+		for _, session := range pooled {
+			session.mu.Lock()
+			if session.client != nil {
+				if err := session.client.EndSession(context.Background()); err != nil {
+					errs = append(errs, fmt.Errorf("error ending secure session with %v: %v", uri, err))
+					discardSecureSession(session.client)
+				}
+				session.client = nil
+			}
+			session.mu.Unlock()
+		}
+	}
+
+	if kmsClients != nil {
+		if err := kmsClients.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing Cloud KMS clients: %v", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ekmSessionLog records the secure sessions in which requests were made to
+// external EKMs. It is safe for concurrent use, and a nil log records
+// nothing.
+type ekmSessionLog struct {
+	mu       sync.Mutex
+	sessions []EKMSession
+}
+
+// record records a request for the key with `uri` made in `session`, if the
+// session has an identifier.
+func (l *ekmSessionLog) record(uri string, session secureSessionClient) {
+	id := sessionID(session)
+	if l == nil || id == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions = append(l.sessions, EKMSession{URI: uri, SessionID: id})
+}
+
+// list returns the recorded sessions.
+func (l *ekmSessionLog) list() []EKMSession {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]EKMSession(nil), l.sessions...)
+}
+
+// sessionID returns the identifier of `session`, which never reveals its
+// session context, or an empty string if it has none.
+func sessionID(session secureSessionClient) string {
+	if s, ok := session.(interface{ SessionID() string }); ok {
+		return s.SessionID()
+	}
+
+	return ""
+}
+
+// describeSession returns the identifier of `session` for use in messages,
+// preceded by a space, or an empty string if it has none.
+func describeSession(session secureSessionClient) string {
+	if id := sessionID(session); id != "" {
+		return " " + id
+	}
+
+	return ""
+}
@@ -0,0 +1,328 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/testutil"
+	"github.com/google/go-cmp/cmp"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// endCountingSessionClient counts the number of times EndSession is called.
+type endCountingSessionClient struct {
+	*testutil.FakeSecureSessionClient
+	ends atomic.Int32
+}
+
+func (c *endCountingSessionClient) EndSession(ctx context.Context) error {
+	c.ends.Add(1)
+	return c.FakeSecureSessionClient.EndSession(ctx)
+}
+
+// closeCountingKMSClient counts the number of times Close is called.
+type closeCountingKMSClient struct {
+	testutil.FakeKeyManagementClient
+	closes int
+}
+
+func (c *closeCountingKMSClient) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestReuseSecureSessions(t *testing.T) {
+	plaintext := []byte("this is plaintext")
+	md := kekMetadata{uri: testutil.ExternalKEK.URI()}
+
+	testCases := []struct {
+		name             string
+		reuse            bool
+		wrapErr          error
+		wantEndsBefore   int32
+		wantEndsAfterAll int32
+	}{
+		{
+			name:             "Sessions not reused",
+			reuse:            false,
+			wantEndsBefore:   3,
+			wantEndsAfterAll: 3,
+		},
+		{
+			name:             "Sessions reused until Close",
+			reuse:            true,
+			wantEndsBefore:   0,
+			wantEndsAfterAll: 1,
+		},
+		{
+			name:             "Failed session ended immediately",
+			reuse:            true,
+			wrapErr:          errors.New("wrap error"),
+			wantEndsBefore:   3,
+			wantEndsAfterAll: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			session := &endCountingSessionClient{FakeSecureSessionClient: &testutil.FakeSecureSessionClient{WrapErr: tc.wrapErr}}
+			stetClient := &StetClient{
+				testSecureSessionClient: session,
+				ReuseSecureSessions:     tc.reuse,
+			}
+
+			ctx := context.Background()
+			for i := 0; i < 3; i++ {
+				_, err := stetClient.ekmSecureSessionWrap(ctx, plaintext, nil, md, nil)
+				if tc.wrapErr == nil && err != nil {
+					t.Fatalf("ekmSecureSessionWrap returned error: %v", err)
+				} else if tc.wrapErr != nil && err == nil {
+					t.Fatal("ekmSecureSessionWrap succeeded, want error")
+				}
+			}
+
+			if got := session.ends.Load(); got != tc.wantEndsBefore {
+				t.Errorf("EndSession called %v times before Close, want %v", got, tc.wantEndsBefore)
+			}
+
+			// Close should end pooled sessions, and be idempotent.
+			for i := 0; i < 2; i++ {
+				if err := stetClient.Close(); err != nil {
+					t.Fatalf("Close returned error: %v", err)
+				}
+			}
+
+			if got := session.ends.Load(); got != tc.wantEndsAfterAll {
+				t.Errorf("EndSession called %v times after Close, want %v", got, tc.wantEndsAfterAll)
+			}
+
+			// The client should establish new sessions after Close.
+			session.WrapErr = nil
+			if _, err := stetClient.ekmSecureSessionWrap(ctx, plaintext, nil, md, nil); err != nil {
+				t.Fatalf("ekmSecureSessionWrap after Close returned error: %v", err)
+			}
+
+			if err := stetClient.Close(); err != nil {
+				t.Fatalf("Close returned error: %v", err)
+			}
+
+			if got := session.ends.Load(); got != tc.wantEndsAfterAll+1 {
+				t.Errorf("EndSession called %v times after reuse following Close, want %v", got, tc.wantEndsAfterAll+1)
+			}
+		})
+	}
+}
+
+func TestCloseEndSessionError(t *testing.T) {
+	session := &testutil.FakeSecureSessionClient{}
+	stetClient := &StetClient{
+		testSecureSessionClient: session,
+		ReuseSecureSessions:     true,
+	}
+
+	if _, err := stetClient.ekmSecureSessionWrap(context.Background(), []byte("plaintext"), nil, kekMetadata{uri: testutil.ExternalKEK.URI()}, nil); err != nil {
+		t.Fatalf("ekmSecureSessionWrap returned error: %v", err)
+	}
+
+	session.EndSessionErr = errors.New("end session error")
+	if err := stetClient.Close(); err == nil {
+		t.Error("Close succeeded despite EndSession error, want error")
+	}
+
+	// The failed session should not be ended again.
+	if err := stetClient.Close(); err != nil {
+		t.Errorf("Second Close returned error: %v", err)
+	}
+}
+
+func TestCloseKMSClients(t *testing.T) {
+	t.Run("Owned clients are closed", func(t *testing.T) {
+		owned := &closeCountingKMSClient{}
+		stetClient := &StetClient{}
+		stetClient.kmsClients = &cloudkms.ClientFactory{CredsMap: map[string]cloudkms.Client{"": owned}}
+
+		// Operations should reuse the owned factory rather than close it.
+		factory, release := stetClient.kmsClientFactory(context.Background())
+		release()
+		if factory != stetClient.kmsClients || owned.closes != 0 {
+			t.Fatal("kmsClientFactory did not reuse the client's Cloud KMS clients")
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := stetClient.Close(); err != nil {
+				t.Fatalf("Close returned error: %v", err)
+			}
+		}
+
+		if owned.closes != 1 {
+			t.Errorf("Owned client closed %v times, want 1", owned.closes)
+		}
+	})
+
+	t.Run("Injected client is not closed", func(t *testing.T) {
+		injected := &closeCountingKMSClient{}
+		stetClient := &StetClient{KMSClient: injected}
+
+		_, release := stetClient.kmsClientFactory(context.Background())
+		release()
+
+		if err := stetClient.Close(); err != nil {
+			t.Fatalf("Close returned error: %v", err)
+		}
+
+		if injected.closes != 0 {
+			t.Errorf("Injected client closed %v times, want 0", injected.closes)
+		}
+	})
+}
+
+func TestPooledSessionsSeparateTLSVerification(t *testing.T) {
+	session := &endCountingSessionClient{FakeSecureSessionClient: &testutil.FakeSecureSessionClient{}}
+	stetClient := &StetClient{
+		testSecureSessionClient: session,
+		ReuseSecureSessions:     true,
+	}
+
+	ctx := context.Background()
+	for _, skip := range []bool{false, true, false, true} {
+		md := kekMetadata{uri: testutil.ExternalKEK.URI(), skipTLSVerify: skip}
+		if _, err := stetClient.ekmSecureSessionWrap(ctx, []byte("plaintext"), nil, md, nil); err != nil {
+			t.Fatalf("ekmSecureSessionWrap returned error: %v", err)
+		}
+	}
+
+	// A session established without verifying the EKM's certificate must not
+	// be reused by calls that verify it.
+	if got := len(stetClient.sessions); got != 2 {
+		t.Errorf("Client pooled %v sessions, want 2", got)
+	}
+
+	if err := stetClient.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if got := session.ends.Load(); got != 2 {
+		t.Errorf("EndSession called %v times after Close, want 2", got)
+	}
+}
+
+func TestPooledSessionsSeparateCertPools(t *testing.T) {
+	newPool := func(raw string) *x509.CertPool {
+		pool := x509.NewCertPool()
+		pool.AddCert(&x509.Certificate{Raw: []byte(raw), RawSubject: []byte(raw)})
+		return pool
+	}
+
+	session := &endCountingSessionClient{FakeSecureSessionClient: &testutil.FakeSecureSessionClient{}}
+	stetClient := &StetClient{
+		testSecureSessionClient: session,
+		ReuseSecureSessions:     true,
+	}
+
+	// Pools with the same certificates are equivalent, even if built anew
+	// for each call.
+	ctx := context.Background()
+	md := kekMetadata{uri: testutil.ExternalKEK.URI()}
+	for _, pool := range []*x509.CertPool{newPool("first"), newPool("second"), nil, newPool("first"), newPool("second"), nil} {
+		if _, err := stetClient.ekmSecureSessionWrap(ctx, []byte("plaintext"), nil, md, pool); err != nil {
+			t.Fatalf("ekmSecureSessionWrap returned error: %v", err)
+		}
+	}
+
+	// A session verified against one cert pool must not be reused by calls
+	// that configured another.
+	if got := len(stetClient.sessions[md.uri]); got != 3 {
+		t.Errorf("Client pooled %v sessions, want 3", got)
+	}
+
+	if err := stetClient.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if got := session.ends.Load(); got != 3 {
+		t.Errorf("EndSession called %v times after Close, want 3", got)
+	}
+}
+
+func TestEKMSessions(t *testing.T) {
+	ctx := context.Background()
+	const sessionID = "0123456789abcdef0123456789abcdef"
+
+	keyConfig := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{{KekType: &configpb.KekInfo_KekUri{KekUri: testutil.ExternalKEK.URI()}}},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig: &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig: &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+	}
+
+	logger := &captureLogger{}
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+		testSecureSessionClient: &testutil.FakeSecureSessionClient{ID: sessionID},
+		Logger:                  logger,
+	}
+
+	want := []EKMSession{{URI: testutil.ExternalEKMURI, SessionID: sessionID}}
+
+	var ciphertext bytes.Buffer
+	encMd, err := stetClient.Encrypt(ctx, bytes.NewReader([]byte("plaintext")), &ciphertext, stetConfig, "blob")
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, encMd.EKMSessions); diff != "" {
+		t.Errorf("Encrypt returned unexpected EKM sessions (-want +got):\n%s", diff)
+	}
+
+	decMd, err := stetClient.Decrypt(ctx, &ciphertext, io.Discard, stetConfig)
+	if err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, decMd.EKMSessions); diff != "" {
+		t.Errorf("Decrypt returned unexpected EKM sessions (-want +got):\n%s", diff)
+	}
+
+	var logged int
+	for _, line := range logger.lines {
+		if strings.Contains(line, sessionID) {
+			logged++
+		}
+	}
+	if logged != 2 {
+		t.Errorf("Session ID was logged %v times, want 2 (for the wrap and the unwrap); logs:\n%v", logged, strings.Join(logger.lines, "\n"))
+	}
+
+	// Sessions without an identifier are not reported.
+	stetClient.testSecureSessionClient = &testutil.FakeSecureSessionClient{}
+	encMd, err = stetClient.Encrypt(ctx, bytes.NewReader([]byte("plaintext")), io.Discard, stetConfig, "blob")
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	if len(encMd.EKMSessions) != 0 {
+		t.Errorf("Encrypt returned EKM sessions %v for a session without an identifier, want none", encMd.EKMSessions)
+	}
+}
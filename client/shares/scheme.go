@@ -0,0 +1,219 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shares
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// Names of the built-in key splitting schemes, as recorded in blob metadata.
+const (
+	// SchemeNoSplit uses the DEK as the sole share, for KeyConfigs with the
+	// 'no split' option.
+	SchemeNoSplit = "no-split"
+
+	// SchemeShamir splits the DEK with Shamir's Secret Sharing over GF(2^8),
+	// for KeyConfigs with a ShamirConfig.
+	SchemeShamir = "shamir-gf256"
+)
+
+// Scheme is a key splitting scheme: a way of splitting a DEK into one share
+// per KEK of a KeyConfig, and of combining enough of the shares into the DEK
+// again. Schemes are registered by name with RegisterScheme, and the name of
+// the scheme a blob was split with is recorded in its metadata, so that it is
+// combined with the same scheme.
+type Scheme interface {
+	// Name identifies the scheme in blob metadata. It must never change once
+	// blobs have been written with the scheme.
+	Name() string
+
+	// Supports returns whether the scheme implements the key splitting
+	// algorithm of `keyCfg`.
+	Supports(keyCfg *configpb.KeyConfig) bool
+
+	// Split splits `secret` into the shares for `keyCfg`, reading randomness
+	// from `rand`, or the system's secure random source if it is nil.
+	Split(rand io.Reader, secret []byte, keyCfg *configpb.KeyConfig) ([][]byte, error)
+
+	// Combine recovers the secret from `unwrappedShares` split for `keyCfg`
+	// into `dst`, which it must fill exactly. On error, `dst` is left
+	// unmodified.
+	Combine(keyCfg *configpb.KeyConfig, unwrappedShares []UnwrappedShare, dst []byte) error
+}
+
+var (
+	schemesMu sync.RWMutex
+	// The registered schemes, in order of registration.
+	schemes = []Scheme{noSplitScheme{}, shamirScheme{}}
+)
+
+// RegisterScheme makes `scheme` available by its name for splitting and
+// combining DEKs. Returns an error if a scheme with the same name is already
+// registered. The built-in schemes are registered first, so a new scheme is
+// only chosen by SchemeForKeyConfig for KeyConfigs they do not support.
+func RegisterScheme(scheme Scheme) error {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+
+	for _, s := range schemes {
+		if s.Name() == scheme.Name() {
+			return fmt.Errorf("key splitting scheme %q is already registered", scheme.Name())
+		}
+	}
+
+	schemes = append(schemes, scheme)
+	return nil
+}
+
+// LookupScheme returns the registered scheme with the given name.
+func LookupScheme(name string) (Scheme, error) {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+
+	for _, s := range schemes {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key splitting scheme %q", name)
+}
+
+// SchemeForKeyConfig returns the first registered scheme that supports the key
+// splitting algorithm of `keyCfg`, with which Encrypt splits the DEK.
+func SchemeForKeyConfig(keyCfg *configpb.KeyConfig) (Scheme, error) {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+
+	for _, s := range schemes {
+		if s.Supports(keyCfg) {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key splitting algorithm")
+}
+
+// ResolveScheme returns the scheme to combine the shares of a blob split for
+// `keyCfg` with: the registered scheme with the name recorded in the blob's
+// metadata, which must support `keyCfg`, or if no name was recorded, as in
+// older blobs, the one inferred by SchemeForKeyConfig.
+func ResolveScheme(name string, keyCfg *configpb.KeyConfig) (Scheme, error) {
+	if name == "" {
+		return SchemeForKeyConfig(keyCfg)
+	}
+
+	scheme, err := LookupScheme(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !scheme.Supports(keyCfg) {
+		return nil, fmt.Errorf("blob was split with key splitting scheme %q, which does not support the key splitting algorithm of the KeyConfig", name)
+	}
+
+	return scheme, nil
+}
+
+// noSplitScheme is SchemeNoSplit.
+type noSplitScheme struct{}
+
+func (noSplitScheme) Name() string { return SchemeNoSplit }
+
+func (noSplitScheme) Supports(keyCfg *configpb.KeyConfig) bool {
+	_, ok := keyCfg.GetKeySplittingAlgorithm().(*configpb.KeyConfig_NoSplit)
+	return ok
+}
+
+func (noSplitScheme) Split(_ io.Reader, secret []byte, _ *configpb.KeyConfig) ([][]byte, error) {
+	return [][]byte{secret}, nil
+}
+
+// Combine returns the sole share, as the DEK wasn't split.
+func (noSplitScheme) Combine(_ *configpb.KeyConfig, unwrappedShares []UnwrappedShare, dst []byte) error {
+	if len(unwrappedShares) != 1 {
+		return fmt.Errorf("number of unwrapped shares is %v but expected 1 for 'no split' option", len(unwrappedShares))
+	}
+
+	share := unwrappedShares[0].Share
+	if len(share) != len(dst) {
+		return fmt.Errorf("Reconstituted DEK has the wrong length: got %v bytes, want %v", len(share), len(dst))
+	}
+
+	copy(dst, share)
+	return nil
+}
+
+// shamirScheme is SchemeShamir.
+type shamirScheme struct{}
+
+func (shamirScheme) Name() string { return SchemeShamir }
+
+func (shamirScheme) Supports(keyCfg *configpb.KeyConfig) bool {
+	_, ok := keyCfg.GetKeySplittingAlgorithm().(*configpb.KeyConfig_Shamir)
+	return ok
+}
+
+func (shamirScheme) Split(rand io.Reader, secret []byte, keyCfg *configpb.KeyConfig) ([][]byte, error) {
+	shamirConfig := keyCfg.GetShamir()
+
+	var shares [][]byte
+	var err error
+	if rand == nil {
+		shares, err = SplitSecret(secret, int(shamirConfig.GetThreshold()), int(shamirConfig.GetShares()))
+	} else {
+		shares, err = SplitSecretFromReader(rand, secret, int(shamirConfig.GetThreshold()), int(shamirConfig.GetShares()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error splitting encryption key: %v", err)
+	}
+
+	return shares, nil
+}
+
+// Combine reverses Shamir's Secret Sharing to reconstitute the whole DEK.
+func (shamirScheme) Combine(keyCfg *configpb.KeyConfig, unwrappedShares []UnwrappedShare, dst []byte) error {
+	if len(unwrappedShares) < int(keyCfg.GetShamir().GetThreshold()) {
+		return fmt.Errorf("only successfully unwrapped %v shares, which is fewer than threshold of %v", len(unwrappedShares), keyCfg.GetShamir().GetThreshold())
+	}
+
+	var shares [][]byte
+	for _, share := range unwrappedShares {
+		// Each share is one byte longer than the secret, so check the
+		// length before doing any work.
+		if len(share.Share) != len(dst)+1 {
+			return fmt.Errorf("Reconstituted DEK has the wrong length: share for %v has %v bytes, want %v", share.URI, len(share.Share), len(dst)+1)
+		}
+		shares = append(shares, share.Share)
+	}
+
+	combined, err := CombineSecret(shares)
+	if err != nil {
+		return fmt.Errorf("Error combining DEK shares: %v", err)
+	}
+
+	copy(dst, combined)
+
+	// Don't leave a stray copy of the secret behind.
+	for i := range combined {
+		combined[i] = 0
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shares
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// replicatedScheme gives every KEK a copy of the secret, any one of which
+// recovers it. It supports Shamir KeyConfigs, to test that the recorded scheme
+// is used rather than the one inferred from the KeyConfig.
+type replicatedScheme struct{}
+
+func (replicatedScheme) Name() string { return "test-replicated" }
+
+func (replicatedScheme) Supports(keyCfg *configpb.KeyConfig) bool {
+	return keyCfg.GetShamir() != nil
+}
+
+func (replicatedScheme) Split(_ io.Reader, secret []byte, keyCfg *configpb.KeyConfig) ([][]byte, error) {
+	shares := make([][]byte, keyCfg.GetShamir().GetShares())
+	for i := range shares {
+		shares[i] = append([]byte{}, secret...)
+	}
+	return shares, nil
+}
+
+func (replicatedScheme) Combine(_ *configpb.KeyConfig, unwrappedShares []UnwrappedShare, dst []byte) error {
+	if len(unwrappedShares) == 0 || len(unwrappedShares[0].Share) != len(dst) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(dst, unwrappedShares[0].Share)
+	return nil
+}
+
+// registerTestScheme registers `scheme` for the duration of the test.
+func registerTestScheme(t *testing.T, scheme Scheme) {
+	t.Helper()
+
+	if err := RegisterScheme(scheme); err != nil {
+		t.Fatalf("RegisterScheme(%q) returned error: %v", scheme.Name(), err)
+	}
+	t.Cleanup(func() {
+		schemesMu.Lock()
+		defer schemesMu.Unlock()
+		schemes = schemes[:len(schemes)-1]
+	})
+}
+
+func TestSchemeForKeyConfig(t *testing.T) {
+	registerTestScheme(t, replicatedScheme{})
+
+	testcases := []struct {
+		name       string
+		keyCfg     *configpb.KeyConfig
+		wantScheme string
+	}{
+		{
+			name:       "No split",
+			keyCfg:     &configpb.KeyConfig{KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true}},
+			wantScheme: SchemeNoSplit,
+		},
+		{
+			// The built-in scheme is chosen over the later registered one.
+			name:       "Shamir",
+			keyCfg:     &configpb.KeyConfig{KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 3}}},
+			wantScheme: SchemeShamir,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			scheme, err := SchemeForKeyConfig(tc.keyCfg)
+			if err != nil {
+				t.Fatalf("SchemeForKeyConfig() returned error: %v", err)
+			}
+			if scheme.Name() != tc.wantScheme {
+				t.Errorf("SchemeForKeyConfig() = %q, want %q", scheme.Name(), tc.wantScheme)
+			}
+
+			// Without a recorded name, the same scheme is inferred.
+			resolved, err := ResolveScheme("", tc.keyCfg)
+			if err != nil {
+				t.Fatalf("ResolveScheme() returned error: %v", err)
+			}
+			if resolved.Name() != tc.wantScheme {
+				t.Errorf("ResolveScheme() = %q, want %q", resolved.Name(), tc.wantScheme)
+			}
+		})
+	}
+
+	if _, err := SchemeForKeyConfig(&configpb.KeyConfig{}); err == nil {
+		t.Error("SchemeForKeyConfig() without a key splitting algorithm succeeded, want error")
+	}
+}
+
+func TestCombineUnwrappedSharesWithScheme(t *testing.T) {
+	registerTestScheme(t, replicatedScheme{})
+
+	shamirCfg := &configpb.KeyConfig{KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 3}}}
+	noSplitCfg := &configpb.KeyConfig{KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true}}
+	dek := NewDEK()
+
+	split := func(name string, keyCfg *configpb.KeyConfig) []UnwrappedShare {
+		t.Helper()
+		scheme, err := LookupScheme(name)
+		if err != nil {
+			t.Fatalf("LookupScheme(%q) returned error: %v", name, err)
+		}
+		shares, err := scheme.Split(nil, dek[:], keyCfg)
+		if err != nil {
+			t.Fatalf("Split() with scheme %q returned error: %v", name, err)
+		}
+		var unwrapped []UnwrappedShare
+		for _, share := range shares {
+			unwrapped = append(unwrapped, UnwrappedShare{Share: share})
+		}
+		return unwrapped
+	}
+
+	testcases := []struct {
+		name          string
+		splitScheme   string
+		combineScheme string
+		keyCfg        *configpb.KeyConfig
+		wantErr       string
+	}{
+		{
+			name:          "Shamir",
+			splitScheme:   SchemeShamir,
+			combineScheme: SchemeShamir,
+			keyCfg:        shamirCfg,
+		},
+		{
+			name:          "Registered scheme",
+			splitScheme:   "test-replicated",
+			combineScheme: "test-replicated",
+			keyCfg:        shamirCfg,
+		},
+		{
+			name:          "Inferred scheme",
+			splitScheme:   SchemeNoSplit,
+			combineScheme: "",
+			keyCfg:        noSplitCfg,
+		},
+		{
+			name:          "Replicated shares combined with Shamir",
+			splitScheme:   "test-replicated",
+			combineScheme: SchemeShamir,
+			keyCfg:        shamirCfg,
+			wantErr:       "wrong length",
+		},
+		{
+			name:          "Shamir shares combined with replication",
+			splitScheme:   SchemeShamir,
+			combineScheme: "test-replicated",
+			keyCfg:        shamirCfg,
+			wantErr:       "unexpected EOF",
+		},
+		{
+			name:          "Scheme does not support KeyConfig",
+			splitScheme:   SchemeShamir,
+			combineScheme: SchemeNoSplit,
+			keyCfg:        shamirCfg,
+			wantErr:       "does not support the key splitting algorithm",
+		},
+		{
+			name:          "Unknown scheme",
+			splitScheme:   SchemeShamir,
+			combineScheme: "shamir-gf65536",
+			keyCfg:        shamirCfg,
+			wantErr:       "unknown key splitting scheme",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			unwrapped := split(tc.splitScheme, tc.keyCfg)
+
+			var combined DEK
+			err := CombineUnwrappedSharesWithScheme(tc.combineScheme, tc.keyCfg, unwrapped, combined[:])
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("CombineUnwrappedSharesWithScheme() returned error %v, want error containing %q", err, tc.wantErr)
+				}
+				if combined != (DEK{}) {
+					t.Error("CombineUnwrappedSharesWithScheme() modified the destination on error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CombineUnwrappedSharesWithScheme() returned error: %v", err)
+			}
+			if !bytes.Equal(combined[:], dek[:]) {
+				t.Errorf("CombineUnwrappedSharesWithScheme() = %x, want %x", combined, dek)
+			}
+		})
+	}
+}
+
+func TestRegisterSchemeDuplicate(t *testing.T) {
+	for _, name := range []string{SchemeNoSplit, SchemeShamir} {
+		scheme, err := LookupScheme(name)
+		if err != nil {
+			t.Fatalf("LookupScheme(%q) returned error: %v", name, err)
+		}
+		if err := RegisterScheme(scheme); err == nil {
+			t.Errorf("RegisterScheme(%q) of a built-in scheme succeeded, want error", name)
+		}
+	}
+}
@@ -13,11 +13,19 @@
 // limitations under the License.
 
 // Package shares contains functions for processing DEK shares.
+//
+// SplitSecret and CombineSecret split and recombine arbitrary secrets with
+// Shamir's Secret Sharing, independently of any KeyConfig, for callers that
+// manage the wrapping of shares themselves. HashShare and ValidateShare can be
+// used to check shares for integrity, since combining faulty shares does not
+// fail.
 package shares
 
 import (
 	"bytes"
+	"crypto/sha512"
 	"fmt"
+	"io"
 
 	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
 	"github.com/google/tink/go/subtle/random"
@@ -40,6 +48,17 @@ func NewDEK() DEK {
 	return dek
 }
 
+// NewDEKFromReader generates a DEK with randomness read from `rand`, which
+// must be a cryptographically secure source, such as crypto/rand.Reader.
+func NewDEKFromReader(rand io.Reader) (DEK, error) {
+	var dek DEK
+	if _, err := io.ReadFull(rand, dek[:]); err != nil {
+		return DEK{}, fmt.Errorf("error generating DEK: %v", err)
+	}
+
+	return dek, nil
+}
+
 // UnwrappedShare represents an unwrapped share and its associated external URI.
 type UnwrappedShare struct {
 	Share []byte
@@ -59,8 +78,107 @@ func ValidateShare(share []byte, expectedHash []byte) bool {
 	return bytes.Equal(actualHash[:], expectedHash[:])
 }
 
+// HashShareWithAlgorithm hashes the provided share with `alg`.
+// DEFAULT_SHARE_HASH is SHA-256, as used by HashShare.
+func HashShareWithAlgorithm(share []byte, alg configpb.ShareHashAlgorithm) ([]byte, error) {
+	switch alg {
+	case configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH, configpb.ShareHashAlgorithm_SHA256:
+		return HashShare(share), nil
+	case configpb.ShareHashAlgorithm_SHA384:
+		hash := sha512.Sum384(share)
+		return hash[:], nil
+	case configpb.ShareHashAlgorithm_SHA512:
+		hash := sha512.Sum512(share)
+		return hash[:], nil
+	default:
+		return nil, fmt.Errorf("unsupported share hash algorithm %v", alg)
+	}
+}
+
+// ValidateShareWithAlgorithm performs HashShareWithAlgorithm on the provided
+// share, then returns whether the result is equal to the provided hash. It
+// returns false if `alg` is not supported.
+func ValidateShareWithAlgorithm(share []byte, expectedHash []byte, alg configpb.ShareHashAlgorithm) bool {
+	actualHash, err := HashShareWithAlgorithm(share, alg)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(actualHash, expectedHash)
+}
+
+// maxShares is the maximum number of shares supported by Shamir's Secret
+// Sharing over GF(2^8).
+const maxShares = 255
+
+// SplitSecret splits `secret` into `total` shares with Shamir's Secret
+// Sharing, any `threshold` of which can be passed to CombineSecret to recover
+// it. The threshold must be at least 2 and at most `total`, which must be at
+// most 255. Each share is one byte longer than the secret.
+func SplitSecret(secret []byte, threshold, total int) ([][]byte, error) {
+	if err := checkSplit(secret, threshold, total); err != nil {
+		return nil, err
+	}
+
+	return shamir.Split(secret, total, threshold)
+}
+
+// checkSplit checks the arguments of SplitSecret.
+func checkSplit(secret []byte, threshold, total int) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("cannot split an empty secret")
+	}
+
+	if threshold < 2 {
+		return fmt.Errorf("threshold is %v, but must be at least 2", threshold)
+	}
+
+	if total < threshold {
+		return fmt.Errorf("total number of shares (%v) is less than the threshold (%v)", total, threshold)
+	}
+
+	if total > maxShares {
+		return fmt.Errorf("total number of shares is %v, but must be at most %v", total, maxShares)
+	}
+
+	return nil
+}
+
+// CombineSecret recovers a secret from shares created by SplitSecret. At least
+// as many shares as the threshold must be given, in any order. Note that this
+// does not guarantee the shares are correct: combining faulty shares, or fewer
+// shares than the threshold, "succeeds" with the wrong secret, so use
+// ValidateShare to check shares against their hashes first.
+func CombineSecret(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("got %v shares, but at least 2 are required", len(shares))
+	}
+
+	seen := make(map[byte]bool)
+	for i, share := range shares {
+		if len(share) < 2 {
+			return nil, fmt.Errorf("share %v is too short", i)
+		}
+
+		if len(share) != len(shares[0]) {
+			return nil, fmt.Errorf("share %v has length %v, but share 0 has length %v", i, len(share), len(shares[0]))
+		}
+
+		// The last byte of each share is its x-coordinate.
+		x := share[len(share)-1]
+		if seen[x] {
+			return nil, fmt.Errorf("share %v is a duplicate", i)
+		}
+		seen[x] = true
+	}
+
+	return shamir.Combine(shares)
+}
+
 // SplitShares takes a DEK as `data`, and returns a slice of byte slices, each representing
 // one of the n shares.
+//
+// Deprecated: Use SplitSecret, which validates its arguments.
 func SplitShares(data []byte, shares, threshold int) ([][]byte, error) {
 	return shamir.Split(data, shares, threshold)
 }
@@ -68,90 +186,98 @@ func SplitShares(data []byte, shares, threshold int) ([][]byte, error) {
 // CombineShares takes a list of shares and reconstitutes the original data. Note that this does not
 // guarantee the shares are correct (SSS will succeed at "reconstructing" data from
 // even faulty shares), so integrity checks are done separately.
+//
+// Deprecated: Use CombineSecret, which validates its arguments.
 func CombineShares(shares [][]byte) ([]byte, error) {
 	return shamir.Combine(shares)
 }
 
-// CreateDEKShares generates a DEK and - if applicable - splits it into shares.
-func CreateDEKShares(dek DEK, keyCfg *configpb.KeyConfig) ([][]byte, error) {
-	var shares [][]byte
+// CheckShareCount returns an error unless CreateDEKShares would create exactly
+// one share per KEK in `keyCfg`, describing the discrepancy if not.
+func CheckShareCount(keyCfg *configpb.KeyConfig) error {
+	numKEKs := len(keyCfg.GetKekInfos())
 
-	// Depending on the key splitting algorithm given in the KeyConfig, take
-	// the DEK and split it, wrapping the resulting shares and writing them
-	// back to the `Shares` field of `metadata`.
+	var numShares int
+	var scheme string
 	switch keyCfg.KeySplittingAlgorithm.(type) {
-
-	// Don't split the DEK.
 	case *configpb.KeyConfig_NoSplit:
-		if len(keyCfg.GetKekInfos()) != 1 {
-			return nil, fmt.Errorf("invalid Encrypt configuration, number of KekInfos is %v but expected 1 for 'no split' option", len(keyCfg.GetKekInfos()))
-		}
-
-		shares = [][]byte{dek[:]}
-
-	// Split DEK with Shamir's Secret Sharing.
+		numShares = 1
+		scheme = "'no split' option"
 	case *configpb.KeyConfig_Shamir:
-		shamirConfig := keyCfg.GetShamir()
-		shamirShares := int(shamirConfig.GetShares())
-		shamirThreshold := int(shamirConfig.GetThreshold())
-
-		// The number of KEK Infos should match the number of shares to generate
-		if len(keyCfg.GetKekInfos()) != shamirShares {
-			return nil, fmt.Errorf("invalid Encrypt configuration, number of KEK Infos does not match the number of shares to generate: found %v KEK Infos, %v shares", len(keyCfg.GetKekInfos()), shamirShares)
-		}
-
-		var err error
-		shares, err = SplitShares(dek[:], shamirShares, shamirThreshold)
-		if err != nil {
-			return nil, fmt.Errorf("error splitting encryption key: %v", err)
-		}
-
+		numShares = int(keyCfg.GetShamir().GetShares())
+		scheme = fmt.Sprintf("Shamir's Secret Sharing with threshold %v", keyCfg.GetShamir().GetThreshold())
 	default:
-		return nil, fmt.Errorf("unknown key splitting algorithm")
+		return fmt.Errorf("unknown key splitting algorithm")
+	}
+
+	switch {
+	case numKEKs > numShares:
+		return fmt.Errorf("invalid Encrypt configuration, the %v generates %v shares but %v KEK Infos are configured: %v KEK Infos would have no share to wrap", scheme, numShares, numKEKs, numKEKs-numShares)
+	case numKEKs < numShares:
+		return fmt.Errorf("invalid Encrypt configuration, the %v generates %v shares but %v KEK Infos are configured: %v shares would have no KEK to wrap them", scheme, numShares, numKEKs, numShares-numKEKs)
 	}
 
-	return shares, nil
+	return nil
 }
 
-// CombineUnwrappedShares reconstitutes and returns the DEK from the provided shares.
-func CombineUnwrappedShares(keyCfg *configpb.KeyConfig, unwrappedShares []UnwrappedShare) ([]byte, error) {
-	// Reconstitute DEK.
-	var combinedShares []byte
+// CreateDEKShares generates a DEK and - if applicable - splits it into shares.
+func CreateDEKShares(dek DEK, keyCfg *configpb.KeyConfig) ([][]byte, error) {
+	return createDEKShares(nil, dek, keyCfg)
+}
 
-	switch keyCfg.KeySplittingAlgorithm.(type) {
-	// DEK wasn't split, so combined shares is just the sole share.
-	case *configpb.KeyConfig_NoSplit:
-		if len(unwrappedShares) != 1 {
-			return nil, fmt.Errorf("number of unwrapped shares is %v but expected 1 for 'no split' option", len(unwrappedShares))
-		}
+// CreateDEKSharesFromReader is like CreateDEKShares, but splits the DEK with
+// SplitSecretFromReader, reading the randomness from `rand`.
+func CreateDEKSharesFromReader(rand io.Reader, dek DEK, keyCfg *configpb.KeyConfig) ([][]byte, error) {
+	return createDEKShares(rand, dek, keyCfg)
+}
 
-		combinedShares = unwrappedShares[0].Share
+// createDEKShares implements CreateDEKShares, splitting the DEK with the
+// scheme for the key splitting algorithm of `keyCfg`, with randomness from
+// `rand` if not nil.
+func createDEKShares(rand io.Reader, dek DEK, keyCfg *configpb.KeyConfig) ([][]byte, error) {
+	// Each share is wrapped by the KEK at the same index, so there must be
+	// exactly one KEK per share.
+	if err := CheckShareCount(keyCfg); err != nil {
+		return nil, err
+	}
 
-	// Reverse Shamir's Secret Sharing to reconstitute the whole DEK.
-	case *configpb.KeyConfig_Shamir:
-		if len(unwrappedShares) < int(keyCfg.GetShamir().GetThreshold()) {
-			return nil, fmt.Errorf("only successfully unwrapped %v shares, which is fewer than threshold of %v", len(unwrappedShares), keyCfg.GetShamir().GetThreshold())
-		}
+	scheme, err := SchemeForKeyConfig(keyCfg)
+	if err != nil {
+		return nil, err
+	}
 
-		var shares [][]byte
-		for _, share := range unwrappedShares {
-			shares = append(shares, share.Share)
-		}
+	return scheme.Split(rand, dek[:], keyCfg)
+}
 
-		var err error
-		combinedShares, err = CombineShares(shares)
-		if err != nil {
-			return nil, fmt.Errorf("Error combining DEK shares: %v", err)
-		}
+// CombineUnwrappedShares reconstitutes and returns the DEK from the provided shares.
+func CombineUnwrappedShares(keyCfg *configpb.KeyConfig, unwrappedShares []UnwrappedShare) ([]byte, error) {
+	combined := make([]byte, DEKBytes)
+	if err := CombineUnwrappedSharesInto(keyCfg, unwrappedShares, combined); err != nil {
+		return nil, err
+	}
 
-	default:
-		return nil, fmt.Errorf("Unknown key splitting algorithm")
+	return combined, nil
+}
 
-	}
+// CombineUnwrappedSharesInto is like CombineUnwrappedShares, but writes the
+// reconstituted secret directly into `dst`, such as the slice of a DEK. The
+// reconstituted secret must be exactly len(dst) bytes long; if it is not, or
+// the shares cannot be combined, an error is returned and `dst` is left
+// unmodified.
+func CombineUnwrappedSharesInto(keyCfg *configpb.KeyConfig, unwrappedShares []UnwrappedShare, dst []byte) error {
+	return CombineUnwrappedSharesWithScheme("", keyCfg, unwrappedShares, dst)
+}
 
-	if len(combinedShares) != int(DEKBytes) {
-		return nil, fmt.Errorf("Reconstituted DEK has the wrong length")
+// CombineUnwrappedSharesWithScheme is like CombineUnwrappedSharesInto, but
+// combines the shares with the scheme named `scheme`, as recorded in the
+// blob's metadata, rather than inferring it from `keyCfg`. Returns an error if
+// the scheme is unknown or does not support the key splitting algorithm of
+// `keyCfg`. If `scheme` is empty, it is inferred as by SchemeForKeyConfig.
+func CombineUnwrappedSharesWithScheme(scheme string, keyCfg *configpb.KeyConfig, unwrappedShares []UnwrappedShare, dst []byte) error {
+	s, err := ResolveScheme(scheme, keyCfg)
+	if err != nil {
+		return err
 	}
 
-	return combinedShares, nil
+	return s.Combine(keyCfg, unwrappedShares, dst)
 }
@@ -16,8 +16,12 @@ package shares
 
 import (
 	"bytes"
+	mathrand "math/rand"
+	"strings"
 	"testing"
 
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/tink/go/subtle/random"
 )
 
@@ -49,6 +53,62 @@ func TestValidateShareFailsForNonmatchingShareAndHash(t *testing.T) {
 	}
 }
 
+func TestHashShareWithAlgorithm(t *testing.T) {
+	share := random.GetRandomBytes(33)
+	otherShare := random.GetRandomBytes(33)
+
+	testCases := []struct {
+		alg     configpb.ShareHashAlgorithm
+		hashLen int
+	}{
+		{alg: configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH, hashLen: 32},
+		{alg: configpb.ShareHashAlgorithm_SHA256, hashLen: 32},
+		{alg: configpb.ShareHashAlgorithm_SHA384, hashLen: 48},
+		{alg: configpb.ShareHashAlgorithm_SHA512, hashLen: 64},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.alg.String(), func(t *testing.T) {
+			hash, err := HashShareWithAlgorithm(share, tc.alg)
+			if err != nil {
+				t.Fatalf("HashShareWithAlgorithm(%v) returned error: %v", tc.alg, err)
+			}
+
+			if len(hash) != tc.hashLen {
+				t.Errorf("HashShareWithAlgorithm(%v) returned %v bytes, want %v", tc.alg, len(hash), tc.hashLen)
+			}
+
+			if !ValidateShareWithAlgorithm(share, hash, tc.alg) {
+				t.Errorf("ValidateShareWithAlgorithm(share, hash, %v) = false, want true", tc.alg)
+			}
+
+			if ValidateShareWithAlgorithm(otherShare, hash, tc.alg) {
+				t.Errorf("ValidateShareWithAlgorithm(otherShare, hash, %v) = true, want false", tc.alg)
+			}
+		})
+	}
+
+	// The default is SHA-256, so that shares hashed by HashShare still validate.
+	if !ValidateShareWithAlgorithm(share, HashShare(share), configpb.ShareHashAlgorithm_DEFAULT_SHARE_HASH) {
+		t.Error("ValidateShareWithAlgorithm(share, HashShare(share), DEFAULT_SHARE_HASH) = false, want true")
+	}
+
+	sha512Hash, err := HashShareWithAlgorithm(share, configpb.ShareHashAlgorithm_SHA512)
+	if err != nil {
+		t.Fatalf("HashShareWithAlgorithm(SHA512) returned error: %v", err)
+	}
+	if ValidateShareWithAlgorithm(share, sha512Hash, configpb.ShareHashAlgorithm_SHA384) {
+		t.Error("ValidateShareWithAlgorithm validated a SHA-512 hash as SHA-384")
+	}
+
+	if _, err := HashShareWithAlgorithm(share, configpb.ShareHashAlgorithm(100)); err == nil {
+		t.Error("HashShareWithAlgorithm succeeded with an unknown algorithm, want error")
+	}
+	if ValidateShareWithAlgorithm(share, HashShare(share), configpb.ShareHashAlgorithm(100)) {
+		t.Error("ValidateShareWithAlgorithm succeeded with an unknown algorithm, want false")
+	}
+}
+
 func TestSplitSharesAndCombineSharesRestoresSecret(t *testing.T) {
 	var secret = random.GetRandomBytes(32)
 	var nShares = 5
@@ -87,3 +147,387 @@ func TestSplitSharesAndCombineSharesRestoresSecret(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitSecretAndCombineSecretRoundTrip(t *testing.T) {
+	testcases := []struct {
+		threshold int
+		total     int
+	}{
+		{2, 2},
+		{2, 3},
+		{3, 5},
+		{5, 5},
+		{4, 10},
+		{2, 255},
+	}
+
+	for _, tc := range testcases {
+		secret := random.GetRandomBytes(32)
+
+		shares, err := SplitSecret(secret, tc.threshold, tc.total)
+		if err != nil {
+			t.Fatalf("SplitSecret(secret, %d, %d) returned error: %v", tc.threshold, tc.total, err)
+		}
+
+		if len(shares) != tc.total {
+			t.Fatalf("SplitSecret(secret, %d, %d) returned %d shares, want %d", tc.threshold, tc.total, len(shares), tc.total)
+		}
+
+		// Any `threshold` shares, in any order, should recover the secret.
+		subsets := [][][]byte{
+			shares[:tc.threshold],
+			shares[tc.total-tc.threshold:],
+			shares,
+		}
+
+		reversed := make([][]byte, tc.threshold)
+		for i := range reversed {
+			reversed[i] = shares[tc.threshold-1-i]
+		}
+		subsets = append(subsets, reversed)
+
+		for _, subset := range subsets {
+			combined, err := CombineSecret(subset)
+			if err != nil {
+				t.Fatalf("CombineSecret() with %d of %d shares returned error: %v", len(subset), tc.total, err)
+			}
+
+			if !bytes.Equal(combined, secret) {
+				t.Errorf("CombineSecret() with %d of %d shares = %v, want %v", len(subset), tc.total, combined, secret)
+			}
+		}
+
+		// Fewer than `threshold` shares should not recover the secret.
+		if tc.threshold > 2 {
+			combined, err := CombineSecret(shares[:tc.threshold-1])
+			if err == nil && bytes.Equal(combined, secret) {
+				t.Errorf("CombineSecret() with %d of %d shares recovered the secret, want threshold %d", tc.threshold-1, tc.total, tc.threshold)
+			}
+		}
+	}
+}
+
+func TestSplitSecretFromReader(t *testing.T) {
+	secret := random.GetRandomBytes(32)
+
+	split := func(seed int64, threshold, total int) [][]byte {
+		t.Helper()
+		shares, err := SplitSecretFromReader(mathrand.New(mathrand.NewSource(seed)), secret, threshold, total)
+		if err != nil {
+			t.Fatalf("SplitSecretFromReader(secret, %d, %d) returned error: %v", threshold, total, err)
+		}
+		return shares
+	}
+
+	for _, tc := range []struct{ threshold, total int }{{2, 2}, {3, 5}, {4, 10}, {2, 255}} {
+		shares := split(1, tc.threshold, tc.total)
+
+		// The shares must be compatible with CombineSecret.
+		for _, subset := range [][][]byte{shares[:tc.threshold], shares[tc.total-tc.threshold:], shares} {
+			combined, err := CombineSecret(subset)
+			if err != nil {
+				t.Fatalf("CombineSecret() with %d of %d shares returned error: %v", len(subset), tc.total, err)
+			}
+			if !bytes.Equal(combined, secret) {
+				t.Errorf("CombineSecret() with %d of %d shares = %v, want %v", len(subset), tc.total, combined, secret)
+			}
+		}
+
+		// The same random source yields the same shares, and a different
+		// one different shares.
+		if again := split(1, tc.threshold, tc.total); !cmp.Equal(again, shares) {
+			t.Errorf("SplitSecretFromReader(secret, %d, %d) is not deterministic for the same source", tc.threshold, tc.total)
+		}
+		if other := split(2, tc.threshold, tc.total); cmp.Equal(other, shares) {
+			t.Errorf("SplitSecretFromReader(secret, %d, %d) returned the same shares for different sources", tc.threshold, tc.total)
+		}
+	}
+
+	if _, err := SplitSecretFromReader(bytes.NewReader(make([]byte, 10)), secret, 2, 3); err == nil {
+		t.Error("SplitSecretFromReader succeeded with an exhausted random source, want error")
+	}
+}
+
+func TestEvaluateShare(t *testing.T) {
+	secret := random.GetRandomBytes(32)
+
+	for _, tc := range []struct{ threshold, total int }{{2, 2}, {3, 5}, {4, 10}} {
+		shares, err := SplitSecret(secret, tc.threshold, tc.total)
+		if err != nil {
+			t.Fatalf("SplitSecret(secret, %d, %d) returned error: %v", tc.threshold, tc.total, err)
+		}
+
+		// Each share is recreated from any threshold of the others.
+		for i, want := range shares {
+			var others [][]byte
+			for j, share := range shares {
+				if j != i && len(others) < tc.threshold {
+					others = append(others, share)
+				}
+			}
+			if len(others) < tc.threshold {
+				continue
+			}
+
+			got, err := EvaluateShare(others, want[len(want)-1])
+			if err != nil {
+				t.Fatalf("EvaluateShare() with %d of %d shares returned error: %v", len(others), tc.total, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("EvaluateShare() with %d of %d shares = %v, want share #%d %v", len(others), tc.total, got, i, want)
+			}
+		}
+
+		// A new share at an unused coordinate combines with the others.
+		used := make(map[byte]bool)
+		for _, share := range shares {
+			used[share[len(share)-1]] = true
+		}
+		x := byte(1)
+		for used[x] {
+			x++
+		}
+		extra, err := EvaluateShare(shares[:tc.threshold], x)
+		if err != nil {
+			t.Fatalf("EvaluateShare() at unused coordinate %d returned error: %v", x, err)
+		}
+		combined, err := CombineSecret(append([][]byte{extra}, shares[1:tc.threshold]...))
+		if err != nil {
+			t.Fatalf("CombineSecret() with the new share returned error: %v", err)
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Errorf("CombineSecret() with the new share = %v, want %v", combined, secret)
+		}
+	}
+
+	shares, err := SplitSecret(secret, 2, 3)
+	if err != nil {
+		t.Fatalf("SplitSecret(secret, 2, 3) returned error: %v", err)
+	}
+	if _, err := EvaluateShare(shares, 0); err == nil {
+		t.Error("EvaluateShare() at coordinate 0 succeeded, want error")
+	}
+	if _, err := EvaluateShare(shares[:1], 1); err == nil {
+		t.Error("EvaluateShare() with one share succeeded, want error")
+	}
+}
+
+func TestSplitSecretErrors(t *testing.T) {
+	testcases := []struct {
+		name      string
+		secret    []byte
+		threshold int
+		total     int
+	}{
+		{"Empty secret", nil, 2, 3},
+		{"Threshold of 1", []byte("secret"), 1, 3},
+		{"Threshold above total", []byte("secret"), 4, 3},
+		{"Too many shares", []byte("secret"), 2, 256},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := SplitSecret(tc.secret, tc.threshold, tc.total); err == nil {
+				t.Errorf("SplitSecret(%v, %d, %d) succeeded, want error", tc.secret, tc.threshold, tc.total)
+			}
+		})
+	}
+}
+
+func TestCombineSecretErrors(t *testing.T) {
+	shares, err := SplitSecret([]byte("secret"), 2, 3)
+	if err != nil {
+		t.Fatalf("SplitSecret returned error: %v", err)
+	}
+
+	testcases := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"No shares", nil},
+		{"Single share", shares[:1]},
+		{"Mismatched lengths", [][]byte{shares[0], shares[1][1:]}},
+		{"Short shares", [][]byte{{1}, {2}}},
+		{"Duplicate shares", [][]byte{shares[0], shares[0]}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := CombineSecret(tc.shares); err == nil {
+				t.Errorf("CombineSecret(%v) succeeded, want error", tc.shares)
+			}
+		})
+	}
+}
+
+func TestCombineUnwrappedSharesInto(t *testing.T) {
+	dek := NewDEK()
+
+	noSplit := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{{}},
+		KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true},
+	}
+	shamirConfig := &configpb.KeyConfig{
+		KekInfos:              []*configpb.KekInfo{{}, {}, {}},
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Shares: 3, Threshold: 2}},
+	}
+
+	shamirShares, err := CreateDEKShares(dek, shamirConfig)
+	if err != nil {
+		t.Fatalf("CreateDEKShares returned error: %v", err)
+	}
+
+	toUnwrapped := func(shares ...[]byte) []UnwrappedShare {
+		var unwrapped []UnwrappedShare
+		for _, share := range shares {
+			unwrapped = append(unwrapped, UnwrappedShare{Share: share})
+		}
+		return unwrapped
+	}
+
+	testcases := []struct {
+		name    string
+		keyCfg  *configpb.KeyConfig
+		shares  []UnwrappedShare
+		dstLen  int
+		wantErr bool
+	}{
+		{
+			name:   "No split",
+			keyCfg: noSplit,
+			shares: toUnwrapped(dek[:]),
+			dstLen: int(DEKBytes),
+		},
+		{
+			name:   "Shamir",
+			keyCfg: shamirConfig,
+			shares: toUnwrapped(shamirShares[2], shamirShares[0]),
+			dstLen: int(DEKBytes),
+		},
+		{
+			name:    "No split with short destination",
+			keyCfg:  noSplit,
+			shares:  toUnwrapped(dek[:]),
+			dstLen:  int(DEKBytes) - 1,
+			wantErr: true,
+		},
+		{
+			name:    "No split with short share",
+			keyCfg:  noSplit,
+			shares:  toUnwrapped(dek[1:]),
+			dstLen:  int(DEKBytes),
+			wantErr: true,
+		},
+		{
+			name:    "Shamir with long destination",
+			keyCfg:  shamirConfig,
+			shares:  toUnwrapped(shamirShares[0], shamirShares[1]),
+			dstLen:  int(DEKBytes) + 1,
+			wantErr: true,
+		},
+		{
+			name:    "Shamir with fewer shares than threshold",
+			keyCfg:  shamirConfig,
+			shares:  toUnwrapped(shamirShares[0]),
+			dstLen:  int(DEKBytes),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := make([]byte, tc.dstLen)
+			err := CombineUnwrappedSharesInto(tc.keyCfg, tc.shares, dst)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("CombineUnwrappedSharesInto succeeded, want error")
+				}
+				if !bytes.Equal(dst, make([]byte, tc.dstLen)) {
+					t.Errorf("CombineUnwrappedSharesInto modified the destination on error: %v", dst)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("CombineUnwrappedSharesInto returned error: %v", err)
+			}
+			if !bytes.Equal(dst, dek[:]) {
+				t.Errorf("CombineUnwrappedSharesInto wrote %v, want %v", dst, dek[:])
+			}
+		})
+	}
+}
+
+func TestCheckShareCount(t *testing.T) {
+	kekInfos := func(n int) []*configpb.KekInfo {
+		var infos []*configpb.KekInfo
+		for i := 0; i < n; i++ {
+			infos = append(infos, &configpb.KekInfo{KekType: &configpb.KekInfo_KekUri{KekUri: "fake"}})
+		}
+		return infos
+	}
+	shamir := func(threshold, shares int64) *configpb.KeyConfig_Shamir {
+		return &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: threshold, Shares: shares}}
+	}
+
+	testcases := []struct {
+		name    string
+		keyCfg  *configpb.KeyConfig
+		wantErr string
+	}{
+		{
+			name:   "No split with one KEK",
+			keyCfg: &configpb.KeyConfig{KekInfos: kekInfos(1), KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true}},
+		},
+		{
+			name:   "Shamir with one KEK per share",
+			keyCfg: &configpb.KeyConfig{KekInfos: kekInfos(3), KeySplittingAlgorithm: shamir(2, 3)},
+		},
+		{
+			name:    "No split with two KEKs",
+			keyCfg:  &configpb.KeyConfig{KekInfos: kekInfos(2), KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true}},
+			wantErr: "1 KEK Infos would have no share",
+		},
+		{
+			name:    "No split without KEKs",
+			keyCfg:  &configpb.KeyConfig{KeySplittingAlgorithm: &configpb.KeyConfig_NoSplit{NoSplit: true}},
+			wantErr: "1 shares would have no KEK",
+		},
+		{
+			name:    "Shamir with more KEKs than shares",
+			keyCfg:  &configpb.KeyConfig{KekInfos: kekInfos(4), KeySplittingAlgorithm: shamir(2, 3)},
+			wantErr: "generates 3 shares but 4 KEK Infos are configured",
+		},
+		{
+			name:    "Shamir with fewer KEKs than shares",
+			keyCfg:  &configpb.KeyConfig{KekInfos: kekInfos(2), KeySplittingAlgorithm: shamir(2, 3)},
+			wantErr: "1 shares would have no KEK",
+		},
+		{
+			name:    "No splitting algorithm",
+			keyCfg:  &configpb.KeyConfig{KekInfos: kekInfos(1)},
+			wantErr: "unknown key splitting algorithm",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckShareCount(tc.keyCfg)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckShareCount() returned error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("CheckShareCount() returned error %v, want error containing %q", err, tc.wantErr)
+			}
+
+			if _, err := CreateDEKShares(NewDEK(), tc.keyCfg); err == nil {
+				t.Error("CreateDEKShares() succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shares
+
+import (
+	"fmt"
+	"io"
+)
+
+// SplitSecretFromReader is like SplitSecret, but reads the random polynomial
+// coefficients and share coordinates from `rand` instead of the system's
+// secure random source. The shares are compatible with CombineSecret.
+//
+// This allows the randomness to be injected, for example from a certified
+// random number generator. `rand` must be a cryptographically secure source:
+// anyone who can predict its output can recover the secret from a single
+// share.
+func SplitSecretFromReader(rand io.Reader, secret []byte, threshold, total int) ([][]byte, error) {
+	if err := checkSplit(secret, threshold, total); err != nil {
+		return nil, err
+	}
+
+	xCoordinates, err := randomXCoordinates(rand, total)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each share holds the y coordinate for each byte of the secret, followed
+	// by its x coordinate, as with shamir.Split.
+	shares := make([][]byte, total)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = xCoordinates[i]
+	}
+
+	// Each byte of the secret is the intercept of its own random polynomial
+	// of degree threshold-1.
+	coefficients := make([]byte, threshold-1)
+	defer func() {
+		for i := range coefficients {
+			coefficients[i] = 0
+		}
+	}()
+
+	for idx, intercept := range secret {
+		if _, err := io.ReadFull(rand, coefficients); err != nil {
+			return nil, fmt.Errorf("error generating polynomial: %v", err)
+		}
+
+		for i, x := range xCoordinates {
+			shares[i][idx] = evaluatePolynomial(intercept, coefficients, x)
+		}
+	}
+
+	return shares, nil
+}
+
+// randomXCoordinates returns `n` distinct, non-zero x coordinates in
+// GF(2^8), chosen uniformly with randomness from `rand`.
+func randomXCoordinates(rand io.Reader, n int) ([]byte, error) {
+	// Shuffle the first n positions of 1..255 with Fisher-Yates.
+	xs := make([]byte, maxShares)
+	for i := range xs {
+		xs[i] = byte(i + 1)
+	}
+
+	for i := 0; i < n; i++ {
+		j, err := randomIndex(rand, len(xs)-i)
+		if err != nil {
+			return nil, fmt.Errorf("error generating share coordinates: %v", err)
+		}
+		xs[i], xs[i+j] = xs[i+j], xs[i]
+	}
+
+	return xs[:n], nil
+}
+
+// randomIndex returns a uniformly random integer in [0, n), for n at most 256,
+// with randomness from `rand`. Bytes that would bias the result are rejected.
+func randomIndex(rand io.Reader, n int) (int, error) {
+	limit := 256 - 256%n
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(rand, b[:]); err != nil {
+			return 0, err
+		}
+
+		if int(b[0]) < limit {
+			return int(b[0]) % n, nil
+		}
+	}
+}
+
+// evaluatePolynomial evaluates the polynomial with the given intercept and
+// higher-order coefficients at `x` in GF(2^8), with Horner's method.
+func evaluatePolynomial(intercept byte, coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coefficients[i]
+	}
+
+	return gfMul(y, x) ^ intercept
+}
+
+// gfMul multiplies in GF(2^8) with the AES reduction polynomial, as used by
+// CombineSecret, in constant time.
+func gfMul(a, b byte) byte {
+	var r byte
+	for i := 0; i < 8; i++ {
+		r ^= -(b & 1) & a
+		b >>= 1
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+	}
+
+	return r
+}
+
+// EvaluateShare returns the share with x coordinate `x` of the secret that
+// `shares` were split from by SplitSecret or SplitSecretFromReader, by
+// interpolating their polynomials. At least as many shares as the threshold
+// must be given, and they must be correct, as with CombineSecret; otherwise
+// the returned share lies on a different polynomial.
+//
+// This allows a lost share to be recreated from the others without changing
+// the secret or the remaining shares.
+func EvaluateShare(shares [][]byte, x byte) ([]byte, error) {
+	if x == 0 {
+		return nil, fmt.Errorf("x coordinate 0 is the secret, not a share")
+	}
+
+	if _, err := CombineSecret(shares); err != nil {
+		return nil, err
+	}
+
+	secretLen := len(shares[0]) - 1
+	share := make([]byte, secretLen+1)
+	share[secretLen] = x
+
+	for i, si := range shares {
+		// The Lagrange basis polynomial of share i, evaluated at x.
+		xi := si[secretLen]
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			xj := sj[secretLen]
+			basis = gfMul(basis, gfMul(x^xj, gfInverse(xi^xj)))
+		}
+
+		for idx := 0; idx < secretLen; idx++ {
+			share[idx] ^= gfMul(si[idx], basis)
+		}
+	}
+
+	return share, nil
+}
+
+// gfInverse returns the multiplicative inverse of a non-zero `a` in GF(2^8),
+// as a^254, in constant time.
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+
+	return result
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// checkSigner returns an error if `signer` does not hold an RSA or ECDSA key.
+func checkSigner(signer crypto.Signer) error {
+	switch k := signer.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return nil
+	default:
+		return fmt.Errorf("unsupported signing key type %T, want RSA or ECDSA", k)
+	}
+}
+
+// signDigest signs the SHA-256 `digest` of a blob with `signer`, using
+// PKCS #1 v1.5 for RSA keys and ASN.1-encoded signatures for ECDSA keys.
+func signDigest(signer crypto.Signer, digest []byte) ([]byte, error) {
+	if err := checkSigner(signer); err != nil {
+		return nil, err
+	}
+
+	signature, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign blob: %v", err)
+	}
+
+	return signature, nil
+}
+
+// VerifySignature checks a detached signature, as written by Encrypt
+// WithSignature, over the STET header, metadata and ciphertext read from
+// `input`. Blobs written by EncryptWithSidecar can be verified by passing
+// io.MultiReader(metadataInput, ciphertextInput).
+//
+// The blob is not decrypted, so this only shows that the holder of the
+// signing key produced the blob; only Decrypt authenticates the ciphertext
+// against the DEK. `publicKey` must be an *rsa.PublicKey or *ecdsa.PublicKey.
+func VerifySignature(input io.Reader, signature []byte, publicKey crypto.PublicKey) error {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, input); err != nil {
+		return fmt.Errorf("error reading blob: %v", err)
+	}
+	digest := hash.Sum(nil)
+
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature); err != nil {
+			return fmt.Errorf("signature verification failed: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, signature) {
+			return fmt.Errorf("signature verification failed")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T, want RSA or ECDSA", k)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+)
+
+func TestSignatureRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+	stetConfig := newFakeKMSConfig(1)
+	plaintext := []byte("This is data to be encrypted.")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey returned error: %v", err)
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey returned error: %v", err)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey returned error: %v", err)
+	}
+
+	testcases := []struct {
+		name   string
+		signer crypto.Signer
+	}{
+		{name: "RSA", signer: rsaKey},
+		{name: "ECDSA", signer: ecdsaKey},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var blob, signature bytes.Buffer
+			if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, "", WithSignature(tc.signer, &signature)); err != nil {
+				t.Fatalf("Encrypt returned error: %v", err)
+			}
+
+			if err := VerifySignature(bytes.NewReader(blob.Bytes()), signature.Bytes(), tc.signer.Public()); err != nil {
+				t.Errorf("VerifySignature returned error: %v", err)
+			}
+
+			tampered := append([]byte{}, blob.Bytes()...)
+			tampered[len(tampered)-1] ^= 1
+			if err := VerifySignature(bytes.NewReader(tampered), signature.Bytes(), tc.signer.Public()); err == nil {
+				t.Error("VerifySignature succeeded for a tampered blob, want error")
+			}
+
+			if err := VerifySignature(bytes.NewReader(blob.Bytes()), signature.Bytes(), otherKey.Public()); err == nil {
+				t.Error("VerifySignature succeeded with the wrong public key, want error")
+			}
+
+			// The blob still decrypts as usual.
+			var output bytes.Buffer
+			if _, err := stetClient.Decrypt(ctx, &blob, &output, stetConfig); err != nil {
+				t.Fatalf("Decrypt returned error: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), plaintext) {
+				t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+			}
+		})
+	}
+
+	t.Run("Sidecar with integrity manifest", func(t *testing.T) {
+		var metadata, ciphertext, signature bytes.Buffer
+		if _, err := stetClient.EncryptWithSidecar(ctx, bytes.NewReader(plaintext), &metadata, &ciphertext, stetConfig, "", WithIntegrityManifest(), WithSignature(ecdsaKey, &signature)); err != nil {
+			t.Fatalf("EncryptWithSidecar returned error: %v", err)
+		}
+
+		if err := VerifySignature(io.MultiReader(&metadata, &ciphertext), signature.Bytes(), ecdsaKey.Public()); err != nil {
+			t.Errorf("VerifySignature returned error: %v", err)
+		}
+	})
+}
+
+func TestSignatureUnsupportedKey(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey returned error: %v", err)
+	}
+
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}}
+
+	var blob, signature bytes.Buffer
+	if _, err := stetClient.Encrypt(context.Background(), bytes.NewReader([]byte("plaintext")), &blob, newFakeKMSConfig(1), "", WithSignature(edKey, &signature)); err == nil {
+		t.Error("Encrypt succeeded with an Ed25519 signing key, want error")
+	}
+
+	if err := VerifySignature(bytes.NewReader(blob.Bytes()), nil, edKey.Public()); err == nil {
+		t.Error("VerifySignature succeeded with an Ed25519 public key, want error")
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stettest provides fakes for testing and benchmarking code built on
+// STET without access to Cloud KMS.
+package stettest
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"sync"
+	"time"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+	spb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/google/tink/go/daead/subtle"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// importTime is reported as the import time of keys with an ImportJob.
+var importTime = time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// FakeKMS is an in-memory fake of the Cloud KMS client that wraps data with a
+// deterministic AEAD keyed by the name of the requested key. It is safe for
+// concurrent use, and can be set as a StetClient's KMSClient.
+//
+// Keys are not stored anywhere: any key name is treated as an existing key,
+// whose versions are enabled unless listed in VersionStates, and data wrapped
+// by one FakeKMS can be unwrapped by another. All versions of a key wrap data
+// identically.
+type FakeKMS struct {
+	// The protection level reported for all keys. Defaults to SOFTWARE. Note
+	// that STET does not wrap with Cloud KMS for EXTERNAL and EXTERNAL_VPC keys.
+	ProtectionLevel rpb.ProtectionLevel
+
+	// If set, all keys are reported as backed by key material imported with
+	// this import job, as for keys brought into Cloud KMS by the customer.
+	ImportJob string
+
+	// Latency added to every call, simulating a network round trip.
+	Latency time.Duration
+
+	// The states of CryptoKeyVersions, keyed by resource name, such as
+	// "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1" for
+	// the primary version of every key. Unlisted versions are enabled.
+	// Encrypt rejects versions that are not enabled, but Decrypt cannot tell
+	// which version data was wrapped with, so does not check.
+	VersionStates map[string]rpb.CryptoKeyVersion_CryptoKeyVersionState
+
+	// RSA keys of asymmetric decryption CryptoKeys, keyed by the resource name
+	// of the CryptoKey. These keys have the ASYMMETRIC_DECRYPT purpose, use
+	// RSA-OAEP with SHA-256, and have no primary version, so must be used
+	// through one of their versions, which all share the same key. The map
+	// must not be modified while the fake is in use.
+	AsymmetricKeys map[string]*rsa.PrivateKey
+
+	// Errors to return from the corresponding calls, if set.
+	GetCryptoKeyErr error
+	EncryptErr      error
+	DecryptErr      error
+
+	mu    sync.Mutex
+	calls int
+}
+
+// Ensure FakeKMS satisfies the interfaces used by STET.
+var (
+	_ cloudkms.Client           = (*FakeKMS)(nil)
+	_ cloudkms.VersionGetter    = (*FakeKMS)(nil)
+	_ cloudkms.AsymmetricClient = (*FakeKMS)(nil)
+)
+
+// Calls returns the number of calls made to the fake so far.
+func (f *FakeKMS) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls
+}
+
+// call records a call and waits for the configured latency.
+func (f *FakeKMS) call(ctx context.Context) error {
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+
+	if f.Latency == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(f.Latency)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func crc32c(data []byte) int64 {
+	return int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// cryptoKeyName returns the name of the CryptoKey that the resource `name`
+// refers to, which may be one of its CryptoKeyVersions.
+func cryptoKeyName(name string) string {
+	if i := strings.Index(name, "/cryptoKeyVersions/"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// keyAEAD returns the deterministic AEAD used for the given key or version
+// name.
+func keyAEAD(name string) (*subtle.AESSIV, error) {
+	key := sha512.Sum512([]byte("stettest fake KMS key: " + cryptoKeyName(name)))
+	return subtle.NewAESSIV(key[:])
+}
+
+// versionState returns the state of the CryptoKeyVersion with the given name.
+func (f *FakeKMS) versionState(name string) rpb.CryptoKeyVersion_CryptoKeyVersionState {
+	if state, ok := f.VersionStates[name]; ok {
+		return state
+	}
+	return rpb.CryptoKeyVersion_ENABLED
+}
+
+// cryptoKeyVersion returns the CryptoKeyVersion with the given name.
+func (f *FakeKMS) cryptoKeyVersion(name string) *rpb.CryptoKeyVersion {
+	pl := f.ProtectionLevel
+	if pl == rpb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED {
+		pl = rpb.ProtectionLevel_SOFTWARE
+	}
+
+	ver := &rpb.CryptoKeyVersion{
+		Name:            name,
+		State:           f.versionState(name),
+		ProtectionLevel: pl,
+		Algorithm:       rpb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION,
+	}
+	if key, ok := f.AsymmetricKeys[cryptoKeyName(name)]; ok {
+		ver.Algorithm = asymmetricAlgorithm(key)
+	}
+
+	if f.ImportJob != "" {
+		ver.ImportJob = f.ImportJob
+		ver.ImportTime = timestamppb.New(importTime)
+	}
+
+	return ver
+}
+
+// GetCryptoKey returns a CryptoKey with the given name, whose primary version
+// is version 1.
+func (f *FakeKMS) GetCryptoKey(ctx context.Context, req *spb.GetCryptoKeyRequest, _ ...gax.CallOption) (*rpb.CryptoKey, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.GetCryptoKeyErr != nil {
+		return nil, f.GetCryptoKeyErr
+	}
+
+	if _, ok := f.AsymmetricKeys[req.GetName()]; ok {
+		return &rpb.CryptoKey{
+			Name:       req.GetName(),
+			Purpose:    rpb.CryptoKey_ASYMMETRIC_DECRYPT,
+			ImportOnly: f.ImportJob != "",
+		}, nil
+	}
+
+	return &rpb.CryptoKey{
+		Name:       req.GetName(),
+		Purpose:    rpb.CryptoKey_ENCRYPT_DECRYPT,
+		Primary:    f.cryptoKeyVersion(req.GetName() + "/cryptoKeyVersions/1"),
+		ImportOnly: f.ImportJob != "",
+	}, nil
+}
+
+// GetCryptoKeyVersion returns the CryptoKeyVersion with the given name.
+func (f *FakeKMS) GetCryptoKeyVersion(ctx context.Context, req *spb.GetCryptoKeyVersionRequest, _ ...gax.CallOption) (*rpb.CryptoKeyVersion, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.GetCryptoKeyErr != nil {
+		return nil, f.GetCryptoKeyErr
+	}
+
+	return f.cryptoKeyVersion(req.GetName()), nil
+}
+
+// Encrypt wraps the plaintext with the key named in the request.
+func (f *FakeKMS) Encrypt(ctx context.Context, req *spb.EncryptRequest, _ ...gax.CallOption) (*spb.EncryptResponse, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.EncryptErr != nil {
+		return nil, f.EncryptErr
+	}
+
+	if _, ok := f.AsymmetricKeys[cryptoKeyName(req.GetName())]; ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v is not a symmetric encryption key", req.GetName())
+	}
+
+	verName := req.GetName()
+	if verName == cryptoKeyName(verName) {
+		verName += "/cryptoKeyVersions/1"
+	}
+	if state := f.versionState(verName); state != rpb.CryptoKeyVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v is not enabled, current state is: %v", verName, state)
+	}
+
+	if req.GetPlaintextCrc32C() != nil && req.GetPlaintextCrc32C().GetValue() != crc32c(req.GetPlaintext()) {
+		return nil, fmt.Errorf("plaintext checksum mismatch")
+	}
+
+	if req.GetAdditionalAuthenticatedDataCrc32C() != nil && req.GetAdditionalAuthenticatedDataCrc32C().GetValue() != crc32c(req.GetAdditionalAuthenticatedData()) {
+		return nil, fmt.Errorf("AAD checksum mismatch")
+	}
+
+	aead, err := keyAEAD(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := aead.EncryptDeterministically(req.GetPlaintext(), req.GetAdditionalAuthenticatedData())
+	if err != nil {
+		return nil, err
+	}
+
+	return &spb.EncryptResponse{
+		Name:                    req.GetName(),
+		Ciphertext:              ciphertext,
+		CiphertextCrc32C:        wrapperspb.Int64(crc32c(ciphertext)),
+		VerifiedPlaintextCrc32C: req.GetPlaintextCrc32C() != nil,
+		ProtectionLevel:         f.ProtectionLevel,
+
+		VerifiedAdditionalAuthenticatedDataCrc32C: req.GetAdditionalAuthenticatedDataCrc32C() != nil,
+	}, nil
+}
+
+// Decrypt unwraps the ciphertext with the key named in the request.
+func (f *FakeKMS) Decrypt(ctx context.Context, req *spb.DecryptRequest, _ ...gax.CallOption) (*spb.DecryptResponse, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.DecryptErr != nil {
+		return nil, f.DecryptErr
+	}
+
+	if _, ok := f.AsymmetricKeys[cryptoKeyName(req.GetName())]; ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v is not a symmetric encryption key", req.GetName())
+	}
+
+	if req.GetCiphertextCrc32C() != nil && req.GetCiphertextCrc32C().GetValue() != crc32c(req.GetCiphertext()) {
+		return nil, fmt.Errorf("ciphertext checksum mismatch")
+	}
+
+	if req.GetAdditionalAuthenticatedDataCrc32C() != nil && req.GetAdditionalAuthenticatedDataCrc32C().GetValue() != crc32c(req.GetAdditionalAuthenticatedData()) {
+		return nil, fmt.Errorf("AAD checksum mismatch")
+	}
+
+	aead, err := keyAEAD(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.DecryptDeterministically(req.GetCiphertext(), req.GetAdditionalAuthenticatedData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %v: %v", req.GetName(), err)
+	}
+
+	return &spb.DecryptResponse{
+		Plaintext:       plaintext,
+		PlaintextCrc32C: wrapperspb.Int64(crc32c(plaintext)),
+		ProtectionLevel: f.ProtectionLevel,
+	}, nil
+}
+
+// asymmetricAlgorithm returns the algorithm of a fake asymmetric decryption
+// key, which uses RSA-OAEP with SHA-256.
+func asymmetricAlgorithm(key *rsa.PrivateKey) rpb.CryptoKeyVersion_CryptoKeyVersionAlgorithm {
+	switch key.N.BitLen() {
+	case 2048:
+		return rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256
+	case 3072:
+		return rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA256
+	case 4096:
+		return rpb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA256
+	default:
+		return rpb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED
+	}
+}
+
+// asymmetricKey returns the key of the asymmetric decryption CryptoKeyVersion
+// with the given name.
+func (f *FakeKMS) asymmetricKey(name string) (*rsa.PrivateKey, error) {
+	key, ok := f.AsymmetricKeys[cryptoKeyName(name)]
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v is not an asymmetric decryption key", name)
+	}
+
+	if name == cryptoKeyName(name) {
+		return nil, status.Errorf(codes.InvalidArgument, "%v is not a CryptoKeyVersion", name)
+	}
+
+	if state := f.versionState(name); state != rpb.CryptoKeyVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v is not enabled, current state is: %v", name, state)
+	}
+
+	return key, nil
+}
+
+// GetPublicKey returns the public key of the asymmetric decryption
+// CryptoKeyVersion named in the request.
+func (f *FakeKMS) GetPublicKey(ctx context.Context, req *spb.GetPublicKeyRequest, _ ...gax.CallOption) (*rpb.PublicKey, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+
+	key, err := f.asymmetricKey(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	return &rpb.PublicKey{
+		Name:            req.GetName(),
+		Pem:             keyPEM,
+		PemCrc32C:       wrapperspb.Int64(crc32c([]byte(keyPEM))),
+		Algorithm:       asymmetricAlgorithm(key),
+		ProtectionLevel: f.cryptoKeyVersion(req.GetName()).GetProtectionLevel(),
+	}, nil
+}
+
+// AsymmetricDecrypt decrypts the ciphertext with the asymmetric decryption
+// CryptoKeyVersion named in the request.
+func (f *FakeKMS) AsymmetricDecrypt(ctx context.Context, req *spb.AsymmetricDecryptRequest, _ ...gax.CallOption) (*spb.AsymmetricDecryptResponse, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.DecryptErr != nil {
+		return nil, f.DecryptErr
+	}
+
+	key, err := f.asymmetricKey(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetCiphertextCrc32C() != nil && req.GetCiphertextCrc32C().GetValue() != crc32c(req.GetCiphertext()) {
+		return nil, fmt.Errorf("ciphertext checksum mismatch")
+	}
+
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), nil, key, req.GetCiphertext(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %v: %v", req.GetName(), err)
+	}
+
+	return &spb.AsymmetricDecryptResponse{
+		Plaintext:                plaintext,
+		PlaintextCrc32C:          wrapperspb.Int64(crc32c(plaintext)),
+		VerifiedCiphertextCrc32C: req.GetCiphertextCrc32C() != nil,
+		ProtectionLevel:          f.cryptoKeyVersion(req.GetName()).GetProtectionLevel(),
+	}, nil
+}
+
+// Close is a no-op.
+func (f *FakeKMS) Close() error {
+	return nil
+}
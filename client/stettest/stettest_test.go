@@ -0,0 +1,178 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stettest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	rpb "cloud.google.com/go/kms/apiv1/kmspb"
+	spb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+)
+
+const testKeyName = "projects/test/locations/test/keyRings/test/cryptoKeys/test"
+
+func TestFakeKMSWrapAndUnwrap(t *testing.T) {
+	ctx := context.Background()
+	fake := &FakeKMS{}
+	share := []byte("I am a share.")
+
+	wrapped, err := cloudkms.WrapShare(ctx, fake, cloudkms.WrapOpts{Share: share, KeyName: testKeyName})
+	if err != nil {
+		t.Fatalf("WrapShare returned error: %v", err)
+	}
+
+	if bytes.Contains(wrapped, share) {
+		t.Errorf("WrapShare returned %v, which contains the plaintext share", wrapped)
+	}
+
+	// Wrapping is deterministic, including across fakes.
+	wrappedAgain, err := cloudkms.WrapShare(ctx, &FakeKMS{}, cloudkms.WrapOpts{Share: share, KeyName: testKeyName})
+	if err != nil {
+		t.Fatalf("WrapShare returned error: %v", err)
+	}
+
+	if !bytes.Equal(wrapped, wrappedAgain) {
+		t.Errorf("WrapShare is not deterministic: got %v and %v", wrapped, wrappedAgain)
+	}
+
+	unwrapped, err := cloudkms.UnwrapShare(ctx, fake, cloudkms.UnwrapOpts{Share: wrapped, KeyName: testKeyName})
+	if err != nil {
+		t.Fatalf("UnwrapShare returned error: %v", err)
+	}
+
+	if !bytes.Equal(unwrapped, share) {
+		t.Errorf("UnwrapShare = %v, want %v", unwrapped, share)
+	}
+
+	if _, err := cloudkms.UnwrapShare(ctx, fake, cloudkms.UnwrapOpts{Share: wrapped, KeyName: testKeyName + "-other"}); err == nil {
+		t.Errorf("UnwrapShare with a different key returned no error, want error")
+	}
+
+	if got := fake.Calls(); got != 3 {
+		t.Errorf("Calls() = %v, want 3", got)
+	}
+}
+
+func TestFakeKMSGetCryptoKey(t *testing.T) {
+	testCases := []struct {
+		name            string
+		protectionLevel rpb.ProtectionLevel
+		want            rpb.ProtectionLevel
+	}{
+		{
+			name: "Default",
+			want: rpb.ProtectionLevel_SOFTWARE,
+		},
+		{
+			name:            "HSM",
+			protectionLevel: rpb.ProtectionLevel_HSM,
+			want:            rpb.ProtectionLevel_HSM,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &FakeKMS{ProtectionLevel: tc.protectionLevel}
+
+			ck, err := fake.GetCryptoKey(context.Background(), &spb.GetCryptoKeyRequest{Name: testKeyName})
+			if err != nil {
+				t.Fatalf("GetCryptoKey returned error: %v", err)
+			}
+
+			if got := ck.GetPrimary().GetProtectionLevel(); got != tc.want {
+				t.Errorf("GetCryptoKey returned protection level %v, want %v", got, tc.want)
+			}
+
+			if got := ck.GetPrimary().GetState(); got != rpb.CryptoKeyVersion_ENABLED {
+				t.Errorf("GetCryptoKey returned state %v, want ENABLED", got)
+			}
+		})
+	}
+}
+
+func TestFakeKMSErrors(t *testing.T) {
+	ctx := context.Background()
+	wantErr := errors.New("injected error")
+
+	fake := &FakeKMS{GetCryptoKeyErr: wantErr, EncryptErr: wantErr, DecryptErr: wantErr}
+
+	if _, err := fake.GetCryptoKey(ctx, &spb.GetCryptoKeyRequest{Name: testKeyName}); !errors.Is(err, wantErr) {
+		t.Errorf("GetCryptoKey returned error %v, want %v", err, wantErr)
+	}
+
+	if _, err := fake.Encrypt(ctx, &spb.EncryptRequest{Name: testKeyName}); !errors.Is(err, wantErr) {
+		t.Errorf("Encrypt returned error %v, want %v", err, wantErr)
+	}
+
+	if _, err := fake.Decrypt(ctx, &spb.DecryptRequest{Name: testKeyName}); !errors.Is(err, wantErr) {
+		t.Errorf("Decrypt returned error %v, want %v", err, wantErr)
+	}
+}
+
+func TestFakeKMSVersionStates(t *testing.T) {
+	ctx := context.Background()
+	primary := testKeyName + "/cryptoKeyVersions/1"
+	pinned := testKeyName + "/cryptoKeyVersions/2"
+
+	fake := &FakeKMS{VersionStates: map[string]rpb.CryptoKeyVersion_CryptoKeyVersionState{
+		primary: rpb.CryptoKeyVersion_DISABLED,
+	}}
+
+	ck, err := fake.GetCryptoKey(ctx, &spb.GetCryptoKeyRequest{Name: testKeyName})
+	if err != nil {
+		t.Fatalf("GetCryptoKey returned error: %v", err)
+	}
+	if got := ck.GetPrimary().GetState(); got != rpb.CryptoKeyVersion_DISABLED {
+		t.Errorf("GetCryptoKey returned primary state %v, want DISABLED", got)
+	}
+
+	ver, err := fake.GetCryptoKeyVersion(ctx, &spb.GetCryptoKeyVersionRequest{Name: pinned})
+	if err != nil {
+		t.Fatalf("GetCryptoKeyVersion returned error: %v", err)
+	}
+	if got := ver.GetState(); got != rpb.CryptoKeyVersion_ENABLED {
+		t.Errorf("GetCryptoKeyVersion returned state %v, want ENABLED", got)
+	}
+
+	if _, err := fake.Encrypt(ctx, &spb.EncryptRequest{Name: testKeyName, Plaintext: []byte("data")}); err == nil {
+		t.Error("Encrypt with disabled primary version succeeded, want error")
+	}
+
+	// Data wrapped with any version unwraps with the CryptoKey.
+	resp, err := fake.Encrypt(ctx, &spb.EncryptRequest{Name: pinned, Plaintext: []byte("data")})
+	if err != nil {
+		t.Fatalf("Encrypt with enabled version returned error: %v", err)
+	}
+
+	if _, err := fake.Decrypt(ctx, &spb.DecryptRequest{Name: testKeyName, Ciphertext: resp.GetCiphertext()}); err != nil {
+		t.Errorf("Decrypt returned error: %v", err)
+	}
+}
+
+func TestFakeKMSLatency(t *testing.T) {
+	fake := &FakeKMS{Latency: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := fake.GetCryptoKey(ctx, &spb.GetCryptoKeyRequest{Name: testKeyName}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetCryptoKey returned error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -16,11 +16,13 @@
 package testutil
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"hash/crc32"
 	"os"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/kms/apiv1"
 	ekmpb "cloud.google.com/go/kms/apiv1/kmspb"
@@ -84,8 +86,8 @@ var (
 )
 
 var defaultKEKs map[kmsrpb.ProtectionLevel]*KEK = map[kmsrpb.ProtectionLevel]*KEK{
-	kmsrpb.ProtectionLevel_HSM:          SoftwareKEK,
-	kmsrpb.ProtectionLevel_SOFTWARE:     HSMKEK,
+	kmsrpb.ProtectionLevel_HSM:          HSMKEK,
+	kmsrpb.ProtectionLevel_SOFTWARE:     SoftwareKEK,
 	kmsrpb.ProtectionLevel_EXTERNAL:     ExternalKEK,
 	kmsrpb.ProtectionLevel_EXTERNAL_VPC: VPCKEK,
 }
@@ -122,15 +124,18 @@ func CreateEnabledCryptoKey(protectionLevel kmsrpb.ProtectionLevel, name string)
 			Name:            name + CryptoKeyVerSuffix,
 			State:           kmsrpb.CryptoKeyVersion_ENABLED,
 			ProtectionLevel: protectionLevel,
+			Algorithm:       kmsrpb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION,
 		},
 	}
 
 	// For external protection level, add ExternalProtectionLevelOptions and external URI.
 	if protectionLevel == kmsrpb.ProtectionLevel_EXTERNAL {
+		ck.Primary.Algorithm = kmsrpb.CryptoKeyVersion_EXTERNAL_SYMMETRIC_ENCRYPTION
 		ck.Primary.ExternalProtectionLevelOptions = &kmsrpb.ExternalProtectionLevelOptions{
 			ExternalKeyUri: ExternalEKMURI,
 		}
 	} else if protectionLevel == kmsrpb.ProtectionLevel_EXTERNAL_VPC {
+		ck.Primary.Algorithm = kmsrpb.CryptoKeyVersion_EXTERNAL_SYMMETRIC_ENCRYPTION
 		ck.CryptoKeyBackend = ExternalVPCBackend
 		ck.Primary.ExternalProtectionLevelOptions = &kmsrpb.ExternalProtectionLevelOptions{
 			EkmConnectionKeyPath: ExternalVPCKeyPath,
@@ -249,31 +254,90 @@ type FakeSecureSessionClient struct {
 	WrapErr       error
 	UnwrapErr     error
 	EndSessionErr error
+
+	// The identifier returned by SessionID.
+	ID string
+
+	// Latency added to each call, simulating a slow EKM. Calls return the
+	// context's error early if it is done first.
+	Latency time.Duration
+}
+
+// wait waits for the configured latency, or until the context is done.
+func (f *FakeSecureSessionClient) wait(ctx context.Context) error {
+	if f.Latency == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(f.Latency)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 // ConfidentialWrap simulates wrapping a share by appending a single byte ('E') to the end of the
 // plaintext to indicate external protection level.
-func (f *FakeSecureSessionClient) ConfidentialWrap(_ context.Context, _, _ string, plaintext []byte) ([]byte, error) {
+func (f *FakeSecureSessionClient) ConfidentialWrap(ctx context.Context, keyPath, resourceName string, plaintext []byte) ([]byte, error) {
+	return f.ConfidentialWrapWithAAD(ctx, keyPath, resourceName, plaintext, nil)
+}
+
+// ConfidentialWrapWithAAD is like ConfidentialWrap, but also appends the AAD
+// before the final byte, so that ConfidentialUnwrapWithAAD can check it.
+func (f *FakeSecureSessionClient) ConfidentialWrapWithAAD(ctx context.Context, _, _ string, plaintext, aad []byte) ([]byte, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+
 	// Return configured error if one was set
 	if f.WrapErr != nil {
 		return nil, f.WrapErr
 	}
 
-	return append(plaintext, byte('E')), nil
+	wrapped := append(append([]byte{}, plaintext...), aad...)
+	return append(wrapped, byte('E')), nil
 }
 
 // ConfidentialUnwrap removes the last byte of the wrapped share (mirroring ConfidentalWrap above).
-func (f *FakeSecureSessionClient) ConfidentialUnwrap(_ context.Context, _, _ string, wrappedBlob []byte) ([]byte, error) {
+func (f *FakeSecureSessionClient) ConfidentialUnwrap(ctx context.Context, keyPath, resourceName string, wrappedBlob []byte) ([]byte, error) {
+	return f.ConfidentialUnwrapWithAAD(ctx, keyPath, resourceName, wrappedBlob, nil)
+}
+
+// ConfidentialUnwrapWithAAD mirrors ConfidentialWrapWithAAD, returning an
+// error if the wrapped share does not end with the given AAD.
+func (f *FakeSecureSessionClient) ConfidentialUnwrapWithAAD(ctx context.Context, _, _ string, wrappedBlob, aad []byte) ([]byte, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+
 	// Return configured error if one was set
 	if f.UnwrapErr != nil {
 		return nil, f.UnwrapErr
 	}
 
-	return wrappedBlob[:len(wrappedBlob)-1], nil
+	wrapped := wrappedBlob[:len(wrappedBlob)-1]
+	if !bytes.HasSuffix(wrapped, aad) {
+		return nil, errors.New("AAD does not match wrapped share")
+	}
+
+	return wrapped[:len(wrapped)-len(aad)], nil
+}
+
+// SessionID returns the configured ID.
+func (f *FakeSecureSessionClient) SessionID() string {
+	return f.ID
 }
 
 // EndSession is necessary to implement the SecureSessionClient interface.
 func (f *FakeSecureSessionClient) EndSession(ctx context.Context) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+
 	// Return configured error if one was set
 	if f.EndSessionErr != nil {
 		return f.EndSessionErr
@@ -0,0 +1,90 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import "time"
+
+// TimingReport breaks down the time spent in each phase of an Encrypt or
+// Decrypt call, for performance diagnostics. See WithTimingReport.
+//
+// The phases do not overlap, but Total also includes work outside of them,
+// such as validating the configuration and signing the blob, so the phases
+// sum to slightly less than Total.
+type TimingReport struct {
+	// Time spent generating and splitting the DEK when encrypting, or
+	// recombining it from the unwrapped shares when decrypting.
+	DEK time.Duration
+	// Time spent wrapping or unwrapping all shares.
+	Shares time.Duration
+	// Time spent wrapping or unwrapping each share, indexed by KEK. Shares
+	// are processed concurrently, so these may sum to more than Shares.
+	PerShare []time.Duration
+	// Time spent streaming the data through the AEAD, including reading the
+	// input and writing the output.
+	AEAD time.Duration
+	// Time spent serializing and writing the metadata when encrypting, or
+	// reading and serializing it when decrypting.
+	Metadata time.Duration
+	// Total time of the call.
+	Total time.Duration
+}
+
+// timingPhase selects the duration of a phase in a TimingReport.
+type timingPhase func(*TimingReport) *time.Duration
+
+var (
+	dekPhase      timingPhase = func(t *TimingReport) *time.Duration { return &t.DEK }
+	sharesPhase   timingPhase = func(t *TimingReport) *time.Duration { return &t.Shares }
+	aeadPhase     timingPhase = func(t *TimingReport) *time.Duration { return &t.AEAD }
+	metadataPhase timingPhase = func(t *TimingReport) *time.Duration { return &t.Metadata }
+)
+
+// start begins timing `phase`, returning a function that adds the time
+// elapsed to it. Timings are only recorded if requested, so both do nothing
+// if `t` is nil.
+func (t *TimingReport) start(phase timingPhase) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		*phase(t) += time.Since(start)
+	}
+}
+
+// startShare is like start, but times the share wrapped or unwrapped with
+// the KEK at index `i` of t.PerShare.
+func (t *TimingReport) startShare(i int) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		t.PerShare[i] = time.Since(start)
+	}
+}
+
+// attachTimings records the total time of the call in the timing report, if
+// one was requested, and attaches it to `md`.
+func (o *callOptions) attachTimings(md *StetMetadata) *StetMetadata {
+	if o.timings != nil {
+		o.timings.Total = time.Since(o.callStart)
+		md.Timings = o.timings
+	}
+
+	return md
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+)
+
+// checkTimingReport checks that every phase and share of `timings` was
+// measured, and that the phases sum to roughly the total.
+func checkTimingReport(t *testing.T, timings *TimingReport, numShares int, latency time.Duration) {
+	t.Helper()
+
+	if timings == nil {
+		t.Fatal("StetMetadata.Timings is nil, want timing report")
+	}
+
+	if len(timings.PerShare) != numShares {
+		t.Fatalf("Timings.PerShare has %v entries, want %v", len(timings.PerShare), numShares)
+	}
+	for i, d := range timings.PerShare {
+		if d < latency {
+			t.Errorf("Timings.PerShare[%v] = %v, want at least the KMS latency of %v", i, d, latency)
+		}
+	}
+
+	if timings.Shares < latency {
+		t.Errorf("Timings.Shares = %v, want at least the KMS latency of %v", timings.Shares, latency)
+	}
+	if timings.AEAD <= 0 || timings.Metadata <= 0 {
+		t.Errorf("Timings = %+v, want AEAD and Metadata phases measured", timings)
+	}
+
+	sum := timings.DEK + timings.Shares + timings.AEAD + timings.Metadata
+	if sum > timings.Total || sum < timings.Total*9/10 {
+		t.Errorf("phases of Timings = %+v sum to %v, want roughly the total %v", timings, sum, timings.Total)
+	}
+}
+
+func TestTimingReport(t *testing.T) {
+	ctx := context.Background()
+	const latency = 20 * time.Millisecond
+	const numShares = 2
+
+	stetClient := &StetClient{KMSClient: &stettest.FakeKMS{Latency: latency}}
+	stetConfig := newFakeKMSConfig(numShares)
+	plaintext := make([]byte, 4*aeadSegmentSize)
+
+	var ciphertext bytes.Buffer
+	encMd, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, "", WithTimingReport())
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	t.Run("Encrypt", func(t *testing.T) {
+		checkTimingReport(t, encMd.Timings, numShares, latency)
+	})
+
+	t.Run("Decrypt", func(t *testing.T) {
+		var output bytes.Buffer
+		decMd, err := stetClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &output, stetConfig, WithTimingReport())
+		if err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		checkTimingReport(t, decMd.Timings, numShares, latency)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		var output bytes.Buffer
+		md, err := stetClient.Decrypt(ctx, bytes.NewReader(ciphertext.Bytes()), &output, stetConfig)
+		if err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		if md.Timings != nil {
+			t.Errorf("Decrypt returned Timings %+v without WithTimingReport, want nil", md.Timings)
+		}
+	})
+}
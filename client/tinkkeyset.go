@@ -0,0 +1,89 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/confidentialspace"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+// tinkKeysetAEAD decrypts the given Tink keyset with its Cloud KMS master key,
+// and returns its AEAD primitive. If `fips` is set, the keyset must only
+// contain FIPS-approved keys.
+func (c *StetClient) tinkKeysetAEAD(ctx context.Context, kmsClients *cloudkms.ClientFactory, tk *configpb.TinkKeyset, confSpaceConfig *confidentialspace.Config, mode configpb.CredentialMode, fips bool) (tink.AEAD, error) {
+	masterURI := tk.GetMasterKekUri()
+	if !strings.HasPrefix(masterURI, gcpKeyPrefix) {
+		return nil, fmt.Errorf("master KEK URI %q does not have the expected URI prefix, want %v", masterURI, gcpKeyPrefix)
+	}
+
+	// Configure CloudKMS Client, with Confidential Space credentials if applicable.
+	creds := ""
+	if confSpaceConfig != nil {
+		creds = confSpaceConfig.FindMatchingCredentials(masterURI, mode)
+	}
+
+	kmsClient, err := kmsClients.Client(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing Cloud KMS Client with credentials \"%v\": %v", creds, err)
+	}
+
+	var reader keyset.Reader
+	switch x := tk.GetKeyset().(type) {
+	case *configpb.TinkKeyset_KeysetFile:
+		keysetJSON, err := os.ReadFile(tk.GetKeysetFile())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Tink keyset file: %v", err)
+		}
+		reader = keyset.NewJSONReader(bytes.NewReader(keysetJSON))
+	case *configpb.TinkKeyset_EncryptedKeyset:
+		reader = keyset.NewBinaryReader(bytes.NewReader(tk.GetEncryptedKeyset()))
+	default:
+		return nil, fmt.Errorf("unsupported Tink keyset type: %v", x)
+	}
+
+	masterName, err := c.kmsResourceName(masterURI)
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey := cloudkms.NewAEAD(ctx, kmsClient, masterName)
+	handle, err := keyset.Read(reader, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt Tink keyset with %v: %v", masterURI, err)
+	}
+
+	if fips {
+		if err := checkFIPSKeyset(handle); err != nil {
+			return nil, err
+		}
+	}
+
+	primitive, err := aead.New(handle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AEAD from Tink keyset: %v", err)
+	}
+
+	return primitive, nil
+}
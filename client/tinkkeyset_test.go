@@ -0,0 +1,254 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/cloudkms"
+	"github.com/GoogleCloudPlatform/stet/client/shares"
+	"github.com/GoogleCloudPlatform/stet/client/testutil"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// newEncryptedTestKeyset creates a new AES-256-GCM Tink keyset, encrypted with
+// the test software KEK, and returns it in both binary and JSON form.
+func newEncryptedTestKeyset(t *testing.T) (binaryKeyset, jsonKeyset []byte) {
+	t.Helper()
+
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatalf("keyset.NewHandle returned error: %v", err)
+	}
+
+	masterKey := cloudkms.NewAEAD(context.Background(), &testutil.FakeKeyManagementClient{}, testutil.SoftwareKEK.Name)
+
+	var binaryBuf, jsonBuf bytes.Buffer
+	if err := handle.Write(keyset.NewBinaryWriter(&binaryBuf), masterKey); err != nil {
+		t.Fatalf("handle.Write returned error: %v", err)
+	}
+
+	if err := handle.Write(keyset.NewJSONWriter(&jsonBuf), masterKey); err != nil {
+		t.Fatalf("handle.Write returned error: %v", err)
+	}
+
+	return binaryBuf.Bytes(), jsonBuf.Bytes()
+}
+
+func TestWrapUnwrapShareTinkKeyset(t *testing.T) {
+	binaryKeyset, jsonKeyset := newEncryptedTestKeyset(t)
+
+	keysetFile := filepath.Join(t.TempDir(), "keyset.json")
+	if err := os.WriteFile(keysetFile, jsonKeyset, 0600); err != nil {
+		t.Fatalf("Failed to write keyset file: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		keyset *configpb.TinkKeyset
+	}{
+		{
+			name: "Inline encrypted keyset",
+			keyset: &configpb.TinkKeyset{
+				Keyset:       &configpb.TinkKeyset_EncryptedKeyset{EncryptedKeyset: binaryKeyset},
+				MasterKekUri: testutil.SoftwareKEK.URI(),
+			},
+		},
+		{
+			name: "Keyset file",
+			keyset: &configpb.TinkKeyset{
+				Keyset:       &configpb.TinkKeyset_KeysetFile{KeysetFile: keysetFile},
+				MasterKekUri: testutil.SoftwareKEK.URI(),
+			},
+		},
+	}
+
+	share := []byte("I am a share.")
+	ctx := context.Background()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stetClient := &StetClient{
+				testKMSClients: &cloudkms.ClientFactory{
+					CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+				},
+			}
+
+			opts := sharesOpts{
+				kekInfos: []*configpb.KekInfo{{
+					KekType: &configpb.KekInfo_TinkKeyset{TinkKeyset: tc.keyset},
+				}},
+			}
+
+			wrapped, uris, err := stetClient.wrapShares(ctx, [][]byte{share}, opts)
+			if err != nil {
+				t.Fatalf("wrapShares returned error: %v", err)
+			}
+
+			if len(uris) != 0 {
+				t.Errorf("wrapShares returned key URIs %v, want none", uris)
+			}
+
+			if !bytes.Equal(wrapped[0].GetHash(), shares.HashShare(share)) {
+				t.Errorf("wrapShares returned hash %v, want %v", wrapped[0].GetHash(), shares.HashShare(share))
+			}
+
+			if bytes.Contains(wrapped[0].GetShare(), share) {
+				t.Errorf("wrapShares returned wrapped share %v containing the plaintext share", wrapped[0].GetShare())
+			}
+
+			unwrapped, err := stetClient.unwrapAndValidateShares(ctx, wrapped, opts)
+			if err != nil {
+				t.Fatalf("unwrapAndValidateShares returned error: %v", err)
+			}
+
+			if len(unwrapped) != 1 || !bytes.Equal(unwrapped[0].Share, share) {
+				t.Errorf("unwrapAndValidateShares = %v, want share %v", unwrapped, share)
+			}
+		})
+	}
+}
+
+func TestWrapUnwrapShareTinkKeysetErrors(t *testing.T) {
+	binaryKeyset, _ := newEncryptedTestKeyset(t)
+	otherKeyset, _ := newEncryptedTestKeyset(t)
+	share := []byte("I am a share.")
+	ctx := context.Background()
+
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+	}
+
+	kekInfo := func(tk *configpb.TinkKeyset) []*configpb.KekInfo {
+		return []*configpb.KekInfo{{KekType: &configpb.KekInfo_TinkKeyset{TinkKeyset: tk}}}
+	}
+
+	wrapTestCases := []struct {
+		name   string
+		keyset *configpb.TinkKeyset
+	}{
+		{
+			name: "Invalid master KEK URI",
+			keyset: &configpb.TinkKeyset{
+				Keyset:       &configpb.TinkKeyset_EncryptedKeyset{EncryptedKeyset: binaryKeyset},
+				MasterKekUri: "I am an invalid URI!",
+			},
+		},
+		{
+			name: "Wrong master KEK",
+			keyset: &configpb.TinkKeyset{
+				Keyset:       &configpb.TinkKeyset_EncryptedKeyset{EncryptedKeyset: binaryKeyset},
+				MasterKekUri: testutil.HSMKEK.URI(),
+			},
+		},
+		{
+			name: "Missing keyset file",
+			keyset: &configpb.TinkKeyset{
+				Keyset:       &configpb.TinkKeyset_KeysetFile{KeysetFile: filepath.Join(t.TempDir(), "missing.json")},
+				MasterKekUri: testutil.SoftwareKEK.URI(),
+			},
+		},
+		{
+			name:   "No keyset",
+			keyset: &configpb.TinkKeyset{MasterKekUri: testutil.SoftwareKEK.URI()},
+		},
+	}
+
+	for _, tc := range wrapTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := stetClient.wrapShares(ctx, [][]byte{share}, sharesOpts{kekInfos: kekInfo(tc.keyset)}); err == nil {
+				t.Errorf("wrapShares returned no error, want error")
+			}
+		})
+	}
+
+	t.Run("Unwrap with a different keyset", func(t *testing.T) {
+		wrapped, _, err := stetClient.wrapShares(ctx, [][]byte{share}, sharesOpts{kekInfos: kekInfo(&configpb.TinkKeyset{
+			Keyset:       &configpb.TinkKeyset_EncryptedKeyset{EncryptedKeyset: binaryKeyset},
+			MasterKekUri: testutil.SoftwareKEK.URI(),
+		})})
+		if err != nil {
+			t.Fatalf("wrapShares returned error: %v", err)
+		}
+
+		unwrapped, err := stetClient.unwrapAndValidateShares(ctx, wrapped, sharesOpts{kekInfos: kekInfo(&configpb.TinkKeyset{
+			Keyset:       &configpb.TinkKeyset_EncryptedKeyset{EncryptedKeyset: otherKeyset},
+			MasterKekUri: testutil.SoftwareKEK.URI(),
+		})})
+		if err != nil {
+			t.Fatalf("unwrapAndValidateShares returned error: %v", err)
+		}
+
+		if len(unwrapped) != 0 {
+			t.Errorf("unwrapAndValidateShares returned %v shares, want 0", len(unwrapped))
+		}
+	})
+}
+
+func TestEncryptAndDecryptWithTinkKeyset(t *testing.T) {
+	binaryKeyset, _ := newEncryptedTestKeyset(t)
+
+	keyConfig := &configpb.KeyConfig{
+		KekInfos: []*configpb.KekInfo{
+			{
+				KekType: &configpb.KekInfo_TinkKeyset{TinkKeyset: &configpb.TinkKeyset{
+					Keyset:       &configpb.TinkKeyset_EncryptedKeyset{EncryptedKeyset: binaryKeyset},
+					MasterKekUri: testutil.SoftwareKEK.URI(),
+				}},
+			},
+			{
+				KekType: &configpb.KekInfo_KekUri{KekUri: testutil.HSMKEK.URI()},
+			},
+		},
+		DekAlgorithm:          configpb.DekAlgorithm_AES256_GCM,
+		KeySplittingAlgorithm: &configpb.KeyConfig_Shamir{Shamir: &configpb.ShamirConfig{Threshold: 2, Shares: 2}},
+	}
+
+	stetConfig := &configpb.StetConfig{
+		EncryptConfig: &configpb.EncryptConfig{KeyConfig: keyConfig},
+		DecryptConfig: &configpb.DecryptConfig{KeyConfigs: []*configpb.KeyConfig{keyConfig}},
+	}
+
+	ctx := context.Background()
+	stetClient := &StetClient{
+		testKMSClients: &cloudkms.ClientFactory{
+			CredsMap: map[string]cloudkms.Client{"": &testutil.FakeKeyManagementClient{}},
+		},
+	}
+
+	plaintext := []byte("This is data to be encrypted.")
+	var ciphertext bytes.Buffer
+	if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &ciphertext, stetConfig, ""); err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	var output bytes.Buffer
+	if _, err := stetClient.Decrypt(ctx, &ciphertext, &output, stetConfig); err != nil {
+		t.Fatalf("Decrypt returned error: %v", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), plaintext) {
+		t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+	}
+}
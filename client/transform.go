@@ -0,0 +1,108 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// ShareTransform is an additional, reversible transformation applied to each
+// wrapped share, such as a secondary envelope with an on-premises HSM, or an
+// audit tap that returns the share unchanged. See StetClient.ShareTransform.
+type ShareTransform interface {
+	// Name identifies the transform. It is recorded with each wrapped share
+	// the transform is applied to, and bound into the AAD, so that shares
+	// are only inverted by a transform of the same name.
+	Name() string
+
+	// Transform is applied to each wrapped share, and backup share, after it
+	// is wrapped with the given KEK.
+	Transform(ctx context.Context, kek *configpb.KekInfo, wrapped []byte) ([]byte, error)
+
+	// Inverse undoes Transform, and is applied to each wrapped share before
+	// it is unwrapped with the given KEK.
+	Inverse(ctx context.Context, kek *configpb.KekInfo, transformed []byte) ([]byte, error)
+}
+
+// transformShare applies the client's ShareTransform, if any, to the wrapped
+// share and its backup share in place, recording the transform's name.
+func (c *StetClient) transformShare(ctx context.Context, kek *configpb.KekInfo, wrapped *configpb.WrappedShare) error {
+	if c.ShareTransform == nil {
+		return nil
+	}
+
+	name := c.ShareTransform.Name()
+	if name == "" {
+		return fmt.Errorf("share transform has an empty name")
+	}
+
+	share, err := c.ShareTransform.Transform(ctx, kek, wrapped.GetShare())
+	if err != nil {
+		return fmt.Errorf("error applying share transform %q: %v", name, err)
+	}
+	wrapped.Share = share
+
+	if len(wrapped.GetBackupShare()) != 0 {
+		backup, err := c.ShareTransform.Transform(ctx, kek, wrapped.GetBackupShare())
+		if err != nil {
+			return fmt.Errorf("error applying share transform %q to backup share: %v", name, err)
+		}
+		wrapped.BackupShare = backup
+	}
+
+	wrapped.Transform = name
+	return nil
+}
+
+// inverseTransformShare returns a copy of the wrapped share with the
+// transform recorded in it inverted, or the share itself if it was not
+// transformed. Returns an error if the share was transformed by a transform
+// other than the client's ShareTransform.
+func (c *StetClient) inverseTransformShare(ctx context.Context, kek *configpb.KekInfo, wrapped *configpb.WrappedShare) (*configpb.WrappedShare, error) {
+	name := wrapped.GetTransform()
+	if name == "" {
+		return wrapped, nil
+	}
+
+	if c.ShareTransform == nil {
+		return nil, fmt.Errorf("share was wrapped with share transform %q, but no share transform is configured", name)
+	}
+
+	if c.ShareTransform.Name() != name {
+		return nil, fmt.Errorf("share was wrapped with share transform %q, but share transform %q is configured", name, c.ShareTransform.Name())
+	}
+
+	inverted := proto.Clone(wrapped).(*configpb.WrappedShare)
+	share, err := c.ShareTransform.Inverse(ctx, kek, wrapped.GetShare())
+	if err != nil {
+		return nil, fmt.Errorf("error inverting share transform %q: %v", name, err)
+	}
+	inverted.Share = share
+
+	if len(wrapped.GetBackupShare()) != 0 {
+		backup, err := c.ShareTransform.Inverse(ctx, kek, wrapped.GetBackupShare())
+		if err != nil {
+			return nil, fmt.Errorf("error inverting share transform %q on backup share: %v", name, err)
+		}
+		inverted.BackupShare = backup
+	}
+
+	inverted.Transform = ""
+	return inverted, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/stet/client/stettest"
+	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
+)
+
+// auditTransform is an identity ShareTransform that records the KEKs it is
+// called with.
+type auditTransform struct {
+	mu        sync.Mutex
+	wrapped   []string
+	unwrapped []string
+}
+
+func (a *auditTransform) Name() string { return "audit" }
+
+func (a *auditTransform) Transform(_ context.Context, kek *configpb.KekInfo, wrapped []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.wrapped = append(a.wrapped, kek.GetKekUri())
+	return wrapped, nil
+}
+
+func (a *auditTransform) Inverse(_ context.Context, kek *configpb.KekInfo, transformed []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unwrapped = append(a.unwrapped, kek.GetKekUri())
+	return transformed, nil
+}
+
+// xorTransform is a reversible ShareTransform that XORs each byte with a key.
+type xorTransform struct {
+	name string
+	key  byte
+}
+
+func (x *xorTransform) Name() string { return x.name }
+
+func (x *xorTransform) xor(in []byte) []byte {
+	out := make([]byte, len(in))
+	for i, b := range in {
+		out[i] = b ^ x.key
+	}
+	return out
+}
+
+func (x *xorTransform) Transform(_ context.Context, _ *configpb.KekInfo, wrapped []byte) ([]byte, error) {
+	return x.xor(wrapped), nil
+}
+
+func (x *xorTransform) Inverse(_ context.Context, _ *configpb.KekInfo, transformed []byte) ([]byte, error) {
+	return x.xor(transformed), nil
+}
+
+func TestShareTransform(t *testing.T) {
+	ctx := context.Background()
+	stetConfig := newFakeKMSConfig(2)
+	plaintext := []byte("This is data to be encrypted.")
+
+	encrypt := func(t *testing.T, transform ShareTransform) ([]byte, *configpb.Metadata) {
+		t.Helper()
+
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, ShareTransform: transform}
+		var blob bytes.Buffer
+		if _, err := stetClient.Encrypt(ctx, bytes.NewReader(plaintext), &blob, stetConfig, ""); err != nil {
+			t.Fatalf("Encrypt returned error: %v", err)
+		}
+
+		metadata, err := ReadMetadata(bytes.NewReader(blob.Bytes()))
+		if err != nil {
+			t.Fatalf("ReadMetadata returned error: %v", err)
+		}
+
+		return blob.Bytes(), metadata
+	}
+
+	decrypt := func(transform ShareTransform, blob []byte) error {
+		stetClient := &StetClient{KMSClient: &stettest.FakeKMS{}, ShareTransform: transform}
+		var output bytes.Buffer
+		if _, err := stetClient.Decrypt(ctx, bytes.NewReader(blob), &output, stetConfig); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(output.Bytes(), plaintext) {
+			t.Errorf("Decrypt returned plaintext %v, want %v", output.Bytes(), plaintext)
+		}
+		return nil
+	}
+
+	t.Run("Identity transform", func(t *testing.T) {
+		audit := &auditTransform{}
+		blob, metadata := encrypt(t, audit)
+
+		for i, share := range metadata.GetShares() {
+			if share.GetTransform() != "audit" {
+				t.Errorf("Share %v has transform %q, want %q", i, share.GetTransform(), "audit")
+			}
+		}
+
+		if err := decrypt(audit, blob); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		if len(audit.wrapped) != 2 || len(audit.unwrapped) != 2 {
+			t.Errorf("Transform called for %v wrapped and %v unwrapped shares, want 2 of each", len(audit.wrapped), len(audit.unwrapped))
+		}
+	})
+
+	t.Run("Reversible transform", func(t *testing.T) {
+		transform := &xorTransform{name: "xor", key: 0x5a}
+		blob, metadata := encrypt(t, transform)
+		_, plainMetadata := encrypt(t, nil)
+
+		if len(metadata.GetShares()[0].GetShare()) != len(plainMetadata.GetShares()[0].GetShare()) {
+			t.Errorf("Transformed share has %v bytes, want %v", len(metadata.GetShares()[0].GetShare()), len(plainMetadata.GetShares()[0].GetShare()))
+		}
+
+		if err := decrypt(transform, blob); err != nil {
+			t.Fatalf("Decrypt returned error: %v", err)
+		}
+
+		testcases := []struct {
+			name      string
+			transform ShareTransform
+		}{
+			{
+				name: "No transform",
+			},
+			{
+				name:      "Different name",
+				transform: &xorTransform{name: "other", key: 0x5a},
+			},
+			{
+				name:      "Different key",
+				transform: &xorTransform{name: "xor", key: 0x3c},
+			},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				if err := decrypt(tc.transform, blob); err == nil {
+					t.Error("Decrypt succeeded, want error")
+				}
+			})
+		}
+	})
+
+	t.Run("Untransformed blob", func(t *testing.T) {
+		blob, _ := encrypt(t, nil)
+		if err := decrypt(&xorTransform{name: "xor", key: 0x5a}, blob); err != nil {
+			t.Errorf("Decrypt with share transform of blob without one returned error: %v", err)
+		}
+	})
+}
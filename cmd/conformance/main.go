@@ -21,9 +21,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
 
 	"cloud.google.com/go/kms/apiv1"
@@ -47,6 +50,11 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
 const (
 	defaultKeyResourceName          = "myresource"
 	defaultProtectedKeyResourceName = "myprotectedresource"
@@ -55,6 +63,8 @@ const (
 var (
 	unprotectedKeyResourceName = flag.String("unprotected-resource-name", defaultKeyResourceName, "CloudKMS resource name of an external key not protected by CC attestation")
 	protectedKeyResourceName   = flag.String("protected-resource-name", defaultProtectedKeyResourceName, "CloudKMS resource name of an external key protected by CC attestation")
+	outputFormat               = flag.String("format", formatText, "Output format for test results: \"text\" for coloured human-readable output, or \"json\" for structured per-test results")
+	keyURIs                    = flag.String("key-uris", "", "Comma-separated list of external keys not protected by CC attestation to run every test case against, in place of --unprotected-resource-name. Each entry is either an EKM key URI or a CloudKMS resource name")
 )
 
 type externalKeyInfo struct {
@@ -71,8 +81,18 @@ var protectedKey *externalKeyInfo
 const recordBufferSize = 16384
 
 const (
-	recordHeaderHandshake      = 0x16
-	handshakeHeaderServerHello = 0x02
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+
+	// The handshake record payload size used to test that fragmented
+	// handshake messages are handled.
+	handshakeFragmentSize = 16
+)
+
+const (
+	recordHeaderHandshake       = 0x16
+	recordHeaderApplicationData = 0x17
+	handshakeHeaderServerHello  = 0x02
 )
 
 type ekmClient struct {
@@ -148,6 +168,71 @@ func newEKMClient(ctx context.Context, key *externalKeyInfo) ekmClient {
 // Returns an empty byte array.
 func emptyFn([]byte) []byte { return []byte{} }
 
+// Prepends an application data record to the given records, which is not
+// valid before the TLS handshake has completed.
+func injectApplicationData(r []byte) []byte {
+	payload := []byte("application data during handshake")
+	record := []byte{recordHeaderApplicationData, 0x03, 0x03, 0x00, byte(len(payload))}
+	record = append(record, payload...)
+	return append(record, r...)
+}
+
+// Splits every handshake record in the given records into records carrying
+// at most `handshakeFragmentSize` bytes each, as an EKM is permitted to do.
+// The resulting handshake messages are unchanged, so the TLS connection must
+// reassemble them.
+func fragmentHandshakeRecords(r []byte) []byte {
+	var out []byte
+	for len(r) >= recordHeaderLen {
+		length := int(binary.BigEndian.Uint16(r[3:5]))
+		if len(r) < recordHeaderLen+length {
+			break
+		}
+		record := r[:recordHeaderLen+length]
+		r = r[recordHeaderLen+length:]
+
+		if record[0] != recordHeaderHandshake {
+			out = append(out, record...)
+			continue
+		}
+
+		for fragment := record[recordHeaderLen:]; len(fragment) > 0; {
+			n := handshakeFragmentSize
+			if len(fragment) < n {
+				n = len(fragment)
+			}
+			out = append(out, record[:3]...)
+			out = binary.BigEndian.AppendUint16(out, uint16(n))
+			out = append(out, fragment[:n]...)
+			fragment = fragment[n:]
+		}
+	}
+	return append(out, r...)
+}
+
+// Returns the type of the first handshake message in the given records,
+// reassembling it from as many handshake records as needed.
+func firstHandshakeMessageType(r []byte) (byte, error) {
+	var handshake []byte
+	for len(r) >= recordHeaderLen {
+		length := int(binary.BigEndian.Uint16(r[3:5]))
+		if len(r) < recordHeaderLen+length {
+			return 0, fmt.Errorf("truncated TLS record")
+		}
+		if r[0] != recordHeaderHandshake {
+			break
+		}
+		handshake = append(handshake, r[recordHeaderLen:recordHeaderLen+length]...)
+		r = r[recordHeaderLen+length:]
+
+		if len(handshake) >= handshakeHeaderLen {
+			return handshake[0], nil
+		}
+	}
+
+	return 0, fmt.Errorf("no complete handshake message header received")
+}
+
 func invalidateJwtSignature(_ context.Context, token string) (string, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
@@ -163,23 +248,89 @@ func badAudience(ctx context.Context, token string) (string, error) {
 	return jwt.GenerateJWT(ctx, "https://dogs-in-the-office.com")
 }
 
-// Prints error message in red by default, yellow (with an additional suffix) if the test
-// is optional.
-func printError(testName string, err error, optional bool) {
+// testResult is the outcome of a single test case against a single key.
+type testResult struct {
+	KeyURI    string `json:"key_uri"`
+	Suite     string `json:"suite"`
+	Name      string `json:"name"`
+	ExpectErr bool   `json:"expect_error"`
+	GotErr    bool   `json:"got_error"`
+	Passed    bool   `json:"passed"`
+	Optional  bool   `json:"optional,omitempty"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// keyResults holds the results of the test cases run against a single key
+// URI.
+type keyResults struct {
+	uri            string
+	suite          string
+	passed         int
+	failed         int
+	optionalFailed int
+	tests          []testResult
+}
+
+// currentResults accumulates the results for the key currently under test.
+var currentResults *keyResults
+
+// Records the outcome of a test case and, for text output, prints it: in green
+// if it passed, otherwise in red by default, or yellow (with an additional
+// suffix) if the test is optional.
+func reportResult(testName string, expectErr bool, err error, optional bool) {
+	result := testResult{
+		KeyURI:    currentResults.uri,
+		Suite:     currentResults.suite,
+		Name:      testName,
+		ExpectErr: expectErr,
+		GotErr:    err != nil,
+		Passed:    expectErr == (err != nil),
+		Optional:  optional,
+	}
+	switch {
+	case err != nil:
+		result.Message = err.Error()
+	case !result.Passed:
+		result.Message = "missing error"
+	}
+
+	switch {
+	case result.Passed:
+		currentResults.passed++
+	case optional:
+		currentResults.optionalFailed++
+	default:
+		currentResults.failed++
+	}
+	currentResults.tests = append(currentResults.tests, result)
+
+	if *outputFormat != formatText {
+		return
+	}
+
 	optionalSuffix := " - NOTE: passing this test case is optional, but recommended"
+	switch {
+	case result.Passed:
+		colour.Printf(" - ^2%v^R\n", testName)
+	case optional:
+		colour.Printf(" - ^3%v^R (%v)%v\n", testName, result.Message, optionalSuffix)
+	default:
+		colour.Printf(" - ^1%v^R (%v)\n", testName, result.Message)
+	}
+}
 
-	if err != nil {
-		if optional {
-			colour.Printf(" - ^3%v^R (%v)%v\n", testName, err.Error(), optionalSuffix)
-		} else {
-			colour.Printf(" - ^1%v^R (%v)\n", testName, err.Error())
-		}
-	} else {
-		if optional {
-			colour.Printf(" - ^3%v^R (missing error)%v\n", testName, optionalSuffix)
-		} else {
-			colour.Printf(" - ^1%v^R (missing error)\n", testName)
-		}
+// Records a test case that was not run and, for text output, prints it.
+func reportSkipped(testName string) {
+	currentResults.tests = append(currentResults.tests, testResult{
+		KeyURI:  currentResults.uri,
+		Suite:   currentResults.suite,
+		Name:    testName,
+		Skipped: true,
+	})
+
+	if *outputFormat == formatText {
+		colour.Printf(" - ^5%v [skipped]^R\n", testName)
 	}
 }
 
@@ -225,7 +376,7 @@ func runBeginSessionTestCase(ctx context.Context, t beginSessionTest) error {
 	}
 
 	records = resp.GetTlsRecords()
-	if len(records) < 6 {
+	if len(records) < recordHeaderLen {
 		return fmt.Errorf("length of record (%d) too short to be a Server Hello", len(records))
 	}
 
@@ -233,7 +384,14 @@ func runBeginSessionTestCase(ctx context.Context, t beginSessionTest) error {
 		return fmt.Errorf("handshake record not received")
 	}
 
-	if records[5] != handshakeHeaderServerHello {
+	// The server may fragment the ServerHello across several records, so
+	// reassemble the handshake messages before inspecting them.
+	msgType, err := firstHandshakeMessageType(records)
+	if err != nil {
+		return err
+	}
+
+	if msgType != handshakeHeaderServerHello {
 		return fmt.Errorf("response is not Server Hello")
 	}
 
@@ -247,9 +405,12 @@ type handshakeTest struct {
 	testName         string
 	expectErr        bool
 	mutateTLSRecords func(r []byte) []byte
-	mutateSessionKey func(s []byte) []byte
-	mutateJWT        func(context.Context, string) (string, error)
-	optional         bool
+	// Applied to the server's BeginSession records before they are passed
+	// to the client TLS connection.
+	mutateServerRecords func(r []byte) []byte
+	mutateSessionKey    func(s []byte) []byte
+	mutateJWT           func(context.Context, string) (string, error)
+	optional            bool
 }
 
 func runHandshakeTestCase(ctx context.Context, t handshakeTest) error {
@@ -269,7 +430,11 @@ func runHandshakeTestCase(ctx context.Context, t handshakeTest) error {
 		sessionContext = t.mutateSessionKey(sessionContext)
 	}
 
-	c.shim.QueueReceiveBuf(resp.GetTlsRecords())
+	serverRecords := resp.GetTlsRecords()
+	if t.mutateServerRecords != nil {
+		serverRecords = t.mutateServerRecords(serverRecords)
+	}
+	c.shim.QueueReceiveBuf(serverRecords)
 
 	records := c.shim.DrainSendBuf()
 	if t.mutateTLSRecords != nil {
@@ -1036,12 +1201,7 @@ func runBeginSessionTests(ctx context.Context) {
 
 	for _, testCase := range beginSessionTestCases {
 		err := runBeginSessionTestCase(ctx, testCase)
-		testPassed := testCase.expectErr == (err != nil)
-		if testPassed {
-			colour.Printf(" - ^2%v^R\n", testCase.testName)
-		} else {
-			printError(testCase.testName, err, testCase.optional)
-		}
+		reportResult(testCase.testName, testCase.expectErr, err, testCase.optional)
 	}
 }
 
@@ -1056,6 +1216,16 @@ func runHandshakeTests(ctx context.Context) {
 			expectErr:        true,
 			mutateTLSRecords: emptyFn,
 		},
+		{
+			testName:         "Application data record during handshake",
+			expectErr:        true,
+			mutateTLSRecords: injectApplicationData,
+		},
+		{
+			testName:            "Server Hello fragmented across records",
+			expectErr:           false,
+			mutateServerRecords: fragmentHandshakeRecords,
+		},
 		{
 			testName:         "Invalid session key",
 			expectErr:        true,
@@ -1077,12 +1247,7 @@ func runHandshakeTests(ctx context.Context) {
 
 	for _, testCase := range handshakeTestCases {
 		err := runHandshakeTestCase(ctx, testCase)
-		testPassed := testCase.expectErr == (err != nil)
-		if testPassed {
-			colour.Printf(" - ^2%v^R\n", testCase.testName)
-		} else {
-			printError(testCase.testName, err, testCase.optional)
-		}
+		reportResult(testCase.testName, testCase.expectErr, err, testCase.optional)
 	}
 }
 
@@ -1225,13 +1390,7 @@ func runNegotiateAttestationTests(ctx context.Context) {
 			}
 		}
 
-		testPassed := testCase.expectErr == (err != nil)
-
-		if testPassed {
-			colour.Printf(" - ^2%v^R\n", testCase.testName)
-		} else {
-			printError(testCase.testName, err, testCase.optional)
-		}
+		reportResult(testCase.testName, testCase.expectErr, err, testCase.optional)
 	}
 }
 
@@ -1295,23 +1454,19 @@ func runFinalizeTests(ctx context.Context) {
 	canAttest := err == nil
 
 	if !canAttest {
-		colour.Println("^5Note: Skipping test cases that require generating attestations.^R")
+		if *outputFormat == formatText {
+			colour.Println("^5Note: Skipping test cases that require generating attestations.^R")
+		}
 	}
 
 	for _, testCase := range finalizeTestCases {
 		if testCase.fullAttestation && !canAttest {
-			colour.Printf(" - ^5%v [skipped]^R\n", testCase.testName)
+			reportSkipped(testCase.testName)
 			continue
 		}
 
 		err := runFinalizeTestCase(ctx, testCase)
-		testPassed := testCase.expectErr == (err != nil)
-
-		if testPassed {
-			colour.Printf(" - ^2%v^R\n", testCase.testName)
-		} else {
-			printError(testCase.testName, err, testCase.optional)
-		}
+		reportResult(testCase.testName, testCase.expectErr, err, testCase.optional)
 	}
 }
 
@@ -1347,12 +1502,7 @@ func runEndSessionTests(ctx context.Context) {
 
 	for _, testCase := range endSessionTestCases {
 		err := runEndSessionTestCase(ctx, testCase)
-		testPassed := testCase.expectErr == (err != nil)
-		if testPassed {
-			colour.Printf(" - ^2%v^R\n", testCase.testName)
-		} else {
-			printError(testCase.testName, err, testCase.optional)
-		}
+		reportResult(testCase.testName, testCase.expectErr, err, testCase.optional)
 	}
 }
 
@@ -1415,12 +1565,7 @@ func runConfidentialWrapTests(ctx context.Context) {
 
 	for _, testCase := range confidentialWrapTestCases {
 		err := runConfidentialWrapTestCase(ctx, testCase)
-		testPassed := testCase.expectErr == (err != nil)
-		if testPassed {
-			colour.Printf(" - ^2%v^R\n", testCase.testName)
-		} else {
-			printError(testCase.testName, err, false)
-		}
+		reportResult(testCase.testName, testCase.expectErr, err, false)
 	}
 }
 
@@ -1483,12 +1628,7 @@ func runConfidentialUnwrapTests(ctx context.Context) {
 
 	for _, testCase := range confidentialUnwrapTestCases {
 		err := runConfidentialUnwrapTestCase(ctx, testCase)
-		testPassed := testCase.expectErr == (err != nil)
-		if testPassed {
-			colour.Printf(" - ^2%v^R\n", testCase.testName)
-		} else {
-			printError(testCase.testName, err, false)
-		}
+		reportResult(testCase.testName, testCase.expectErr, err, false)
 	}
 }
 
@@ -1565,40 +1705,164 @@ func configureExternalKeyInfo(ctx context.Context) error {
 	return nil
 }
 
-func main() {
-	flag.Parse()
-	ctx := context.Background()
+// unprotectedKeys returns the keys to run the test suites against. If
+// --key-uris is unset, this is the single key configured by
+// configureExternalKeyInfo.
+func unprotectedKeys(ctx context.Context) ([]*externalKeyInfo, error) {
+	if *keyURIs == "" {
+		return []*externalKeyInfo{unprotectedKey}, nil
+	}
 
-	if err := configureExternalKeyInfo(ctx); err != nil {
-		glog.Fatalf("Failed to configure key URIs: %v", err)
+	var keys []*externalKeyInfo
+	for _, entry := range strings.Split(*keyURIs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(entry, "projects/") {
+			keys = append(keys, &externalKeyInfo{uri: entry})
+			continue
+		}
+
+		key, err := getKeyInfo(ctx, entry)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting KeyURI for %v: %v", entry, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("--key-uris does not contain any keys")
+	}
+
+	return keys, nil
+}
+
+// Starts a new test suite, printing its name for text output.
+func startSuite(name string) {
+	if *outputFormat == formatText {
+		if currentResults.suite != "" {
+			fmt.Println()
+		}
+		fmt.Printf("Running %v tests...\n", name)
 	}
 
+	currentResults.suite = name
+}
+
+// runAllTests runs every test suite against the key in unprotectedKey.
+func runAllTests(ctx context.Context) {
 	// Define and run BeginSession tests.
-	fmt.Println("Running BeginSession tests...")
+	startSuite("BeginSession")
 	runBeginSessionTests(ctx)
 
 	// Define and run Handshake tests.
-	fmt.Println("\nRunning Handshake tests...")
+	startSuite("Handshake")
 	runHandshakeTests(ctx)
 
 	// Define and run NegotiateAttestation tests.
-	fmt.Println("\nRunning NegotiateAttestation tests...")
+	startSuite("NegotiateAttestation")
 	runNegotiateAttestationTests(ctx)
 
 	// Define and run Finalize tests.
-	fmt.Println("\nRunning Finalize tests...")
+	startSuite("Finalize")
 	runFinalizeTests(ctx)
 
 	// Define and run EndSession tests.
-	fmt.Println("\nRunning EndSession tests...")
+	startSuite("EndSession")
 	runEndSessionTests(ctx)
 
 	// Define and run ConfidentialWrap tests.
-	fmt.Println("\nRunning ConfidentialWrap tests...")
+	startSuite("ConfidentialWrap")
 	runConfidentialWrapTests(ctx)
 
 	// Define and run ConfidentialUnwrap tests.
-	fmt.Println("\nRunning ConfidentialUnwrap tests...")
+	startSuite("ConfidentialUnwrap")
 	runConfidentialUnwrapTests(ctx)
+}
+
+// Prints the number of passing and failing test cases for each key.
+func printSummary(results []*keyResults) {
+	fmt.Println("\nSummary:")
+	for _, r := range results {
+		switch {
+		case r.failed > 0:
+			colour.Printf(" - ^1%v^R: %v passed, %v failed, %v optional failed\n", r.uri, r.passed, r.failed, r.optionalFailed)
+		case r.optionalFailed > 0:
+			colour.Printf(" - ^3%v^R: %v passed, %v optional failed\n", r.uri, r.passed, r.optionalFailed)
+		default:
+			colour.Printf(" - ^2%v^R: %v passed\n", r.uri, r.passed)
+		}
+	}
+}
+
+// Writes the results of every test case as a single JSON document.
+func printJSON(results []*keyResults, passed bool) error {
+	report := struct {
+		Passed bool         `json:"passed"`
+		Tests  []testResult `json:"tests"`
+	}{Passed: passed, Tests: []testResult{}}
 
+	for _, r := range results {
+		report.Tests = append(report.Tests, r.tests...)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func main() {
+	flag.Parse()
+	ctx := context.Background()
+
+	if *outputFormat != formatText && *outputFormat != formatJSON {
+		glog.Fatalf("Unsupported --format %q, want %q or %q", *outputFormat, formatText, formatJSON)
+	}
+
+	if err := configureExternalKeyInfo(ctx); err != nil {
+		glog.Fatalf("Failed to configure key URIs: %v", err)
+	}
+
+	keys, err := unprotectedKeys(ctx)
+	if err != nil {
+		glog.Fatalf("Failed to configure key URIs: %v", err)
+	}
+
+	var results []*keyResults
+	for i, key := range keys {
+		if *outputFormat == formatText {
+			if i > 0 {
+				fmt.Println()
+			}
+			colour.Printf("^5Running tests against %v^R\n\n", key.uri)
+		}
+
+		unprotectedKey = key
+		currentResults = &keyResults{uri: key.uri}
+		results = append(results, currentResults)
+
+		runAllTests(ctx)
+	}
+
+	// Optional test cases are reported, but do not fail the run.
+	passed := true
+	for _, r := range results {
+		if r.failed > 0 {
+			passed = false
+		}
+	}
+
+	if *outputFormat == formatJSON {
+		if err := printJSON(results, passed); err != nil {
+			glog.Fatalf("Failed to write JSON results: %v", err)
+		}
+	} else {
+		printSummary(results)
+	}
+
+	if !passed {
+		os.Exit(1)
+	}
 }
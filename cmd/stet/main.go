@@ -28,6 +28,7 @@ import (
 
 	"flag"
 	"github.com/GoogleCloudPlatform/stet/client"
+	"github.com/GoogleCloudPlatform/stet/client/confidentialspace"
 	configpb "github.com/GoogleCloudPlatform/stet/proto/config_go_proto"
 	glog "github.com/golang/glog"
 	"github.com/google/subcommands"
@@ -115,6 +116,14 @@ type encryptCmd struct {
 	configFile         string
 	blobID             string
 	insecureSkipVerify bool
+	attestationToken   bool
+	provenance         bool
+	keyCommitment      bool
+	maxMetadataSize    int
+	importedKEKs       bool
+	formatVersion      int
+	shareContext       string
+	verifyWrap         bool
 	quiet              bool
 }
 
@@ -160,6 +169,14 @@ func (e *encryptCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&e.configFile, "config-file", configFilePath, "Path to a StetConfig YAML file. Optional.")
 	f.StringVar(&e.blobID, "blob-id", "", "The blob ID to assign to the encrypted blob. Optional.")
 	f.BoolVar(&e.insecureSkipVerify, "insecure-skip-verify", false, "Disable certificate check for inner TLS session.")
+	f.BoolVar(&e.provenance, "provenance", false, "Record the encryption time and STET version in the blob metadata.")
+	f.BoolVar(&e.keyCommitment, "key-commitment", false, "Store a commitment to the data encryption key in the blob metadata, so that decryption reports a wrongly reconstructed key.")
+	f.IntVar(&e.maxMetadataSize, "max-metadata-size", 0, "Fail if the serialized blob metadata would exceed this many bytes. Zero means no limit.")
+	f.BoolVar(&e.importedKEKs, "imported-keks", false, "Require Cloud KMS KEKs to be backed by imported key material.")
+	f.IntVar(&e.formatVersion, "format-version", 0, "The blob format version to write, for compatibility with older versions of STET. Zero means the oldest version supporting the requested features.")
+	f.StringVar(&e.shareContext, "share-context", "", "An encryption context to bind Cloud KMS and external EKM wrapped shares to. The same context must be given to decrypt. Optional.")
+	f.BoolVar(&e.verifyWrap, "verify-wrap", false, "Unwrap the shares after wrapping them, and fail if they do not reconstruct the data encryption key. Doubles the calls to Cloud KMS and external EKMs.")
+	f.BoolVar(&e.attestationToken, "confidential-space-attestation-token", false, "Authenticate to external EKMs with a Confidential Space attestation token. Only works in a Confidential Space workload.")
 	f.BoolVar(&e.quiet, "quiet", false, "Suppress logging output.")
 }
 
@@ -230,8 +247,39 @@ func (e *encryptCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...any) sub
 		InsecureSkipVerify: e.insecureSkipVerify,
 		Version:            version,
 	}
+	if e.attestationToken {
+		c.EKMTokenSource = confidentialspace.AttestationTokenSource()
+	}
+	defer c.Close()
 
-	md, err := c.Encrypt(ctx, inFile, outFile, stetConfig, e.blobID)
+	var opts []client.CallOption
+	if e.provenance {
+		opts = append(opts, client.WithProvenance())
+	}
+	if e.keyCommitment {
+		opts = append(opts, client.WithKeyCommitment())
+	}
+	if e.maxMetadataSize > 0 {
+		opts = append(opts, client.WithMaxMetadataSize(e.maxMetadataSize))
+	}
+	if e.importedKEKs {
+		opts = append(opts, client.WithImportedKEKs())
+	}
+	if e.formatVersion < 0 || e.formatVersion > int(client.LatestFormatVersion) {
+		glog.Errorf("Invalid format version %v, want between 1 and %v", e.formatVersion, client.LatestFormatVersion)
+		return subcommands.ExitFailure
+	}
+	if e.formatVersion > 0 {
+		opts = append(opts, client.WithFormatVersion(uint8(e.formatVersion)))
+	}
+	if e.shareContext != "" {
+		opts = append(opts, client.WithShareContext([]byte(e.shareContext)))
+	}
+	if e.verifyWrap {
+		opts = append(opts, client.WithVerifyWrap())
+	}
+
+	md, err := c.Encrypt(ctx, inFile, outFile, stetConfig, e.blobID, opts...)
 	if err != nil {
 		glog.Errorf("Failed to encrypt plaintext: %v", err.Error())
 		return subcommands.ExitFailure
@@ -267,6 +315,11 @@ type decryptCmd struct {
 	configFile         string
 	blobID             string
 	insecureSkipVerify bool
+	attestationToken   bool
+	blobKeyConfig      bool
+	importedKEKs       bool
+	rsaKeyFallback     bool
+	shareContext       string
 	quiet              bool
 }
 
@@ -326,6 +379,11 @@ func (d *decryptCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&d.configFile, "config-file", configFilePath, "Path to a StetConfig YAML file. Optional.")
 	f.StringVar(&d.blobID, "blob-id", "", "The blob ID to validate the decryption against. Optional.")
 	f.BoolVar(&d.insecureSkipVerify, "insecure-skip-verify", false, "Disable certificate check for inner TLS session.")
+	f.BoolVar(&d.attestationToken, "confidential-space-attestation-token", false, "Authenticate to external EKMs with a Confidential Space attestation token. Only works in a Confidential Space workload.")
+	f.BoolVar(&d.blobKeyConfig, "use-blob-key-config", false, "Decrypt using the KeyConfig stored in the blob, without requiring a matching DecryptConfig. Only use for blobs from trusted sources.")
+	f.BoolVar(&d.importedKEKs, "imported-keks", false, "Require Cloud KMS KEKs to be backed by imported key material.")
+	f.BoolVar(&d.rsaKeyFallback, "rsa-key-fallback", false, "Try every RSA private key for shares whose fingerprint matches none of them.")
+	f.StringVar(&d.shareContext, "share-context", "", "The encryption context the blob's shares were bound to when encrypting. Optional.")
 	f.BoolVar(&d.quiet, "quiet", false, "Suppress logging output.")
 }
 
@@ -348,7 +406,7 @@ func (d *decryptCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...any) sub
 		return subcommands.ExitFailure
 	}
 
-	if stetConfig.GetDecryptConfig() == nil {
+	if stetConfig.GetDecryptConfig() == nil && !d.blobKeyConfig {
 		glog.Errorf("No DecryptConfig stanza found in config file")
 		return subcommands.ExitFailure
 	}
@@ -395,8 +453,26 @@ func (d *decryptCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...any) sub
 		InsecureSkipVerify: d.insecureSkipVerify,
 		Version:            version,
 	}
+	if d.attestationToken {
+		c.EKMTokenSource = confidentialspace.AttestationTokenSource()
+	}
+	defer c.Close()
+
+	var opts []client.CallOption
+	if d.blobKeyConfig {
+		opts = append(opts, client.WithBlobKeyConfig())
+	}
+	if d.importedKEKs {
+		opts = append(opts, client.WithImportedKEKs())
+	}
+	if d.rsaKeyFallback {
+		opts = append(opts, client.WithRSAKeyFallback())
+	}
+	if d.shareContext != "" {
+		opts = append(opts, client.WithShareContext([]byte(d.shareContext)))
+	}
 
-	md, err := c.Decrypt(ctx, inFile, outFile, stetConfig)
+	md, err := c.Decrypt(ctx, inFile, outFile, stetConfig, opts...)
 	if err != nil {
 		glog.Errorf("Failed to decrypt ciphertext: %v", err.Error())
 		return subcommands.ExitFailure
@@ -29,6 +29,18 @@ var AllowableCipherSuites = []uint16{
 	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
 }
 
+// SafeCipherSuites is the set of TLS 1.2 cipher suites that callers may
+// choose from when overriding AllowableCipherSuites for the inner session.
+// All of them use ECDHE key exchange and an AEAD cipher.
+var SafeCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
 // AttestationPrefix is the protocol-defined prefix for finalizing attestations.
 const AttestationPrefix = "TLSAttestationV1"
 
@@ -18,6 +18,7 @@ package transportshim
 
 import (
 	"net"
+	"sync"
 	"time"
 )
 
@@ -40,6 +41,8 @@ const receiveBufLen = 1024 * 1024
 type TransportShim struct {
 	sendBuf    chan []byte
 	receiveBuf chan byte
+	closed     chan struct{}
+	closeOnce  sync.Once
 }
 
 // NewTransportShim initializes and returns the transport shim.
@@ -47,6 +50,7 @@ func NewTransportShim() ShimInterface {
 	t := &TransportShim{}
 	t.sendBuf = make(chan []byte, sendBufLen)
 	t.receiveBuf = make(chan byte, receiveBufLen)
+	t.closed = make(chan struct{})
 	return t
 }
 
@@ -62,8 +66,13 @@ func (shim *TransportShim) Read(b []byte) (n int, err error) {
 		return 0, nil
 	}
 
-	// Block until we can read at least one byte, as per https://pkg.go.dev/io#Reader.
-	b[0] = <-shim.receiveBuf
+	// Block until we can read at least one byte, as per https://pkg.go.dev/io#Reader,
+	// or the shim is closed.
+	select {
+	case b[0] = <-shim.receiveBuf:
+	case <-shim.closed:
+		return 0, net.ErrClosed
+	}
 
 	// Read as many remaining bytes from `receiveBuf` as available, stopping if
 	// we have read len(b) bytes, noting that we are starting at the 2nd byte.
@@ -80,10 +89,15 @@ func (shim *TransportShim) Read(b []byte) (n int, err error) {
 
 // DrainSendBuf returns records from `sendBuf` to be sent to the counterparty
 // (over some transport, i.e., gRPC). Will block until Write is invoked with
-// data to be sent to the counterparty.
+// data to be sent to the counterparty, or return nil if the shim is closed.
 func (shim *TransportShim) DrainSendBuf() []byte {
 	// Block until at least one slice of bytes is available in the sendBuf channel.
-	ret := <-shim.sendBuf
+	var ret []byte
+	select {
+	case ret = <-shim.sendBuf:
+	case <-shim.closed:
+		return nil
+	}
 
 	// Then, exhaust the remainder of the channel.
 	for {
@@ -97,15 +111,26 @@ func (shim *TransportShim) DrainSendBuf() []byte {
 }
 
 func (shim *TransportShim) Write(b []byte) (n int, err error) {
+	select {
+	case <-shim.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
 	buf := make([]byte, len(b))
 	copy(buf, b)
 	shim.sendBuf <- buf
 	return len(buf), nil
 }
 
-// Close not implemented
+// Close unblocks any pending Read or DrainSendBuf calls, and causes later
+// Read and Write calls to return net.ErrClosed. It is safe to call more than
+// once.
 func (shim *TransportShim) Close() error {
-	panic("Close not implemented")
+	shim.closeOnce.Do(func() {
+		close(shim.closed)
+	})
+	return nil
 }
 
 // LocalAddr not implemented
@@ -16,7 +16,9 @@ package transportshim
 
 import (
 	"bytes"
+	"errors"
 	"math/rand"
+	"net"
 	"testing"
 )
 
@@ -120,3 +122,34 @@ func TestShimLargeReceive(t *testing.T) {
 		t.Fatalf("Queued data did not match received data: got %v, want %v", got, want)
 	}
 }
+
+func TestShimClose(t *testing.T) {
+	shim := NewTransportShim()
+
+	// Close should unblock a pending Read.
+	readErr := make(chan error)
+	go func() {
+		_, err := shim.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	if err := shim.Close(); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+
+	if err := <-readErr; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read() after Close() returned error %v, want %v", err, net.ErrClosed)
+	}
+
+	if _, err := shim.Write([]byte("test")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() after Close() returned error %v, want %v", err, net.ErrClosed)
+	}
+
+	if got := shim.DrainSendBuf(); got != nil {
+		t.Errorf("DrainSendBuf() after Close() = %v, want nil", got)
+	}
+
+	if err := shim.Close(); err != nil {
+		t.Errorf("Second Close() returned error: %v", err)
+	}
+}